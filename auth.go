@@ -16,9 +16,13 @@ package kvgo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/hooto/hauth/go/hauth/v1"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
@@ -50,10 +54,142 @@ func newAppCredential(key *hauth.AccessKey) credentials.PerRPCCredentials {
 	return hauth.NewGrpcAppCredential(key)
 }
 
-func appAuthParse(ctx context.Context, keyMgr *hauth.AccessKeyManager) (*hauth.AppValidator, error) {
-	return hauth.GrpcAppValidator(ctx, keyMgr)
+// authRole returns the default role of the name.
+func authRole(name string) *hauth.Role {
+	for _, v := range defaultRoles {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// appValidator allows the calls by the permissions of the caller, of an
+// access key (*hauth.AppValidator), or of a JWT or a signed request
+// (*roleValidator).
+type appValidator interface {
+	SignValid(b []byte) error
+	Allow(args ...interface{}) error
+}
+
+// appAuthParse returns the validator of the JWT bearer token of the call if
+// Server.Jwt is setup, of the signed request, or else of the access key,
+// the address of the call is checked by the firewall rule of the identity.
+func (cn *Conn) appAuthParse(ctx context.Context) (appValidator, error) {
+
+	var av appValidator
+
+	if token := jwtIncoming(ctx); cn.jwt != nil && token != "" {
+		av2, err := cn.jwt.validate(token)
+		if err != nil {
+			return nil, err
+		}
+		av = av2
+	} else if sign := reqSignIncoming(ctx); cn.reqSign != nil && sign != "" {
+		key, err := cn.reqSign.validate(ctx, sign, cn.keyMgr)
+		if err != nil {
+			return nil, err
+		}
+		av = reqSignValidator(key)
+	} else {
+		if cn.opts.Server.RequestSign.Required {
+			return nil, errors.New("signed request required")
+		}
+		av2, err := hauth.GrpcAppValidator(ctx, cn.keyMgr)
+		if err != nil {
+			return nil, err
+		}
+		av = av2
+	}
+
+	if err := cn.firewall.allowIdentity(ctx, appIdentity(av)); err != nil {
+		return nil, err
+	}
+
+	return av, nil
+}
+
+// jwtIncoming returns the token of the "authorization: Bearer {jwt}"
+// metadata of the call.
+func jwtIncoming(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("authorization") {
+			if strings.HasPrefix(v, "Bearer ") && strings.Count(v, ".") == 2 {
+				return strings.TrimSpace(v[7:])
+			}
+		}
+	}
+	return ""
+}
+
+// appAuthValid returns the validator of the internal calls of the nodes,
+// of the signed request or else of the access key, the address of the call
+// is checked by the firewall rule of the identity.
+func (cn *Conn) appAuthValid(ctx context.Context) (appValidator, error) {
+	if sign := reqSignIncoming(ctx); cn.reqSign != nil && sign != "" {
+		key, err := cn.reqSign.validate(ctx, sign, cn.keyMgr)
+		if err != nil {
+			return nil, err
+		}
+		if err := cn.firewall.allowIdentity(ctx, key.Id); err != nil {
+			return nil, err
+		}
+		return reqSignValidator(key), nil
+	}
+	if cn.opts.Server.RequestSign.Required {
+		return nil, errors.New("signed request required")
+	}
+	av, err := hauth.GrpcAppValidator(ctx, cn.keyMgr)
+	if err != nil {
+		return nil, err
+	}
+	if err := cn.firewall.allowIdentity(ctx, appIdentity(av)); err != nil {
+		return nil, err
+	}
+	return av, nil
+}
+
+// roleValidator allows the calls by the permissions of the roles and the
+// tables of a caller, e.g. of the claims of a JWT or of a signed request.
+type roleValidator struct {
+	kind    string
+	subject string
+	perms   map[string]bool
+	tables  map[string]bool
 }
 
-func appAuthValid(ctx context.Context, keyMgr *hauth.AccessKeyManager) error {
-	return hauth.GrpcAppCredentialValid(ctx, keyMgr)
+// SignValid returns nil, the signature of the caller is checked before the
+// validator is returned.
+func (it *roleValidator) SignValid(b []byte) error {
+	return nil
+}
+
+// Allow returns nil if all permissions and table scopes of the args are
+// allowed.
+func (it *roleValidator) Allow(args ...interface{}) error {
+
+	for _, arg := range args {
+
+		switch v := arg.(type) {
+
+		case string:
+			if !it.perms[v] {
+				return fmt.Errorf("%s (%s) permission %s denied", it.kind, it.subject, v)
+			}
+
+		case *hauth.ScopeFilter:
+			if v.Name != AuthScopeTable {
+				continue
+			}
+			name := v.Value
+			if name == "" {
+				name = "main"
+			}
+			if !it.tables["*"] && !it.tables[name] {
+				return fmt.Errorf("%s (%s) table %s denied", it.kind, it.subject, name)
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,427 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+)
+
+const (
+	backupManifestName = "manifest.json"
+	backupIdLayout     = "20060102T150405.000"
+)
+
+// BackupManifest lists the files of a backup with their checksums, and the
+// number of records of the tables. The files of an incremental backup which
+// are unchanged since the base backup are not copied again but referenced
+// to the backup holding them.
+type BackupManifest struct {
+	Id      string         `json:"id"`
+	Created int64          `json:"created"`
+	Base    string         `json:"base,omitempty"`
+	Files   []*BackupFile  `json:"files"`
+	Tables  []*BackupTable `json:"tables"`
+}
+
+type BackupFile struct {
+	// the path relative to the data directory
+	Path string `json:"path"`
+
+	// the size and the checksum of the file in the backup, after the
+	// compression and the encryption
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+
+	// the size of the file in the data directory, the table files of the
+	// same path and size are unchanged
+	SourceSize int64 `json:"source_size,omitempty"`
+
+	Compress string `json:"compress,omitempty"`
+	Encrypt  string `json:"encrypt,omitempty"`
+
+	// the id of the backup holding the file
+	Backup string `json:"backup"`
+}
+
+type BackupTable struct {
+	// the directory of the table relative to the data directory
+	Dir     string `json:"dir"`
+	Records int64  `json:"records"`
+}
+
+func backupManifestGet(dir, id string) (*BackupManifest, error) {
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, id, backupManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m BackupManifest
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// BackupList returns the ids of the backups in the directory in the order
+// they are created.
+func BackupList(dir string) ([]string, error) {
+
+	ls, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, v := range ls {
+		if !v.IsDir() || strings.HasPrefix(v.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, v.Name(), backupManifestName)); err == nil {
+			ids = append(ids, v.Name())
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Backup writes a backup of all tables into a new sub directory of dir from
+// a checkpoint. If incremental is set, only the files new since the last
+// backup in dir are copied, the table files are never changed once written,
+// so the unchanged files are referenced to the previous backups. The files
+// are compressed and encrypted by Config.Backup as they are written.
+func (cn *Conn) Backup(dir string, incremental bool) (*BackupManifest, error) {
+
+	if cn.opts.ClientConnectEnable {
+		return nil, errors.New("backup not supported in client mode")
+	}
+
+	m := &BackupManifest{
+		Id:      strings.Replace(time.Now().UTC().Format(backupIdLayout), ".", "", 1),
+		Created: time.Now().UnixNano() / 1e6,
+	}
+
+	// the encrypt key may be refreshed from the secret store
+	cfg := cn.opts.Backup
+	cfg.EncryptKey = cn.secrets.value(&cn.opts.Backup.EncryptKey)
+
+	var base = map[string]*BackupFile{}
+
+	if incremental {
+
+		ids, err := BackupList(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ids) > 0 {
+
+			bm, err := backupManifestGet(dir, ids[len(ids)-1])
+			if err != nil {
+				return nil, err
+			}
+
+			for _, v := range bm.Files {
+				base[v.Path] = v
+			}
+			m.Base = bm.Id
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, m.Id)); err == nil {
+		return nil, errors.New("backup already exists")
+	}
+
+	cp, err := cn.CreateCheckpoint("backup-" + m.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.DropCheckpoint(cp.Name)
+
+	tmp := filepath.Join(dir, ".tmp-"+m.Id)
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(cp.Path, func(path string, fi os.FileInfo, err error) error {
+
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(cp.Path, path)
+		if err != nil {
+			return err
+		}
+
+		if name == checkpointMetaName {
+			return nil
+		}
+
+		switch filepath.Ext(name) {
+		case ".ldb", ".sst":
+			// the files of the manifests without the source size are
+			// matched by their size only if they are stored as is
+			if v, ok := base[name]; ok && (v.SourceSize == fi.Size() ||
+				(v.SourceSize == 0 && v.Compress == "" && v.Encrypt == "" && v.Size == fi.Size())) {
+				m.Files = append(m.Files, v)
+				return nil
+			}
+		}
+
+		to := filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(to), 0750); err != nil {
+			return err
+		}
+
+		if err := backupFileWrite(&cfg, path, to); err != nil {
+			return err
+		}
+
+		sum, size, err := fileSum(to)
+		if err != nil {
+			return err
+		}
+
+		file := &BackupFile{
+			Path:       name,
+			Size:       size,
+			Sha256:     sum,
+			SourceSize: fi.Size(),
+			Compress:   cn.opts.Backup.Compress,
+			Backup:     m.Id,
+		}
+		if file.Compress == BackupCompressNone {
+			file.Compress = ""
+		}
+		if cfg.EncryptKey != "" {
+			file.Encrypt = BackupEncryptAesGcm
+		}
+
+		m.Files = append(m.Files, file)
+
+		return nil
+	})
+
+	if err == nil {
+		m.Tables, err = backupTableCount(cp.Path)
+	}
+
+	if err == nil {
+		var bs []byte
+		if bs, err = json.MarshalIndent(m, "", "  "); err == nil {
+			err = ioutil.WriteFile(filepath.Join(tmp, backupManifestName), bs, 0640)
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, m.Id))
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func fileSum(path string) (string, int64, error) {
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fp.Close()
+
+	h, err := cryptoProvider().NewHash(crypto.SHA256)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := io.Copy(h, fp)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// backupTableCount returns the number of the records of the tables of the
+// checkpoint.
+func backupTableCount(dir string) ([]*BackupTable, error) {
+
+	ls, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []*BackupTable{}
+
+	for _, v := range ls {
+
+		if !v.IsDir() {
+			continue
+		}
+
+		db, err := leveldb.OpenFile(filepath.Join(dir, v.Name()), &opt.Options{
+			ReadOnly: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		t := &BackupTable{
+			Dir: v.Name(),
+		}
+
+		iter := db.NewIterator(util.BytesPrefix([]byte{nsKeyData}), nil)
+		for iter.Next() {
+			t.Records += 1
+		}
+		iter.Release()
+
+		err = iter.Error()
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, t)
+	}
+
+	return tables, nil
+}
+
+// VerifyBackup checks the files of the backup of the id in dir, and of the
+// base backups it references, against the sizes and the checksums of the
+// manifest, without restoring the backup.
+func VerifyBackup(dir, id string) error {
+
+	m, err := backupManifestGet(dir, id)
+	if err != nil {
+		return err
+	}
+
+	if len(m.Files) == 0 {
+		return errors.New("no files found in the manifest")
+	}
+
+	for _, v := range m.Files {
+
+		sum, size, err := fileSum(filepath.Join(dir, v.Backup, v.Path))
+		if err != nil {
+			return fmt.Errorf("file %s of backup %s, err %s", v.Path, v.Backup, err.Error())
+		}
+
+		if size != v.Size {
+			return fmt.Errorf("file %s of backup %s, size %d, expected %d",
+				v.Path, v.Backup, size, v.Size)
+		}
+
+		if v.Sha256 != "" && sum != v.Sha256 {
+			return fmt.Errorf("file %s of backup %s, checksum mismatch", v.Path, v.Backup)
+		}
+	}
+
+	return nil
+}
+
+// BackupRestore restores the backup of the id in dir into the new data
+// directory dataDir, with the files of the base backups it references, the
+// files and the numbers of the records of the tables are checked against
+// the manifest. The encryptKey is the backup/encrypt_key setting of the
+// encrypted backups.
+func BackupRestore(dir, id, dataDir, encryptKey string) error {
+
+	m, err := backupManifestGet(dir, id)
+	if err != nil {
+		return err
+	}
+
+	if ls, err := ioutil.ReadDir(dataDir); err == nil && len(ls) > 0 {
+		return errors.New("data directory not empty")
+	}
+
+	for _, v := range m.Files {
+
+		to := filepath.Join(dataDir, v.Path)
+		if err := os.MkdirAll(filepath.Dir(to), 0750); err != nil {
+			return err
+		}
+
+		from := filepath.Join(dir, v.Backup, v.Path)
+
+		sum, size, err := fileSum(from)
+		if err != nil {
+			return fmt.Errorf("restore file %s from backup %s, err %s",
+				v.Path, v.Backup, err.Error())
+		}
+
+		if size != v.Size || (v.Sha256 != "" && sum != v.Sha256) {
+			return fmt.Errorf("restore file %s from backup %s, checksum mismatch",
+				v.Path, v.Backup)
+		}
+
+		if err := backupFileRead(v, encryptKey, from, to); err != nil {
+			return fmt.Errorf("restore file %s from backup %s, err %s",
+				v.Path, v.Backup, err.Error())
+		}
+	}
+
+	if len(m.Tables) == 0 {
+		return nil
+	}
+
+	tables, err := backupTableCount(dataDir)
+	if err != nil {
+		return err
+	}
+
+	records := map[string]int64{}
+	for _, v := range tables {
+		records[v.Dir] = v.Records
+	}
+
+	for _, v := range m.Tables {
+		if n := records[v.Dir]; n != v.Records {
+			return fmt.Errorf("restore table %s, records %d, expected %d",
+				v.Dir, n, v.Records)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,368 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	BackupCompressNone   = "none"
+	BackupCompressGzip   = "gzip"
+	BackupCompressSnappy = "snappy"
+
+	BackupEncryptAesGcm = "aes-256-gcm"
+
+	backupCryptMagic     = "kvgobk1\n"
+	backupCryptChunkSize = 64 * 1024
+)
+
+// BackupCompressor compresses the files of the backups, the built-in ones
+// are gzip and snappy, others (e.g. zstd) are plugged in by registering a
+// compressor of their library by BackupCompressorRegister.
+type BackupCompressor interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	backupCompressorMu sync.RWMutex
+	backupCompressors  = map[string]BackupCompressor{
+		BackupCompressGzip:   &backupGzip{},
+		BackupCompressSnappy: &backupSnappy{},
+	}
+)
+
+// BackupCompressorRegister registers the compressor of the name, which is
+// used by the setting backup/compress.
+func BackupCompressorRegister(name string, c BackupCompressor) {
+	backupCompressorMu.Lock()
+	defer backupCompressorMu.Unlock()
+	backupCompressors[name] = c
+}
+
+func backupCompressor(name string) BackupCompressor {
+	backupCompressorMu.RLock()
+	defer backupCompressorMu.RUnlock()
+	return backupCompressors[name]
+}
+
+type backupGzip struct{}
+
+func (it *backupGzip) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (it *backupGzip) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type backupSnappy struct{}
+
+func (it *backupSnappy) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (it *backupSnappy) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(r)), nil
+}
+
+func backupEncryptKey(key string) (cipher.AEAD, error) {
+
+	bs, err := hex.DecodeString(key)
+	if err != nil || len(bs) != 32 {
+		return nil, errors.New("invalid backup/encrypt_key, 64 hex digits required")
+	}
+
+	return cryptoProvider().NewAEAD(bs)
+}
+
+// backupCryptWriter encrypts the stream in chunks by AES-GCM, the nonce of
+// a chunk is the random prefix of the file and the sequence of the chunk,
+// and the last chunk is marked in the additional data, so the reordered or
+// truncated files are refused.
+type backupCryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint64
+	buf    []byte
+}
+
+func newBackupCryptWriter(w io.Writer, aead cipher.AEAD) (*backupCryptWriter, error) {
+
+	it := &backupCryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: make([]byte, aead.NonceSize()-8),
+		buf:    make([]byte, 0, backupCryptChunkSize),
+	}
+
+	if err := cryptoRandRead(it.prefix); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append([]byte(backupCryptMagic), it.prefix...)); err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+func backupCryptNonce(prefix []byte, seq uint64) []byte {
+	return append(append([]byte{}, prefix...), uint64ToBytes(seq)...)
+}
+
+func (it *backupCryptWriter) flush(last bool) error {
+
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+
+	bs := it.aead.Seal(nil, backupCryptNonce(it.prefix, it.seq), it.buf, ad)
+	it.seq += 1
+	it.buf = it.buf[:0]
+
+	if _, err := it.w.Write(uint32ToBytes(uint32(len(bs)))); err != nil {
+		return err
+	}
+
+	_, err := it.w.Write(bs)
+	return err
+}
+
+func (it *backupCryptWriter) Write(p []byte) (int, error) {
+
+	n := len(p)
+
+	for len(p) > 0 {
+
+		m := backupCryptChunkSize - len(it.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+
+		it.buf = append(it.buf, p[:m]...)
+		p = p[m:]
+
+		if len(it.buf) == backupCryptChunkSize {
+			if err := it.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (it *backupCryptWriter) Close() error {
+	return it.flush(true)
+}
+
+type backupCryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint64
+	buf    []byte
+	last   bool
+}
+
+func newBackupCryptReader(r io.Reader, aead cipher.AEAD) (*backupCryptReader, error) {
+
+	head := make([]byte, len(backupCryptMagic)+aead.NonceSize()-8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(head, []byte(backupCryptMagic)) {
+		return nil, errors.New("invalid encrypted backup file")
+	}
+
+	return &backupCryptReader{
+		r:      r,
+		aead:   aead,
+		prefix: head[len(backupCryptMagic):],
+	}, nil
+}
+
+func (it *backupCryptReader) Read(p []byte) (int, error) {
+
+	for len(it.buf) == 0 {
+
+		if it.last {
+			return 0, io.EOF
+		}
+
+		head := make([]byte, 4)
+		if _, err := io.ReadFull(it.r, head); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		n := binary.BigEndian.Uint32(head)
+		if n > backupCryptChunkSize+uint32(it.aead.Overhead()) {
+			return 0, errors.New("invalid encrypted backup chunk")
+		}
+
+		bs := make([]byte, n)
+		if _, err := io.ReadFull(it.r, bs); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		nonce := backupCryptNonce(it.prefix, it.seq)
+		it.seq += 1
+
+		buf, err := it.aead.Open(nil, nonce, bs, []byte{0})
+		if err != nil {
+			if buf, err = it.aead.Open(nil, nonce, bs, []byte{1}); err != nil {
+				return 0, errors.New("backup decrypt failed")
+			}
+			it.last = true
+		}
+		it.buf = buf
+	}
+
+	n := copy(p, it.buf)
+	it.buf = it.buf[n:]
+
+	return n, nil
+}
+
+// backupFileWrite copies the file to the backup file to, compressed and
+// encrypted by the settings.
+func backupFileWrite(cfg *ConfigBackup, from, to string) error {
+
+	fp, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fpo, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer fpo.Close()
+
+	var (
+		w       io.Writer = fpo
+		closers []io.Closer
+	)
+
+	if cfg.EncryptKey != "" {
+		aead, err := backupEncryptKey(cfg.EncryptKey)
+		if err != nil {
+			return err
+		}
+		cw, err := newBackupCryptWriter(w, aead)
+		if err != nil {
+			return err
+		}
+		w, closers = cw, append(closers, cw)
+	}
+
+	if cfg.Compress != "" && cfg.Compress != BackupCompressNone {
+		c := backupCompressor(cfg.Compress)
+		if c == nil {
+			return errors.New("backup compressor (" + cfg.Compress + ") not found")
+		}
+		cw, err := c.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		w, closers = cw, append(closers, cw)
+	}
+
+	if _, err := io.Copy(w, fp); err != nil {
+		return err
+	}
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return err
+		}
+	}
+
+	return fpo.Sync()
+}
+
+// backupFileRead copies the backup file from to the file to, decrypted and
+// decompressed by the settings of the file.
+func backupFileRead(file *BackupFile, encryptKey, from, to string) error {
+
+	fp, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var r io.Reader = fp
+
+	if file.Encrypt != "" {
+		if encryptKey == "" {
+			return errors.New("no backup encrypt key setup")
+		}
+		aead, err := backupEncryptKey(encryptKey)
+		if err != nil {
+			return err
+		}
+		if r, err = newBackupCryptReader(r, aead); err != nil {
+			return err
+		}
+	}
+
+	if file.Compress != "" && file.Compress != BackupCompressNone {
+		c := backupCompressor(file.Compress)
+		if c == nil {
+			return errors.New("backup compressor (" + file.Compress + ") not found")
+		}
+		cr, err := c.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		r = cr
+	}
+
+	fpo, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer fpo.Close()
+
+	if _, err := io.Copy(fpo, r); err != nil {
+		return err
+	}
+
+	return fpo.Sync()
+}
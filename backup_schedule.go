@@ -0,0 +1,474 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	backupScheduleSleep = 20e9
+)
+
+// ConfigBackupSchedule runs the backups into the Directory by the Cron
+// expression (minute hour day-of-month month day-of-week, in local time),
+// and removes the old backups after each run except the last KeepLast
+// ones, the last ones of the recent KeepDaily days and of the recent
+// KeepWeekly weeks, and the base backups they reference.
+type ConfigBackupSchedule struct {
+	Name        string `toml:"name" json:"name"`
+	Cron        string `toml:"cron" json:"cron"`
+	Directory   string `toml:"directory" json:"directory"`
+	Incremental bool   `toml:"incremental" json:"incremental"`
+	KeepLast    int    `toml:"keep_last" json:"keep_last"`
+	KeepDaily   int    `toml:"keep_daily" json:"keep_daily"`
+	KeepWeekly  int    `toml:"keep_weekly" json:"keep_weekly"`
+}
+
+// BackupScheduleStatus is the schedule with the state of its last run.
+type BackupScheduleStatus struct {
+	*ConfigBackupSchedule
+	LastRun   int64  `json:"last_run,omitempty"`
+	LastId    string `json:"last_id,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (it *ConfigBackupSchedule) Valid() error {
+
+	if !seqNameReg.MatchString(it.Name) {
+		return errors.New("invalid backup/schedules/name")
+	}
+
+	if _, err := cronParse(it.Cron); err != nil {
+		return fmt.Errorf("invalid backup/schedules/cron, err %s", err.Error())
+	}
+
+	if it.Directory == "" {
+		return errors.New("invalid backup/schedules/directory")
+	}
+
+	if it.KeepLast < 0 || it.KeepDaily < 0 || it.KeepWeekly < 0 {
+		return errors.New("invalid backup/schedules/keep_*")
+	}
+
+	return nil
+}
+
+// cronSchedule is the parsed 5 fields cron expression, the fields support
+// "*", values, ranges "a-b", lists "a,b" and steps "*/n" or "a-b/n".
+type cronSchedule struct {
+	fields [5]map[int]bool
+}
+
+var cronFieldRanges = [5][2]int{
+	{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6},
+}
+
+func cronParse(expr string) (*cronSchedule, error) {
+
+	ls := strings.Fields(expr)
+	if len(ls) != 5 {
+		return nil, errors.New("5 fields required")
+	}
+
+	cs := &cronSchedule{}
+
+	for i, field := range ls {
+
+		var (
+			min, max = cronFieldRanges[i][0], cronFieldRanges[i][1]
+			set      = map[int]bool{}
+		)
+
+		for _, part := range strings.Split(field, ",") {
+
+			step := 1
+			if n := strings.Index(part, "/"); n > 0 {
+				v, err := strconv.Atoi(part[n+1:])
+				if err != nil || v < 1 {
+					return nil, errors.New("invalid step " + part)
+				}
+				step, part = v, part[:n]
+			}
+
+			lo, hi := min, max
+			if part != "*" {
+				rg := strings.SplitN(part, "-", 2)
+				v, err := strconv.Atoi(rg[0])
+				if err != nil {
+					return nil, errors.New("invalid value " + part)
+				}
+				lo, hi = v, v
+				if len(rg) == 2 {
+					if hi, err = strconv.Atoi(rg[1]); err != nil {
+						return nil, errors.New("invalid range " + part)
+					}
+				} else if step > 1 {
+					hi = max
+				}
+			}
+
+			// 7 is sunday too
+			if i == 4 && hi == 7 {
+				if lo == 7 {
+					lo = 0
+				}
+				hi = 6
+				set[0] = true
+			}
+
+			if lo < min || hi > max || lo > hi {
+				return nil, errors.New("value out of range " + part)
+			}
+
+			for v := lo; v <= hi; v += step {
+				set[v] = true
+			}
+		}
+
+		cs.fields[i] = set
+	}
+
+	return cs, nil
+}
+
+func (it *cronSchedule) match(t time.Time) bool {
+	return it.fields[0][t.Minute()] &&
+		it.fields[1][t.Hour()] &&
+		it.fields[2][t.Day()] &&
+		it.fields[3][int(t.Month())] &&
+		it.fields[4][int(t.Weekday())]
+}
+
+type backupScheduler struct {
+	mu       sync.Mutex
+	statuses map[string]*BackupScheduleStatus
+	running  bool
+}
+
+func keySysBackupSchedule(name string) []byte {
+	return append([]byte{nsKeySys}, []byte("backup:schedule:"+name)...)
+}
+
+// backupSchedules returns the schedules of the config and of the Admin API,
+// the ones of the Admin API override the ones of the config of the same
+// name.
+func (cn *Conn) backupSchedules() ([]*ConfigBackupSchedule, error) {
+
+	sets := map[string]*ConfigBackupSchedule{}
+	for _, v := range cn.opts.Backup.Schedules {
+		sets[v.Name] = v
+	}
+
+	iter := cn.dbSys.NewIterator(util.BytesPrefix(keySysBackupSchedule("")), nil)
+	for iter.Next() {
+		var v ConfigBackupSchedule
+		if err := json.Unmarshal(iter.Value(), &v); err == nil {
+			sets[v.Name] = &v
+		}
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	ls := []*ConfigBackupSchedule{}
+	for _, v := range sets {
+		ls = append(ls, v)
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Name < ls[j].Name
+	})
+
+	return ls, nil
+}
+
+// BackupScheduleSet adds or updates the schedule, which is kept in the
+// system table and overrides the schedule of the config of the same name.
+func (cn *Conn) BackupScheduleSet(s *ConfigBackupSchedule) error {
+
+	if cn.opts.ClientConnectEnable {
+		return errors.New("backup not supported in client mode")
+	}
+
+	if err := s.Valid(); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return cn.dbSys.Put(keySysBackupSchedule(s.Name), bs, nil)
+}
+
+// BackupScheduleDel removes the schedule set by BackupScheduleSet.
+func (cn *Conn) BackupScheduleDel(name string) error {
+
+	if cn.opts.ClientConnectEnable {
+		return errors.New("backup not supported in client mode")
+	}
+
+	return cn.dbSys.Delete(keySysBackupSchedule(name), nil)
+}
+
+// BackupScheduleList returns the schedules with the states of their last
+// runs.
+func (cn *Conn) BackupScheduleList() ([]*BackupScheduleStatus, error) {
+
+	if cn.opts.ClientConnectEnable {
+		return nil, errors.New("backup not supported in client mode")
+	}
+
+	ls, err := cn.backupSchedules()
+	if err != nil {
+		return nil, err
+	}
+
+	cn.backupSched.mu.Lock()
+	defer cn.backupSched.mu.Unlock()
+
+	rs := []*BackupScheduleStatus{}
+	for _, v := range ls {
+		st := &BackupScheduleStatus{
+			ConfigBackupSchedule: v,
+		}
+		if st2, ok := cn.backupSched.statuses[v.Name]; ok {
+			st.LastRun, st.LastId, st.LastError = st2.LastRun, st2.LastId, st2.LastError
+		}
+		rs = append(rs, st)
+	}
+
+	return rs, nil
+}
+
+func (cn *Conn) workerBackupSchedule() {
+
+	var last int64
+
+	for !cn.close {
+
+		time.Sleep(backupScheduleSleep)
+
+		tn := time.Now()
+		if m := tn.Unix() / 60; m == last {
+			continue
+		} else {
+			last = m
+		}
+
+		if cn.Maintenance() {
+			continue
+		}
+
+		cn.backupScheduleTrigger(tn)
+	}
+}
+
+// backupScheduleTrigger starts the runs of the schedules matching the time,
+// one backup runs at a time and the others are skipped.
+func (cn *Conn) backupScheduleTrigger(tn time.Time) {
+
+	ls, err := cn.backupSchedules()
+	if err != nil {
+		hlog.Printf("warn", "kvgo backup schedules err %s", err.Error())
+		return
+	}
+
+	for _, v := range ls {
+
+		cs, err := cronParse(v.Cron)
+		if err != nil || !cs.match(tn) {
+			continue
+		}
+
+		cn.backupSched.mu.Lock()
+		running := cn.backupSched.running
+		cn.backupSched.running = true
+		cn.backupSched.mu.Unlock()
+
+		if running {
+			hlog.Printf("warn", "kvgo backup schedule %s skipped, a backup is running", v.Name)
+			continue
+		}
+
+		go cn.backupScheduleRun(v)
+	}
+}
+
+func (cn *Conn) backupScheduleRun(s *ConfigBackupSchedule) {
+
+	st := &BackupScheduleStatus{
+		ConfigBackupSchedule: s,
+		LastRun:              time.Now().UnixNano() / 1e6,
+	}
+
+	m, err := cn.Backup(s.Directory, s.Incremental)
+	if err == nil {
+		st.LastId = m.Id
+		err = backupRetain(s)
+	}
+
+	if err != nil {
+		st.LastError = err.Error()
+		hlog.Printf("warn", "kvgo backup schedule %s err %s", s.Name, err.Error())
+	} else {
+		hlog.Printf("info", "kvgo backup schedule %s done, backup %s", s.Name, m.Id)
+	}
+
+	cn.backupSched.mu.Lock()
+	if cn.backupSched.statuses == nil {
+		cn.backupSched.statuses = map[string]*BackupScheduleStatus{}
+	}
+	cn.backupSched.statuses[s.Name] = st
+	cn.backupSched.running = false
+	cn.backupSched.mu.Unlock()
+}
+
+// backupRetain removes the backups out of the retention of the schedule,
+// nothing is removed if no retention is set.
+func backupRetain(s *ConfigBackupSchedule) error {
+
+	if s.KeepLast < 1 && s.KeepDaily < 1 && s.KeepWeekly < 1 {
+		return nil
+	}
+
+	ids, err := BackupList(s.Directory)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ms    = map[string]*BackupManifest{}
+		keeps = map[string]bool{}
+		days  = map[string]bool{}
+		weeks = map[string]bool{}
+	)
+
+	for i := len(ids) - 1; i >= 0; i-- {
+
+		m, err := backupManifestGet(s.Directory, ids[i])
+		if err != nil {
+			return err
+		}
+		ms[m.Id] = m
+
+		var (
+			t        = time.Unix(0, m.Created*1e6)
+			day      = t.Format("20060102")
+			yw, w    = t.ISOWeek()
+			week     = fmt.Sprintf("%d-%d", yw, w)
+			keepLast = len(ids)-i <= s.KeepLast
+		)
+
+		if keepLast {
+			keeps[m.Id] = true
+		}
+
+		if !days[day] && len(days) < s.KeepDaily {
+			days[day], keeps[m.Id] = true, true
+		}
+
+		if !weeks[week] && len(weeks) < s.KeepWeekly {
+			weeks[week], keeps[m.Id] = true, true
+		}
+	}
+
+	// the base backups holding the files of the kept ones
+	for id := range keeps {
+		if m, ok := ms[id]; ok {
+			for _, f := range m.Files {
+				keeps[f.Backup] = true
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if keeps[id] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.Directory, id)); err != nil {
+			return err
+		}
+		hlog.Printf("info", "kvgo backup %s removed by the retention of schedule %s", id, s.Name)
+	}
+
+	return nil
+}
+
+type backupScheduleRequest struct {
+	Schedule *ConfigBackupSchedule `json:"schedule,omitempty"`
+	Name     string                `json:"name,omitempty"`
+}
+
+func (cn *Conn) backupScheduleCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req backupScheduleRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	switch method {
+
+	case "BackupScheduleSet":
+		if req.Schedule == nil {
+			return kv2.NewObjectResultClientError(errors.New("no schedule setup"))
+		}
+		if err := cn.BackupScheduleSet(req.Schedule); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+
+	case "BackupScheduleDel":
+		if err := cn.BackupScheduleDel(req.Name); err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+
+	case "BackupScheduleList":
+		ls, err := cn.BackupScheduleList()
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		bs, err := json.Marshal(ls)
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		return sysCmdResultBytes(bs)
+	}
+
+	return kv2.NewObjectResultOK()
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	BalancerHash   = "hash"
+	BalancerRandom = "random"
+
+	hashRingReplicas = 64
+)
+
+// hashRings caches the rings of the main nodes by their addresses.
+var hashRings sync.Map
+
+// hashRing is a consistent hash ring of the main nodes, each node is placed
+// at hashRingReplicas points so the keys are spread evenly and only the keys
+// of a removed node move to the other nodes.
+type hashRing struct {
+	points []uint32
+	nodes  []int
+}
+
+// hashRingSum hashes the key by md5 as ketama does, the fnv hashes of the
+// similar short keys are not spread evenly enough.
+func hashRingSum(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func newHashRing(addrs []string) *hashRing {
+
+	ring := &hashRing{}
+
+	type point struct {
+		sum  uint32
+		node int
+	}
+
+	ls := []point{}
+	for i, addr := range addrs {
+		for j := 0; j < hashRingReplicas; j++ {
+			ls = append(ls, point{hashRingSum(addr + "#" + strconv.Itoa(j)), i})
+		}
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].sum < ls[j].sum
+	})
+
+	for _, v := range ls {
+		ring.points = append(ring.points, v.sum)
+		ring.nodes = append(ring.nodes, v.node)
+	}
+
+	return ring
+}
+
+// lookup returns the indexes of the n nodes next to the key on the ring,
+// the first one is the preferred node of the key.
+func (it *hashRing) lookup(key string, n int) []int {
+
+	var (
+		sum = hashRingSum(key)
+		i   = sort.Search(len(it.points), func(i int) bool {
+			return it.points[i] >= sum
+		})
+		ls   = []int{}
+		hits = map[int]bool{}
+	)
+
+	for j := 0; j < len(it.points) && len(ls) < n; j++ {
+		node := it.nodes[(i+j)%len(it.points)]
+		if !hits[node] {
+			hits[node] = true
+			ls = append(ls, node)
+		}
+	}
+
+	return ls
+}
+
+// keyMainNodes returns the main nodes to send the request of the key to,
+// the preferred node of the key by the hash ring first and then the next
+// nodes on the ring to fall back to, so each node caches a share of the
+// keys rather than all of them.
+func (it *ConfigCluster) keyMainNodes(table string, key []byte, cap int) []*ClientConfig {
+
+	nodes := dataNodes(it.MainNodes)
+
+	if it.Balancer == BalancerRandom || len(key) == 0 || len(nodes) < 2 {
+		return it.randMainNodes(cap)
+	}
+
+	addrs := make([]string, len(nodes))
+	for i, v := range nodes {
+		addrs[i] = v.Addr
+	}
+	sign := strings.Join(addrs, "\n")
+
+	ring, ok := hashRings.Load(sign)
+	if !ok {
+		ring, _ = hashRings.LoadOrStore(sign, newHashRing(addrs))
+	}
+
+	ls := []*ClientConfig{}
+	for _, i := range ring.(*hashRing).lookup(table+"/"+string(key), cap+1) {
+		ls = append(ls, nodes[i])
+	}
+
+	return ls
+}
+
+// zoneMainNodes returns the main nodes to send the query of the key to, the
+// nodes of the same zone first, then the nodes of the same region, each in
+// the order of keyMainNodes. The consistency of the query is kept by the
+// node serving it, so any node may be picked.
+func (it *ConfigCluster) zoneMainNodes(table string, key []byte, cap int) []*ClientConfig {
+
+	if it.Zone == "" && it.Region == "" {
+		return it.keyMainNodes(table, key, cap)
+	}
+
+	ls := it.keyMainNodes(table, key, len(it.MainNodes))
+
+	sort.SliceStable(ls, func(i, j int) bool {
+		return it.zoneDistance(ls[i]) < it.zoneDistance(ls[j])
+	})
+
+	if len(ls) > cap+1 {
+		ls = ls[:cap+1]
+	}
+
+	return ls
+}
+
+func (it *ConfigCluster) zoneDistance(node *ClientConfig) int {
+	switch {
+	case it.Zone != "" && node.Zone == it.Zone:
+		return 0
+	case it.Region != "" && node.Region == it.Region:
+		return 1
+	}
+	return 2
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+)
+
+const (
+	lruCacheEntryOverhead = 64
+	lruCacheGenShards     = 64
+)
+
+type lruCacheEntry struct {
+	key     string
+	value   []byte
+	expired int64
+}
+
+// lruCache is a size bounded LRU cache of byte values, the nil *lruCache is
+// a valid disabled cache.
+//
+// The keys are hashed into the shards of generations, the generation of
+// the shard of a key is increased by every Del of the key, the readers that
+// fill the cache after reading from db get the generation of the key before
+// reading and pass it to Set, so a value read before a concurrent write is
+// never cached, and the writes of the other shards do not fail the fills.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ttl      int64
+	gens     [lruCacheGenShards]uint64
+	list     *list.List
+	items    map[string]*list.Element
+}
+
+func lruCacheShard(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h = (h ^ uint32(key[i])) * 16777619
+	}
+	return int(h % lruCacheGenShards)
+}
+
+// newLruCache returns a cache of capacity bytes, the entries expire after
+// ttl milliseconds if ttl > 0.
+func newLruCache(capacity, ttl int64) *lruCache {
+	if capacity < 1 {
+		return nil
+	}
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		list:     list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (it *lruCache) Get(key string) ([]byte, bool) {
+
+	if it == nil {
+		return nil, false
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	elem, ok := it.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruCacheEntry)
+	if entry.expired > 0 && entry.expired < time.Now().UnixNano()/1e6 {
+		it.remove(elem)
+		return nil, false
+	}
+
+	it.list.MoveToFront(elem)
+
+	return entry.value, true
+}
+
+// Generation returns the generation of the shard of the key.
+func (it *lruCache) Generation(key string) uint64 {
+
+	if it == nil {
+		return 0
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	return it.gens[lruCacheShard(key)]
+}
+
+func (it *lruCache) Set(key string, value []byte, gen uint64) {
+
+	if it == nil {
+		return
+	}
+
+	size := int64(len(key) + len(value) + lruCacheEntryOverhead)
+	if size > it.capacity/8 {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if gen != it.gens[lruCacheShard(key)] {
+		return
+	}
+
+	if elem, ok := it.items[key]; ok {
+		it.remove(elem)
+	}
+
+	entry := &lruCacheEntry{
+		key:   key,
+		value: value,
+	}
+	if it.ttl > 0 {
+		entry.expired = time.Now().UnixNano()/1e6 + it.ttl
+	}
+
+	it.items[key] = it.list.PushFront(entry)
+	it.size += size
+
+	it.evict()
+}
+
+func (it *lruCache) evict() {
+	for it.size > it.capacity {
+		if elem := it.list.Back(); elem != nil {
+			it.remove(elem)
+		} else {
+			break
+		}
+	}
+}
+
+func (it *lruCache) Capacity() int64 {
+
+	if it == nil {
+		return 0
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	return it.capacity
+}
+
+// SetCapacity resizes the cache, the least recently used entries are evicted
+// if the cache is shrunk.
+func (it *lruCache) SetCapacity(capacity int64) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.capacity = capacity
+	it.evict()
+}
+
+func (it *lruCache) Del(key string) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.gens[lruCacheShard(key)] += 1
+
+	if elem, ok := it.items[key]; ok {
+		it.remove(elem)
+	}
+}
+
+func (it *lruCache) Purge() {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	for i := range it.gens {
+		it.gens[i] += 1
+	}
+	it.size = 0
+	it.list.Init()
+	it.items = map[string]*list.Element{}
+}
+
+func (it *lruCache) remove(elem *list.Element) {
+	entry := elem.Value.(*lruCacheEntry)
+	it.list.Remove(elem)
+	delete(it.items, entry.key)
+	it.size -= int64(len(entry.key) + len(entry.value) + lruCacheEntryOverhead)
+}
+
+func valueCacheKey(tdb *dbTable, ns byte, key []byte) string {
+	return valueCacheKeyOf(tdb.tableId, ns, key)
+}
+
+func valueCacheKeyOf(tableId uint32, ns byte, key []byte) string {
+	return string(append(uint32ToBytes(tableId), keyEncode(ns, key)...))
+}
+
+// valueCacheDel invalidates the cached values and not-found results of the
+// key, it must be called after every local write or delete of the key.
+func (cn *Conn) valueCacheDel(tdb *dbTable, key []byte) {
+	cn.pinned.del(tdb, key)
+	cn.valueCacheInvalidate(tdb.tableId, key)
+}
+
+// valueCacheInvalidate invalidates the key in the value cache and the
+// not-found cache, e.g. after the compaction filters rewrite or drop it.
+func (cn *Conn) valueCacheInvalidate(tableId uint32, key []byte) {
+	for _, c := range []*lruCache{cn.valueCache, cn.notFoundCache} {
+		if c != nil {
+			c.Del(valueCacheKeyOf(tableId, nsKeyMeta, key))
+			c.Del(valueCacheKeyOf(tableId, nsKeyData, key))
+		}
+	}
+}
+
+// valueCachePurge drops all entries of the value cache and the not-found
+// cache.
+func (cn *Conn) valueCachePurge() {
+	cn.valueCache.Purge()
+	cn.notFoundCache.Purge()
+}
+
+// valueGet reads the value of the key in the namespace ns through the
+// value cache and the not-found cache.
+func (cn *Conn) valueGet(tdb *dbTable, ns byte, key []byte) ([]byte, error) {
+
+	if bs, hit, pinned, gen := cn.pinned.get(tdb, ns, key); hit {
+		if bs == nil {
+			return nil, leveldb.ErrNotFound
+		}
+		return bs, nil
+	} else if pinned {
+		bs, err := tdb.db.Get(keyEncode(ns, key), nil)
+		if err == nil || err == leveldb.ErrNotFound {
+			cn.pinned.fill(tdb, ns, key, bs, gen)
+		}
+		return bs, err
+	}
+
+	if cn.valueCache == nil && cn.notFoundCache == nil {
+		return tdb.db.Get(keyEncode(ns, key), nil)
+	}
+
+	ck := valueCacheKey(tdb, ns, key)
+	if bs, ok := cn.valueCache.Get(ck); ok {
+		return bs, nil
+	}
+
+	if _, ok := cn.notFoundCache.Get(ck); ok {
+		return nil, leveldb.ErrNotFound
+	}
+
+	var (
+		gen  = cn.valueCache.Generation(ck)
+		gen2 = cn.notFoundCache.Generation(ck)
+	)
+
+	bs, err := tdb.db.Get(keyEncode(ns, key), nil)
+	if err == nil {
+		cn.valueCache.Set(ck, bs, gen)
+	} else if err == leveldb.ErrNotFound {
+		cn.notFoundCache.Set(ck, nil, gen2)
+	}
+
+	return bs, err
+}
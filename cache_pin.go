@@ -0,0 +1,535 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	pinnedCacheRefreshInterval = 10 * time.Second
+)
+
+// PinnedPrefix is a key prefix of a table pinned in memory by PinPrefix.
+type PinnedPrefix struct {
+	Table  string `json:"table"`
+	Prefix []byte `json:"prefix"`
+	Keys   int64  `json:"keys"`
+	Size   int64  `json:"size"`   // in bytes
+	Loaded int64  `json:"loaded"` // unix time of the last (re)load
+}
+
+type cachePinRequest struct {
+	Table  string `json:"table,omitempty"`
+	Prefix []byte `json:"prefix,omitempty"`
+}
+
+type pinnedPrefix struct {
+	PinnedPrefix
+	tableId uint32
+	loading bool
+}
+
+// pinnedCache holds all the meta and data entries of the pinned prefixes,
+// so the reads of the keys of the prefixes, including the not found ones,
+// never hit the disk. The nil *pinnedCache is a valid disabled cache.
+//
+// A write of a pinned key marks the key dirty, the dirty keys are read from
+// db and filled again by the next read, with the generation check of
+// lruCache. The prefixes are reloaded after the compactions of the table,
+// since the compaction filters may drop or rewrite the entries without
+// writes.
+type pinnedCache struct {
+	mu          sync.RWMutex
+	capacity    int64
+	size        int64
+	gen         uint64
+	prefixes    []*pinnedPrefix
+	values      map[string][]byte
+	dirty       map[string]bool
+	compactions map[string]int64
+}
+
+func newPinnedCache(capacity int64) *pinnedCache {
+	if capacity < 1 {
+		return nil
+	}
+	return &pinnedCache{
+		capacity:    capacity,
+		values:      map[string][]byte{},
+		dirty:       map[string]bool{},
+		compactions: map[string]int64{},
+	}
+}
+
+func pinnedEntrySize(ck string, value []byte) int64 {
+	return int64(len(ck) + len(value) + lruCacheEntryOverhead)
+}
+
+func (it *pinnedCache) match(tableId uint32, key []byte) *pinnedPrefix {
+	for _, p := range it.prefixes {
+		if p.tableId == tableId && bytes.HasPrefix(key, p.Prefix) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (it *pinnedCache) find(table string, prefix []byte) int {
+	for i, p := range it.prefixes {
+		if p.Table == table && bytes.Equal(p.Prefix, prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// get returns the value of the key if the key is pinned and not dirty, the
+// nil value of a hit is not found. If the key is pinned but missed, the
+// value read from db is passed to fill with the generation returned.
+func (it *pinnedCache) get(tdb *dbTable, ns byte, key []byte) (value []byte, hit, pinned bool, gen uint64) {
+
+	if it == nil {
+		return nil, false, false, 0
+	}
+
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	p := it.match(tdb.tableId, key)
+	if p == nil {
+		return nil, false, false, 0
+	}
+
+	ck := valueCacheKey(tdb, ns, key)
+	if p.loading || it.dirty[ck] {
+		return nil, false, true, it.gen
+	}
+
+	return it.values[ck], true, true, it.gen
+}
+
+func (it *pinnedCache) fill(tdb *dbTable, ns byte, key, value []byte, gen uint64) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	ck := valueCacheKey(tdb, ns, key)
+	if gen != it.gen || !it.dirty[ck] {
+		return
+	}
+
+	delete(it.dirty, ck)
+	if value != nil {
+		it.values[ck] = value
+		it.size += pinnedEntrySize(ck, value)
+		if p := it.match(tdb.tableId, key); p != nil {
+			p.Keys += 1
+			p.Size += pinnedEntrySize(ck, value)
+		}
+	}
+}
+
+// del marks the key dirty, it is called by valueCacheDel after every local
+// write or delete of the key.
+func (it *pinnedCache) del(tdb *dbTable, key []byte) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	p := it.match(tdb.tableId, key)
+	if p == nil {
+		return
+	}
+
+	it.gen += 1
+
+	for _, ns := range []byte{nsKeyMeta, nsKeyData} {
+		ck := valueCacheKey(tdb, ns, key)
+		if value, ok := it.values[ck]; ok {
+			delete(it.values, ck)
+			it.size -= pinnedEntrySize(ck, value)
+			p.Keys -= 1
+			p.Size -= pinnedEntrySize(ck, value)
+		}
+		it.dirty[ck] = true
+	}
+}
+
+// drop removes the entries of the prefix, must be called with the lock
+// held.
+func (it *pinnedCache) drop(tdb *dbTable, p *pinnedPrefix) {
+	for _, ns := range []byte{nsKeyMeta, nsKeyData} {
+		pk := valueCacheKey(tdb, ns, p.Prefix)
+		for ck, value := range it.values {
+			if len(ck) >= len(pk) && ck[:len(pk)] == pk {
+				delete(it.values, ck)
+				it.size -= pinnedEntrySize(ck, value)
+			}
+		}
+		for ck := range it.dirty {
+			if len(ck) >= len(pk) && ck[:len(pk)] == pk {
+				delete(it.dirty, ck)
+			}
+		}
+	}
+	p.Keys, p.Size = 0, 0
+}
+
+// load (re)loads the entries of the prefix from db. While loading the keys
+// of the prefix are read from db, and the keys written meanwhile are left
+// dirty since the scan may have read the values before the writes.
+func (it *pinnedCache) load(tdb *dbTable, p *pinnedPrefix) error {
+
+	it.mu.Lock()
+	it.gen += 1
+	it.drop(tdb, p)
+	p.loading = true
+	it.mu.Unlock()
+
+	var (
+		values = map[string][]byte{}
+		size   int64
+		err    error
+	)
+
+	for _, ns := range []byte{nsKeyMeta, nsKeyData} {
+
+		iter := tdb.db.NewIterator(util.BytesPrefix(keyEncode(ns, p.Prefix)), nil)
+		for iter.Next() {
+			ck := valueCacheKey(tdb, ns, iter.Key()[1:])
+			values[ck] = bytesClone(iter.Value())
+			if size += pinnedEntrySize(ck, iter.Value()); size > it.capacity {
+				break
+			}
+		}
+		err = iter.Error()
+		iter.Release()
+
+		if err != nil {
+			break
+		}
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if i := it.find(p.Table, p.Prefix); i < 0 || it.prefixes[i] != p {
+		return errors.New("prefix unpinned")
+	}
+
+	if err == nil && it.size+size > it.capacity {
+		err = errors.New("pinned cache capacity exceeded")
+	}
+
+	if err != nil {
+		// the keys are read from db until the prefix is unpinned or
+		// reloaded successfully
+		return err
+	}
+
+	for ck, value := range values {
+		if it.dirty[ck] {
+			continue
+		}
+		it.values[ck] = value
+		it.size += pinnedEntrySize(ck, value)
+		p.Keys += 1
+		p.Size += pinnedEntrySize(ck, value)
+	}
+	p.loading = false
+	p.Loaded = time.Now().Unix()
+
+	return nil
+}
+
+func (it *pinnedCache) pin(tdb *dbTable, prefix []byte) error {
+
+	if it == nil {
+		return errors.New("pinned cache not enabled")
+	}
+
+	it.mu.Lock()
+	if it.find(tdb.tableName, prefix) >= 0 {
+		it.mu.Unlock()
+		return nil
+	}
+	for _, p := range it.prefixes {
+		if p.tableId == tdb.tableId &&
+			(bytes.HasPrefix(prefix, p.Prefix) || bytes.HasPrefix(p.Prefix, prefix)) {
+			it.mu.Unlock()
+			return errors.New("prefix overlaps the pinned prefix")
+		}
+	}
+	p := &pinnedPrefix{
+		PinnedPrefix: PinnedPrefix{
+			Table:  tdb.tableName,
+			Prefix: bytesClone(prefix),
+		},
+		tableId: tdb.tableId,
+	}
+	it.prefixes = append(it.prefixes, p)
+	it.mu.Unlock()
+
+	if err := it.load(tdb, p); err != nil {
+		it.unpin(tdb, prefix)
+		return err
+	}
+
+	return nil
+}
+
+func (it *pinnedCache) unpin(tdb *dbTable, prefix []byte) bool {
+
+	if it == nil {
+		return false
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	i := it.find(tdb.tableName, prefix)
+	if i < 0 {
+		return false
+	}
+
+	it.gen += 1
+	it.drop(tdb, it.prefixes[i])
+	it.prefixes = append(it.prefixes[:i], it.prefixes[i+1:]...)
+
+	return true
+}
+
+func (it *pinnedCache) list() []*PinnedPrefix {
+
+	ls := []*PinnedPrefix{}
+	if it == nil {
+		return ls
+	}
+
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	for _, p := range it.prefixes {
+		v := p.PinnedPrefix
+		ls = append(ls, &v)
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		if ls[i].Table != ls[j].Table {
+			return ls[i].Table < ls[j].Table
+		}
+		return bytes.Compare(ls[i].Prefix, ls[j].Prefix) < 0
+	})
+
+	return ls
+}
+
+// refresh reloads the prefixes of the tables compacted since the last
+// refresh, the compactions are detected by the bytes written to the levels
+// below level-0, which are not written by the memdb flushes.
+func (it *pinnedCache) refresh(cn *Conn) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.RLock()
+	ls := append([]*pinnedPrefix{}, it.prefixes...)
+	it.mu.RUnlock()
+
+	done := map[string]bool{}
+
+	for _, p := range ls {
+
+		tdb := cn.tabledb(p.Table)
+		if tdb == nil {
+			continue
+		}
+
+		if !done[p.Table] {
+
+			var st leveldb.DBStats
+			if err := tdb.db.Stats(&st); err != nil {
+				continue
+			}
+
+			var written int64
+			for i := 1; i < len(st.LevelWrite); i++ {
+				written += int64(st.LevelWrite[i])
+			}
+
+			it.mu.Lock()
+			last, ok := it.compactions[p.Table]
+			it.compactions[p.Table] = written
+			it.mu.Unlock()
+
+			if !ok || last == written {
+				continue
+			}
+			done[p.Table] = true
+		}
+
+		if err := it.load(tdb, p); err != nil {
+			hlog.Printf("warn", "kvgo pinned prefix %s of table %s reload err %s",
+				string(p.Prefix), p.Table, err.Error())
+		}
+	}
+}
+
+func (cn *Conn) workerCachePin() {
+
+	for !cn.close {
+		time.Sleep(pinnedCacheRefreshInterval)
+		cn.pinned.refresh(cn)
+	}
+}
+
+// PinPrefix loads all the keys of the prefix of the table in memory, the
+// reads of the keys (including the not found ones) of the prefix never hit
+// the disk since then, the entries are reloaded after the compactions of
+// the table. The total size of the pinned entries is limited by the
+// Performance.PinnedCacheSize. In client mode the prefix is pinned on the
+// connected node.
+func (cn *Conn) PinPrefix(tableName string, prefix []byte) error {
+	_, err := cn.cachePinCmd("CachePin", tableName, prefix)
+	return err
+}
+
+// UnpinPrefix releases the prefix pinned by PinPrefix.
+func (cn *Conn) UnpinPrefix(tableName string, prefix []byte) error {
+	_, err := cn.cachePinCmd("CacheUnpin", tableName, prefix)
+	return err
+}
+
+// PinnedPrefixes returns the prefixes pinned by PinPrefix.
+func (cn *Conn) PinnedPrefixes() ([]*PinnedPrefix, error) {
+	return cn.cachePinCmd("CachePinList", "", nil)
+}
+
+func (cn *Conn) cachePinCmd(method, tableName string, prefix []byte) ([]*PinnedPrefix, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		bs, err := json.Marshal(&cachePinRequest{
+			Table:  tableName,
+			Prefix: prefix,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: method,
+			Body:   bs,
+		})
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+
+		var ls []*PinnedPrefix
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &ls); err != nil {
+				return nil, err
+			}
+		}
+
+		return ls, nil
+	}
+
+	return cn.cachePinLocal(method, tableName, prefix)
+}
+
+func (cn *Conn) cachePinLocal(method, tableName string, prefix []byte) ([]*PinnedPrefix, error) {
+
+	if method == "CachePinList" {
+		return cn.pinned.list(), nil
+	}
+
+	if tableName == "" {
+		tableName = "main"
+	}
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil || tableName == sysTableName {
+		return nil, errors.New("table not found")
+	}
+
+	switch method {
+
+	case "CachePin":
+		if len(prefix) == 0 {
+			return nil, errors.New("prefix not setup")
+		}
+		if err := cn.pinned.pin(tdb, prefix); err != nil {
+			return nil, err
+		}
+
+	case "CacheUnpin":
+		if !cn.pinned.unpin(tdb, prefix) {
+			return nil, errors.New("prefix not pinned")
+		}
+
+	default:
+		return nil, errors.New("cmd not found")
+	}
+
+	return cn.pinned.list(), nil
+}
+
+func (cn *Conn) cachePinCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req cachePinRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	ls, err := cn.cachePinLocal(method, req.Table, req.Prefix)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(ls)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
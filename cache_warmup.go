@@ -0,0 +1,295 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+)
+
+const (
+	cacheStateFile    = "CACHE_STATE"
+	cacheStateVersion = 1
+
+	// the warmup yields to the foreground reads every cacheWarmupBatch keys
+	cacheWarmupBatch = 1000
+)
+
+type cacheStateKey struct {
+	Table string `json:"table"`
+	Key   []byte `json:"key"`
+}
+
+// cacheState is the list of the hot keys saved in the data directory, the
+// most recently read key first.
+type cacheState struct {
+	Version int              `json:"version"`
+	Created int64            `json:"created"`
+	Keys    []*cacheStateKey `json:"keys"`
+}
+
+// cacheHotKeys is the count bounded LRU list of the recently read keys, the
+// nil *cacheHotKeys is a valid disabled list.
+//
+// The list is split into the shards by the hash of the key, and one of every
+// cacheHotKeysSample reads of a shard is tracked, so the reads neither
+// contend on one lock nor allocate, the hot keys are read often enough to be
+// sampled. The small lists (such as the tests) are not split.
+type cacheHotKeys struct {
+	max    int
+	shards []*cacheHotKeysShard
+}
+
+type cacheHotKeysShard struct {
+	mu     sync.Mutex
+	max    int
+	reads  uint32
+	list   *list.List
+	tables map[string]map[string]*list.Element
+}
+
+type cacheHotKey struct {
+	key *cacheStateKey
+	at  int64
+}
+
+const (
+	cacheHotKeysShardMax  = 16
+	cacheHotKeysShardKeys = 1024
+	cacheHotKeysSample    = 4
+)
+
+func newCacheHotKeys(max int) *cacheHotKeys {
+	if max < 1 {
+		return nil
+	}
+	n := max / cacheHotKeysShardKeys
+	if n < 1 {
+		n = 1
+	} else if n > cacheHotKeysShardMax {
+		n = cacheHotKeysShardMax
+	}
+	it := &cacheHotKeys{
+		max: max,
+	}
+	for i := 0; i < n; i++ {
+		it.shards = append(it.shards, &cacheHotKeysShard{
+			max:    (max + n - 1) / n,
+			list:   list.New(),
+			tables: map[string]map[string]*list.Element{},
+		})
+	}
+	return it
+}
+
+// shard returns the shard of the key by the FNV-1a hash of the table and
+// the key.
+func (it *cacheHotKeys) shard(table string, key []byte) *cacheHotKeysShard {
+	if len(it.shards) == 1 {
+		return it.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(table); i++ {
+		h = (h ^ uint32(table[i])) * 16777619
+	}
+	for _, c := range key {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return it.shards[h%uint32(len(it.shards))]
+}
+
+// touch samples the read of the key.
+func (it *cacheHotKeys) touch(table string, key []byte) {
+
+	if it == nil {
+		return
+	}
+
+	sh := it.shard(table, key)
+	if atomic.AddUint32(&sh.reads, 1)%cacheHotKeysSample != 0 {
+		return
+	}
+
+	sh.add(table, key)
+}
+
+// add moves the key to the front of the shard, the key is not retained.
+func (sh *cacheHotKeysShard) add(table string, key []byte) {
+
+	tn := time.Now().UnixNano()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	items, ok := sh.tables[table]
+	if ok {
+		if elem, ok := items[string(key)]; ok {
+			elem.Value.(*cacheHotKey).at = tn
+			sh.list.MoveToFront(elem)
+			return
+		}
+	} else {
+		items = map[string]*list.Element{}
+		sh.tables[table] = items
+	}
+
+	k := &cacheStateKey{
+		Table: table,
+		Key:   bytesClone(key),
+	}
+	items[string(k.Key)] = sh.list.PushFront(&cacheHotKey{
+		key: k,
+		at:  tn,
+	})
+
+	for sh.list.Len() > sh.max {
+		elem := sh.list.Back()
+		k := elem.Value.(*cacheHotKey).key
+		sh.list.Remove(elem)
+		if items := sh.tables[k.Table]; items != nil {
+			delete(items, string(k.Key))
+			if len(items) == 0 {
+				delete(sh.tables, k.Table)
+			}
+		}
+	}
+}
+
+// keys returns the keys of all shards, the most recently read key first.
+func (it *cacheHotKeys) keys() []*cacheStateKey {
+
+	if it == nil {
+		return nil
+	}
+
+	var ls []*cacheHotKey
+	for _, sh := range it.shards {
+		sh.mu.Lock()
+		for elem := sh.list.Front(); elem != nil; elem = elem.Next() {
+			hk := *elem.Value.(*cacheHotKey)
+			ls = append(ls, &hk)
+		}
+		sh.mu.Unlock()
+	}
+
+	sort.SliceStable(ls, func(i, j int) bool {
+		return ls[i].at > ls[j].at
+	})
+	if len(ls) > it.max {
+		ls = ls[:it.max]
+	}
+
+	keys := make([]*cacheStateKey, 0, len(ls))
+	for _, hk := range ls {
+		keys = append(keys, hk.key)
+	}
+
+	return keys
+}
+
+// SaveCacheState saves the recently read keys in the data directory, they
+// are read in the background after the next Open to warm up the caches. It
+// is called by Close, and may be called periodically to survive crashes.
+func (cn *Conn) SaveCacheState() error {
+
+	if cn.hotKeys == nil {
+		return errors.New("cache warmup not enabled")
+	}
+
+	bs, err := json.Marshal(&cacheState{
+		Version: cacheStateVersion,
+		Created: time.Now().Unix(),
+		Keys:    cn.hotKeys.keys(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		file = filepath.Join(cn.opts.Storage.DataDirectory, cacheStateFile)
+		tmp  = file + ".tmp"
+	)
+	if err := ioutil.WriteFile(tmp, bs, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func cacheStateLoad(dir string) (*cacheState, error) {
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, cacheStateFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var state cacheState
+	if err := json.Unmarshal(bs, &state); err != nil {
+		return nil, err
+	}
+
+	if state.Version != cacheStateVersion {
+		return nil, errors.New("cache state version not supported")
+	}
+
+	return &state, nil
+}
+
+// workerCacheWarmup reads the keys of the saved cache state from the least
+// recently read one, so the hottest keys are the last to be evicted.
+func (cn *Conn) workerCacheWarmup() {
+
+	state, err := cacheStateLoad(cn.opts.Storage.DataDirectory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			hlog.Printf("warn", "kvgo cache warmup err %s", err.Error())
+		}
+		return
+	}
+
+	var (
+		tn  = time.Now()
+		num = 0
+	)
+
+	for i := len(state.Keys) - 1; i >= 0 && !cn.close; i-- {
+
+		k := state.Keys[i]
+
+		if tdb := cn.tabledb(k.Table); tdb != nil {
+			if _, err := cn.valueGet(tdb, nsKeyData, k.Key); err == nil {
+				cn.hotKeys.shard(k.Table, k.Key).add(k.Table, k.Key)
+				num += 1
+			}
+		}
+
+		if i%cacheWarmupBatch == 0 {
+			time.Sleep(1e6)
+		}
+	}
+
+	hlog.Printf("info", "kvgo cache warmup %d/%d keys in %v",
+		num, len(state.Keys), time.Since(tn).Round(time.Millisecond))
+}
@@ -0,0 +1,490 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// The content-addressed storage keeps every value once under its SHA-256
+// in the Feature.CasTable. A blob has a reference counter, increased by
+// every PutCAS of the value and decreased by ReleaseCAS, and the blob is
+// deleted when the last reference is released.
+//
+// The counter is updated in a transaction, so the content-addressed storage
+// is not supported in cluster mode, PutCAS, ReleaseCAS and CasGC fail with
+// errCasCluster on the servers with the Cluster.MainNodes. The writes of a transaction are not
+// atomic on crashes, the blob is written before its counter and the counter
+// is deleted before its blob, so a crash may leave a blob without a counter
+// but never a counter without a blob.
+const (
+	casKeyBlobPrefix = "cas:blob:"
+	casKeyRefPrefix  = "cas:ref:"
+	casGcBatch       = 100
+	casGcSleep       = 10e9
+)
+
+var errCasCluster = errors.New("cas not supported in cluster mode")
+
+// CasStats is the deduplication statistics of the content-addressed
+// storage, counted by the last garbage collection.
+type CasStats struct {
+	// the number and the size in bytes of the stored blobs
+	Blobs int64 `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+
+	// the number of the references and the size in bytes of the values of
+	// all the references, as if they were stored without deduplication
+	Refs         int64 `json:"refs"`
+	LogicalBytes int64 `json:"logical_bytes"`
+
+	// LogicalBytes / Bytes
+	DedupRatio float64 `json:"dedup_ratio"`
+
+	// the blobs without references removed by the last collection, and the
+	// bytes reclaimed by all the collections since the node started
+	Orphans        int64 `json:"orphans"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+
+	Updated int64 `json:"updated"`
+}
+
+type casGcStatus struct {
+	mu        sync.Mutex
+	stats     CasStats
+	reclaimed int64
+	last      int64
+}
+
+type casRequest struct {
+	Hash  string `json:"hash,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+func casHash(value []byte) string {
+	h := sha256.Sum256(value)
+	return hex.EncodeToString(h[:])
+}
+
+func casHashValid(hash string) error {
+	if bs, err := hex.DecodeString(hash); err != nil || len(bs) != sha256.Size {
+		return errors.New("invalid cas hash")
+	}
+	return nil
+}
+
+func casKeyBlob(hash string) []byte {
+	return keyInternalEncode(casKeyBlobPrefix + hash)
+}
+
+func casKeyRef(hash string) []byte {
+	return keyInternalEncode(casKeyRefPrefix + hash)
+}
+
+func casRefs(tx *Txn, table, hash string) (uint64, error) {
+	bs, err := tx.Get(table, casKeyRef(hash))
+	if err != nil {
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(string(bs), 10, 64)
+}
+
+// PutCAS stores the value under its SHA-256 and returns the hash in hex, an
+// existing value is not written again and gets one more reference. It is
+// not supported in cluster mode.
+func (cn *Conn) PutCAS(value []byte) (string, error) {
+
+	if !cn.opts.ClientConnectEnable {
+		return cn.casPutLocal(nil, value)
+	}
+
+	var hash string
+	if err := cn.casCmdRemote("CasPut", &casRequest{
+		Value: value,
+	}, &hash); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// GetCAS returns the value of the hash, or ErrNotFound.
+func (cn *Conn) GetCAS(hash string) ([]byte, error) {
+
+	if err := casHashValid(hash); err != nil {
+		return nil, err
+	}
+
+	rs := cn.Query(kv2.NewObjectReader(casKeyBlob(hash)).
+		TableNameSet(cn.opts.Feature.CasTable))
+	if rs.NotFound() {
+		return nil, ErrNotFound
+	} else if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	value := rs.DataValue().Bytes()
+	if casHash(value) != hash {
+		return nil, errors.New("cas value corrupted")
+	}
+
+	return value, nil
+}
+
+// ReleaseCAS releases one reference of the value of the hash, the value is
+// deleted when its last reference is released. It is not supported in
+// cluster mode.
+func (cn *Conn) ReleaseCAS(hash string) error {
+
+	if !cn.opts.ClientConnectEnable {
+		return cn.casReleaseLocal(nil, hash)
+	}
+
+	return cn.casCmdRemote("CasRelease", &casRequest{
+		Hash: hash,
+	}, nil)
+}
+
+func (cn *Conn) casPutLocal(av appValidator, value []byte) (string, error) {
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return "", errCasCluster
+	}
+
+	var (
+		hash  = casHash(value)
+		table = cn.opts.Feature.CasTable
+	)
+
+	err := cn.txnInternal(av, func(tx *Txn) error {
+
+		n, err := casRefs(tx, table, hash)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			if err := tx.Put(table, casKeyBlob(hash), value); err != nil {
+				return err
+			}
+		}
+
+		return tx.Put(table, casKeyRef(hash), []byte(strconv.FormatUint(n+1, 10)))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+func (cn *Conn) casReleaseLocal(av appValidator, hash string) error {
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return errCasCluster
+	}
+
+	if err := casHashValid(hash); err != nil {
+		return err
+	}
+
+	table := cn.opts.Feature.CasTable
+
+	return cn.txnInternal(av, func(tx *Txn) error {
+
+		n, err := casRefs(tx, table, hash)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		if n > 1 {
+			return tx.Put(table, casKeyRef(hash), []byte(strconv.FormatUint(n-1, 10)))
+		}
+
+		if err := tx.Delete(table, casKeyRef(hash)); err != nil {
+			return err
+		}
+
+		return tx.Delete(table, casKeyBlob(hash))
+	})
+}
+
+func (cn *Conn) casCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	var req casRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	var ret interface{}
+
+	switch method {
+
+	case "CasPut":
+		hash, err := cn.casPutLocal(av, req.Value)
+		if err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		ret = hash
+
+	case "CasStats":
+		ret = cn.casStats()
+
+	case "CasGC":
+		stats, err := cn.CasGC()
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		ret = stats
+
+	case "CasRelease":
+		if err := cn.casReleaseLocal(av, req.Hash); err != nil {
+			if err == ErrNotFound {
+				return kv2.NewObjectResultNotFound()
+			}
+			return kv2.NewObjectResultClientError(err)
+		}
+		return kv2.NewObjectResultOK()
+
+	default:
+		return kv2.NewObjectResultClientError(errors.New("cmd not found"))
+	}
+
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
+
+func (cn *Conn) casCmdRemote(method string, req *casRequest, ret interface{}) error {
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rs := cn.SysCmd(&kv2.SysCmdRequest{
+		Method: method,
+		Body:   bs,
+	})
+	if rs.NotFound() {
+		return ErrNotFound
+	} else if !rs.OK() {
+		return rs.Error()
+	}
+
+	if ret != nil && len(rs.Items) > 0 {
+		return wireDecode(rs.DataValue().Bytes(), ret)
+	}
+
+	return nil
+}
+
+// CasStats returns the deduplication statistics of the last garbage
+// collection of the content-addressed storage.
+func (cn *Conn) CasStats() (*CasStats, error) {
+
+	if !cn.opts.ClientConnectEnable {
+		return cn.casStats(), nil
+	}
+
+	var stats CasStats
+	if err := cn.casCmdRemote("CasStats", &casRequest{}, &stats); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (cn *Conn) casStats() *CasStats {
+	cn.casGc.mu.Lock()
+	defer cn.casGc.mu.Unlock()
+	stats := cn.casGc.stats
+	return &stats
+}
+
+// CasGC runs the garbage collection of the content-addressed storage now:
+// the references are marked, and the blobs without references, left by
+// the crashes during the writes of PutCAS or ReleaseCAS, are swept.
+func (cn *Conn) CasGC() (*CasStats, error) {
+
+	if cn.opts.ClientConnectEnable {
+		var stats CasStats
+		if err := cn.casCmdRemote("CasGC", &casRequest{}, &stats); err != nil {
+			return nil, err
+		}
+		return &stats, nil
+	}
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return nil, errCasCluster
+	}
+
+	tdb := cn.tabledb(cn.opts.Feature.CasTable)
+	if tdb == nil {
+		return nil, errors.New("table not found")
+	}
+
+	cn.casGc.mu.Lock()
+	defer cn.casGc.mu.Unlock()
+
+	var (
+		stats   = CasStats{}
+		refs    = map[string]uint64{}
+		orphans = []string{}
+		sizes   = map[string]int64{}
+	)
+
+	// mark
+	iter := tdb.db.NewIterator(util.BytesPrefix(keyEncode(nsKeyData, casKeyRef(""))), nil)
+	for iter.Next() {
+		item, err := kv2.ObjectItemDecode(iter.Value())
+		if err != nil || item == nil {
+			continue
+		}
+		n, err := strconv.ParseUint(item.DataValue().String(), 10, 64)
+		if err != nil || n == 0 {
+			continue
+		}
+		refs[string(iter.Key()[1+len(casKeyRef("")):])] = n
+	}
+	iter.Release()
+
+	// sweep
+	iter = tdb.db.NewIterator(util.BytesPrefix(keyEncode(nsKeyData, casKeyBlob(""))), nil)
+	for iter.Next() {
+		var (
+			hash = string(iter.Key()[1+len(casKeyBlob("")):])
+			size = int64(0)
+		)
+		if item, err := kv2.ObjectItemDecode(iter.Value()); err == nil && item != nil {
+			size = int64(len(item.DataValue().Bytes()))
+		}
+		if n, ok := refs[hash]; ok {
+			stats.Blobs += 1
+			stats.Bytes += size
+			stats.Refs += int64(n)
+			stats.LogicalBytes += size * int64(n)
+		} else {
+			orphans = append(orphans, hash)
+			sizes[hash] = size
+		}
+	}
+	iter.Release()
+
+	// the orphans are checked again in the transactions, the blob of a
+	// concurrent PutCAS is written before its reference
+	for i := 0; i < len(orphans); i += casGcBatch {
+
+		j := i + casGcBatch
+		if j > len(orphans) {
+			j = len(orphans)
+		}
+
+		var (
+			num   int64
+			bytes int64
+		)
+
+		if err := cn.txnInternal(nil, func(tx *Txn) error {
+			num, bytes = 0, 0
+			for _, hash := range orphans[i:j] {
+				n, err := casRefs(tx, cn.opts.Feature.CasTable, hash)
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					continue
+				}
+				if err := tx.Delete(cn.opts.Feature.CasTable, casKeyBlob(hash)); err != nil {
+					return err
+				}
+				num += 1
+				bytes += sizes[hash]
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		stats.Orphans += num
+		cn.casGc.reclaimed += bytes
+	}
+
+	if stats.Bytes > 0 {
+		stats.DedupRatio = float64(stats.LogicalBytes) / float64(stats.Bytes)
+	}
+	stats.ReclaimedBytes = cn.casGc.reclaimed
+	stats.Updated = time.Now().UnixNano() / 1e6
+
+	cn.casGc.stats = stats
+
+	if stats.Orphans > 0 {
+		hlog.Printf("info", "kvgo cas gc, %d orphans removed, %d bytes reclaimed",
+			stats.Orphans, cn.casGc.reclaimed)
+	}
+
+	return &stats, nil
+}
+
+func (cn *Conn) workerCasGC() {
+
+	for !cn.close {
+
+		time.Sleep(casGcSleep)
+
+		if len(cn.opts.Cluster.MainNodes) > 0 || cn.Maintenance() {
+			continue
+		}
+
+		tn := time.Now().Unix()
+
+		cn.casGc.mu.Lock()
+		last := cn.casGc.last
+		cn.casGc.mu.Unlock()
+
+		if last+cn.opts.Feature.CasGcInterval > tn {
+			continue
+		}
+
+		if _, err := cn.CasGC(); err != nil {
+			hlog.Printf("warn", "kvgo cas gc err %s", err.Error())
+		}
+
+		cn.casGc.mu.Lock()
+		cn.casGc.last = tn
+		cn.casGc.mu.Unlock()
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	checkpointDirName  = "checkpoint"
+	checkpointMetaName = "checkpoint.json"
+	checkpointRetry    = 3
+)
+
+// Checkpoint is a named copy of the data directory, the table files are
+// hard linked so a checkpoint takes little time and space until the tables
+// are compacted. It is restored by opening the Path as the data directory.
+type Checkpoint struct {
+	Name    string `json:"name"`
+	Created int64  `json:"created"`
+	Path    string `json:"path"`
+}
+
+func (cn *Conn) checkpointDir() string {
+	return filepath.Join(cn.opts.Storage.DataDirectory, checkpointDirName)
+}
+
+func checkpointNameValid(name string) error {
+	if !seqNameReg.MatchString(name) || strings.HasPrefix(name, ".") {
+		return errors.New("invalid checkpoint name")
+	}
+	return nil
+}
+
+// CreateCheckpoint creates the checkpoint of all tables, the writes are
+// paused while the files are linked and the journals are copied.
+func (cn *Conn) CreateCheckpoint(name string) (*Checkpoint, error) {
+
+	if cn.opts.ClientConnectEnable {
+		return nil, errors.New("checkpoint not supported in client mode")
+	}
+
+	if err := checkpointNameValid(name); err != nil {
+		return nil, err
+	}
+
+	var (
+		dir = filepath.Join(cn.checkpointDir(), name)
+		tmp = filepath.Join(cn.checkpointDir(), ".tmp-"+name)
+	)
+
+	if _, err := os.Stat(dir); err == nil {
+		return nil, errors.New("checkpoint already exists")
+	}
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+
+	cn.txnLock()
+	defer cn.txnUnlock()
+
+	cn.mu.RLock()
+	tables := []*dbTable{}
+	for _, tdb := range cn.tables {
+		tables = append(tables, tdb)
+	}
+	cn.mu.RUnlock()
+
+	cp := &Checkpoint{
+		Name:    name,
+		Created: time.Now().UnixNano() / 1e6,
+		Path:    dir,
+	}
+
+	for _, tdb := range tables {
+
+		dirName := tableDirName(tdb)
+
+		var err error
+		for i := 0; i < checkpointRetry; i++ {
+			// the table files referenced by the copied manifest may be
+			// removed by a compaction before they are linked
+			if err = checkpointTable(&cn.opts.Storage, dirName, filepath.Join(tmp, dirName)); err == nil ||
+				!os.IsNotExist(err) {
+				break
+			}
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+	}
+
+	bs, _ := json.Marshal(cp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, checkpointMetaName), bs, 0640); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func tableDirName(tdb *dbTable) string {
+	if tdb.tableName == sysTableName {
+		return sysTableName
+	}
+	return fmt.Sprintf("%d_%d_%d", tdb.tableId, 0, 0)
+}
+
+// checkpointTable links the table files and copies the other files of the
+// table from the data, wal and extra data directories of the storage to dst,
+// the current manifest is copied first, so all files it references are
+// linked after. The table files moved to the object storage are fetched.
+func checkpointTable(stor *ConfigStorage, dirName, dst string) error {
+
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dst, 0750); err != nil {
+		return err
+	}
+
+	src := filepath.Join(stor.DataDirectory, dirName)
+
+	current, err := ioutil.ReadFile(filepath.Join(src, "CURRENT"))
+	if err != nil {
+		return err
+	}
+	manifest := strings.TrimSpace(string(current))
+
+	if err := fileCopy(filepath.Join(src, manifest), filepath.Join(dst, manifest)); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dst, "CURRENT"), current, 0640); err != nil {
+		return err
+	}
+
+	srcs := []string{src}
+	if stor.WalDirectory != "" {
+		srcs = append(srcs, filepath.Join(stor.WalDirectory, dirName))
+	}
+	for _, v := range stor.ExtraDataDirectories {
+		srcs = append(srcs, filepath.Join(v, dirName))
+	}
+
+	for _, dir := range srcs {
+
+		ls, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) && dir != src {
+				continue
+			}
+			return err
+		}
+
+		for _, v := range ls {
+
+			var (
+				name = v.Name()
+				from = filepath.Join(dir, name)
+				to   = filepath.Join(dst, name)
+			)
+
+			switch filepath.Ext(name) {
+
+			case ".ldb", ".sst":
+				if err := os.Link(from, to); err != nil {
+					if os.IsNotExist(err) {
+						return err
+					}
+					// the extra data directories may be on other devices
+					if err = fileCopy(from, to); err != nil {
+						return err
+					}
+				}
+
+			case ".log":
+				if err := fileCopy(from, to); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	return tierCheckpoint(stor.Tiering, src, dirName, dst)
+}
+
+func fileCopy(from, to string) error {
+
+	fp, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fpo, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(fpo, fp); err == nil {
+		err = fpo.Sync()
+	}
+	if err2 := fpo.Close(); err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// ListCheckpoints returns the checkpoints ordered by the created time.
+func (cn *Conn) ListCheckpoints() ([]*Checkpoint, error) {
+
+	if cn.opts.ClientConnectEnable {
+		return nil, errors.New("checkpoint not supported in client mode")
+	}
+
+	ls, err := ioutil.ReadDir(cn.checkpointDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cps := []*Checkpoint{}
+	for _, v := range ls {
+
+		if !v.IsDir() || strings.HasPrefix(v.Name(), ".") {
+			continue
+		}
+
+		dir := filepath.Join(cn.checkpointDir(), v.Name())
+
+		bs, err := ioutil.ReadFile(filepath.Join(dir, checkpointMetaName))
+		if err != nil {
+			continue
+		}
+
+		var cp Checkpoint
+		if err := json.Unmarshal(bs, &cp); err != nil {
+			continue
+		}
+		cp.Path = dir
+
+		cps = append(cps, &cp)
+	}
+
+	sort.Slice(cps, func(i, j int) bool {
+		return cps[i].Created < cps[j].Created
+	})
+
+	return cps, nil
+}
+
+// DropCheckpoint removes the checkpoint.
+func (cn *Conn) DropCheckpoint(name string) error {
+
+	if cn.opts.ClientConnectEnable {
+		return errors.New("checkpoint not supported in client mode")
+	}
+
+	if err := checkpointNameValid(name); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(cn.checkpointDir(), name)
+	if _, err := os.Stat(filepath.Join(dir, checkpointMetaName)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("checkpoint not found")
+		}
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
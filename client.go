@@ -21,18 +21,23 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hooto/hauth/go/hauth/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
 
 	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
 )
 
 var (
 	grpcClientConns = map[string]*grpc.ClientConn{}
+	grpcClientRefs  = map[*grpc.ClientConn]int{}
 	grpcClientMu    sync.Mutex
 )
 
@@ -41,34 +46,66 @@ type ClientConfig struct {
 	AccessKey   *hauth.AccessKey      `toml:"access_key" json:"access_key"`
 	AuthTLSCert *ConfigTLSCertificate `toml:"auth_tls_cert" json:"auth_tls_cert"`
 	Options     *kv2.ClientOptions    `toml:"options,omitempty" json:"options,omitempty"`
+	Compress    string                `toml:"compress,omitempty" json:"compress,omitempty"`
+	Keepalive   *ConfigKeepalive      `toml:"keepalive,omitempty" json:"keepalive,omitempty"`
+	Zone        string                `toml:"zone,omitempty" json:"zone,omitempty"`
+	Region      string                `toml:"region,omitempty" json:"region,omitempty"`
+	Witness     bool                  `toml:"witness,omitempty" json:"witness,omitempty"`
+	RequestSign bool                  `toml:"request_sign,omitempty" json:"request_sign,omitempty"`
+	Observer    ClientObserver        `toml:"-" json:"-"`
 	c           kv2.Client            `toml:"-" json:"-"`
 	cc          *ClientConnector      `toml:"-" json:"-"`
 }
 
 type ClientConnector struct {
-	cfg  *ClientConfig
-	conn *grpc.ClientConn
-	err  error
+	mu       sync.Mutex
+	cfg      *ClientConfig
+	conn     *grpc.ClientConn
+	err      error
+	server   *HandshakeInfo
+	compress string
 }
 
-func (it *ClientConnector) reconnect(retry bool) error {
+// reconnect connects the node and handshakes with it, the connection is
+// shared by the concurrent requests, which wait for the handshake. The
+// requests use the returned connection, a concurrent reconnect may replace
+// the one of the connector.
+//
+// The connection is the cached one shared with the other connectors and the
+// requests between the nodes of the cluster, it is never closed by the
+// connector. The retries replace it only if it has failed.
+func (it *ClientConnector) reconnect(retry bool) (*grpc.ClientConn, error) {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
 
-	if retry || (it.err != nil && it.err == grpc.ErrClientConnClosing) {
+	forceNew := it.err != nil && it.err == grpc.ErrClientConnClosing
+	if it.conn != nil && retry && clientConnFailed(it.conn) {
+		forceNew = true
+	}
+	if forceNew {
 		if it.conn != nil {
-			it.conn.Close()
+			clientConnRelease(it.conn)
 		}
 		it.err = nil
 		it.conn = nil
 	}
 
 	if it.conn == nil {
-		it.conn, it.err = clientConn(it.cfg.Addr, it.cfg.AccessKey, it.cfg.AuthTLSCert, true)
-		if it.err != nil {
-			return it.err
+		conn, err := clientConnAcquire(it.cfg.Addr, it.cfg.AccessKey, it.cfg.RequestSign, it.cfg.AuthTLSCert, it.cfg.Keepalive, forceNew)
+		if err != nil {
+			it.err = err
+			return nil, err
 		}
+		if it.server, it.err = clientHandshake(conn, it.cfg.Options.Timeout); it.err != nil {
+			clientConnRelease(conn)
+			return nil, it.err
+		}
+		it.conn = conn
+		it.compress = rpcCompressNegotiate(it.cfg.Compress, it.server)
 	}
 
-	return nil
+	return it.conn, nil
 }
 
 func (it *ClientConfig) NewClient() (kv2.Client, error) {
@@ -104,20 +141,31 @@ func (it *ClientConnector) timeout() time.Duration {
 
 func (it *ClientConnector) Query(req *kv2.ObjectReader) *kv2.ObjectResult {
 
-	if err := it.reconnect(false); err != nil {
+	tn := time.Now()
+
+	conn, err := it.reconnect(false)
+	if err != nil {
+		it.observeDone("Query", "", tn, 0, err)
 		return kv2.NewObjectResultClientError(err)
 	}
 
 	ctx, fc := context.WithTimeout(context.Background(), it.timeout())
 	defer fc()
 
-	rs, err := kv2.NewPublicClient(it.conn).Query(ctx, req)
+	ctx, reqId := requestIdOutgoing(ctx)
+
+	retries := 0
+	rs, err := kv2.NewPublicClient(conn).Query(ctx, req, it.callOptions(-1)...)
 	if err != nil {
-		if err = it.reconnect(true); err == nil {
-			rs, err = kv2.NewPublicClient(it.conn).Query(ctx, req)
+		it.observeRetry("Query", err)
+		retries += 1
+		if conn, err = it.reconnect(true); err == nil {
+			rs, err = kv2.NewPublicClient(conn).Query(ctx, req, it.callOptions(-1)...)
 		}
 	}
 
+	it.observeDone("Query", reqId, tn, retries, err)
+
 	if err != nil {
 		return kv2.NewObjectResultClientError(err)
 	}
@@ -127,20 +175,31 @@ func (it *ClientConnector) Query(req *kv2.ObjectReader) *kv2.ObjectResult {
 
 func (it *ClientConnector) Commit(req *kv2.ObjectWriter) *kv2.ObjectResult {
 
-	if err := it.reconnect(false); err != nil {
+	tn := time.Now()
+
+	conn, err := it.reconnect(false)
+	if err != nil {
+		it.observeDone("Commit", "", tn, 0, err)
 		return kv2.NewObjectResultClientError(err)
 	}
 
 	ctx, fc := context.WithTimeout(context.Background(), it.timeout())
 	defer fc()
 
-	rs, err := kv2.NewPublicClient(it.conn).Commit(ctx, req)
+	ctx, reqId := requestIdOutgoing(ctx)
+
+	retries := 0
+	rs, err := kv2.NewPublicClient(conn).Commit(ctx, req, it.callOptions(proto.Size(req))...)
 	if err != nil {
-		if err = it.reconnect(true); err == nil {
-			rs, err = kv2.NewPublicClient(it.conn).Commit(ctx, req)
+		it.observeRetry("Commit", err)
+		retries += 1
+		if conn, err = it.reconnect(true); err == nil {
+			rs, err = kv2.NewPublicClient(conn).Commit(ctx, req, it.callOptions(proto.Size(req))...)
 		}
 	}
 
+	it.observeDone("Commit", reqId, tn, retries, err)
+
 	if err != nil {
 		return kv2.NewObjectResultClientError(err)
 	}
@@ -150,20 +209,31 @@ func (it *ClientConnector) Commit(req *kv2.ObjectWriter) *kv2.ObjectResult {
 
 func (it *ClientConnector) BatchCommit(req *kv2.BatchRequest) *kv2.BatchResult {
 
-	if err := it.reconnect(false); err != nil {
+	tn := time.Now()
+
+	conn, err := it.reconnect(false)
+	if err != nil {
+		it.observeDone("BatchCommit", "", tn, 0, err)
 		return req.NewResult(kv2.ResultClientError, err.Error())
 	}
 
 	ctx, fc := context.WithTimeout(context.Background(), it.timeout())
 	defer fc()
 
-	rs, err := kv2.NewPublicClient(it.conn).BatchCommit(ctx, req)
+	ctx, reqId := requestIdOutgoing(ctx)
+
+	retries := 0
+	rs, err := kv2.NewPublicClient(conn).BatchCommit(ctx, req, it.callOptions(proto.Size(req))...)
 	if err != nil {
-		if err = it.reconnect(true); err == nil {
-			rs, err = kv2.NewPublicClient(it.conn).BatchCommit(ctx, req)
+		it.observeRetry("BatchCommit", err)
+		retries += 1
+		if conn, err = it.reconnect(true); err == nil {
+			rs, err = kv2.NewPublicClient(conn).BatchCommit(ctx, req, it.callOptions(proto.Size(req))...)
 		}
 	}
 
+	it.observeDone("BatchCommit", reqId, tn, retries, err)
+
 	if err != nil {
 		return req.NewResult(kv2.ResultClientError, err.Error())
 	}
@@ -173,20 +243,31 @@ func (it *ClientConnector) BatchCommit(req *kv2.BatchRequest) *kv2.BatchResult {
 
 func (it *ClientConnector) SysCmd(req *kv2.SysCmdRequest) *kv2.ObjectResult {
 
-	if err := it.reconnect(false); err != nil {
+	tn := time.Now()
+
+	conn, err := it.reconnect(false)
+	if err != nil {
+		it.observeDone("SysCmd", "", tn, 0, err)
 		return kv2.NewObjectResultClientError(err)
 	}
 
 	ctx, fc := context.WithTimeout(context.Background(), it.timeout())
 	defer fc()
 
-	rs, err := kv2.NewPublicClient(it.conn).SysCmd(ctx, req)
+	ctx, reqId := requestIdOutgoing(ctx)
+
+	retries := 0
+	rs, err := kv2.NewPublicClient(conn).SysCmd(ctx, req, it.callOptions(proto.Size(req))...)
 	if err != nil {
-		if err = it.reconnect(true); err == nil {
-			rs, err = kv2.NewPublicClient(it.conn).SysCmd(ctx, req)
+		it.observeRetry("SysCmd", err)
+		retries += 1
+		if conn, err = it.reconnect(true); err == nil {
+			rs, err = kv2.NewPublicClient(conn).SysCmd(ctx, req, it.callOptions(proto.Size(req))...)
 		}
 	}
 
+	it.observeDone("SysCmd", reqId, tn, retries, err)
+
 	if err != nil {
 		return kv2.NewObjectResultClientError(err)
 	}
@@ -194,49 +275,149 @@ func (it *ClientConnector) SysCmd(req *kv2.SysCmdRequest) *kv2.ObjectResult {
 	return rs
 }
 
+// Close releases the connection of the connector, which is closed once it
+// is evicted from the cache and released by all the connectors.
 func (it *ClientConnector) Close() error {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
 	if it.conn != nil {
-		return it.conn.Close()
+		clientConnRelease(it.conn)
+		it.conn = nil
 	}
+
 	return nil
 }
 
+// clientConn returns the cached connection of the node, forceNew evicts the
+// cached one and dials again.
 func clientConn(addr string,
-	key *hauth.AccessKey, cert *ConfigTLSCertificate,
+	key *hauth.AccessKey, sign bool, cert *ConfigTLSCertificate, ka *ConfigKeepalive,
 	forceNew bool) (*grpc.ClientConn, error) {
 
-	if key == nil {
-		return nil, errors.New("not auth key setup")
+	grpcClientMu.Lock()
+	defer grpcClientMu.Unlock()
+
+	return clientConnLocked(addr, key, sign, cert, ka, forceNew)
+}
+
+// clientConnAcquire returns the cached connection of the node as clientConn,
+// and holds it until clientConnRelease, an evicted connection is not closed
+// while it is held.
+func clientConnAcquire(addr string,
+	key *hauth.AccessKey, sign bool, cert *ConfigTLSCertificate, ka *ConfigKeepalive,
+	forceNew bool) (*grpc.ClientConn, error) {
+
+	grpcClientMu.Lock()
+	defer grpcClientMu.Unlock()
+
+	c, err := clientConnLocked(addr, key, sign, cert, ka, forceNew)
+	if err == nil {
+		grpcClientRefs[c] += 1
 	}
 
-	ck := fmt.Sprintf("%s.%s", addr, key.Id)
+	return c, err
+}
+
+// clientConnRelease releases the connection of clientConnAcquire, and closes
+// it if it was evicted from the cache and is not held anymore.
+func clientConnRelease(c *grpc.ClientConn) {
 
 	grpcClientMu.Lock()
 	defer grpcClientMu.Unlock()
 
+	if n := grpcClientRefs[c] - 1; n > 0 {
+		grpcClientRefs[c] = n
+		return
+	}
+	delete(grpcClientRefs, c)
+
+	for _, v := range grpcClientConns {
+		if v == c {
+			return
+		}
+	}
+	c.Close()
+}
+
+// clientConnEvict removes the connection from the cache, the connection is
+// closed now or by the last clientConnRelease.
+func clientConnEvict(ck string, c *grpc.ClientConn) {
+	delete(grpcClientConns, ck)
+	if grpcClientRefs[c] == 0 {
+		c.Close()
+	}
+}
+
+// clientConnFailed returns whether the connection is closed or failing to
+// connect, which the retries replace by a new one instead of waiting for the
+// backoff of the reconnects.
+func clientConnFailed(c *grpc.ClientConn) bool {
+	switch c.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return true
+	}
+	return false
+}
+
+func clientConnLocked(addr string,
+	key *hauth.AccessKey, sign bool, cert *ConfigTLSCertificate, ka *ConfigKeepalive,
+	forceNew bool) (*grpc.ClientConn, error) {
+
+	if key == nil {
+		return nil, errors.New("not auth key setup")
+	}
+
+	if err := failpointInject(FailpointPartition); err != nil {
+		return nil, err
+	}
+
+	ck := fmt.Sprintf("%s.%s", addr, key.Id)
+	if sign {
+		ck += ".sign"
+	}
+
 	if c, ok := grpcClientConns[ck]; ok {
 		if forceNew {
-			c.Close()
-			delete(grpcClientConns, ck)
+			clientConnEvict(ck, c)
 		} else {
 			return c, nil
 		}
 	}
 
 	dialOptions := []grpc.DialOption{
-		grpc.WithPerRPCCredentials(newAppCredential(key)),
 		grpc.WithMaxMsgSize(grpcMsgByteMax),
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(grpcMsgByteMax)),
 		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(grpcMsgByteMax)),
 	}
 
+	// the signed requests are signed with the digests of the requests,
+	// which the credentials of the calls have no access to
+	if sign {
+		dialOptions = append(dialOptions, grpc.WithUnaryInterceptor(reqSignUnaryInterceptor(key)))
+	} else {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(newAppCredential(key)))
+	}
+
+	dialOptions = append(dialOptions, keepaliveDialOptions(ka)...)
+
 	if cert == nil {
 
 		dialOptions = append(dialOptions, grpc.WithInsecure())
 
 	} else {
 
-		block, _ := pem.Decode([]byte(cert.ServerCertData))
+		// the cert file is read on each dial, so the reconnections trust
+		// the rotated certificate of the server
+		certData := cert.ServerCertData
+		if cert.ServerCertFile != "" {
+			if bs, err := ioutil.ReadFile(cert.ServerCertFile); err == nil {
+				certData = string(bs)
+			}
+		}
+
+		block, _ := pem.Decode([]byte(certData))
 		if block == nil || block.Type != "CERTIFICATE" {
 			return nil, errors.New("failed to decode CERTIFICATE")
 		}
@@ -267,3 +448,17 @@ func clientConn(addr string,
 
 	return c, nil
 }
+
+// clientConnDrop evicts the cached connections of the address, the next
+// calls dial again with the current settings of the node.
+func clientConnDrop(addr string) {
+
+	grpcClientMu.Lock()
+	defer grpcClientMu.Unlock()
+
+	for ck, c := range grpcClientConns {
+		if strings.HasPrefix(ck, addr+".") {
+			clientConnEvict(ck, c)
+		}
+	}
+}
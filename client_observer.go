@@ -0,0 +1,108 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"time"
+)
+
+// ClientObserver receives the metrics of the calls of the clients to the
+// servers, so the applications can alert on the degraded access to kvgo
+// from their side. The methods are called synchronously in the calls, and
+// must not block.
+type ClientObserver interface {
+
+	// CallDone is called after every call, err is the error of the
+	// connection or the transport, not the status of the result.
+	CallDone(ev *ClientCallEvent)
+
+	// Retry is called before a failed call is retried on a new connection
+	// to the same server.
+	Retry(addr, method string, err error)
+
+	// Failover is called when a call moves from the node from to the node
+	// to, which is empty if no nodes are left.
+	Failover(method, from, to string, err error)
+}
+
+// ClientCallEvent is a finished call of a client.
+type ClientCallEvent struct {
+	Addr      string
+	Method    string
+	RequestId string
+	Latency   time.Duration
+	Retries   int
+	Err       error
+}
+
+// ClientPoolStat is the state of a pooled connection of the clients.
+type ClientPoolStat struct {
+	Addr  string `json:"addr"`
+	State string `json:"state"`
+}
+
+// ClientPoolStats returns the connections pooled by the clients and the
+// cluster nodes of the process, the state is one of IDLE, CONNECTING,
+// READY, TRANSIENT_FAILURE and SHUTDOWN.
+func ClientPoolStats() []*ClientPoolStat {
+
+	grpcClientMu.Lock()
+	defer grpcClientMu.Unlock()
+
+	ls := []*ClientPoolStat{}
+	for _, c := range grpcClientConns {
+		ls = append(ls, &ClientPoolStat{
+			Addr:  c.Target(),
+			State: c.GetState().String(),
+		})
+	}
+
+	return ls
+}
+
+func clientObserveDone(obs ClientObserver, addr, method, reqId string, tn time.Time, retries int, err error) {
+	if obs != nil {
+		obs.CallDone(&ClientCallEvent{
+			Addr:      addr,
+			Method:    method,
+			RequestId: reqId,
+			Latency:   time.Since(tn),
+			Retries:   retries,
+			Err:       err,
+		})
+	}
+}
+
+// clientObserveFailover reports the failover of the call from the node i of
+// the nodes to the next one.
+func clientObserveFailover(obs ClientObserver, method string, nodes []*ClientConfig, i int, err error) {
+	if obs != nil {
+		to := ""
+		if i+1 < len(nodes) {
+			to = nodes[i+1].Addr
+		}
+		obs.Failover(method, nodes[i].Addr, to, err)
+	}
+}
+
+func (it *ClientConnector) observeDone(method, reqId string, tn time.Time, retries int, err error) {
+	clientObserveDone(it.cfg.Observer, it.cfg.Addr, method, reqId, tn, retries, err)
+}
+
+func (it *ClientConnector) observeRetry(method string, err error) {
+	if it.cfg.Observer != nil {
+		it.cfg.Observer.Retry(it.cfg.Addr, method, err)
+	}
+}
@@ -0,0 +1,115 @@
+# Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+"""Reference Python client of kvgo.
+
+The messages and the Public service are generated from the .proto files
+written by kvgo-proto (see README.md), the generated modules are passed to
+the Client, so the client does not depend on the paths of the proto files:
+
+    import kvspec_pb2, kvspec_pb2_grpc
+    c = Client("127.0.0.1:9100", kvspec_pb2, kvspec_pb2_grpc, metadata=auth)
+    rs = c.get(b"key")
+"""
+
+import json
+import os
+
+import grpc
+
+MSG_BYTE_MAX = 12 * 1024 * 1024
+
+
+def load_consts(path="kvspec_consts.json"):
+    """Loads the constants of the protocol written by kvgo-proto."""
+    with open(path) as fp:
+        return json.load(fp)
+
+
+class Error(Exception):
+
+    def __init__(self, status, message):
+        super().__init__("status %d, %s" % (status, message))
+        self.status = status
+        self.message = message
+
+
+class Client:
+    """Client of the Public service of a kvgo node.
+
+    metadata is a callable returning the list of (key, value) pairs of the
+    request metadata of the authentication (the hauth v1 app credential of
+    the access key), it is called for every request.
+    """
+
+    def __init__(self, addr, pb2, pb2_grpc, metadata=None,
+                 credentials=None, timeout=10.0, consts=None):
+        options = [
+            ("grpc.max_send_message_length", MSG_BYTE_MAX),
+            ("grpc.max_receive_message_length", MSG_BYTE_MAX),
+        ]
+        if credentials is not None:
+            self._channel = grpc.secure_channel(addr, credentials, options)
+        else:
+            self._channel = grpc.insecure_channel(addr, options)
+        self._pb2 = pb2
+        self._stub = pb2_grpc.PublicStub(self._channel)
+        self._metadata = metadata
+        self._timeout = timeout
+        self._c = consts or load_consts(os.path.join(
+            os.path.dirname(os.path.abspath(pb2.__file__)), "kvspec_consts.json"))
+
+    def close(self):
+        self._channel.close()
+
+    def _call(self, method, req):
+        md = self._metadata() if self._metadata else None
+        rs = method(req, timeout=self._timeout, metadata=md)
+        if rs.status not in (self._c["ResultOK"], self._c["ResultNotFound"]):
+            raise Error(rs.status, rs.message)
+        return rs
+
+    def query(self, req):
+        """Sends the ObjectReader and returns the ObjectResult."""
+        return self._call(self._stub.Query, req)
+
+    def commit(self, req):
+        """Sends the ObjectWriter and returns the ObjectResult."""
+        return self._call(self._stub.Commit, req)
+
+    def get(self, key, table="main"):
+        """Returns the ObjectItem of the key, or None if not found."""
+        rs = self.query(self._pb2.ObjectReader(
+            keys=[key], table_name=table, mode=self._c["ObjectReaderModeKey"]))
+        if rs.status == self._c["ResultNotFound"] or len(rs.items) == 0:
+            return None
+        return rs.items[0]
+
+    def scan(self, offset, cutset, limit=100, table="main", reverse=False):
+        """Returns the ObjectItems of the keys in (offset, cutset]."""
+        mode = self._c["ObjectReaderModeKeyRange"]
+        if reverse:
+            mode |= self._c["ObjectReaderModeRevRange"]
+        rs = self.query(self._pb2.ObjectReader(
+            key_offset=offset, key_cutset=cutset, limit_num=limit,
+            table_name=table, mode=mode))
+        return list(rs.items)
+
+    def sys_cmd(self, method, body=None):
+        """Sends the SysCmd with the json body and returns the ObjectResult,
+        the result of the kvgo commands is the json value of the first item.
+        """
+        req = self._pb2.SysCmdRequest(
+            method=method, body=json.dumps(body or {}).encode())
+        return self._call(self._stub.SysCmd, req)
@@ -0,0 +1,375 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// The main nodes of a cluster are peers, each one of them coordinates the
+// writes it receives and pulls the logs of the others, so there is no leader
+// and follower. The upstream nodes are the nodes of the other clusters the
+// local node replicates from (Cluster.ReplicaOfNodes).
+const (
+	NodeRoleMain     = "main"
+	NodeRoleUpstream = "upstream"
+
+	NodeHealthUp   = "up"
+	NodeHealthDown = "down"
+)
+
+// NodeStatus is the status of a node in ClusterStatus. The LagTime is the
+// maximum time in milliseconds between the newest logs of the peers (or of
+// the upstream node) and the logs the node has pulled from them, and the
+// Tables are the tables held by the node.
+type NodeStatus struct {
+	Addr        string   `json:"addr"`
+	Role        string   `json:"role"`
+	Health      string   `json:"health"`
+	Version     string   `json:"version,omitempty"`
+	Uptime      int64    `json:"uptime,omitempty"`
+	LagTime     int64    `json:"lag_time"`
+	Tables      []string `json:"tables,omitempty"`
+	Removed     bool     `json:"removed,omitempty"`
+	Epoch       uint64   `json:"epoch,omitempty"`
+	Fenced      bool     `json:"fenced,omitempty"`
+	Maintenance bool     `json:"maintenance,omitempty"`
+	Message     string   `json:"message,omitempty"`
+}
+
+// ClusterStatusInfo is the topology of the cluster seen by the node Addr.
+type ClusterStatusInfo struct {
+	Addr    string        `json:"addr"`
+	Nodes   []*NodeStatus `json:"nodes"`
+	Updated int64         `json:"updated"`
+}
+
+type nodeStatusResult struct {
+	Addr        string                       `json:"addr"`
+	Version     string                       `json:"version"`
+	Uptime      int64                        `json:"uptime"`
+	Removed     bool                         `json:"removed,omitempty"`
+	Epoch       uint64                       `json:"epoch,omitempty"`
+	Fenced      bool                         `json:"fenced,omitempty"`
+	Maintenance bool                         `json:"maintenance,omitempty"`
+	Offsets     map[string]uint64            `json:"offsets"`
+	Pulled      map[string]map[string]uint64 `json:"pulled,omitempty"`
+}
+
+// nodeStatus returns the local log offsets of the tables and the offsets of
+// the logs pulled from the other main nodes and the upstream nodes.
+func (cn *Conn) nodeStatus() (*nodeStatusResult, error) {
+
+	ret := &nodeStatusResult{
+		Addr:        cn.opts.Server.Bind,
+		Version:     Version,
+		Uptime:      time.Now().Unix() - cn.uptime,
+		Removed:     cn.nodeRemoved(),
+		Maintenance: cn.Maintenance(),
+		Pulled:      map[string]map[string]uint64{},
+	}
+
+	epoch, seen := cn.memberEpoch()
+	ret.Epoch, ret.Fenced = epoch, seen > epoch
+
+	var err error
+	if ret.Offsets, err = cn.nodeLogOffsets(""); err != nil {
+		return nil, err
+	}
+
+	for _, v := range cn.mainNodes() {
+		if v.Addr == cn.opts.Server.Bind {
+			continue
+		}
+		if ret.Pulled[v.Addr], err = cn.nodeLogOffsets(v.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hp := range cn.replicaOfNodes() {
+
+		offsets, ok := ret.Pulled[hp.Addr]
+		if !ok {
+			offsets = map[string]uint64{}
+			ret.Pulled[hp.Addr] = offsets
+		}
+
+		for _, tm := range hp.TableMaps {
+			tdb := cn.tabledb(tm.To)
+			if tdb == nil {
+				continue
+			}
+			offset, err := tdb.objectLogAsyncOffset(hp.Addr, tm.From)
+			if err != nil {
+				return nil, err
+			}
+			offsets[tm.From] = offset
+		}
+	}
+
+	return ret, nil
+}
+
+func (tdb *dbTable) objectLogAsyncOffset(addr, tableName string) (uint64, error) {
+	bs, err := tdb.db.Get(keySysLogAsync(addr, tableName), nil)
+	if err != nil {
+		if err.Error() == ldbNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(string(bs), 10, 64)
+}
+
+// nodeStatusLag returns the lag time in milliseconds of the logs pulled by
+// the node from the peers.
+func nodeStatusLag(node *nodeStatusResult, peers []*nodeStatusResult) int64 {
+
+	lag := int64(0)
+
+	for _, peer := range peers {
+
+		if peer == nil || peer.Addr == node.Addr {
+			continue
+		}
+
+		pulled := node.Pulled[peer.Addr]
+
+		for name, offset := range peer.Offsets {
+			if v, ok := pulled[name]; ok && v < offset {
+				if ms := VersionTime(offset).Sub(VersionTime(v)).Milliseconds(); ms > lag {
+					lag = ms
+				}
+			}
+		}
+	}
+
+	return lag
+}
+
+// ClusterStatus returns the role, health, replication lag, tables and
+// version of the main nodes of the cluster and of the upstream nodes. The
+// nodes not reachable are reported as down.
+func (cn *Conn) ClusterStatus() (*ClusterStatusInfo, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		rs := cn.sysCmdRemote(&kv2.SysCmdRequest{
+			Method: "ClusterStatus",
+		})
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+
+		var info ClusterStatusInfo
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &info); err != nil {
+				return nil, err
+			}
+		}
+		return &info, nil
+	}
+
+	var (
+		mainNodes = cn.mainNodes()
+		nodes     = []*NodeStatus{}
+		results   = []*nodeStatusResult{}
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+
+	if len(mainNodes) == 0 {
+		mainNodes = []*ClientConfig{{Addr: cn.opts.Server.Bind}}
+	}
+
+	query := func(node *ClientConfig, role string) {
+
+		defer wg.Done()
+
+		var (
+			st = &NodeStatus{
+				Addr:   node.Addr,
+				Role:   role,
+				Health: NodeHealthUp,
+			}
+			ret *nodeStatusResult
+			err error
+		)
+
+		if node.Addr == cn.opts.Server.Bind {
+			ret, err = cn.nodeStatus()
+		} else {
+			ret = &nodeStatusResult{}
+			err = nodeCmdRemote(node, "NodeStatus", struct{}{}, ret)
+		}
+
+		if err != nil {
+			st.Health, st.Message, ret = NodeHealthDown, err.Error(), nil
+		} else {
+			st.Version, st.Uptime, st.Removed = ret.Version, ret.Uptime, ret.Removed
+			st.Epoch, st.Fenced = ret.Epoch, ret.Fenced
+			st.Maintenance = ret.Maintenance
+			ret.Addr = node.Addr
+			for name := range ret.Offsets {
+				st.Tables = append(st.Tables, name)
+			}
+			sort.Strings(st.Tables)
+		}
+
+		mu.Lock()
+		nodes = append(nodes, st)
+		results = append(results, ret)
+		mu.Unlock()
+	}
+
+	for _, v := range mainNodes {
+		wg.Add(1)
+		go query(v, NodeRoleMain)
+	}
+
+	for _, v := range cn.replicaOfNodes() {
+		if v.ClientConfig == nil || v.Addr == "" {
+			continue
+		}
+		wg.Add(1)
+		go query(v.ClientConfig, NodeRoleUpstream)
+	}
+
+	wg.Wait()
+
+	for i, st := range nodes {
+		if results[i] == nil {
+			continue
+		}
+		if st.Role == NodeRoleMain {
+			st.LagTime = nodeStatusLag(results[i], results)
+		} else if st.Addr != cn.opts.Server.Bind {
+			// the lag of the local node pulling from the upstream
+			for j, v := range results {
+				if v != nil && nodes[j].Addr == cn.opts.Server.Bind {
+					st.LagTime = nodeStatusLag(v, []*nodeStatusResult{results[i]})
+				}
+			}
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Role != nodes[j].Role {
+			return nodes[i].Role == NodeRoleMain
+		}
+		return nodes[i].Addr < nodes[j].Addr
+	})
+
+	return &ClusterStatusInfo{
+		Addr:    cn.opts.Server.Bind,
+		Nodes:   nodes,
+		Updated: time.Now().UnixNano() / 1e6,
+	}, nil
+}
+
+func (cn *Conn) clusterStatusCmdLocal(av appValidator, method string) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var (
+		ret interface{}
+		err error
+	)
+
+	switch method {
+	case "NodeStatus":
+		ret, err = cn.nodeStatus()
+	case "ClusterStatus":
+		ret, err = cn.ClusterStatus()
+	default:
+		return kv2.NewObjectResultClientError(errors.New("cmd not found"))
+	}
+
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
+
+var clusterStatusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>kvgo cluster status</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.up { color: #080; }
+.down { color: #c00; }
+</style>
+</head>
+<body>
+<h3>kvgo cluster status</h3>
+<p>node {{.Addr}}</p>
+<table>
+<tr><th>Addr</th><th>Role</th><th>Health</th><th>Lag (ms)</th><th>Tables</th><th>Version</th><th>Uptime (s)</th><th>Message</th></tr>
+{{range .Nodes}}<tr>
+<td>{{.Addr}}{{if .Removed}} (removed){{end}}{{if .Fenced}} (fenced){{end}}{{if .Maintenance}} (maintenance){{end}}</td>
+<td>{{.Role}}</td>
+<td class="{{.Health}}">{{.Health}}</td>
+<td>{{.LagTime}}</td>
+<td>{{range $i, $v := .Tables}}{{if $i}}, {{end}}{{$v}}{{end}}</td>
+<td>{{.Version}}</td>
+<td>{{.Uptime}}</td>
+<td>{{.Message}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (cn *Conn) httpClusterStatus(w http.ResponseWriter, r *http.Request) {
+
+	info, err := cn.ClusterStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path == "/status.json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	clusterStatusTemplate.Execute(w, info)
+}
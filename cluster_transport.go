@@ -0,0 +1,90 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// clusterTransport sends the proposals of the cluster commits and the node
+// local system commands to the main nodes, it is replaced by the simulated network in the simulation tests.
+type clusterTransport interface {
+	Prepare(ctx context.Context, node *ClientConfig, rr *kv2.ObjectWriter) (*kv2.ObjectResult, error)
+	Accept(ctx context.Context, node *ClientConfig, rr *kv2.ObjectWriter) (*kv2.ObjectResult, error)
+	SysCmd(ctx context.Context, node *ClientConfig, req *kv2.SysCmdRequest) (*kv2.ObjectResult, error)
+}
+
+type grpcClusterTransport struct{}
+
+func (grpcClusterTransport) Prepare(ctx context.Context,
+	node *ClientConfig, rr *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
+
+	conn, err := clientConn(node.Addr, node.AccessKey, node.RequestSign, node.AuthTLSCert, node.Keepalive, false)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := kv2.NewInternalClient(conn).Prepare(ctx, rr)
+	if err != nil {
+		if conn, err = clientConn(node.Addr, node.AccessKey, node.RequestSign, node.AuthTLSCert, node.Keepalive, true); err != nil {
+			return nil, err
+		}
+		rs, err = kv2.NewInternalClient(conn).Prepare(ctx, rr)
+	}
+
+	return rs, err
+}
+
+func (grpcClusterTransport) Accept(ctx context.Context,
+	node *ClientConfig, rr *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
+
+	conn, err := clientConn(node.Addr, node.AccessKey, node.RequestSign, node.AuthTLSCert, node.Keepalive, false)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := kv2.NewInternalClient(conn).Accept(ctx, rr)
+	if err != nil {
+		if conn, err = clientConn(node.Addr, node.AccessKey, node.RequestSign, node.AuthTLSCert, node.Keepalive, true); err != nil {
+			return nil, err
+		}
+		rs, err = kv2.NewInternalClient(conn).Accept(ctx, rr)
+	}
+
+	return rs, err
+}
+
+func (grpcClusterTransport) SysCmd(ctx context.Context,
+	node *ClientConfig, req *kv2.SysCmdRequest) (*kv2.ObjectResult, error) {
+
+	conn, err := clientConn(node.Addr, node.AccessKey, node.RequestSign, node.AuthTLSCert, node.Keepalive, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return kv2.NewPublicClient(conn).SysCmd(ctx, req)
+}
+
+// timeNow returns the time of the proposals, from the simulated clock in
+// the simulation tests.
+func (cn *Conn) timeNow() time.Time {
+	if cn.clock != nil {
+		return cn.clock()
+	}
+	return time.Now()
+}
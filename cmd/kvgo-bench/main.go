@@ -0,0 +1,289 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// kvgo-bench runs a configurable workload against an embedded store or a
+// remote node, and prints the throughput and latency percentiles.
+//
+//	kvgo-bench -data_dir /tmp/kvgo-bench -read_ratio 0.9 -dist zipf
+//	kvgo-bench -addr 127.0.0.1:9100 -access_key_id 00000000 -access_key_secret xxx
+//
+// Options:
+//
+//	-data_dir           the data directory of the embedded store
+//	-addr               the address of the remote node (instead of data_dir)
+//	-access_key_id      the access key of the remote node
+//	-access_key_secret
+//	-read_ratio         the ratio of reads in [0, 1], default to 0.5
+//	-key_size           in bytes, default to 16
+//	-value_size         in bytes, default to 100
+//	-keys               the number of distinct keys, default to 100000
+//	-dist               the distribution of keys, uniform or zipf, default to uniform
+//	-zipf_s             the skew of the zipf distribution (> 1), default to 1.1
+//	-concurrency        the number of workers, default to 8
+//	-duration           in seconds, default to 10
+//	-preload            write all keys before the workload
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hflag4g/hflag"
+	"github.com/lynkdb/kvgo"
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+type benchConfig struct {
+	dataDir     string
+	addr        string
+	readRatio   float64
+	keySize     int
+	valueSize   int
+	keys        uint64
+	dist        string
+	zipfS       float64
+	concurrency int
+	duration    time.Duration
+	preload     bool
+}
+
+type benchResult struct {
+	reads     []time.Duration
+	writes    []time.Duration
+	readErrs  int
+	writeErrs int
+}
+
+func flagString(name, def string) string {
+	if v, ok := hflag.ValueOK(name); ok && v.String() != "" {
+		return v.String()
+	}
+	return def
+}
+
+func flagInt(name string, def int) int {
+	if v, err := strconv.Atoi(flagString(name, "")); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func flagFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(flagString(name, ""), 64); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+func main() {
+
+	cfg := &benchConfig{
+		dataDir:     flagString("data_dir", "/tmp/kvgo-bench"),
+		addr:        flagString("addr", ""),
+		readRatio:   flagFloat("read_ratio", 0.5),
+		keySize:     flagInt("key_size", 16),
+		valueSize:   flagInt("value_size", 100),
+		keys:        uint64(flagInt("keys", 100000)),
+		dist:        flagString("dist", "uniform"),
+		zipfS:       flagFloat("zipf_s", 1.1),
+		concurrency: flagInt("concurrency", 8),
+		duration:    time.Duration(flagInt("duration", 10)) * time.Second,
+	}
+	if _, ok := hflag.ValueOK("preload"); ok {
+		cfg.preload = true
+	}
+
+	if cfg.readRatio > 1 {
+		cfg.readRatio = 1
+	}
+	if cfg.keySize < 8 {
+		cfg.keySize = 8
+	}
+	if cfg.zipfS <= 1 {
+		cfg.zipfS = 1.1
+	}
+
+	if err := run(cfg); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+func open(cfg *benchConfig) (kv2.Client, error) {
+
+	if cfg.addr != "" {
+		c := &kvgo.ClientConfig{
+			Addr: cfg.addr,
+			AccessKey: &hauth.AccessKey{
+				Id:     flagString("access_key_id", ""),
+				Secret: flagString("access_key_secret", ""),
+			},
+		}
+		return c.NewClient()
+	}
+
+	db, err := kvgo.Open(kvgo.ConfigStorage{
+		DataDirectory: cfg.dataDir,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return db.NewClient()
+}
+
+func run(cfg *benchConfig) error {
+
+	c, err := open(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	value := bytes.Repeat([]byte{'v'}, cfg.valueSize)
+
+	if cfg.preload {
+		tn := time.Now()
+		for i := uint64(0); i < cfg.keys; i++ {
+			if rs := c.NewWriter(benchKey(cfg, i), value).Commit(); !rs.OK() {
+				return rs.Error()
+			}
+		}
+		fmt.Printf("preload %d keys in %v\n", cfg.keys, time.Since(tn))
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]*benchResult, cfg.concurrency)
+		tn      = time.Now()
+	)
+
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = work(c, cfg, value, rand.New(rand.NewSource(tn.UnixNano()+int64(i))))
+		}(i)
+	}
+
+	wg.Wait()
+
+	var (
+		elapsed = time.Since(tn)
+		all     = &benchResult{}
+	)
+
+	for _, v := range results {
+		all.reads = append(all.reads, v.reads...)
+		all.writes = append(all.writes, v.writes...)
+		all.readErrs += v.readErrs
+		all.writeErrs += v.writeErrs
+	}
+
+	fmt.Printf("mode %s, dist %s, read ratio %.2f, key %d B, value %d B, keys %d, concurrency %d\n",
+		mode(cfg), cfg.dist, cfg.readRatio, cfg.keySize, cfg.valueSize, cfg.keys, cfg.concurrency)
+	fmt.Printf("total %d ops in %v, %.0f ops/s\n",
+		len(all.reads)+len(all.writes), elapsed,
+		float64(len(all.reads)+len(all.writes))/elapsed.Seconds())
+
+	report("read", all.reads, all.readErrs, elapsed)
+	report("write", all.writes, all.writeErrs, elapsed)
+
+	return nil
+}
+
+func mode(cfg *benchConfig) string {
+	if cfg.addr != "" {
+		return "remote"
+	}
+	return "embedded"
+}
+
+func benchKey(cfg *benchConfig, n uint64) []byte {
+	key := make([]byte, cfg.keySize)
+	copy(key, fmt.Sprintf("%0*d", cfg.keySize, n))
+	return key
+}
+
+func work(c kv2.Client, cfg *benchConfig, value []byte, rnd *rand.Rand) *benchResult {
+
+	var (
+		res   = &benchResult{}
+		zipf  *rand.Zipf
+		until = time.Now().Add(cfg.duration)
+	)
+
+	if cfg.dist == "zipf" {
+		zipf = rand.NewZipf(rnd, cfg.zipfS, 1, cfg.keys-1)
+	}
+
+	for time.Now().Before(until) {
+
+		var n uint64
+		if zipf != nil {
+			n = zipf.Uint64()
+		} else {
+			n = uint64(rnd.Int63n(int64(cfg.keys)))
+		}
+
+		var (
+			key = benchKey(cfg, n)
+			tn  = time.Now()
+		)
+
+		if rnd.Float64() < cfg.readRatio {
+			if rs := c.NewReader(key).Query(); !rs.OK() && !rs.NotFound() {
+				res.readErrs += 1
+			} else {
+				res.reads = append(res.reads, time.Since(tn))
+			}
+		} else {
+			if rs := c.NewWriter(key, value).Commit(); !rs.OK() {
+				res.writeErrs += 1
+			} else {
+				res.writes = append(res.writes, time.Since(tn))
+			}
+		}
+	}
+
+	return res
+}
+
+func report(name string, ls []time.Duration, errs int, elapsed time.Duration) {
+
+	if len(ls) == 0 {
+		fmt.Printf("%-5s  none, errors %d\n", name, errs)
+		return
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i] < ls[j]
+	})
+
+	pct := func(p float64) time.Duration {
+		return ls[int(float64(len(ls)-1)*p)]
+	}
+
+	fmt.Printf("%-5s  %d ops, %.0f ops/s, errors %d\n",
+		name, len(ls), float64(len(ls))/elapsed.Seconds(), errs)
+	fmt.Printf("       p50 %v, p90 %v, p99 %v, p999 %v, max %v\n",
+		pct(0.5), pct(0.9), pct(0.99), pct(0.999), ls[len(ls)-1])
+}
@@ -0,0 +1,340 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lynkdb/kvgo"
+)
+
+const rollingRestartPoll = 2 * time.Second
+
+func cmdCluster() error {
+
+	if len(os.Args) < 3 {
+		return errors.New("usage: kvgo-cli cluster <rolling-restart|chaos> [options]")
+	}
+
+	switch os.Args[2] {
+	case "rolling-restart":
+		return cmdClusterRollingRestart()
+	case "chaos":
+		return cmdClusterChaos()
+	}
+
+	return fmt.Errorf("unknown command cluster %s", os.Args[2])
+}
+
+func flagInt64(name string, def int64) int64 {
+	if v, err := strconv.ParseInt(flagString(name, ""), 10, 64); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+type rollingRestartNode struct {
+	Uptime int64 `json:"uptime"`
+}
+
+func cmdClusterRollingRestart() error {
+
+	var info kvgo.ClusterStatusInfo
+	if err := sysCmd("ClusterStatus", struct{}{}, &info); err != nil {
+		return err
+	}
+
+	var (
+		timeout = time.Duration(flagInt64("timeout", 600)) * time.Second
+		maxLag  = flagInt64("max_lag", 1000)
+		nodes   = []string{}
+	)
+
+	for _, v := range info.Nodes {
+		if v.Role != kvgo.NodeRoleMain || v.Removed {
+			continue
+		}
+		if v.Health != kvgo.NodeHealthUp {
+			return fmt.Errorf("node %s is %s, the cluster is not healthy", v.Addr, v.Health)
+		}
+		nodes = append(nodes, v.Addr)
+	}
+
+	if len(nodes) == 0 {
+		return errors.New("no main nodes found")
+	}
+
+	for i, addr := range nodes {
+
+		// the leadership is transferred to the next node, which puts the
+		// node in maintenance once the next node has caught up with it
+		if len(nodes) > 1 {
+			target := nodes[(i+1)%len(nodes)]
+			fmt.Printf("[%d/%d] %s leadership transfer to %s\n", i+1, len(nodes), addr, target)
+			if err := sysCmdAddr(addr, "TransferLeadership", map[string]string{
+				"target": target,
+			}, nil); err != nil {
+				return err
+			}
+		} else if err := sysCmdAddr(addr, "NodeMaintenance", map[string]bool{
+			"enable": true,
+		}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("[%d/%d] %s maintenance on\n", i+1, len(nodes), addr)
+
+		var st rollingRestartNode
+		if err := sysCmdAddr(addr, "NodeStatus", struct{}{}, &st); err != nil {
+			return err
+		}
+		tn := time.Now()
+
+		if cmd := flagString("exec", ""); cmd != "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			cmd = strings.NewReplacer("{addr}", addr, "{host}", host).Replace(cmd)
+			fmt.Printf("[%d/%d] %s restart: %s\n", i+1, len(nodes), addr, cmd)
+			if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+				return fmt.Errorf("node %s restart err %s, output %s", addr, err.Error(), string(out))
+			}
+		} else {
+			fmt.Printf("[%d/%d] %s waiting for the node to be restarted\n", i+1, len(nodes), addr)
+		}
+
+		// the node restarted if its uptime is less than the uptime read
+		// before plus the time elapsed since, with a margin of the rounding
+		// of the seconds
+		if err := rollingRestartWait(timeout, func() bool {
+			var st2 rollingRestartNode
+			err := sysCmdAddr(addr, "NodeStatus", struct{}{}, &st2)
+			return err == nil && st2.Uptime+2 < st.Uptime+int64(time.Since(tn)/time.Second)
+		}); err != nil {
+			return fmt.Errorf("node %s not restarted in %v, still in maintenance", addr, timeout)
+		}
+
+		fmt.Printf("[%d/%d] %s restarted, waiting for the cluster to be healthy\n", i+1, len(nodes), addr)
+		if err := rollingRestartWait(timeout, func() bool {
+			return rollingRestartHealthy(addr, nodes, maxLag)
+		}); err != nil {
+			return fmt.Errorf("node %s not caught up in %v, still in maintenance", addr, timeout)
+		}
+
+		if err := sysCmdAddr(addr, "NodeMaintenance", map[string]bool{
+			"enable": false,
+		}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("[%d/%d] %s maintenance off\n", i+1, len(nodes), addr)
+	}
+
+	fmt.Printf("%d nodes restarted\n", len(nodes))
+
+	return nil
+}
+
+// rollingRestartHealthy returns whether all the main nodes are up and the
+// node addr lags behind the others no more than maxLag milliseconds.
+func rollingRestartHealthy(addr string, nodes []string, maxLag int64) bool {
+
+	var info kvgo.ClusterStatusInfo
+	if err := sysCmdAddr(addr, "ClusterStatus", struct{}{}, &info); err != nil {
+		return false
+	}
+
+	up := map[string]bool{}
+	for _, v := range info.Nodes {
+		if v.Role != kvgo.NodeRoleMain || v.Health != kvgo.NodeHealthUp {
+			continue
+		}
+		if v.Addr == addr && v.LagTime > maxLag {
+			return false
+		}
+		up[v.Addr] = true
+	}
+
+	for _, v := range nodes {
+		if !up[v] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func rollingRestartWait(timeout time.Duration, fn func() bool) error {
+	for tn := time.Now(); time.Since(tn) < timeout; time.Sleep(rollingRestartPoll) {
+		if fn() {
+			return nil
+		}
+	}
+	return errors.New("timeout")
+}
+
+// chaosFault injects the fault into the node and returns the function
+// recovering it.
+func chaosFault(fault, addr string, duration time.Duration) (func() error, error) {
+
+	run := func(flag string) error {
+		cmd := flagString(flag, "")
+		if cmd == "" {
+			return nil
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cmd = strings.NewReplacer("{addr}", addr, "{host}", host).Replace(cmd)
+		fmt.Printf("%s %s: %s\n", addr, flag, cmd)
+		if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+			return fmt.Errorf("node %s %s err %s, output %s", addr, flag, err.Error(), string(out))
+		}
+		return nil
+	}
+
+	failpoint := func(name string, delay int64) (func() error, error) {
+		// the node disables the failpoint itself a while after the drill,
+		// in case the drill is interrupted
+		if err := sysCmdAddr(addr, "NodeFailpoint", &kvgo.NodeFailpointRequest{
+			Name:     name,
+			Enable:   true,
+			Delay:    delay,
+			Duration: int64(duration/time.Second) + 60,
+		}, nil); err != nil {
+			return nil, err
+		}
+		return func() error {
+			return sysCmdAddr(addr, "NodeFailpoint", &kvgo.NodeFailpointRequest{
+				Name: name,
+			}, nil)
+		}, nil
+	}
+
+	switch fault {
+
+	case "kill":
+		if flagString("exec", "") == "" {
+			return nil, errors.New("no -exec command setup to kill the node")
+		}
+		if err := run("exec"); err != nil {
+			return nil, err
+		}
+		return func() error {
+			return run("recover")
+		}, nil
+
+	case "pause":
+		if flagString("exec", "") != "" {
+			if err := run("exec"); err != nil {
+				return nil, err
+			}
+			return func() error {
+				return run("recover")
+			}, nil
+		}
+		// without the -exec command the requests of the node are stalled
+		return failpoint(kvgo.FailpointRpcLatency, int64(duration/time.Millisecond))
+
+	case "partition":
+		return failpoint(kvgo.FailpointPartition, 0)
+	}
+
+	return nil, fmt.Errorf("unknown fault %s", fault)
+}
+
+func cmdClusterChaos() error {
+
+	if len(os.Args) < 4 {
+		return errors.New("usage: kvgo-cli cluster chaos <kill|pause|partition> [options]")
+	}
+
+	var info kvgo.ClusterStatusInfo
+	if err := sysCmd("ClusterStatus", struct{}{}, &info); err != nil {
+		return err
+	}
+
+	var (
+		fault    = os.Args[3]
+		addr     = flagString("node", "")
+		duration = time.Duration(flagInt64("duration", 30)) * time.Second
+		timeout  = time.Duration(flagInt64("timeout", 600)) * time.Second
+		maxLag   = flagInt64("max_lag", 1000)
+		nodes    = []string{}
+	)
+
+	for _, v := range info.Nodes {
+		if v.Role != kvgo.NodeRoleMain || v.Removed {
+			continue
+		}
+		if v.Health != kvgo.NodeHealthUp {
+			return fmt.Errorf("node %s is %s, the cluster is not healthy", v.Addr, v.Health)
+		}
+		nodes = append(nodes, v.Addr)
+	}
+
+	if len(nodes) < 2 {
+		return errors.New("at least 2 main nodes required")
+	}
+
+	if addr == "" {
+		// a random node but the one of -addr, which reports the status
+		for _, v := range nodes {
+			if v != flagString("addr", "127.0.0.1:9100") {
+				addr = v
+				break
+			}
+		}
+	}
+
+	found := false
+	for _, v := range nodes {
+		found = found || v == addr
+	}
+	if !found {
+		return fmt.Errorf("node %s is not a main node of the cluster", addr)
+	}
+
+	fmt.Printf("%s %s for %v\n", addr, fault, duration)
+	heal, err := chaosFault(fault, addr, duration)
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(duration)
+
+	if err := heal(); err != nil {
+		return err
+	}
+	fmt.Printf("%s recovered, waiting for the cluster to converge\n", addr)
+
+	tn := time.Now()
+	if err := rollingRestartWait(timeout, func() bool {
+		return rollingRestartHealthy(addr, nodes, maxLag)
+	}); err != nil {
+		return fmt.Errorf("the cluster not converged in %v", timeout)
+	}
+
+	fmt.Printf("the cluster converged in %v\n", time.Since(tn).Round(time.Second))
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hooto/hflag4g/hflag"
+	"github.com/lynkdb/kvgo"
+)
+
+func cmdInspect() error {
+
+	if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+		return errors.New("usage: kvgo-cli inspect <dir> [-json]")
+	}
+
+	rep, err := kvgo.Inspect(os.Args[2])
+	if err != nil {
+		return err
+	}
+
+	if _, ok := hflag.ValueOK("json"); ok {
+		bs, _ := json.MarshalIndent(rep, "", "  ")
+		fmt.Println(string(bs))
+		return nil
+	}
+
+	fmt.Printf("directory  %s\n", rep.Directory)
+	if rep.Layout != nil {
+		fmt.Printf("layout     version %d, engine %s, release %s\n",
+			rep.Layout.Version, rep.Layout.Engine, rep.Layout.Release)
+	} else {
+		fmt.Println("layout     unknown")
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tID\tFORMAT\tTABLES/LEVEL\tMETA(MB)\tDATA(MB)\tLOG(MB)\tLOG-OFFSET")
+	for _, t := range rep.Tables {
+		levels := []string{}
+		for _, n := range t.LevelTables {
+			levels = append(levels, fmt.Sprint(n))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%.1f\t%.1f\t%.1f\t%d\n",
+			t.Name, t.Id, t.FormatVersion, strings.Join(levels, ","),
+			float64(t.MetaSize)/(1<<20), float64(t.DataSize)/(1<<20),
+			float64(t.LogSize)/(1<<20), t.LogOffset)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	if len(rep.Issues) == 0 {
+		fmt.Println("no issues found")
+	}
+	for _, v := range rep.Issues {
+		fmt.Println("issue:", v)
+	}
+
+	return nil
+}
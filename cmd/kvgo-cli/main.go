@@ -0,0 +1,244 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// kvgo-cli is the command line tool of the administration of kvgo nodes.
+//
+//	kvgo-cli status -addr 127.0.0.1:9100 -access_key_id 00000000 -access_key_secret xxx
+//
+// Commands:
+//
+//	status              prints the role, health, replication lag, tables and
+//	                    version of the nodes of the cluster
+//	maintenance         turns the maintenance of the node on (-enable) or
+//	                    off, the node drains the clients and pauses the
+//	                    scheduled backups and compactions
+//	transfer-leadership hands the client requests of the node over to the
+//	                    main node -target before a maintenance, the node is
+//	                    put in maintenance, and taken out of it again if the
+//	                    target does not catch up with it
+//	cluster rolling-restart
+//	                    restarts the main nodes of the cluster one by one,
+//	                    the leadership of each node is transferred to the
+//	                    next node (which puts it in maintenance), the node
+//	                    is restarted by the -exec command (or by hand), and
+//	                    put back in service once the cluster is healthy and
+//	                    the node has caught up with the others
+//	cluster chaos <kill|pause|partition>
+//	                    the resilience drill, injects the fault into a main
+//	                    node (-node) for -duration seconds, recovers it and
+//	                    verifies the cluster converges: all main nodes up
+//	                    and the node caught up with the others. The kill
+//	                    (and optionally pause) runs the -exec command and
+//	                    the -recover command after, the partition (and the
+//	                    pause without -exec) injects the failpoints of the
+//	                    node, which must be built with the failpoint tag
+//	inspect <dir>       reports the layout version, the tables (levels, meta,
+//	                    data and log sizes) and the inconsistencies of a data
+//	                    directory, offline and read-only, run it on a copy of
+//	                    the directory of a running node
+//
+// Options:
+//
+//	-addr               the address of the node
+//	-access_key_id      the access key of the node (of the sa role)
+//	-access_key_secret
+//	-json               prints the result in json
+//	-enable             (maintenance) turns the maintenance on
+//	-target             (transfer-leadership) the address of the main node
+//	                    taking the leadership over
+//	-exec               (rolling-restart) the command restarting a node, run
+//	                    by sh -c with {addr} and {host} replaced by the
+//	                    address and the host of the node, e.g.
+//	                    "ssh {host} systemctl restart kvgo"
+//	                    (chaos) the command injecting the fault, e.g.
+//	                    "ssh {host} systemctl kill -s KILL kvgo"
+//	-recover            (chaos) the command recovering the fault, run as
+//	                    -exec, e.g. "ssh {host} systemctl start kvgo"
+//	-node               (chaos) the address of the node, default to a main
+//	                    node other than -addr
+//	-duration           (chaos) the seconds of the fault, default 30
+//	-timeout            (rolling-restart, chaos) the seconds waiting for a
+//	                    node to restart and catch up, default 600
+//	-max_lag            (rolling-restart, chaos) the replication lag in
+//	                    milliseconds of a caught up node, default 1000
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hflag4g/hflag"
+	"github.com/lynkdb/kvgo"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+func flagString(name, def string) string {
+	if v, ok := hflag.ValueOK(name); ok && v.String() != "" {
+		return v.String()
+	}
+	return def
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Println("usage: kvgo-cli <command> [options]")
+		os.Exit(1)
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "status":
+		err = cmdStatus()
+	case "maintenance":
+		err = cmdMaintenance()
+	case "transfer-leadership":
+		err = cmdTransferLeadership()
+	case "cluster":
+		err = cmdCluster()
+	case "inspect":
+		err = cmdInspect()
+	default:
+		err = fmt.Errorf("unknown command %s", os.Args[1])
+	}
+
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+}
+
+func sysCmd(method string, req, ret interface{}) error {
+	return sysCmdAddr(flagString("addr", "127.0.0.1:9100"), method, req, ret)
+}
+
+func sysCmdAddr(addr, method string, req, ret interface{}) error {
+
+	c, err := (&kvgo.ClientConfig{
+		Addr: addr,
+		AccessKey: &hauth.AccessKey{
+			Id:     flagString("access_key_id", ""),
+			Secret: flagString("access_key_secret", ""),
+		},
+	}).NewClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rs := c.Connector().SysCmd(&kv2.SysCmdRequest{
+		Method: method,
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return rs.Error()
+	}
+
+	if ret != nil && len(rs.Items) > 0 {
+		return json.Unmarshal(rs.DataValue().Bytes(), ret)
+	}
+
+	return nil
+}
+
+func cmdStatus() error {
+
+	var info kvgo.ClusterStatusInfo
+	if err := sysCmd("ClusterStatus", struct{}{}, &info); err != nil {
+		return err
+	}
+
+	if _, ok := hflag.ValueOK("json"); ok {
+		bs, _ := json.MarshalIndent(&info, "", "  ")
+		fmt.Println(string(bs))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDR\tROLE\tHEALTH\tLAG(ms)\tTABLES\tVERSION\tUPTIME(s)\tMESSAGE")
+	for _, v := range info.Nodes {
+		addr := v.Addr
+		if v.Removed {
+			addr += " (removed)"
+		}
+		if v.Fenced {
+			addr += " (fenced)"
+		}
+		if v.Maintenance {
+			addr += " (maintenance)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%s\n",
+			addr, v.Role, v.Health, v.LagTime, strings.Join(v.Tables, ","),
+			v.Version, v.Uptime, v.Message)
+	}
+
+	return w.Flush()
+}
+
+func cmdMaintenance() error {
+
+	_, enable := hflag.ValueOK("enable")
+
+	var ret struct {
+		Addr        string `json:"addr"`
+		Maintenance bool   `json:"maintenance"`
+	}
+	if err := sysCmd("NodeMaintenance", map[string]bool{
+		"enable": enable,
+	}, &ret); err != nil {
+		return err
+	}
+
+	if ret.Maintenance {
+		fmt.Printf("node %s in maintenance\n", ret.Addr)
+	} else {
+		fmt.Printf("node %s in service\n", ret.Addr)
+	}
+
+	return nil
+}
+
+func cmdTransferLeadership() error {
+
+	target := flagString("target", "")
+	if target == "" {
+		return errors.New("usage: kvgo-cli transfer-leadership -target <addr>")
+	}
+
+	var ret struct {
+		Addr   string `json:"addr"`
+		Target string `json:"target"`
+	}
+	if err := sysCmd("TransferLeadership", map[string]string{
+		"target": target,
+	}, &ret); err != nil {
+		return err
+	}
+
+	fmt.Printf("node %s leadership transferred to %s, node in maintenance\n", ret.Addr, ret.Target)
+
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	badgerBatchNum = 1000
+)
+
+// badgerWriter writes the backup format of Badger (DB.Backup/DB.Load), a
+// sequence of pb.KVList messages, each one prefixed by its size in uint64
+// little-endian. The messages are encoded by hand since there are only a
+// few fields:
+//
+//	message KVList { repeated KV kv = 1; }
+//	message KV {
+//	  bytes key = 1; bytes value = 2; bytes user_meta = 3;
+//	  uint64 version = 4; uint64 expires_at = 5; bytes meta = 6;
+//	}
+type badgerWriter struct {
+	w    *bufio.Writer
+	list []byte
+	num  int
+}
+
+func newBadgerWriter(w io.Writer) *badgerWriter {
+	return &badgerWriter{
+		w: bufio.NewWriter(w),
+	}
+}
+
+func pbAppendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func pbAppendBytes(buf []byte, field int, bs []byte) []byte {
+	buf = pbAppendVarint(buf, uint64(field<<3|2))
+	buf = pbAppendVarint(buf, uint64(len(bs)))
+	return append(buf, bs...)
+}
+
+func pbAppendUint64(buf []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = pbAppendVarint(buf, uint64(field<<3))
+	return pbAppendVarint(buf, v)
+}
+
+func (it *badgerWriter) Write(item *exportItem) error {
+
+	kv := pbAppendBytes(nil, 1, item.key)
+	kv = pbAppendBytes(kv, 2, item.value)
+	// the version is the commit timestamp of the key in badger, must be > 0
+	version := item.version
+	if version == 0 {
+		version = 1
+	}
+	kv = pbAppendUint64(kv, 4, version)
+	kv = pbAppendUint64(kv, 5, item.expired/1000)
+
+	it.list = pbAppendBytes(it.list, 1, kv)
+
+	if it.num += 1; it.num >= badgerBatchNum {
+		return it.flush()
+	}
+	return nil
+}
+
+func (it *badgerWriter) flush() error {
+
+	if it.num == 0 {
+		return nil
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(it.list)))
+	if _, err := it.w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := it.w.Write(it.list); err != nil {
+		return err
+	}
+
+	it.list, it.num = it.list[:0], 0
+
+	return nil
+}
+
+func (it *badgerWriter) Close() error {
+	if err := it.flush(); err != nil {
+		return err
+	}
+	return it.w.Flush()
+}
@@ -0,0 +1,274 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"os"
+)
+
+// The on-disk layout of BoltDB (bbolt) version 2, in little-endian:
+//
+//	page header:  id u64, flags u16, count u16, overflow u32
+//	meta:         magic u32, version u32, page_size u32, flags u32,
+//	              root {root u64, sequence u64}, freelist u64, pgid u64,
+//	              txid u64, checksum u64 (fnv64a of the fields before)
+//	leaf element:   flags u32, pos u32, ksize u32, vsize u32
+//	branch element: pos u32, ksize u32, pgid u64
+//
+// The pos of an element is the offset of its key from the element.
+const (
+	boltPageSize         = 4096
+	boltPageHeaderSize   = 16
+	boltElementSize      = 16
+	boltMagic            = 0xED0CDAED
+	boltVersion          = 2
+	boltBranchPageFlag   = 0x01
+	boltLeafPageFlag     = 0x02
+	boltMetaPageFlag     = 0x04
+	boltFreelistPageFlag = 0x10
+	boltBucketLeafFlag   = 0x01
+)
+
+type boltEntry struct {
+	key   []byte
+	value []byte
+	pgid  uint64
+	flags uint32
+}
+
+// boltWriter writes a bolt file with one bucket of the items, the pages of
+// the b+tree are written bottom-up as the (sorted) items arrive:
+//
+//	0, 1: meta, 2: freelist (empty), 3..n-1: the bucket, n: the root bucket
+type boltWriter struct {
+	fp       *os.File
+	bucket   []byte
+	pgid     uint64
+	leaf     []*boltEntry
+	leafSize int
+	branches []*boltEntry
+}
+
+func newBoltWriter(fp *os.File, bucket []byte) *boltWriter {
+	return &boltWriter{
+		fp:     fp,
+		bucket: bucket,
+		pgid:   3,
+	}
+}
+
+func (it *boltWriter) Write(item *exportItem) error {
+
+	size := boltElementSize + len(item.key) + len(item.value)
+
+	if len(it.leaf) > 0 && it.leafSize+size > boltPageSize {
+		if err := it.flushLeaf(); err != nil {
+			return err
+		}
+	}
+
+	it.leaf = append(it.leaf, &boltEntry{
+		key:   item.key,
+		value: item.value,
+	})
+	it.leafSize += size
+
+	return nil
+}
+
+// writePage writes the page at the next page id and returns the id.
+func (it *boltWriter) writePage(flags uint16, entries []*boltEntry) (uint64, error) {
+
+	size := boltPageHeaderSize + boltElementSize*len(entries)
+	for _, v := range entries {
+		size += len(v.key) + len(v.value)
+	}
+
+	var (
+		pages = (size + boltPageSize - 1) / boltPageSize
+		buf   = make([]byte, pages*boltPageSize)
+		pgid  = it.pgid
+		off   = boltPageHeaderSize + boltElementSize*len(entries)
+	)
+
+	binary.LittleEndian.PutUint64(buf[0:], pgid)
+	binary.LittleEndian.PutUint16(buf[8:], flags)
+	binary.LittleEndian.PutUint16(buf[10:], uint16(len(entries)))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(pages-1))
+
+	for i, v := range entries {
+
+		elem := buf[boltPageHeaderSize+boltElementSize*i:]
+		pos := uint32(off - (boltPageHeaderSize + boltElementSize*i))
+
+		if flags == boltBranchPageFlag {
+			binary.LittleEndian.PutUint32(elem[0:], pos)
+			binary.LittleEndian.PutUint32(elem[4:], uint32(len(v.key)))
+			binary.LittleEndian.PutUint64(elem[8:], v.pgid)
+		} else {
+			binary.LittleEndian.PutUint32(elem[0:], v.flags)
+			binary.LittleEndian.PutUint32(elem[4:], pos)
+			binary.LittleEndian.PutUint32(elem[8:], uint32(len(v.key)))
+			binary.LittleEndian.PutUint32(elem[12:], uint32(len(v.value)))
+		}
+
+		off += copy(buf[off:], v.key)
+		off += copy(buf[off:], v.value)
+	}
+
+	if _, err := it.fp.WriteAt(buf, int64(pgid)*boltPageSize); err != nil {
+		return 0, err
+	}
+
+	it.pgid += uint64(pages)
+
+	return pgid, nil
+}
+
+func (it *boltWriter) flushLeaf() error {
+
+	pgid, err := it.writePage(boltLeafPageFlag, it.leaf)
+	if err != nil {
+		return err
+	}
+
+	entry := &boltEntry{
+		pgid: pgid,
+	}
+	if len(it.leaf) > 0 {
+		entry.key = it.leaf[0].key
+	}
+	it.branches = append(it.branches, entry)
+	it.leaf, it.leafSize = nil, 0
+
+	return nil
+}
+
+// writeBranches writes the branch levels and returns the root page id.
+func (it *boltWriter) writeBranches() (uint64, error) {
+
+	level := it.branches
+
+	for len(level) > 1 {
+
+		var (
+			next []*boltEntry
+			page []*boltEntry
+			size = boltPageHeaderSize
+		)
+
+		flush := func() error {
+			pgid, err := it.writePage(boltBranchPageFlag, page)
+			if err != nil {
+				return err
+			}
+			next = append(next, &boltEntry{
+				key:  page[0].key,
+				pgid: pgid,
+			})
+			page, size = nil, boltPageHeaderSize
+			return nil
+		}
+
+		for _, v := range level {
+			if len(page) > 1 && size+boltElementSize+len(v.key) > boltPageSize {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+			page = append(page, v)
+			size += boltElementSize + len(v.key)
+		}
+
+		if err := flush(); err != nil {
+			return 0, err
+		}
+
+		level = next
+	}
+
+	return level[0].pgid, nil
+}
+
+func (it *boltWriter) writeMeta(root, txid uint64) error {
+
+	buf := make([]byte, boltPageSize)
+
+	binary.LittleEndian.PutUint64(buf[0:], txid%2)
+	binary.LittleEndian.PutUint16(buf[8:], boltMetaPageFlag)
+
+	m := buf[boltPageHeaderSize:]
+	binary.LittleEndian.PutUint32(m[0:], boltMagic)
+	binary.LittleEndian.PutUint32(m[4:], boltVersion)
+	binary.LittleEndian.PutUint32(m[8:], boltPageSize)
+	binary.LittleEndian.PutUint64(m[16:], root)
+	binary.LittleEndian.PutUint64(m[32:], 2)
+	binary.LittleEndian.PutUint64(m[40:], it.pgid)
+	binary.LittleEndian.PutUint64(m[48:], txid)
+
+	h := fnv.New64a()
+	h.Write(m[:56])
+	binary.LittleEndian.PutUint64(m[56:], h.Sum64())
+
+	_, err := it.fp.WriteAt(buf, int64(txid%2)*boltPageSize)
+	return err
+}
+
+func (it *boltWriter) Close() error {
+
+	if len(it.leaf) > 0 || len(it.branches) == 0 {
+		if err := it.flushLeaf(); err != nil {
+			return err
+		}
+	}
+
+	root, err := it.writeBranches()
+	if err != nil {
+		return err
+	}
+
+	// the root bucket, with the bucket header {root, sequence} as the value
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, root)
+
+	rootBucket, err := it.writePage(boltLeafPageFlag, []*boltEntry{
+		{
+			key:   it.bucket,
+			value: value,
+			flags: boltBucketLeafFlag,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the empty freelist
+	buf := make([]byte, boltPageSize)
+	binary.LittleEndian.PutUint64(buf[0:], 2)
+	binary.LittleEndian.PutUint16(buf[8:], boltFreelistPageFlag)
+	if _, err := it.fp.WriteAt(buf, 2*boltPageSize); err != nil {
+		return err
+	}
+
+	for txid := uint64(0); txid < 2; txid++ {
+		if err := it.writeMeta(rootBucket, txid); err != nil {
+			return err
+		}
+	}
+
+	return it.fp.Sync()
+}
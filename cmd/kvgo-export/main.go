@@ -0,0 +1,196 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// kvgo-export writes the items of a table into a Badger backup file or a
+// BoltDB file, which can be loaded back by kvgo-import.
+//
+//	kvgo-export -format badger -dst kvgo.bak -data_dir /data/kvgo
+//	kvgo-export -format bolt -dst kvgo.db -addr 127.0.0.1:9100 -access_key_id 00000000 -access_key_secret xxx
+//
+// Options:
+//
+//	-format             badger or bolt
+//	-dst                the file to write
+//	-data_dir           the data directory of the embedded store
+//	-addr               the address of the remote node (instead of data_dir)
+//	-access_key_id      the access key of the remote node
+//	-access_key_secret
+//	-table              the table to export, default to main
+//	-prefix             only the keys of the prefix are exported
+//	-bucket             the bucket of the bolt file, default to the table name
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hflag4g/hflag"
+	"github.com/lynkdb/kvgo"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	exportScanLimit = 1000
+)
+
+type exportItem struct {
+	key     []byte
+	value   []byte
+	version uint64
+	expired uint64 // unix time in milliseconds, 0 if no ttl
+}
+
+type exportWriter interface {
+	Write(item *exportItem) error
+	Close() error
+}
+
+func flagString(name, def string) string {
+	if v, ok := hflag.ValueOK(name); ok && v.String() != "" {
+		return v.String()
+	}
+	return def
+}
+
+func main() {
+
+	var (
+		format = flagString("format", "")
+		dst    = flagString("dst", "")
+		table  = flagString("table", "main")
+		tn     = time.Now()
+	)
+
+	if dst == "" {
+		fmt.Println("no dst setup")
+		os.Exit(1)
+	}
+
+	c, err := open()
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	fp, err := os.Create(dst)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	defer fp.Close()
+
+	var w exportWriter
+
+	switch format {
+	case "badger":
+		w = newBadgerWriter(fp)
+	case "bolt":
+		w = newBoltWriter(fp, []byte(flagString("bucket", table)))
+	default:
+		fmt.Println("invalid format")
+		os.Exit(1)
+	}
+
+	num, err := export(c, table, []byte(flagString("prefix", "")), w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("exported %d items in %v\n", num, time.Since(tn))
+}
+
+func open() (kv2.Client, error) {
+
+	if addr := flagString("addr", ""); addr != "" {
+		c := &kvgo.ClientConfig{
+			Addr: addr,
+			AccessKey: &hauth.AccessKey{
+				Id:     flagString("access_key_id", ""),
+				Secret: flagString("access_key_secret", ""),
+			},
+		}
+		return c.NewClient()
+	}
+
+	dir := flagString("data_dir", "")
+	if dir == "" {
+		return nil, errors.New("no data_dir or addr setup")
+	}
+
+	db, err := kvgo.Open(kvgo.ConfigStorage{
+		DataDirectory: dir,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return db.NewClient()
+}
+
+// export writes the items of the prefix in order of keys.
+func export(c kv2.Client, table string, prefix []byte, w exportWriter) (int64, error) {
+
+	var (
+		offset = prefix
+		cutset = append(append([]byte{}, prefix...), 0xff)
+		num    = int64(0)
+		tn     = uint64(time.Now().UnixNano() / 1e6)
+	)
+
+	for {
+
+		rs := c.NewReader(nil).TableNameSet(table).
+			KeyRangeSet(offset, cutset).LimitNumSet(exportScanLimit).Query()
+		if rs.NotFound() || (rs.OK() && len(rs.Items) == 0) {
+			break
+		} else if !rs.OK() {
+			return num, rs.Error()
+		}
+
+		for _, item := range rs.Items {
+
+			offset = item.Meta.Key
+
+			if item.Meta.Expired > 0 && item.Meta.Expired <= tn {
+				continue
+			}
+
+			if err := w.Write(&exportItem{
+				key:     item.Meta.Key,
+				value:   item.DataValue().Bytes(),
+				version: item.Meta.Version,
+				expired: item.Meta.Expired,
+			}); err != nil {
+				return num, err
+			}
+
+			num += 1
+		}
+
+		if len(rs.Items) < exportScanLimit {
+			break
+		}
+	}
+
+	return num, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	badgerBitDelete       = 1 << 0
+	badgerBitExpiredEntry = 1 << 1
+)
+
+func pbReadVarint(bs []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(bs) && i < 10; i++ {
+		v |= uint64(bs[i]&0x7f) << (7 * uint(i))
+		if bs[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("pb invalid varint")
+}
+
+// pbFields calls fn with the fields of the message, the value of the varint
+// fields is returned in v, and of the length-delimited fields in bs.
+func pbFields(msg []byte, fn func(field int, v uint64, bs []byte) error) error {
+
+	for len(msg) > 0 {
+
+		tag, n, err := pbReadVarint(msg)
+		if err != nil {
+			return err
+		}
+		msg = msg[n:]
+
+		var (
+			v  uint64
+			bs []byte
+		)
+
+		switch tag & 7 {
+
+		case 0:
+			if v, n, err = pbReadVarint(msg); err != nil {
+				return err
+			}
+
+		case 1:
+			n = 8
+
+		case 2:
+			size, n2, err := pbReadVarint(msg)
+			if err != nil {
+				return err
+			}
+			if uint64(len(msg)-n2) < size {
+				return errors.New("pb invalid length")
+			}
+			bs, n = msg[n2:n2+int(size)], n2+int(size)
+
+		case 5:
+			n = 4
+
+		default:
+			return errors.New("pb invalid wire type")
+		}
+
+		if n > len(msg) {
+			return errors.New("pb invalid length")
+		}
+		msg = msg[n:]
+
+		if err := fn(int(tag>>3), v, bs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importBadger loads a backup of Badger (DB.Backup), a sequence of pb.KVList
+// messages, each one prefixed by its size in uint64 little-endian.
+func (it *importer) importBadger(src string) error {
+
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var (
+		r  = bufio.NewReader(fp)
+		tn = uint64(time.Now().Unix())
+	)
+
+	for {
+
+		var size [8]byte
+		if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		list := make([]byte, binary.LittleEndian.Uint64(size[:]))
+		if _, err := io.ReadFull(r, list); err != nil {
+			return err
+		}
+
+		if err := pbFields(list, func(field int, _ uint64, kv []byte) error {
+
+			if field != 1 {
+				return nil
+			}
+
+			var (
+				key, value []byte
+				expires    uint64
+				meta       []byte
+			)
+
+			if err := pbFields(kv, func(field int, v uint64, bs []byte) error {
+				switch field {
+				case 1:
+					key = bs
+				case 2:
+					value = bs
+				case 5:
+					expires = v
+				case 6:
+					meta = bs
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if len(meta) > 0 && meta[0]&(badgerBitDelete|badgerBitExpiredEntry) != 0 {
+				it.skips += 1
+				return nil
+			}
+
+			var ttl int64
+			if expires > 0 {
+				if expires <= tn {
+					it.skips += 1
+					return nil
+				}
+				ttl = int64(expires-tn) * 1000
+			}
+
+			return it.put(key, value, ttl)
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+const (
+	boltPageHeaderSize = 16
+	boltElementSize    = 16
+	boltMagic          = 0xED0CDAED
+	boltBranchPageFlag = 0x01
+	boltLeafPageFlag   = 0x02
+	boltBucketLeafFlag = 0x01
+)
+
+type boltReader struct {
+	fp       *os.File
+	pageSize int
+}
+
+// page returns the page of the id with its overflow pages.
+func (it *boltReader) page(pgid uint64) ([]byte, error) {
+
+	head := make([]byte, boltPageHeaderSize)
+	if _, err := it.fp.ReadAt(head, int64(pgid)*int64(it.pageSize)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, (int(binary.LittleEndian.Uint32(head[12:]))+1)*it.pageSize)
+	if _, err := it.fp.ReadAt(buf, int64(pgid)*int64(it.pageSize)); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// walk calls fn with the leaf elements of the b+tree of the page in order.
+func (it *boltReader) walk(p []byte, fn func(flags uint32, key, value []byte) error) error {
+
+	var (
+		flags = binary.LittleEndian.Uint16(p[8:])
+		count = int(binary.LittleEndian.Uint16(p[10:]))
+	)
+
+	for i := 0; i < count; i++ {
+
+		elem := p[boltPageHeaderSize+boltElementSize*i:]
+
+		switch {
+
+		case flags&boltBranchPageFlag != 0:
+			child, err := it.page(binary.LittleEndian.Uint64(elem[8:]))
+			if err != nil {
+				return err
+			}
+			if err := it.walk(child, fn); err != nil {
+				return err
+			}
+
+		case flags&boltLeafPageFlag != 0:
+			var (
+				pos   = int(binary.LittleEndian.Uint32(elem[4:]))
+				ksize = int(binary.LittleEndian.Uint32(elem[8:]))
+				vsize = int(binary.LittleEndian.Uint32(elem[12:]))
+				off   = boltPageHeaderSize + boltElementSize*i + pos
+			)
+			if off+ksize+vsize > len(p) {
+				return errors.New("bolt invalid leaf element")
+			}
+			if err := fn(binary.LittleEndian.Uint32(elem[0:]),
+				p[off:off+ksize], p[off+ksize:off+ksize+vsize]); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("bolt invalid page flags %x", flags)
+		}
+	}
+
+	return nil
+}
+
+// bucketPage returns the root page of the bucket by its header value.
+func (it *boltReader) bucketPage(value []byte) ([]byte, error) {
+	if len(value) < 16 {
+		return nil, errors.New("bolt invalid bucket")
+	}
+	if root := binary.LittleEndian.Uint64(value); root > 0 {
+		return it.page(root)
+	}
+	// inline bucket
+	return value[16:], nil
+}
+
+// importBolt loads the items of a bucket of a BoltDB file, the nested
+// buckets are skipped.
+func (it *importer) importBolt(src string) error {
+
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var (
+		r      = &boltReader{fp: fp}
+		root   uint64
+		txid   uint64
+		bucket = []byte(flagString("bucket", ""))
+	)
+
+	// the valid meta of the highest txid
+	for i := 0; i < 2; i++ {
+
+		var (
+			buf = make([]byte, boltPageHeaderSize+64)
+			off = int64(0)
+		)
+		if i == 1 {
+			if r.pageSize == 0 {
+				// the page size of meta 0 is unknown, try the default one
+				off = 4096
+			} else {
+				off = int64(r.pageSize)
+			}
+		}
+		if _, err := fp.ReadAt(buf, off); err != nil {
+			continue
+		}
+
+		m := buf[boltPageHeaderSize:]
+		if binary.LittleEndian.Uint32(m[0:]) != boltMagic {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write(m[:56])
+		if h.Sum64() != binary.LittleEndian.Uint64(m[56:]) {
+			continue
+		}
+
+		if t := binary.LittleEndian.Uint64(m[48:]); root == 0 || t > txid {
+			r.pageSize = int(binary.LittleEndian.Uint32(m[8:]))
+			root, txid = binary.LittleEndian.Uint64(m[16:]), t
+		}
+	}
+
+	if root == 0 || r.pageSize < 1024 {
+		return errors.New("invalid bolt file")
+	}
+
+	rootPage, err := r.page(root)
+	if err != nil {
+		return err
+	}
+
+	var (
+		data    []byte
+		buckets []string
+	)
+
+	if err := r.walk(rootPage, func(flags uint32, key, value []byte) error {
+		if flags&boltBucketLeafFlag == 0 {
+			return nil
+		}
+		buckets = append(buckets, string(key))
+		if (len(bucket) == 0 && data == nil) || string(key) == string(bucket) {
+			data = value
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if data == nil || (len(bucket) == 0 && len(buckets) > 1) {
+		return fmt.Errorf("bolt bucket not found or not specified, buckets %v", buckets)
+	}
+
+	page, err := r.bucketPage(data)
+	if err != nil {
+		return err
+	}
+
+	return r.walk(page, func(flags uint32, key, value []byte) error {
+		if flags&boltBucketLeafFlag != 0 {
+			it.skips += 1
+			return nil
+		}
+		return it.put(append([]byte{}, key...), append([]byte{}, value...), 0)
+	})
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// kvgo-import loads the contents of a goleveldb directory, a Redis RDB/AOF
+// file, a Badger backup file or a BoltDB file into an embedded store or a
+// remote node.
+//
+//	kvgo-import -src_type leveldb -src /data/old-db -data_dir /data/kvgo
+//	kvgo-import -src_type redis-rdb -src dump.rdb -addr 127.0.0.1:9100 -access_key_id 00000000 -access_key_secret xxx
+//
+// Options:
+//
+//	-src_type           leveldb, redis-rdb, redis-aof, badger (backup file) or bolt
+//	-src                the source directory or file
+//	-data_dir           the data directory of the embedded store
+//	-addr               the address of the remote node (instead of data_dir)
+//	-access_key_id      the access key of the remote node
+//	-access_key_secret
+//	-table              the table to load into, default to main
+//	-prefix             the prefix added to the keys
+//	-redis_db           the redis database to import, default to 0
+//	-bucket             the bucket of the bolt file, required if it has more than one
+//
+// The Redis importers only load the string values, the keys of the other
+// types are skipped and counted.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hflag4g/hflag"
+	"github.com/lynkdb/kvgo"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+type importer struct {
+	c       kv2.Client
+	table   string
+	prefix  []byte
+	redisDb int
+	puts    int64
+	dels    int64
+	skips   int64
+}
+
+func flagString(name, def string) string {
+	if v, ok := hflag.ValueOK(name); ok && v.String() != "" {
+		return v.String()
+	}
+	return def
+}
+
+func main() {
+
+	var (
+		srcType = flagString("src_type", "")
+		src     = flagString("src", "")
+		tn      = time.Now()
+	)
+
+	if src == "" {
+		fmt.Println("no src setup")
+		os.Exit(1)
+	}
+
+	it := &importer{
+		table:  flagString("table", "main"),
+		prefix: []byte(flagString("prefix", "")),
+	}
+	it.redisDb, _ = strconv.Atoi(flagString("redis_db", "0"))
+
+	var fn func(src string) error
+
+	switch srcType {
+	case "leveldb":
+		fn = it.importLevelDB
+	case "redis-rdb":
+		fn = it.importRedisRDB
+	case "redis-aof":
+		fn = it.importRedisAOF
+	case "badger":
+		fn = it.importBadger
+	case "bolt":
+		fn = it.importBolt
+	default:
+		fmt.Println("invalid src_type")
+		os.Exit(1)
+	}
+
+	if err := it.run(fn, src); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("imported in %v, put %d, delete %d, skip %d\n",
+		time.Since(tn), it.puts, it.dels, it.skips)
+}
+
+func (it *importer) run(fn func(src string) error, src string) error {
+
+	if addr := flagString("addr", ""); addr != "" {
+		c := &kvgo.ClientConfig{
+			Addr: addr,
+			AccessKey: &hauth.AccessKey{
+				Id:     flagString("access_key_id", ""),
+				Secret: flagString("access_key_secret", ""),
+			},
+		}
+		var err error
+		if it.c, err = c.NewClient(); err != nil {
+			return err
+		}
+		defer it.c.Close()
+		return fn(src)
+	}
+
+	dir := flagString("data_dir", "")
+	if dir == "" {
+		return errors.New("no data_dir or addr setup")
+	}
+
+	db, err := kvgo.Open(kvgo.ConfigStorage{
+		DataDirectory: dir,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// bulk ingest, synced once at the end
+	return db.BatchLoad(func(bl *kvgo.BatchLoader) error {
+		if it.c, err = bl.NewClient(); err != nil {
+			return err
+		}
+		return fn(src)
+	})
+}
+
+func (it *importer) key(key []byte) []byte {
+	if len(it.prefix) == 0 {
+		return key
+	}
+	return append(append([]byte{}, it.prefix...), key...)
+}
+
+// put writes the value, ttl in milliseconds if > 0.
+func (it *importer) put(key, value []byte, ttl int64) error {
+	w := it.c.NewWriter(it.key(key), value).TableNameSet(it.table)
+	if ttl > 0 {
+		w.ExpireSet(ttl)
+	}
+	if rs := w.Commit(); !rs.OK() {
+		return rs.Error()
+	}
+	it.puts += 1
+	return nil
+}
+
+func (it *importer) del(key []byte) error {
+	rs := it.c.NewWriter(it.key(key), nil).TableNameSet(it.table).
+		ModeDeleteSet(true).Commit()
+	if !rs.OK() && !rs.NotFound() {
+		return rs.Error()
+	}
+	it.dels += 1
+	return nil
+}
+
+// expire sets the ttl of an existing key, or removes the ttl if 0.
+func (it *importer) expire(key []byte, ttl int64) error {
+	rs := it.c.NewReader(it.key(key)).TableNameSet(it.table).Query()
+	if rs.NotFound() {
+		return nil
+	} else if !rs.OK() {
+		return rs.Error()
+	}
+	return it.put(key, rs.DataValue().Bytes(), ttl)
+}
+
+func (it *importer) importLevelDB(src string) error {
+
+	db, err := leveldb.OpenFile(src, &opt.Options{
+		ReadOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err := it.put(append([]byte{}, iter.Key()...),
+			append([]byte{}, iter.Value()...), 0); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
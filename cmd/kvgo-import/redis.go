@@ -0,0 +1,510 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rdbOpModuleAux    = 0xf7
+	rdbOpIdle         = 0xf8
+	rdbOpFreq         = 0xf9
+	rdbOpAux          = 0xfa
+	rdbOpResizeDB     = 0xfb
+	rdbOpExpireTimeMs = 0xfc
+	rdbOpExpireTime   = 0xfd
+	rdbOpSelectDB     = 0xfe
+	rdbOpEOF          = 0xff
+
+	rdbTypeString = 0
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLzf   = 3
+)
+
+func (it *importer) importRedisRDB(src string) error {
+
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return it.readRDB(bufio.NewReader(fp))
+}
+
+func (it *importer) importRedisAOF(src string) error {
+
+	fp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	r := bufio.NewReader(fp)
+
+	// the aof with a rdb preamble (aof-use-rdb-preamble)
+	if bs, err := r.Peek(5); err == nil && string(bs) == "REDIS" {
+		if err := it.readRDB(r); err != nil {
+			return err
+		}
+	}
+
+	return it.readAOF(r)
+}
+
+func rdbReadLength(r *bufio.Reader) (uint64, bool, error) {
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+
+	case 0:
+		return uint64(b & 0x3f), false, nil
+
+	case 1:
+		b2, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+
+	case 2:
+		if b == 0x80 {
+			var bs [4]byte
+			if _, err := io.ReadFull(r, bs[:]); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(bs[:])), false, nil
+		} else if b == 0x81 {
+			var bs [8]byte
+			if _, err := io.ReadFull(r, bs[:]); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(bs[:]), false, nil
+		}
+		return 0, false, fmt.Errorf("rdb invalid length encoding %x", b)
+	}
+
+	// special encoding
+	return uint64(b & 0x3f), true, nil
+}
+
+func rdbReadString(r *bufio.Reader) ([]byte, error) {
+
+	n, enc, err := rdbReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enc {
+		bs := make([]byte, n)
+		_, err := io.ReadFull(r, bs)
+		return bs, err
+	}
+
+	switch n {
+
+	case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+		bs := make([]byte, 1<<n)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return nil, err
+		}
+		var v int64
+		switch n {
+		case rdbEncInt8:
+			v = int64(int8(bs[0]))
+		case rdbEncInt16:
+			v = int64(int16(binary.LittleEndian.Uint16(bs)))
+		default:
+			v = int64(int32(binary.LittleEndian.Uint32(bs)))
+		}
+		return []byte(strconv.FormatInt(v, 10)), nil
+
+	case rdbEncLzf:
+		clen, _, err := rdbReadLength(r)
+		if err != nil {
+			return nil, err
+		}
+		ulen, _, err := rdbReadLength(r)
+		if err != nil {
+			return nil, err
+		}
+		in := make([]byte, clen)
+		if _, err := io.ReadFull(r, in); err != nil {
+			return nil, err
+		}
+		return lzfDecompress(in, int(ulen))
+	}
+
+	return nil, fmt.Errorf("rdb invalid string encoding %d", n)
+}
+
+func lzfDecompress(in []byte, ulen int) ([]byte, error) {
+
+	out := make([]byte, 0, ulen)
+
+	for ip := 0; ip < len(in); {
+
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 32 {
+			ctrl++
+			if ip+ctrl > len(in) {
+				return nil, errors.New("lzf invalid literal")
+			}
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, errors.New("lzf invalid length")
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errors.New("lzf invalid reference")
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[ip]) - 1
+		ip++
+		if ref < 0 {
+			return nil, errors.New("lzf invalid reference")
+		}
+		for i := 0; i < n+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != ulen {
+		return nil, errors.New("lzf invalid length")
+	}
+
+	return out, nil
+}
+
+func (it *importer) readRDB(r *bufio.Reader) error {
+
+	var head [9]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+	if string(head[:5]) != "REDIS" {
+		return errors.New("invalid rdb file")
+	}
+	ver, _ := strconv.Atoi(string(head[5:]))
+
+	var (
+		db      = uint64(0)
+		expired = int64(0)
+	)
+
+	for {
+
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+
+		case rdbOpEOF:
+			if ver >= 5 {
+				var sum [8]byte
+				if _, err := io.ReadFull(r, sum[:]); err != nil {
+					return err
+				}
+			}
+			return nil
+
+		case rdbOpSelectDB:
+			if db, _, err = rdbReadLength(r); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpResizeDB:
+			for i := 0; i < 2; i++ {
+				if _, _, err := rdbReadLength(r); err != nil {
+					return err
+				}
+			}
+			continue
+
+		case rdbOpAux:
+			for i := 0; i < 2; i++ {
+				if _, err := rdbReadString(r); err != nil {
+					return err
+				}
+			}
+			continue
+
+		case rdbOpIdle:
+			if _, _, err := rdbReadLength(r); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpFreq:
+			if _, err := r.ReadByte(); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpModuleAux:
+			return errors.New("rdb module data not supported")
+
+		case rdbOpExpireTime:
+			var bs [4]byte
+			if _, err := io.ReadFull(r, bs[:]); err != nil {
+				return err
+			}
+			expired = int64(binary.LittleEndian.Uint32(bs[:])) * 1000
+			continue
+
+		case rdbOpExpireTimeMs:
+			var bs [8]byte
+			if _, err := io.ReadFull(r, bs[:]); err != nil {
+				return err
+			}
+			expired = int64(binary.LittleEndian.Uint64(bs[:]))
+			continue
+		}
+
+		key, err := rdbReadString(r)
+		if err != nil {
+			return err
+		}
+
+		if op != rdbTypeString {
+			// the encodings of the other types must be decoded to be skipped
+			return fmt.Errorf("rdb type %d of key %q not supported, only string values can be imported", op, key)
+		}
+
+		value, err := rdbReadString(r)
+		if err != nil {
+			return err
+		}
+
+		var ttl int64
+		if expired > 0 {
+			if ttl = expired - time.Now().UnixNano()/1e6; ttl <= 0 {
+				expired = 0
+				it.skips += 1
+				continue
+			}
+			expired = 0
+		}
+
+		if int(db) != it.redisDb {
+			it.skips += 1
+			continue
+		}
+
+		if err := it.put(key, value, ttl); err != nil {
+			return err
+		}
+	}
+}
+
+func respReadLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func respReadCommand(r *bufio.Reader) ([][]byte, error) {
+
+	line, err := respReadLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, fmt.Errorf("aof invalid line %q", line)
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := respReadLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, fmt.Errorf("aof invalid line %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		bs := make([]byte, size+2)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return nil, err
+		}
+		args = append(args, bs[:size])
+	}
+
+	return args, nil
+}
+
+func (it *importer) readAOF(r *bufio.Reader) error {
+
+	db := 0
+
+	for {
+
+		args, err := respReadCommand(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		cmd := strings.ToUpper(string(args[0]))
+
+		if cmd == "SELECT" && len(args) == 2 {
+			db, _ = strconv.Atoi(string(args[1]))
+			continue
+		}
+
+		if db != it.redisDb {
+			it.skips += 1
+			continue
+		}
+
+		if err := it.applyCommand(cmd, args[1:]); err != nil {
+			return err
+		}
+	}
+}
+
+func aofInt(bs []byte) int64 {
+	v, _ := strconv.ParseInt(string(bs), 10, 64)
+	return v
+}
+
+func (it *importer) applyCommand(cmd string, args [][]byte) error {
+
+	tn := time.Now().UnixNano() / 1e6
+
+	switch cmd {
+
+	case "SET":
+		if len(args) < 2 {
+			break
+		}
+		var ttl int64
+		for i := 2; i+1 < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "EX":
+				ttl = aofInt(args[i+1]) * 1000
+			case "PX":
+				ttl = aofInt(args[i+1])
+			case "EXAT":
+				ttl = aofInt(args[i+1])*1000 - tn
+			case "PXAT":
+				ttl = aofInt(args[i+1]) - tn
+			}
+		}
+		if ttl < 0 {
+			return it.del(args[0])
+		}
+		return it.put(args[0], args[1], ttl)
+
+	case "SETEX", "PSETEX":
+		if len(args) != 3 {
+			break
+		}
+		ttl := aofInt(args[1])
+		if cmd == "SETEX" {
+			ttl *= 1000
+		}
+		return it.put(args[0], args[2], ttl)
+
+	case "MSET":
+		for i := 0; i+1 < len(args); i += 2 {
+			if err := it.put(args[i], args[i+1], 0); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "DEL", "UNLINK":
+		for _, k := range args {
+			if err := it.del(k); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if len(args) < 2 {
+			break
+		}
+		ttl := aofInt(args[1])
+		switch cmd {
+		case "EXPIRE":
+			ttl *= 1000
+		case "EXPIREAT":
+			ttl = ttl*1000 - tn
+		case "PEXPIREAT":
+			ttl -= tn
+		}
+		if ttl <= 0 {
+			return it.del(args[0])
+		}
+		return it.expire(args[0], ttl)
+
+	case "PERSIST":
+		if len(args) != 1 {
+			break
+		}
+		return it.expire(args[0], 0)
+
+	case "MULTI", "EXEC":
+		return nil
+	}
+
+	it.skips += 1
+
+	return nil
+}
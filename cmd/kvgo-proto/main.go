@@ -0,0 +1,282 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// kvgo-proto writes the protobuf definitions of the wire protocol of kvgo
+// (the messages and services of kvspec registered by the generated code
+// linked into kvgo), so the clients of the other languages can be generated
+// from them, e.g.
+//
+//	kvgo-proto -out proto
+//	python -m grpc_tools.protoc -I proto --python_out=. --grpc_python_out=. proto/*.proto
+//
+// Options:
+//
+// The constants of the protocol (the result status, the modes of the readers
+// and writers, the attributes of the objects) are written to
+// kvspec_consts.json in the same directory.
+//
+//	-out       the directory of the .proto files, default to proto
+//	-protoset  also write the descriptors as a FileDescriptorSet to the file
+//	-package   the prefix of the protobuf packages to write, default to kvspec
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hooto/hflag4g/hflag"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	_ "github.com/lynkdb/kvgo"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+var consts = map[string]interface{}{
+	"ResultOK":                 kv2.ResultOK,
+	"ResultNotFound":           kv2.ResultNotFound,
+	"ResultClientError":        kv2.ResultClientError,
+	"ResultServerError":        kv2.ResultServerError,
+	"ObjectReaderModeKey":      kv2.ObjectReaderModeKey,
+	"ObjectReaderModeKeyRange": kv2.ObjectReaderModeKeyRange,
+	"ObjectReaderModeLogRange": kv2.ObjectReaderModeLogRange,
+	"ObjectReaderModeRevRange": kv2.ObjectReaderModeRevRange,
+	"ObjectWriterModeCreate":   kv2.ObjectWriterModeCreate,
+	"ObjectWriterModeDelete":   kv2.ObjectWriterModeDelete,
+	"ObjectMetaAttrDelete":     kv2.ObjectMetaAttrDelete,
+	"ObjectMetaAttrMetaOff":    kv2.ObjectMetaAttrMetaOff,
+	"ObjectMetaAttrDataOff":    kv2.ObjectMetaAttrDataOff,
+}
+
+func flagString(name, def string) string {
+	if v, ok := hflag.ValueOK(name); ok && v.String() != "" {
+		return v.String()
+	}
+	return def
+}
+
+func main() {
+
+	var (
+		out    = flagString("out", "proto")
+		prefix = flagString("package", "kvspec")
+		files  = []protoreflect.FileDescriptor{}
+	)
+
+	protoregistry.GlobalFiles.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		if strings.HasPrefix(string(fd.Package()), prefix) {
+			files = append(files, fd)
+		}
+		return true
+	})
+
+	if len(files) == 0 {
+		fmt.Println("error: no protobuf files of package", prefix, "registered")
+		os.Exit(1)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path() < files[j].Path()
+	})
+
+	set := &descriptorpb.FileDescriptorSet{}
+
+	for _, fd := range files {
+
+		path := filepath.Join(out, filepath.FromSlash(fd.Path()))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+
+		var b strings.Builder
+		printFile(&b, fd)
+
+		if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+
+		fmt.Println("write", path)
+	}
+
+	bs, _ := json.MarshalIndent(consts, "", "  ")
+	if err := ioutil.WriteFile(filepath.Join(out, "kvspec_consts.json"), bs, 0644); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	if v := flagString("protoset", ""); v != "" {
+		bs, err := proto.Marshal(set)
+		if err == nil {
+			err = ioutil.WriteFile(v, bs, 0644)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("write", v)
+	}
+}
+
+func printFile(b *strings.Builder, fd protoreflect.FileDescriptor) {
+
+	fmt.Fprintf(b, "// Code generated by kvgo-proto. DO NOT EDIT.\n// source: %s\n\n", fd.Path())
+
+	syntax := "proto3"
+	if fd.Syntax() == protoreflect.Proto2 {
+		syntax = "proto2"
+	}
+	fmt.Fprintf(b, "syntax = %q;\n\npackage %s;\n", syntax, fd.Package())
+
+	if fdp := protodesc.ToFileDescriptorProto(fd); fdp.GetOptions().GetGoPackage() != "" {
+		fmt.Fprintf(b, "\noption go_package = %q;\n", fdp.GetOptions().GetGoPackage())
+	}
+
+	if fd.Imports().Len() > 0 {
+		b.WriteString("\n")
+		for i := 0; i < fd.Imports().Len(); i++ {
+			fmt.Fprintf(b, "import %q;\n", fd.Imports().Get(i).Path())
+		}
+	}
+
+	for i := 0; i < fd.Enums().Len(); i++ {
+		b.WriteString("\n")
+		printEnum(b, fd.Enums().Get(i), "")
+	}
+
+	for i := 0; i < fd.Messages().Len(); i++ {
+		b.WriteString("\n")
+		printMessage(b, fd.Messages().Get(i), "", syntax)
+	}
+
+	for i := 0; i < fd.Services().Len(); i++ {
+		b.WriteString("\n")
+		printService(b, fd.Services().Get(i))
+	}
+}
+
+func printEnum(b *strings.Builder, ed protoreflect.EnumDescriptor, indent string) {
+	fmt.Fprintf(b, "%senum %s {\n", indent, ed.Name())
+	for i := 0; i < ed.Values().Len(); i++ {
+		v := ed.Values().Get(i)
+		fmt.Fprintf(b, "%s  %s = %d;\n", indent, v.Name(), v.Number())
+	}
+	fmt.Fprintf(b, "%s}\n", indent)
+}
+
+func printMessage(b *strings.Builder, md protoreflect.MessageDescriptor, indent, syntax string) {
+
+	fmt.Fprintf(b, "%smessage %s {\n", indent, md.Name())
+
+	for i := 0; i < md.Enums().Len(); i++ {
+		printEnum(b, md.Enums().Get(i), indent+"  ")
+	}
+
+	for i := 0; i < md.Messages().Len(); i++ {
+		if nmd := md.Messages().Get(i); !nmd.IsMapEntry() {
+			printMessage(b, nmd, indent+"  ", syntax)
+		}
+	}
+
+	oneofs := map[protoreflect.FullName]bool{}
+
+	for i := 0; i < md.Fields().Len(); i++ {
+
+		field := md.Fields().Get(i)
+
+		if od := field.ContainingOneof(); od != nil && !od.IsSynthetic() {
+			if oneofs[od.FullName()] {
+				continue
+			}
+			oneofs[od.FullName()] = true
+			fmt.Fprintf(b, "%s  oneof %s {\n", indent, od.Name())
+			for j := 0; j < od.Fields().Len(); j++ {
+				printField(b, od.Fields().Get(j), indent+"    ", syntax)
+			}
+			fmt.Fprintf(b, "%s  }\n", indent)
+			continue
+		}
+
+		printField(b, field, indent+"  ", syntax)
+	}
+
+	fmt.Fprintf(b, "%s}\n", indent)
+}
+
+func fieldType(field protoreflect.FieldDescriptor) string {
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "." + string(field.Message().FullName())
+	case protoreflect.EnumKind:
+		return "." + string(field.Enum().FullName())
+	}
+	return field.Kind().String()
+}
+
+func printField(b *strings.Builder, field protoreflect.FieldDescriptor, indent, syntax string) {
+
+	var label, typ string
+
+	switch {
+	case field.IsMap():
+		typ = fmt.Sprintf("map<%s, %s>", fieldType(field.MapKey()), fieldType(field.MapValue()))
+	case field.Cardinality() == protoreflect.Repeated:
+		label, typ = "repeated ", fieldType(field)
+	case field.Cardinality() == protoreflect.Required:
+		label, typ = "required ", fieldType(field)
+	case syntax == "proto2" || field.HasOptionalKeyword():
+		label, typ = "optional ", fieldType(field)
+	default:
+		typ = fieldType(field)
+	}
+
+	fmt.Fprintf(b, "%s%s%s %s = %d;\n", indent, label, typ, field.Name(), field.Number())
+}
+
+func printService(b *strings.Builder, sd protoreflect.ServiceDescriptor) {
+
+	fmt.Fprintf(b, "service %s {\n", sd.Name())
+
+	for i := 0; i < sd.Methods().Len(); i++ {
+
+		var (
+			m         = sd.Methods().Get(i)
+			inS, outS = "", ""
+		)
+
+		if m.IsStreamingClient() {
+			inS = "stream "
+		}
+		if m.IsStreamingServer() {
+			outS = "stream "
+		}
+
+		fmt.Fprintf(b, "  rpc %s (%s.%s) returns (%s.%s) {}\n", m.Name(),
+			inS, m.Input().FullName(), outS, m.Output().FullName())
+	}
+
+	b.WriteString("}\n")
+}
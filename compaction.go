@@ -0,0 +1,156 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"sync"
+
+	"github.com/hooto/hlog4g/hlog"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// CompactionFilterFunc is called by the compaction of the tables (in
+// embedded mode, passed as an argument of Open) for the items of the table,
+// it returns whether the item should be removed, or whether the item has
+// been changed in place and should be written back.
+//
+// The function is called with the item decoded from the data entry, and
+// with the item of only the meta (Data is nil) decoded from the meta entry
+// of the same key, so a filter deciding by the key or meta removes both.
+// Only the data of items can be changed.
+//
+// The items are filtered lazily, they are readable until the compaction of
+// the tables containing them, and the logs and ttl index entries of the
+// removed items are kept, so the removed items are not replicated.
+type CompactionFilterFunc func(tableName string, item *kv2.ObjectItem) (remove, changed bool)
+
+const (
+	compactionFilterKeysMax = 100000
+)
+
+// compactionFilter filters the items of the table, the keys it removes or
+// changes are invalidated in the value caches after the compaction is
+// committed, so a read of the old value racing the compaction is not kept
+// in the caches. The caches are purged if too many keys are filtered.
+type compactionFilter struct {
+	tableName  string
+	fn         CompactionFilterFunc
+	invalidate func(keys [][]byte)
+	purge      func()
+	mu         sync.Mutex
+	keys       map[string]bool
+	overflow   bool
+}
+
+func (it *compactionFilter) filtered(key []byte) {
+
+	if it.invalidate == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.overflow {
+		return
+	}
+	if len(it.keys) >= compactionFilterKeysMax {
+		it.keys, it.overflow = nil, true
+		return
+	}
+	if it.keys == nil {
+		it.keys = map[string]bool{}
+	}
+	it.keys[string(key)] = true
+}
+
+// Committed invalidates the keys filtered by the compaction.
+func (it *compactionFilter) Committed() {
+
+	it.mu.Lock()
+	keys, overflow := it.keys, it.overflow
+	it.keys, it.overflow = nil, false
+	it.mu.Unlock()
+
+	if overflow {
+		if it.purge != nil {
+			it.purge()
+		}
+		return
+	}
+
+	if len(keys) > 0 && it.invalidate != nil {
+		ls := make([][]byte, 0, len(keys))
+		for k := range keys {
+			ls = append(ls, []byte(k))
+		}
+		it.invalidate(ls)
+	}
+}
+
+func (it *compactionFilter) Filter(level int, ukey, value []byte) (bool, []byte) {
+
+	if len(ukey) < 1 {
+		return false, nil
+	}
+
+	var (
+		item *kv2.ObjectItem
+		err  error
+	)
+
+	switch ukey[0] {
+
+	case nsKeyData:
+		item, err = kv2.ObjectItemDecode(value)
+
+	case nsKeyMeta:
+		var meta *kv2.ObjectMeta
+		if meta, err = kv2.ObjectMetaDecode(value); err == nil {
+			item = &kv2.ObjectItem{
+				Meta: meta,
+			}
+		}
+
+	default:
+		return false, nil
+	}
+
+	if err != nil || item == nil {
+		return false, nil
+	}
+
+	remove, changed := it.fn(it.tableName, item)
+	if remove {
+		it.filtered(ukey[1:])
+		return true, nil
+	}
+
+	if !changed || ukey[0] != nsKeyData {
+		return false, nil
+	}
+
+	bs, err := kv2.StdProto.Encode(item)
+	if err != nil {
+		hlog.Printf("warn", "kvgo compaction filter table %s, encode err %s",
+			it.tableName, err.Error())
+		return false, nil
+	}
+
+	it.filtered(ukey[1:])
+
+	return false, bs
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+const (
+	compactionPacerRate      = 4 * opt.MiB // bytes per second while throttled
+	compactionPacerSleepMax  = 100 * time.Millisecond
+	compactionPacerRefresh   = 1e9
+	compactionPacerEwmaShift = 4 // weight 1/16 of the new sample
+)
+
+// compactionPacer deprioritizes the compactions while the foreground reads
+// are slower than the target of Performance.CompactionReadLatencySLO, the
+// table files written by the compactions (and the flushes) are throttled to
+// compactionPacerRate, and are written at full speed again once the reads
+// are under the target, so the compactions catch up in the idle periods.
+//
+// The throttle is never applied while a table has as many level 0 tables as
+// the write slowdown trigger, since then the writes of the clients would be
+// stalled by the compactions falling behind. The nil *compactionPacer is a
+// valid disabled pacer.
+type compactionPacer struct {
+	target    int64 // in microseconds
+	latency   int64 // the moving average in microseconds
+	throttled int32
+}
+
+func newCompactionPacer(target int) *compactionPacer {
+	if target < 1 {
+		return nil
+	}
+	return &compactionPacer{
+		target: int64(target),
+	}
+}
+
+// observe adds the latency of a foreground read to the moving average.
+func (it *compactionPacer) observe(d time.Duration) {
+	if it == nil {
+		return
+	}
+	v := int64(d / time.Microsecond)
+	for {
+		prev := atomic.LoadInt64(&it.latency)
+		next := prev + (v-prev)>>compactionPacerEwmaShift
+		if atomic.CompareAndSwapInt64(&it.latency, prev, next) {
+			return
+		}
+	}
+}
+
+func (it *compactionPacer) Latency() int64 {
+	if it == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&it.latency)
+}
+
+func (it *compactionPacer) Throttled() bool {
+	return it != nil && atomic.LoadInt32(&it.throttled) == 1
+}
+
+// refresh turns the throttle on or off by the read latency and the level 0
+// tables of the tables.
+func (it *compactionPacer) refresh(tables []*leveldb.DB) {
+
+	if it == nil {
+		return
+	}
+
+	throttle := it.Latency() > it.target
+
+	if throttle {
+		for _, db := range tables {
+			var st leveldb.DBStats
+			if err := db.Stats(&st); err != nil || len(st.LevelTablesCounts) == 0 {
+				continue
+			}
+			if st.LevelTablesCounts[0] >= opt.DefaultWriteL0SlowdownTrigger {
+				throttle = false
+				break
+			}
+		}
+	}
+
+	var v int32
+	if throttle {
+		v = 1
+	}
+	if prev := atomic.SwapInt32(&it.throttled, v); prev != v {
+		hlog.Printf("info", "kvgo compaction throttle %v, read latency %d us, target %d us",
+			throttle, it.Latency(), it.target)
+	}
+}
+
+// delay returns the time the writer of n bytes of a table file waits.
+func (it *compactionPacer) delay(n int) time.Duration {
+	if !it.Throttled() {
+		return 0
+	}
+	d := time.Duration(int64(n) * int64(time.Second) / compactionPacerRate)
+	if d > compactionPacerSleepMax {
+		d = compactionPacerSleepMax
+	}
+	return d
+}
+
+type compactionPacerWriter struct {
+	storage.Writer
+	pacer *compactionPacer
+}
+
+func (it *compactionPacerWriter) Write(p []byte) (int, error) {
+	if d := it.pacer.delay(len(p)); d > 0 {
+		time.Sleep(d)
+	}
+	return it.Writer.Write(p)
+}
+
+func (cn *Conn) workerCompactionPacer() {
+
+	for !cn.close {
+
+		time.Sleep(compactionPacerRefresh)
+
+		var ls []*leveldb.DB
+
+		cn.mu.RLock()
+		for _, tdb := range cn.tables {
+			if tdb.db != nil {
+				ls = append(ls, tdb.db)
+			}
+		}
+		cn.mu.RUnlock()
+
+		cn.compactionPacer.refresh(ls)
+	}
+}
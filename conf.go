@@ -41,15 +41,113 @@ type Config struct {
 	// Cluster Settings
 	Cluster ConfigCluster `toml:"cluster" json:"cluster" desc:"Cluster Settings"`
 
+	// Trigger Settings
+	Triggers []*ConfigTrigger `toml:"triggers" json:"triggers" desc:"Trigger Settings"`
+
+	// Change Stream Sinks Settings
+	Sinks []*ConfigSink `toml:"sinks" json:"sinks" desc:"Change Stream Sinks Settings"`
+
+	// Backup Settings
+	Backup ConfigBackup `toml:"backup" json:"backup" desc:"Backup Settings"`
+
+	// Tenant Settings
+	Tenant ConfigTenant `toml:"tenant" json:"tenant" desc:"Tenant Settings"`
+
+	// Secret Stores Settings
+	Secrets ConfigSecrets `toml:"secrets" json:"secrets" desc:"Secret Stores Settings"`
+
 	// Client Settings
 	ClientConnectEnable bool `toml:"-" json:"-"`
 
+	// The observer of the calls to the servers in client mode.
+	ClientObserver ClientObserver `toml:"-" json:"-"`
+
+	// The encryption of the values in client mode
+	ClientEncryption *ConfigClientEncryption `toml:"client_encryption,omitempty" json:"client_encryption,omitempty"`
+
 	// Client Keys
 	// ClientAccessKeys []*hauth.AccessKey `toml:"client_access_keys" json:"client_access_keys`
 }
 
+// ConfigBackup sets how the files of the backups are written, the backups
+// are read by the compression and the encryption recorded in their
+// manifests, so the settings can be changed between the backups.
+type ConfigBackup struct {
+	// The compression of the files, none, gzip, snappy or the name of a
+	// compressor registered by BackupCompressorRegister (e.g. zstd)
+	Compress string `toml:"compress" json:"compress" desc:"none, gzip, snappy or registered compressors"`
+
+	// The AES-256 key of the encryption of the files in 64 hex digits,
+	// the files are not encrypted if empty
+	EncryptKey string `toml:"encrypt_key" json:"encrypt_key" desc:"AES-256 key in 64 hex digits"`
+
+	// The scheduled backups, the schedules can also be set by the Admin API
+	// (SysCmd BackupScheduleSet)
+	Schedules []*ConfigBackupSchedule `toml:"schedules" json:"schedules" desc:"Scheduled Backups"`
+}
+
+// ConfigTenant sets the periodic usage reports of the tables and their
+// tenants for the chargeback, see TableUsage.
+type ConfigTenant struct {
+	// The directory the usage reports are written into, the reports are
+	// not written if empty
+	UsageReportDirectory string `toml:"usage_report_directory" json:"usage_report_directory"`
+
+	// The interval of the usage reports in seconds
+	UsageReportInterval int64 `toml:"usage_report_interval" json:"usage_report_interval" desc:"in seconds, default to 3600, min to 60"`
+
+	// The format of the usage reports, csv or json
+	UsageReportFormat string `toml:"usage_report_format" json:"usage_report_format" desc:"csv or json, default to csv"`
+}
+
 type ConfigStorage struct {
 	DataDirectory string `toml:"data_directory" json:"data_directory"`
+
+	// Optional directory of the write-ahead log files, usually on a separate
+	// device so the sequential log writes don't compete with the compaction
+	// reads of the data directory.
+	WalDirectory string `toml:"wal_directory" json:"wal_directory"`
+
+	// Optional extra data directories, usually on other disks, the table
+	// files are spread round-robin over the data directory and the extra
+	// data directories.
+	ExtraDataDirectories []string `toml:"extra_data_directories" json:"extra_data_directories"`
+
+	// If enabled (or the --force-unlock flag setup), the lock of the data
+	// directory left by a process which is not alive is removed, e.g. the
+	// stale lock on a network filesystem.
+	ForceUnlock bool `toml:"force_unlock" json:"force_unlock"`
+
+	// Optional tiering of the cold table files to the object storage
+	Tiering *ConfigTiering `toml:"tiering,omitempty" json:"tiering,omitempty"`
+
+	// The read mode of the table files, the direct mode bypasses the page
+	// cache (O_DIRECT on linux, the reads are synchronous, io_uring is not
+	// used), the mmap mode maps the files into memory. The modes fall back
+	// to pread if not supported by the platform or the filesystem.
+	ReadMode string `toml:"read_mode" json:"read_mode" desc:"pread, direct or mmap, default to pread"`
+}
+
+// ConfigTiering moves the table files of the tables which are not read for
+// ColdDays to the S3 compatible object storage, the moved files are fetched
+// back into the local cache on access. The cold data usually stays in the
+// files of the deeper levels, which are rewritten rarely by the compactions.
+//
+// The Prefix must be unique for every node sharing the bucket.
+type ConfigTiering struct {
+	Endpoint  string `toml:"endpoint" json:"endpoint" desc:"e.g. https://s3.us-east-1.amazonaws.com"`
+	Region    string `toml:"region" json:"region" desc:"default to us-east-1"`
+	Bucket    string `toml:"bucket" json:"bucket"`
+	Prefix    string `toml:"prefix" json:"prefix"`
+	AccessKey string `toml:"access_key" json:"access_key"`
+	SecretKey string `toml:"secret_key" json:"secret_key"`
+
+	ColdDays       int    `toml:"cold_days" json:"cold_days" desc:"default to 30"`
+	CacheDirectory string `toml:"cache_directory" json:"cache_directory" desc:"default to {data_directory}/tier-cache"`
+	CacheSize      int    `toml:"cache_size" json:"cache_size" desc:"in MiB, default to 1024"`
+
+	// Optional object storage instead of the S3 settings above
+	Store TierObjectStore `toml:"-" json:"-"`
 }
 
 type ConfigTLSCertificate struct {
@@ -57,25 +155,181 @@ type ConfigTLSCertificate struct {
 	ServerKeyData  string `toml:"server_key_data" json:"server_key_data"`
 	ServerCertFile string `toml:"server_cert_file" json:"server_cert_file"`
 	ServerCertData string `toml:"server_cert_data" json:"server_cert_data"`
+
+	// The interval the server checks the changes of the key and cert files,
+	// the changed certificate is reloaded without dropping the connections
+	ReloadInterval int64 `toml:"reload_interval,omitempty" json:"reload_interval,omitempty" desc:"in seconds, default to 60, min to 5"`
 }
 
 type ConfigServer struct {
 	Bind        string                `toml:"bind" json:"bind"`
 	AccessKey   *hauth.AccessKey      `toml:"access_key" json:"access_key"`
 	AuthTLSCert *ConfigTLSCertificate `toml:"auth_tls_cert" json:"auth_tls_cert"`
+
+	// The address of the http listener of the status page and the web admin
+	// ui, disabled if not setup. The requests are authenticated by the http basic auth of the
+	// access keys of the sa role.
+	HttpBind string `toml:"http_bind" json:"http_bind"`
+
+	// The address of the debug listener of the pprof profiles, expvar and
+	// goroutine dumps, disabled by default. It should be bound to a loopback
+	// or private address.
+	DebugBind string `toml:"debug_bind" json:"debug_bind"`
+
+	// The maximum replication lag in milliseconds of a ready node (/readyz
+	// of the http listener), default to 10000.
+	ReadyLagTime int64 `toml:"ready_lag_time" json:"ready_lag_time"`
+
+	// The keepalive of the client connections, the server always accepts
+	// the pings of the clients sent at least every 5 seconds.
+	Keepalive *ConfigKeepalive `toml:"keepalive,omitempty" json:"keepalive,omitempty"`
+
+	// The JWT bearer tokens of an OIDC identity provider accepted as an
+	// alternative to the access keys
+	Jwt *ConfigJwt `toml:"jwt,omitempty" json:"jwt,omitempty"`
+
+	// The CIDR allow and deny lists of the listeners and of the identities
+	Firewall *ConfigFirewall `toml:"firewall,omitempty" json:"firewall,omitempty"`
+
+	// The signed requests with the replay protection of the access keys
+	RequestSign ConfigRequestSign `toml:"request_sign" json:"request_sign"`
+
+	// The name of the crypto provider the process is required to be linked
+	// with (see CryptoProviderSet), e.g. a FIPS validated module, the open
+	// fails if the provider in use is another one. The hauth credentials of
+	// the access keys are not signed by the provider, so it also requires
+	// RequestSign.Required and the RequestSign of the main nodes.
+	CryptoProvider string `toml:"crypto_provider,omitempty" json:"crypto_provider,omitempty"`
+}
+
+// ConfigKeepalive is the keepalive settings of the connections, a ping is
+// sent after the connection is idle for Time, and the connection is closed
+// if the ping is not acked in Timeout, so the connections silently dropped
+// by the NAT or firewall are detected in seconds.
+type ConfigKeepalive struct {
+	Time    int64 `toml:"time" json:"time" desc:"in milliseconds, default to 0 (disable), min to 5000"`
+	Timeout int64 `toml:"timeout" json:"timeout" desc:"in milliseconds, default to 5000"`
+
+	// Send the pings even if there are no active calls on the connection.
+	PermitWithoutStream bool `toml:"permit_without_stream" json:"permit_without_stream"`
 }
 
 type ConfigPerformance struct {
+
+	// If enabled, the write buffer, block cache, max table size and max open
+	// files that are not setup are derived from the cpu, memory and open file
+	// limits available to the process (including the container limits).
+	Auto bool `toml:"auto" json:"auto"`
+
 	WriteBufferSize int `toml:"write_buffer_size" json:"write_buffer_size" desc:"in MiB, default to 8"`
 	BlockCacheSize  int `toml:"block_cache_size" json:"block_cache_size" desc:"in MiB, default to 32"`
 	MaxTableSize    int `toml:"max_table_size" json:"max_table_size" desc:"in MiB, default to 8"`
 	MaxOpenFiles    int `toml:"max_open_files" json:"max_open_files" desc:"default to 500"`
+	ValueCacheSize  int `toml:"value_cache_size" json:"value_cache_size" desc:"in MiB, default to 0 (disable)"`
+
+	// The number of the parallel subcompactions of a compaction of a table,
+	// the key range of a compaction is split by the tables of the output
+	// level, so the large compactions of the fast disks are not bound to
+	// one cpu
+	CompactionWorkers int `toml:"compaction_workers" json:"compaction_workers" desc:"default to 1, max to 16"`
+
+	// Memory budget of the node, if setup the block cache, write buffer and
+	// value cache sizes above are ignored and divided from the budget, and
+	// the value cache is shrunk while the process is over the budget.
+	MemoryBudgetMB int `toml:"memory_budget_mb" json:"memory_budget_mb" desc:"in MiB, default to 0 (disable)"`
+
+	// Not-Found Cache Settings
+	NotFoundCacheSize int `toml:"not_found_cache_size" json:"not_found_cache_size" desc:"in MiB, default to 0 (disable)"`
+	NotFoundCacheTTL  int `toml:"not_found_cache_ttl" json:"not_found_cache_ttl" desc:"in milliseconds, default to 3000"`
+
+	// The number of the recently read keys saved by SaveCacheState (and by
+	// Close) in the data directory, they are read again in the background
+	// after the next Open to warm up the block and value caches. Open still
+	// opens the tables before it returns, it only does not wait for the
+	// warmup. The reads are sampled, so the list holds the frequently read
+	// keys rather than exactly the last ones.
+	CacheWarmupKeys int `toml:"cache_warmup_keys" json:"cache_warmup_keys" desc:"default to 0 (disable), max to 1000000"`
+
+	// The max size of the entries of the key prefixes pinned in memory by
+	// PinPrefix.
+	PinnedCacheSize int `toml:"pinned_cache_size" json:"pinned_cache_size" desc:"in MiB, default to 64"`
+
+	// Fsync Policy of Writes
+	//
+	//  none:     writes are buffered by the OS, a process crash loses nothing
+	//            but a power loss or kernel crash may lose recent writes
+	//  interval: as none, but all tables are synced every SyncInterval, so at
+	//            most the writes of the last interval may be lost
+	//  always:   every write is synced before it returns, nothing is lost at
+	//            the cost of much lower write throughput
+	SyncWrites   string `toml:"sync_writes" json:"sync_writes" desc:"none, interval or always, default to none"`
+	SyncInterval int    `toml:"sync_interval" json:"sync_interval" desc:"in milliseconds, default to 1000"`
+
+	// The target of the average latency of the reads, the compactions are
+	// throttled while the reads are slower than the target, and run at full
+	// speed again once the reads are under it
+	CompactionReadLatencySLO int `toml:"compaction_read_latency_slo" json:"compaction_read_latency_slo" desc:"in microseconds, default to 0 (disable)"`
 }
 
 type ConfigFeature struct {
+	// Saves the meta of the keys only in their objects and not alone, the
+	// keys saved in either encoding are read whatever the setting, see Meta
 	WriteMetaDisable  bool   `toml:"write_meta_disable" json:"write_meta_disable"`
 	WriteLogDisable   bool   `toml:"write_log_disable" json:"write_log_disable"`
 	TableCompressName string `toml:"table_compress_name" json:"table_compress_name"`
+
+	// The time in seconds the replaced and deleted versions of the keys are
+	// kept for the point-in-time reads (GetAsOf, ScanAsOf), 0 to disable
+	HistoryRetentionTime int64 `toml:"history_retention_time" json:"history_retention_time" desc:"in seconds, 0 to disable"`
+
+	// The number of the replaced or deleted versions of every key kept in
+	// the history even if they are before the retention time, e.g. for the
+	// audits by ArchiveVersions, the reads as of a time are still limited to
+	// the retention time
+	HistoryRetentionVersions int `toml:"history_retention_versions" json:"history_retention_versions" desc:"default to 0"`
+
+	// The time in seconds the deletes are kept in the write log, 0 to keep
+	// them forever. The log keeps the newest write of every key, so it is
+	// bounded by the live keys and the deletes kept. The deletes are
+	// removed once they are older than the retention time and have been
+	// pulled by all the other main nodes.
+	LogRetentionTime int64 `toml:"log_retention_time" json:"log_retention_time" desc:"in seconds, 0 to disable"`
+
+	// The max size in MiB of the write log of a table, the oldest deletes
+	// are removed from the log of the larger size even if the other main
+	// nodes have not pulled them, 0 to disable. The nodes pulling the log
+	// from before the removed deletes copy the snapshot of the table
+	// instead, and keep the keys of the deletes they missed.
+	LogRetentionSize int64 `toml:"log_retention_size" json:"log_retention_size" desc:"in MiB, 0 to disable"`
+
+	// The default TTLs of the keys of the tables and prefixes
+	TtlDefaults []*ConfigTtlDefault `toml:"ttl_defaults" json:"ttl_defaults" desc:"Default TTLs by table and key prefix"`
+
+	// The table of the content-addressed values of PutCAS, default to main
+	CasTable string `toml:"cas_table" json:"cas_table"`
+
+	// The interval in seconds of the garbage collection of the blobs of
+	// PutCAS without references, default to 3600
+	CasGcInterval int64 `toml:"cas_gc_interval" json:"cas_gc_interval" desc:"in seconds, default to 3600"`
+
+	// The prefixes of the immutable (write-once) keys of the tables, the
+	// writes of the existing keys fail by ErrImmutable
+	ImmutablePrefixes []*ConfigImmutablePrefix `toml:"immutable_prefixes" json:"immutable_prefixes" desc:"Immutable keys by table and key prefix"`
+}
+
+// ConfigImmutablePrefix sets the keys of the Prefix in the Table immutable.
+type ConfigImmutablePrefix struct {
+	Table  string `toml:"table" json:"table"`
+	Prefix string `toml:"prefix" json:"prefix"`
+}
+
+// ConfigTtlDefault sets the TTL of the writes of the keys of the Prefix in
+// the Table that are written without a TTL, the longest Prefix of the table
+// matches. Each write of the key restarts the TTL.
+type ConfigTtlDefault struct {
+	Table  string `toml:"table" json:"table"`
+	Prefix string `toml:"prefix" json:"prefix"`
+	Ttl    int64  `toml:"ttl" json:"ttl" desc:"in milliseconds"`
 }
 
 type ConfigCluster struct {
@@ -84,6 +338,58 @@ type ConfigCluster struct {
 
 	// Replica-Of nodes settings
 	ReplicaOfNodes []*ConfigReplicaOfNode `toml:"replica_of_nodes" json:"replica_of_nodes" desc:"Replica-Of nodes settings"`
+
+	// Replica-To nodes settings
+	ReplicaToNodes []*ConfigReplicaToNode `toml:"replica_to_nodes" json:"replica_to_nodes" desc:"Replica-To nodes settings"`
+
+	// The policy of the conflicts of the writes replicated from the
+	// Replica-To nodes of other clusters, lww (default) or keep-both
+	ConflictPolicy string `toml:"conflict_policy" json:"conflict_policy" desc:"lww or keep-both"`
+
+	// The replication policies of the keys of the tables and prefixes, the
+	// keys without a policy are written to a majority of the main nodes
+	ReplicationPolicies []*ConfigReplicationPolicy `toml:"replication_policies" json:"replication_policies" desc:"Replication Policies"`
+
+	// The max time in milliseconds a main node waits to catch up to the
+	// writes of a session before it serves a query of the session
+	SessionWaitTime int64 `toml:"session_wait_time" json:"session_wait_time" desc:"in milliseconds, default to 1000"`
+
+	// How the clients pick the main node of a request, hash (default) sends
+	// the requests of a key to the same node, random spreads them
+	Balancer string `toml:"balancer" json:"balancer" desc:"hash or random"`
+
+	// The zone and region of this node or client, the queries are sent to
+	// the main nodes of the same zone, then of the same region, first
+	Zone   string `toml:"zone" json:"zone"`
+	Region string `toml:"region" json:"region"`
+
+	// The max replication lag in milliseconds of a main node behind the
+	// other main nodes to serve the queries, the clients fail over the
+	// queries of a node lagging more, default to 0 (disable)
+	ReadLagTime int64 `toml:"read_lag_time" json:"read_lag_time" desc:"in milliseconds, default to 0 (disable)"`
+
+	// The writes coordinated by a main node are throttled if all the other
+	// main nodes lag behind it more than the time in milliseconds, default
+	// to 0 (disable)
+	ThrottleLagTime int64 `toml:"throttle_lag_time" json:"throttle_lag_time" desc:"in milliseconds, default to 0 (disable)"`
+}
+
+// ConfigReplicationPolicy sets how the writes of the keys of the Prefix in
+// the Table are replicated, the longest Prefix of the table matches. The
+// policies must be the same on all main nodes.
+//
+// The writes are always sent to all main nodes, Replicas is the number of
+// the main nodes that must accept a write before it returns, default to a
+// majority. The writes acked by less than a majority may be overwritten by
+// the concurrent writes of the same key on other nodes.
+//
+// The Durability sync fsyncs the writes on every node before the node
+// accepts them, async leaves them to the SyncWrites policy of the node.
+type ConfigReplicationPolicy struct {
+	Table      string `toml:"table" json:"table"`
+	Prefix     string `toml:"prefix" json:"prefix"`
+	Replicas   int    `toml:"replicas" json:"replicas" desc:"default to a majority of the main nodes"`
+	Durability string `toml:"durability" json:"durability" desc:"async or sync, default to async"`
 }
 
 type ConfigReplicaOfNode struct {
@@ -91,11 +397,52 @@ type ConfigReplicaOfNode struct {
 	TableMaps []*ConfigReplicaTableMap `toml:"table_maps" json:"table_maps"`
 }
 
+// ConfigReplicaToNode pushes the changes of the local tables to a node of a
+// remote cluster (asynchronous geo-replication), only the keys of the
+// Prefix are replicated if it is set. The conflicts are resolved by the
+// ConflictPolicy of the remote cluster. The access key must have the sa
+// role of the remote cluster.
+type ConfigReplicaToNode struct {
+	*ClientConfig
+	TableMaps []*ConfigReplicaTableMap `toml:"table_maps" json:"table_maps"`
+	Prefix    string                   `toml:"prefix" json:"prefix"`
+}
+
 type ConfigReplicaTableMap struct {
 	From string `toml:"from" json:"from"`
 	To   string `toml:"to" json:"to"`
 }
 
+// ConfigTrigger posts the changes of the keys of the prefix in the table
+// to the webhook url, see Conn.TriggerRegister.
+type ConfigTrigger struct {
+	Name   string `toml:"name" json:"name"`
+	Table  string `toml:"table" json:"table"`
+	Prefix string `toml:"prefix" json:"prefix"`
+	Url    string `toml:"url" json:"url"`
+}
+
+// ConfigSink sends the changes of the keys of the prefix in the table to a
+// downstream system, the types of sinks are:
+//
+//	webhook  posts the JSON array of changes to the http(s) url Addr
+//	kafka    produces the changes to the topic, Addr is the list of brokers
+//	         (host:port,host:port...)
+//	nats     publishes the changes to the subject Topic, Addr is the url of
+//	         the server (nats://[user:pass@]host:port)
+//
+// The changes are sent in batches of at most BatchNum (default to 100), a
+// failed batch is retried with backoff until it is delivered.
+type ConfigSink struct {
+	Name     string `toml:"name" json:"name"`
+	Type     string `toml:"type" json:"type" desc:"webhook, kafka or nats"`
+	Table    string `toml:"table" json:"table"`
+	Prefix   string `toml:"prefix" json:"prefix"`
+	Addr     string `toml:"addr" json:"addr"`
+	Topic    string `toml:"topic" json:"topic"`
+	BatchNum int    `toml:"batch_num" json:"batch_num"`
+}
+
 func (it *ConfigCluster) Master(addr string) *ClientConfig {
 
 	for _, v := range it.MainNodes {
@@ -108,16 +455,21 @@ func (it *ConfigCluster) Master(addr string) *ClientConfig {
 
 func (it *ConfigCluster) randMainNodes(cap int) []*ClientConfig {
 
+	nodes := dataNodes(it.MainNodes)
+	if len(nodes) == 0 {
+		return nil
+	}
+
 	var (
 		ls     = []*ClientConfig{}
-		offset = rand.Intn(len(it.MainNodes))
+		offset = rand.Intn(len(nodes))
 	)
 
-	for i := offset; i < len(it.MainNodes) && len(ls) <= cap; i++ {
-		ls = append(ls, it.MainNodes[i])
+	for i := offset; i < len(nodes) && len(ls) <= cap; i++ {
+		ls = append(ls, nodes[i])
 	}
 	for i := 0; i < offset && len(ls) <= cap; i++ {
-		ls = append(ls, it.MainNodes[i])
+		ls = append(ls, nodes[i])
 	}
 
 	return ls
@@ -131,6 +483,110 @@ func (it *Config) Valid() error {
 		}
 	}
 
+	if it.Backup.Compress != "" && it.Backup.Compress != BackupCompressNone &&
+		backupCompressor(it.Backup.Compress) == nil {
+		return errors.New("invalid backup/compress")
+	}
+
+	if it.Backup.EncryptKey != "" {
+		if _, err := backupEncryptKey(it.Backup.EncryptKey); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range it.Backup.Schedules {
+		if err := v.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if it.Server.Jwt != nil {
+		if err := it.Server.Jwt.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if it.ClientEncryption != nil {
+		if err := it.ClientEncryption.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if it.Server.Firewall != nil {
+		if err := it.Server.Firewall.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if it.Server.CryptoProvider != "" {
+		if name := cryptoProvider().Name(); name != it.Server.CryptoProvider {
+			return errors.New("server/crypto_provider " + it.Server.CryptoProvider +
+				" not linked, " + name + " in use")
+		}
+		// the signatures of the hauth credentials are computed by the hauth
+		// library out of the provider, so only the signed requests are used
+		if it.Server.Bind != "" && !it.Server.RequestSign.Required {
+			return errors.New("server/crypto_provider requires server/request_sign/required")
+		}
+		for _, v := range it.Cluster.MainNodes {
+			if !v.RequestSign {
+				return errors.New("server/crypto_provider requires cluster/main_nodes/request_sign of " + v.Addr)
+			}
+		}
+	}
+
+	switch it.Tenant.UsageReportFormat {
+	case "", UsageReportCsv, UsageReportJson:
+	default:
+		return errors.New("invalid tenant/usage_report_format")
+	}
+
+	if v := it.Storage.Tiering; v != nil && v.Store == nil && v.Bucket != "" {
+		if v.Endpoint == "" || v.AccessKey == "" || v.SecretKey == "" {
+			return errors.New("invalid storage/tiering, endpoint and keys required")
+		}
+	}
+
+	for _, v := range it.Feature.TtlDefaults {
+		if v.Table == "" || v.Ttl < 1 {
+			return errors.New("invalid feature/ttl_defaults")
+		}
+	}
+
+	for _, v := range it.Cluster.ReplicationPolicies {
+		if v.Table == "" || v.Replicas < 0 {
+			return errors.New("invalid cluster/replication_policies")
+		}
+		switch v.Durability {
+		case "", DurabilityAsync, DurabilitySync:
+		default:
+			return errors.New("invalid cluster/replication_policies/durability")
+		}
+	}
+
+	for _, v := range it.Sinks {
+		if !seqNameReg.MatchString(v.Name) {
+			return errors.New("invalid sinks/name")
+		}
+		switch v.Type {
+		case SinkWebhook, SinkKafka, SinkNats:
+		default:
+			return errors.New("invalid sinks/type")
+		}
+		if v.Addr == "" || (v.Type != SinkWebhook && v.Topic == "") {
+			return errors.New("invalid sinks/addr or sinks/topic")
+		}
+	}
+
+	for _, v := range it.Triggers {
+		if !seqNameReg.MatchString(v.Name) {
+			return errors.New("invalid triggers/name")
+		}
+		if !strings.HasPrefix(v.Url, "http://") && !strings.HasPrefix(v.Url, "https://") {
+			return errors.New("invalid triggers/url")
+		}
+	}
+
 	return nil
 }
 
@@ -144,6 +600,71 @@ func NewConfig(dir string) *Config {
 
 func (it *Config) Reset() *Config {
 
+	if it.Performance.Auto && it.Storage.DataDirectory != "" {
+		it.Performance.autoTune()
+	}
+
+	if it.Storage.WalDirectory != "" {
+		it.Storage.WalDirectory = filepath.Clean(it.Storage.WalDirectory)
+	}
+
+	for i, v := range it.Storage.ExtraDataDirectories {
+		it.Storage.ExtraDataDirectories[i] = filepath.Clean(v)
+	}
+
+	switch it.Storage.ReadMode {
+	case StorageReadDirect, StorageReadMmap:
+	default:
+		it.Storage.ReadMode = StorageReadPread
+	}
+
+	if v := it.Server.Jwt; v != nil {
+		if v.RolesClaim == "" {
+			v.RolesClaim = "roles"
+		}
+		if v.TablesClaim == "" {
+			v.TablesClaim = "kvgo_tables"
+		}
+	}
+
+	if it.Tenant.UsageReportFormat != UsageReportJson {
+		it.Tenant.UsageReportFormat = UsageReportCsv
+	}
+
+	if it.Tenant.UsageReportInterval < 1 {
+		it.Tenant.UsageReportInterval = 3600
+	} else if it.Tenant.UsageReportInterval < 60 {
+		it.Tenant.UsageReportInterval = 60
+	}
+
+	if it.Server.RequestSign.Window < 1 {
+		it.Server.RequestSign.Window = 300
+	} else if it.Server.RequestSign.Window < 10 {
+		it.Server.RequestSign.Window = 10
+	}
+
+	if it.Secrets.RefreshInterval < 1 {
+		it.Secrets.RefreshInterval = 300
+	} else if it.Secrets.RefreshInterval < 10 {
+		it.Secrets.RefreshInterval = 10
+	}
+
+	if it.Tenant.UsageReportDirectory != "" {
+		it.Tenant.UsageReportDirectory = filepath.Clean(it.Tenant.UsageReportDirectory)
+	}
+
+	if v := it.Storage.Tiering; v != nil {
+		if v.ColdDays < 1 {
+			v.ColdDays = tierColdDaysDef
+		}
+		if v.CacheSize < 1 {
+			v.CacheSize = tierCacheSizeDef
+		}
+		if v.CacheDirectory == "" && it.Storage.DataDirectory != "" {
+			v.CacheDirectory = filepath.Join(it.Storage.DataDirectory, tierCacheDirName)
+		}
+	}
+
 	if it.Performance.WriteBufferSize < 4 {
 		it.Performance.WriteBufferSize = 4
 	} else if it.Performance.WriteBufferSize > 128 {
@@ -162,16 +683,98 @@ func (it *Config) Reset() *Config {
 		it.Performance.MaxTableSize = 64
 	}
 
+	if it.Performance.CompactionWorkers < 1 {
+		it.Performance.CompactionWorkers = 1
+	} else if it.Performance.CompactionWorkers > 16 {
+		it.Performance.CompactionWorkers = 16
+	}
+
 	if it.Performance.MaxOpenFiles < 500 {
 		it.Performance.MaxOpenFiles = 500
 	} else if it.Performance.MaxOpenFiles > 10000 {
 		it.Performance.MaxOpenFiles = 10000
 	}
 
+	if it.Performance.ValueCacheSize < 0 {
+		it.Performance.ValueCacheSize = 0
+	} else if it.Performance.ValueCacheSize > 16384 {
+		it.Performance.ValueCacheSize = 16384
+	}
+
+	if it.Performance.MemoryBudgetMB < 0 {
+		it.Performance.MemoryBudgetMB = 0
+	} else if it.Performance.MemoryBudgetMB > 0 && it.Performance.MemoryBudgetMB < 64 {
+		it.Performance.MemoryBudgetMB = 64
+	}
+
+	if it.Performance.NotFoundCacheSize < 0 {
+		it.Performance.NotFoundCacheSize = 0
+	} else if it.Performance.NotFoundCacheSize > 1024 {
+		it.Performance.NotFoundCacheSize = 1024
+	}
+
+	if it.Performance.NotFoundCacheTTL < 1 {
+		it.Performance.NotFoundCacheTTL = 3000
+	} else if it.Performance.NotFoundCacheTTL > 3600000 {
+		it.Performance.NotFoundCacheTTL = 3600000
+	}
+
+	if it.Performance.CacheWarmupKeys < 0 {
+		it.Performance.CacheWarmupKeys = 0
+	} else if it.Performance.CacheWarmupKeys > 1000000 {
+		it.Performance.CacheWarmupKeys = 1000000
+	}
+
+	if it.Performance.PinnedCacheSize < 1 {
+		it.Performance.PinnedCacheSize = 64
+	} else if it.Performance.PinnedCacheSize > 16384 {
+		it.Performance.PinnedCacheSize = 16384
+	}
+
+	switch it.Performance.SyncWrites {
+	case SyncWritesInterval, SyncWritesAlways:
+	default:
+		it.Performance.SyncWrites = SyncWritesNone
+	}
+
+	if it.Performance.SyncInterval < 10 {
+		it.Performance.SyncInterval = 1000
+	} else if it.Performance.SyncInterval > 600000 {
+		it.Performance.SyncInterval = 600000
+	}
+
+	if it.Cluster.ConflictPolicy != ConflictKeepBoth {
+		it.Cluster.ConflictPolicy = ConflictLastWriteWins
+	}
+
+	if it.Cluster.Balancer != BalancerRandom {
+		it.Cluster.Balancer = BalancerHash
+	}
+
+	if it.Cluster.SessionWaitTime < 1 {
+		it.Cluster.SessionWaitTime = sessionWaitTimeDef
+	} else if it.Cluster.SessionWaitTime > sessionWaitTimeMax {
+		it.Cluster.SessionWaitTime = sessionWaitTimeMax
+	}
+
+	if it.Feature.CasTable == "" {
+		it.Feature.CasTable = "main"
+	}
+
+	if it.Feature.CasGcInterval < 1 {
+		it.Feature.CasGcInterval = 3600
+	} else if it.Feature.CasGcInterval < 60 {
+		it.Feature.CasGcInterval = 60
+	}
+
 	if it.Feature.TableCompressName != "none" {
 		it.Feature.TableCompressName = "snappy"
 	}
 
+	if it.Server.ReadyLagTime < 1 {
+		it.Server.ReadyLagTime = 10000
+	}
+
 	if it.Server.Bind != "" && it.Server.AccessKey == nil {
 		it.Server.AccessKey = NewSystemAccessKey()
 	}
@@ -191,6 +794,12 @@ func (it *Config) Reset() *Config {
 				it.Server.AuthTLSCert.ServerCertData = strings.TrimSpace(string(bs))
 			}
 		}
+
+		if it.Server.AuthTLSCert.ReloadInterval < 1 {
+			it.Server.AuthTLSCert.ReloadInterval = 60
+		} else if it.Server.AuthTLSCert.ReloadInterval < 5 {
+			it.Server.AuthTLSCert.ReloadInterval = 5
+		}
 	}
 
 	return it
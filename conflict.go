@@ -0,0 +1,303 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// The policies of the conflicts of the replicated writes, see
+// ConfigCluster.ConflictPolicy.
+const (
+	// ConflictLastWriteWins keeps the version updated last.
+	ConflictLastWriteWins = "lww"
+
+	// ConflictKeepBoth keeps the version updated last, and saves the other
+	// one as a sibling of the key, see SiblingList.
+	ConflictKeepBoth = "keep-both"
+)
+
+const (
+	conflictApplyRetry = 10
+	siblingListLimit   = 100
+)
+
+// ConflictResolverFunc returns the version of the key to keep for the
+// conflict of the local and the remote (replicated) versions, it may
+// return a new item merged from both. The remote item is a deletion if its
+// meta has the attr kv2.ObjectMetaAttrDelete.
+type ConflictResolverFunc func(tableName string, local, remote *kv2.ObjectItem) (*kv2.ObjectItem, error)
+
+type conflictResolver struct {
+	prefix []byte
+	fn     ConflictResolverFunc
+}
+
+// ConflictResolverRegister registers the resolver of the conflicts of the
+// keys of the prefix, which overrides the policy of the cluster, the
+// resolver of the longest prefix is used if the prefixes overlap.
+func (cn *Conn) ConflictResolverRegister(prefix []byte, fn ConflictResolverFunc) error {
+
+	if fn == nil {
+		return errors.New("no resolver func setup")
+	}
+
+	cn.trigMu.Lock()
+	defer cn.trigMu.Unlock()
+
+	cn.conflictResolvers = append(cn.conflictResolvers, &conflictResolver{
+		prefix: bytesClone(prefix),
+		fn:     fn,
+	})
+
+	sort.SliceStable(cn.conflictResolvers, func(i, j int) bool {
+		return len(cn.conflictResolvers[i].prefix) > len(cn.conflictResolvers[j].prefix)
+	})
+
+	return nil
+}
+
+func (cn *Conn) conflictResolverGet(key []byte) ConflictResolverFunc {
+	cn.trigMu.Lock()
+	defer cn.trigMu.Unlock()
+	for _, v := range cn.conflictResolvers {
+		if bytes.HasPrefix(key, v.prefix) {
+			return v.fn
+		}
+	}
+	return nil
+}
+
+// conflictNewer returns whether the version a is newer than b by their
+// hybrid logical clock versions, the ties are broken by the data checksums
+// so all nodes choose the same version.
+func conflictNewer(a, b *kv2.ObjectMeta) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.DataCheck > b.DataCheck
+}
+
+func siblingKeyRange(key []byte) ([]byte, []byte) {
+	return NsKeyRange("kvgo-sibling", uint32(len(key)), key)
+}
+
+// conflictResolve returns the item to keep and the sibling to save.
+func (cn *Conn) conflictResolve(tableName string, local, remote *kv2.ObjectItem) (*kv2.ObjectItem, *kv2.ObjectItem, error) {
+
+	if local == nil {
+		if kv2.AttrAllow(remote.Meta.Attrs, kv2.ObjectMetaAttrDelete) {
+			return nil, nil, nil
+		}
+		return remote, nil, nil
+	}
+
+	if local.Meta.DataCheck == remote.Meta.DataCheck &&
+		local.Meta.Attrs == remote.Meta.Attrs {
+		return local, nil, nil
+	}
+
+	if fn := cn.conflictResolverGet(remote.Meta.Key); fn != nil {
+		keep, err := fn(tableName, local, remote)
+		return keep, nil, err
+	}
+
+	keep, other := local, remote
+	if conflictNewer(remote.Meta, local.Meta) {
+		keep, other = remote, local
+	}
+
+	if cn.opts.Cluster.ConflictPolicy == ConflictKeepBoth &&
+		!kv2.AttrAllow(other.Meta.Attrs, kv2.ObjectMetaAttrDelete) {
+		return keep, other, nil
+	}
+
+	return keep, nil, nil
+}
+
+// replicaApply applies the replicated version of a key by the conflict
+// policy, the local version is checked by its version on commit.
+func (cn *Conn) replicaApply(tableName string, remote *kv2.ObjectItem) error {
+
+	if remote == nil || remote.Meta == nil || len(remote.Meta.Key) == 0 {
+		return errors.New("invalid item")
+	}
+
+	for i := 0; i < conflictApplyRetry; i++ {
+
+		rs := cn.Query(kv2.NewObjectReader(remote.Meta.Key).TableNameSet(tableName))
+		if !rs.OK() && !rs.NotFound() {
+			return rs.Error()
+		}
+
+		var local *kv2.ObjectItem
+		if rs.OK() && len(rs.Items) > 0 && rs.Items[0].Meta != nil {
+			local = rs.Items[0]
+		}
+
+		keep, sibling, err := cn.conflictResolve(tableName, local, remote)
+		if err != nil {
+			return err
+		}
+
+		if keep != nil && keep != local {
+
+			meta := proto.Clone(keep.Meta).(*kv2.ObjectMeta)
+			meta.Key, meta.Version = remote.Meta.Key, 0
+
+			// the commits of the updates older than the local version
+			// are ignored, so a resolved version must be newer
+			if local != nil && meta.Updated <= local.Meta.Updated {
+				meta.Updated = local.Meta.Updated + 1
+			}
+
+			ow := &kv2.ObjectWriter{
+				Meta: meta,
+				Data: keep.Data,
+			}
+			if kv2.AttrAllow(meta.Attrs, kv2.ObjectMetaAttrDelete) {
+				ow.ModeDeleteSet(true)
+			}
+			if local != nil {
+				ow.PrevVersion = local.Meta.Version
+			} else {
+				ow.ModeCreateSet(true)
+			}
+			ow.TableNameSet(tableName)
+
+			rs := cn.commit(ow)
+			if !rs.OK() {
+				if resultErrIs(rs, errPrevVersion) {
+					continue
+				}
+				return rs.Error()
+			}
+
+			// the commit in create mode of an existing key is a no-op
+			if local == nil && commitCreateExists(rs) {
+				continue
+			}
+		}
+
+		if sibling != nil {
+			return cn.siblingSave(tableName, remote.Meta.Key, sibling)
+		}
+
+		return nil
+	}
+
+	return errors.New("replica apply conflict")
+}
+
+func (cn *Conn) siblingSave(tableName string, key []byte, item *kv2.ObjectItem) error {
+
+	bs, err := kv2.StdProto.Encode(item)
+	if err != nil {
+		return err
+	}
+
+	offset, _ := siblingKeyRange(key)
+
+	rs := cn.Commit(kv2.NewObjectWriter(append(offset, uint64ToBytes(item.Meta.Updated)...), bs).
+		TableNameSet(tableName))
+	if !rs.OK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// SiblingList returns the versions of the key kept by the conflicts of the
+// replicated writes with the policy ConflictKeepBoth, the readers resolve
+// the siblings and remove them by SiblingClear.
+func (cn *Conn) SiblingList(tableName string, key []byte) ([]*kv2.ObjectItem, error) {
+
+	offset, cutset := siblingKeyRange(key)
+
+	rs := cn.Query(kv2.NewObjectReader(nil).TableNameSet(tableName).
+		KeyRangeSet(offset, cutset).LimitNumSet(siblingListLimit))
+	if rs.NotFound() {
+		return nil, nil
+	} else if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	ls := []*kv2.ObjectItem{}
+	for _, v := range rs.Items {
+		var item kv2.ObjectItem
+		if err := kv2.StdProto.Decode(v.DataValue().Bytes(), &item); err != nil {
+			return nil, err
+		}
+		ls = append(ls, &item)
+	}
+
+	return ls, nil
+}
+
+// SiblingClear removes the siblings of the key.
+func (cn *Conn) SiblingClear(tableName string, key []byte) error {
+
+	offset, cutset := siblingKeyRange(key)
+
+	rs := cn.Query(kv2.NewObjectReader(nil).TableNameSet(tableName).
+		KeyRangeSet(offset, cutset).LimitNumSet(siblingListLimit))
+	if rs.NotFound() {
+		return nil
+	} else if !rs.OK() {
+		return rs.Error()
+	}
+
+	for _, v := range rs.Items {
+		if rs := cn.Commit(kv2.NewObjectWriter(v.Meta.Key, nil).TableNameSet(tableName).
+			ModeDeleteSet(true)); !rs.OK() {
+			return rs.Error()
+		}
+	}
+
+	return nil
+}
+
+type replicaApplyRequest struct {
+	Table string   `json:"table"`
+	Items [][]byte `json:"items"`
+}
+
+func (cn *Conn) replicaApplyCmdLocal(body []byte) *kv2.ObjectResult {
+
+	var req replicaApplyRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	for _, bs := range req.Items {
+
+		var item kv2.ObjectItem
+		if err := kv2.StdProto.Decode(bs, &item); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+
+		if err := cn.replicaApply(req.Table, &item); err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+	}
+
+	return kv2.NewObjectResultOK()
+}
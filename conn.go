@@ -18,20 +18,22 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hooto/hauth/go/hauth/v1"
 	"github.com/hooto/hflag4g/hflag"
 	"github.com/hooto/hlog4g/hlog"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/filter"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/filter"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
 
 	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
 )
@@ -59,24 +61,72 @@ type dbTable struct {
 	logAsyncMu   sync.Mutex
 	logAsyncSets map[string]bool
 	logLockSets  map[uint64]uint64
+	stor         *dirStorage
+	mergeUsed    int32
 }
 
+// connSetupFunc sets up the connection before its workers are started, it
+// is used by the tests to replace the transport and the clock.
+type connSetupFunc func(cn *Conn)
+
 type Conn struct {
-	mu                   sync.RWMutex
-	dbmu                 sync.Mutex
-	dbSys                *leveldb.DB
-	tables               map[string]*dbTable
-	opts                 *Config
-	clients              int
-	client               *kv2.PublicClient
-	public               *PublicServiceImpl
-	internal             *InternalServiceImpl
-	keyMgr               *hauth.AccessKeyManager
-	close                bool
-	workmu               sync.Mutex
-	workerLocalRunning   bool
-	uptime               int64
-	workerTableRefreshed int64
+	mu                     sync.RWMutex
+	dbmu                   sync.Mutex
+	dbSys                  *leveldb.DB
+	tables                 map[string]*dbTable
+	opts                   *Config
+	clients                int
+	client                 *kv2.PublicClient
+	public                 *PublicServiceImpl
+	internal               *InternalServiceImpl
+	keyMgr                 *hauth.AccessKeyManager
+	close                  bool
+	workmu                 sync.Mutex
+	workerLocalRunning     bool
+	uptime                 int64
+	workerTableRefreshed   int64
+	workerHistoryRefreshed int64
+	pubsub                 *pubSubHub
+	valueCache             *lruCache
+	notFoundCache          *lruCache
+	hotKeys                *cacheHotKeys
+	pinned                 *pinnedCache
+	commitMus              [commitShardNum]sync.Mutex
+	syncDirty              int32
+	memBudget              *memoryBudget
+	compactionPacer        *compactionPacer
+	transport              clusterTransport
+	clock                  func() time.Time
+	jobMu                  sync.Mutex
+	rewriteJobs            map[string]*RewriteJob
+	compactionFilter       CompactionFilterFunc
+	openProgressFunc       OpenProgressFunc
+	mergeSeq               uint64
+	trigMu                 sync.Mutex
+	triggers               map[string]*trigger
+	conflictResolvers      []*conflictResolver
+	backupSched            backupScheduler
+	snapshots              snapshotHub
+	members                clusterMembers
+	httpServer             *http.Server
+	debugServer            *http.Server
+	dirLock                *dirLock
+	requests               *requestLog
+	maintenance            int32
+	transferTarget         atomic.Value
+	replicaLags            replicaLagStatus
+	readyPeers             readyPeerStatus
+	casGc                  casGcStatus
+	seqBlocks              seqBlockSet
+	corruption             corruptionStatus
+	tenants                tenantSet
+	usage                  tableUsageStatus
+	jwt                    *jwtAuth
+	firewall               *firewall
+	valueCrypt             *ValueEncryptor
+	secrets                *secretSet
+	reqSign                *reqSignAuth
+	tls                    *tlsReloader
 }
 
 func Open(args ...interface{}) (*Conn, error) {
@@ -95,7 +145,13 @@ func Open(args ...interface{}) (*Conn, error) {
 			tables:  map[string]*dbTable{},
 			opts:    &Config{},
 			uptime:  time.Now().Unix(),
+			pubsub:  newPubSubHub(),
+
+			mergeSeq: uint64(time.Now().UnixNano()),
+
+			transport: grpcClusterTransport{},
 		}
+		setups []connSetupFunc
 	)
 
 	for _, cfg := range args {
@@ -125,11 +181,26 @@ func Open(args ...interface{}) (*Conn, error) {
 		case ConfigCluster:
 			cn.opts.Cluster = cfg.(ConfigCluster)
 
+		case CompactionFilterFunc:
+			cn.compactionFilter = cfg.(CompactionFilterFunc)
+
+		case OpenProgressFunc:
+			cn.openProgressFunc = cfg.(OpenProgressFunc)
+
+		case connSetupFunc:
+			setups = append(setups, cfg.(connSetupFunc))
+
 		default:
 			return nil, errors.New("invalid config")
 		}
 	}
 
+	secrets, err := newSecretSet(cn.opts)
+	if err != nil {
+		return nil, err
+	}
+	cn.secrets = secrets
+
 	cn.opts.Reset()
 
 	if err := cn.opts.Valid(); err != nil {
@@ -142,28 +213,88 @@ func Open(args ...interface{}) (*Conn, error) {
 
 	if cn.opts.ClientConnectEnable {
 
+		if v := cn.opts.ClientEncryption; v != nil {
+			cn.valueCrypt, _ = v.encryptor()
+		}
+
+		for _, v := range cn.opts.Cluster.MainNodes {
+			if v.Observer == nil {
+				v.Observer = cn.opts.ClientObserver
+			}
+		}
+
 		if err := cn.serviceStart(); err != nil {
 			cn.closeForce()
 			return nil, err
 		}
+
+		if len(cn.secrets.refs) > 0 {
+			go cn.workerSecrets()
+		}
+
 		hlog.Printf("info", "kvgo client connected")
 		return cn, nil
 	}
 
 	if pconn, ok := conns[cn.opts.Storage.DataDirectory]; ok {
+		// the rpc endpoint of the shared handle is started by the first
+		// Open with the server setup
+		if cn.opts.Server.Bind != "" && !pconn.serving() {
+			if err := pconn.Serve(cn.opts.Server); err != nil {
+				return nil, err
+			}
+		}
 		pconn.clients++
 		return pconn, nil
 	}
 
 	if cn.opts.Storage.DataDirectory != "" {
 
+		cn.memBudget = newMemoryBudget(cn.opts.Performance.MemoryBudgetMB)
+		cn.compactionPacer = newCompactionPacer(cn.opts.Performance.CompactionReadLatencySLO)
+		if cn.memBudget != nil {
+			cn.valueCache = newLruCache(cn.memBudget.valueCache, 0)
+		} else {
+			cn.valueCache = newLruCache(int64(cn.opts.Performance.ValueCacheSize)*int64(kv2.MiB), 0)
+		}
+		cn.notFoundCache = newLruCache(int64(cn.opts.Performance.NotFoundCacheSize)*int64(kv2.MiB),
+			int64(cn.opts.Performance.NotFoundCacheTTL))
+		cn.hotKeys = newCacheHotKeys(cn.opts.Performance.CacheWarmupKeys)
+		cn.pinned = newPinnedCache(int64(cn.opts.Performance.PinnedCacheSize) * int64(kv2.MiB))
+		cn.jwt = newJwtAuth(cn.opts.Server.Jwt)
+		cn.reqSign = newReqSignAuth(&cn.opts.Server.RequestSign)
+
+		forceUnlock := cn.opts.Storage.ForceUnlock
+		if _, ok := hflag.ValueOK("force-unlock"); ok {
+			forceUnlock = true
+		}
+
+		var err error
+		if cn.firewall, err = newFirewall(cn.opts.Server.Firewall); err != nil {
+			hlog.Printf("error", "kvgo firewall error %s", err.Error())
+			return nil, err
+		}
+
+		if cn.dirLock, err = dirLockAcquire(cn.opts.Storage.DataDirectory, forceUnlock); err != nil {
+			hlog.Printf("error", "kvgo lock error %s", err.Error())
+			return nil, err
+		}
+
+		if err := dataLayoutSetup(cn.opts.Storage.DataDirectory); err != nil {
+			hlog.Printf("error", "kvgo data layout error %s", err.Error())
+			cn.dirLock.Release()
+			return nil, err
+		}
+
 		if err := cn.dbSysSetup(); err != nil {
 			hlog.Printf("error", "kvgo db-meta setup error %s", err.Error())
+			cn.dirLock.Release()
 			return nil, err
 		}
 
 		if err := cn.dbTableListSetup(); err != nil {
 			hlog.Printf("error", "kvgo db-table setup error %s", err.Error())
+			cn.dirLock.Release()
 			return nil, err
 		}
 	}
@@ -173,12 +304,66 @@ func Open(args ...interface{}) (*Conn, error) {
 		return nil, err
 	}
 
+	for _, fn := range setups {
+		fn(cn)
+	}
+
 	go cn.workerLocal()
 
+	go cn.workerTrigger()
+
+	go cn.workerBackupSchedule()
+
+	go cn.workerReplicaLag()
+
+	go cn.workerReadyPeer()
+
+	go cn.workerCasGC()
+
+	go cn.workerTenant()
+
+	go cn.workerPubSub()
+
+	if cn.opts.Tenant.UsageReportDirectory != "" {
+		go cn.workerUsageReport()
+	}
+
+	if cn.compactionPacer != nil {
+		go cn.workerCompactionPacer()
+	}
+
+	if cn.opts.Performance.SyncWrites == SyncWritesInterval {
+		go cn.workerSync()
+	}
+
+	if cn.memBudget != nil {
+		go cn.workerMemoryBudget()
+	}
+
+	if cn.hotKeys != nil {
+		go cn.workerCacheWarmup()
+	}
+
+	if cn.pinned != nil {
+		go cn.workerCachePin()
+	}
+
+	if cn.opts.Storage.Tiering.enabled() {
+		go cn.workerTiering()
+	}
+
+	if len(cn.secrets.refs) > 0 {
+		go cn.workerSecrets()
+	}
+
 	hlog.Printf("info", "kvgo started (%s)", cn.opts.Storage.DataDirectory)
 
 	conns[cn.opts.Storage.DataDirectory] = cn
 
+	if err := SystemdNotify("READY=1"); err != nil {
+		hlog.Printf("warn", "kvgo systemd notify err %s", err.Error())
+	}
+
 	time.Sleep(500e6)
 
 	return cn, nil
@@ -211,8 +396,37 @@ func (cn *Conn) dbSetup(dir string, opts *opt.Options) (*dbTable, error) {
 		opts.WriteL0SlowdownTrigger = 16
 	}
 
-	db, err := leveldb.OpenFile(dir, opts)
-	if err != nil {
+	var (
+		db   *leveldb.DB
+		stor *dirStorage
+		err  error
+	)
+
+	if cn.opts.Storage.WalDirectory != "" || len(cn.opts.Storage.ExtraDataDirectories) > 0 ||
+		cn.opts.Storage.Tiering.enabled() || cn.compactionPacer != nil || failpointEnabled ||
+		cn.opts.Storage.ReadMode == StorageReadDirect || cn.opts.Storage.ReadMode == StorageReadMmap {
+		var (
+			name      = filepath.Base(dir)
+			walDir    string
+			extraDirs []string
+		)
+		if cn.opts.Storage.WalDirectory != "" {
+			walDir = filepath.Join(cn.opts.Storage.WalDirectory, name)
+		}
+		for _, v := range cn.opts.Storage.ExtraDataDirectories {
+			extraDirs = append(extraDirs, filepath.Join(v, name))
+		}
+		stor, err = newDirStorage(dir, walDir, extraDirs, cn.opts.Storage.Tiering)
+		if err != nil {
+			return nil, err
+		}
+		stor.pacer = cn.compactionPacer
+		stor.mode = cn.opts.Storage.ReadMode
+		if db, err = leveldb.Open(stor, opts); err != nil {
+			stor.Close()
+			return nil, err
+		}
+	} else if db, err = leveldb.OpenFile(dir, opts); err != nil {
 		return nil, err
 	}
 
@@ -232,7 +446,7 @@ func (cn *Conn) dbSetup(dir string, opts *opt.Options) (*dbTable, error) {
 
 			iter := db.NewIterator(&util.Range{
 				Start: []byte{v},
-				Limit: []byte{v, 0xff},
+				Limit: keyPrefixLimit([]byte{v}),
 			}, nil)
 			defer iter.Release()
 
@@ -264,17 +478,25 @@ func (cn *Conn) dbSetup(dir string, opts *opt.Options) (*dbTable, error) {
 
 	dt := &dbTable{
 		db:           db,
+		stor:         stor,
 		incrSets:     map[string]*dbTableIncrSet{},
 		logAsyncSets: map[string]bool{},
 		logLockSets:  map[uint64]uint64{},
 	}
 
+	created := false
+
 	bs, err := dt.db.Get(keySysInstanceId, nil)
 	if err == nil {
 		dt.instId = string(bs)
 	} else if err.Error() == ldbNotFound {
 		dt.instId = randHexString(16)
 		err = dt.db.Put(keySysInstanceId, []byte(dt.instId), nil)
+		created = true
+	}
+
+	if err == nil {
+		err = dbMigrate(dir, dt.db, created)
 	}
 
 	if err != nil {
@@ -296,6 +518,7 @@ func (cn *Conn) dbSysSetup() error {
 			OpenFilesCacheCapacity: 10,
 			Filter:                 filter.NewBloomFilter(10),
 			Compression:            opt.NoCompression,
+			RecoveryProgress:       cn.openProgress(sysTableName),
 		}
 	)
 
@@ -309,54 +532,60 @@ func (cn *Conn) dbSysSetup() error {
 		tableId:      0,
 		tableName:    sysTableName,
 		db:           dt.db,
+		stor:         dt.stor,
 		incrSets:     map[string]*dbTableIncrSet{},
 		logAsyncSets: map[string]bool{},
 		logLockSets:  map[uint64]uint64{},
 	}
 
 	if cn.opts.Server.Bind != "" {
+		cn.serverKeysLoad()
+	}
+
+	return nil
+}
 
-		rr2 := kv2.NewObjectReader(nil).
-			TableNameSet(sysTableName).
-			KeyRangeSet(nsSysAccessKey(""), append(nsSysAccessKey(""), 0xff)).
-			LimitNumSet(1000)
+// serverKeysLoad loads the access keys of the server from the system table.
+func (cn *Conn) serverKeysLoad() {
 
-		if rs := cn.objectLocalQuery(rr2); rs.OK() {
-			for _, v := range rs.Items {
-				var key hauth.AccessKey
-				if err := v.DataValue().Decode(&key, nil); err == nil {
-					cn.keyMgr.KeySet(&key)
-				}
+	rr2 := kv2.NewObjectReader(nil).
+		TableNameSet(sysTableName).
+		KeyRangeSet(nsSysAccessKey(""), nsSysAccessKey("")).
+		LimitNumSet(1000)
+
+	if rs := cn.objectLocalQuery(rr2); rs.OK() {
+		for _, v := range rs.Items {
+			var key hauth.AccessKey
+			if err := v.DataValue().Decode(&key, nil); err == nil {
+				cn.keyMgr.KeySet(&key)
 			}
-			hlog.Printf("info", "server load access keys %d", len(rs.Items))
 		}
+		hlog.Printf("info", "server load access keys %d", len(rs.Items))
+	}
 
-		if cn.opts.Server.AccessKey != nil &&
-			len(cn.opts.Server.AccessKey.Secret) > 20 {
-			key := cn.opts.Server.AccessKey
-			if pkey := cn.keyMgr.KeyGet(key.Id); pkey == nil || key.Secret != pkey.Secret {
+	if cn.opts.Server.AccessKey != nil &&
+		len(cn.opts.Server.AccessKey.Secret) > 20 {
+		key := cn.opts.Server.AccessKey
+		if pkey := cn.keyMgr.KeyGet(key.Id); pkey == nil || key.Secret != pkey.Secret {
 
-				rootKey := NewSystemAccessKey()
-				key.Roles = rootKey.Roles
-				key.Scopes = rootKey.Scopes
+			rootKey := NewSystemAccessKey()
+			key.Roles = rootKey.Roles
+			key.Scopes = rootKey.Scopes
 
-				rr2 := kv2.NewObjectWriter(nsSysAccessKey(key.Id), key).
-					TableNameSet(sysTableName)
-				tdb := cn.tabledb(sysTableName)
-				if tdb != nil {
-					cn.commitLocal(rr2, 0)
-					cn.keyMgr.KeySet(key)
-					hlog.Printf("warn", "server force rewrite root access key")
-				}
+			rr2 := kv2.NewObjectWriter(nsSysAccessKey(key.Id), key).
+				TableNameSet(sysTableName)
+			tdb := cn.tabledb(sysTableName)
+			if tdb != nil {
+				cn.commitLocal(rr2, 0)
+				cn.keyMgr.KeySet(key)
+				hlog.Printf("warn", "server force rewrite root access key")
 			}
 		}
-
-		for _, role := range defaultRoles {
-			cn.keyMgr.RoleSet(role)
-		}
 	}
 
-	return nil
+	for _, role := range defaultRoles {
+		cn.keyMgr.RoleSet(role)
+	}
 }
 
 func (cn *Conn) dbTableListSetup() error {
@@ -399,14 +628,50 @@ func (cn *Conn) dbTableListSetup() error {
 		}
 	}
 
+	ls, err := dbSysTableList(cn.dbSys)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range ls {
+
+		if tables[t.tableName] != nil &&
+			tables[t.tableName].tableId != t.tableId {
+			return fmt.Errorf("table name (%s) conflict", t.tableName)
+		}
+
+		if t.tableName == sysTableName {
+			continue
+		}
+
+		tables[t.tableName] = t
+	}
+
+	cn.memBudget.tablesSet(len(tables))
+
+	for _, t := range tables {
+
+		if err := cn.dbTableSetup(t.tableName, t.tableId); err != nil {
+			return err
+		}
+
+		hlog.Printf("info", "kvgo table %s (%d) started", t.tableName, t.tableId)
+	}
+
+	return nil
+}
+
+// dbSysTableList returns the tables defined in the system table.
+func dbSysTableList(dbSys *leveldb.DB) ([]*dbTable, error) {
+
 	var (
 		offset = keyEncode(nsKeyData, nsSysTable(""))
-		cutset = keyEncode(nsKeyData, nsSysTable(""))
+		cutset = keyPrefixLimit(keyEncode(nsKeyData, nsSysTable("")))
 		values = [][]byte{}
+		tables = []*dbTable{}
 	)
-	cutset = append(cutset, 0xff)
 
-	iter := cn.dbSys.NewIterator(&util.Range{
+	iter := dbSys.NewIterator(&util.Range{
 		Start: offset,
 		Limit: cutset,
 	}, nil)
@@ -426,49 +691,31 @@ func (cn *Conn) dbTableListSetup() error {
 	}
 
 	if iter.Error() != nil {
-		return iter.Error()
+		return nil, iter.Error()
 	}
 
 	for _, bs := range values {
 
 		item, err := kv2.ObjectItemDecode(bs)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		var tb kv2.TableItem
 		if err = item.DataValue().Decode(&tb, nil); err != nil {
-			return err
-		}
-
-		if tables[tb.Name] != nil &&
-			uint64(tables[tb.Name].tableId) != item.Meta.IncrId {
-			return fmt.Errorf("table name (%s) conflict", tb.Name)
-		}
-
-		if tb.Name == sysTableName {
-			continue
+			return nil, err
 		}
 
-		tables[tb.Name] = &dbTable{
+		tables = append(tables, &dbTable{
 			tableId:      uint32(item.Meta.IncrId),
 			tableName:    tb.Name,
 			incrSets:     map[string]*dbTableIncrSet{},
 			logAsyncSets: map[string]bool{},
 			logLockSets:  map[uint64]uint64{},
-		}
-	}
-
-	for _, t := range tables {
-
-		if err := cn.dbTableSetup(t.tableName, t.tableId); err != nil {
-			return err
-		}
-
-		hlog.Printf("info", "kvgo table %s (%d) started", t.tableName, t.tableId)
+		})
 	}
 
-	return nil
+	return tables, nil
 }
 
 func (cn *Conn) dbTableSetup(tableName string, tableId uint32) error {
@@ -481,8 +728,7 @@ func (cn *Conn) dbTableSetup(tableName string, tableId uint32) error {
 		return nil
 	}
 
-	dir := filepath.Clean(fmt.Sprintf("%s/%d_%d_%d", cn.opts.Storage.DataDirectory,
-		tableId, 0, 0))
+	dir := dbTableDir(cn.opts.Storage.DataDirectory, tableId)
 
 	ldbOpts := &opt.Options{
 		WriteBuffer:            cn.opts.Performance.WriteBufferSize * opt.MiB,
@@ -490,6 +736,8 @@ func (cn *Conn) dbTableSetup(tableName string, tableId uint32) error {
 		CompactionTableSize:    cn.opts.Performance.MaxTableSize * opt.MiB,
 		OpenFilesCacheCapacity: cn.opts.Performance.MaxOpenFiles,
 		Filter:                 filter.NewBloomFilter(10),
+		CompactionConcurrency:  cn.opts.Performance.CompactionWorkers,
+		RecoveryProgress:       cn.openProgress(tableName),
 	}
 
 	if cn.opts.Feature.TableCompressName == "snappy" {
@@ -498,6 +746,21 @@ func (cn *Conn) dbTableSetup(tableName string, tableId uint32) error {
 		ldbOpts.Compression = opt.NoCompression
 	}
 
+	cn.memBudget.tableOptionsSet(ldbOpts)
+
+	if cn.compactionFilter != nil {
+		ldbOpts.CompactionFilter = &compactionFilter{
+			tableName: tableName,
+			fn:        cn.compactionFilter,
+			invalidate: func(keys [][]byte) {
+				for _, key := range keys {
+					cn.valueCacheInvalidate(tableId, key)
+				}
+			},
+			purge: cn.valueCachePurge,
+		}
+	}
+
 	dt, err := cn.dbSetup(dir, ldbOpts)
 	if err != nil {
 		return err
@@ -510,8 +773,56 @@ func (cn *Conn) dbTableSetup(tableName string, tableId uint32) error {
 		logAsyncSets: map[string]bool{},
 		logLockSets:  map[uint64]uint64{},
 		db:           dt.db,
+		stor:         dt.stor,
 	}
 
+	cn.tables[tableName].mergeUsedInit()
+
+	return nil
+}
+
+// dbTableDrop closes the table and removes its data from all directories,
+// the definition in the system table is removed by the caller.
+func (cn *Conn) dbTableDrop(tableName string) error {
+
+	if tableName == "" || tableName == "main" || tableName == sysTableName {
+		return errors.New("table can not be dropped")
+	}
+
+	cn.dbmu.Lock()
+	defer cn.dbmu.Unlock()
+
+	cn.mu.Lock()
+	tdb := cn.tables[tableName]
+	delete(cn.tables, tableName)
+	cn.mu.Unlock()
+
+	if tdb == nil {
+		return nil
+	}
+
+	tdb.Close()
+
+	var (
+		dir  = dbTableDir(cn.opts.Storage.DataDirectory, tdb.tableId)
+		name = filepath.Base(dir)
+		dirs = []string{dir}
+	)
+	if cn.opts.Storage.WalDirectory != "" {
+		dirs = append(dirs, filepath.Join(cn.opts.Storage.WalDirectory, name))
+	}
+	for _, v := range cn.opts.Storage.ExtraDataDirectories {
+		dirs = append(dirs, filepath.Join(v, name))
+	}
+
+	for _, v := range dirs {
+		if err := os.RemoveAll(v); err != nil {
+			return err
+		}
+	}
+
+	hlog.Printf("info", "kvgo table %s dropped", tableName)
+
 	return nil
 }
 
@@ -539,10 +850,32 @@ func (cn *Conn) closeForce() error {
 		}
 	}
 
-	if cn.public != nil && cn.public.sock != nil {
+	if cn.close && !cn.opts.ClientConnectEnable {
+		SystemdNotify("STOPPING=1")
+	}
+
+	if cn.close && cn.hotKeys != nil {
+		if err := cn.SaveCacheState(); err != nil {
+			hlog.Printf("warn", "kvgo save cache state err %s", err.Error())
+		}
+	}
+
+	if cn.public != nil && cn.public.server != nil {
+		// the connections of the other nodes are closed too, so no request
+		// is served by the tables closed below
+		cn.public.server.Stop()
+	} else if cn.public != nil && cn.public.sock != nil {
 		cn.public.sock.Close()
 	}
 
+	if cn.httpServer != nil {
+		cn.httpServer.Close()
+	}
+
+	if cn.debugServer != nil {
+		cn.debugServer.Close()
+	}
+
 	for _, tdb := range cn.tables {
 		tdb.Close()
 	}
@@ -551,6 +884,8 @@ func (cn *Conn) closeForce() error {
 		// cn.dbSys.Close()
 	}
 
+	cn.dirLock.Release()
+
 	delete(conns, cn.opts.Storage.DataDirectory)
 
 	return nil
@@ -595,6 +930,11 @@ func (it *dbTable) Close() error {
 	it.db.Close()
 	it.db = nil
 
+	if it.stor != nil {
+		it.stor.Close()
+		it.stor = nil
+	}
+
 	return nil
 }
 
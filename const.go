@@ -15,6 +15,7 @@
 package kvgo
 
 //go:generate protoc --proto_path=./ --go_out=./ --go_opt=paths=source_relative --go-grpc_out=. kvgo.proto
+//go:generate go run ./cmd/kvgo-proto -out proto -protoset proto/kvspec.protoset
 
 import (
 	"github.com/hooto/hauth/go/hauth/v1"
@@ -31,6 +32,11 @@ const (
 	nsKeyData uint8 = 18
 	nsKeyLog  uint8 = 19
 	nsKeyTtl  uint8 = 20
+
+	nsKeyMerge   uint8 = 21
+	nsKeyHistory uint8 = 22
+
+	keyInternalPrefix = "\x00\x00kvgo:"
 )
 
 const (
@@ -46,6 +52,7 @@ const (
 	workerLogRangeWaitSleep    = int64(200)
 	workerReplicaLogAsyncSleep = 1e9
 	workerTableRefreshTime     = int64(600)
+	commitShardNum             = 64
 )
 
 var (
@@ -60,10 +67,28 @@ func keySysLogAsync(hostAddr, tableName string) []byte {
 	return append([]byte{nsKeySys}, []byte("log:async:"+hostAddr+":"+tableName)...)
 }
 
+func keySysTriggerOffset(name string) []byte {
+	return append([]byte{nsKeySys}, []byte("trigger:offset:"+name)...)
+}
+
 func keySysIncrCutset(ns string) []byte {
 	return append([]byte{nsKeySys}, []byte("incr:cutset:"+ns)...)
 }
 
+// Failpoints, only effective in the builds with the failpoint tag, see
+// FailpointEnable.
+const (
+	FailpointSyncWrite      = "sync-write"
+	FailpointCompactionSlow = "compaction-slow"
+	FailpointReplicaDrop    = "replica-drop"
+	FailpointRpcLatency     = "rpc-latency"
+
+	// the node is isolated from the cluster, the outgoing connections and
+	// the incoming requests (but the NodeFailpoint and NodeStatus commands)
+	// fail
+	FailpointPartition = "partition"
+)
+
 const (
 	sysTableName   = "sys"
 	sysTableIncrNS = "sys_table_id"
@@ -94,6 +119,76 @@ var (
 	defaultScopes      = []string{
 		AuthScopeTable,
 	}
+	sysCmdClientMethods = map[string]bool{
+		"Handshake":         true,
+		"SeqNext":           true,
+		"ObjectMerge":       true,
+		"ScriptEval":        true,
+		"ProcedureCall":     true,
+		"CasPut":            true,
+		"CasRelease":        true,
+		"HistoryQuery":      true,
+		"PubSubPublish":     true,
+		"PubSubSubscribe":   true,
+		"PubSubPoll":        true,
+		"PubSubUnsubscribe": true,
+		"SnapshotOpen":      true,
+		"SnapshotRead":      true,
+		"SnapshotClose":     true,
+		"KeyTokenIssue":     true,
+	}
+	sysCmdNodeLocalMethods = map[string]bool{
+		"Handshake":              true,
+		"ObjectMerge":            true,
+		"SeqNext":                true,
+		"BackupScheduleSet":      true,
+		"BackupScheduleDel":      true,
+		"BackupScheduleList":     true,
+		"ReplicaApply":           true,
+		"ScriptEval":             true,
+		"ProcedureCall":          true,
+		"CasPut":                 true,
+		"CasRelease":             true,
+		"CasStats":               true,
+		"CasGC":                  true,
+		"HistoryQuery":           true,
+		"SystemScan":             true,
+		"TableStats":             true,
+		"CachePin":               true,
+		"CacheUnpin":             true,
+		"CachePinList":           true,
+		"TenantCreate":           true,
+		"TenantDelete":           true,
+		"TenantList":             true,
+		"TableUsages":            true,
+		"TLSReload":              true,
+		"KeyTokenIssue":          true,
+		"PubSubPublish":          true,
+		"PubSubSubscribe":        true,
+		"PubSubPoll":             true,
+		"PubSubUnsubscribe":      true,
+		"SnapshotOpen":           true,
+		"SnapshotRead":           true,
+		"SnapshotClose":          true,
+		"NodeDecommission":       true,
+		"NodeDecommissionStatus": true,
+		"NodeLogOffsets":         true,
+		"NodeRemove":             true,
+		"NodeAdd":                true,
+		"NodeJoin":               true,
+		"NodeJoinStatus":         true,
+		"NodeMembers":            true,
+		"NodeMaintenance":        true,
+		"TransferLeadership":     true,
+		"NodeFailpoint":          true,
+		"ReplicaOfAdd":           true,
+		"ReplicaOfRemove":        true,
+		"NodeStatus":             true,
+		"ClusterStatus":          true,
+		"ReadIndex":              true,
+		"ObjectDigest":           true,
+		"ObjectRepair":           true,
+	}
 	defaultRoles = []*hauth.Role{
 		{
 			Name:  "sa",
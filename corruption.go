@@ -0,0 +1,553 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/errors"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	corruptionQuarantineDir = "quarantine"
+	corruptionRepairBatch   = 1000
+	corruptionRepairRetry   = 60 // in seconds
+)
+
+// CorruptionFile is a table file that failed the checksum of a block read.
+// The file is quarantined in the background: it is copied to the quarantine
+// directory of the data directory for the inspection, and the reads failed
+// by it are served by the replicas.
+//
+// In cluster mode the key range of the file is repaired: the objects of the
+// range are read from a replica, the file is compacted with its corrupted
+// blocks dropped (Live turns false), and the objects are written back, so
+// the versions of the dropped blocks are restored and the older versions
+// exposed by them are overwritten or deleted. A failed repair is retried by
+// the corrupted reads after corruptionRepairRetry. In local mode the file is
+// kept, since the keys of its corrupted blocks can not be restored.
+type CorruptionFile struct {
+	Table       string `json:"table"`
+	File        int64  `json:"file"`
+	Error       string `json:"error"`
+	Reads       int64  `json:"reads"`    // the corrupted reads
+	Repaired    int64  `json:"repaired"` // the keys repaired from the replicas
+	RepairError string `json:"repair_error,omitempty"`
+	Quarantine  string `json:"quarantine,omitempty"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+	Live        bool   `json:"live"`
+
+	repairing bool
+	repaired  bool
+	repairAt  int64
+}
+
+type corruptionStatus struct {
+	mu    sync.Mutex
+	total int64
+	files map[string]*CorruptionFile
+}
+
+func errCorrupted(err error) bool {
+	return errors.IsCorrupted(err)
+}
+
+// corruptionFileNum returns the table file number of the corruption error,
+// or -1 if the error is not a corruption of a table file.
+func corruptionFileNum(err error) int64 {
+	if e, ok := err.(*errors.ErrCorrupted); ok && e.Fd.Type == storage.TypeTable {
+		return e.Fd.Num
+	}
+	return -1
+}
+
+// corruptionReport counts the corrupted read and quarantines the file of
+// the corruption error.
+func (cn *Conn) corruptionReport(tdb *dbTable, err error) {
+
+	num := corruptionFileNum(err)
+
+	cn.corruption.mu.Lock()
+	defer cn.corruption.mu.Unlock()
+
+	cn.corruption.total += 1
+
+	if num < 0 {
+		hlog.Printf("error", "kvgo table %s corruption %s", tdb.tableName, err.Error())
+		return
+	}
+
+	if cn.corruption.files == nil {
+		cn.corruption.files = map[string]*CorruptionFile{}
+	}
+
+	var (
+		tn = time.Now().Unix()
+		fk = fmt.Sprintf("%s/%d", tdb.tableName, num)
+		cf = cn.corruption.files[fk]
+	)
+
+	if cf == nil {
+		cf = &CorruptionFile{
+			Table:   tdb.tableName,
+			File:    num,
+			Error:   err.Error(),
+			Created: tn,
+		}
+		cn.corruption.files[fk] = cf
+
+		hlog.Printf("error", "kvgo table %s file %d corrupted, quarantine, err %s",
+			tdb.tableName, num, err.Error())
+	}
+
+	cf.Reads += 1
+	cf.Updated = tn
+
+	if !cf.repairing && !cf.repaired && tn-cf.repairAt >= corruptionRepairRetry {
+		cf.repairing, cf.repairAt = true, tn
+		go cn.corruptionRepair(tdb, cf)
+	}
+}
+
+// corruptionRepair quarantines the table file of cf and repairs its key
+// range from a replica.
+func (cn *Conn) corruptionRepair(tdb *dbTable, cf *CorruptionFile) {
+
+	cn.corruption.mu.Lock()
+	quarantined := cf.Quarantine != ""
+	cn.corruption.mu.Unlock()
+
+	if !quarantined {
+		if path, err := cn.corruptionQuarantine(tdb, cf.File); err != nil {
+			hlog.Printf("error", "kvgo table %s file %d quarantine err %s",
+				tdb.tableName, cf.File, err.Error())
+		} else {
+			cn.corruption.mu.Lock()
+			cf.Quarantine = path
+			cn.corruption.mu.Unlock()
+		}
+	}
+
+	num, err := cn.corruptionRepairRange(tdb, cf.File)
+
+	cn.corruption.mu.Lock()
+	defer cn.corruption.mu.Unlock()
+
+	cf.repairing = false
+	cf.Repaired += num
+	if err != nil {
+		cf.RepairError = err.Error()
+		hlog.Printf("error", "kvgo table %s file %d repair err %s",
+			tdb.tableName, cf.File, err.Error())
+	} else {
+		cf.repaired, cf.RepairError = true, ""
+		hlog.Printf("warn", "kvgo table %s file %d repaired, %d keys",
+			tdb.tableName, cf.File, num)
+	}
+}
+
+// corruptionQuarantine copies the table file to the quarantine directory.
+func (cn *Conn) corruptionQuarantine(tdb *dbTable, num int64) (string, error) {
+
+	var (
+		fd   = storage.FileDesc{Type: storage.TypeTable, Num: num}
+		dirs = []string{dbTableDir(cn.opts.Storage.DataDirectory, tdb.tableId)}
+	)
+	if tdb.stor != nil {
+		for _, dir := range tdb.stor.dirs {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	qdir := filepath.Join(cn.opts.Storage.DataDirectory, corruptionQuarantineDir)
+	if err := os.MkdirAll(qdir, 0750); err != nil {
+		return "", err
+	}
+
+	for _, dir := range dirs {
+
+		fp, err := os.Open(storageTableFile(dir, fd))
+		if err != nil {
+			continue
+		}
+		defer fp.Close()
+
+		path := filepath.Join(qdir, fmt.Sprintf("%s-%06d.ldb", tdb.tableName, num))
+		fq, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+		if err != nil {
+			return "", err
+		}
+		defer fq.Close()
+
+		if _, err := io.Copy(fq, fp); err != nil {
+			return "", err
+		}
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("table file %d not found", num)
+}
+
+// corruptionRepairRange repairs the objects of the key range of the table
+// file from a replica, and returns the number of the objects written.
+func (cn *Conn) corruptionRepairRange(tdb *dbTable, num int64) (int64, error) {
+
+	var (
+		nodes, _ = cn.dataQuorum(tdb.tableName)
+		peers    []*ClientConfig
+	)
+	for _, v := range nodes {
+		if v.Addr != cn.opts.Server.Bind {
+			peers = append(peers, v)
+		}
+	}
+	if len(peers) == 0 {
+		return 0, errors.New("no replicas to repair from")
+	}
+
+	umin, umax, ok := tdb.db.TableFileRange(num)
+	if !ok {
+		return 0, nil // rewritten by the compactions
+	}
+
+	// the object keys of the meta and data namespaces of the range
+	var offset, cutset []byte
+	for _, ns := range []byte{nsKeyMeta, nsKeyData} {
+		var (
+			nsMin = keyEncode(ns, nil)
+			nsMax = keyPrefixLimit(nsMin)
+		)
+		if bytes.Compare(umax, nsMin) < 0 || bytes.Compare(umin, nsMax) >= 0 {
+			continue
+		}
+		kmin, kmax := []byte{}, []byte(nil)
+		if bytes.Compare(umin, nsMin) > 0 {
+			kmin = umin[1:]
+		}
+		if bytes.Compare(umax, nsMax) < 0 {
+			kmax = keyPrefixLimit(umax[1:])
+		}
+		if offset == nil || bytes.Compare(kmin, offset) < 0 {
+			offset = kmin
+		}
+		if cutset == nil || kmax == nil || bytes.Compare(kmax, cutset) > 0 {
+			cutset = kmax
+		}
+	}
+
+	var items []*kv2.ObjectItem
+	if offset != nil {
+		var err error
+		if items, err = cn.corruptionRangeItems(peers, tdb.tableName, offset, cutset); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tdb.db.CompactRangeDropCorrupted(util.Range{
+		Start: umin,
+		Limit: keyPrefixLimit(umax),
+	}); err != nil {
+		return 0, err
+	}
+	cn.valueCachePurge()
+
+	if offset == nil {
+		return 0, nil
+	}
+
+	for _, item := range items {
+		if err := cn.corruptionRepairItem(tdb, item); err != nil {
+			return 0, err
+		}
+	}
+
+	// the local objects of the range missed by all replicas are the older
+	// versions exposed by the dropped deletes
+	var (
+		have  = map[string]bool{}
+		stale [][]byte
+	)
+	for _, item := range items {
+		have[string(item.Meta.Key)] = true
+	}
+
+	var ret objectDigestResult
+	if err := cn.objectDigestRange(tdb, &objectDigestRequest{
+		Offset: offset,
+		Cutset: cutsetMax(cutset),
+	}, &ret); err != nil {
+		return 0, err
+	}
+	for _, d := range ret.Digests {
+		if !have[string(d.Key)] {
+			stale = append(stale, d.Key)
+		}
+	}
+
+	if len(stale) > 0 {
+		digests, err := cn.objectDigestQuorum(peers, tdb.tableName, stale, len(peers))
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range stale {
+			if objectDigestsHave(digests, key) {
+				continue
+			}
+			rr := kv2.NewObjectWriter(key, nil).TableNameSet(tdb.tableName).ModeDeleteSet(true)
+			if rs := cn.commitLocal(rr, 0); !rs.OK() {
+				return 0, rs.Error()
+			}
+		}
+	}
+
+	return int64(len(items) + len(stale)), nil
+}
+
+// corruptionRepairItem writes the object of the replica if the local data
+// entry is older or dropped, the meta entry of the same version may survive
+// the dropped blocks, so it is removed first to not skip the write.
+func (cn *Conn) corruptionRepairItem(tdb *dbTable, item *kv2.ObjectItem) error {
+
+	if item.Meta == nil || item.Meta.Version == 0 {
+		return nil
+	}
+
+	mu := cn.commitLock(tdb.tableName, item.Meta.Key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	bs, err := tdb.db.Get(keyEncode(nsKeyData, item.Meta.Key), nil)
+	if err == nil {
+		if local, err := kv2.ObjectItemDecode(bs); err == nil &&
+			local.Meta.Version >= item.Meta.Version {
+			return nil
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if err := tdb.db.Delete(keyEncode(nsKeyMeta, item.Meta.Key), nil); err != nil {
+		return err
+	}
+
+	ow := &kv2.ObjectWriter{
+		Meta: item.Meta,
+		Data: item.Data,
+	}
+	ow.TableNameSet(tdb.tableName)
+
+	if rs := cn.commitLocked(ow, item.Meta.Version, false); !rs.OK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// corruptionRangeItems reads the objects of the range [offset, cutset) from
+// the first replica that serves them, nil cutset for the end of the table.
+func (cn *Conn) corruptionRangeItems(peers []*ClientConfig,
+	table string, offset, cutset []byte) ([]*kv2.ObjectItem, error) {
+
+	var err error
+
+	for _, v := range peers {
+
+		var items []*kv2.ObjectItem
+
+		if items, err = cn.objectDigestRangeRemote(v, table, offset, cutsetMax(cutset)); err == nil {
+			return items, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (cn *Conn) objectDigestRangeRemote(node *ClientConfig,
+	table string, offset, cutset []byte) ([]*kv2.ObjectItem, error) {
+
+	var items []*kv2.ObjectItem
+
+	for {
+
+		body, err := json.Marshal(&objectDigestRequest{
+			Table:  table,
+			Values: true,
+			Offset: offset,
+			Cutset: cutset,
+			Limit:  corruptionRepairBatch,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+		rs, err := cn.transport.SysCmd(ctx, node, &kv2.SysCmdRequest{
+			Method: "ObjectDigest",
+			Body:   body,
+		})
+		fc()
+		if err != nil {
+			return nil, err
+		}
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+
+		var ret objectDigestResult
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &ret); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, d := range ret.Digests {
+			var item kv2.ObjectItem
+			if err := kv2.StdProto.Decode(d.Item, &item); err != nil {
+				return nil, err
+			}
+			items = append(items, &item)
+		}
+
+		if len(ret.Digests) < corruptionRepairBatch {
+			return items, nil
+		}
+		offset = append(bytesClone(ret.Digests[len(ret.Digests)-1].Key), 0x00)
+	}
+}
+
+// cutsetMax returns the cutset of the range, the nil cutset is the end of
+// the keys.
+func cutsetMax(cutset []byte) []byte {
+	if cutset == nil {
+		return []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	}
+	return cutset
+}
+
+// corruptionRead reads the key from the replicas after a corrupted local
+// read, and repairs the key in the background.
+func (cn *Conn) corruptionRead(tdb *dbTable, key []byte, rerr error) (*kv2.ObjectItem, error) {
+
+	cn.corruptionReport(tdb, rerr)
+
+	nodes, _ := cn.dataQuorum(tdb.tableName)
+
+	for _, v := range nodes {
+
+		if v.Addr == cn.opts.Server.Bind {
+			continue
+		}
+
+		item, err := cn.objectDigestValue(v, tdb.tableName, key)
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			if err := cn.objectRepairLocal(tdb.tableName, []*kv2.ObjectItem{item}); err != nil {
+				hlog.Printf("warn", "kvgo table %s corruption repair err %s",
+					tdb.tableName, err.Error())
+				return
+			}
+			cn.corruption.mu.Lock()
+			if cf := cn.corruption.files[fmt.Sprintf("%s/%d",
+				tdb.tableName, corruptionFileNum(rerr))]; cf != nil {
+				cf.Repaired += 1
+			}
+			cn.corruption.mu.Unlock()
+		}()
+
+		return item, nil
+	}
+
+	return nil, rerr
+}
+
+// tableFileNums returns the numbers of the table files of the current
+// version of the table.
+func tableFileNums(tdb *dbTable) map[int64]bool {
+
+	ls := map[int64]bool{}
+
+	v, err := tdb.db.GetProperty("leveldb.sstables")
+	if err != nil {
+		return ls
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(v))
+	for sc.Scan() {
+		if n := strings.IndexByte(sc.Text(), ':'); n > 0 {
+			if num, err := strconv.ParseInt(sc.Text()[:n], 10, 64); err == nil {
+				ls[num] = true
+			}
+		}
+	}
+
+	return ls
+}
+
+// Corruptions returns the number of the corrupted reads of the node and the
+// quarantined table files.
+func (cn *Conn) Corruptions() (int64, []*CorruptionFile) {
+
+	cn.corruption.mu.Lock()
+	var (
+		total = cn.corruption.total
+		ls    = []*CorruptionFile{}
+	)
+	for _, v := range cn.corruption.files {
+		cf := *v
+		ls = append(ls, &cf)
+	}
+	cn.corruption.mu.Unlock()
+
+	nums := map[string]map[int64]bool{}
+	for _, cf := range ls {
+		if _, ok := nums[cf.Table]; !ok {
+			if tdb := cn.tabledb(cf.Table); tdb != nil {
+				nums[cf.Table] = tableFileNums(tdb)
+			} else {
+				nums[cf.Table] = nil
+			}
+		}
+		cf.Live = nums[cf.Table][cf.File]
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Created < ls[j].Created
+	})
+
+	return total, ls
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+const CryptoProviderStd = "std"
+
+// CryptoProvider is the implementation of the hashes, the ciphers and the
+// signatures of the auth (the key tokens, the JWTs and the signatures of
+// the tiering requests) and of the encryption at rest (the backups and the
+// values of ClientEncryption), so a build may link a FIPS validated module
+// (e.g. BoringCrypto) by CryptoProviderSet in an init func. The default
+// provider is of the standard library, which is itself the FIPS module of
+// the builds of GOEXPERIMENT=boringcrypto or of GODEBUG=fips140=on.
+type CryptoProvider interface {
+	// The name of the provider, which is checked by Server.CryptoProvider
+	Name() string
+
+	// The hash of SHA-256, SHA-384 or SHA-512
+	NewHash(h crypto.Hash) (hash.Hash, error)
+
+	// The HMAC of the hash of SHA-256, SHA-384 or SHA-512
+	NewHMAC(h crypto.Hash, key []byte) (hash.Hash, error)
+
+	// The AES-GCM of the 128, 192 or 256 bits key
+	NewAEAD(key []byte) (cipher.AEAD, error)
+
+	// The cryptographically secure random source
+	Rand() io.Reader
+
+	// Verify checks the signature of the digest, RSA PKCS #1 v1.5 of the
+	// *rsa.PublicKey or ECDSA in ASN.1 DER of the *ecdsa.PublicKey
+	Verify(pub crypto.PublicKey, h crypto.Hash, digest, sig []byte) error
+}
+
+var (
+	cryptoMu       sync.RWMutex
+	cryptoProvided CryptoProvider = &stdCryptoProvider{}
+)
+
+// CryptoProviderSet replaces the crypto provider of the process, it should
+// be called before any Open.
+func CryptoProviderSet(p CryptoProvider) {
+	cryptoMu.Lock()
+	defer cryptoMu.Unlock()
+	if p == nil {
+		p = &stdCryptoProvider{}
+	}
+	cryptoProvided = p
+}
+
+func cryptoProvider() CryptoProvider {
+	cryptoMu.RLock()
+	defer cryptoMu.RUnlock()
+	return cryptoProvided
+}
+
+func cryptoHashValid(h crypto.Hash) error {
+	switch h {
+	case crypto.SHA256, crypto.SHA384, crypto.SHA512:
+		return nil
+	}
+	return errors.New("unsupported hash " + h.String())
+}
+
+type stdCryptoProvider struct{}
+
+func (it *stdCryptoProvider) Name() string {
+	return CryptoProviderStd
+}
+
+func (it *stdCryptoProvider) NewHash(h crypto.Hash) (hash.Hash, error) {
+	if err := cryptoHashValid(h); err != nil {
+		return nil, err
+	}
+	return h.New(), nil
+}
+
+func (it *stdCryptoProvider) NewHMAC(h crypto.Hash, key []byte) (hash.Hash, error) {
+	if err := cryptoHashValid(h); err != nil {
+		return nil, err
+	}
+	return hmac.New(h.New, key), nil
+}
+
+func (it *stdCryptoProvider) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (it *stdCryptoProvider) Rand() io.Reader {
+	return rand.Reader
+}
+
+func (it *stdCryptoProvider) Verify(pub crypto.PublicKey, h crypto.Hash, digest, sig []byte) error {
+
+	switch k := pub.(type) {
+
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, sig) {
+			return errors.New("invalid ecdsa signature")
+		}
+		return nil
+	}
+
+	return errors.New("unsupported public key")
+}
+
+// cryptoSum returns the hash of the data by the provider.
+func cryptoSum(h crypto.Hash, data []byte) ([]byte, error) {
+	hh, err := cryptoProvider().NewHash(h)
+	if err != nil {
+		return nil, err
+	}
+	hh.Write(data)
+	return hh.Sum(nil), nil
+}
+
+// cryptoHmac returns the HMAC of the data by the provider.
+func cryptoHmac(h crypto.Hash, key, data []byte) ([]byte, error) {
+	hh, err := cryptoProvider().NewHMAC(h, key)
+	if err != nil {
+		return nil, err
+	}
+	hh.Write(data)
+	return hh.Sum(nil), nil
+}
+
+func cryptoRandRead(b []byte) error {
+	_, err := io.ReadFull(cryptoProvider().Rand(), b)
+	return err
+}
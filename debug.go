@@ -0,0 +1,94 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/hooto/hlog4g/hlog"
+)
+
+const (
+	// the sampling rates of the block and mutex profiles while the debug
+	// listener is enabled
+	debugBlockProfileRate     = 10000 // in nanoseconds
+	debugMutexProfileFraction = 5
+)
+
+// debugServe starts the debug listener of Server.DebugBind, which serves
+// the pprof profiles under /debug/pprof/, the expvar variables under
+// /debug/vars, the stacks of all goroutines under /debug/goroutines, and
+// the recent rpc requests under /debug/requests.
+// The contended locks are sampled into /debug/pprof/mutex and
+// /debug/pprof/block. If the server access key is setup the requests are
+// authenticated the same as the status page.
+func (cn *Conn) debugServe() error {
+
+	lis, err := listen(SystemdListenerDebug, cn.opts.Server.DebugBind)
+	if err != nil {
+		return err
+	}
+	hlog.Printf("info", "debug bind %s", lis.Addr().String())
+
+	lis = cn.firewallListen(FirewallListenerDebug, lis)
+
+	runtime.SetBlockProfileRate(debugBlockProfileRate)
+	runtime.SetMutexProfileFraction(debugMutexProfileFraction)
+
+	auth := func(fn http.HandlerFunc) http.HandlerFunc {
+		if cn.opts.Server.AccessKey == nil {
+			return fn
+		}
+		return cn.httpAuth(fn)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", auth(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", auth(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", auth(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", auth(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", auth(pprof.Trace))
+	mux.HandleFunc("/debug/vars", auth(expvar.Handler().ServeHTTP))
+	mux.HandleFunc("/debug/goroutines", auth(debugGoroutines))
+	mux.HandleFunc("/debug/requests", auth(cn.debugRequests))
+
+	cn.debugServer = &http.Server{
+		Handler: mux,
+	}
+
+	go cn.debugServer.Serve(lis)
+
+	return nil
+}
+
+// debugGoroutines writes the stacks of all goroutines, the goroutines
+// waiting for the locks are reported with the wait reason and duration
+// (e.g. "[sync.Mutex.Lock, 2 minutes]").
+func debugGoroutines(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
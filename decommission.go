@@ -0,0 +1,533 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	DecommissionDraining = "draining"
+	DecommissionRemoving = "removing"
+	DecommissionRemoved  = "removed"
+	DecommissionFailed   = "failed"
+
+	decommissionCheckSleep = 2e9
+	decommissionTimeout    = int64(3600)
+)
+
+func keySysNodeRemoved(addr string) []byte {
+	return append([]byte{nsKeySys}, []byte("node:removed:"+addr)...)
+}
+
+// DecommissionStatus is the progress of the removal of a main node, the
+// node is removed after all other main nodes have replicated its tables.
+type DecommissionStatus struct {
+	Addr    string `json:"addr"`
+	State   string `json:"state"`
+	Tables  int    `json:"tables"`
+	Synced  int    `json:"synced"`
+	Message string `json:"message,omitempty"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+type clusterMembers struct {
+	mu           sync.RWMutex
+	removed      map[string]bool
+	nodes        []*ClientConfig
+	learners     []*ClientConfig
+	replicaOf    []*ConfigReplicaOfNode
+	decommission map[string]*DecommissionStatus
+	joins        map[string]*NodeJoinStatus
+	epoch        uint64
+	epochSeen    uint64
+	epochClaimed uint64
+}
+
+// mainNodes returns the main nodes of the cluster without the nodes removed
+// by the decommissions and the learners.
+func (cn *Conn) mainNodes() []*ClientConfig {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	if cn.members.nodes != nil {
+		return cn.members.nodes
+	}
+	return cn.opts.Cluster.MainNodes
+}
+
+// membersRefresh loads the removed and the added nodes from the system
+// table.
+func (cn *Conn) membersRefresh() error {
+
+	if cn.dbSys == nil {
+		return nil
+	}
+
+	if err := cn.epochLoad(); err != nil {
+		return err
+	}
+
+	removed := map[string]bool{}
+
+	iter := cn.dbSys.NewIterator(util.BytesPrefix(keySysNodeRemoved("")), nil)
+	for iter.Next() {
+		removed[string(iter.Key()[len(keySysNodeRemoved("")):])] = true
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	added, replicaOfAdded, replicaOfRemoved, err := cn.membersAdded()
+	if err != nil {
+		return err
+	}
+
+	var (
+		nodes    = []*ClientConfig{}
+		learners = []*ClientConfig{}
+		states   = map[string]*nodeMember{}
+	)
+
+	for _, m := range added {
+		states[m.Node.Addr] = m
+	}
+
+	for _, v := range cn.opts.Cluster.MainNodes {
+		if removed[v.Addr] {
+			continue
+		}
+		if m, ok := states[v.Addr]; ok && m.State == nodeStateLearner {
+			learners = append(learners, v)
+		} else {
+			nodes = append(nodes, v)
+		}
+		delete(states, v.Addr)
+	}
+
+	for _, m := range added {
+		if _, ok := states[m.Node.Addr]; !ok || removed[m.Node.Addr] {
+			continue
+		}
+		if !m.Node.accessKeyValid() {
+			return fmt.Errorf("node %s, no access_key setup", m.Node.Addr)
+		}
+		if err := cn.keyMgr.KeySet(m.Node.AccessKey); err != nil {
+			return err
+		}
+		if m.State == nodeStateLearner {
+			learners = append(learners, m.Node)
+		} else {
+			nodes = append(nodes, m.Node)
+		}
+	}
+
+	replicaOf := []*ConfigReplicaOfNode{}
+	for _, v := range cn.opts.Cluster.ReplicaOfNodes {
+		if v.ClientConfig == nil || !replicaOfRemoved[v.Addr] {
+			replicaOf = append(replicaOf, v)
+		}
+	}
+	for _, v := range replicaOfAdded {
+		replicaOf = append(replicaOf, v)
+	}
+
+	cn.members.mu.Lock()
+	cn.members.removed = removed
+	cn.members.nodes = nodes
+	cn.members.learners = learners
+	cn.members.replicaOf = replicaOf
+	cn.members.mu.Unlock()
+
+	return nil
+}
+
+// nodeRemoved returns whether the local node has been removed from the
+// cluster, the removed node refuses to coordinate the writes.
+func (cn *Conn) nodeRemoved() bool {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	return cn.members.removed[cn.opts.Server.Bind]
+}
+
+type decommissionRequest struct {
+	Addr  string `json:"addr,omitempty"`
+	Epoch uint64 `json:"epoch,omitempty"`
+}
+
+// nodeLogOffsets returns the offsets of the logs of the tables of the local
+// node the other nodes can pull, or the offsets of the logs of the tables
+// pulled from the node addr.
+func (cn *Conn) nodeLogOffsets(addr string) (map[string]uint64, error) {
+
+	cn.mu.RLock()
+	tables := []*dbTable{}
+	for _, tdb := range cn.tables {
+		if tdb.db != nil {
+			tables = append(tables, tdb)
+		}
+	}
+	cn.mu.RUnlock()
+
+	offsets := map[string]uint64{}
+
+	for _, tdb := range tables {
+
+		if addr == "" {
+			offset, err := tdb.objectLogPullOffset()
+			if err != nil {
+				return nil, err
+			}
+			offsets[tdb.tableName] = offset
+			continue
+		}
+
+		offset, err := tdb.objectLogAsyncOffset(addr, tdb.tableName)
+		if err != nil {
+			return nil, err
+		}
+		offsets[tdb.tableName] = offset
+	}
+
+	return offsets, nil
+}
+
+// objectLogPullOffset returns the version of the newest log not after the
+// safe log offset, which is the last one the other nodes can pull, the
+// versions taken by the aborted or the skipped writes have no log.
+func (tdb *dbTable) objectLogPullOffset() (uint64, error) {
+
+	iter := tdb.db.NewIterator(&util.Range{
+		Start: keyEncode(nsKeyLog, uint64ToBytes(0)),
+		Limit: keyEncode(nsKeyLog, uint64ToBytes(tdb.objectLogSafeOffset()+1)),
+	}, nil)
+	defer iter.Release()
+
+	offset := uint64(0)
+	if iter.Last() && len(iter.Key()) == 9 {
+		offset = binary.BigEndian.Uint64(iter.Key()[1:])
+	}
+
+	return offset, iter.Error()
+}
+
+func nodeCmdRemote(node *ClientConfig, method string, req interface{}, ret interface{}) error {
+
+	c, err := node.NewClient()
+	if err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rs := c.Connector().SysCmd(&kv2.SysCmdRequest{
+		Method: method,
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return fmt.Errorf("node %s, err %s", node.Addr, rs.Message)
+	}
+
+	if ret != nil && len(rs.Items) > 0 {
+		return wireDecode(rs.DataValue().Bytes(), ret)
+	}
+
+	return nil
+}
+
+// Decommission starts the removal of the main node addr from the cluster,
+// the node is removed from the membership of all main nodes after the other
+// main nodes have replicated all of its tables, the progress is returned by
+// DecommissionStatusList.
+func (cn *Conn) Decommission(addr string) error {
+
+	if cn.opts.ClientConnectEnable || len(cn.opts.Cluster.MainNodes) == 0 {
+		return errors.New("decommission only supported in the main nodes of a cluster")
+	}
+
+	var (
+		target *ClientConfig
+		others = []*ClientConfig{}
+	)
+
+	for _, v := range cn.mainNodes() {
+		if v.Addr == addr {
+			target = v
+		} else {
+			others = append(others, v)
+		}
+	}
+
+	if target == nil {
+		return errors.New("node not found in the cluster")
+	}
+
+	if len(dataNodes(others)) == 0 {
+		return errors.New("the last data node of the cluster can not be removed")
+	}
+
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+
+	if st, ok := cn.members.decommission[addr]; ok &&
+		(st.State == DecommissionDraining || st.State == DecommissionRemoving) {
+		return errors.New("decommission in progress")
+	}
+
+	if cn.members.changing() {
+		return errors.New("membership change in progress")
+	}
+
+	if cn.members.decommission == nil {
+		cn.members.decommission = map[string]*DecommissionStatus{}
+	}
+
+	tn := time.Now().UnixNano() / 1e6
+	st := &DecommissionStatus{
+		Addr:    addr,
+		State:   DecommissionDraining,
+		Created: tn,
+		Updated: tn,
+	}
+	cn.members.decommission[addr] = st
+
+	go cn.decommissionRun(target, others)
+
+	return nil
+}
+
+func (cn *Conn) decommissionUpdate(addr string, fn func(st *DecommissionStatus)) {
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+	if st, ok := cn.members.decommission[addr]; ok {
+		fn(st)
+		st.Updated = time.Now().UnixNano() / 1e6
+	}
+}
+
+func (cn *Conn) decommissionRun(target *ClientConfig, others []*ClientConfig) {
+
+	var (
+		tn  = time.Now().Unix()
+		err error
+	)
+
+	for !cn.close {
+
+		if time.Now().Unix()-tn > decommissionTimeout {
+			err = errors.New("timeout waiting for the replication")
+			break
+		}
+
+		var synced, total int
+		if synced, total, err = cn.decommissionCheck(target, others); err == nil {
+			cn.decommissionUpdate(target.Addr, func(st *DecommissionStatus) {
+				st.Tables, st.Synced, st.Message = total, synced, ""
+			})
+			if synced == total {
+				break
+			}
+		} else {
+			cn.decommissionUpdate(target.Addr, func(st *DecommissionStatus) {
+				st.Message = err.Error()
+			})
+		}
+
+		time.Sleep(decommissionCheckSleep)
+	}
+
+	if err == nil && cn.close {
+		err = errors.New("closed")
+	}
+
+	if err == nil {
+
+		cn.decommissionUpdate(target.Addr, func(st *DecommissionStatus) {
+			st.State = DecommissionRemoving
+		})
+
+		epoch := cn.epochNext()
+
+		// the target is the last one to remove, so it keeps pulling the
+		// logs of the others until then
+		for _, v := range append(others, target) {
+			if v.Addr == cn.opts.Server.Bind {
+				err = cn.nodeRemove(target.Addr, epoch)
+			} else {
+				err = nodeCmdRemote(v, "NodeRemove", &decommissionRequest{
+					Addr:  target.Addr,
+					Epoch: epoch,
+				}, nil)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	cn.decommissionUpdate(target.Addr, func(st *DecommissionStatus) {
+		if err != nil {
+			st.State, st.Message = DecommissionFailed, err.Error()
+		} else {
+			st.State, st.Message = DecommissionRemoved, ""
+		}
+	})
+
+	if err != nil {
+		hlog.Printf("warn", "kvgo decommission %s err %s", target.Addr, err.Error())
+	} else {
+		hlog.Printf("info", "kvgo decommission %s done", target.Addr)
+	}
+}
+
+// decommissionCheck returns the number of the tables of the target which
+// have been replicated by all other data nodes.
+func (cn *Conn) decommissionCheck(target *ClientConfig, others []*ClientConfig) (int, int, error) {
+
+	others = dataNodes(others)
+
+	var offsets map[string]uint64
+
+	if target.Addr == cn.opts.Server.Bind {
+		var err error
+		if offsets, err = cn.nodeLogOffsets(""); err != nil {
+			return 0, 0, err
+		}
+	} else if err := nodeCmdRemote(target, "NodeLogOffsets",
+		&decommissionRequest{}, &offsets); err != nil {
+		return 0, 0, err
+	}
+
+	synced := map[string]int{}
+
+	for _, v := range others {
+
+		var offsets2 map[string]uint64
+
+		if v.Addr == cn.opts.Server.Bind {
+			var err error
+			if offsets2, err = cn.nodeLogOffsets(target.Addr); err != nil {
+				return 0, 0, err
+			}
+		} else if err := nodeCmdRemote(v, "NodeLogOffsets", &decommissionRequest{
+			Addr: target.Addr,
+		}, &offsets2); err != nil {
+			return 0, 0, err
+		}
+
+		for name, offset := range offsets {
+			if v2, ok := offsets2[name]; ok && v2 >= offset {
+				synced[name] += 1
+			}
+		}
+	}
+
+	num := 0
+	for name := range offsets {
+		if synced[name] == len(others) {
+			num += 1
+		}
+	}
+
+	return num, len(offsets), nil
+}
+
+func (cn *Conn) nodeRemove(addr string, epoch uint64) error {
+	if err := cn.dbSys.Put(keySysNodeRemoved(addr), []byte("1"), nil); err != nil {
+		return err
+	}
+	if err := cn.epochSet(epoch); err != nil {
+		return err
+	}
+	return cn.membersRefresh()
+}
+
+// DecommissionStatusList returns the decommissions started by this node.
+func (cn *Conn) DecommissionStatusList() []*DecommissionStatus {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	ls := []*DecommissionStatus{}
+	for _, v := range cn.members.decommission {
+		st := *v
+		ls = append(ls, &st)
+	}
+	return ls
+}
+
+func (cn *Conn) decommissionCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req decommissionRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	var ret interface{}
+
+	switch method {
+
+	case "NodeDecommission":
+		if err := cn.Decommission(req.Addr); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		return kv2.NewObjectResultOK()
+
+	case "NodeDecommissionStatus":
+		ret = cn.DecommissionStatusList()
+
+	case "NodeLogOffsets":
+		offsets, err := cn.nodeLogOffsets(req.Addr)
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		ret = offsets
+
+	case "NodeRemove":
+		if req.Addr == "" {
+			return kv2.NewObjectResultClientError(errors.New("no addr setup"))
+		}
+		if err := cn.nodeRemove(req.Addr, req.Epoch); err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		return kv2.NewObjectResultOK()
+	}
+
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
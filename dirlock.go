@@ -0,0 +1,107 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hooto/hlog4g/hlog"
+)
+
+const (
+	dirLockFile = "kvgo.lock"
+)
+
+// dirLock is the exclusive lock of the data directory held by the process
+// of the store, the lock file keeps the pid of the holder.
+type dirLock struct {
+	f *os.File
+}
+
+func dirLockPid(path string) int {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(bs)))
+	return pid
+}
+
+// dirLockAcquire locks the data directory. If force is set and the lock is
+// held by a process that is not alive (e.g. a stale lock left on a network
+// filesystem), the lock file is removed and locked again.
+func dirLockAcquire(dir string, force bool) (*dirLock, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, dirLockFile)
+
+	for retry := 0; ; retry++ {
+
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = fileLockTry(f); err == nil {
+			if err = f.Truncate(0); err == nil {
+				_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+			}
+			if err == nil {
+				err = f.Sync()
+			}
+			if err != nil {
+				fileUnlock(f)
+				f.Close()
+				return nil, err
+			}
+			return &dirLock{f: f}, nil
+		}
+
+		f.Close()
+
+		pid := dirLockPid(path)
+
+		if force && retry == 0 && pid > 0 && pid != os.Getpid() && !processAlive(pid) {
+			hlog.Printf("warn", "kvgo force unlock %s of pid %d", dir, pid)
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if pid > 0 {
+			return nil, fmt.Errorf("data directory %s already in use by pid %d", dir, pid)
+		}
+		return nil, fmt.Errorf("data directory %s already in use, err %s", dir, err.Error())
+	}
+}
+
+func (it *dirLock) Release() error {
+	if it == nil || it.f == nil {
+		return nil
+	}
+	fileUnlock(it.f)
+	err := it.f.Close()
+	it.f = nil
+	return err
+}
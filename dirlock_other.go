@@ -0,0 +1,37 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package kvgo
+
+import (
+	"os"
+)
+
+// the data directory is only locked by the LOCK files of the tables on the
+// other platforms
+
+func fileLockTry(f *os.File) error {
+	return nil
+}
+
+func fileUnlock(f *os.File) error {
+	return nil
+}
+
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package kvgo
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x01
+	lockfileExclusiveLock   = 0x02
+
+	processQueryLimitedInformation = 0x1000
+	processStillActive             = 259
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+// the locked byte range is far beyond the pid written in the lock file, so
+// the pid can be read by the other processes
+func fileLockOverlapped() *syscall.Overlapped {
+	return &syscall.Overlapped{
+		OffsetHigh: 0x7fffffff,
+	}
+}
+
+func fileLockTry(f *os.File) error {
+	r1, _, e1 := syscall.Syscall6(procLockFileEx.Addr(), 6, f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(fileLockOverlapped())))
+	if r1 == 0 {
+		if e1 != 0 {
+			return error(e1)
+		}
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+func fileUnlock(f *os.File) error {
+	r1, _, e1 := syscall.Syscall6(procUnlockFileEx.Addr(), 5, f.Fd(),
+		0, 1, 0, uintptr(unsafe.Pointer(fileLockOverlapped())), 0)
+	if r1 == 0 {
+		if e1 != 0 {
+			return error(e1)
+		}
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == processStillActive
+}
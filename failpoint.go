@@ -0,0 +1,119 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build failpoint
+// +build failpoint
+
+package kvgo
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const failpointEnabled = true
+
+// FailpointAction is the fault injected at a failpoint, the delay is applied
+// before the error, and Probability in (0, 1] limits the fraction of hits
+// that inject the fault (0 means always).
+type FailpointAction struct {
+	Delay       time.Duration
+	Err         error
+	Probability float64
+}
+
+var (
+	failpointMu     sync.RWMutex
+	failpointSet    = map[string]*FailpointAction{}
+	failpointTimers = map[string]*time.Timer{}
+)
+
+// FailpointEnable injects the action at the failpoint of the name (one of
+// the Failpoint* constants) until FailpointDisable is called. It is only
+// available in the builds with the failpoint tag:
+//
+//	go test -tags failpoint ./...
+func FailpointEnable(name string, action FailpointAction) {
+	failpointMu.Lock()
+	defer failpointMu.Unlock()
+	failpointSet[name] = &action
+}
+
+func FailpointDisable(name string) {
+	failpointMu.Lock()
+	defer failpointMu.Unlock()
+	delete(failpointSet, name)
+	if tr, ok := failpointTimers[name]; ok {
+		tr.Stop()
+		delete(failpointTimers, name)
+	}
+}
+
+// failpointEnableFor enables the failpoint, it is disabled after the ttl if
+// ttl > 0, so a fault injected by a remote drill is not left behind.
+func failpointEnableFor(name string, delay time.Duration, err error, probability float64, ttl time.Duration) error {
+
+	FailpointEnable(name, FailpointAction{
+		Delay:       delay,
+		Err:         err,
+		Probability: probability,
+	})
+
+	if ttl > 0 {
+		failpointMu.Lock()
+		if tr, ok := failpointTimers[name]; ok {
+			tr.Stop()
+		}
+		var tr *time.Timer
+		tr = time.AfterFunc(ttl, func() {
+			failpointMu.Lock()
+			defer failpointMu.Unlock()
+			if failpointTimers[name] == tr {
+				delete(failpointSet, name)
+				delete(failpointTimers, name)
+			}
+		})
+		failpointTimers[name] = tr
+		failpointMu.Unlock()
+	}
+
+	return nil
+}
+
+func failpointDisable(name string) error {
+	FailpointDisable(name)
+	return nil
+}
+
+func failpointInject(name string) error {
+
+	failpointMu.RLock()
+	action, ok := failpointSet[name]
+	failpointMu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	if action.Probability > 0 && rand.Float64() >= action.Probability {
+		return nil
+	}
+
+	if action.Delay > 0 {
+		time.Sleep(action.Delay)
+	}
+
+	return action.Err
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+var failpointNames = map[string]bool{
+	FailpointSyncWrite:      true,
+	FailpointCompactionSlow: true,
+	FailpointReplicaDrop:    true,
+	FailpointRpcLatency:     true,
+	FailpointPartition:      true,
+}
+
+// NodeFailpointRequest is the request of the NodeFailpoint command, which
+// injects the faults of the resilience drills (see kvgo-cli cluster chaos)
+// into the nodes built with the failpoint tag.
+type NodeFailpointRequest struct {
+	Name        string  `json:"name"`
+	Enable      bool    `json:"enable"`
+	Delay       int64   `json:"delay,omitempty"` // in milliseconds
+	Error       string  `json:"error,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+
+	// the seconds after which the failpoint is disabled by the node itself
+	Duration int64 `json:"duration,omitempty"`
+}
+
+func (cn *Conn) failpointCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req NodeFailpointRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	if !failpointNames[req.Name] {
+		return kv2.NewObjectResultClientError(errors.New("failpoint not found"))
+	}
+
+	var err error
+	if req.Enable {
+		var ferr error
+		if req.Error != "" {
+			ferr = errors.New(req.Error)
+		} else if req.Delay == 0 {
+			ferr = errors.New("failpoint " + req.Name)
+		}
+		err = failpointEnableFor(req.Name, time.Duration(req.Delay)*time.Millisecond,
+			ferr, req.Probability, time.Duration(req.Duration)*time.Second)
+	} else {
+		err = failpointDisable(req.Name)
+	}
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(&req)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
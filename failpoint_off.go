@@ -0,0 +1,39 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !failpoint
+// +build !failpoint
+
+package kvgo
+
+import (
+	"errors"
+	"time"
+)
+
+const failpointEnabled = false
+
+var errFailpointNotEnabled = errors.New("failpoints not enabled, the node is not built with the failpoint tag")
+
+func failpointInject(name string) error {
+	return nil
+}
+
+func failpointEnableFor(name string, delay time.Duration, err error, probability float64, ttl time.Duration) error {
+	return errFailpointNotEnabled
+}
+
+func failpointDisable(name string) error {
+	return errFailpointNotEnabled
+}
@@ -0,0 +1,302 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc/metadata"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// EpochMetadataKey is the grpc metadata of the membership epoch of the
+// node coordinating a write.
+//
+// The epoch is increased by every change of the membership of the main
+// nodes and is sent with the proposals of the writes. The nodes reject the
+// proposals of an older epoch, so a node that missed a change, e.g. it was
+// partitioned when it was removed from the cluster, can not get its writes
+// accepted by the quorum of a membership it does not know. Such a node is
+// fenced: it refuses to coordinate the writes until it has caught up with
+// the membership of the cluster, and a removed node never does.
+const EpochMetadataKey = "x-kvgo-epoch"
+
+const epochFencedPrefix = "fenced, epoch "
+
+var keySysMemberEpoch = append([]byte{nsKeySys}, []byte("member:epoch")...)
+
+type nodeMembersResult struct {
+	Epoch   uint64        `json:"epoch"`
+	Members []*nodeMember `json:"members"`
+	Removed []string      `json:"removed,omitempty"`
+}
+
+// memberEpoch returns the membership epoch of the node and the highest
+// epoch it has seen from the other nodes.
+func (cn *Conn) memberEpoch() (uint64, uint64) {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	return cn.members.epoch, cn.members.epochSeen
+}
+
+// Fenced returns whether the node has seen a membership epoch newer than
+// its own.
+func (cn *Conn) Fenced() bool {
+	epoch, seen := cn.memberEpoch()
+	return seen > epoch
+}
+
+func (cn *Conn) epochLoad() error {
+
+	bs, err := cn.dbSys.Get(keySysMemberEpoch, nil)
+	if err != nil {
+		if err.Error() == ldbNotFound {
+			return nil
+		}
+		return err
+	}
+
+	epoch, err := strconv.ParseUint(string(bs), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	cn.members.mu.Lock()
+	cn.members.epoch = epoch
+	cn.members.mu.Unlock()
+
+	return nil
+}
+
+// epochSet saves the epoch of a membership change if it is newer.
+func (cn *Conn) epochSet(epoch uint64) error {
+
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+
+	if epoch <= cn.members.epoch {
+		return nil
+	}
+
+	if err := cn.dbSys.Put(keySysMemberEpoch,
+		[]byte(strconv.FormatUint(epoch, 10)), nil); err != nil {
+		return err
+	}
+
+	cn.members.epoch = epoch
+
+	return nil
+}
+
+func (cn *Conn) epochObserve(epoch uint64) {
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+	if epoch > cn.members.epochSeen {
+		cn.members.epochSeen = epoch
+		if epoch > cn.members.epoch {
+			hlog.Printf("warn", "kvgo node fenced, epoch %d, cluster epoch %d",
+				cn.members.epoch, epoch)
+		}
+	}
+}
+
+// epochNext returns the epoch of a new membership change.
+func (cn *Conn) epochNext() uint64 {
+	epoch, seen := cn.memberEpoch()
+	if seen > epoch {
+		epoch = seen
+	}
+	return epoch + 1
+}
+
+func (cn *Conn) epochOutgoing(ctx context.Context) context.Context {
+	epoch, _ := cn.memberEpoch()
+	return metadata.AppendToOutgoingContext(ctx,
+		EpochMetadataKey, strconv.FormatUint(epoch, 10))
+}
+
+// epochCheck returns the fenced result if the proposal is of an older
+// epoch, or else the epoch of the proposal, which is claimed by epochClaim
+// after the proposal is accepted. The epochs are of the proposals of the
+// nodes (of the sys/all permission) only, the epochs of the other callers
+// are ignored, and the proposals without an epoch are of the nodes of the
+// older versions and are accepted.
+func (cn *Conn) epochCheck(ctx context.Context, av appValidator) (uint64, *kv2.ObjectResult) {
+
+	if av == nil || av.Allow(authPermSysAll) != nil {
+		return 0, nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0, nil
+	}
+
+	vs := md.Get(EpochMetadataKey)
+	if len(vs) == 0 {
+		return 0, nil
+	}
+
+	remote, err := strconv.ParseUint(vs[0], 10, 64)
+	if err != nil {
+		return 0, kv2.NewObjectResultClientError(errors.New("invalid epoch"))
+	}
+
+	if epoch, _ := cn.memberEpoch(); remote < epoch {
+		return 0, kv2.NewObjectResultClientError(fmt.Errorf(epochFencedPrefix+"%d", epoch))
+	}
+
+	return remote, nil
+}
+
+// epochClaim records the newer epoch of an accepted proposal. The node is
+// not fenced by the claim, epochSync fences it if a peer confirms the epoch
+// by its members.
+func (cn *Conn) epochClaim(epoch uint64) {
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+	if epoch > cn.members.epoch && epoch > cn.members.epochSeen &&
+		epoch > cn.members.epochClaimed {
+		cn.members.epochClaimed = epoch
+	}
+}
+
+// epochClaimPop returns the newer epoch claimed by the proposals and not
+// confirmed yet, and resets it.
+func (cn *Conn) epochClaimPop() uint64 {
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+	epoch := cn.members.epochClaimed
+	cn.members.epochClaimed = 0
+	if epoch <= cn.members.epoch {
+		return 0
+	}
+	return epoch
+}
+
+// epochFencedObserve records the epoch of the fenced result of a proposal.
+func (cn *Conn) epochFencedObserve(rs *kv2.ObjectResult) {
+	if rs != nil && strings.HasPrefix(rs.Message, epochFencedPrefix) {
+		if epoch, err := strconv.ParseUint(rs.Message[len(epochFencedPrefix):], 10, 64); err == nil {
+			cn.epochObserve(epoch)
+		}
+	}
+}
+
+func (cn *Conn) nodeMembers() *nodeMembersResult {
+
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+
+	ret := &nodeMembersResult{
+		Epoch: cn.members.epoch,
+	}
+
+	for _, v := range cn.members.nodes {
+		ret.Members = append(ret.Members, &nodeMember{
+			Node:  v,
+			State: nodeStateVoter,
+		})
+	}
+
+	for _, v := range cn.members.learners {
+		ret.Members = append(ret.Members, &nodeMember{
+			Node:  v,
+			State: nodeStateLearner,
+		})
+	}
+
+	for addr := range cn.members.removed {
+		ret.Removed = append(ret.Removed, addr)
+	}
+
+	return ret
+}
+
+// epochSync catches up the fenced node with the membership of the peer of
+// the newest epoch, the node is fenced once a peer confirms a newer epoch.
+func (cn *Conn) epochSync() error {
+
+	var newest *nodeMembersResult
+
+	for _, v := range cn.mainNodes() {
+
+		if v.Addr == cn.opts.Server.Bind {
+			continue
+		}
+
+		var ret nodeMembersResult
+		if err := nodeCmdRemote(v, "NodeMembers", struct{}{}, &ret); err != nil {
+			continue
+		}
+
+		if newest == nil || ret.Epoch > newest.Epoch {
+			newest = &ret
+		}
+	}
+
+	if epoch, _ := cn.memberEpoch(); newest == nil || newest.Epoch <= epoch {
+		return errors.New("no peer of the newer epoch found")
+	}
+
+	cn.epochObserve(newest.Epoch)
+
+	for _, addr := range newest.Removed {
+		if err := cn.dbSys.Put(keySysNodeRemoved(addr), []byte("1"), nil); err != nil {
+			return err
+		}
+	}
+
+	if err := cn.nodeJoinApply(newest.Members, newest.Epoch); err != nil {
+		return err
+	}
+
+	hlog.Printf("info", "kvgo node membership synced to epoch %d", newest.Epoch)
+
+	return nil
+}
+
+func (cn *Conn) workerEpochSync() {
+
+	if cn.dbSys == nil {
+		return
+	}
+
+	if claimed := cn.epochClaimPop(); cn.Fenced() {
+		if err := cn.epochSync(); err != nil {
+			hlog.Printf("warn", "kvgo node fenced, membership sync err %s", err.Error())
+		}
+	} else if claimed > 0 {
+		if err := cn.epochSync(); err != nil {
+			hlog.Printf("warn", "kvgo node epoch %d claimed, not confirmed, err %s",
+				claimed, err.Error())
+		}
+	}
+}
+
+func (cn *Conn) nodeMembersCmdLocal() *kv2.ObjectResult {
+	bs, err := json.Marshal(cn.nodeMembers())
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+	return sysCmdResultBytes(bs)
+}
@@ -0,0 +1,336 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	FirewallListenerRpc   = "rpc"
+	FirewallListenerHttp  = "http"
+	FirewallListenerDebug = "debug"
+
+	firewallLogInterval = int64(10e9)
+)
+
+// ConfigFirewall limits the client addresses by the CIDR lists (or the
+// single IPs), Allow and Deny of all listeners, and the ones of Listeners
+// (rpc, http or debug) are checked on the connections before any request
+// is read, and the ones of Identities (the access key ids or the JWT
+// subjects) on the calls of the public and internal services and of the
+// http endpoints before the permissions.
+// An address is denied if it is in a Deny list, or if an Allow list is set
+// and it is not in. The rpc listener also serves the other nodes of the
+// cluster, which should be allowed.
+type ConfigFirewall struct {
+	Allow      []string              `toml:"allow" json:"allow"`
+	Deny       []string              `toml:"deny" json:"deny"`
+	Listeners  []*ConfigFirewallRule `toml:"listeners" json:"listeners"`
+	Identities []*ConfigFirewallRule `toml:"identities" json:"identities"`
+}
+
+// ConfigFirewallRule is the CIDR lists of the listener or the identity of
+// the Name.
+type ConfigFirewallRule struct {
+	Name  string   `toml:"name" json:"name"`
+	Allow []string `toml:"allow" json:"allow"`
+	Deny  []string `toml:"deny" json:"deny"`
+}
+
+func (it *ConfigFirewall) Valid() error {
+	_, err := newFirewall(it)
+	return err
+}
+
+type firewallRule struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+type firewall struct {
+	global     *firewallRule
+	listeners  map[string]*firewallRule
+	identities map[string]*firewallRule
+	denied     int64
+	logged     int64
+}
+
+func firewallCidrs(ls []string) ([]*net.IPNet, error) {
+
+	ret := []*net.IPNet{}
+
+	for _, v := range ls {
+
+		v = strings.TrimSpace(v)
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid server/firewall address %s", v)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ret = append(ret, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server/firewall cidr %s", v)
+		}
+		ret = append(ret, n)
+	}
+
+	return ret, nil
+}
+
+func newFirewallRule(allow, deny []string) (*firewallRule, error) {
+
+	var (
+		it  = &firewallRule{}
+		err error
+	)
+
+	if it.allow, err = firewallCidrs(allow); err != nil {
+		return nil, err
+	}
+
+	if it.deny, err = firewallCidrs(deny); err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+func newFirewall(cfg *ConfigFirewall) (*firewall, error) {
+
+	if cfg == nil {
+		return nil, nil
+	}
+
+	global, err := newFirewallRule(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &firewall{
+		global:     global,
+		listeners:  map[string]*firewallRule{},
+		identities: map[string]*firewallRule{},
+	}
+
+	for _, v := range cfg.Listeners {
+		switch v.Name {
+		case FirewallListenerRpc, FirewallListenerHttp, FirewallListenerDebug:
+		default:
+			return nil, fmt.Errorf("invalid server/firewall/listeners name %s", v.Name)
+		}
+		if it.listeners[v.Name], err = newFirewallRule(v.Allow, v.Deny); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range cfg.Identities {
+		if v.Name == "" {
+			return nil, errors.New("invalid server/firewall/identities name")
+		}
+		if it.identities[v.Name], err = newFirewallRule(v.Allow, v.Deny); err != nil {
+			return nil, err
+		}
+	}
+
+	return it, nil
+}
+
+func (it *firewallRule) allowed(ip net.IP) bool {
+
+	for _, v := range it.deny {
+		if v.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(it.allow) == 0 {
+		return true
+	}
+
+	for _, v := range it.allow {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func firewallIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// deny counts the denied address, and logs it at most every 10 seconds.
+func (it *firewall) deny(name string, addr net.Addr) {
+
+	atomic.AddInt64(&it.denied, 1)
+
+	tn := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&it.logged); tn-last > firewallLogInterval &&
+		atomic.CompareAndSwapInt64(&it.logged, last, tn) {
+		hlog.Printf("warn", "kvgo firewall %s denied %s, %d denied in total",
+			name, addr, atomic.LoadInt64(&it.denied))
+	}
+}
+
+// allowListener returns true if the address of the unix sockets, or of the
+// rules of all listeners and of the listener is allowed.
+func (it *firewall) allowListener(name string, addr net.Addr) bool {
+
+	if it == nil {
+		return true
+	}
+
+	ip := firewallIP(addr)
+	if ip == nil {
+		return addr != nil && addr.Network() == "unix"
+	}
+
+	if !it.global.allowed(ip) {
+		return false
+	}
+
+	if r, ok := it.listeners[name]; ok && !r.allowed(ip) {
+		return false
+	}
+
+	return true
+}
+
+// allowIdentity returns nil if the address of the peer of the call is
+// allowed by the rule of the identity, or if no rule of the identity.
+func (it *firewall) allowIdentity(ctx context.Context, id string) error {
+
+	if it == nil {
+		return nil
+	}
+
+	if _, ok := it.identities[id]; !ok {
+		return nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return errors.New("firewall, no peer address found")
+	}
+
+	return it.allowIdentityAddr(id, p.Addr)
+}
+
+// allowIdentityAddr returns nil if the address is allowed by the rule of
+// the identity, or if no rule of the identity.
+func (it *firewall) allowIdentityAddr(id string, addr net.Addr) error {
+
+	if it == nil {
+		return nil
+	}
+
+	r, ok := it.identities[id]
+	if !ok {
+		return nil
+	}
+
+	if ip := firewallIP(addr); ip == nil || !r.allowed(ip) {
+		it.deny("identity "+id, addr)
+		return fmt.Errorf("firewall, address %s of %s denied", addr, id)
+	}
+
+	return nil
+}
+
+// firewallListener closes the connections of the denied addresses right
+// after they are accepted.
+type firewallListener struct {
+	net.Listener
+	fw   *firewall
+	name string
+}
+
+func (it *firewallListener) Accept() (net.Conn, error) {
+	for {
+		c, err := it.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if it.fw.allowListener(it.name, c.RemoteAddr()) {
+			return c, nil
+		}
+		it.fw.deny("listener "+it.name, c.RemoteAddr())
+		c.Close()
+	}
+}
+
+func (cn *Conn) firewallListen(name string, lis net.Listener) net.Listener {
+	if cn.firewall == nil {
+		return lis
+	}
+	return &firewallListener{
+		Listener: lis,
+		fw:       cn.firewall,
+		name:     name,
+	}
+}
+
+// FirewallDenied returns the number of the connections and the calls
+// denied by Server.Firewall.
+func (cn *Conn) FirewallDenied() int64 {
+	if cn.firewall == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&cn.firewall.denied)
+}
+
+// appIdentity returns the access key id or the JWT subject of the caller.
+func appIdentity(av appValidator) string {
+	switch v := av.(type) {
+	case *hauth.AppValidator:
+		if v != nil {
+			return v.Id
+		}
+	case *roleValidator:
+		return v.subject
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// The protocol version is increased when the encoding of the requests or
+// the results changes in a way the peers of the older versions can not
+// decode, the nodes accept the peers of the versions in [ProtocolVersionMin,
+// ProtocolVersion]. The peers without the handshake are of version 1.
+const (
+	ProtocolVersion    = uint32(2)
+	ProtocolVersionMin = uint32(1)
+)
+
+// The optional features of the protocol, the requests of a feature are only
+// sent to the peers which support it.
+const (
+	FeatureReplicaApply  = "replica-apply"
+	FeatureHistory       = "history"
+	FeatureSnapshot      = "snapshot"
+	FeaturePubSub        = "pubsub"
+	FeatureClusterStatus = "cluster-status"
+	FeatureHlcVersion    = "hlc-version"
+	FeatureSessionRead   = "session-read"
+	FeatureReadIndex     = "read-index"
+	FeatureQuorumRead    = "quorum-read"
+	FeatureMembership    = "membership"
+	FeatureWitness       = "witness"
+	FeatureMaintenance   = "maintenance"
+)
+
+var protocolFeatures = []string{
+	FeatureReplicaApply,
+	FeatureHistory,
+	FeatureSnapshot,
+	FeaturePubSub,
+	FeatureClusterStatus,
+	FeatureHlcVersion,
+	FeatureSessionRead,
+	FeatureReadIndex,
+	FeatureQuorumRead,
+	FeatureMembership,
+	FeatureWitness,
+	FeatureMaintenance,
+}
+
+// HandshakeInfo is the protocol version and the features of a peer,
+// exchanged by the client and the server when the client connects.
+type HandshakeInfo struct {
+	Version     string   `json:"version"`
+	Protocol    uint32   `json:"protocol"`
+	ProtocolMin uint32   `json:"protocol_min"`
+	Features    []string `json:"features,omitempty"`
+	Compressors []string `json:"compressors,omitempty"`
+}
+
+func handshakeLocal() *HandshakeInfo {
+	return &HandshakeInfo{
+		Version:     Version,
+		Protocol:    ProtocolVersion,
+		ProtocolMin: ProtocolVersionMin,
+		Features:    protocolFeatures,
+		Compressors: rpcCompressorList(),
+	}
+}
+
+// Feature returns whether the peer supports the feature.
+func (it *HandshakeInfo) Feature(name string) bool {
+	if it == nil {
+		return false
+	}
+	for _, v := range it.Features {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// compatible returns the error if the protocol versions of the local peer
+// and the remote peer have no overlap.
+func (it *HandshakeInfo) compatible(remote *HandshakeInfo, side string) error {
+	if remote.Protocol < it.ProtocolMin {
+		return fmt.Errorf("protocol version %d of the %s (%s) is not supported, "+
+			"versions %d-%d required, upgrade the %s",
+			remote.Protocol, side, remote.Version, it.ProtocolMin, it.Protocol, side)
+	}
+	if remote.ProtocolMin > it.Protocol {
+		return fmt.Errorf("protocol version %d (%s) is not supported by the %s, "+
+			"versions %d-%d required, upgrade this node",
+			it.Protocol, it.Version, side, remote.ProtocolMin, remote.Protocol)
+	}
+	return nil
+}
+
+func (cn *Conn) handshakeCmdLocal(body []byte) *kv2.ObjectResult {
+
+	var (
+		local  = handshakeLocal()
+		remote HandshakeInfo
+	)
+
+	if err := wireDecode(body, &remote); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	if err := local.compatible(&remote, "client"); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(local)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
+
+// clientHandshake exchanges the handshake on the new connection, the
+// servers without the handshake are taken as the protocol version 1
+// without the optional features.
+func clientHandshake(conn *grpc.ClientConn, timeout int64) (*HandshakeInfo, error) {
+
+	local := handshakeLocal()
+
+	bs, err := json.Marshal(local)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, fc := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer fc()
+
+	rs, err := kv2.NewPublicClient(conn).SysCmd(ctx, &kv2.SysCmdRequest{
+		Method: "Handshake",
+		Body:   bs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	remote := &HandshakeInfo{
+		Protocol:    1,
+		ProtocolMin: 1,
+	}
+
+	if !rs.OK() {
+		if !strings.Contains(rs.Message, "cmd not found") {
+			return nil, rs.Error()
+		}
+	} else if len(rs.Items) > 0 {
+		if err := wireDecode(rs.DataValue().Bytes(), remote); err != nil {
+			return nil, fmt.Errorf("invalid handshake of the server, err %s", err.Error())
+		}
+	}
+
+	if err := local.compatible(remote, "server"); err != nil {
+		return nil, err
+	}
+
+	return remote, nil
+}
+
+// Handshake returns the protocol version and the features of the server.
+func (it *ClientConfig) Handshake() (*HandshakeInfo, error) {
+
+	if _, err := it.NewClient(); err != nil {
+		return nil, err
+	}
+
+	if _, err := it.cc.reconnect(false); err != nil {
+		return nil, err
+	}
+
+	return it.cc.server, nil
+}
+
+// featureCheck returns the error if the server of the node does not
+// support the feature.
+func (it *ClientConfig) featureCheck(name string) error {
+	hs, err := it.Handshake()
+	if err != nil {
+		return err
+	}
+	if !hs.Feature(name) {
+		return fmt.Errorf("node %s (%s) does not support %s, upgrade it", it.Addr, hs.Version, name)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+)
+
+const (
+	readyPeerInterval = 5e9
+	readyPeerStale    = int64(30)
+)
+
+// readyPeerStatus is the log offsets of the other main nodes and the
+// upstream nodes pulled by the local node, refreshed in background so the
+// probes of /readyz do not call the other nodes.
+type readyPeerStatus struct {
+	mu      sync.RWMutex
+	peers   []*nodeStatusResult
+	updated int64
+}
+
+// httpHealthz reports the process is up.
+func (cn *Conn) httpHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// httpReadyz reports the node is ready to serve, see Ready.
+func (cn *Conn) httpReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := cn.Ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Ready returns nil if the store is open, the writes of the tables are not
+// stalled by the compactions, and the logs pulled from the other main nodes
+// and the upstream nodes lag behind them no more than
+// Server.ReadyLagTime. The log offsets of the other nodes are refreshed
+// every few seconds in background, the nodes not reachable are skipped, so
+// one node down does not make the others unready. A node in maintenance is
+// not ready.
+func (cn *Conn) Ready() error {
+
+	if cn.close {
+		return errors.New("closed")
+	}
+
+	if cn.Maintenance() {
+		return errors.New("in maintenance")
+	}
+
+	if cn.dbSys == nil {
+		return errors.New("store not open")
+	}
+
+	cn.mu.RLock()
+	for name, tdb := range cn.tables {
+		if tdb.db == nil {
+			cn.mu.RUnlock()
+			return fmt.Errorf("table %s not open", name)
+		}
+		var st leveldb.DBStats
+		if err := tdb.db.Stats(&st); err != nil {
+			cn.mu.RUnlock()
+			return fmt.Errorf("table %s, err %s", name, err.Error())
+		}
+		if st.WritePaused {
+			cn.mu.RUnlock()
+			return fmt.Errorf("table %s in write stall", name)
+		}
+	}
+	cn.mu.RUnlock()
+
+	local, err := cn.nodeStatus()
+	if err != nil {
+		return err
+	}
+
+	if lag := nodeStatusLag(local, cn.readyPeerList()); lag > cn.opts.Server.ReadyLagTime {
+		return fmt.Errorf("replication lag %d ms", lag)
+	}
+
+	return nil
+}
+
+// readyPeerList returns the cached log offsets of the other nodes, none if
+// they are not refreshed recently.
+func (cn *Conn) readyPeerList() []*nodeStatusResult {
+
+	cn.readyPeers.mu.RLock()
+	defer cn.readyPeers.mu.RUnlock()
+
+	if cn.readyPeers.updated+readyPeerStale < time.Now().Unix() {
+		return nil
+	}
+
+	return cn.readyPeers.peers
+}
+
+func (cn *Conn) readyPeerRefresh() error {
+
+	local, err := cn.nodeStatus()
+	if err != nil {
+		return err
+	}
+
+	peers := []*nodeStatusResult{}
+
+	for addr := range local.Pulled {
+		var offsets map[string]uint64
+		if err := nodeCmdRemote(cn.readyNode(addr), "NodeLogOffsets",
+			&decommissionRequest{}, &offsets); err != nil {
+			continue
+		}
+		peers = append(peers, &nodeStatusResult{
+			Addr:    addr,
+			Offsets: offsets,
+		})
+	}
+
+	cn.readyPeers.mu.Lock()
+	cn.readyPeers.peers, cn.readyPeers.updated = peers, time.Now().Unix()
+	cn.readyPeers.mu.Unlock()
+
+	return nil
+}
+
+func (cn *Conn) workerReadyPeer() {
+
+	for !cn.close {
+
+		time.Sleep(readyPeerInterval)
+
+		if cn.close || (len(cn.mainNodes()) < 2 && len(cn.replicaOfNodes()) == 0) {
+			continue
+		}
+
+		if err := cn.readyPeerRefresh(); err != nil {
+			hlog.Printf("warn", "kvgo ready peers refresh err %s", err.Error())
+		}
+	}
+}
+
+// readyNode returns the client config of the main node or upstream node.
+func (cn *Conn) readyNode(addr string) *ClientConfig {
+	for _, v := range cn.mainNodes() {
+		if v.Addr == addr {
+			return v
+		}
+	}
+	for _, v := range cn.replicaOfNodes() {
+		if v.ClientConfig != nil && v.Addr == addr {
+			return v.ClientConfig
+		}
+	}
+	return &ClientConfig{Addr: addr}
+}
@@ -0,0 +1,637 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	historyValueItem      = uint8(0)
+	historyValueTombstone = uint8(1)
+	historyRefreshTime    = int64(60)
+	historyRefreshLimit   = 10000
+)
+
+// historyKeyEncode returns the key of the version of the key in the history,
+// the 0x00 bytes of the key are escaped as 0x00 0xff and the key is ended by
+// 0x00 0x01, so the versions of a key are adjacent and the keys keep their
+// order.
+func historyKeyEncode(key []byte, version uint64) []byte {
+	return append(historyKeyPrefix(key, true), uint64ToBytes(version)...)
+}
+
+func historyKeyPrefix(key []byte, end bool) []byte {
+	bs := make([]byte, 0, len(key)+12)
+	bs = append(bs, nsKeyHistory)
+	for _, b := range key {
+		if b == 0x00 {
+			bs = append(bs, 0x00, 0xff)
+		} else {
+			bs = append(bs, b)
+		}
+	}
+	if end {
+		bs = append(bs, 0x00, 0x01)
+	}
+	return bs
+}
+
+func historyKeyDecode(bs []byte) ([]byte, uint64, error) {
+
+	if len(bs) < 11 || bs[0] != nsKeyHistory {
+		return nil, 0, errors.New("invalid history key")
+	}
+
+	key := []byte{}
+	for i := 1; i+1 < len(bs); i++ {
+		if bs[i] != 0x00 {
+			key = append(key, bs[i])
+			continue
+		}
+		if bs[i+1] == 0xff {
+			key = append(key, 0x00)
+			i += 1
+			continue
+		}
+		if bs[i+1] == 0x01 && len(bs) == i+10 {
+			return key, binary.BigEndian.Uint64(bs[i+2:]), nil
+		}
+		break
+	}
+
+	return nil, 0, errors.New("invalid history key")
+}
+
+// historyVersion returns the last version allocated at or before the time.
+func historyVersion(ts time.Time) uint64 {
+	return (uint64(ts.UnixNano()/1e6) << hlcLogicalBits) | (1<<hlcLogicalBits - 1)
+}
+
+func (cn *Conn) historyCutoff() (uint64, bool) {
+	if cn.opts.Feature.HistoryRetentionTime < 1 {
+		return 0, false
+	}
+	return historyVersion(time.Now().Add(
+		-time.Duration(cn.opts.Feature.HistoryRetentionTime) * time.Second)), true
+}
+
+// historyCurrent returns the encoded item of the current version of the key.
+func historyCurrent(tdb *dbTable, key []byte) ([]byte, error) {
+	bs, err := tdb.db.Get(keyEncode(nsKeyData, key), nil)
+	if err == leveldb.ErrNotFound {
+		if bs, err = tdb.db.Get(keyEncode(nsKeyMeta, key), nil); err == nil {
+			if _, err2 := kv2.ObjectItemDecode(bs); err2 != nil {
+				return nil, leveldb.ErrNotFound
+			}
+		}
+	}
+	return bs, err
+}
+
+// historyArchive saves the current version of the key to the history in the
+// batch before it is overwritten or deleted, and the tombstone of the
+// deletion if deleted > 0. It must be called with the commit lock of the
+// key held.
+func (cn *Conn) historyArchive(tdb *dbTable, batch *leveldb.Batch, key []byte, meta *kv2.ObjectMeta, deleted uint64) error {
+
+	if cn.opts.Feature.HistoryRetentionTime < 1 || meta == nil || meta.Version < 1 {
+		return nil
+	}
+
+	bs, err := historyCurrent(tdb, key)
+	if err == nil {
+		batch.Put(historyKeyEncode(key, meta.Version),
+			append([]byte{historyValueItem}, bs...))
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if deleted > 0 {
+		batch.Put(historyKeyEncode(key, deleted), []byte{historyValueTombstone})
+	}
+
+	return nil
+}
+
+// historyGet returns the version of the key at the version bound, or nil if
+// the key did not exist. The cur is the encoded current item, or nil if the
+// key does not exist now.
+func historyGet(tdb *dbTable, key, cur []byte, version uint64) (*kv2.ObjectItem, error) {
+
+	var item *kv2.ObjectItem
+
+	if cur != nil {
+		it, err := kv2.ObjectItemDecode(cur)
+		if err != nil {
+			return nil, err
+		}
+		if it.Meta != nil && it.Meta.Version <= version {
+			item = it
+		}
+	}
+
+	if item == nil {
+
+		iter := tdb.db.NewIterator(&util.Range{
+			Start: historyKeyEncode(key, 0),
+			Limit: historyKeyEncode(key, version+1),
+		}, nil)
+		defer iter.Release()
+
+		if !iter.Last() {
+			return nil, iter.Error()
+		}
+
+		bs := iter.Value()
+		if len(bs) < 2 || bs[0] != historyValueItem {
+			return nil, nil
+		}
+
+		it, err := kv2.ObjectItemDecode(bytesClone(bs[1:]))
+		if err != nil {
+			return nil, err
+		}
+		item = it
+	}
+
+	if item.Meta != nil && item.Meta.Expired > 0 &&
+		item.Meta.Expired <= version>>hlcLogicalBits {
+		return nil, nil
+	}
+
+	return item, nil
+}
+
+func (cn *Conn) historyValid(ts time.Time) (uint64, error) {
+
+	cutoff, ok := cn.historyCutoff()
+	if !ok {
+		return 0, errors.New("history disabled")
+	}
+
+	version := historyVersion(ts)
+	if version < cutoff {
+		return 0, errors.New("time out of history retention")
+	}
+
+	return version, nil
+}
+
+// GetAsOf returns the version of the key at the time, the time must be in
+// the history retention window (Config.Feature.HistoryRetentionTime).
+func (cn *Conn) GetAsOf(tableName string, key []byte, ts time.Time) *kv2.ObjectResult {
+
+	if cn.opts.ClientConnectEnable {
+		return cn.historyCmdRemote(&historyRequest{
+			Table: tableName,
+			Key:   key,
+			Time:  ts.UnixNano() / 1e6,
+		})
+	}
+
+	if tableName == "" {
+		tableName = "main"
+	}
+
+	version, err := cn.historyValid(ts)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil {
+		return kv2.NewObjectResultClientError(errors.New("table not found"))
+	}
+
+	cur, err := historyCurrent(tdb, key)
+	if err != nil && err != leveldb.ErrNotFound {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	item, err := historyGet(tdb, key, cur, version)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+	rs := kv2.NewObjectResultOK()
+	if item == nil {
+		rs.StatusMessage(kv2.ResultNotFound, "")
+	} else {
+		rs.Items = append(rs.Items, item)
+	}
+	return rs
+}
+
+// ScanAsOf returns at most limit keys of the range (offset, cutset] as of
+// the time, in the same key range semantics of the range queries, the time
+// must be in the history retention window.
+func (cn *Conn) ScanAsOf(tableName string, offset, cutset []byte, ts time.Time, limit int64) *kv2.ObjectResult {
+
+	if cn.opts.ClientConnectEnable {
+		return cn.historyCmdRemote(&historyRequest{
+			Table:  tableName,
+			Offset: offset,
+			Cutset: cutset,
+			Time:   ts.UnixNano() / 1e6,
+			Limit:  limit,
+		})
+	}
+
+	if tableName == "" {
+		tableName = "main"
+	}
+
+	version, err := cn.historyValid(ts)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil {
+		return kv2.NewObjectResultClientError(errors.New("table not found"))
+	}
+
+	if limit > kv2.ObjectReaderLimitNumMax {
+		limit = kv2.ObjectReaderLimitNumMax
+	} else if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		iter = tdb.db.NewIterator(&util.Range{
+			Start: keyEncode(nsKeyData, offset),
+			Limit: keyPrefixLimit(keyEncode(nsKeyData, cutset)),
+		}, nil)
+		hiter = tdb.db.NewIterator(&util.Range{
+			Start: historyKeyPrefix(offset, false),
+			Limit: keyPrefixLimit(historyKeyPrefix(cutset, false)),
+		}, nil)
+		ok  = iter.Next()
+		hok = hiter.Next()
+		rs  = kv2.NewObjectResultOK()
+	)
+	defer iter.Release()
+	defer hiter.Release()
+
+	for (ok || hok) && int64(len(rs.Items)) < limit {
+
+		var (
+			key []byte
+			cur []byte
+		)
+
+		hkey, _, err := historyKeyDecode(hiter.Key())
+		if hok && err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+
+		if ok {
+			key = iter.Key()[1:]
+		}
+		if hok && (!ok || bytes.Compare(hkey, key) < 0) {
+			key = hkey
+		}
+		key = bytesClone(key)
+
+		if ok && bytes.Equal(iter.Key()[1:], key) {
+			cur = bytesClone(iter.Value())
+			ok = iter.Next()
+		}
+
+		for hok && bytes.Equal(hkey, key) {
+			if hok = hiter.Next(); hok {
+				if hkey, _, err = historyKeyDecode(hiter.Key()); err != nil {
+					return kv2.NewObjectResultServerError(err)
+				}
+			}
+		}
+
+		if bytes.Equal(key, offset) || keyInternal(key) {
+			continue
+		}
+
+		item, err := historyGet(tdb, key, cur, version)
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		if item != nil {
+			rs.Items = append(rs.Items, item)
+		}
+	}
+
+	if ok || hok {
+		rs.Next = true
+	}
+
+	return rs
+}
+
+// HistoryVersion is a version of a key exported by ArchiveVersions, Item is
+// the encoded object item of the version, nil for the deletions.
+type HistoryVersion struct {
+	Key     []byte `json:"key"`
+	Version uint64 `json:"version"`
+	Time    int64  `json:"time"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Current bool   `json:"current,omitempty"`
+	Item    []byte `json:"item,omitempty"`
+}
+
+// ArchiveVersions writes the versions of the keys of the prefix in the table
+// kept in the history and their current versions to dst in JSON lines of
+// HistoryVersion, in the order of the keys and the versions, for the long
+// term audit storage. It returns the number of versions written, and is
+// only supported in embedded mode.
+func (cn *Conn) ArchiveVersions(tableName string, prefix []byte, dst io.Writer) (int64, error) {
+
+	if cn.opts.ClientConnectEnable {
+		return 0, errors.New("archive versions is only supported in embedded mode")
+	}
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil {
+		return 0, errors.New("table not found")
+	}
+
+	var (
+		hIter = tdb.db.NewIterator(util.BytesPrefix(historyKeyPrefix(prefix, false)), nil)
+		dIter = tdb.db.NewIterator(util.BytesPrefix(keyEncode(nsKeyData, prefix)), nil)
+		enc   = json.NewEncoder(dst)
+		num   int64
+		hKey  []byte
+		hVer  uint64
+	)
+	defer hIter.Release()
+	defer dIter.Release()
+
+	hNext := func() bool {
+		for hIter.Next() {
+			if key, version, err := historyKeyDecode(hIter.Key()); err == nil {
+				hKey, hVer = key, version
+				return true
+			}
+		}
+		hKey = nil
+		return false
+	}
+
+	hOk, dOk := hNext(), dIter.Next()
+
+	for (hOk || dOk) && !cn.close {
+
+		var key []byte
+		if dOk {
+			key = dIter.Key()[1:]
+		}
+		if hOk && (!dOk || bytes.Compare(hKey, key) <= 0) {
+			key = hKey
+		}
+		key = bytesClone(key)
+
+		for hOk && bytes.Equal(hKey, key) {
+			v := &HistoryVersion{
+				Key:     key,
+				Version: hVer,
+				Time:    VersionTime(hVer).UnixNano() / 1e6,
+			}
+			if bs := hIter.Value(); len(bs) > 1 && bs[0] == historyValueItem {
+				v.Item = bytesClone(bs[1:])
+			} else {
+				v.Deleted = true
+			}
+			if err := enc.Encode(v); err != nil {
+				return num, err
+			}
+			num += 1
+			hOk = hNext()
+		}
+
+		if dOk && bytes.Equal(dIter.Key()[1:], key) {
+			if item, err := kv2.ObjectItemDecode(dIter.Value()); err == nil && item.Meta != nil {
+				v := &HistoryVersion{
+					Key:     key,
+					Version: item.Meta.Version,
+					Time:    VersionTime(item.Meta.Version).UnixNano() / 1e6,
+					Current: true,
+					Item:    bytesClone(dIter.Value()),
+				}
+				if err := enc.Encode(v); err != nil {
+					return num, err
+				}
+				num += 1
+			}
+			dOk = dIter.Next()
+		}
+	}
+
+	if err := hIter.Error(); err != nil {
+		return num, err
+	}
+
+	return num, dIter.Error()
+}
+
+type historyRequest struct {
+	Table  string `json:"table"`
+	Key    []byte `json:"key,omitempty"`
+	Offset []byte `json:"offset,omitempty"`
+	Cutset []byte `json:"cutset,omitempty"`
+	Time   int64  `json:"time"`
+	Limit  int64  `json:"limit,omitempty"`
+}
+
+func (cn *Conn) historyCmdRemote(req *historyRequest) *kv2.ObjectResult {
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	return cn.SysCmd(&kv2.SysCmdRequest{
+		Method: "HistoryQuery",
+		Body:   bs,
+	})
+}
+
+func (cn *Conn) historyCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	var req historyRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	if req.Table == "" {
+		req.Table = "main"
+	}
+
+	if av != nil {
+		if err := av.Allow(authPermTableRead,
+			hauth.NewScopeFilter(AuthScopeTable, req.Table)); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	ts := time.Unix(req.Time/1e3, (req.Time%1e3)*1e6)
+
+	if len(req.Key) > 0 {
+		return cn.GetAsOf(req.Table, req.Key, ts)
+	}
+
+	return cn.ScanAsOf(req.Table, req.Offset, req.Cutset, ts, req.Limit)
+}
+
+func (cn *Conn) workerLocalHistoryRefresh() error {
+
+	cutoff, ok := cn.historyCutoff()
+	if !ok {
+		return nil
+	}
+
+	tn := time.Now().Unix()
+	if cn.workerHistoryRefreshed+historyRefreshTime > tn {
+		return nil
+	}
+	cn.workerHistoryRefreshed = tn
+
+	for _, tdb := range cn.tables {
+		if err := cn.historyRefreshTable(tdb, cutoff); err != nil {
+			hlog.Printf("warn", "history refresh table %s err %s", tdb.tableName, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// historyRefreshTable removes the versions replaced by newer versions before
+// the cutoff, and the tombstones before the cutoff, which are never read
+// again by the reads in the retention window. The last
+// HistoryRetentionVersions replaced or deleted versions of every key are
+// kept anyway.
+func (cn *Conn) historyRefreshTable(tdb *dbTable, cutoff uint64) error {
+
+	iter := tdb.db.NewIterator(util.BytesPrefix([]byte{nsKeyHistory}), nil)
+	defer iter.Release()
+
+	var (
+		batch   = new(leveldb.Batch)
+		prevKey []byte
+		entries []*historyEntry
+	)
+
+	flush := func() error {
+		if batch.Len() > 0 {
+			if err := cn.dbWrite(tdb, batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	}
+
+	for iter.Next() && !cn.close {
+
+		key, version, err := historyKeyDecode(iter.Key())
+		if err != nil {
+			batch.Delete(bytesClone(iter.Key()))
+			continue
+		}
+
+		if len(entries) > 0 && !bytes.Equal(key, prevKey) {
+			if err := cn.historyRefreshKey(tdb, batch, prevKey, entries, cutoff); err != nil {
+				return err
+			}
+			entries = entries[:0]
+		}
+
+		prevKey = key
+		entries = append(entries, &historyEntry{
+			key:       bytesClone(iter.Key()),
+			version:   version,
+			tombstone: len(iter.Value()) > 0 && iter.Value()[0] == historyValueTombstone,
+		})
+
+		if batch.Len() >= historyRefreshLimit {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(entries) > 0 {
+		if err := cn.historyRefreshKey(tdb, batch, prevKey, entries, cutoff); err != nil {
+			return err
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+type historyEntry struct {
+	key       []byte
+	version   uint64
+	tombstone bool
+}
+
+// historyRefreshKey removes the obsolete entries of the history of the key
+// in the order of the versions.
+func (cn *Conn) historyRefreshKey(tdb *dbTable, batch *leveldb.Batch,
+	key []byte, entries []*historyEntry, cutoff uint64) error {
+
+	// the version replacing the last entry, 0 if the key does not exist
+	var next uint64
+	bs, err := historyCurrent(tdb, key)
+	if err == nil {
+		if item, err := kv2.ObjectItemDecode(bs); err == nil && item.Meta != nil {
+			next = item.Meta.Version
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	keep := cn.opts.Feature.HistoryRetentionVersions
+
+	for i := len(entries) - 1; i >= 0; i-- {
+
+		v := entries[i]
+
+		if keep > 0 {
+			keep -= 1
+		} else if v.tombstone && v.version <= cutoff {
+			batch.Delete(v.key)
+		} else if !v.tombstone && next > v.version && next <= cutoff {
+			batch.Delete(v.key)
+		}
+
+		next = v.version
+	}
+
+	return nil
+}
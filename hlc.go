@@ -0,0 +1,43 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"time"
+)
+
+// The versions of the objects are hybrid logical clock timestamps, the high
+// 48 bits are the physical time in milliseconds and the low 16 bits are the
+// logical counter of the versions allocated in the same millisecond. The
+// versions of a table are monotonic, never lag behind the versions received
+// from other nodes, and stay close to the wall clock, so the versions of
+// different nodes are comparable.
+const (
+	hlcLogicalBits = 16
+
+	// the versions reserved on disk ahead of the allocated ones, so the
+	// versions allocated after a restart never go back
+	hlcCutsetWindow = uint64(1000) << hlcLogicalBits
+)
+
+func hlcNow() uint64 {
+	return uint64(time.Now().UnixNano()/1e6) << hlcLogicalBits
+}
+
+// VersionTime returns the physical time of the version of an object.
+func VersionTime(version uint64) time.Time {
+	ms := int64(version >> hlcLogicalBits)
+	return time.Unix(ms/1e3, (ms%1e3)*1e6)
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+)
+
+const (
+	httpReadTimeout  = 10 * time.Second
+	httpWriteTimeout = 30 * time.Second
+)
+
+// httpServe starts the http listener of Server.HttpBind, the probes of
+// /healthz and /readyz are not authenticated.
+func (cn *Conn) httpServe() error {
+
+	lis, err := listen(SystemdListenerHttp, cn.opts.Server.HttpBind)
+	if err != nil {
+		return err
+	}
+	hlog.Printf("info", "http bind %s", lis.Addr().String())
+
+	lis = cn.firewallListen(FirewallListenerHttp, lis)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", cn.httpHealthz)
+	mux.HandleFunc("/readyz", cn.httpReadyz)
+	mux.HandleFunc("/status", cn.httpAuth(cn.httpClusterStatus))
+	mux.HandleFunc("/status.json", cn.httpAuth(cn.httpClusterStatus))
+	cn.webUIHandle(mux)
+
+	cn.httpServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  httpReadTimeout,
+		WriteTimeout: httpWriteTimeout,
+	}
+
+	go cn.httpServer.Serve(lis)
+
+	return nil
+}
+
+// httpAuth checks the http basic auth of the request, the user and password
+// are the id and secret of an access key of the sa role, or the JWT bearer
+// token of the sys/all permission if Server.Jwt is setup.
+func (cn *Conn) httpAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		if v := r.Header.Get("Authorization"); cn.jwt != nil && strings.HasPrefix(v, "Bearer ") {
+			if av, err := cn.jwt.validate(strings.TrimSpace(v[7:])); err == nil &&
+				cn.firewall.allowIdentityAddr(av.subject, addr) == nil &&
+				av.Allow(authPermSysAll) == nil {
+				fn(w, r)
+				return
+			}
+		} else if id, secret, ok := r.BasicAuth(); ok {
+			if key := cn.keyMgr.KeyGet(id); key != nil &&
+				subtle.ConstantTimeCompare([]byte(key.Secret), []byte(secret)) == 1 &&
+				cn.firewall.allowIdentityAddr(key.Id, addr) == nil {
+				for _, v := range key.Roles {
+					if v == "sa" {
+						fn(w, r)
+						return
+					}
+				}
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="kvgo"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// ErrImmutable is the error of the writes of the existing immutable keys,
+// the keys of AttrImmutable or of the Feature.ImmutablePrefixes. The
+// immutable keys are write-once: they can be deleted, but not overwritten
+// unless the write is forced by CommitForce.
+var ErrImmutable = errors.New("immutable key")
+
+// WriteForceMetadataKey is the grpc metadata of the writes forced to
+// overwrite the immutable keys, the forced writes are only accepted from the
+// access keys of the sys/all permission.
+const WriteForceMetadataKey = "x-kvgo-write-force"
+
+// IsErrImmutable returns whether the write failed by ErrImmutable.
+func IsErrImmutable(rs *kv2.ObjectResult) bool {
+	return rs != nil && !rs.OK() && strings.HasPrefix(rs.Message, ErrImmutable.Error())
+}
+
+// immutable returns whether the keys of the prefix of the table are
+// immutable.
+func (it *ConfigFeature) immutable(table string, key []byte) bool {
+	for _, v := range it.ImmutablePrefixes {
+		if v.Table == table && bytes.HasPrefix(key, []byte(v.Prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// immutableCheck returns ErrImmutable if the write overwrites the existing
+// immutable key of the meta.
+func (cn *Conn) immutableCheck(rr *kv2.ObjectWriter, meta *kv2.ObjectMeta) error {
+	if meta == nil || kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeDelete) {
+		return nil
+	}
+	if Attrs(meta)&AttrImmutable != 0 ||
+		cn.opts.Feature.immutable(rr.TableName, rr.Meta.Key) {
+		return ErrImmutable
+	}
+	return nil
+}
+
+func writeForceIncoming(ctx context.Context) bool {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get(WriteForceMetadataKey); len(vs) > 0 && vs[0] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// CommitForce commits the write even if it overwrites an immutable key, in
+// client mode the access key must be of the sys/all permission.
+func (cn *Conn) CommitForce(rr *kv2.ObjectWriter) *kv2.ObjectResult {
+
+	if keyInternalWrite(rr) {
+		return kv2.NewObjectResultClientError(errKeyInternal)
+	}
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+
+		if cn.opts.ClientConnectEnable {
+			return cn.objectCommitRemote(rr, 0, WriteForceMetadataKey, "true")
+		}
+
+		rs, err := cn.public.commit(nil, rr, true)
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		return rs
+	}
+
+	return cn.commitLocalForce(rr, 0, true)
+}
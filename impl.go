@@ -18,18 +18,32 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"hash/fnv"
+	"sync"
 	"time"
 
 	"github.com/hooto/hlog4g/hlog"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/iterator"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+	"google.golang.org/grpc/metadata"
 
 	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
 )
 
 func (cn *Conn) Commit(rr *kv2.ObjectWriter) *kv2.ObjectResult {
 
+	if keyInternalWrite(rr) {
+		return kv2.NewObjectResultClientError(errKeyInternal)
+	}
+
+	return cn.commit(rr)
+}
+
+// commit is the Commit of the internal writes, which may write the keys of
+// keyInternalPrefix.
+func (cn *Conn) commit(rr *kv2.ObjectWriter) *kv2.ObjectResult {
+
 	if len(cn.opts.Cluster.MainNodes) > 0 {
 
 		if cn.opts.ClientConnectEnable {
@@ -38,55 +52,119 @@ func (cn *Conn) Commit(rr *kv2.ObjectWriter) *kv2.ObjectResult {
 
 		rs, err := cn.public.Commit(nil, rr)
 		if err != nil {
-			return kv2.NewObjectResultServerError(err)
+			return cn.usageWrite(rr, kv2.NewObjectResultServerError(err))
 		}
-		return rs
+		return cn.usageWrite(rr, rs)
 	}
 
-	return cn.commitLocal(rr, 0)
+	return cn.usageWrite(rr, cn.commitLocal(rr, 0))
 }
 
 func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult {
+	return cn.commitLocalForce(rr, cLog, false)
+}
+
+// commitLocalForce commits the object, force overwrites the immutable keys.
+func (cn *Conn) commitLocalForce(rr *kv2.ObjectWriter, cLog uint64, force bool) *kv2.ObjectResult {
+	return cn.commitLocalWrite(rr, cLog, force, false)
+}
+
+// commitLocalWrite commits the object, the write is not fsynced if noSync
+// is set, regardless of the fsync and replication policies.
+func (cn *Conn) commitLocalWrite(rr *kv2.ObjectWriter, cLog uint64, force, noSync bool) *kv2.ObjectResult {
 
 	if err := rr.CommitValid(); err != nil {
 		return kv2.NewObjectResultClientError(err)
 	}
 
-	cn.mu.Lock()
-	defer cn.mu.Unlock()
+	if cLog == 0 {
+		if err := cn.tenantQuotaCheck(rr); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		cn.ttlDefaultSet(rr)
+	}
+
+	mu := cn.commitLock(rr.TableName, rr.Meta.Key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	return cn.commitLockedWrite(rr, cLog, force, noSync)
+}
+
+// commitLocked commits the object with the commit lock of its key held, the
+// new writes (cLog == 0) of the immutable keys fail unless forced.
+func (cn *Conn) commitLocked(rr *kv2.ObjectWriter, cLog uint64, force bool) *kv2.ObjectResult {
+	return cn.commitLockedWrite(rr, cLog, force, false)
+}
+
+func (cn *Conn) commitLockedWrite(rr *kv2.ObjectWriter, cLog uint64, force, noSync bool) *kv2.ObjectResult {
+
+	var (
+		batch    = new(leveldb.Batch)
+		rs, done = cn.commitLockedBatch(batch, rr, cLog, force)
+	)
+
+	if done == nil {
+		// the merge operands dropped by the deletes of the keys not found
+		// and by the writes of the same items
+		if rs.OK() && batch.Len() > 0 {
+			if err := cn.dbWrite(cn.tabledb(rr.TableName), batch); err != nil {
+				return kv2.NewObjectResultServerError(err)
+			}
+		}
+		return rs
+	}
+
+	err := cn.dbWriteObject(cn.tabledb(rr.TableName), rr.Meta.Key, batch, noSync)
+	done(err)
+
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return rs
+}
+
+// commitLockedBatch adds the write of the object to the batch with the
+// commit lock of its key held, nothing is written if the result is not OK.
+// The done func is called after the batch is written, it is nil if the
+// object is not changed and the batch has only the merge operands to drop.
+func (cn *Conn) commitLockedBatch(batch *leveldb.Batch, rr *kv2.ObjectWriter,
+	cLog uint64, force bool) (*kv2.ObjectResult, func(err error)) {
 
 	meta, err := cn.objectMetaGet(rr)
 	if meta == nil && err != nil {
-		return kv2.NewObjectResultServerError(err)
+		return kv2.NewObjectResultServerError(err), nil
 	}
 
 	tdb := cn.tabledb(rr.TableName)
 	if tdb == nil {
-		return kv2.NewObjectResultClientError(errors.New("table not found"))
+		return kv2.NewObjectResultClientError(errors.New("table not found")), nil
 	}
 
 	if meta == nil {
 
 		if kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeDelete) {
-			return kv2.NewObjectResultOK()
+			cn.mergeOperandsDel(tdb, batch, rr.Meta.Key)
+			return kv2.NewObjectResultOK(), nil
 		}
 
 	} else {
 
 		if rr.PrevVersion > 0 && rr.PrevVersion != meta.Version {
-			return kv2.NewObjectResultClientError(errors.New("invalid prev_version"))
+			return kv2.NewObjectResultClientError(errPrevVersion), nil
 		}
 
 		if rr.PrevDataCheck > 0 && rr.PrevDataCheck != meta.DataCheck {
-			return kv2.NewObjectResultClientError(errors.New("invalid prev_data_check"))
+			return kv2.NewObjectResultClientError(errors.New("invalid prev_data_check")), nil
 		}
 
 		if rr.PrevAttrs > 0 && !kv2.AttrAllow(meta.Attrs, rr.PrevAttrs) {
-			return kv2.NewObjectResultClientError(errors.New("invalid prev_attrs"))
+			return kv2.NewObjectResultClientError(errors.New("invalid prev_attrs")), nil
 		}
 
 		if rr.PrevIncrId > 0 && rr.PrevIncrId != meta.IncrId {
-			return kv2.NewObjectResultClientError(errors.New("invalid prev_incr_id"))
+			return kv2.NewObjectResultClientError(errors.New("invalid prev_incr_id")), nil
 		}
 
 		if (cLog > 0 && meta.Version == cLog) ||
@@ -95,7 +173,12 @@ func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult
 			(rr.Meta.Expired == meta.Expired &&
 				(rr.Meta.IncrId == 0 || rr.Meta.IncrId == meta.IncrId) &&
 				(rr.PrevIncrId == 0 || rr.PrevIncrId == meta.IncrId) &&
-				rr.Meta.DataCheck == meta.DataCheck) {
+				rr.Meta.DataCheck == meta.DataCheck &&
+				Attrs(rr.Meta) == Attrs(meta)) {
+
+			if cLog == 0 && !kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeCreate) {
+				cn.mergeOperandsDel(tdb, batch, rr.Meta.Key)
+			}
 
 			rs := kv2.NewObjectResultOK()
 			rs.Meta = &kv2.ObjectMeta{
@@ -104,15 +187,22 @@ func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult
 				Created: meta.Created,
 				Updated: meta.Updated,
 			}
-			return rs
+			return rs, nil
+		}
+
+		if cLog == 0 && !force {
+			if err := cn.immutableCheck(rr, meta); err != nil {
+				return kv2.NewObjectResultClientError(err), nil
+			}
 		}
 
 		if rr.Meta.IncrId == 0 && meta.IncrId > 0 {
 			rr.Meta.IncrId = meta.IncrId
 		}
 
+		// the attribute bits are replaced by the write
 		if meta.Attrs > 0 {
-			rr.Meta.Attrs |= meta.Attrs
+			rr.Meta.Attrs |= meta.Attrs &^ AttrMask
 		}
 
 		if meta.Created > 0 {
@@ -135,7 +225,7 @@ func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult
 		if rr.Meta.IncrId == 0 {
 			rr.Meta.IncrId, err = tdb.objectIncrSet(rr.IncrNamespace, 1, 0)
 			if err != nil {
-				return kv2.NewObjectResultServerError(err)
+				return kv2.NewObjectResultServerError(err), nil
 			}
 		} else {
 			tdb.objectIncrSet(rr.IncrNamespace, 0, rr.Meta.IncrId)
@@ -150,12 +240,12 @@ func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult
 
 		cLog, err = tdb.objectLogVersionSet(1, cLog, updated)
 		if err != nil {
-			return kv2.NewObjectResultServerError(err)
+			return kv2.NewObjectResultServerError(err), nil
 		}
 	} else {
 		_, err = tdb.objectLogVersionSet(0, cLog, updated)
 		if err != nil {
-			return kv2.NewObjectResultServerError(err)
+			return kv2.NewObjectResultServerError(err), nil
 		}
 		cLogOn = false
 	}
@@ -165,71 +255,88 @@ func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult
 
 		rr.Meta.Attrs = kv2.ObjectMetaAttrDelete
 
-		if bsMeta, err := rr.MetaEncode(); err == nil {
-
-			batch := new(leveldb.Batch)
+		bsMeta, err := rr.MetaEncode()
+		if err != nil {
+			return kv2.NewObjectResultServerError(err), nil
+		}
 
-			if meta != nil {
-				if !cn.opts.Feature.WriteMetaDisable {
-					batch.Delete(keyEncode(nsKeyMeta, rr.Meta.Key))
-				}
-				batch.Delete(keyEncode(nsKeyData, rr.Meta.Key))
-				if !cn.opts.Feature.WriteLogDisable {
-					batch.Delete(keyEncode(nsKeyLog, uint64ToBytes(meta.Version)))
-				}
-			}
+		if err := cn.historyArchive(tdb, batch, rr.Meta.Key, meta, cLog); err != nil {
+			return kv2.NewObjectResultServerError(err), nil
+		}
 
-			if cLogOn && !cn.opts.Feature.WriteLogDisable {
-				batch.Put(keyEncode(nsKeyLog, uint64ToBytes(cLog)), bsMeta)
+		if meta != nil {
+			// the meta may be saved by the writes before
+			// WriteMetaDisable is set
+			batch.Delete(keyEncode(nsKeyMeta, rr.Meta.Key))
+			batch.Delete(keyEncode(nsKeyData, rr.Meta.Key))
+			if !cn.opts.Feature.WriteLogDisable {
+				batch.Delete(keyEncode(nsKeyLog, uint64ToBytes(meta.Version)))
 			}
+		}
 
-			err = tdb.db.Write(batch, nil)
+		if cLogOn && !cn.opts.Feature.WriteLogDisable {
+			batch.Put(keyEncode(nsKeyLog, uint64ToBytes(cLog)), bsMeta)
 		}
 
+		cn.mergeOperandsDel(tdb, batch, rr.Meta.Key)
+
 	} else {
 
-		if bsMeta, bsData, err := rr.PutEncode(); err == nil {
+		bsMeta, bsData, err := rr.PutEncode()
+		if err != nil {
+			return kv2.NewObjectResultServerError(err), nil
+		}
 
-			batch := new(leveldb.Batch)
+		if err := cn.historyArchive(tdb, batch, rr.Meta.Key, meta, 0); err != nil {
+			return kv2.NewObjectResultServerError(err), nil
+		}
 
-			if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrDataOff) {
-				batch.Put(keyEncode(nsKeyMeta, rr.Meta.Key), bsData)
-			} else if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrMetaOff) {
-				batch.Put(keyEncode(nsKeyData, rr.Meta.Key), bsData)
-			} else {
-				if !cn.opts.Feature.WriteMetaDisable {
-					batch.Put(keyEncode(nsKeyMeta, rr.Meta.Key), bsMeta)
-				}
-				batch.Put(keyEncode(nsKeyData, rr.Meta.Key), bsData)
+		if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrDataOff) {
+			batch.Put(keyEncode(nsKeyMeta, rr.Meta.Key), bsData)
+		} else if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrMetaOff) {
+			batch.Put(keyEncode(nsKeyData, rr.Meta.Key), bsData)
+		} else {
+			if !cn.opts.Feature.WriteMetaDisable {
+				batch.Put(keyEncode(nsKeyMeta, rr.Meta.Key), bsMeta)
 			}
+			batch.Put(keyEncode(nsKeyData, rr.Meta.Key), bsData)
+		}
 
-			if cLogOn && !cn.opts.Feature.WriteLogDisable {
-				batch.Put(keyEncode(nsKeyLog, uint64ToBytes(cLog)), bsMeta)
-			}
+		if cLogOn && !cn.opts.Feature.WriteLogDisable {
+			batch.Put(keyEncode(nsKeyLog, uint64ToBytes(cLog)), bsMeta)
+		}
 
-			if rr.Meta.Expired > 0 {
-				batch.Put(keyExpireEncode(nsKeyTtl, rr.Meta.Expired, rr.Meta.Key), bsMeta)
-			}
+		if rr.Meta.Expired > 0 {
+			batch.Put(keyExpireEncode(nsKeyTtl, rr.Meta.Expired, rr.Meta.Key), bsMeta)
+		}
 
-			if meta != nil {
-				if meta.Version < cLog && !cn.opts.Feature.WriteLogDisable {
-					batch.Delete(keyEncode(nsKeyLog, uint64ToBytes(meta.Version)))
-				}
-				if meta.Expired > 0 && meta.Expired != rr.Meta.Expired {
-					batch.Delete(keyExpireEncode(nsKeyTtl, meta.Expired, rr.Meta.Key))
-				}
+		if meta != nil {
+			// converts the key saved by the writes before
+			// WriteMetaDisable is set
+			if cn.opts.Feature.WriteMetaDisable &&
+				!kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrDataOff) {
+				batch.Delete(keyEncode(nsKeyMeta, rr.Meta.Key))
 			}
-
-			err = tdb.db.Write(batch, nil)
-
-			if err == nil && cLogOn {
-				tdb.objectLogFree(cLog)
+			if meta.Version < cLog && !cn.opts.Feature.WriteLogDisable {
+				batch.Delete(keyEncode(nsKeyLog, uint64ToBytes(meta.Version)))
+			}
+			if meta.Expired > 0 && meta.Expired != rr.Meta.Expired {
+				batch.Delete(keyExpireEncode(nsKeyTtl, meta.Expired, rr.Meta.Key))
 			}
 		}
+
+		cn.mergeOperandsDel(tdb, batch, rr.Meta.Key)
 	}
 
-	if err != nil {
-		return kv2.NewObjectResultServerError(err)
+	var (
+		key     = rr.Meta.Key
+		deleted = kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeDelete)
+	)
+	done := func(err error) {
+		cn.valueCacheDel(tdb, key)
+		if err == nil && cLogOn && !deleted {
+			tdb.objectLogFree(cLog)
+		}
 	}
 
 	rs := kv2.NewObjectResultOK()
@@ -239,37 +346,74 @@ func (cn *Conn) commitLocal(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult
 		Updated: rr.Meta.Updated,
 	}
 
-	return rs
+	return rs, done
+}
+
+// commitLock returns the mutex of the shard of the key, the commits of
+// different keys are serialized only if they fall into the same shard, and
+// the engine merges the concurrent batch writes.
+func (cn *Conn) commitLock(tableName string, key []byte) *sync.Mutex {
+	return &cn.commitMus[commitShard(tableName, key)]
+}
+
+func commitShard(tableName string, key []byte) int {
+	h := fnv.New32a()
+	h.Write([]byte(tableName))
+	h.Write(key)
+	return int(h.Sum32() % commitShardNum)
 }
 
-func (cn *Conn) objectCommitRemote(rr *kv2.ObjectWriter, cLog uint64) *kv2.ObjectResult {
+// objectCommitRemote sends the write to one of the main nodes, the md pairs
+// are appended to the metadata of the request.
+func (cn *Conn) objectCommitRemote(rr *kv2.ObjectWriter, cLog uint64, md ...string) *kv2.ObjectResult {
 
 	err := rr.CommitValid()
 	if err != nil {
 		return kv2.NewObjectResultClientError(err)
 	}
 
-	mainNodes := cn.opts.Cluster.randMainNodes(3)
+	restore, err := cn.valueEncrypt(rr)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+	defer restore()
+
+	mainNodes := cn.opts.Cluster.keyMainNodes(rr.TableName, rr.Meta.Key, 3)
 	if len(mainNodes) < 1 {
 		return kv2.NewObjectResultClientError(errors.New("no master found"))
 	}
 
-	for _, v := range mainNodes {
+	for i, v := range mainNodes {
 
-		conn, err := clientConn(v.Addr, v.AccessKey, v.AuthTLSCert, false)
+		tn := time.Now()
+
+		conn, err := clientConn(v.Addr, v.AccessKey, v.RequestSign, v.AuthTLSCert, v.Keepalive, false)
 		if err != nil {
+			clientObserveDone(cn.opts.ClientObserver, v.Addr, "Commit", "", tn, 0, err)
+			clientObserveFailover(cn.opts.ClientObserver, "Commit", mainNodes, i, err)
 			continue
 		}
 
 		ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
 		defer fc()
 
+		ctx, reqId := requestIdOutgoing(ctx)
+		if len(md) > 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, md...)
+		}
+
 		rs, err := kv2.NewPublicClient(conn).Commit(ctx, rr)
+		clientObserveDone(cn.opts.ClientObserver, v.Addr, "Commit", reqId, tn, 0, err)
 		if err != nil {
+			if nodeRefused(err) && i+1 < len(mainNodes) {
+				cn.opts.Cluster.failoverTarget(mainNodes, i, err)
+				clientObserveFailover(cn.opts.ClientObserver, "Commit", mainNodes, i, err)
+				continue
+			}
 			return kv2.NewObjectResultServerError(err)
 		}
 
-		return rs
+		return cn.valueDecrypt(rr.TableName, rs)
 	}
 
 	return kv2.NewObjectResultServerError(errors.New("no cluster nodes"))
@@ -282,7 +426,15 @@ func (cn *Conn) Query(rr *kv2.ObjectReader) *kv2.ObjectResult {
 		return cn.objectQueryRemote(rr)
 	}
 
-	return cn.objectLocalQuery(rr)
+	if cn.compactionPacer == nil {
+		return cn.usageRead(rr, cn.objectLocalQuery(rr))
+	}
+
+	tn := time.Now()
+	rs := cn.objectLocalQuery(rr)
+	cn.compactionPacer.observe(time.Since(tn))
+
+	return cn.usageRead(rr, rs)
 }
 
 func (cn *Conn) objectLocalQuery(rr *kv2.ObjectReader) *kv2.ObjectResult {
@@ -305,13 +457,27 @@ func (cn *Conn) objectLocalQuery(rr *kv2.ObjectReader) *kv2.ObjectResult {
 			)
 
 			if kv2.AttrAllow(rr.Attrs, kv2.ObjectMetaAttrDataOff) {
-				bs, err = tdb.db.Get(keyEncode(nsKeyMeta, k), nil)
+				bs, err = cn.valueGet(tdb, nsKeyMeta, k)
 			} else {
-				bs, err = tdb.db.Get(keyEncode(nsKeyData, k), nil)
+				bs, err = cn.valueGet(tdb, nsKeyData, k)
+				bs, err = cn.mergeValueGet(tdb, k, bs, err)
+			}
+
+			if err != nil && errCorrupted(err) {
+				item, err2 := cn.corruptionRead(tdb, k, err)
+				if err2 == nil {
+					if kv2.AttrAllow(rr.Attrs, kv2.ObjectMetaAttrDataOff) {
+						item.Data = nil
+					}
+					rs.Items = append(rs.Items, item)
+					continue
+				}
 			}
 
 			if err == nil {
 
+				cn.hotKeys.touch(tdb.tableName, k)
+
 				item, err := kv2.ObjectItemDecode(bs)
 				if err == nil {
 					rs.Items = append(rs.Items, item)
@@ -356,25 +522,47 @@ func (cn *Conn) objectLocalQuery(rr *kv2.ObjectReader) *kv2.ObjectResult {
 	return rs
 }
 
-func (cn *Conn) objectQueryRemote(rr *kv2.ObjectReader) *kv2.ObjectResult {
+// objectQueryRemote sends the query to one of the main nodes, the md pairs
+// are appended to the metadata of the request, e.g. the session version.
+func (cn *Conn) objectQueryRemote(rr *kv2.ObjectReader, md ...string) *kv2.ObjectResult {
 
-	mainNodes := cn.opts.Cluster.randMainNodes(3)
+	var key []byte
+	if kv2.AttrAllow(rr.Mode, kv2.ObjectReaderModeKey) && len(rr.Keys) > 0 {
+		key = rr.Keys[0]
+	}
+
+	mainNodes := cn.opts.Cluster.zoneMainNodes(rr.TableName, key, 3)
 	if len(mainNodes) < 1 {
 		return kv2.NewObjectResultClientError(errors.New("no master found"))
 	}
 
-	for _, v := range mainNodes {
+	for i, v := range mainNodes {
 
-		conn, err := clientConn(v.Addr, v.AccessKey, v.AuthTLSCert, false)
+		tn := time.Now()
+
+		conn, err := clientConn(v.Addr, v.AccessKey, v.RequestSign, v.AuthTLSCert, v.Keepalive, false)
 		if err != nil {
+			clientObserveDone(cn.opts.ClientObserver, v.Addr, "Query", "", tn, 0, err)
+			clientObserveFailover(cn.opts.ClientObserver, "Query", mainNodes, i, err)
 			continue
 		}
 
 		ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
 		defer fc()
 
+		ctx, reqId := requestIdOutgoing(ctx)
+		if len(md) > 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, md...)
+		}
+
 		rs, err := kv2.NewPublicClient(conn).Query(ctx, rr)
+		clientObserveDone(cn.opts.ClientObserver, v.Addr, "Query", reqId, tn, 0, err)
 		if err != nil {
+			if nodeRefused(err) && i+1 < len(mainNodes) {
+				cn.opts.Cluster.failoverTarget(mainNodes, i, err)
+				clientObserveFailover(cn.opts.ClientObserver, "Query", mainNodes, i, err)
+				continue
+			}
 			return kv2.NewObjectResultServerError(err)
 		}
 
@@ -416,13 +604,17 @@ func (cn *Conn) objectQueryKeyRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 	}
 
 	var (
-		iter   iterator.Iterator
-		values = [][]byte{}
+		iter  iterator.Iterator
+		items = []*kv2.ObjectItem{}
 	)
 
 	if kv2.AttrAllow(rr.Mode, kv2.ObjectReaderModeRevRange) {
 
-		// offset = append(offset, 0xff)
+		// the empty offset of the reverse range is the end of the keys,
+		// there is no upper bound key of the binary keys otherwise
+		if len(rr.KeyOffset) == 0 {
+			offset = []byte{nsKey + 1}
+		}
 
 		iter = tdb.db.NewIterator(&util.Range{
 			Start: cutset,
@@ -443,7 +635,8 @@ func (cn *Conn) objectQueryKeyRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 				break
 			}
 
-			if len(iter.Value()) < 2 {
+			// the internal keys are read by SystemScan only
+			if len(iter.Value()) < 2 || keyInternal(iter.Key()[1:]) {
 				continue
 			}
 
@@ -453,12 +646,17 @@ func (cn *Conn) objectQueryKeyRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 			}
 
 			limitNum -= 1
-			values = append(values, bytesClone(iter.Value()))
+
+			// the buffer of the iterator is reused by the next moves, and
+			// the decoded item may keep the slices of its input
+			if item, err := kv2.ObjectItemDecode(bytesClone(iter.Value())); err == nil {
+				items = append(items, item)
+			}
 		}
 
 	} else {
 
-		cutset = append(cutset, 0xff)
+		cutset = keyPrefixLimit(cutset)
 
 		iter = tdb.db.NewIterator(&util.Range{
 			Start: offset,
@@ -479,7 +677,7 @@ func (cn *Conn) objectQueryKeyRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 				break
 			}
 
-			if len(iter.Value()) < 2 {
+			if len(iter.Value()) < 2 || keyInternal(iter.Key()[1:]) {
 				continue
 			}
 
@@ -489,7 +687,10 @@ func (cn *Conn) objectQueryKeyRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 			}
 
 			limitNum -= 1
-			values = append(values, bytesClone(iter.Value()))
+
+			if item, err := kv2.ObjectItemDecode(bytesClone(iter.Value())); err == nil {
+				items = append(items, item)
+			}
 		}
 	}
 
@@ -499,11 +700,7 @@ func (cn *Conn) objectQueryKeyRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 		return iter.Error()
 	}
 
-	for _, bs := range values {
-		if item, err := kv2.ObjectItemDecode(bs); err == nil {
-			rs.Items = append(rs.Items, item)
-		}
-	}
+	rs.Items = append(rs.Items, items...)
 
 	if limitNum < 1 || limitSize < 1 {
 		rs.Next = true
@@ -519,6 +716,10 @@ func (cn *Conn) objectQueryLogRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 		return errors.New("table not found")
 	}
 
+	if err := tdb.logCompactedCheck(rr.LogOffset); err != nil {
+		return err
+	}
+
 	var (
 		offset    = keyEncode(nsKeyLog, uint64ToBytes(rr.LogOffset))
 		cutset    = keyEncode(nsKeyLog, []byte{0xff})
@@ -544,7 +745,7 @@ func (cn *Conn) objectQueryLogRange(rr *kv2.ObjectReader, rs *kv2.ObjectResult)
 		rr.WaitTime = workerLogRangeWaitTimeMax
 	}
 
-	for ; rr.WaitTime >= 0; rr.WaitTime -= workerLogRangeWaitSleep {
+	for ; rr.WaitTime >= 0 && !cn.close; rr.WaitTime -= workerLogRangeWaitSleep {
 
 		if tdb.logOffset <= rr.LogOffset {
 			time.Sleep(time.Duration(workerLogRangeWaitSleep) * time.Millisecond)
@@ -674,31 +875,9 @@ func (cn *Conn) objectMetaGet(rr *kv2.ObjectWriter) (*kv2.ObjectMeta, error) {
 		return nil, errors.New("table not found")
 	}
 
-	var nsKey = nsKeyMeta
-	if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrMetaOff) ||
-		cn.opts.Feature.WriteMetaDisable {
-		nsKey = nsKeyData
-	}
-	data, err := tdb.db.Get(keyEncode(nsKey, rr.Meta.Key), nil)
-
-	if err != nil && err.Error() == ldbNotFound {
-		if nsKey == nsKeyData {
-			nsKey = nsKeyMeta
-		} else {
-			nsKey = nsKeyData
-		}
-		data, err = tdb.db.Get(keyEncode(nsKey, rr.Meta.Key), nil)
-	}
-
-	if err == nil {
-		return kv2.ObjectMetaDecode(data)
-	} else {
-		if err.Error() == ldbNotFound {
-			err = nil
-		}
-	}
-
-	return nil, err
+	return tdb.objectMetaRead(rr.Meta.Key,
+		kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrMetaOff) ||
+			cn.opts.Feature.WriteMetaDisable)
 }
 
 func (it *Conn) Connector() kv2.ClientConnector {
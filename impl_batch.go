@@ -23,6 +23,12 @@ import (
 
 func (cn *Conn) BatchCommit(rr *kv2.BatchRequest) *kv2.BatchResult {
 
+	for _, v := range rr.Items {
+		if keyInternalWrite(v.Writer) {
+			return rr.NewResult(kv2.ResultClientError, errKeyInternal.Error())
+		}
+	}
+
 	if len(cn.opts.Cluster.MainNodes) > 0 {
 
 		if cn.opts.ClientConnectEnable {
@@ -59,14 +65,14 @@ func (cn *Conn) batchCommitLocal(rr *kv2.BatchRequest) *kv2.BatchResult {
 			if v.Reader.TableName == "" {
 				v.Reader.TableName = rr.TableName
 			}
-			rs2 = cn.objectLocalQuery(v.Reader)
+			rs2 = cn.usageRead(v.Reader, cn.objectLocalQuery(v.Reader))
 
 		} else if v.Writer != nil {
 
 			if v.Writer.TableName == "" {
 				v.Writer.TableName = rr.TableName
 			}
-			rs2 = cn.commitLocal(v.Writer, 0)
+			rs2 = cn.usageWrite(v.Writer, cn.commitLocal(v.Writer, 0))
 
 		} else {
 			rs2 = kv2.NewObjectResultClientError(errors.New("no reader/writer commit"))
@@ -93,6 +99,20 @@ func (cn *Conn) batchCommitLocal(rr *kv2.BatchRequest) *kv2.BatchResult {
 
 func (cn *Conn) batchCommitRemote(rr *kv2.BatchRequest) *kv2.BatchResult {
 
+	for _, v := range rr.Items {
+		if v.Writer == nil {
+			continue
+		}
+		if v.Writer.TableName == "" {
+			v.Writer.TableName = rr.TableName
+		}
+		restore, err := cn.valueEncrypt(v.Writer)
+		if err != nil {
+			return rr.NewResult(kv2.ResultClientError, err.Error())
+		}
+		defer restore()
+	}
+
 	mainNodes := cn.opts.Cluster.randMainNodes(3)
 
 	for _, v := range mainNodes {
@@ -103,6 +123,15 @@ func (cn *Conn) batchCommitRemote(rr *kv2.BatchRequest) *kv2.BatchResult {
 		}
 
 		if rs := c.Connector().BatchCommit(rr); rs.OK() {
+			for i, v2 := range rr.Items {
+				if v2.Reader != nil && i < len(rs.Items) {
+					table := v2.Reader.TableName
+					if table == "" {
+						table = rr.TableName
+					}
+					rs.Items[i] = cn.valueDecrypt(table, rs.Items[i])
+				}
+			}
 			return rs
 		}
 	}
@@ -0,0 +1,394 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+var errRewriteModified = errors.New("item modified")
+
+const (
+	rewriteBatchDef   = 100
+	rewriteBatchMax   = 1000
+	rewriteRetryMax   = 3
+	rewriteSaveSleep  = 1e9
+	rewriteRetrySleep = 1e9
+)
+
+// RewriteFunc returns the new key and value of the item, the item is kept
+// as is if the returned key is nil, and is moved if the key is changed.
+//
+// The items are scanned in order of keys, so the new keys should be out of
+// the scanned prefix or less than the old keys, otherwise the moved items
+// are scanned (and transformed) again.
+type RewriteFunc func(item *kv2.ObjectItem) (key []byte, value interface{}, err error)
+
+type RewriteOptions struct {
+	Table  string
+	Prefix []byte
+
+	// max number of items scanned per second, default to 0 (no limit)
+	Rate int
+
+	// number of items scanned per query, default to 100
+	Batch int
+}
+
+type RewriteProgress struct {
+	Offset    []byte `json:"offset"`
+	Scanned   int64  `json:"scanned"`
+	Rewritten int64  `json:"rewritten"`
+	Moved     int64  `json:"moved"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RewriteJob rewrites the items of a prefix in background, the progress is
+// saved in the table so the job is resumed from the last saved offset if it
+// is started again with the same name after a stop or restart.
+//
+// Every item is rewritten atomically with the commit locks of its old and
+// new keys held, the new key is written and the old one removed only if the
+// item is not modified since it is read, an item modified concurrently by
+// the application is read and transformed again. The jobs are not supported
+// in cluster mode.
+type RewriteJob struct {
+	mu       sync.Mutex
+	name     string
+	db       *Conn
+	opts     RewriteOptions
+	fn       RewriteFunc
+	progress RewriteProgress
+	stop     bool
+	done     chan bool
+	err      error
+}
+
+func rewriteKeyProgress(name string) []byte {
+	return NsKey("kvgo-rewrite", name)
+}
+
+// RewriteJobStart starts the job of the name, or returns the running one.
+func (cn *Conn) RewriteJobStart(name string, opts RewriteOptions, fn RewriteFunc) (*RewriteJob, error) {
+
+	if name == "" || fn == nil {
+		return nil, errors.New("invalid name or func")
+	}
+
+	if len(opts.Prefix) == 0 {
+		return nil, errors.New("no prefix setup")
+	}
+
+	if cn.opts.ClientConnectEnable || len(cn.opts.Cluster.MainNodes) > 0 {
+		return nil, errors.New("rewrite not supported in cluster mode")
+	}
+
+	if bytes.HasPrefix(rewriteKeyProgress(name), opts.Prefix) {
+		return nil, errors.New("prefix conflicts with the job progress key")
+	}
+
+	if opts.Batch < 1 {
+		opts.Batch = rewriteBatchDef
+	} else if opts.Batch > rewriteBatchMax {
+		opts.Batch = rewriteBatchMax
+	}
+
+	cn.jobMu.Lock()
+	defer cn.jobMu.Unlock()
+
+	if job, ok := cn.rewriteJobs[name]; ok {
+		return job, nil
+	}
+
+	job := &RewriteJob{
+		name: name,
+		db:   cn,
+		opts: opts,
+		fn:   fn,
+		done: make(chan bool),
+	}
+
+	rs := cn.Query(kv2.NewObjectReader(rewriteKeyProgress(name)).TableNameSet(opts.Table))
+	if rs.OK() {
+		if err := wireDecode(rs.DataValue().Bytes(), &job.progress); err != nil {
+			return nil, err
+		}
+		if job.progress.Done {
+			close(job.done)
+			return job, nil
+		}
+		job.progress.Error = ""
+	} else if !rs.NotFound() {
+		return nil, rs.Error()
+	}
+
+	if cn.rewriteJobs == nil {
+		cn.rewriteJobs = map[string]*RewriteJob{}
+	}
+	cn.rewriteJobs[name] = job
+
+	go job.run()
+
+	return job, nil
+}
+
+// Progress returns the progress of the job.
+func (it *RewriteJob) Progress() RewriteProgress {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.progress
+}
+
+// Stop stops the job after the current item, the job can be resumed by
+// RewriteJobStart.
+func (it *RewriteJob) Stop() {
+	it.mu.Lock()
+	it.stop = true
+	it.mu.Unlock()
+	<-it.done
+}
+
+// Wait waits for the job to be done or stopped.
+func (it *RewriteJob) Wait() error {
+	<-it.done
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.err
+}
+
+func (it *RewriteJob) errSet(err error) {
+	it.mu.Lock()
+	it.err = err
+	if err != nil {
+		it.progress.Error = err.Error()
+	}
+	it.mu.Unlock()
+}
+
+func (it *RewriteJob) stopping() bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.stop || it.db.close
+}
+
+func (it *RewriteJob) save() error {
+	it.mu.Lock()
+	bs, err := json.Marshal(it.progress)
+	it.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	rr := kv2.NewObjectWriter(rewriteKeyProgress(it.name), bs).TableNameSet(it.opts.Table)
+	if rs := it.db.Commit(rr); !rs.OK() {
+		return rs.Error()
+	}
+	return nil
+}
+
+func (it *RewriteJob) run() {
+
+	defer func() {
+		it.db.jobMu.Lock()
+		delete(it.db.rewriteJobs, it.name)
+		it.db.jobMu.Unlock()
+		close(it.done)
+	}()
+
+	var (
+		cutset = bytesClone(it.opts.Prefix)
+		saved  = time.Now()
+		tn     = time.Now()
+		num    = 0
+		err    error
+	)
+
+	for !it.stopping() {
+
+		offset := it.progress.Offset
+		if offset == nil {
+			offset = it.opts.Prefix
+		}
+
+		rs := it.db.Query(kv2.NewObjectReader(nil).
+			TableNameSet(it.opts.Table).
+			KeyRangeSet(offset, cutset).
+			LimitNumSet(int64(it.opts.Batch)))
+		if !rs.OK() && !rs.NotFound() {
+			err = rs.Error()
+			break
+		}
+
+		if len(rs.Items) == 0 {
+			it.mu.Lock()
+			it.progress.Done = true
+			it.mu.Unlock()
+			break
+		}
+
+		for _, item := range rs.Items {
+
+			if it.stopping() {
+				break
+			}
+
+			if err = it.rewrite(item); err != nil {
+				break
+			}
+
+			it.mu.Lock()
+			it.progress.Offset = bytesClone(item.Meta.Key)
+			it.progress.Scanned += 1
+			it.mu.Unlock()
+
+			if it.opts.Rate > 0 {
+				if num += 1; num >= it.opts.Rate {
+					if d := time.Second - time.Since(tn); d > 0 {
+						time.Sleep(d)
+					}
+					num, tn = 0, time.Now()
+				}
+			}
+		}
+
+		if err != nil {
+			break
+		}
+
+		if time.Since(saved) > rewriteSaveSleep {
+			if err := it.save(); err != nil {
+				hlog.Printf("warn", "kvgo rewrite job %s, save progress err %s", it.name, err.Error())
+			}
+			saved = time.Now()
+		}
+	}
+
+	if err != nil {
+		it.errSet(err)
+		hlog.Printf("warn", "kvgo rewrite job %s, err %s", it.name, err.Error())
+	}
+
+	if err2 := it.save(); err2 != nil && err == nil {
+		it.errSet(err2)
+	}
+}
+
+func (it *RewriteJob) rewrite(item *kv2.ObjectItem) error {
+
+	for retry := 0; ; retry++ {
+
+		key, value, err := it.fn(item)
+		if err != nil || key == nil {
+			return err
+		}
+
+		moved := !bytes.Equal(key, item.Meta.Key)
+
+		err = it.db.rewriteCommit(item, kv2.NewObjectWriter(key, value).TableNameSet(it.opts.Table))
+		if err == nil {
+			it.mu.Lock()
+			it.progress.Rewritten += 1
+			if moved {
+				it.progress.Moved += 1
+			}
+			it.mu.Unlock()
+			return nil
+		}
+
+		if err != errRewriteModified || retry >= rewriteRetryMax {
+			return err
+		}
+
+		// modified concurrently and nothing written, read and transform
+		// the new version again
+		time.Sleep(rewriteRetrySleep)
+
+		rs := it.db.Query(kv2.NewObjectReader(item.Meta.Key).TableNameSet(it.opts.Table))
+		if rs.NotFound() {
+			return nil
+		} else if !rs.OK() || len(rs.Items) == 0 {
+			return rs.Error()
+		}
+		item = rs.Items[0]
+	}
+}
+
+// rewriteCommit writes the new object rr of the item and removes the old key
+// if moved, with the commit locks of both keys held, so the rewrite is not
+// interleaved with other commits of the keys. Nothing is written if the item
+// is modified since it is read.
+func (cn *Conn) rewriteCommit(item *kv2.ObjectItem, rr *kv2.ObjectWriter) error {
+
+	if err := rr.CommitValid(); err != nil {
+		return err
+	}
+
+	if err := cn.tenantQuotaCheck(rr); err != nil {
+		return err
+	}
+	cn.ttlDefaultSet(rr)
+
+	var (
+		moved  = !bytes.Equal(rr.Meta.Key, item.Meta.Key)
+		shards = []int{commitShard(rr.TableName, item.Meta.Key)}
+	)
+	if moved {
+		// the locks are taken in order of the shards, as the txn locks
+		if i := commitShard(rr.TableName, rr.Meta.Key); i < shards[0] {
+			shards = append([]int{i}, shards...)
+		} else if i > shards[0] {
+			shards = append(shards, i)
+		}
+	}
+	for _, i := range shards {
+		cn.commitMus[i].Lock()
+	}
+	defer func() {
+		for i := len(shards) - 1; i >= 0; i-- {
+			cn.commitMus[shards[i]].Unlock()
+		}
+	}()
+
+	old := kv2.NewObjectWriter(item.Meta.Key, nil).TableNameSet(rr.TableName).
+		ModeDeleteSet(true)
+
+	meta, err := cn.objectMetaGet(old)
+	if err != nil {
+		return err
+	}
+	if meta == nil || meta.Version != item.Meta.Version {
+		return errRewriteModified
+	}
+
+	if rs := cn.usageWrite(rr, cn.commitLocked(rr, 0, false)); !rs.OK() {
+		return rs.Error()
+	}
+
+	if moved {
+		if rs := cn.usageWrite(old, cn.commitLocked(old, 0, false)); !rs.OK() {
+			return rs.Error()
+		}
+	}
+
+	return nil
+}
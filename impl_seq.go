@@ -0,0 +1,241 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+var (
+	seqNameReg = regexp.MustCompile("^[a-zA-Z0-9_\\-\\.]{1,64}$")
+)
+
+const (
+	seqStepMax       = uint64(1000000)
+	seqOffsetMin     = uint64(100)
+	seqBlockSize     = uint64(1000)
+	seqCommitTimeout = 2 * commitRetryTimeout
+)
+
+type sysCmdSeqNextRequest struct {
+	Name string `json:"name"`
+	Step uint64 `json:"step"`
+}
+
+func nsSysSeq(name string) string {
+	return "seq:" + name
+}
+
+// NextSeq allocates step ids of the sequence name and returns the first one,
+// the ids [id, id+step) are owned by the caller. The first id of a sequence
+// is seqOffsetMin+1.
+//
+// The ids are never reused, the allocator persists the upper bound of the
+// current block before returning, so a crashed server restarts from the end
+// of the last block. In a cluster every node allocates the blocks of
+// seqBlockSize ids through the quorum (see seqNextCommit) and serves the
+// ids from its block, so the ids allocated by a node are monotonically
+// increasing, but the ids of the nodes are not ordered with each other,
+// and the rest of the blocks is skipped on the restarts of the nodes.
+func (cn *Conn) NextSeq(name string, step uint64) (uint64, error) {
+
+	bs, err := json.Marshal(&sysCmdSeqNextRequest{
+		Name: name,
+		Step: step,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rs := cn.SysCmd(&kv2.SysCmdRequest{
+		Method: "SeqNext",
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return 0, rs.Error()
+	}
+
+	if rs.Meta == nil || rs.Meta.IncrId == 0 {
+		return 0, errors.New("seq not supported")
+	}
+
+	return rs.Meta.IncrId, nil
+}
+
+func (cn *Conn) seqNextLocal(name string, step uint64) (uint64, error) {
+
+	if !seqNameReg.MatchString(name) {
+		return 0, errors.New("invalid seq name")
+	}
+
+	if step < 1 {
+		step = 1
+	} else if step > seqStepMax {
+		return 0, errors.New("invalid seq step")
+	}
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return cn.seqNextBlock(name, step)
+	}
+
+	tdb := cn.tabledb(sysTableName)
+	if tdb == nil {
+		return 0, errors.New("table not found")
+	}
+
+	// the counters of objectIncrSet start at seqOffsetMin
+	id, err := tdb.objectIncrSet(nsSysSeq(name), step, seqOffsetMin)
+	if err != nil {
+		return 0, err
+	}
+
+	return id - step + 1, nil
+}
+
+type seqBlock struct {
+	mu     sync.Mutex
+	offset uint64 // the last id allocated
+	cutset uint64 // the last id of the block
+}
+
+type seqBlockSet struct {
+	mu     sync.Mutex
+	blocks map[string]*seqBlock
+}
+
+func (it *seqBlockSet) block(name string) *seqBlock {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.blocks == nil {
+		it.blocks = map[string]*seqBlock{}
+	}
+	b := it.blocks[name]
+	if b == nil {
+		b = &seqBlock{}
+		it.blocks[name] = b
+	}
+	return b
+}
+
+// seqNextBlock allocates the ids of the sequence of the cluster from the
+// block of the node, a new block is committed through the quorum when the
+// ids of the block are not enough.
+func (cn *Conn) seqNextBlock(name string, step uint64) (uint64, error) {
+
+	b := cn.seqBlocks.block(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.offset+step > b.cutset {
+
+		size := seqBlockSize
+		if step > size {
+			size = step
+		}
+
+		id, err := cn.seqNextCommit(name, size)
+		if err != nil {
+			return 0, err
+		}
+
+		b.offset, b.cutset = id-1, id-1+size
+	}
+
+	id := b.offset + 1
+	b.offset += step
+
+	return id, nil
+}
+
+// seqNextCommit allocates the block of the sequence of the cluster by the
+// compare-and-swap commit of the upper bound of the sequence through the
+// quorum, so the blocks allocated by the nodes never overlap.
+//
+// The commits of the nodes allocating the blocks at the same time overtake
+// each other, and an overtaken commit may leave the upper bound on a
+// minority of the nodes until the others pull it, so the allocation is
+// retried with a random backoff until seqCommitTimeout.
+func (cn *Conn) seqNextCommit(name string, step uint64) (uint64, error) {
+
+	var (
+		key      = keyInternalEncode(nsSysSeq(name))
+		deadline = time.Now().Add(seqCommitTimeout)
+		err      = errors.New("seq conflict")
+	)
+
+	for {
+
+		if rs := cn.QueryQuorum(kv2.NewObjectReader(key).TableNameSet(sysTableName)); rs.OK() || rs.NotFound() {
+
+			var (
+				offset  = seqOffsetMin
+				version uint64
+			)
+			if rs.OK() {
+				bs := rs.DataValue().Bytes()
+				if len(bs) != 8 {
+					return 0, errors.New("invalid seq value")
+				}
+				offset = binary.BigEndian.Uint64(bs)
+				if item := rs.Items[0]; item.Meta != nil {
+					version = item.Meta.Version
+				}
+			}
+
+			rr := kv2.NewObjectWriter(key, uint64ToBytes(offset+step)).TableNameSet(sysTableName)
+			if version > 0 {
+				rr.PrevVersion = version
+			} else {
+				rr.ModeCreateSet(true)
+			}
+
+			rs, err2 := cn.public.commit(nil, rr, false)
+			if err2 != nil {
+				if !errors.Is(err2, errCommitConflict) && !errors.Is(err2, errCommitAccept) {
+					return 0, err2
+				}
+				err = err2
+			} else if rs.OK() {
+				if version > 0 || !commitCreateExists(rs) {
+					return offset + 1, nil
+				}
+			} else if !rs.NotFound() && !resultErrIs(rs, errPrevVersion) {
+				return 0, rs.Error()
+			} else {
+				err = rs.Error()
+			}
+
+		} else {
+			err = rs.Error()
+		}
+
+		if time.Now().After(deadline) {
+			return 0, err
+		}
+
+		// no id of the overtaken commit is returned, the upper bound is
+		// read again
+		time.Sleep(time.Duration(rand.Int63n(commitRetryBackoff)+1) * time.Millisecond)
+	}
+}
@@ -15,7 +15,6 @@
 package kvgo
 
 import (
-	"crypto/tls"
 	"errors"
 	"net"
 
@@ -63,73 +62,161 @@ func (cn *Conn) serviceStart() error {
 		cn.opts.Cluster.MainNodes = masters
 	}
 
-	if cn.opts.Server.Bind != "" && !cn.opts.ClientConnectEnable {
-
-		if cn.opts.Server.AccessKey == nil {
-			return errors.New("no [server.access_key] setup")
-		}
+	if err := cn.membersRefresh(); err != nil {
+		return err
+	}
 
-		cn.keyMgr.KeySet(cn.opts.Server.AccessKey)
+	if err := cn.maintenanceLoad(); err != nil {
+		return err
+	}
 
-		host, port, err := net.SplitHostPort(cn.opts.Server.Bind)
-		if err != nil {
+	if cn.opts.Server.Bind != "" && !cn.opts.ClientConnectEnable {
+		if err := cn.serverStart(); err != nil {
 			return err
 		}
+	} else {
+		cn.public = &PublicServiceImpl{
+			db: cn,
+		}
+	}
 
-		lis, err := net.Listen("tcp", ":"+port)
-		if err != nil {
+	if cn.opts.Server.DebugBind != "" && !cn.opts.ClientConnectEnable {
+		if err := cn.debugServe(); err != nil {
 			return err
 		}
-		hlog.Printf("info", "server bind %s:%s", host, port)
+	}
 
-		cn.opts.Server.Bind = host + ":" + port
+	return nil
+}
 
-		serverOptions := []grpc.ServerOption{
-			grpc.MaxMsgSize(grpcMsgByteMax),
-			grpc.MaxSendMsgSize(grpcMsgByteMax),
-			grpc.MaxRecvMsgSize(grpcMsgByteMax),
-		}
+// serverStart starts the rpc endpoint of Server.Bind and the http listener
+// of Server.HttpBind.
+func (cn *Conn) serverStart() error {
 
-		if cn.opts.Server.AuthTLSCert != nil {
+	if cn.opts.Server.AccessKey == nil {
+		return errors.New("no [server.access_key] setup")
+	}
 
-			cert, err := tls.X509KeyPair(
-				[]byte(cn.opts.Server.AuthTLSCert.ServerCertData),
-				[]byte(cn.opts.Server.AuthTLSCert.ServerKeyData))
-			if err != nil {
-				return err
-			}
+	cn.keyMgr.KeySet(cn.opts.Server.AccessKey)
 
-			certs := credentials.NewServerTLSFromCert(&cert)
+	host, port, err := net.SplitHostPort(cn.opts.Server.Bind)
+	if err != nil {
+		return err
+	}
 
-			serverOptions = append(serverOptions, grpc.Creds(certs))
-		}
+	lis, err := listen(SystemdListenerServer, ":"+port)
+	if err != nil {
+		return err
+	}
+	hlog.Printf("info", "server bind %s:%s", host, port)
 
-		server := grpc.NewServer(serverOptions...)
+	lis = cn.firewallListen(FirewallListenerRpc, lis)
 
-		go server.Serve(lis)
+	cn.opts.Server.Bind = host + ":" + port
 
-		cn.public = &PublicServiceImpl{
-			sock:     lis,
-			server:   server,
-			db:       cn,
-			prepares: map[string]*kv2.ObjectWriter{},
-		}
+	serverOptions := []grpc.ServerOption{
+		grpc.MaxMsgSize(grpcMsgByteMax),
+		grpc.MaxSendMsgSize(grpcMsgByteMax),
+		grpc.MaxRecvMsgSize(grpcMsgByteMax),
+	}
+
+	serverOptions = append(serverOptions, keepaliveServerOptions(cn.opts.Server.Keepalive)...)
+
+	cn.requests = newRequestLog(requestLogMax)
+	serverOptions = append(serverOptions, grpc.ChainUnaryInterceptor(
+		cn.requestUnaryInterceptor, cn.reqSignUnaryInterceptor))
+
+	var tr *tlsReloader
 
-		cn.internal = &InternalServiceImpl{
-			sock:     lis,
-			server:   server,
-			db:       cn,
-			prepares: map[string]*kv2.ObjectWriter{},
+	if cn.opts.Server.AuthTLSCert != nil {
+
+		if tr, err = newTLSReloader(cn.opts.Server.AuthTLSCert); err != nil {
+			return err
 		}
 
-		kv2.RegisterPublicServer(server, cn.public)
-		kv2.RegisterInternalServer(server, cn.internal)
+		// the certificate is of each handshake, so it is reloaded
+		// without restarting the server
+		certs := credentials.NewTLS(tr.config())
 
-	} else {
-		cn.public = &PublicServiceImpl{
-			db: cn,
+		serverOptions = append(serverOptions, grpc.Creds(certs))
+	}
+
+	server := grpc.NewServer(serverOptions...)
+
+	go server.Serve(lis)
+
+	cn.mu.Lock()
+	cn.public = &PublicServiceImpl{
+		sock:     lis,
+		server:   server,
+		db:       cn,
+		prepares: map[string]*kv2.ObjectWriter{},
+	}
+
+	cn.internal = &InternalServiceImpl{
+		sock:     lis,
+		server:   server,
+		db:       cn,
+		prepares: map[string]*kv2.ObjectWriter{},
+	}
+	cn.tls = tr
+	cn.mu.Unlock()
+
+	if tr != nil && tr.watched() {
+		go cn.workerTLSReload()
+	}
+
+	kv2.RegisterPublicServer(server, cn.public)
+	kv2.RegisterInternalServer(server, cn.internal)
+
+	if cn.opts.Server.HttpBind != "" {
+		if err := cn.httpServe(); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
+
+func (cn *Conn) serving() bool {
+	cn.mu.RLock()
+	defer cn.mu.RUnlock()
+	return cn.public != nil && cn.public.sock != nil
+}
+
+// Serve starts the rpc endpoint (and the http listener if setup) of the
+// store opened in embedded mode, so the tools can query the live store of
+// the application through the same handle instead of a second copy. The
+// writes of the embedded application and of the rpc clients are committed
+// to the same tables.
+func (cn *Conn) Serve(cfg ConfigServer) error {
+
+	if cn.opts.ClientConnectEnable {
+		return errors.New("serve not supported in client mode")
+	}
+
+	if cfg.Bind == "" {
+		return errors.New("no [server.bind] setup")
+	}
+
+	if cfg.AccessKey == nil {
+		return errors.New("no [server.access_key] setup")
+	}
+
+	if cn.serving() {
+		return errors.New("server already started")
+	}
+
+	cn.mu.Lock()
+	cn.opts.Server.Bind = cfg.Bind
+	cn.opts.Server.AccessKey = cfg.AccessKey
+	cn.opts.Server.AuthTLSCert = cfg.AuthTLSCert
+	if cfg.HttpBind != "" {
+		cn.opts.Server.HttpBind = cfg.HttpBind
+	}
+	cn.mu.Unlock()
+
+	cn.serverKeysLoad()
+
+	return cn.serverStart()
+}
@@ -19,9 +19,8 @@ import (
 	"errors"
 	"net"
 	"sync"
-	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
 	"google.golang.org/grpc"
 
 	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
@@ -33,16 +32,36 @@ type InternalServiceImpl struct {
 	db         *Conn
 	prepares   map[string]*kv2.ObjectWriter
 	proposalMu sync.RWMutex
-	sock       net.Listener
+	// the log versions of the tables of the witness node
+	witnessVersions map[string]uint64
+	sock            net.Listener
 }
 
 func (it *InternalServiceImpl) Prepare(ctx context.Context,
 	or *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
 
-	if err := appAuthValid(ctx, it.db.keyMgr); err != nil {
+	av, err := it.db.appAuthValid(ctx)
+	if err != nil {
 		return kv2.NewObjectResultClientError(err), nil
 	}
 
+	if err := failpointInject(FailpointPartition); err != nil {
+		return nil, err
+	}
+
+	if err := failpointInject(FailpointReplicaDrop); err != nil {
+		return nil, err
+	}
+
+	epoch, rs := it.db.epochCheck(ctx, av)
+	if rs != nil {
+		return rs, nil
+	}
+
+	if it.db.nodeWitness() {
+		return it.witnessPrepare(or)
+	}
+
 	tdb := it.db.tabledb(or.TableName)
 	if tdb == nil {
 		return kv2.NewObjectResultClientError(errors.New("table not found")), nil
@@ -51,7 +70,7 @@ func (it *InternalServiceImpl) Prepare(ctx context.Context,
 	it.proposalMu.Lock()
 	defer it.proposalMu.Unlock()
 
-	tn := uint64(time.Now().UnixNano() / 1e6)
+	tn := uint64(it.db.timeNow().UnixNano() / 1e6)
 
 	if len(it.prepares) > 10 {
 		dels := []string{}
@@ -70,6 +89,20 @@ func (it *InternalServiceImpl) Prepare(ctx context.Context,
 		return nil, errors.New("deny")
 	}
 
+	// the conditional writes are denied by the nodes of a newer version of
+	// the key than the coordinator read, so two compare-and-swap writes of
+	// the same version never both reach the quorum
+	if or.PrevVersion > 0 || kv2.AttrAllow(or.Mode, kv2.ObjectWriterModeCreate) {
+		meta, err := it.db.objectMetaGet(or)
+		if meta == nil && err != nil {
+			return nil, err
+		}
+		if meta != nil && (meta.Version > or.PrevVersion ||
+			kv2.AttrAllow(or.Mode, kv2.ObjectWriterModeCreate)) {
+			return nil, errPrevVersion
+		}
+	}
+
 	pLog, err := tdb.objectLogVersionSet(1, 0, tn)
 	if err != nil {
 		return nil, err
@@ -87,7 +120,9 @@ func (it *InternalServiceImpl) Prepare(ctx context.Context,
 
 	it.prepares[string(or.Meta.Key)] = or
 
-	rs := kv2.NewObjectResultOK()
+	it.db.epochClaim(epoch)
+
+	rs = kv2.NewObjectResultOK()
 	rs.Meta = &kv2.ObjectMeta{
 		Version: pLog,
 		IncrId:  pInc,
@@ -98,10 +133,28 @@ func (it *InternalServiceImpl) Prepare(ctx context.Context,
 func (it *InternalServiceImpl) Accept(ctx context.Context,
 	rr2 *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
 
-	if err := appAuthValid(ctx, it.db.keyMgr); err != nil {
+	av, err := it.db.appAuthValid(ctx)
+	if err != nil {
 		return kv2.NewObjectResultClientError(err), nil
 	}
 
+	if err := failpointInject(FailpointPartition); err != nil {
+		return nil, err
+	}
+
+	if err := failpointInject(FailpointReplicaDrop); err != nil {
+		return nil, err
+	}
+
+	epoch, rs := it.db.epochCheck(ctx, av)
+	if rs != nil {
+		return rs, nil
+	}
+
+	if it.db.nodeWitness() {
+		return it.witnessAccept(rr2)
+	}
+
 	it.proposalMu.Lock()
 	defer it.proposalMu.Unlock()
 
@@ -110,7 +163,7 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 	}
 
 	var (
-		tn   = uint64(time.Now().UnixNano() / 1e6)
+		tn   = uint64(it.db.timeNow().UnixNano() / 1e6)
 		cLog = rr2.Meta.Version
 		cInc = rr2.Meta.IncrId
 	)
@@ -134,8 +187,9 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 		tdb.objectIncrSet(rr.IncrNamespace, 0, cInc)
 	}
 
-	it.db.mu.Lock()
-	defer it.db.mu.Unlock()
+	mu := it.db.commitLock(rr.TableName, rr.Meta.Key)
+	mu.Lock()
+	defer mu.Unlock()
 
 	meta, err := it.db.objectMetaGet(rr)
 	if meta == nil && err != nil {
@@ -164,6 +218,10 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 
 			batch := new(leveldb.Batch)
 
+			if err := it.db.historyArchive(tdb, batch, rr.Meta.Key, meta, cLog); err != nil {
+				return nil, err
+			}
+
 			if meta != nil {
 				batch.Delete(keyEncode(nsKeyMeta, rr.Meta.Key))
 				batch.Delete(keyEncode(nsKeyData, rr.Meta.Key))
@@ -172,7 +230,8 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 
 			batch.Put(keyEncode(nsKeyLog, uint64ToBytes(cLog)), bsMeta)
 
-			err = tdb.db.Write(batch, nil)
+			err = it.db.dbWriteObject(tdb, rr.Meta.Key, batch, false)
+			it.db.valueCacheDel(tdb, rr.Meta.Key)
 		}
 
 	} else {
@@ -181,6 +240,10 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 
 			batch := new(leveldb.Batch)
 
+			if err := it.db.historyArchive(tdb, batch, rr.Meta.Key, meta, 0); err != nil {
+				return nil, err
+			}
+
 			if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrDataOff) {
 				batch.Put(keyEncode(nsKeyMeta, rr.Meta.Key), bsData)
 			} else if kv2.AttrAllow(rr.Meta.Attrs, kv2.ObjectMetaAttrMetaOff) {
@@ -205,7 +268,8 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 				}
 			}
 
-			err = tdb.db.Write(batch, nil)
+			err = it.db.dbWriteObject(tdb, rr.Meta.Key, batch, false)
+			it.db.valueCacheDel(tdb, rr.Meta.Key)
 			if err == nil {
 				tdb.objectLogFree(cLog)
 			}
@@ -218,7 +282,9 @@ func (it *InternalServiceImpl) Accept(ctx context.Context,
 
 	delete(it.prepares, string(rr2.Meta.Key))
 
-	rs := kv2.NewObjectResultOK()
+	it.db.epochClaim(epoch)
+
+	rs = kv2.NewObjectResultOK()
 	rs.Meta = &kv2.ObjectMeta{
 		Version: cLog,
 		IncrId:  cInc,
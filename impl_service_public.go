@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"strings"
 	"sync"
@@ -39,43 +40,172 @@ type PublicServiceImpl struct {
 }
 
 type pQueItem struct {
-	Log uint64
-	Inc uint64
+	Log     uint64
+	Inc     uint64
+	Witness bool
 }
 
 func (it *PublicServiceImpl) Query(ctx context.Context,
 	or *kv2.ObjectReader) (*kv2.ObjectResult, error) {
 
+	if err := failpointInject(FailpointPartition); err != nil {
+		return nil, err
+	}
+
+	if err := failpointInject(FailpointRpcLatency); err != nil {
+		return nil, err
+	}
+
 	if ctx != nil {
 
-		av, err := appAuthParse(ctx, it.db.keyMgr)
-		if err != nil {
-			return kv2.NewObjectResultAccessDenied(err.Error()), nil
+		// the log pulls of the other nodes are served in maintenance or
+		// lagging behind, so the node is still replicated by them, see
+		// TransferLeadership
+		logPull := false
+
+		if token := keyTokenIncoming(ctx); token != "" {
+
+			if err := it.db.keyTokenAllow(token, or); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error()), nil
+			}
+
+		} else {
+
+			av, err := it.db.appAuthParse(ctx)
+			if err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error()), nil
+			}
+
+			if err := av.SignValid(nil); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error()), nil
+			}
+
+			if or.TableName == "sys" && av.Allow(authPermSysAll) != nil {
+				return kv2.NewObjectResultAccessDenied(), nil
+			}
+
+			if err := av.Allow(authPermTableRead,
+				hauth.NewScopeFilter(AuthScopeTable, or.TableName)); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error()), nil
+			}
+
+			logPull = kv2.AttrAllow(or.Mode, kv2.ObjectReaderModeLogRange) &&
+				av.Allow(authPermSysAll) == nil
 		}
 
-		if err := av.SignValid(nil); err != nil {
-			return kv2.NewObjectResultAccessDenied(err.Error()), nil
+		if it.db.Maintenance() && len(it.db.opts.Cluster.MainNodes) > 0 && !logPull {
+			return nil, it.db.maintenanceErr()
 		}
 
-		if or.TableName == "sys" && av.Allow(authPermSysAll) != nil {
-			return kv2.NewObjectResultAccessDenied(), nil
+		if !logPull {
+			if err := it.db.replicaLagRead(); err != nil {
+				return nil, err
+			}
 		}
 
-		if err := av.Allow(authPermTableRead,
-			hauth.NewScopeFilter(AuthScopeTable, or.TableName)); err != nil {
-			return kv2.NewObjectResultAccessDenied(err.Error()), nil
+		if err := it.db.sessionWait(or.TableName, sessionVersionIncoming(ctx)); err != nil {
+			return kv2.NewObjectResultServerError(err), nil
+		}
+
+		switch readConsistencyIncoming(ctx) {
+
+		case ReadConsistencyLinearizable:
+			if err := it.db.readIndexWait(or.TableName); err != nil {
+				return kv2.NewObjectResultServerError(err), nil
+			}
+
+		case ReadConsistencyQuorum:
+			if kv2.AttrAllow(or.Mode, kv2.ObjectReaderModeKey) &&
+				len(it.db.opts.Cluster.MainNodes) > 0 {
+				return it.db.usageRead(or, it.db.objectQuorumQuery(or)), nil
+			}
 		}
 	}
 
+	if it.db.nodeWitness() {
+		return kv2.NewObjectResultServerError(errWitnessNoData), nil
+	}
+
 	return it.db.Query(or), nil
 }
 
+var (
+	// errCommitConflict is the error of the commits whose proposal is
+	// denied by the quorum, such as by a concurrent proposal of the same key.
+	errCommitConflict = errors.New("p1 fail")
+
+	// errCommitAccept is the error of the commits whose accept is not
+	// acknowledged by the quorum, the write may be left on a minority of
+	// the nodes until the others pull it.
+	errCommitAccept = errors.New("p2 fail")
+
+	// errPrevVersion is the error of the conditional writes of a key whose
+	// version is not the PrevVersion, or which exists in create mode.
+	errPrevVersion = errors.New("invalid prev_version")
+)
+
+// resultErrIs returns whether the result failed by the error err, the
+// errors are passed by the messages of the results through the rpcs.
+func resultErrIs(rs *kv2.ObjectResult, err error) bool {
+	return !rs.OK() && strings.HasPrefix(rs.Message, err.Error())
+}
+
+// commitCreateExists returns whether the commit rs in create mode was a
+// no-op on an existing key. The create mode of an existing key returns the
+// meta of the existing version, with its Created set, the meta of a new
+// write has no Created.
+func commitCreateExists(rs *kv2.ObjectResult) bool {
+	return rs.OK() && rs.Meta != nil && rs.Meta.Created > 0
+}
+
+const (
+	commitRetryTimeout = time.Duration(2*objAcceptTTL+1000) * time.Millisecond
+	commitRetryBackoff = int64(100)
+)
+
+// commitRetryable returns whether the commit failed by a conflict of the
+// proposals before the deadline, and waits a random backoff for the retry.
+// The denied proposals of a key expire in 2*objAcceptTTL, the deadline of
+// the compare-and-swap loops is commitRetryTimeout.
+func commitRetryable(rs *kv2.ObjectResult, deadline time.Time) bool {
+	if !resultErrIs(rs, errCommitConflict) || time.Now().After(deadline) {
+		return false
+	}
+	time.Sleep(time.Duration(rand.Int63n(commitRetryBackoff)+1) * time.Millisecond)
+	return true
+}
+
 func (it *PublicServiceImpl) Commit(ctx context.Context,
 	rr *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
 
+	rs, err := it.commit(ctx, rr, false)
+
+	// the local writes are counted by Conn.Commit, and the calls without ctx
+	// are from Conn.Commit or the batches
+	if ctx != nil && len(it.db.opts.Cluster.MainNodes) > 0 {
+		it.db.usageWrite(rr, rs)
+	}
+
+	return rs, err
+}
+
+// commit coordinates the write, force overwrites the immutable keys, and is
+// also set by the WriteForceMetadataKey of the requests of the sys/all
+// permission.
+func (it *PublicServiceImpl) commit(ctx context.Context,
+	rr *kv2.ObjectWriter, force bool) (*kv2.ObjectResult, error) {
+
+	if err := failpointInject(FailpointPartition); err != nil {
+		return nil, err
+	}
+
+	if err := failpointInject(FailpointRpcLatency); err != nil {
+		return nil, err
+	}
+
 	if ctx != nil {
 
-		av, err := appAuthParse(ctx, it.db.keyMgr)
+		av, err := it.db.appAuthParse(ctx)
 		if err != nil {
 			return kv2.NewObjectResultAccessDenied(err.Error()), nil
 		}
@@ -88,13 +218,27 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 			return kv2.NewObjectResultAccessDenied(), nil
 		}
 
+		if keyInternalWrite(rr) {
+			return kv2.NewObjectResultClientError(errKeyInternal), nil
+		}
+
 		if err := av.Allow(authPermTableWrite,
 			hauth.NewScopeFilter(AuthScopeTable, rr.TableName)); err != nil {
 			return kv2.NewObjectResultAccessDenied(err.Error()), nil
 		}
+
+		if writeForceIncoming(ctx) {
+			if err := av.Allow(authPermSysAll); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error()), nil
+			}
+			force = true
+		}
 	}
 
 	if len(it.db.opts.Cluster.MainNodes) == 0 {
+		if force {
+			return it.db.CommitForce(rr), nil
+		}
 		return it.db.Commit(rr), nil
 	}
 
@@ -102,6 +246,32 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 		return kv2.NewObjectResultClientError(err), nil
 	}
 
+	if err := it.db.tenantQuotaCheck(rr); err != nil {
+		return kv2.NewObjectResultClientError(err), nil
+	}
+
+	it.db.ttlDefaultSet(rr)
+
+	if it.db.Maintenance() {
+		return nil, it.db.maintenanceErr()
+	}
+
+	if d := it.db.replicaLagThrottle(); d > 0 {
+		time.Sleep(d)
+	}
+
+	if it.db.nodeRemoved() {
+		return kv2.NewObjectResultServerError(errors.New("node removed from the cluster")), nil
+	}
+
+	if it.db.Fenced() {
+		return kv2.NewObjectResultServerError(errors.New("node fenced, the membership epoch is behind the cluster")), nil
+	}
+
+	if it.db.nodeWitness() {
+		return kv2.NewObjectResultServerError(errWitnessNoData), nil
+	}
+
 	meta, err := it.db.objectMetaGet(rr)
 	if meta == nil && err != nil {
 		return kv2.NewObjectResultServerError(err), nil
@@ -116,7 +286,7 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 	} else {
 
 		if rr.PrevVersion > 0 && rr.PrevVersion != meta.Version {
-			return kv2.NewObjectResultClientError(errors.New("invalid prev_version")), nil
+			return kv2.NewObjectResultClientError(errPrevVersion), nil
 		}
 
 		if rr.PrevDataCheck > 0 && rr.PrevDataCheck != meta.DataCheck {
@@ -136,7 +306,8 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 			(rr.Meta.Expired == meta.Expired &&
 				(rr.Meta.IncrId == 0 || rr.Meta.IncrId == meta.IncrId) &&
 				(rr.PrevIncrId == 0 || rr.PrevIncrId == meta.IncrId) &&
-				meta.DataCheck == rr.Meta.DataCheck) {
+				meta.DataCheck == rr.Meta.DataCheck &&
+				Attrs(rr.Meta) == Attrs(meta)) {
 
 			rs := kv2.NewObjectResultOK()
 			rs.Meta = &kv2.ObjectMeta{
@@ -148,12 +319,19 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 			return rs, nil
 		}
 
+		if !force {
+			if err := it.db.immutableCheck(rr, meta); err != nil {
+				return kv2.NewObjectResultClientError(err), nil
+			}
+		}
+
 		if rr.Meta.IncrId == 0 && meta.IncrId > 0 {
 			rr.Meta.IncrId = meta.IncrId
 		}
 
+		// the attribute bits are replaced by the write
 		if meta.Attrs > 0 {
-			rr.Meta.Attrs |= meta.Attrs
+			rr.Meta.Attrs |= meta.Attrs &^ AttrMask
 		}
 
 		if meta.Created > 0 {
@@ -166,35 +344,36 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 	}
 
 	var (
-		nCap = len(it.db.opts.Cluster.MainNodes)
-		pNum = 0
-		pLog = uint64(0)
-		pInc = uint64(0)
-		pQue = make(chan pQueItem, nCap+1)
-		pTTL = time.Millisecond * time.Duration(objAcceptTTL)
+		nodes = it.db.mainNodes()
+		nCap  = len(nodes)
+		nQuo  = it.db.opts.Cluster.replicationPolicy(rr.TableName, rr.Meta.Key).quorum(nCap)
+		dQuo  = witnessDataQuorum(nodes, nQuo)
+		pNum  = 0
+		dNum  = 0
+		pRecv = 0
+		pLog  = uint64(0)
+		pInc  = uint64(0)
+		pQue  = make(chan pQueItem, nCap+1)
+		pTTL  = time.Millisecond * time.Duration(objAcceptTTL)
 	)
 
-	for _, v := range it.db.opts.Cluster.MainNodes {
+	for _, v := range nodes {
 
 		go func(v *ClientConfig, rr *kv2.ObjectWriter) {
 
-			conn, err := clientConn(v.Addr, v.AccessKey, v.AuthTLSCert, false)
-			var rs *kv2.ObjectResult
+			ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+			defer fc()
 
+			rs, err := it.db.transport.Prepare(it.db.epochOutgoing(ctx), v, rr)
 			if err == nil {
-				ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
-				defer fc()
-				rs, err = kv2.NewInternalClient(conn).Prepare(ctx, rr)
-				if err != nil {
-					conn, err = clientConn(v.Addr, v.AccessKey, v.AuthTLSCert, true)
-					rs, err = kv2.NewInternalClient(conn).Prepare(ctx, rr)
-				}
+				it.db.epochFencedObserve(rs)
 			}
 
 			if err == nil && rs.Meta != nil && rs.Meta.Version > 0 {
 				pQue <- pQueItem{
-					Log: rs.Meta.Version,
-					Inc: rs.Meta.IncrId,
+					Log:     rs.Meta.Version,
+					Inc:     rs.Meta.IncrId,
+					Witness: v.witness(),
 				}
 			} else {
 				pQue <- pQueItem{
@@ -208,8 +387,12 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 
 		select {
 		case v := <-pQue:
+			pRecv += 1
 			if v.Log > 0 {
 				pNum += 1
+				if !v.Witness {
+					dNum += 1
+				}
 				if v.Log > pLog {
 					pLog = v.Log
 				}
@@ -222,8 +405,10 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 			pTTL = -1
 		}
 
-		if (pNum*2) > nCap || pTTL == -1 {
-			if pNum < nCap && pTTL > 0 {
+		// the failed proposals or accepts are returned once all the nodes
+		// have answered, so the retries are not delayed
+		if (pNum >= nQuo && dNum >= dQuo) || pRecv == nCap || pTTL == -1 {
+			if pRecv < nCap && pTTL > 0 {
 				pTTL = time.Millisecond * 10
 				continue
 			}
@@ -231,11 +416,11 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 		}
 	}
 
-	if (pNum * 2) <= nCap {
-		return nil, fmt.Errorf("p1 fail %d/%d", pNum, nCap)
+	if pNum < nQuo || dNum < dQuo {
+		return nil, fmt.Errorf("%w %d/%d", errCommitConflict, pNum, nCap)
 	}
 
-	pNum = 0
+	pNum, dNum, pRecv = 0, 0, 0
 	pTTL = time.Millisecond * time.Duration(objAcceptTTL)
 	pQue2 := make(chan uint64, nCap+1)
 
@@ -243,24 +428,24 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 	rr2.Meta.Version = pLog
 	rr2.Meta.IncrId = pInc
 
-	for _, v := range it.db.opts.Cluster.MainNodes {
+	for _, v := range nodes {
 
 		go func(v *ClientConfig, rr *kv2.ObjectWriter) {
 
-			conn, err := clientConn(v.Addr, v.AccessKey, v.AuthTLSCert, false)
-			var rs *kv2.ObjectResult
+			ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+			defer fc()
+
+			rs, err := it.db.transport.Accept(it.db.epochOutgoing(ctx), v, rr2)
 			if err == nil {
-				ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
-				defer fc()
-				rs, err = kv2.NewInternalClient(conn).Accept(ctx, rr2)
-				if err != nil {
-					conn, err = clientConn(v.Addr, v.AccessKey, v.AuthTLSCert, true)
-					rs, err = kv2.NewInternalClient(conn).Accept(ctx, rr2)
-				}
+				it.db.epochFencedObserve(rs)
 			}
 
 			if err == nil && rs.Meta != nil && rs.Meta.Version == pLog {
-				pQue2 <- 1
+				if v.witness() {
+					pQue2 <- 2
+				} else {
+					pQue2 <- 1
+				}
 			} else {
 				pQue2 <- 0
 			}
@@ -271,16 +456,20 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 
 		select {
 		case v := <-pQue2:
-			if v == 1 {
+			pRecv += 1
+			if v > 0 {
 				pNum += 1
 			}
+			if v == 1 {
+				dNum += 1
+			}
 
 		case <-time.After(pTTL):
 			pTTL = -1
 		}
 
-		if (pNum*2) > nCap || pTTL == -1 {
-			if pNum < nCap && pTTL > 0 {
+		if (pNum >= nQuo && dNum >= dQuo) || pRecv == nCap || pTTL == -1 {
+			if pRecv < nCap && pTTL > 0 {
 				pTTL = time.Millisecond * 10
 				continue
 			}
@@ -288,8 +477,8 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 		}
 	}
 
-	if (pNum * 2) <= nCap {
-		return nil, fmt.Errorf("p2 fail %d/%d", pNum, nCap)
+	if pNum < nQuo || dNum < dQuo {
+		return nil, fmt.Errorf("%w %d/%d", errCommitAccept, pNum, nCap)
 	}
 
 	rs := kv2.NewObjectResultOK()
@@ -305,9 +494,17 @@ func (it *PublicServiceImpl) Commit(ctx context.Context,
 func (it *PublicServiceImpl) BatchCommit(ctx context.Context,
 	rr *kv2.BatchRequest) (*kv2.BatchResult, error) {
 
+	if err := failpointInject(FailpointPartition); err != nil {
+		return nil, err
+	}
+
+	if err := failpointInject(FailpointRpcLatency); err != nil {
+		return nil, err
+	}
+
 	if ctx != nil {
 
-		av, err := appAuthParse(ctx, it.db.keyMgr)
+		av, err := it.db.appAuthParse(ctx)
 		if err != nil {
 			return kv2.NewBatchResultAccessDenied(err.Error()), nil
 		}
@@ -335,6 +532,10 @@ func (it *PublicServiceImpl) BatchCommit(ctx context.Context,
 					return kv2.NewBatchResultAccessDenied(), nil
 				}
 
+				if keyInternalWrite(v.Writer) {
+					return rr.NewResult(kv2.ResultClientError, errKeyInternal.Error()), nil
+				}
+
 				if err := av.Allow(authPermTableWrite,
 					hauth.NewScopeFilter(AuthScopeTable, v.Writer.TableName)); err != nil {
 					return kv2.NewBatchResultAccessDenied(), nil
@@ -376,6 +577,7 @@ func (it *PublicServiceImpl) BatchCommit(ctx context.Context,
 				v.Writer.TableName = rr.TableName
 			}
 			rs2, err = it.Commit(nil, v.Writer)
+			it.db.usageWrite(v.Writer, rs2)
 
 		} else {
 			rs2 = kv2.NewObjectResultClientError(errors.New("no reader/writer commit"))
@@ -407,13 +609,19 @@ func (it *PublicServiceImpl) BatchCommit(ctx context.Context,
 func (it *PublicServiceImpl) SysCmd(ctx context.Context, req *kv2.SysCmdRequest) (*kv2.ObjectResult, error) {
 
 	var (
-		av  *hauth.AppValidator
+		av  appValidator
 		err error
 	)
 
+	if req.Method != "NodeFailpoint" && req.Method != "NodeStatus" {
+		if err := failpointInject(FailpointPartition); err != nil {
+			return nil, err
+		}
+	}
+
 	if ctx != nil {
 
-		av, err = appAuthParse(ctx, it.db.keyMgr)
+		av, err = it.db.appAuthParse(ctx)
 		if err != nil {
 			return kv2.NewObjectResultAccessDenied(err.Error()), nil
 		}
@@ -423,12 +631,14 @@ func (it *PublicServiceImpl) SysCmd(ctx context.Context, req *kv2.SysCmdRequest)
 		}
 
 		if !strings.HasPrefix(req.Method, "Table") &&
+			!sysCmdClientMethods[req.Method] &&
 			av.Allow(authPermSysAll) != nil {
 			return kv2.NewObjectResultAccessDenied(), nil
 		}
 	}
 
-	if len(it.db.opts.Cluster.MainNodes) == 0 {
+	if len(it.db.opts.Cluster.MainNodes) == 0 ||
+		sysCmdNodeLocalMethods[req.Method] {
 		return it.db.sysCmdLocal(av, req), nil
 	}
 
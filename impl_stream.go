@@ -0,0 +1,130 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/binary"
+	"errors"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+func streamKeyEntries(stream string) string {
+	return "stream:" + stream
+}
+
+func streamKeyOffset(stream, consumer string) []byte {
+	return NsKey("stream-offset", stream, consumer)
+}
+
+func streamSeqName(stream string) string {
+	return "stream." + stream
+}
+
+// StreamConn is an append-only stream per name, the offsets of entries are
+// allocated by NextSeq so they are monotonically increasing (but may have
+// gaps), and the committed offsets of consumers are stored in the table.
+type StreamConn struct {
+	db    *Conn
+	table kv2.ClientTable
+}
+
+type StreamEntry struct {
+	Offset uint64
+	Item   *kv2.ObjectItem
+}
+
+func NewStreamConn(db *Conn, tableName string) (*StreamConn, error) {
+	if db == nil {
+		return nil, errors.New("no db setup")
+	}
+	return &StreamConn{
+		db:    db,
+		table: db.OpenTable(tableName),
+	}, nil
+}
+
+// StreamAppend appends the value to the stream and returns its offset.
+func (cn *StreamConn) StreamAppend(stream string, value interface{}) (uint64, error) {
+
+	if !seqNameReg.MatchString(streamSeqName(stream)) {
+		return 0, errors.New("invalid stream name")
+	}
+
+	offset, err := cn.db.NextSeq(streamSeqName(stream), 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if rs := cn.table.NewWriter(NsIncrKey(streamKeyEntries(stream), offset), value).
+		Commit(); !rs.OK() {
+		return 0, rs.Error()
+	}
+
+	return offset, nil
+}
+
+// StreamRead returns at most limit entries of the stream after the offset.
+func (cn *StreamConn) StreamRead(stream string, offset uint64, limit int64) ([]*StreamEntry, error) {
+
+	var (
+		ns = streamKeyEntries(stream)
+		ls = []*StreamEntry{}
+	)
+
+	rs := cn.table.NewReader(nil).
+		KeyRangeSet(NsIncrKey(ns, offset), NsIncrKey(ns, ^uint64(0))).
+		LimitNumSet(limit).Query()
+	if !rs.OK() {
+		if rs.NotFound() {
+			return ls, nil
+		}
+		return nil, rs.Error()
+	}
+
+	for _, item := range rs.Items {
+		if item.Meta == nil || len(item.Meta.Key) != len(ns)+9 {
+			continue
+		}
+		ls = append(ls, &StreamEntry{
+			Offset: binary.BigEndian.Uint64(item.Meta.Key[len(ns)+1:]),
+			Item:   item,
+		})
+	}
+
+	return ls, nil
+}
+
+// StreamCommit saves the offset of the last entry processed by the consumer.
+func (cn *StreamConn) StreamCommit(stream, consumer string, offset uint64) error {
+	if rs := cn.table.NewWriter(streamKeyOffset(stream, consumer), offset).
+		Commit(); !rs.OK() {
+		return rs.Error()
+	}
+	return nil
+}
+
+// StreamOffset returns the committed offset of the consumer, 0 if the
+// consumer has never committed.
+func (cn *StreamConn) StreamOffset(stream, consumer string) (uint64, error) {
+	rs := cn.table.NewReader(streamKeyOffset(stream, consumer)).Query()
+	if rs.OK() {
+		return rs.DataValue().Uint64(), nil
+	}
+	if rs.NotFound() {
+		return 0, nil
+	}
+	return 0, rs.Error()
+}
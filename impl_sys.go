@@ -15,6 +15,7 @@
 package kvgo
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -41,7 +42,7 @@ func (cn *Conn) SysCmd(rr *kv2.SysCmdRequest) *kv2.ObjectResult {
 	return cn.sysCmdLocal(nil, rr)
 }
 
-func (cn *Conn) sysCmdLocal(av *hauth.AppValidator, rr *kv2.SysCmdRequest) *kv2.ObjectResult {
+func (cn *Conn) sysCmdLocal(av appValidator, rr *kv2.SysCmdRequest) *kv2.ObjectResult {
 
 	var rs *kv2.ObjectResult
 
@@ -234,6 +235,134 @@ func (cn *Conn) sysCmdLocal(av *hauth.AppValidator, rr *kv2.SysCmdRequest) *kv2.
 			rs = rs2
 		}
 
+	case "SeqNext":
+
+		var req2 sysCmdSeqNextRequest
+		if err := json.Unmarshal(rr.Body, &req2); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+
+		if av != nil {
+			if err := av.Allow(authPermTableWrite); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+
+		id, err := cn.seqNextLocal(req2.Name, req2.Step)
+		if err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+
+		rs = kv2.NewObjectResultOK()
+		rs.Meta = &kv2.ObjectMeta{
+			IncrId: id,
+		}
+
+	case "Handshake":
+		rs = cn.handshakeCmdLocal(rr.Body)
+
+	case "ObjectMerge":
+		rs = cn.mergeCmdLocal(av, rr.Body)
+
+	case "ScriptEval":
+		rs = cn.scriptCmdLocal(av, rr.Body)
+
+	case "ProcedureCall":
+		rs = cn.procedureCmdLocal(av, rr.Body)
+
+	case "CasPut", "CasRelease", "CasStats", "CasGC":
+		rs = cn.casCmdLocal(av, rr.Method, rr.Body)
+
+	case "HistoryQuery":
+		rs = cn.historyCmdLocal(av, rr.Body)
+
+	case "SystemScan":
+		rs = cn.systemScanCmdLocal(av, rr.Body)
+
+	case "TableStats":
+		rs = cn.tableStatsCmdLocal(av, rr.Body)
+
+	case "CachePin", "CacheUnpin", "CachePinList":
+		rs = cn.cachePinCmdLocal(av, rr.Method, rr.Body)
+
+	case "TenantCreate", "TenantDelete", "TenantList":
+		rs = cn.tenantCmdLocal(av, rr.Method, rr.Body)
+
+	case "TableUsages":
+		rs = cn.tableUsagesCmdLocal(av)
+
+	case "TLSReload":
+		rs = cn.tlsReloadCmdLocal(av)
+
+	case "KeyTokenIssue":
+		rs = cn.keyTokenCmdLocal(av, rr.Body)
+
+	case "BackupScheduleSet", "BackupScheduleDel", "BackupScheduleList":
+		rs = cn.backupScheduleCmdLocal(av, rr.Method, rr.Body)
+
+	case "SnapshotOpen", "SnapshotRead", "SnapshotClose":
+		rs = cn.snapshotCmdLocal(av, rr.Method, rr.Body)
+
+	case "NodeDecommission", "NodeDecommissionStatus", "NodeLogOffsets", "NodeRemove":
+		rs = cn.decommissionCmdLocal(av, rr.Method, rr.Body)
+
+	case "NodeAdd", "NodeJoin", "NodeJoinStatus", "ReplicaOfAdd", "ReplicaOfRemove":
+		rs = cn.membershipCmdLocal(av, rr.Method, rr.Body)
+
+	case "NodeFailpoint":
+		rs = cn.failpointCmdLocal(av, rr.Body)
+
+	case "NodeMaintenance":
+		rs = cn.maintenanceCmdLocal(av, rr.Body)
+
+	case "TransferLeadership":
+		rs = cn.leadershipTransferCmdLocal(av, rr.Body)
+
+	case "NodeMembers":
+		if av != nil {
+			if err := av.Allow(authPermSysAll); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+		rs = cn.nodeMembersCmdLocal()
+
+	case "NodeStatus", "ClusterStatus":
+		rs = cn.clusterStatusCmdLocal(av, rr.Method)
+
+	case "ObjectDigest", "ObjectRepair":
+		if av != nil {
+			if err := av.Allow(authPermSysAll); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+		rs = cn.objectDigestCmdLocal(rr.Method, rr.Body)
+
+	case "ReadIndex":
+		if av != nil {
+			if err := av.Allow(authPermSysAll); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+		rs = cn.readIndexCmdLocal(rr.Body)
+
+	case "ReplicaApply":
+		if av != nil {
+			if err := av.Allow(authPermSysAll); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+		rs = cn.replicaApplyCmdLocal(rr.Body)
+
+	case "PubSubPublish", "PubSubSubscribe", "PubSubPoll", "PubSubUnsubscribe":
+
+		if av != nil {
+			if err := av.Allow(authPermTableRead); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+
+		rs = cn.pubSubCmdLocal(rr.Method, rr.Body)
+
 	default:
 		rs = kv2.NewObjectResultClientError(errors.New("cmd not found"))
 	}
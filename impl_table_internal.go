@@ -51,18 +51,19 @@ func (tdb *dbTable) objectLogVersionSet(incr, set, updated uint64) (uint64, erro
 	}
 
 	if set > 0 && set > tdb.logOffset {
-		incr += (set - tdb.logOffset)
+		tdb.logOffset = set
 	}
 
 	if incr > 0 {
 
-		if (tdb.logOffset + incr) >= tdb.logCutset {
+		version := tdb.logOffset + incr
+		if hv := hlcNow(); hv > version {
+			version = hv
+		}
 
-			cutset := tdb.logOffset + incr + 100
+		if version >= tdb.logCutset {
 
-			if n := cutset % 100; n > 0 {
-				cutset += n
-			}
+			cutset := version + hlcCutsetWindow
 
 			if err := tdb.db.Put(keySysLogCutset,
 				[]byte(strconv.FormatUint(cutset, 10)), nil); err != nil {
@@ -70,12 +71,12 @@ func (tdb *dbTable) objectLogVersionSet(incr, set, updated uint64) (uint64, erro
 			}
 
 			hlog.Printf("debug", "table %s, reset log-version to %d~%d",
-				tdb.tableName, tdb.logOffset+incr, cutset)
+				tdb.tableName, version, cutset)
 
 			tdb.logCutset = cutset
 		}
 
-		tdb.logOffset += incr
+		tdb.logOffset = version
 
 		if updated > 0 {
 			tdb.logLockSets[tdb.logOffset] = updated
@@ -15,18 +15,61 @@
 package kvgo
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
 	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
 )
 
+var (
+	testLong     = flag.Bool("kvgo.long", false, "run the long tests")
+	testSimDrop  = flag.Float64("kvgo.sim-drop", 0, "the drop rate of the simulated network in the long tests")
+	testSimDelay = flag.Duration("kvgo.sim-delay", 5*time.Millisecond, "the max delay of the simulated network in the long tests")
+)
+
 var (
 	dbTestMu        sync.Mutex
 	dbTestCaches    = map[string]*Conn{}
@@ -472,7 +515,7 @@ func Test_Object_LogAsync(t *testing.T) {
 
 		for _, hp := range db.opts.Cluster.MainNodes {
 
-			conn, err := clientConn(hp.Addr, hp.AccessKey, hp.AuthTLSCert, false)
+			conn, err := clientConn(hp.Addr, hp.AccessKey, hp.RequestSign, hp.AuthTLSCert, hp.Keepalive, false)
 			if err != nil {
 				t.Fatalf("Object AsyncLog ER %s", err.Error())
 			}
@@ -558,144 +601,7642 @@ func Test_Table(t *testing.T) {
 	}
 }
 
-func Benchmark_Commit_Seq(b *testing.B) {
+func Test_Seq(t *testing.T) {
 
-	dbs, err := dbOpen(nil, false)
+	dbs, err := dbOpen([]int{}, false)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatalf("Can Not Open Database %s", err.Error())
 	}
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < b.N; i++ {
-		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
-			b.Fatalf("Commit ER!, Err %s", rs.Message)
-		}
+	id1, err := dbs[0].NextSeq("seq-test", 10)
+	if err != nil {
+		t.Fatalf("NextSeq ER! %s", err.Error())
 	}
-}
 
-func Benchmark_Commit_Seq_MetaLogDisable(b *testing.B) {
+	id2, err := dbs[0].NextSeq("seq-test", 1)
+	if err != nil {
+		t.Fatalf("NextSeq ER! %s", err.Error())
+	}
 
-	dbs, err := dbOpen([]int{-1}, false)
+	if id2 != id1+10 {
+		t.Fatalf("NextSeq ER! %d/%d", id1, id2)
+	}
+
+	if _, err := dbs[0].NextSeq("", 1); err == nil {
+		t.Fatal("NextSeq ER! invalid name")
+	}
+
+	t.Logf("NextSeq OK %d/%d", id1, id2)
+
+	// the first id is the same in embedded and in cluster mode
+	seqName := fmt.Sprintf("seq-first-%d", time.Now().UnixNano())
+	if id, err := dbs[0].NextSeq(seqName, 5); err != nil || id != seqOffsetMin+1 {
+		t.Fatalf("NextSeq ER! first id %d %v", id, err)
+	}
+
+	// the blocks allocated by the nodes of a cluster never overlap
+	dbs, err = dbOpen([]int{20201, 20202, 20203}, false)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatalf("Can Not Open Database %s", err.Error())
 	}
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < b.N; i++ {
-		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
-			b.Fatalf("Commit ER!, Err %s", rs.Message)
+	if id, err := dbs[0].NextSeq(seqName, 5); err != nil || id != seqOffsetMin+1 {
+		t.Fatalf("NextSeq ER! cluster first id %d %v", id, err)
+	}
+
+	// the ids of a node are served from its block, and a new block is
+	// committed when the block is used up
+	var prev uint64
+	for i, step := range []uint64{5, 300, 600, 100, 2000} {
+		id, err := dbs[0].NextSeq(seqName, step)
+		if err != nil || id <= prev {
+			t.Fatalf("NextSeq ER! cluster %d: %d %v", i, id, err)
 		}
+		prev = id
+	}
+	rs := dbs[0].QueryQuorum(kv2.NewObjectReader(keyInternalEncode(nsSysSeq(seqName))).
+		TableNameSet(sysTableName))
+	if !rs.OK() || binary.BigEndian.Uint64(rs.DataValue().Bytes()) != seqOffsetMin+2*seqBlockSize+2000 {
+		t.Fatalf("NextSeq ER! cluster blocks %s", rs.Message)
+	}
+	if id, err := dbs[1].NextSeq(seqName, 1); err != nil || id != seqOffsetMin+2*seqBlockSize+2000+1 {
+		t.Fatalf("NextSeq ER! cluster block of node 2 %d %v", id, err)
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = map[uint64]bool{}
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(db *Conn) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				id, err := db.NextSeq("seq-cluster", 10)
+				if err != nil {
+					t.Errorf("NextSeq ER! cluster %s", err.Error())
+					return
+				}
+				mu.Lock()
+				for k := id; k < id+10; k++ {
+					if seen[k] {
+						t.Errorf("NextSeq ER! cluster id %d reused", k)
+					}
+					seen[k] = true
+				}
+				mu.Unlock()
+			}
+		}(dbs[i])
 	}
+	wg.Wait()
 }
 
-func Benchmark_Commit_Rand(b *testing.B) {
+func Test_TimeSeries(t *testing.T) {
 
-	dbs, err := dbOpen(nil, false)
+	dbs, err := dbOpen([]int{}, false)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatalf("Can Not Open Database %s", err.Error())
 	}
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < b.N; i++ {
-		if rs := dbs[0].NewWriter(
-			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs).Commit(); !rs.OK() {
-			b.Fatalf("Commit ER!, Err %s", rs.Message)
+	ts, err := NewTimeSeriesConn(dbs[0].OpenTable("main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs := ts.TsRetentionSet("ts-test", time.Hour); !rs.OK() {
+		t.Fatalf("TsRetentionSet ER! %s", rs.Message)
+	}
+
+	tn := time.Now().Truncate(time.Second)
+	for i := 3; i > 0; i-- {
+		if rs := ts.TsPut("ts-test", tn.Add(-time.Duration(i)*time.Minute), i); !rs.OK() {
+			t.Fatalf("TsPut ER! %s", rs.Message)
+		}
+	}
+
+	// the points out of the retention are not written
+	if rs := ts.TsPut("ts-test", tn.Add(-2*time.Hour), 0); !rs.OK() {
+		t.Fatalf("TsPut ER! %s", rs.Message)
+	}
+
+	// the retention is loaded by the new connections
+	ts2, _ := NewTimeSeriesConn(dbs[0].OpenTable("main"))
+	if rs := ts2.TsPut("ts-test", tn.Add(-3*time.Hour), 0); !rs.OK() {
+		t.Fatalf("TsPut ER! %s", rs.Message)
+	}
+
+	ls, err := ts2.TsRange("ts-test", tn.Add(-4*time.Hour), tn, 10)
+	if err != nil {
+		t.Fatalf("TsRange ER! %s", err.Error())
+	}
+	if len(ls) != 3 {
+		t.Fatalf("TsRange ER! points %d", len(ls))
+	}
+	for i, p := range ls {
+		if !p.Time.Equal(tn.Add(-time.Duration(3-i)*time.Minute)) ||
+			p.Item.DataValue().Int() != 3-i {
+			t.Fatalf("TsRange ER! point %d, time %v", i, p.Time)
+		}
+		if p.Item.Meta.Expired == 0 {
+			t.Fatal("TsRange ER! no retention ttl")
 		}
 	}
+
+	if ls, err := ts2.TsRange("ts-test", tn.Add(-2*time.Minute), tn, 10); err != nil || len(ls) != 2 {
+		t.Fatal("TsRange ER! from")
+	}
+
+	if _, err := ts2.TsRange("ts-test", tn, tn.Add(-time.Minute), 10); err == nil {
+		t.Fatal("TsRange ER! invalid range")
+	}
+
+	t.Log("TimeSeries OK")
 }
 
-func Benchmark_Commit_Rand_MetaLogDisable(b *testing.B) {
+func Test_Stream(t *testing.T) {
 
-	dbs, err := dbOpen([]int{-2}, false)
+	dbs, err := dbOpen([]int{}, false)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatalf("Can Not Open Database %s", err.Error())
 	}
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < b.N; i++ {
-		if rs := dbs[0].NewWriter(
-			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs).Commit(); !rs.OK() {
-			b.Fatalf("Commit ER!, Err %s", rs.Message)
+	sc, err := NewStreamConn(dbs[0], "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		offset, err := sc.StreamAppend("stream-test", fmt.Sprintf("value-%d", i))
+		if err != nil {
+			t.Fatalf("StreamAppend ER! %s", err.Error())
+		}
+		if i > 0 && offset <= offsets[i-1] {
+			t.Fatalf("StreamAppend ER! offset %d", offset)
+		}
+		offsets = append(offsets, offset)
+	}
+
+	// the entries of the streams of the same prefix are not read
+	if _, err := sc.StreamAppend("stream-test2", "value"); err != nil {
+		t.Fatalf("StreamAppend ER! %s", err.Error())
+	}
+
+	if _, err := sc.StreamAppend("stream test", "value"); err == nil {
+		t.Fatal("StreamAppend ER! invalid name")
+	}
+
+	// the entries after the offset are read
+	ls, err := sc.StreamRead("stream-test", 0, 10)
+	if err != nil || len(ls) != 3 {
+		t.Fatalf("StreamRead ER! %v", err)
+	}
+	for i, v := range ls {
+		if v.Offset != offsets[i] || v.Item.DataValue().String() != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("StreamRead ER! entry %d", i)
 		}
 	}
+
+	if ls, err := sc.StreamRead("stream-test", offsets[0], 1); err != nil ||
+		len(ls) != 1 || ls[0].Offset != offsets[1] {
+		t.Fatal("StreamRead ER! offset, limit")
+	}
+
+	// the consumers commit their offsets
+	if offset, err := sc.StreamOffset("stream-test", "c1"); err != nil || offset != 0 {
+		t.Fatal("StreamOffset ER! not committed")
+	}
+	if err := sc.StreamCommit("stream-test", "c1", offsets[1]); err != nil {
+		t.Fatalf("StreamCommit ER! %s", err.Error())
+	}
+	if offset, err := sc.StreamOffset("stream-test", "c1"); err != nil || offset != offsets[1] {
+		t.Fatal("StreamOffset ER!")
+	}
+	if offset, err := sc.StreamOffset("stream-test", "c2"); err != nil || offset != 0 {
+		t.Fatal("StreamOffset ER! consumer")
+	}
+
+	t.Log("Stream OK")
 }
 
-func Benchmark_Commit_Rand_Cluster_x3_1k(b *testing.B) {
+func Test_CommitLockShards(t *testing.T) {
 
-	dbs, err := dbOpen([]int{10001, 10002, 10003}, false)
+	dbs, err := dbOpen([]int{}, false)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatalf("Can Not Open Database %s", err.Error())
 	}
+	cn := dbs[0]
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < b.N; i++ {
-		ow := kv2.NewObjectWriter(
-			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs)
-		if rs := dbs[rand.Intn(len(dbs))].Commit(ow); !rs.OK() {
-			b.Fatalf("Commit ER!, Err %s", rs.Message)
+	// the keys are spread over the shards, by the table and the key
+	var (
+		shards = map[int]bool{}
+		keys   = map[int][]byte{}
+	)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("lock-%d", i))
+		n := commitShard("main", key)
+		if n != commitShard("main", key) {
+			t.Fatal("commitShard ER! not stable")
+		}
+		shards[n] = true
+		if _, ok := keys[n]; !ok {
+			keys[n] = key
+		}
+	}
+	if len(shards) != commitShardNum {
+		t.Fatalf("commitShard ER! shards %d", len(shards))
+	}
+
+	var (
+		held  = []byte("lock-0")
+		same  []byte
+		other []byte
+	)
+	for i := 1; i < 1000 && (same == nil || other == nil); i++ {
+		key := []byte(fmt.Sprintf("lock-%d", i))
+		if commitShard("main", key) == commitShard("main", held) {
+			same = key
+		} else if other == nil {
+			other = key
 		}
 	}
+	if same == nil {
+		t.Fatal("commitShard ER! no key of the same shard")
+	}
+
+	commit := func(key []byte) chan *kv2.ObjectResult {
+		ch := make(chan *kv2.ObjectResult, 1)
+		go func() {
+			ch <- cn.Commit(kv2.NewObjectWriter(key, "value").TableNameSet("main"))
+		}()
+		return ch
+	}
+
+	// the commits of the other shards are not blocked by a held shard
+	mu := cn.commitLock("main", held)
+	mu.Lock()
+
+	select {
+	case rs := <-commit(other):
+		if !rs.OK() {
+			mu.Unlock()
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	case <-time.After(3 * time.Second):
+		mu.Unlock()
+		t.Fatal("Commit ER! blocked by the other shard")
+	}
+
+	ch := commit(same)
+	select {
+	case rs := <-ch:
+		mu.Unlock()
+		t.Fatalf("Commit ER! not blocked by the shard, %s", rs.Message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Unlock()
+
+	select {
+	case rs := <-ch:
+		if !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Commit ER! not released")
+	}
+
+	// the concurrent compare-and-swap commits of a key lose no update
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; {
+				rs := cn.NewReader([]byte("lock-counter")).Query()
+				var (
+					n       int64
+					version uint64
+				)
+				if rs.OK() {
+					n, version = rs.DataValue().Int64(), rs.Items[0].Meta.Version
+				}
+				rr := kv2.NewObjectWriter([]byte("lock-counter"), n+1)
+				if version > 0 {
+					rr.PrevVersion = version
+				} else {
+					rr.ModeCreateSet(true)
+				}
+				if rs := cn.Commit(rr); rs.OK() && (version > 0 || rs.Meta.Created == 0) {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rs := cn.NewReader([]byte("lock-counter")).Query(); !rs.OK() || rs.DataValue().Int64() != 160 {
+		t.Fatal("Commit ER! lost updates")
+	}
+
+	t.Log("CommitLockShards OK")
 }
 
-func Benchmark_Commit_Rand_Cluster_x3_100b(b *testing.B) {
+func Test_KeySchema(t *testing.T) {
 
-	dbs, err := dbOpen([]int{11001, 11002, 11003}, false)
-	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+	if k := NsKey("users", "u1", uint64(1)); string(k) != "users:u1:\x00\x00\x00\x00\x00\x00\x00\x01" {
+		t.Fatalf("NsKey ER! %q", k)
 	}
 
-	bs := []byte(strings.Repeat("a", 100))
-	for i := 0; i < b.N; i++ {
-		ow := kv2.NewObjectWriter(
-			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs)
-		if rs := dbs[rand.Intn(len(dbs))].Commit(ow); !rs.OK() {
-			b.Fatalf("Commit ER!, Err %s", rs.Message)
+	if bytes.Compare(NsIncrKey("seq", 9), NsIncrKey("seq", 10)) >= 0 {
+		t.Fatal("NsIncrKey ER! Order")
+	}
+
+	if bytes.Compare(NsKey("n", -1), NsKey("n", 1)) >= 0 {
+		t.Fatal("NsKey ER! Int Order")
+	}
+
+	var (
+		t1 = time.Unix(1500000000, 0)
+		t2 = t1.Add(time.Second)
+	)
+
+	if bytes.Compare(NsTimeKey("ts", t1), NsTimeKey("ts", t2)) >= 0 {
+		t.Fatal("NsTimeKey ER! Order")
+	}
+
+	if bytes.Compare(NsTimeKeyRev("ts", t1), NsTimeKeyRev("ts", t2)) <= 0 {
+		t.Fatal("NsTimeKeyRev ER! Order")
+	}
+
+	if tp, err := NsTimeKeyParse("ts", NsTimeKeyRev("ts", t2, "x"), true); err != nil || !tp.Equal(t2) {
+		t.Fatal("NsTimeKeyParse ER!")
+	}
+
+	offset, cutset := NsKeyRange("users")
+	for _, k := range [][]byte{
+		NsKey("users", "u1"),
+		append(NsKey("users", "u1"), 0xff),
+		append(append(bytesClone(offset), 0xff), 0xff),
+	} {
+		if bytes.Compare(k, offset) <= 0 || bytes.Compare(k, keyPrefixLimit(cutset)) >= 0 {
+			t.Fatalf("NsKeyRange ER! %q", k)
 		}
 	}
+	if k := NsKey("usersz", "u1"); bytes.Compare(k, keyPrefixLimit(cutset)) < 0 {
+		t.Fatal("NsKeyRange ER! Limit")
+	}
+
+	t.Log("KeySchema OK")
 }
 
-func Benchmark_Query_Key(b *testing.B) {
+func Test_Merge(t *testing.T) {
 
-	dbs, err := dbOpen(nil, false)
+	key := []byte("k1")
+	if k := mergeKeyDecode(append(mergeKeyPrefix(key), uint64ToBytes(1)...)); !bytes.Equal(k, key) {
+		t.Fatalf("mergeKeyDecode ER! %q", k)
+	}
+
+	if bytes.HasPrefix(mergeKeyPrefix([]byte("k12")), mergeKeyPrefix(key)) {
+		t.Fatal("mergeKeyPrefix ER! Prefix")
+	}
+
+	value, err := mergeApply(key, []byte("10"), []*mergeOperand{
+		{operator: MergeOperatorCounter, operand: []byte("5")},
+		{operator: MergeOperatorCounter, operand: []byte("-3")},
+		{operator: MergeOperatorAppend, operand: []byte("x")},
+	})
+	if err != nil || string(value) != "12x" {
+		t.Fatalf("mergeApply ER! %q %v", value, err)
+	}
+
+	value, err = mergeApply(key, []byte(`["b"]`), []*mergeOperand{
+		{operator: MergeOperatorSetUnion, operand: []byte(`["c","a"]`)},
+		{operator: MergeOperatorSetUnion, operand: []byte(`["b"]`)},
+	})
+	if err != nil || string(value) != `["a","b","c"]` {
+		t.Fatalf("mergeApply ER! %q %v", value, err)
+	}
+
+	if _, err := mergeApply(key, nil, []*mergeOperand{
+		{operator: "not-found"},
+	}); err == nil {
+		t.Fatal("mergeApply ER! operator not found")
+	}
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatal(err)
 	}
+	defer db.Close()
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < 10000; i++ {
-		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
-			b.Fatalf("Commit ER!, %d Err %s", i, rs.Message)
-		}
+	cn := &Conn{
+		opts:   &Config{},
+		tables: map[string]*dbTable{},
+	}
+	cn.tables["main"] = &dbTable{
+		db:           db,
+		tableName:    "main",
+		incrSets:     map[string]*dbTableIncrSet{},
+		logAsyncSets: map[string]bool{},
+		logLockSets:  map[uint64]uint64{},
+	}
+	cn.opts.Feature.ImmutablePrefixes = []*ConfigImmutablePrefix{
+		{Table: "main", Prefix: "blob/"},
 	}
 
-	for i := 0; i < b.N; i++ {
-		if rs := dbs[0].NewReader([]byte(fmt.Sprintf("%032d", rand.Intn(1000)))).Query(); !rs.OK() {
-			b.Fatalf("Query ER!, Err %s", rs.Message)
+	if err := cn.Merge("main", []byte("blob/0a1b"), MergeOperatorAppend, []byte("x")); err != ErrImmutable {
+		t.Fatal("Merge ER! immutable prefix")
+	}
+	if err := cn.Merge("main", key, MergeOperatorAppend, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs := cn.Commit(AttrsSet(kv2.NewObjectWriter([]byte("k2"), "v").TableNameSet("main"),
+		AttrImmutable)); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+	if err := cn.Merge("main", []byte("k2"), MergeOperatorAppend, []byte("x")); err != ErrImmutable {
+		t.Fatal("Merge ER! immutable key")
+	}
+
+	// the operands of an unregistered operator fail on the fold of its key
+	// only, the other keys of the table are still folded
+	tdb := cn.tabledb("main")
+	db.Put(append(mergeKeyPrefix([]byte("k0")), uint64ToBytes(1)...),
+		mergeOperandEncode("unregistered", []byte("x")), nil)
+	if err := cn.workerLocalMergeRefreshTable(tdb); err != nil {
+		t.Fatal(err)
+	}
+	if ls, _ := tdb.mergeOperands(key); len(ls) != 0 {
+		t.Fatalf("Merge ER! fold %d", len(ls))
+	}
+	if ls, _ := tdb.mergeOperands([]byte("k0")); len(ls) != 1 {
+		t.Fatal("Merge ER! unregistered operator")
+	}
+
+	t.Log("Merge OK")
+}
+
+// testAppValidator allows all the permissions but the denied ones.
+type testAppValidator struct {
+	deny map[string]bool
+}
+
+func (it *testAppValidator) SignValid(b []byte) error {
+	return nil
+}
+
+func (it *testAppValidator) Allow(args ...interface{}) error {
+	if len(args) > 0 {
+		if perm, ok := args[0].(string); ok && it.deny[perm] {
+			return errors.New("access denied")
 		}
 	}
+	return nil
 }
 
-func Benchmark_Query_KeyRange(b *testing.B) {
+func Test_Procedure(t *testing.T) {
 
-	dbs, err := dbOpen(nil, false)
+	cfg := NewConfig(t.TempDir())
+	cfg.Feature.ImmutablePrefixes = []*ConfigImmutablePrefix{
+		{Table: "main", Prefix: "proc-imm/"},
+	}
+
+	cn, err := Open(cfg)
 	if err != nil {
-		b.Fatalf("Can Not Open Database %s", err.Error())
+		t.Fatal(err)
 	}
+	defer cn.Close()
 
-	bs := []byte(strings.Repeat("a", 1000))
-	for i := 0; i < 10000; i++ {
-		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
-			b.Fatalf("Commit Key ER! Err %s", rs.Message)
+	if rs := cn.SysCmd(kv2.NewSysCmdRequest("TableSet", &kv2.TableSetRequest{
+		Name: "proc_other",
+	})); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+
+	for k, v := range map[string]string{
+		"proc-a":     "10",
+		"proc-b":     "5",
+		"proc-imm/1": "v0",
+	} {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(k), v).TableNameSet("main")); !rs.OK() {
+			t.Fatal(rs.Message)
 		}
 	}
 
-	for i := 0; i < b.N; i++ {
-		offset := rand.Intn(10000 - 10)
-		if rs := dbs[0].NewReader(nil).KeyRangeSet(
-			[]byte(fmt.Sprintf("%032d", offset)),
-			[]byte(fmt.Sprintf("%032d", offset+10))).
-			LimitNumSet(10).Query(); !rs.OK() {
-			b.Fatalf("Query KeyRange ER!, Err %s", rs.Message)
+	get := func(key string) string {
+		rs := cn.NewReader([]byte(key)).TableNameSet("main").Query()
+		if rs.NotFound() {
+			return "<nil>"
+		} else if !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+		return rs.DataValue().String()
+	}
+
+	// moves the amount of args[0] from proc-a to proc-b, then runs the
+	// writes of the other args: "put:key", "del:key", "fail" or "table:key"
+	ProcedureRegister("proc_transfer", func(tx *Txn, args [][]byte) ([]byte, error) {
+		n, _ := strconv.Atoi(string(args[0]))
+		var vs [2]int
+		for i, k := range []string{"proc-a", "proc-b"} {
+			bs, err := tx.Get("main", []byte(k))
+			if err != nil {
+				return nil, err
+			}
+			vs[i], _ = strconv.Atoi(string(bs))
+		}
+		if err := tx.Put("main", []byte("proc-a"), []byte(strconv.Itoa(vs[0]-n))); err != nil {
+			return nil, err
+		}
+		if err := tx.Put("main", []byte("proc-b"), []byte(strconv.Itoa(vs[1]+n))); err != nil {
+			return nil, err
+		}
+		for _, arg := range args[1:] {
+			op, key := string(arg), ""
+			if i := strings.IndexByte(op, ':'); i > 0 {
+				op, key = op[:i], op[i+1:]
+			}
+			var err error
+			switch op {
+			case "put":
+				err = tx.Put("main", []byte(key), []byte("1"))
+			case "del":
+				if err = tx.Delete("main", []byte(key)); err == nil {
+					if _, err = tx.Get("main", []byte(key)); err == ErrNotFound {
+						err = nil
+					} else {
+						err = errors.New("deleted key read")
+					}
+				}
+			case "table":
+				err = tx.Put("proc_other", []byte(key), []byte("1"))
+			case "fail":
+				err = errors.New("procedure failed")
+			}
+			if err != nil {
+				return nil, err
+			}
 		}
+		bs, err := tx.Get("main", []byte("proc-a"))
+		return bs, err
+	})
+
+	ret, err := cn.ProcedureCall("proc_transfer", []byte("3"), []byte("put:proc-c"), []byte("del:proc-b2"))
+	if err != nil || string(ret) != "7" {
+		t.Fatalf("procedure ER! %q %v", ret, err)
+	}
+	if get("proc-a") != "7" || get("proc-b") != "8" || get("proc-c") != "1" {
+		t.Fatal("procedure ER! writes not committed")
+	}
+
+	// the errors of the procedures and of the writes discard all the writes
+	for _, args := range [][]string{
+		{"4", "put:proc-d", "fail"},
+		{"4", "put:proc-d", "put:proc-imm/1"},
+		{"4", "put:proc-d", "table:proc-d"},
+		{"4", "put:proc-d", "del:proc-c", "put:"},
+	} {
+		var bs [][]byte
+		for _, v := range args {
+			bs = append(bs, []byte(v))
+		}
+		if _, err := cn.ProcedureCall("proc_transfer", bs...); err == nil {
+			t.Fatalf("procedure ER! %v not failed", args)
+		}
+		if get("proc-a") != "7" || get("proc-b") != "8" || get("proc-c") != "1" ||
+			get("proc-d") != "<nil>" || get("proc-imm/1") != "v0" {
+			t.Fatalf("procedure ER! %v partially committed", args)
+		}
+	}
+
+	if _, err := cn.ProcedureCall("proc_none"); err == nil {
+		t.Fatal("procedure ER! unknown procedure")
+	}
+
+	// the writes of the sys table and of the internal keys need the sys/all
+	// permission of the caller
+	ProcedureRegister("proc_put", func(tx *Txn, args [][]byte) ([]byte, error) {
+		return nil, tx.Put(string(args[0]), args[1], []byte("1"))
+	})
+	av := &testAppValidator{deny: map[string]bool{authPermSysAll: true}}
+	for _, args := range [][][]byte{
+		{[]byte("sys"), []byte("proc-sys")},
+		{[]byte("main"), keyInternalEncode("proc")},
+	} {
+		if _, err := cn.procedureCallLocal(av, "proc_put", args); err == nil {
+			t.Fatalf("procedure ER! %s/%q written without sys/all", args[0], args[1])
+		}
+	}
+	if _, err := cn.procedureCallLocal(av, "proc_put", [][]byte{[]byte("main"), []byte("proc-e")}); err != nil ||
+		get("proc-e") != "1" {
+		t.Fatalf("procedure ER! %v", err)
+	}
+}
+
+func Test_ScriptEval(t *testing.T) {
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for k, v := range map[string]string{
+		"script-a": "10",
+		"script-b": "5",
+	} {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(k), v).TableNameSet("main")); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+
+	get := func(key string) string {
+		rs := cn.NewReader([]byte(key)).TableNameSet("main").Query()
+		if rs.NotFound() {
+			return "<nil>"
+		} else if !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+		return rs.DataValue().String()
+	}
+
+	// moves the amount of ARGV[1] from script-a to script-b, deletes
+	// script-c and fails after the writes if ARGV[2] is set
+	transfer := []byte(`
+local n = tonumber(ARGV[1])
+local a = tonumber(kv.get("main", "script-a"))
+local b = tonumber(kv.get("main", "script-b"))
+kv.put("main", "script-a", tostring(a - n))
+kv.put("main", "script-b", tostring(b + n))
+kv.del("main", "script-c")
+if kv.get("main", "script-c") ~= nil then
+	error("deleted key read")
+end
+if ARGV[2] then
+	error(ARGV[2])
+end
+return kv.get("main", "script-a")
+`)
+
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("script-c"), "1").TableNameSet("main")); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+
+	ret, err := cn.ScriptEval(ScriptLua, transfer, []byte("3"))
+	if err != nil || string(ret) != "7" {
+		t.Fatalf("script ER! %q %v", ret, err)
+	}
+	if get("script-a") != "7" || get("script-b") != "8" || get("script-c") != "<nil>" {
+		t.Fatal("script ER! writes not committed")
+	}
+
+	// the errors of the scripts discard all the writes
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("script-c"), "1").TableNameSet("main")); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+	if _, err := cn.ScriptEval(ScriptLua, transfer, []byte("3"), []byte("script failed")); err == nil ||
+		!strings.Contains(err.Error(), "script failed") {
+		t.Fatalf("script ER! %v", err)
+	}
+	if get("script-a") != "7" || get("script-b") != "8" || get("script-c") != "1" {
+		t.Fatal("script ER! failed script partially committed")
+	}
+
+	for _, v := range []struct {
+		script string
+		ret    string
+	}{
+		{`return kv.get("main", "script-none")`, ""},
+		{`return 1 + 2`, "3"},
+		{`return #ARGV == 0`, "true"},
+		{`local t = {} table.insert(t, "x") return string.upper(t[1])`, "X"},
+	} {
+		if ret, err := cn.ScriptEval(ScriptLua, []byte(v.script)); err != nil || string(ret) != v.ret {
+			t.Fatalf("script ER! %s : %q %v", v.script, ret, err)
+		}
+	}
+
+	for _, v := range []struct {
+		lang   string
+		script []byte
+	}{
+		{"none", []byte(`return 1`)},
+		{ScriptLua, nil},
+		{ScriptLua, make([]byte, scriptSizeMax+1)},
+		{ScriptLua, []byte(`return (`)},
+		{ScriptLua, []byte(`return {}`)},
+		{ScriptLua, []byte(`return dofile("/etc/passwd")`)},
+		{ScriptLua, []byte(`return os.time()`)},
+		{ScriptLua, []byte(`kv.put("main", "script-d")`)},
+	} {
+		if _, err := cn.ScriptEval(v.lang, v.script); err == nil {
+			t.Fatalf("script ER! %s : %.32q not failed", v.lang, v.script)
+		}
+	}
+	if get("script-d") != "<nil>" {
+		t.Fatal("script ER! invalid put committed")
+	}
+
+	args := make([][]byte, scriptArgsMax+1)
+	if _, err := cn.ScriptEval(ScriptLua, []byte(`return 1`), args...); err == nil {
+		t.Fatal("script ER! too many args")
+	}
+
+	// the scripts of the clients are run by the sys cmd of the server
+	bs, _ := json.Marshal(&scriptEvalRequest{
+		Lang:   ScriptLua,
+		Script: []byte(`kv.put("main", ARGV[1], "1") return "ok"`),
+		Args:   [][]byte{[]byte("script-e")},
+	})
+	if rs := cn.scriptCmdLocal(nil, bs); !rs.OK() || rs.DataValue().String() != "ok" ||
+		get("script-e") != "1" {
+		t.Fatalf("script ER! sys cmd %s", rs.Message)
+	}
+}
+
+func Test_ConflictResolve(t *testing.T) {
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+	cn.opts.Cluster.ConflictPolicy = ConflictKeepBoth
+
+	var (
+		local = &kv2.ObjectItem{
+			Meta: &kv2.ObjectMeta{Key: []byte("k1"), Version: 100 << hlcLogicalBits, DataCheck: 2},
+		}
+		remote = &kv2.ObjectItem{
+			Meta: &kv2.ObjectMeta{Key: []byte("k1"), Version: 200 << hlcLogicalBits, DataCheck: 1},
+		}
+	)
+
+	if keep, sibling, err := cn.conflictResolve("main", local, remote); err != nil ||
+		keep != remote || sibling != local {
+		t.Fatal("conflictResolve ER! keep-both")
+	}
+
+	if keep, sibling, _ := cn.conflictResolve("main", remote, local); keep != remote || sibling != local {
+		t.Fatal("conflictResolve ER! older remote")
+	}
+
+	cn.ConflictResolverRegister([]byte("k"), func(tableName string, local, remote *kv2.ObjectItem) (*kv2.ObjectItem, error) {
+		return local, nil
+	})
+
+	if keep, sibling, _ := cn.conflictResolve("main", local, remote); keep != local || sibling != nil {
+		t.Fatal("conflictResolve ER! resolver")
+	}
+
+	t.Log("ConflictResolve OK")
+}
+
+func Test_Sibling(t *testing.T) {
+
+	cfg := NewConfig(t.TempDir())
+	cfg.Cluster.ConflictPolicy = ConflictKeepBoth
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	key := []byte("sibling-1")
+
+	if rs := cn.Commit(kv2.NewObjectWriter(key, "local").TableNameSet("main")); !rs.OK() {
+		t.Fatalf("sibling ER! %s", rs.Message)
+	}
+
+	get := func() *kv2.ObjectItem {
+		rs := cn.Query(kv2.NewObjectReader(key).TableNameSet("main"))
+		if !rs.OK() || len(rs.Items) == 0 {
+			t.Fatalf("sibling ER! %s", rs.Message)
+		}
+		return rs.Items[0]
+	}
+
+	// the concurrent writes of the other sites, one newer and one older
+	// than the local version
+	remote := func(value string, version uint64) *kv2.ObjectItem {
+		item := &kv2.ObjectItem{
+			Meta: &kv2.ObjectMeta{
+				Key:     key,
+				Version: version,
+				Updated: version >> hlcLogicalBits,
+			},
+		}
+		item.DataValueSet(value, nil)
+		return item
+	}
+
+	local := get()
+
+	if ls, err := cn.SiblingList("main", key); err != nil || len(ls) != 0 {
+		t.Fatalf("sibling ER! list before conflicts %d %v", len(ls), err)
+	}
+
+	if err := cn.replicaApply("main", remote("remote-newer", hlcNow()+(10<<hlcLogicalBits))); err != nil {
+		t.Fatalf("sibling ER! %s", err.Error())
+	}
+	if v := get().DataValue().String(); v != "remote-newer" {
+		t.Fatalf("sibling ER! newer remote not kept %s", v)
+	}
+
+	if err := cn.replicaApply("main", remote("remote-older", local.Meta.Version-(10<<hlcLogicalBits))); err != nil {
+		t.Fatalf("sibling ER! %s", err.Error())
+	}
+	if v := get().DataValue().String(); v != "remote-newer" {
+		t.Fatalf("sibling ER! older remote kept %s", v)
+	}
+
+	ls, err := cn.SiblingList("main", key)
+	if err != nil || len(ls) != 2 {
+		t.Fatalf("sibling ER! list %d %v", len(ls), err)
+	}
+	values := map[string]bool{}
+	for _, v := range ls {
+		if !bytes.Equal(v.Meta.Key, key) {
+			t.Fatalf("sibling ER! key %s", string(v.Meta.Key))
+		}
+		values[v.DataValue().String()] = true
+	}
+	if !values["local"] || !values["remote-older"] {
+		t.Fatalf("sibling ER! values %v", values)
+	}
+
+	// the siblings of the other keys are not listed
+	if ls, _ := cn.SiblingList("main", []byte("sibling-10")); len(ls) != 0 {
+		t.Fatal("sibling ER! list of other key")
+	}
+
+	// the reader resolves the siblings and clears them
+	if err := cn.SiblingClear("main", key); err != nil {
+		t.Fatalf("sibling ER! clear %s", err.Error())
+	}
+	if ls, err := cn.SiblingList("main", key); err != nil || len(ls) != 0 {
+		t.Fatalf("sibling ER! list after clear %d %v", len(ls), err)
+	}
+	if v := get().DataValue().String(); v != "remote-newer" {
+		t.Fatalf("sibling ER! value after clear %s", v)
+	}
+
+	// the same versions are not conflicts
+	if err := cn.replicaApply("main", get()); err != nil {
+		t.Fatalf("sibling ER! %s", err.Error())
+	}
+	if ls, _ := cn.SiblingList("main", key); len(ls) != 0 {
+		t.Fatal("sibling ER! sibling of the same version")
+	}
+}
+
+func Test_HLC(t *testing.T) {
+
+	tn := time.Now()
+
+	if d := VersionTime(hlcNow()).Sub(tn); d < -time.Second || d > time.Second {
+		t.Fatalf("VersionTime ER! %v", d)
+	}
+
+	if VersionTime(hlcNow()+1).UnixNano()/1e6 < tn.UnixNano()/1e6 {
+		t.Fatal("VersionTime ER! logical")
+	}
+
+	t.Log("HLC OK")
+}
+
+func Test_HistoryKey(t *testing.T) {
+
+	keys := [][]byte{
+		[]byte("a"),
+		[]byte("a\x00"),
+		[]byte("a\x00b"),
+		[]byte("a\x01"),
+		[]byte("ab"),
+	}
+
+	var prev []byte
+	for _, k := range keys {
+
+		hk := historyKeyEncode(k, 1<<40)
+		if bytes.Compare(prev, hk) >= 0 {
+			t.Fatalf("historyKeyEncode ER! order %q", k)
+		}
+		prev = historyKeyEncode(k, ^uint64(0))
+
+		key, version, err := historyKeyDecode(hk)
+		if err != nil || !bytes.Equal(key, k) || version != 1<<40 {
+			t.Fatalf("historyKeyDecode ER! %q %v", key, err)
+		}
+	}
+
+	t.Log("HistoryKey OK")
+}
+
+func Test_HistoryAsOf(t *testing.T) {
+
+	cfg := NewConfig(t.TempDir())
+	cfg.Feature.HistoryRetentionTime = 3600
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	// the times between the writes, the versions are allocated in ms
+	tick := func() time.Time {
+		time.Sleep(3 * time.Millisecond)
+		ts := time.Now()
+		time.Sleep(3 * time.Millisecond)
+		return ts
+	}
+
+	put := func(key, value string) {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(key), value)); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+	del := func(key string) {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(key), nil).ModeDeleteSet(true)); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+
+	var ts []time.Time
+
+	ts = append(ts, tick()) // 0: before the first version
+	put("asof-a", "a1")
+	put("asof-b", "b1")
+	ts = append(ts, tick()) // 1
+	put("asof-a", "a2")
+	put("asof-c", "c1")
+	ts = append(ts, tick()) // 2
+	del("asof-a")
+	put("asof-b", "b2")
+	ts = append(ts, tick()) // 3: after the delete
+	put("asof-a", "a3")
+	ts = append(ts, tick()) // 4
+
+	for _, v := range []struct {
+		key   string
+		value []string
+	}{
+		{"asof-a", []string{"", "a1", "a2", "", "a3"}},
+		{"asof-b", []string{"", "b1", "b1", "b2", "b2"}},
+		{"asof-c", []string{"", "", "c1", "c1", "c1"}},
+	} {
+		for i, value := range v.value {
+			rs := cn.GetAsOf("main", []byte(v.key), ts[i])
+			if value == "" {
+				if !rs.NotFound() {
+					t.Fatalf("GetAsOf ER! %s at %d found %s", v.key, i, rs.DataValue().String())
+				}
+			} else if !rs.OK() || rs.DataValue().String() != value {
+				t.Fatalf("GetAsOf ER! %s at %d %s, %s", v.key, i, rs.DataValue().String(), rs.Message)
+			}
+		}
+	}
+
+	for i, values := range []string{
+		"",
+		"a1,b1",
+		"a2,b1,c1",
+		"b2,c1",
+		"a3,b2,c1",
+	} {
+		rs := cn.ScanAsOf("main", []byte("asof-"), []byte("asof-z"), ts[i], 10)
+		if !rs.OK() {
+			t.Fatalf("ScanAsOf ER! %s", rs.Message)
+		}
+		var vs []string
+		for _, item := range rs.Items {
+			vs = append(vs, item.DataValue().String())
+		}
+		if strings.Join(vs, ",") != values {
+			t.Fatalf("ScanAsOf ER! at %d %v", i, vs)
+		}
+	}
+
+	// the limit and the offset of the range
+	if rs := cn.ScanAsOf("main", []byte("asof-a"), []byte("asof-z"), ts[2], 1); !rs.OK() ||
+		len(rs.Items) != 1 || rs.DataValue().String() != "b1" || !rs.Next {
+		t.Fatalf("ScanAsOf ER! limit %s", rs.Message)
+	}
+
+	// out of the retention window
+	if rs := cn.GetAsOf("main", []byte("asof-a"), time.Now().Add(-2*time.Hour)); rs.OK() {
+		t.Fatal("GetAsOf ER! out of the history retention")
+	}
+
+	t.Log("HistoryAsOf OK")
+}
+
+func Test_ArchiveVersions(t *testing.T) {
+
+	cfg := NewConfig(t.TempDir())
+	cfg.Feature.HistoryRetentionTime = 3600
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	commit := func(ow *kv2.ObjectWriter) {
+		if rs := cn.Commit(ow); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+
+	for _, v := range []string{"a1", "a2", "a3"} {
+		commit(kv2.NewObjectWriter([]byte("arch-a"), v))
+	}
+	commit(kv2.NewObjectWriter([]byte("arch-b"), "b1"))
+	commit(kv2.NewObjectWriter([]byte("arch-b"), nil).ModeDeleteSet(true))
+	commit(kv2.NewObjectWriter([]byte("arch-c"), "c1"))
+	commit(kv2.NewObjectWriter([]byte("other"), "x1"))
+
+	var buf bytes.Buffer
+	n, err := cn.ArchiveVersions("main", []byte("arch-"), &buf)
+	if err != nil {
+		t.Fatalf("archive versions ER! %s", err.Error())
+	}
+
+	type version struct {
+		key, value       string
+		deleted, current bool
+	}
+
+	var (
+		ls   []version
+		prev = map[string]uint64{}
+		dec  = json.NewDecoder(&buf)
+	)
+	for dec.More() {
+		var v HistoryVersion
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("archive versions ER! decode %s", err.Error())
+		}
+		if v.Version <= prev[string(v.Key)] {
+			t.Fatalf("archive versions ER! order of %s", string(v.Key))
+		}
+		prev[string(v.Key)] = v.Version
+		if v.Time != VersionTime(v.Version).UnixNano()/1e6 {
+			t.Fatalf("archive versions ER! time %d", v.Time)
+		}
+		item := version{
+			key:     string(v.Key),
+			deleted: v.Deleted,
+			current: v.Current,
+		}
+		if !v.Deleted {
+			it, err := kv2.ObjectItemDecode(v.Item)
+			if err != nil || it.Meta == nil || it.Meta.Version != v.Version {
+				t.Fatalf("archive versions ER! item of %s", string(v.Key))
+			}
+			item.value = it.DataValue().String()
+		}
+		ls = append(ls, item)
+	}
+
+	// the old versions are archived with the current ones, the keys out of
+	// the prefix are not
+	want := []version{
+		{key: "arch-a", value: "a1"},
+		{key: "arch-a", value: "a2"},
+		{key: "arch-a", value: "a3", current: true},
+		{key: "arch-b", value: "b1"},
+		{key: "arch-b", deleted: true},
+		{key: "arch-c", value: "c1", current: true},
+	}
+	if n != int64(len(want)) || len(ls) != len(want) {
+		t.Fatalf("archive versions ER! num %d/%d, want %d", n, len(ls), len(want))
+	}
+	for i, v := range want {
+		if ls[i] != v {
+			t.Fatalf("archive versions ER! #%d %v, want %v", i, ls[i], v)
+		}
+	}
+
+	// the current versions are still readable after the archive
+	if rs := cn.Query(kv2.NewObjectReader([]byte("arch-a"))); !rs.OK() ||
+		rs.DataValue().String() != "a3" {
+		t.Fatal("archive versions ER! current version")
+	}
+
+	buf.Reset()
+	if n, err := cn.ArchiveVersions("main", []byte("none-"), &buf); err != nil || n != 0 || buf.Len() != 0 {
+		t.Fatal("archive versions ER! empty prefix")
+	}
+	if _, err := cn.ArchiveVersions("none", nil, &buf); err == nil {
+		t.Fatal("archive versions ER! table not found")
+	}
+}
+
+func Test_Checkpoint(t *testing.T) {
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for i := 0; i < 100; i++ {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(fmt.Sprintf("cp-%03d", i)), "v1").
+			TableNameSet("main")); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+	cn.tabledb("main").db.CompactRange(util.Range{})
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("cp-journal"), "v1").TableNameSet("main")); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+
+	if _, err := cn.CreateCheckpoint("../cp"); err == nil {
+		t.Fatal("checkpoint, invalid name")
+	}
+
+	cp, err := cn.CreateCheckpoint("cp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cn.CreateCheckpoint("cp1"); err == nil {
+		t.Fatal("checkpoint, created twice")
+	}
+
+	// the writes after the checkpoint are not in it
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("cp-000"), "v2").TableNameSet("main")); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("cp-new"), "v2").TableNameSet("main")); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+
+	if ls, err := cn.ListCheckpoints(); err != nil || len(ls) != 1 ||
+		ls[0].Name != "cp1" || ls[0].Path != cp.Path {
+		t.Fatal("checkpoint, list")
+	}
+
+	// the checkpoint is opened as a data directory
+	cn2, err := Open(NewConfig(cp.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"cp-000": "v1", "cp-099": "v1", "cp-journal": "v1"} {
+		if rs := cn2.NewReader([]byte(k)).TableNameSet("main").Query(); !rs.OK() ||
+			rs.DataValue().String() != v {
+			cn2.Close()
+			t.Fatalf("checkpoint, %s not restored", k)
+		}
+	}
+	if rs := cn2.NewReader([]byte("cp-new")).TableNameSet("main").Query(); !rs.NotFound() {
+		cn2.Close()
+		t.Fatal("checkpoint, write after the checkpoint")
+	}
+	cn2.Close()
+
+	if err := cn.DropCheckpoint("cp1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cn.DropCheckpoint("cp1"); err == nil {
+		t.Fatal("checkpoint, dropped twice")
+	}
+	if ls, err := cn.ListCheckpoints(); err != nil || len(ls) != 0 {
+		t.Fatal("checkpoint, list after drop")
+	}
+}
+
+func Test_Secondary(t *testing.T) {
+
+	cfg := NewConfig(t.TempDir())
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	put := func(table, key, value string) {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(key), value).TableNameSet(table)); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+
+	put("main", "sec-1", "v1")
+	cn.tabledb("main").db.CompactRange(util.Range{})
+	put("main", "sec-2", "v1")
+
+	if _, err := OpenSecondary(cfg.Storage, ConfigSecondary{Directory: cfg.Storage.DataDirectory}); err == nil {
+		t.Fatal("secondary, the directory of the primary")
+	}
+
+	sec, err := OpenSecondary(cfg.Storage, ConfigSecondary{
+		Directory:       t.TempDir(),
+		CatchUpInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sec.Close()
+
+	get := func(table, key string) string {
+		rs := sec.NewReader([]byte(key)).TableNameSet(table).Query()
+		if rs.NotFound() {
+			return "<nil>"
+		} else if !rs.OK() {
+			t.Fatalf("secondary, query %s", rs.Message)
+		}
+		return rs.DataValue().String()
+	}
+
+	// the table files and the journals of the primary are both read
+	if get("main", "sec-1") != "v1" || get("main", "sec-2") != "v1" {
+		t.Fatal("secondary, writes of the primary not read")
+	}
+
+	// the writes after the open are read after the catch-up
+	put("main", "sec-1", "v2")
+	put("main", "sec-3", "v1")
+	if rs := cn.SysCmd(kv2.NewSysCmdRequest("TableSet", &kv2.TableSetRequest{
+		Name: "sec_t2",
+	})); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+	put("sec_t2", "sec-1", "t2")
+
+	if get("main", "sec-1") != "v1" || get("main", "sec-3") != "<nil>" {
+		t.Fatal("secondary, writes read before the catch-up")
+	}
+
+	if err := sec.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	if get("main", "sec-1") != "v2" || get("main", "sec-3") != "v1" ||
+		get("sec_t2", "sec-1") != "t2" {
+		t.Fatal("secondary, writes of the primary not read after the catch-up")
+	}
+
+	// the writes are refused
+	if rs := sec.Commit(kv2.NewObjectWriter([]byte("sec-4"), "v1")); rs.OK() {
+		t.Fatal("secondary, write not refused")
+	}
+	if rs := sec.BatchCommit(&kv2.BatchRequest{
+		Items: []*kv2.BatchItem{{Writer: kv2.NewObjectWriter([]byte("sec-4"), "v1")}},
+	}); rs.OK() {
+		t.Fatal("secondary, batch write not refused")
+	}
+	if rs := sec.SysCmd(kv2.NewSysCmdRequest("TableSet", &kv2.TableSetRequest{
+		Name: "sec_t3",
+	})); rs.OK() {
+		t.Fatal("secondary, sys cmd not refused")
+	}
+	if get("main", "sec-4") != "<nil>" {
+		t.Fatal("secondary, write committed")
+	}
+	if rs := cn.NewReader([]byte("sec-4")).Query(); !rs.NotFound() {
+		t.Fatal("secondary, write committed to the primary")
+	}
+
+	if err := sec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rs := sec.NewReader([]byte("sec-1")).Query(); rs.OK() {
+		t.Fatal("secondary, read after close")
+	}
+}
+
+func Test_Backup(t *testing.T) {
+
+	var (
+		root = t.TempDir()
+		dir  = filepath.Join(root, "backup")
+		cfg  = NewConfig(filepath.Join(root, "data"))
+	)
+	cfg.Backup.Compress = BackupCompressGzip
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	commit := func(from, to int) {
+		for i := from; i < to; i++ {
+			if rs := cn.Commit(kv2.NewObjectWriter([]byte(fmt.Sprintf("bk-%03d", i)), i).
+				TableNameSet("main")); !rs.OK() {
+				t.Fatal(rs.Message)
+			}
+		}
+	}
+
+	commit(0, 100)
+	cn.tabledb("main").db.CompactRange(util.Range{})
+
+	m1, err := cn.Backup(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.Base != "" {
+		t.Fatal("backup, base of the first backup")
+	}
+
+	// the unchanged table files are referenced to the base backup
+	commit(100, 200)
+	time.Sleep(2e6)
+
+	m2, err := cn.Backup(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Base != m1.Id {
+		t.Fatalf("backup, base %s", m2.Base)
+	}
+	tables := 0
+	for _, v := range m2.Files {
+		if filepath.Ext(v.Path) == ".ldb" {
+			if v.Backup != m1.Id {
+				t.Fatalf("backup, table file %s copied again", v.Path)
+			}
+			tables += 1
+		}
+	}
+	if tables == 0 {
+		t.Fatal("backup, no table files")
+	}
+
+	if ids, err := BackupList(dir); err != nil || len(ids) != 2 ||
+		ids[0] != m1.Id || ids[1] != m2.Id {
+		t.Fatalf("backup, list %v", ids)
+	}
+
+	// the full backups copy all files
+	time.Sleep(2e6)
+	m3, err := cn.Backup(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range m3.Files {
+		if v.Backup != m3.Id {
+			t.Fatalf("backup, file %s of full backup referenced", v.Path)
+		}
+	}
+
+	// the incremental backup is restored with the files of its base
+	restore := filepath.Join(root, "restore")
+	if err := BackupRestore(dir, m2.Id, restore, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := BackupRestore(dir, m2.Id, restore, ""); err == nil {
+		t.Fatal("backup, restore into not empty directory")
+	}
+
+	cn2, err := Open(NewConfig(restore))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn2.Close()
+
+	for _, i := range []int{0, 99, 100, 199} {
+		if rs := cn2.NewReader([]byte(fmt.Sprintf("bk-%03d", i))).TableNameSet("main").Query(); !rs.OK() ||
+			rs.DataValue().Int() != i {
+			t.Fatalf("backup, bk-%03d not restored", i)
+		}
+	}
+}
+
+func Test_BackupVerify(t *testing.T) {
+
+	var (
+		root = t.TempDir()
+		dir  = filepath.Join(root, "backup")
+	)
+
+	cn, err := Open(NewConfig(filepath.Join(root, "data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for i := 0; i < 100; i++ {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(fmt.Sprintf("bv-%03d", i)), i).
+			TableNameSet("main")); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+	cn.tabledb("main").db.CompactRange(util.Range{})
+
+	m1, err := cn.Backup(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2e6)
+	m2, err := cn.Backup(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2e6)
+	m3, err := cn.Backup(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records of the tables are counted
+	records := map[string]int64{}
+	for _, v := range m3.Tables {
+		records[v.Dir] = v.Records
+	}
+	if n := records[tableDirName(cn.tabledb("main"))]; n != 100 {
+		t.Fatalf("backup verify, records %d", n)
+	}
+
+	for _, id := range []string{m1.Id, m2.Id, m3.Id} {
+		if err := VerifyBackup(dir, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := VerifyBackup(dir, "none"); err == nil {
+		t.Fatal("backup verify, backup not found")
+	}
+
+	// the corrupted files of the base backups fail the backups referencing
+	// them, by the checksums or the sizes
+	var file *BackupFile
+	for _, v := range m2.Files {
+		if filepath.Ext(v.Path) == ".ldb" && v.Backup == m1.Id {
+			file = v
+		}
+	}
+	if file == nil {
+		t.Fatal("backup verify, no table file referenced")
+	}
+	path := filepath.Join(dir, file.Backup, file.Path)
+	bs, _ := ioutil.ReadFile(path)
+
+	bs2 := append([]byte{}, bs...)
+	bs2[len(bs2)/2] ^= 0xff
+	ioutil.WriteFile(path, bs2, 0640)
+	if err := VerifyBackup(dir, m2.Id); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("backup verify, checksum %v", err)
+	}
+	if err := BackupRestore(dir, m2.Id, filepath.Join(root, "restore-1"), ""); err == nil {
+		t.Fatal("backup verify, restore of corrupted backup")
+	}
+
+	ioutil.WriteFile(path, bs[:len(bs)-1], 0640)
+	if err := VerifyBackup(dir, m2.Id); err == nil || !strings.Contains(err.Error(), "size") {
+		t.Fatalf("backup verify, size %v", err)
+	}
+
+	// the full backup holds its own files, the restored records are checked
+	if err := VerifyBackup(dir, m3.Id); err != nil {
+		t.Fatal(err)
+	}
+	m3.Tables[0].Records += 1
+	bs, _ = json.Marshal(m3)
+	ioutil.WriteFile(filepath.Join(dir, m3.Id, backupManifestName), bs, 0640)
+	if err := BackupRestore(dir, m3.Id, filepath.Join(root, "restore-2"), ""); err == nil ||
+		!strings.Contains(err.Error(), "records") {
+		t.Fatalf("backup verify, records %v", err)
+	}
+}
+
+func Test_BackupCrypt(t *testing.T) {
+
+	aead, err := backupEncryptKey(strings.Repeat("0f", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		data = make([]byte, backupCryptChunkSize*2+100)
+		buf  bytes.Buffer
+	)
+	rand.Read(data)
+
+	w, err := newBackupCryptWriter(&buf, aead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+
+	read := func(bs []byte) ([]byte, error) {
+		r, err := newBackupCryptReader(bytes.NewReader(bs), aead)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		_, err = out.ReadFrom(r)
+		return out.Bytes(), err
+	}
+
+	if out, err := read(buf.Bytes()); err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("backupCryptReader ER! %v", err)
+	}
+
+	if _, err := read(buf.Bytes()[:buf.Len()-100]); err == nil {
+		t.Fatal("backupCryptReader ER! truncated")
+	}
+
+	t.Log("BackupCrypt OK")
+}
+
+func Test_BackupCron(t *testing.T) {
+
+	cs, err := cronParse("*/15 2 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		t     time.Time
+		match bool
+	}{
+		{time.Date(2024, 1, 1, 2, 30, 0, 0, time.Local), true},  // monday
+		{time.Date(2024, 1, 1, 2, 31, 0, 0, time.Local), false}, // minute
+		{time.Date(2024, 1, 7, 2, 30, 0, 0, time.Local), false}, // sunday
+	} {
+		if cs.match(v.t) != v.match {
+			t.Fatalf("cronSchedule.match ER! %v", v.t)
+		}
+	}
+
+	for _, v := range []string{"* * *", "60 * * * *", "* * * * 8", "a * * * *"} {
+		if _, err := cronParse(v); err == nil {
+			t.Fatalf("cronParse ER! %s", v)
+		}
+	}
+
+	t.Log("BackupCron OK")
+}
+
+func Test_BackupSchedule(t *testing.T) {
+
+	var (
+		dir = t.TempDir()
+		cfg = NewConfig(filepath.Join(dir, "data"))
+	)
+	cfg.Backup.Schedules = []*ConfigBackupSchedule{{
+		Name:      "daily",
+		Cron:      "0 2 * * *",
+		Directory: filepath.Join(dir, "daily"),
+	}}
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for i := 0; i < 10; i++ {
+		cn.Commit(kv2.NewObjectWriter([]byte(fmt.Sprintf("sched-%d", i)), "1").TableNameSet("main"))
+	}
+
+	list := func() map[string]*BackupScheduleStatus {
+		ls, err := cn.BackupScheduleList()
+		if err != nil {
+			t.Fatalf("backup schedule ER! list %s", err.Error())
+		}
+		sets := map[string]*BackupScheduleStatus{}
+		for i, v := range ls {
+			if i > 0 && ls[i-1].Name >= v.Name {
+				t.Fatal("backup schedule ER! list order")
+			}
+			sets[v.Name] = v
+		}
+		return sets
+	}
+
+	if ls := list(); len(ls) != 1 || ls["daily"] == nil {
+		t.Fatalf("backup schedule ER! list of config %d", len(ls))
+	}
+
+	for _, v := range []*ConfigBackupSchedule{
+		{Name: "a b", Cron: "* * * * *", Directory: dir},
+		{Name: "hourly", Cron: "* * *", Directory: dir},
+		{Name: "hourly", Cron: "* * * * *"},
+		{Name: "hourly", Cron: "* * * * *", Directory: dir, KeepLast: -1},
+	} {
+		if err := cn.BackupScheduleSet(v); err == nil {
+			t.Fatalf("backup schedule ER! invalid set %v", v)
+		}
+	}
+
+	if err := cn.BackupScheduleSet(&ConfigBackupSchedule{
+		Name:      "hourly",
+		Cron:      "30 * * * *",
+		Directory: filepath.Join(dir, "hourly"),
+		KeepLast:  1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the schedule of the admin api overrides the one of the config
+	if err := cn.BackupScheduleSet(&ConfigBackupSchedule{
+		Name:      "daily",
+		Cron:      "0 3 * * *",
+		Directory: filepath.Join(dir, "daily-2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ls := list(); len(ls) != 2 || ls["hourly"] == nil ||
+		ls["daily"].Directory != filepath.Join(dir, "daily-2") {
+		t.Fatalf("backup schedule ER! list after set %d", len(ls))
+	}
+
+	wait := func(name string, lastRun int64) *BackupScheduleStatus {
+		for i := 0; i < 200; i++ {
+			if st := list()[name]; st != nil && st.LastRun > lastRun {
+				cn.backupSched.mu.Lock()
+				running := cn.backupSched.running
+				cn.backupSched.mu.Unlock()
+				if !running {
+					return st
+				}
+			}
+			time.Sleep(50e6)
+		}
+		t.Fatalf("backup schedule ER! %s not run", name)
+		return nil
+	}
+
+	// 03:30 matches the hourly schedule only
+	cn.backupScheduleTrigger(time.Date(2024, 1, 1, 3, 30, 0, 0, time.Local))
+
+	st := wait("hourly", 0)
+	if st.LastError != "" || st.LastId == "" {
+		t.Fatalf("backup schedule ER! run %s", st.LastError)
+	}
+	if st := list()["daily"]; st.LastRun != 0 {
+		t.Fatal("backup schedule ER! unmatched schedule run")
+	}
+	if err := VerifyBackup(filepath.Join(dir, "hourly"), st.LastId); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2e6)
+	cn.backupScheduleTrigger(time.Date(2024, 1, 1, 4, 30, 0, 0, time.Local))
+
+	st2 := wait("hourly", st.LastRun)
+	if st2.LastError != "" || st2.LastId == st.LastId {
+		t.Fatalf("backup schedule ER! second run %s", st2.LastError)
+	}
+
+	// the old backup is removed by the retention
+	if ids, err := BackupList(filepath.Join(dir, "hourly")); err != nil ||
+		len(ids) != 1 || ids[0] != st2.LastId {
+		t.Fatalf("backup schedule ER! retention %v %v", ids, err)
+	}
+
+	// the run is skipped while another backup is running
+	cn.backupSched.mu.Lock()
+	cn.backupSched.running = true
+	cn.backupSched.mu.Unlock()
+
+	cn.backupScheduleTrigger(time.Date(2024, 1, 1, 3, 0, 0, 0, time.Local))
+	time.Sleep(100e6)
+	if st := list()["daily"]; st.LastRun != 0 {
+		t.Fatal("backup schedule ER! run while running")
+	}
+
+	cn.backupSched.mu.Lock()
+	cn.backupSched.running = false
+	cn.backupSched.mu.Unlock()
+
+	// the removed schedule of the admin api falls back to the config one
+	for _, name := range []string{"hourly", "daily"} {
+		if err := cn.BackupScheduleDel(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ls := list(); len(ls) != 1 || ls["daily"].Directory != filepath.Join(dir, "daily") {
+		t.Fatalf("backup schedule ER! list after del %d", len(ls))
+	}
+
+	if rs := cn.backupScheduleCmdLocal(nil, "BackupScheduleList", nil); !rs.OK() {
+		t.Fatalf("backup schedule ER! sys cmd %s", rs.Message)
+	} else {
+		var ls []*BackupScheduleStatus
+		if err := json.Unmarshal(rs.DataValue().Bytes(), &ls); err != nil ||
+			len(ls) != 1 || ls[0].Name != "daily" {
+			t.Fatalf("backup schedule ER! sys cmd list %v", err)
+		}
+	}
+}
+
+func Test_ClusterStatusLag(t *testing.T) {
+
+	var (
+		tn    = hlcNow()
+		peers = []*nodeStatusResult{
+			{Addr: "a", Offsets: map[string]uint64{"main": tn}},
+			{Addr: "b", Offsets: map[string]uint64{"main": tn - (1500 << hlcLogicalBits)}},
+		}
+		node = &nodeStatusResult{
+			Addr: "c",
+			Pulled: map[string]map[string]uint64{
+				"a": {"main": tn - (200 << hlcLogicalBits)},
+				"b": {"main": tn},
+			},
+		}
+	)
+
+	if lag := nodeStatusLag(node, peers); lag != 200 {
+		t.Fatalf("nodeStatusLag ER! %d", lag)
+	}
+
+	if lag := nodeStatusLag(peers[0], peers); lag != 0 {
+		t.Fatalf("nodeStatusLag ER! not pulled %d", lag)
+	}
+
+	t.Log("ClusterStatus Lag OK")
+}
+
+func Test_SystemdNotify(t *testing.T) {
+
+	sock := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", sock)
+
+	if err := SystemdNotify("READY=1"); err != nil {
+		t.Fatalf("SystemdNotify ER! %s", err.Error())
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("SystemdNotify ER! %q %v", buf[:n], err)
+	}
+
+	t.Log("SystemdNotify OK")
+}
+
+func Test_DirLock(t *testing.T) {
+
+	dir := t.TempDir()
+
+	l, err := dirLockAcquire(dir, false)
+	if err != nil {
+		t.Fatalf("dirLockAcquire ER! %s", err.Error())
+	}
+
+	if _, err := dirLockAcquire(dir, true); err == nil ||
+		!strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Fatalf("dirLockAcquire ER! locked %v", err)
+	}
+
+	l.Release()
+
+	l2, err := dirLockAcquire(dir, false)
+	if err != nil {
+		t.Fatalf("dirLockAcquire ER! released %s", err.Error())
+	}
+	l2.Release()
+
+	t.Log("DirLock OK")
+}
+
+func Test_DirLockForce(t *testing.T) {
+
+	// the pid of an exited process
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("dirLock force, no process spawned")
+	}
+	pid := cmd.Process.Pid
+
+	dir := t.TempDir()
+
+	// the lock left by the process, which is still held on the network
+	// filesystems
+	stale := func(pid int) *os.File {
+		f, err := os.OpenFile(filepath.Join(dir, dirLockFile), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fileLockTry(f); err != nil {
+			t.Fatalf("dirLock force ER! stale lock %s", err.Error())
+		}
+		f.Truncate(0)
+		f.WriteAt([]byte(fmt.Sprintf("%d\n", pid)), 0)
+		return f
+	}
+
+	f := stale(pid)
+	defer f.Close()
+
+	cfg := NewConfig(dir)
+
+	if _, err := Open(cfg); err == nil ||
+		!strings.Contains(err.Error(), fmt.Sprintf("pid %d", pid)) {
+		t.Fatalf("dirLock force ER! open without force %v", err)
+	}
+
+	cfg.Storage.ForceUnlock = true
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("dirLock force ER! open %s", err.Error())
+	}
+
+	if n := dirLockPid(filepath.Join(dir, dirLockFile)); n != os.Getpid() {
+		t.Fatalf("dirLock force ER! holder pid %d", n)
+	}
+
+	// the lock of the store is not removed by force
+	if _, err := dirLockAcquire(dir, true); err == nil {
+		t.Fatal("dirLock force ER! live lock removed")
+	}
+
+	cn.Close()
+
+	// the next locker succeeds after the store closed
+	l, err := dirLockAcquire(dir, false)
+	if err != nil {
+		t.Fatalf("dirLock force ER! after close %s", err.Error())
+	}
+	l.Release()
+
+	// the lock of a live process is not removed by force
+	f2 := stale(os.Getppid())
+	defer f2.Close()
+
+	if _, err := dirLockAcquire(dir, true); err == nil ||
+		!strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getppid())) {
+		t.Fatalf("dirLock force ER! live process %v", err)
+	}
+}
+
+func Test_WireGolden(t *testing.T) {
+
+	for _, v := range []struct {
+		value  interface{}
+		golden string
+	}{
+		{
+			&HandshakeInfo{Version: "1.0", Protocol: 2, ProtocolMin: 1, Features: []string{FeatureSnapshot}},
+			`{"version":"1.0","protocol":2,"protocol_min":1,"features":["snapshot"]}`,
+		},
+		{
+			&pubSubRequest{Id: "a1", Message: &PubSubMessage{Channel: "c", Data: []byte("hi")}, WaitTime: 3000},
+			`{"id":"a1","message":{"channel":"c","data":"aGk="},"wait_time":3000}`,
+		},
+		{
+			&snapshotResult{Id: "s1", LogOffset: 1 << 60, Items: [][]byte{{0x01}}, Next: true},
+			`{"id":"s1","log_offset":1152921504606846976,"items":["AQ=="],"next":true}`,
+		},
+		{
+			&replicaApplyRequest{Table: "main", Items: [][]byte{{0xff}}},
+			`{"table":"main","items":["/w=="]}`,
+		},
+		{
+			&historyRequest{Table: "main", Key: []byte("k"), Time: 1, Limit: 10},
+			`{"table":"main","key":"aw==","time":1,"limit":10}`,
+		},
+		{
+			&sysCmdSeqNextRequest{Name: "id", Step: 1},
+			`{"name":"id","step":1}`,
+		},
+	} {
+		bs, err := json.Marshal(v.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != v.golden {
+			t.Fatalf("WireGolden ER! encode %s, golden %s", string(bs), v.golden)
+		}
+	}
+
+	// unknown fields and empty bodies
+	var req pubSubRequest
+	if err := wireDecode([]byte(`{"id":"a1","wait_time":10,"x_unknown":{"a":[1]}}`), &req); err != nil ||
+		req.Id != "a1" || req.WaitTime != 10 {
+		t.Fatalf("WireGolden ER! decode %v", err)
+	}
+
+	var info HandshakeInfo
+	if err := wireDecode(nil, &info); err != nil || info.Protocol != 0 {
+		t.Fatalf("WireGolden ER! decode empty %v", err)
+	}
+
+	t.Log("WireGolden OK")
+}
+
+func Test_RpcCompress(t *testing.T) {
+
+	var (
+		c   = &rpcSnappy{}
+		buf bytes.Buffer
+		val = bytes.Repeat([]byte("0123456789"), 1000)
+	)
+
+	w, _ := c.Compress(&buf)
+	w.Write(val)
+	w.Close()
+	if buf.Len() >= len(val) {
+		t.Fatalf("RpcCompress ER! size %d", buf.Len())
+	}
+
+	r, _ := c.Decompress(&buf)
+	if bs, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(bs, val) {
+		t.Fatalf("RpcCompress ER! decompress %v", err)
+	}
+
+	for _, v := range []struct {
+		name   string
+		server *HandshakeInfo
+		ret    string
+	}{
+		{RpcCompressSnappy, handshakeLocal(), RpcCompressSnappy},
+		{RpcCompressGzip, handshakeLocal(), RpcCompressGzip},
+		{RpcCompressNone, handshakeLocal(), ""},
+		{RpcCompressSnappy, &HandshakeInfo{Protocol: 1}, ""},
+		{"zstd", handshakeLocal(), ""},
+	} {
+		if ret := rpcCompressNegotiate(v.name, v.server); ret != v.ret {
+			t.Fatalf("RpcCompress ER! negotiate %s, got %s", v.name, ret)
+		}
+	}
+
+	t.Log("RpcCompress OK")
+}
+
+func Test_RequestLog(t *testing.T) {
+
+	rl := newRequestLog(3)
+	for i := 1; i <= 5; i++ {
+		entry := &RequestLogEntry{Id: fmt.Sprintf("r%d", i)}
+		if i%2 == 0 {
+			entry.Error = "err"
+		}
+		rl.add(entry)
+	}
+
+	if ls := rl.list("", false, 10); len(ls) != 3 || ls[0].Id != "r5" || ls[2].Id != "r3" {
+		t.Fatalf("RequestLog ER! list %d", len(ls))
+	}
+
+	if ls := rl.list("", true, 10); len(ls) != 1 || ls[0].Id != "r4" {
+		t.Fatal("RequestLog ER! errors")
+	}
+
+	if ls := rl.list("r1", false, 10); len(ls) != 0 {
+		t.Fatal("RequestLog ER! evicted")
+	}
+
+	if !requestIdValid("a-1") || requestIdValid("a 1") || requestIdValid(strings.Repeat("a", 65)) {
+		t.Fatal("RequestLog ER! id valid")
+	}
+
+	t.Log("RequestLog OK")
+}
+
+func Test_ReplicationPolicy(t *testing.T) {
+
+	cfg := &ConfigCluster{
+		ReplicationPolicies: []*ConfigReplicationPolicy{
+			{Table: "main", Prefix: "session/", Replicas: 1},
+			{Table: "main", Prefix: "billing/", Replicas: 3, Durability: DurabilitySync},
+			{Table: "main", Prefix: "billing/eu/", Replicas: 9},
+		},
+	}
+
+	for _, v := range []struct {
+		table   string
+		key     string
+		quorum  int
+		durable bool
+	}{
+		{"main", "session/1", 1, false},
+		{"main", "billing/1", 3, true},
+		{"main", "billing/eu/1", 5, false},
+		{"main", "other/1", 3, false},
+		{"log", "session/1", 3, false},
+	} {
+		p := cfg.replicationPolicy(v.table, []byte(v.key))
+		if p.quorum(5) != v.quorum || p.durable() != v.durable {
+			t.Fatalf("ReplicationPolicy ER! %s/%s quorum %d", v.table, v.key, p.quorum(5))
+		}
+	}
+
+	t.Log("ReplicationPolicy OK")
+}
+
+func Test_TtlDefault(t *testing.T) {
+
+	cfg := &ConfigFeature{
+		TtlDefaults: []*ConfigTtlDefault{
+			{Table: "main", Prefix: "cache/", Ttl: 60000},
+			{Table: "main", Prefix: "cache/long/", Ttl: 3600000},
+		},
+	}
+
+	for _, v := range []struct {
+		key string
+		ttl int64
+	}{
+		{"cache/1", 60000},
+		{"cache/long/1", 3600000},
+		{"user/1", 0},
+	} {
+		if ttl := cfg.ttlDefault("main", []byte(v.key)); ttl != v.ttl {
+			t.Fatalf("TtlDefault ER! %s ttl %d", v.key, ttl)
+		}
+	}
+
+	if cfg.ttlDefault("log", []byte("cache/1")) != 0 {
+		t.Fatal("TtlDefault ER! table")
+	}
+
+	t.Log("TtlDefault OK")
+}
+
+type testTierStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (it *testTierStore) Put(name string, r io.Reader, size int64) error {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.objects[name] = bs
+	return nil
+}
+
+func (it *testTierStore) Get(name string) (io.ReadCloser, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	bs, ok := it.objects[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(bs)), nil
+}
+
+func (it *testTierStore) Delete(name string) error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	delete(it.objects, name)
+	return nil
+}
+
+func Test_Tiering(t *testing.T) {
+
+	var (
+		dir   = filepath.Join(os.TempDir(), fmt.Sprintf("kvgo-tier-%d", time.Now().UnixNano()))
+		store = &testTierStore{objects: map[string][]byte{}}
+		cfg   = &ConfigTiering{
+			Prefix:         "node1",
+			CacheDirectory: filepath.Join(dir, "cache"),
+			CacheSize:      1,
+			Store:          store,
+		}
+		tdir = filepath.Join(dir, "data", "10_0_0")
+	)
+	defer os.RemoveAll(dir)
+
+	open := func() (*leveldb.DB, *dirStorage) {
+		stor, err := newDirStorage(tdir, "", nil, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := leveldb.Open(stor, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, stor
+	}
+
+	db, stor := open()
+	for i := 0; i < 1000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%04d", i)), bytes.Repeat([]byte{'v'}, 100), nil)
+	}
+	db.CompactRange(util.Range{})
+
+	num, err := stor.tierMigrate(time.Now().Unix() + 1)
+	if err != nil || num < 1 || len(store.objects) != num {
+		t.Fatalf("Tiering ER! migrate %d %v", num, err)
+	}
+
+	if ls, _ := filepath.Glob(filepath.Join(tdir, "*.ldb")); len(ls) != 0 {
+		t.Fatalf("Tiering ER! local files %d", len(ls))
+	}
+
+	db.Close()
+	stor.Close()
+
+	db, stor = open()
+	defer func() {
+		db.Close()
+		stor.Close()
+	}()
+
+	if bs, err := db.Get([]byte("key-0500"), nil); err != nil || len(bs) != 100 {
+		t.Fatalf("Tiering ER! get %v", err)
+	}
+
+	t.Log("Tiering OK")
+}
+
+func Test_HistoryRetentionVersions(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var (
+		tdb     = &dbTable{db: db}
+		key     = []byte("k")
+		entries = []*historyEntry{}
+	)
+
+	// the versions 1-4 are replaced before the cutoff 10, the key is deleted
+	// at 5, and the current version 6 does not exist
+	for _, v := range []uint64{1, 2, 3, 4, 5} {
+		entries = append(entries, &historyEntry{
+			key:       historyKeyEncode(key, v),
+			version:   v,
+			tombstone: v == 5,
+		})
+	}
+
+	for _, v := range []struct {
+		keep    int
+		removed int
+	}{
+		{0, 5},
+		{2, 3},
+		{9, 0},
+	} {
+		cn := &Conn{opts: &Config{}}
+		cn.opts.Feature.HistoryRetentionVersions = v.keep
+
+		batch := new(leveldb.Batch)
+		if err := cn.historyRefreshKey(tdb, batch, key, entries, 10); err != nil {
+			t.Fatal(err)
+		}
+		if batch.Len() != v.removed {
+			t.Fatalf("HistoryRetentionVersions ER! keep %d, removed %d", v.keep, batch.Len())
+		}
+	}
+
+	t.Log("HistoryRetentionVersions OK")
+}
+
+func Test_Handshake(t *testing.T) {
+
+	local := handshakeLocal()
+
+	for _, v := range []struct {
+		remote *HandshakeInfo
+		ok     bool
+	}{
+		{&HandshakeInfo{Protocol: ProtocolVersion, ProtocolMin: ProtocolVersionMin}, true},
+		{&HandshakeInfo{Protocol: 1, ProtocolMin: 1}, true},
+		{&HandshakeInfo{Protocol: ProtocolVersion + 1, ProtocolMin: ProtocolVersion}, true},
+		{&HandshakeInfo{Protocol: ProtocolVersion + 2, ProtocolMin: ProtocolVersion + 1}, false},
+		{&HandshakeInfo{Protocol: ProtocolVersionMin - 1}, false},
+	} {
+		if err := local.compatible(v.remote, "server"); (err == nil) != v.ok {
+			t.Fatalf("Handshake ER! %d-%d %v", v.remote.ProtocolMin, v.remote.Protocol, err)
+		}
+	}
+
+	if !local.Feature(FeatureReplicaApply) || local.Feature("none") {
+		t.Fatal("Handshake ER! Feature")
+	}
+
+	t.Log("Handshake OK")
+}
+
+func Test_ClientConnShare(t *testing.T) {
+
+	cfg := NewConfig(t.TempDir())
+	cfg.Server.Bind = "127.0.0.1:20451"
+	cfg.Server.AccessKey = dbTestAccessKey
+
+	db, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open ER! %s", err.Error())
+	}
+	defer db.Close()
+
+	var (
+		node = &ClientConfig{Addr: cfg.Server.Bind, AccessKey: dbTestAccessKey}
+		c1   = &ClientConfig{Addr: cfg.Server.Bind, AccessKey: dbTestAccessKey}
+		c2   = &ClientConfig{Addr: cfg.Server.Bind, AccessKey: dbTestAccessKey}
+	)
+
+	for _, c := range []*ClientConfig{c1, c2} {
+		kc, err := c.NewClient()
+		if err != nil {
+			t.Fatalf("NewClient ER! %s", err.Error())
+		}
+		if rs := kc.NewWriter([]byte("conn-share"), "1").TableNameSet("main").Commit(); !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	}
+
+	conn, err := clientConn(node.Addr, node.AccessKey, false, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1.cc.conn != conn || c2.cc.conn != conn {
+		t.Fatal("ClientConn ER! the connection of the node not shared")
+	}
+
+	// the closed connector releases the connection of the others
+	c1.cc.Close()
+	if conn.GetState() == connectivity.Shutdown {
+		t.Fatal("ClientConn ER! shared connection closed by a connector")
+	}
+	if rs := c2.c.NewReader([]byte("conn-share")).TableNameSet("main").Query(); !rs.OK() {
+		t.Fatalf("Query ER! %s", rs.Message)
+	}
+
+	// the evicted connection is closed once the last connector releases it
+	conn2, err := clientConn(node.Addr, node.AccessKey, false, nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn2 == conn || conn.GetState() == connectivity.Shutdown {
+		t.Fatal("ClientConn ER! held connection closed by the eviction")
+	}
+	if rs := c2.c.NewReader([]byte("conn-share")).TableNameSet("main").Query(); !rs.OK() {
+		t.Fatalf("Query ER! %s", rs.Message)
+	}
+	c2.cc.Close()
+	if conn.GetState() != connectivity.Shutdown {
+		t.Fatal("ClientConn ER! evicted connection not closed on release")
+	}
+
+	// the released connector acquires the cached one again
+	if rs := c1.c.NewReader([]byte("conn-share")).TableNameSet("main").Query(); !rs.OK() ||
+		c1.cc.conn != conn2 {
+		t.Fatalf("Query ER! %s", rs.Message)
+	}
+	c1.cc.Close()
+
+	t.Log("ClientConn OK")
+}
+
+type testClientObserver struct {
+	mu        sync.Mutex
+	calls     []*ClientCallEvent
+	retries   []string
+	failovers []string
+}
+
+func (it *testClientObserver) CallDone(ev *ClientCallEvent) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.calls = append(it.calls, ev)
+}
+
+func (it *testClientObserver) Retry(addr, method string, err error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.retries = append(it.retries, addr+" "+method)
+}
+
+func (it *testClientObserver) Failover(method, from, to string, err error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.failovers = append(it.failovers, method+" "+from+" "+to)
+}
+
+func (it *testClientObserver) reset() (calls []*ClientCallEvent, retries, failovers []string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	calls, retries, failovers = it.calls, it.retries, it.failovers
+	it.calls, it.retries, it.failovers = nil, nil, nil
+	return
+}
+
+func Test_ClientObserver(t *testing.T) {
+
+	var (
+		addrs = []string{"127.0.0.1:20471", "127.0.0.1:20472"}
+		down  = "127.0.0.1:20479"
+		dbs   = []*Conn{}
+		obs   = &testClientObserver{}
+	)
+
+	// the main nodes of a cluster
+	nodes := []*ClientConfig{}
+	for _, addr := range addrs {
+		nodes = append(nodes, &ClientConfig{
+			Addr:      addr,
+			AccessKey: dbTestAccessKey,
+		})
+	}
+	for _, addr := range addrs {
+		cfg := NewConfig(t.TempDir())
+		cfg.Server.Bind = addr
+		cfg.Server.AccessKey = dbTestAccessKey
+		cfg.Cluster.MainNodes = nodes
+		db, err := Open(cfg)
+		if err != nil {
+			t.Fatalf("Open ER! %s", err.Error())
+		}
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+
+	// the calls of the client
+	kc, err := (&ClientConfig{
+		Addr:      addrs[0],
+		AccessKey: dbTestAccessKey,
+		Observer:  obs,
+	}).NewClient()
+	if err != nil {
+		t.Fatalf("NewClient ER! %s", err.Error())
+	}
+	defer kc.Close()
+
+	if rs := kc.NewWriter([]byte("observer-1"), "1").TableNameSet("main").Commit(); !rs.OK() {
+		t.Fatalf("Commit ER! %s", rs.Message)
+	}
+	if rs := kc.NewReader([]byte("observer-1")).TableNameSet("main").Query(); !rs.OK() {
+		t.Fatalf("Query ER! %s", rs.Message)
+	}
+
+	calls, retries, _ := obs.reset()
+	if len(calls) != 2 || len(retries) != 0 {
+		t.Fatalf("ClientObserver ER! calls %d, retries %d", len(calls), len(retries))
+	}
+	for i, method := range []string{"Commit", "Query"} {
+		if v := calls[i]; v.Method != method || v.Addr != addrs[0] || v.Err != nil ||
+			v.RequestId == "" || v.Latency <= 0 || v.Retries != 0 {
+			t.Fatalf("ClientObserver ER! call %s %+v", method, v)
+		}
+	}
+
+	// the errors of the calls to the node down
+	kc2, err := (&ClientConfig{
+		Addr:      down,
+		AccessKey: dbTestAccessKey,
+		Observer:  obs,
+	}).NewClient()
+	if err != nil {
+		t.Fatalf("NewClient ER! %s", err.Error())
+	}
+	defer kc2.Close()
+
+	if rs := kc2.NewWriter([]byte("observer-2"), "1").TableNameSet("main").Commit(); rs.OK() {
+		t.Fatal("ClientObserver ER! commit to the node down")
+	}
+
+	calls, retries, _ = obs.reset()
+	if len(calls) != 1 || calls[0].Method != "Commit" || calls[0].Addr != down || calls[0].Err == nil {
+		t.Fatalf("ClientObserver ER! call of error %d", len(calls))
+	}
+	if calls[0].Retries != len(retries) {
+		t.Fatalf("ClientObserver ER! retries %d/%d", calls[0].Retries, len(retries))
+	}
+	for _, v := range retries {
+		if v != down+" Commit" {
+			t.Fatalf("ClientObserver ER! retry %s", v)
+		}
+	}
+
+	// the calls refused by the node in maintenance fail over to the other
+	if err := dbs[0].MaintenanceSet(true); err != nil {
+		t.Fatal(err)
+	}
+	defer dbs[0].MaintenanceSet(false)
+
+	cfg := &Config{
+		ClientConnectEnable: true,
+		ClientObserver:      obs,
+	}
+	for _, v := range nodes {
+		cfg.Cluster.MainNodes = append(cfg.Cluster.MainNodes, &ClientConfig{
+			Addr:      v.Addr,
+			AccessKey: v.AccessKey,
+		})
+	}
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open ER! %s", err.Error())
+	}
+	defer cn.Close()
+
+	for i := 0; i < 10; i++ {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(fmt.Sprintf("observer-f%d", i)), "1").
+			TableNameSet("main")); !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	}
+
+	calls, _, failovers := obs.reset()
+	if len(failovers) == 0 {
+		t.Fatal("ClientObserver ER! no failovers")
+	}
+	for _, v := range failovers {
+		if v != "Commit "+addrs[0]+" "+addrs[1] {
+			t.Fatalf("ClientObserver ER! failover %s", v)
+		}
+	}
+	var refused, done int
+	for _, v := range calls {
+		switch {
+		case v.Addr == addrs[0] && v.Err != nil:
+			refused += 1
+		case v.Addr == addrs[1] && v.Err == nil:
+			done += 1
+		default:
+			t.Fatalf("ClientObserver ER! call %+v", v)
+		}
+	}
+	if refused != len(failovers) || done != 10 {
+		t.Fatalf("ClientObserver ER! calls refused %d, done %d", refused, done)
+	}
+}
+
+func Test_SnapshotBootstrap(t *testing.T) {
+
+	cfg := NewConfig(t.TempDir())
+	cfg.Server.Bind = "127.0.0.1:20411"
+	cfg.Server.AccessKey = dbTestAccessKey
+
+	up, err := Open(cfg)
+	if err != nil {
+		t.Fatalf("Open ER! %s", err.Error())
+	}
+	defer up.Close()
+
+	vers := map[string]uint64{}
+
+	// more items than a read of the snapshot returns, and an item of
+	// ObjectMetaAttrDataOff which has only the meta entry
+	for i := 0; i <= snapshotReadLimit*2+50; i++ {
+		key := fmt.Sprintf("snap-%03d", i)
+		ow := kv2.NewObjectWriter([]byte(key), key).TableNameSet("main")
+		if i == 0 {
+			ow.Meta.Attrs |= kv2.ObjectMetaAttrDataOff
+		}
+		rs := up.commitLocal(ow, 0)
+		if !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+		vers[key] = rs.Meta.Version
+	}
+
+	snapshotCmd := func(method string, req *snapshotRequest) (*snapshotResult, error) {
+		bs, _ := json.Marshal(req)
+		rs := up.snapshotCmdLocal(nil, method, bs)
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+		var ret snapshotResult
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &ret); err != nil {
+				return nil, err
+			}
+		}
+		return &ret, nil
+	}
+
+	ret, err := snapshotCmd("SnapshotOpen", &snapshotRequest{Table: "main"})
+	if err != nil {
+		t.Fatalf("Snapshot Open ER! %s", err.Error())
+	}
+	if ret.LogOffset < vers["snap-250"] {
+		t.Fatalf("Snapshot ER! log offset %d/%d", ret.LogOffset, vers["snap-250"])
+	}
+
+	// the writes after the snapshot is opened are not in the snapshot
+	if rs := up.commitLocal(kv2.NewObjectWriter([]byte("snap-new"), "new").TableNameSet("main"), 0); !rs.OK() {
+		t.Fatalf("Commit ER! %s", rs.Message)
+	}
+
+	var (
+		id    = ret.Id
+		items = map[string]uint64{}
+		reads = 1
+	)
+	for {
+		for _, bs := range ret.Items {
+			item, err := kv2.ObjectItemDecode(bs)
+			if err != nil {
+				t.Fatalf("Snapshot ER! %s", err.Error())
+			}
+			items[string(item.Meta.Key)] = item.Meta.Version
+		}
+		if !ret.Next {
+			break
+		}
+		if ret, err = snapshotCmd("SnapshotRead", &snapshotRequest{Id: id, Offset: ret.Offset}); err != nil {
+			t.Fatalf("Snapshot Read ER! %s", err.Error())
+		}
+		reads += 1
+	}
+
+	if reads < 3 || len(items) != len(vers) {
+		t.Fatalf("Snapshot ER! reads %d, items %d/%d", reads, len(items), len(vers))
+	}
+	for key, ver := range vers {
+		if items[key] != ver {
+			t.Fatalf("Snapshot ER! %s version %d/%d", key, items[key], ver)
+		}
+	}
+
+	if _, err := snapshotCmd("SnapshotClose", &snapshotRequest{Id: id}); err != nil {
+		t.Fatalf("Snapshot Close ER! %s", err.Error())
+	}
+	if _, err := snapshotCmd("SnapshotRead", &snapshotRequest{Id: id}); err == nil {
+		t.Fatal("Snapshot ER! read after close")
+	}
+
+	// a new replica copies the snapshot and saves its log offset
+	rp, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Open ER! %s", err.Error())
+	}
+	defer rp.Close()
+
+	var (
+		hp = &ClientConfig{
+			Addr:      cfg.Server.Bind,
+			AccessKey: dbTestAccessKey,
+		}
+		tm = &ConfigReplicaTableMap{From: "main", To: "main"}
+		dt = rp.tabledb("main")
+	)
+
+	offset, err := rp.replicaBootstrap(hp, tm, dt)
+	if err != nil {
+		t.Fatalf("Replica Bootstrap ER! %s", err.Error())
+	}
+	if offset < vers["snap-250"] {
+		t.Fatalf("Replica Bootstrap ER! log offset %d", offset)
+	}
+	if bs, err := dt.db.Get(keySysLogAsync(hp.Addr, tm.From), nil); err != nil ||
+		string(bs) != strconv.FormatUint(offset, 10) {
+		t.Fatalf("Replica Bootstrap ER! saved log offset %s", string(bs))
+	}
+
+	for key, ver := range vers {
+		rr := kv2.NewObjectReader([]byte(key)).TableNameSet("main")
+		if key == "snap-000" {
+			rr.Attrs |= kv2.ObjectMetaAttrDataOff
+		}
+		rs := rp.Query(rr)
+		if !rs.OK() || len(rs.Items) == 0 || rs.Items[0].Meta.Version != ver {
+			t.Fatalf("Replica Bootstrap ER! %s %s", key, rs.Message)
+		}
+	}
+
+	t.Log("Snapshot Bootstrap OK")
+}
+
+func Test_SST(t *testing.T) {
+
+	dbs, err := dbOpen([]int{}, false)
+	if err != nil {
+		t.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	for i := 0; i < 2000; i++ {
+		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("sst:%06d", i)),
+			fmt.Sprintf("value-%d", i)).Commit(); !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	}
+
+	path := "/dev/shm/kvgo/test.sst"
+
+	if n, err := dbs[0].DumpSST("main", []byte("sst:"), path); err != nil || n != 2000 {
+		t.Fatalf("DumpSST ER! %d %v", n, err)
+	}
+
+	rs := dbs[0].SysCmd(kv2.NewSysCmdRequest("TableSet", &kv2.TableSetRequest{
+		Name: "sst_ingest",
+	}))
+	if !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+
+	if n, err := dbs[0].IngestSST("sst_ingest", path); err != nil || n != 2000 {
+		t.Fatalf("IngestSST ER! %d %v", n, err)
+	}
+
+	if rs := dbs[0].NewReader([]byte("sst:001234")).TableNameSet("sst_ingest").Query(); !rs.OK() ||
+		rs.DataValue().String() != "value-1234" {
+		t.Fatal("IngestSST ER! Compare")
+	}
+
+	t.Log("SST OK")
+}
+
+func Test_BatchLoad(t *testing.T) {
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("kvgo-batch-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{}
+	cfg.Storage.DataDirectory = dir
+	cfg.Performance.SyncWrites = SyncWritesAlways
+
+	cn, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	err = cn.BatchLoad(func(bl *BatchLoader) error {
+
+		c, err := bl.NewClient()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 100; i++ {
+			if rs := c.NewWriter([]byte(fmt.Sprintf("bl:%03d", i)), i).Commit(); !rs.OK() {
+				return rs.Error()
+			}
+		}
+
+		// the writes out of the loader keep the fsync policy
+		if cn.writeOptions() != syncWriteOpts {
+			t.Fatal("BatchLoad ER! fsync disabled out of the loader")
+		}
+		if rs := cn.NewWriter([]byte("bl:out"), 1).Commit(); !rs.OK() {
+			return rs.Error()
+		}
+
+		// the tables created during the load are synced
+		rs := cn.SysCmd(kv2.NewSysCmdRequest("TableSet", &kv2.TableSetRequest{
+			Name: "batch_load",
+		}))
+		if !rs.OK() {
+			return rs.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("BatchLoad ER! %v", err)
+	}
+
+	if atomic.LoadInt32(&cn.syncDirty) != 0 {
+		t.Fatal("BatchLoad ER! tables not synced")
+	}
+
+	if rs := cn.NewReader([]byte("bl:042")).Query(); !rs.OK() || rs.DataValue().Int() != 42 {
+		t.Fatal("BatchLoad ER! Query")
+	}
+}
+
+func Test_Rewrite(t *testing.T) {
+
+	dbs, err := dbOpen([]int{}, false)
+	if err != nil {
+		t.Fatalf("Can Not Open Database %s", err.Error())
+	}
+	cn := dbs[0]
+
+	for i := 0; i < 20; i++ {
+		if rs := cn.NewWriter([]byte(fmt.Sprintf("rw:%03d", i)), i).Commit(); !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	}
+
+	// a stale item is not rewritten
+	rs := cn.NewReader([]byte("rw:000")).Query()
+	if !rs.OK() {
+		t.Fatal("Query ER!")
+	}
+	stale := rs.Items[0]
+	if rs := cn.NewWriter([]byte("rw:000"), 100).Commit(); !rs.OK() {
+		t.Fatalf("Commit ER! %s", rs.Message)
+	}
+	if err := cn.rewriteCommit(stale, kv2.NewObjectWriter([]byte("rx:000"), 0)); err != errRewriteModified {
+		t.Fatalf("Rewrite ER! stale item %v", err)
+	}
+	if rs := cn.NewReader([]byte("rx:000")).Query(); !rs.NotFound() {
+		t.Fatal("Rewrite ER! stale item written")
+	}
+
+	var calls int64
+	job, err := cn.RewriteJobStart("rw", RewriteOptions{
+		Prefix: []byte("rw:"),
+	}, func(item *kv2.ObjectItem) ([]byte, interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		key := append([]byte("rx:"), item.Meta.Key[3:]...)
+		return key, item.DataValue().Int() * 2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := job.Wait(); err != nil {
+		t.Fatalf("Rewrite ER! %v", err)
+	}
+
+	if p := job.Progress(); !p.Done || p.Rewritten != 20 || p.Moved != 20 || calls != 20 {
+		t.Fatalf("Rewrite ER! progress %+v, calls %d", p, calls)
+	}
+
+	for i := 0; i < 20; i++ {
+		if rs := cn.NewReader([]byte(fmt.Sprintf("rw:%03d", i))).Query(); !rs.NotFound() {
+			t.Fatalf("Rewrite ER! old key rw:%03d", i)
+		}
+		v := i * 2
+		if i == 0 {
+			v = 200
+		}
+		if rs := cn.NewReader([]byte(fmt.Sprintf("rx:%03d", i))).Query(); !rs.OK() ||
+			rs.DataValue().Int() != v {
+			t.Fatalf("Rewrite ER! new key rx:%03d", i)
+		}
+	}
+
+	cfg := &Config{}
+	cfg.Cluster.MainNodes = []*ClientConfig{{Addr: "127.0.0.1:1"}}
+	if _, err := (&Conn{opts: cfg}).RewriteJobStart("rw", RewriteOptions{
+		Prefix: []byte("rw:"),
+	}, func(item *kv2.ObjectItem) ([]byte, interface{}, error) {
+		return nil, nil, nil
+	}); err == nil {
+		t.Fatal("Rewrite ER! cluster mode")
+	}
+}
+
+func Test_SimCluster(t *testing.T) {
+
+	dir := "/dev/shm/kvgo/sim"
+	if _, err := exec.Command("rm", "-rf", dir).Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := newSimCluster(dir, 3, 1, simOptions{
+		MaxDelay: 2 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("newSimCluster ER! %s", err.Error())
+	}
+	defer sim.Close()
+
+	// the majority side commits
+	sim.Partition([]int{0, 1}, []int{2})
+
+	if rs := sim.Commit(0, kv2.NewObjectWriter([]byte("sim-1"), "1")); !rs.OK() {
+		t.Fatalf("Sim Commit ER! %s", rs.Message)
+	}
+
+	if rs := sim.Query(1, kv2.NewObjectReader([]byte("sim-1"))); !rs.OK() {
+		t.Fatalf("Sim Query ER! %s", rs.Message)
+	}
+
+	if rs := sim.Query(2, kv2.NewObjectReader([]byte("sim-1"))); !rs.NotFound() {
+		t.Fatal("Sim Query ER! partitioned node")
+	}
+
+	// the minority side does not
+	sim.Partition([]int{0}, []int{1, 2})
+	sim.Advance(time.Minute)
+
+	if rs := sim.Commit(0, kv2.NewObjectWriter([]byte("sim-2"), "2")); rs.OK() {
+		t.Fatal("Sim Commit ER! minority")
+	}
+
+	sim.Heal()
+	sim.Advance(time.Minute)
+
+	if rs := sim.Commit(2, kv2.NewObjectWriter([]byte("sim-2"), "2")); !rs.OK() {
+		t.Fatalf("Sim Commit ER! %s", rs.Message)
+	}
+
+	t.Log("SimCluster OK")
+}
+
+func Test_PubSub(t *testing.T) {
+
+	hub := newPubSubHub()
+
+	sub, err := hub.subscribe([]string{"c1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := hub.subscribe([]string{"c1", "c2"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := hub.publish(&PubSubMessage{Channel: "c1", Data: []byte("m1")}); n != 2 {
+		t.Fatalf("PubSub ER! publish to %d subscribers", n)
+	}
+	if ls, err := hub.poll(sub.id, 100); err != nil || len(ls) != 1 || string(ls[0].Data) != "m1" {
+		t.Fatal("PubSub ER! poll")
+	}
+
+	// the remote subscribers idle in pubSubIdleTTL are removed
+	atomic.StoreInt64(&sub.active, time.Now().Unix()-pubSubIdleTTL-1)
+	atomic.StoreInt64(&local.active, time.Now().Unix()-pubSubIdleTTL-1)
+	hub.mu.Lock()
+	hub.gc()
+	hub.mu.Unlock()
+	if _, err := hub.poll(sub.id, 0); err == nil {
+		t.Fatal("PubSub ER! idle subscriber not removed")
+	}
+	if _, ok := hub.subs[local.id]; !ok {
+		t.Fatal("PubSub ER! local subscriber removed")
+	}
+
+	// the messages are sent to the subscribers of the other nodes
+	dir := "/dev/shm/kvgo/pubsub"
+	if _, err := exec.Command("rm", "-rf", dir).Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := newSimCluster(dir, 3, 1, simOptions{})
+	if err != nil {
+		t.Fatalf("newSimCluster ER! %s", err.Error())
+	}
+	defer sim.Close()
+
+	var subs []*Subscription
+	for _, cn := range sim.nodes {
+		sub, err := cn.Subscribe("c1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := sim.nodes[0].Publish("c1", []byte(fmt.Sprintf("m%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for n, sub := range subs {
+		for i := 0; i < 3; i++ {
+			select {
+			case msg := <-sub.C:
+				if string(msg.Data) != fmt.Sprintf("m%d", i) {
+					t.Fatalf("PubSub ER! node %d message %s", n, msg.Data)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("PubSub ER! node %d message m%d not received", n, i)
+			}
+		}
+	}
+}
+
+func Test_QuorumRead(t *testing.T) {
+
+	dir := "/dev/shm/kvgo/quorum-read"
+	if _, err := exec.Command("rm", "-rf", dir).Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := newSimCluster(dir, 3, 1, simOptions{
+		MaxDelay: 2 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("newSimCluster ER! %s", err.Error())
+	}
+	defer sim.Close()
+
+	// the node missing the key reads it from the quorum
+	sim.Partition([]int{0, 1}, []int{2})
+	if rs := sim.Commit(0, kv2.NewObjectWriter([]byte("qr-1"), "1")); !rs.OK() {
+		t.Fatalf("Sim Commit ER! %s", rs.Message)
+	}
+	sim.Heal()
+
+	if rs := sim.QueryQuorum(2, kv2.NewObjectReader([]byte("qr-1"))); !rs.OK() ||
+		rs.DataValue().String() != "1" {
+		t.Fatalf("QueryQuorum ER! missing key, %s", rs.Message)
+	}
+
+	// the stale node gets the newest version and is repaired
+	if rs := sim.Commit(0, kv2.NewObjectWriter([]byte("qr-2"), "1")); !rs.OK() {
+		t.Fatalf("Sim Commit ER! %s", rs.Message)
+	}
+	sim.Partition([]int{0, 1}, []int{2})
+	sim.Advance(time.Minute)
+	if rs := sim.Commit(0, kv2.NewObjectWriter([]byte("qr-2"), "2")); !rs.OK() {
+		t.Fatalf("Sim Commit ER! %s", rs.Message)
+	}
+	sim.Heal()
+
+	if rs := sim.Query(2, kv2.NewObjectReader([]byte("qr-2"))); !rs.OK() ||
+		rs.DataValue().String() != "1" {
+		t.Fatal("Sim Query ER! stale node")
+	}
+
+	if rs := sim.QueryQuorum(2, kv2.NewObjectReader([]byte("qr-2"))); !rs.OK() ||
+		rs.DataValue().String() != "2" {
+		t.Fatalf("QueryQuorum ER! stale key, %s", rs.Message)
+	}
+
+	for i := 0; ; i++ {
+		rs := sim.Query(2, kv2.NewObjectReader([]byte("qr-2")))
+		if rs.OK() && rs.DataValue().String() == "2" {
+			break
+		}
+		if i >= 100 {
+			t.Fatal("QueryQuorum ER! stale node not repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the key only the local node has is not committed by a quorum
+	if rs := sim.nodes[2].commitLocal(kv2.NewObjectWriter([]byte("qr-3"), "1"), 0); !rs.OK() {
+		t.Fatalf("Commit Local ER! %s", rs.Message)
+	}
+
+	if rs := sim.QueryQuorum(2, kv2.NewObjectReader([]byte("qr-3"))); !rs.NotFound() {
+		t.Fatalf("QueryQuorum ER! local only key, %v", rs.OK())
+	}
+
+	// the check of the local only key needs all peers
+	sim.Partition([]int{1, 2}, []int{0})
+	if rs := sim.QueryQuorum(2, kv2.NewObjectReader([]byte("qr-3"))); rs.OK() || rs.NotFound() {
+		t.Fatal("QueryQuorum ER! local only key of the partitioned peer")
+	}
+
+	if rs := sim.QueryQuorum(2, kv2.NewObjectReader([]byte("qr-1"))); !rs.OK() ||
+		rs.DataValue().String() != "1" {
+		t.Fatalf("QueryQuorum ER! %s", rs.Message)
+	}
+
+	t.Log("QueryQuorum OK")
+}
+
+// linOp is an operation of a register history, the ret of the writes
+// with unknown outcome (error or timeout) is 0, they may or may not have
+// taken effect.
+type linOp struct {
+	write bool
+	value string
+	call  int64
+	ret   int64
+}
+
+// linCheck returns true if the history of a single register (initially "")
+// is linearizable, by a depth-first search of the orders that respect the
+// real time (Wing & Gong) with the memoization of the visited states.
+func linCheck(ops []*linOp) bool {
+
+	const inf = int64(1) << 62
+
+	rets := make([]int64, len(ops))
+	for i, op := range ops {
+		if rets[i] = op.ret; rets[i] == 0 {
+			rets[i] = inf
+		}
+	}
+
+	var (
+		done    = make([]bool, len(ops))
+		visited = map[string]bool{}
+		search  func(state string, left int) bool
+	)
+
+	search = func(state string, left int) bool {
+
+		if left == 0 {
+			return true
+		}
+
+		key := fmt.Sprintf("%v/%s", done, state)
+		if visited[key] {
+			return false
+		}
+		visited[key] = true
+
+		minRet, pending := inf, 0
+		for i := range ops {
+			if !done[i] {
+				if rets[i] < minRet {
+					minRet = rets[i]
+				}
+				if rets[i] == inf {
+					pending += 1
+				}
+			}
+		}
+
+		// the pending writes may never take effect
+		if pending == left {
+			return true
+		}
+
+		for i, op := range ops {
+
+			if done[i] || op.call > minRet {
+				continue
+			}
+
+			next := state
+			if op.write {
+				next = op.value
+			} else if op.value != state {
+				continue
+			}
+
+			done[i] = true
+			ok := search(next, left-1)
+			done[i] = false
+
+			if ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return search("", len(ops))
+}
+
+func Test_LinCheck(t *testing.T) {
+
+	// w(a) -> r(a) -> w(b) -> r(b)
+	if !linCheck([]*linOp{
+		{write: true, value: "a", call: 1, ret: 2},
+		{value: "a", call: 3, ret: 4},
+		{write: true, value: "b", call: 5, ret: 6},
+		{value: "b", call: 7, ret: 8},
+	}) {
+		t.Fatal("linCheck ER! sequential")
+	}
+
+	// stale read after the write returned
+	if linCheck([]*linOp{
+		{write: true, value: "a", call: 1, ret: 2},
+		{write: true, value: "b", call: 3, ret: 4},
+		{value: "a", call: 5, ret: 6},
+	}) {
+		t.Fatal("linCheck ER! stale read")
+	}
+
+	// concurrent write and reads, and a pending write seen by a read
+	if !linCheck([]*linOp{
+		{write: true, value: "a", call: 1, ret: 10},
+		{value: "", call: 2, ret: 3},
+		{value: "a", call: 4, ret: 5},
+		{write: true, value: "b", call: 11},
+		{value: "b", call: 12, ret: 13},
+	}) {
+		t.Fatal("linCheck ER! concurrent")
+	}
+
+	t.Log("linCheck OK")
+}
+
+// Test_Linearizability drives concurrent clients against a simulated cluster
+// and checks the histories of the keys, it only runs with -kvgo.long:
+//
+//	go test -run Test_Linearizability -kvgo.long -kvgo.sim-drop 0.05
+func Test_Linearizability(t *testing.T) {
+
+	if !*testLong {
+		t.Skip("long test, enable with -kvgo.long")
+	}
+
+	dir := "/dev/shm/kvgo/lin"
+	if _, err := exec.Command("rm", "-rf", dir).Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := newSimCluster(dir, 3, time.Now().UnixNano(), simOptions{
+		DropRate: *testSimDrop,
+		MaxDelay: *testSimDelay,
+	})
+	if err != nil {
+		t.Fatalf("newSimCluster ER! %s", err.Error())
+	}
+	defer sim.Close()
+
+	var (
+		clients = 6
+		keys    = 4
+		rounds  = 40
+		tn      = time.Now()
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		hists   = make([][]*linOp, keys)
+	)
+
+	now := func() int64 {
+		return int64(time.Since(tn)) + 1
+	}
+
+	for c := 0; c < clients; c++ {
+
+		wg.Add(1)
+
+		go func(c int) {
+
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(int64(c)))
+
+			for i := 0; i < rounds; i++ {
+
+				var (
+					k   = rnd.Intn(keys)
+					key = []byte(fmt.Sprintf("lin-%d", k))
+					op  = &linOp{call: now()}
+				)
+
+				if rnd.Intn(2) == 0 {
+					op.write, op.value = true, fmt.Sprintf("c%d-%d", c, i)
+					if rs := sim.Commit(c%3, kv2.NewObjectWriter(key, op.value)); rs.OK() {
+						op.ret = now()
+					}
+				} else {
+					rs := sim.QueryQuorum(c%3, kv2.NewObjectReader(key))
+					if !rs.OK() && !rs.NotFound() {
+						continue
+					}
+					if rs.OK() {
+						op.value = rs.DataValue().String()
+					}
+					op.ret = now()
+				}
+
+				mu.Lock()
+				hists[k] = append(hists[k], op)
+				mu.Unlock()
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	for k, ops := range hists {
+		if !linCheck(ops) {
+			for _, op := range ops {
+				t.Logf("key %d, write %v, value %q, call %d, return %d",
+					k, op.write, op.value, op.call, op.ret)
+			}
+			t.Fatalf("Linearizability ER! key %d", k)
+		}
+	}
+
+	t.Logf("Linearizability OK, %d clients, %d keys, %d ops", clients, keys, clients*rounds)
+}
+
+func Test_ValueRef(t *testing.T) {
+
+	dbs, err := dbOpen(nil, false)
+	if err != nil {
+		t.Fatalf("Can Not Open Database %s", err.Error())
+	}
+	db := dbs[0]
+
+	if rs := db.NewWriter([]byte("ref-1"), "v1").Commit(); !rs.OK() {
+		t.Fatalf("Commit ER! %s", rs.Message)
+	}
+
+	ref, err := db.GetRef("main", []byte("ref-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, err := ref.Item(); err != nil || item.DataValue().String() != "v1" {
+		t.Fatal("GetRef ER! value")
+	}
+
+	// a released ref is pooled once
+	ref.Release()
+	ref.Release()
+	if _, err := ref.Item(); err == nil {
+		t.Fatal("GetRef ER! item of a released ref")
+	}
+	r1, _ := db.GetRef("main", []byte("ref-1"))
+	r2, _ := db.GetRef("main", []byte("ref-1"))
+	if r1 == nil || r1 == r2 {
+		t.Fatal("GetRef ER! ref pooled twice")
+	}
+	r1.Release()
+	r2.Release()
+
+	// the pending merge operands are applied
+	if err := db.Merge("main", []byte("ref-1"), MergeOperatorAppend, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge("main", []byte("ref-2"), MergeOperatorCounter, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"ref-1": "v1x", "ref-2": "3"} {
+		ref, err := db.GetRef("main", []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item, err := ref.Item(); err != nil || item.DataValue().String() != v {
+			t.Fatalf("GetRef ER! merged value of %s", k)
+		}
+		ref.Release()
+	}
+
+	if _, err := db.GetRef("main", []byte("ref-0")); err == nil || err.Error() != ldbNotFound {
+		t.Fatal("GetRef ER! not found")
+	}
+}
+
+func Benchmark_GetRef(b *testing.B) {
+
+	dbs, err := dbOpen(nil, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < 10000; i++ {
+		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit ER!, %d Err %s", i, rs.Message)
+		}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ref, err := dbs[0].GetRef("main", []byte(fmt.Sprintf("%032d", rand.Intn(1000))))
+		if err != nil {
+			b.Fatalf("GetRef ER!, Err %s", err.Error())
+		}
+		ref.Release()
+	}
+}
+
+func Benchmark_Commit_Seq(b *testing.B) {
+
+	dbs, err := dbOpen(nil, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < b.N; i++ {
+		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Commit_Seq_MetaLogDisable(b *testing.B) {
+
+	dbs, err := dbOpen([]int{-1}, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < b.N; i++ {
+		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Commit_Rand(b *testing.B) {
+
+	dbs, err := dbOpen(nil, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < b.N; i++ {
+		if rs := dbs[0].NewWriter(
+			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Commit_Rand_MetaLogDisable(b *testing.B) {
+
+	dbs, err := dbOpen([]int{-2}, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < b.N; i++ {
+		if rs := dbs[0].NewWriter(
+			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Commit_Rand_Cluster_x3_1k(b *testing.B) {
+
+	dbs, err := dbOpen([]int{10001, 10002, 10003}, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < b.N; i++ {
+		ow := kv2.NewObjectWriter(
+			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs)
+		if rs := dbs[rand.Intn(len(dbs))].Commit(ow); !rs.OK() {
+			b.Fatalf("Commit ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Commit_Rand_Cluster_x3_100b(b *testing.B) {
+
+	dbs, err := dbOpen([]int{11001, 11002, 11003}, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 100))
+	for i := 0; i < b.N; i++ {
+		ow := kv2.NewObjectWriter(
+			[]byte(fmt.Sprintf("%032d", rand.Int31())), bs)
+		if rs := dbs[rand.Intn(len(dbs))].Commit(ow); !rs.OK() {
+			b.Fatalf("Commit ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Query_Key(b *testing.B) {
+
+	dbs, err := dbOpen(nil, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < 10000; i++ {
+		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit ER!, %d Err %s", i, rs.Message)
+		}
+	}
+
+	for i := 0; i < b.N; i++ {
+		if rs := dbs[0].NewReader([]byte(fmt.Sprintf("%032d", rand.Intn(1000)))).Query(); !rs.OK() {
+			b.Fatalf("Query ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Benchmark_Query_KeyRange(b *testing.B) {
+
+	dbs, err := dbOpen(nil, false)
+	if err != nil {
+		b.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	bs := []byte(strings.Repeat("a", 1000))
+	for i := 0; i < 10000; i++ {
+		if rs := dbs[0].NewWriter([]byte(fmt.Sprintf("%032d", i)), bs).Commit(); !rs.OK() {
+			b.Fatalf("Commit Key ER! Err %s", rs.Message)
+		}
+	}
+
+	for i := 0; i < b.N; i++ {
+		offset := rand.Intn(10000 - 10)
+		if rs := dbs[0].NewReader(nil).KeyRangeSet(
+			[]byte(fmt.Sprintf("%032d", offset)),
+			[]byte(fmt.Sprintf("%032d", offset+10))).
+			LimitNumSet(10).Query(); !rs.OK() {
+			b.Fatalf("Query KeyRange ER!, Err %s", rs.Message)
+		}
+	}
+}
+
+func Test_SessionSynced(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+	cn.opts.Server.Bind = "n1"
+	for _, v := range []string{"n1", "n2", "n3"} {
+		cn.opts.Cluster.MainNodes = append(cn.opts.Cluster.MainNodes, &ClientConfig{
+			Addr: v,
+		})
+	}
+
+	tdb := &dbTable{db: db, tableName: "main"}
+
+	// the majority of 3 is 2, the node must have pulled the logs of one peer
+	if ok, err := cn.sessionSynced(tdb, 100); err != nil || ok {
+		t.Fatalf("session synced %v, %v", ok, err)
+	}
+
+	db.Put(keySysLogAsync("n2", "main"), []byte("99"), nil)
+	if ok, _ := cn.sessionSynced(tdb, 100); ok {
+		t.Fatal("session synced before the version")
+	}
+
+	db.Put(keySysLogAsync("n3", "main"), []byte("100"), nil)
+	if ok, _ := cn.sessionSynced(tdb, 100); !ok {
+		t.Fatal("session not synced")
+	}
+
+	// the writes acked by 1 node may be missed unless all peers are pulled
+	cn.opts.Cluster.ReplicationPolicies = []*ConfigReplicationPolicy{
+		{Table: "main", Prefix: "a", Replicas: 1},
+	}
+	if ok, _ := cn.sessionSynced(tdb, 100); ok {
+		t.Fatal("session synced with the quorum 1")
+	}
+
+	sess, _ := cn.NewSession("")
+	sess.versionSet("", 100)
+	sess2, err := cn.NewSession(sess.Token())
+	if err != nil || sess2.Version("main") != 100 {
+		t.Fatalf("session token %v, %v", sess2, err)
+	}
+}
+
+type testReadIndexTransport struct {
+	clusterTransport
+	versions map[string]uint64
+}
+
+func (it *testReadIndexTransport) SysCmd(ctx context.Context,
+	node *ClientConfig, req *kv2.SysCmdRequest) (*kv2.ObjectResult, error) {
+	v, ok := it.versions[node.Addr]
+	if !ok {
+		return nil, fmt.Errorf("unavailable")
+	}
+	rs := kv2.NewObjectResultOK()
+	rs.Meta = &kv2.ObjectMeta{
+		Version: v,
+	}
+	return rs, nil
+}
+
+func Test_ReadIndex(t *testing.T) {
+
+	tr := &testReadIndexTransport{
+		versions: map[string]uint64{
+			"n1": 10,
+			"n2": 30,
+		},
+	}
+
+	cn := &Conn{
+		opts:      &Config{},
+		transport: tr,
+	}
+	for _, v := range []string{"n1", "n2", "n3"} {
+		cn.opts.Cluster.MainNodes = append(cn.opts.Cluster.MainNodes, &ClientConfig{
+			Addr: v,
+		})
+	}
+
+	if v, err := cn.readIndex("main"); err != nil || v != 30 {
+		t.Fatalf("read index %d, %v", v, err)
+	}
+
+	// the writes acked by 1 node are only covered by all nodes
+	cn.opts.Cluster.ReplicationPolicies = []*ConfigReplicationPolicy{
+		{Table: "main", Replicas: 1},
+	}
+	if _, err := cn.readIndex("main"); err == nil {
+		t.Fatal("read index without quorum")
+	}
+}
+
+func Test_HashBalancer(t *testing.T) {
+
+	cfg := &ConfigCluster{}
+	for _, v := range []string{"n1", "n2", "n3"} {
+		cfg.MainNodes = append(cfg.MainNodes, &ClientConfig{
+			Addr: v,
+		})
+	}
+
+	hits := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		ls := cfg.keyMainNodes("main", key, 2)
+		if len(ls) != 3 || ls[0] == ls[1] || ls[1] == ls[2] || ls[0] == ls[2] {
+			t.Fatalf("hash balancer nodes %v", ls)
+		}
+		if ls2 := cfg.keyMainNodes("main", key, 2); ls2[0] != ls[0] {
+			t.Fatal("hash balancer not stable")
+		}
+		hits[ls[0].Addr] += 1
+	}
+
+	for k, n := range hits {
+		if n < 500 {
+			t.Fatalf("hash balancer node %s, keys %d", k, n)
+		}
+	}
+
+	// the keys of the remaining nodes stay on them if a node is removed
+	cfg2 := &ConfigCluster{
+		MainNodes: cfg.MainNodes[:2],
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if v := cfg.keyMainNodes("main", key, 0)[0]; v.Addr != "n3" &&
+			cfg2.keyMainNodes("main", key, 0)[0] != v {
+			t.Fatalf("hash balancer key %s moved", key)
+		}
+	}
+}
+
+func Test_ZoneBalancer(t *testing.T) {
+
+	cfg := &ConfigCluster{
+		Zone:   "a1",
+		Region: "a",
+	}
+	for _, v := range [][]string{{"n1", "a1", "a"}, {"n2", "a2", "a"}, {"n3", "b1", "b"}} {
+		cfg.MainNodes = append(cfg.MainNodes, &ClientConfig{
+			Addr:   v[0],
+			Zone:   v[1],
+			Region: v[2],
+		})
+	}
+
+	for i := 0; i < 100; i++ {
+		ls := cfg.zoneMainNodes("main", []byte(fmt.Sprintf("key-%d", i)), 2)
+		if len(ls) != 3 || ls[0].Addr != "n1" || ls[1].Addr != "n2" || ls[2].Addr != "n3" {
+			t.Fatalf("zone balancer nodes %v", ls)
+		}
+	}
+}
+
+func Test_Membership(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts:   &Config{},
+		dbSys:  db,
+		keyMgr: hauth.NewAccessKeyManager(),
+	}
+	nodeKey := func(id string) *hauth.AccessKey {
+		return &hauth.AccessKey{Id: id, Secret: "secret-of-" + id}
+	}
+	for _, v := range []string{"n1", "n2"} {
+		cn.opts.Cluster.MainNodes = append(cn.opts.Cluster.MainNodes, &ClientConfig{
+			Addr:      v,
+			AccessKey: nodeKey(v),
+		})
+	}
+
+	addrs := func() string {
+		s := ""
+		for _, v := range cn.mainNodes() {
+			s += v.Addr + ","
+		}
+		return s
+	}
+
+	voters := cn.opts.Cluster.MainNodes
+
+	// the members without an access key are refused
+	if err := cn.nodeJoinApply([]*nodeMember{
+		{Node: &ClientConfig{Addr: "n3"}, State: nodeStateLearner},
+	}, 0); err == nil || addrs() != "n1,n2," {
+		t.Fatal("member without access key applied")
+	}
+	if err := cn.NodeAdd(&ClientConfig{Addr: "n4:9100"}); err == nil {
+		t.Fatal("node without access key added")
+	}
+
+	n3 := &ClientConfig{Addr: "n3", AccessKey: nodeKey("n3")}
+
+	for _, v := range []struct {
+		state string
+		addrs string
+	}{
+		{nodeStateLearner, "n1,n2,"},
+		{nodeStateVoter, "n1,n2,n3,"},
+	} {
+		members := []*nodeMember{{Node: n3, State: v.state}}
+		for _, v2 := range voters {
+			members = append(members, &nodeMember{Node: v2, State: nodeStateVoter})
+		}
+		if err := cn.nodeJoinApply(members, 0); err != nil {
+			t.Fatal(err)
+		}
+		if s := addrs(); s != v.addrs {
+			t.Fatalf("members %s, expect %s", s, v.addrs)
+		}
+	}
+
+	if err := cn.nodeRemove("n1", 0); err != nil || addrs() != "n2,n3," {
+		t.Fatalf("members %s, err %v", addrs(), err)
+	}
+
+	if err := cn.ReplicaOfAdd(&ConfigReplicaOfNode{
+		ClientConfig: &ClientConfig{Addr: "r1"},
+	}); err != nil || len(cn.replicaOfNodes()) != 1 {
+		t.Fatalf("replica-of add %v", err)
+	}
+
+	if err := cn.ReplicaOfRemove("r1"); err != nil || len(cn.replicaOfNodes()) != 0 {
+		t.Fatalf("replica-of remove %v", err)
+	}
+}
+
+func Test_Decommission(t *testing.T) {
+
+	dbs, err := dbOpen([]int{20431, 20432, 20433}, false)
+	if err != nil {
+		t.Fatalf("Can Not Open Database %s", err.Error())
+	}
+
+	// the writes of the target are replicated before it is removed
+	vers := map[string]uint64{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("decommission-%d", i)
+		rs := dbs[2].commitLocal(kv2.NewObjectWriter([]byte(key), key).TableNameSet("main"), 0)
+		if !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+		vers[key] = rs.Meta.Version
+	}
+
+	if err := dbs[0].Decommission("127.0.0.1:20439"); err == nil {
+		t.Fatal("Decommission ER! unknown node")
+	}
+
+	target := dbs[2].opts.Server.Bind
+
+	if err := dbs[0].Decommission(target); err != nil {
+		t.Fatalf("Decommission ER! %s", err.Error())
+	}
+	if err := dbs[0].Decommission(target); err == nil {
+		t.Fatal("Decommission ER! in progress")
+	}
+
+	var st *DecommissionStatus
+	for i := 0; i < 300; i++ {
+		if ls := dbs[0].DecommissionStatusList(); len(ls) == 1 && ls[0].Addr == target &&
+			(ls[0].State == DecommissionRemoved || ls[0].State == DecommissionFailed) {
+			st = ls[0]
+			break
+		}
+		time.Sleep(100e6)
+	}
+	if st == nil || st.State != DecommissionRemoved {
+		t.Fatalf("Decommission ER! status %v", st)
+	}
+	if st.Tables == 0 || st.Synced != st.Tables {
+		t.Fatalf("Decommission ER! tables %d/%d", st.Synced, st.Tables)
+	}
+
+	for key, ver := range vers {
+		for _, db := range dbs[:2] {
+			rs := db.objectLocalQuery(kv2.NewObjectReader([]byte(key)).TableNameSet("main"))
+			if !rs.OK() || len(rs.Items) == 0 || rs.Items[0].Meta.Version != ver {
+				t.Fatalf("Decommission ER! %s not replicated to %s", key, db.opts.Server.Bind)
+			}
+		}
+	}
+
+	// all nodes remove the target from the membership, and the removed
+	// node refuses to coordinate the writes
+	for _, db := range dbs {
+		for _, v := range db.mainNodes() {
+			if v.Addr == target {
+				t.Fatalf("Decommission ER! %s in the members of %s", target, db.opts.Server.Bind)
+			}
+		}
+		if db.nodeRemoved() != (db.opts.Server.Bind == target) {
+			t.Fatalf("Decommission ER! %s removed", db.opts.Server.Bind)
+		}
+	}
+
+	if err := dbs[0].Decommission(target); err == nil {
+		t.Fatal("Decommission ER! removed node")
+	}
+
+	t.Log("Decommission OK")
+}
+
+func Test_EpochFencing(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts:  &Config{},
+		dbSys: db,
+	}
+
+	if err := cn.epochSet(3); err != nil {
+		t.Fatal(err)
+	}
+
+	incoming := func(epoch uint64) context.Context {
+		return metadata.NewIncomingContext(context.Background(),
+			metadata.Pairs(EpochMetadataKey, fmt.Sprintf("%d", epoch)))
+	}
+
+	var (
+		sys    = reqSignValidator(&hauth.AccessKey{Id: "n1", Roles: []string{"sa"}})
+		client = reqSignValidator(&hauth.AccessKey{Id: "c1", Roles: []string{"client"}})
+	)
+
+	// the proposals of an older epoch are rejected
+	if _, rs := cn.epochCheck(incoming(2), sys); rs == nil {
+		t.Fatal("proposal of an older epoch accepted")
+	}
+
+	if epoch, rs := cn.epochCheck(incoming(3), sys); rs != nil || epoch != 3 || cn.Fenced() {
+		t.Fatalf("epoch check %v", rs)
+	}
+
+	// the epochs of the callers without the sys/all permission are ignored
+	if epoch, rs := cn.epochCheck(incoming(1<<63), client); rs != nil || epoch != 0 {
+		t.Fatalf("epoch check of client, epoch %d, rs %v", epoch, rs)
+	}
+	if epoch, _ := cn.epochCheck(incoming(2), nil); epoch != 0 {
+		t.Fatalf("epoch check of unknown caller, epoch %d", epoch)
+	}
+
+	// a newer epoch is claimed, the node is not fenced until a peer
+	// confirms it
+	epoch, rs := cn.epochCheck(incoming(4), sys)
+	if rs != nil || epoch != 4 {
+		t.Fatalf("epoch check %v", rs)
+	}
+	cn.epochClaim(epoch)
+	if cn.Fenced() || cn.members.epochClaimed != 4 {
+		t.Fatal("node fenced by an unconfirmed epoch")
+	}
+
+	// no peer confirms the epoch
+	cn.workerEpochSync()
+	if cn.Fenced() || cn.members.epochClaimed != 0 {
+		t.Fatal("node fenced by an unconfirmed epoch")
+	}
+
+	// the node is fenced after a peer confirmed a newer epoch
+	cn.epochObserve(4)
+	if !cn.Fenced() {
+		t.Fatal("node not fenced")
+	}
+
+	if err := cn.nodeRemove("n9", 4); err != nil || cn.Fenced() {
+		t.Fatalf("node fenced after the epoch synced, err %v", err)
+	}
+
+	cn2 := &Conn{opts: &Config{}}
+	cn2.epochFencedObserve(&kv2.ObjectResult{
+		Message: epochFencedPrefix + "3",
+	})
+	if _, seen := cn2.memberEpoch(); seen != 3 {
+		t.Fatalf("epoch seen %d", seen)
+	}
+}
+
+func Test_TransferLeadership(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts:  &Config{},
+		dbSys: db,
+	}
+	cn.opts.Server.Bind = "n1"
+	for _, v := range []string{"n1", "n2", "n3"} {
+		cn.opts.Cluster.MainNodes = append(cn.opts.Cluster.MainNodes, &ClientConfig{Addr: v})
+	}
+
+	for _, target := range []string{"n1", "n9"} {
+		if err := cn.TransferLeadership(target); err == nil {
+			t.Fatalf("leadership transferred to %s", target)
+		}
+	}
+
+	// the target must be a healthy voter of the same epoch
+	for _, v := range []struct {
+		st    *nodeStatusResult
+		valid bool
+	}{
+		{&nodeStatusResult{Addr: "n2"}, true},
+		{&nodeStatusResult{Addr: "n2", Maintenance: true}, false},
+		{&nodeStatusResult{Addr: "n2", Removed: true}, false},
+		{&nodeStatusResult{Addr: "n2", Fenced: true}, false},
+		{&nodeStatusResult{Addr: "n2", Epoch: 2}, false},
+	} {
+		if err := cn.leadershipTargetValid(v.st); (err == nil) != v.valid {
+			t.Fatalf("leadership target %+v, err %v", v.st, err)
+		}
+	}
+
+	// the target has the leadership once it has pulled the logs of the node
+	offsets := map[string]uint64{"main": 10, "t1": 0}
+	if leadershipCaughtUp("n1", offsets, &nodeStatusResult{
+		Pulled: map[string]map[string]uint64{"n1": {"main": 9}},
+	}) || !leadershipCaughtUp("n1", offsets, &nodeStatusResult{
+		Pulled: map[string]map[string]uint64{"n1": {"main": 10}},
+	}) {
+		t.Fatal("leadership target caught up")
+	}
+
+	// the clients fail over to the target first
+	if err := cn.maintenanceErr(); nodeRefusedTarget(err) != "" {
+		t.Fatal("maintenance hint without a transfer")
+	}
+	cn.transferTarget.Store("n3")
+	if err := cn.MaintenanceSet(true); err != nil {
+		t.Fatal(err)
+	}
+	err = cn.maintenanceErr()
+	if !nodeRefused(err) || nodeRefusedTarget(err) != "n3" {
+		t.Fatalf("maintenance hint %v", err)
+	}
+	if err := cn.TransferLeadership("n2"); err == nil {
+		t.Fatal("leadership transferred by a node in maintenance")
+	}
+
+	nodes := []*ClientConfig{{Addr: "n1"}, {Addr: "n2"}, {Addr: "n3"}}
+	cn.opts.Cluster.failoverTarget(nodes, 0, err)
+	if nodes[1].Addr != "n3" || nodes[2].Addr != "n2" {
+		t.Fatalf("failover nodes %s %s", nodes[1].Addr, nodes[2].Addr)
+	}
+	nodes = []*ClientConfig{{Addr: "n1"}, {Addr: "n2"}}
+	cn.opts.Cluster.failoverTarget(nodes, 0, err)
+	if nodes[1].Addr != "n3" {
+		t.Fatalf("failover nodes %s", nodes[1].Addr)
+	}
+
+	if err := cn.MaintenanceSet(false); err != nil {
+		t.Fatal(err)
+	}
+	if nodeRefusedTarget(cn.maintenanceErr()) != "" {
+		t.Fatal("maintenance hint after the maintenance off")
+	}
+}
+
+func Test_RollingRestart(t *testing.T) {
+
+	var (
+		dirs  = []string{t.TempDir(), t.TempDir()}
+		nodes = []*ClientConfig{}
+		dbs   = make([]*Conn, len(dirs))
+	)
+	for _, port := range []int{20441, 20442} {
+		nodes = append(nodes, &ClientConfig{
+			Addr:      fmt.Sprintf("127.0.0.1:%d", port),
+			AccessKey: dbTestAccessKey,
+		})
+	}
+
+	open := func(i int) {
+		cfg := NewConfig(dirs[i])
+		cfg.Server.Bind = nodes[i].Addr
+		cfg.Server.AccessKey = dbTestAccessKey
+		cfg.Cluster.MainNodes = nodes
+		db, err := Open(cfg)
+		if err != nil {
+			t.Fatalf("Open ER! %s", err.Error())
+		}
+		dbs[i] = db
+	}
+	for i := range dirs {
+		open(i)
+	}
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+
+	commit := func(db *Conn, key string) uint64 {
+		rs := db.commitLocal(kv2.NewObjectWriter([]byte(key), key).TableNameSet("main"), 0)
+		if !rs.OK() {
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+		return rs.Meta.Version
+	}
+
+	query := func(db *Conn, key string) uint64 {
+		rs := db.objectLocalQuery(kv2.NewObjectReader([]byte(key)).TableNameSet("main"))
+		if !rs.OK() || len(rs.Items) == 0 {
+			return 0
+		}
+		return rs.Items[0].Meta.Version
+	}
+
+	wait := func(fn func() bool) bool {
+		for tn := time.Now(); time.Since(tn) < 20*time.Second; time.Sleep(200e6) {
+			if fn() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the nodes are restarted one by one as kvgo-cli cluster rolling-restart
+	// does, each one hands its leadership over to the next one first
+	for i := range dbs {
+
+		var (
+			next = (i + 1) % len(dbs)
+			key  = fmt.Sprintf("rolling-restart-%d", i)
+			ver  = commit(dbs[i], key)
+		)
+
+		if err := dbs[i].TransferLeadership(nodes[next].Addr); err != nil {
+			t.Fatalf("Rolling Restart ER! transfer %s", err.Error())
+		}
+		if !dbs[i].Maintenance() || query(dbs[next], key) != ver {
+			t.Fatalf("Rolling Restart ER! %s not caught up before the restart", nodes[next].Addr)
+		}
+
+		dbs[i].Close()
+
+		// the writes of the other nodes while the node is down are pulled
+		// after the restart
+		key2 := key + "-down"
+		ver2 := commit(dbs[next], key2)
+
+		open(i)
+
+		if !dbs[i].Maintenance() {
+			t.Fatalf("Rolling Restart ER! %s maintenance not kept", nodes[i].Addr)
+		}
+
+		if !wait(func() bool {
+			info, err := dbs[i].ClusterStatus()
+			if err != nil || len(info.Nodes) != len(nodes) {
+				return false
+			}
+			for _, v := range info.Nodes {
+				if v.Health != NodeHealthUp {
+					return false
+				}
+			}
+			return query(dbs[i], key2) == ver2
+		}) {
+			t.Fatalf("Rolling Restart ER! %s not caught up after the restart", nodes[i].Addr)
+		}
+
+		if err := dbs[i].MaintenanceSet(false); err != nil {
+			t.Fatalf("Rolling Restart ER! %s", err.Error())
+		}
+	}
+
+	for _, db := range dbs {
+		if db.Maintenance() {
+			t.Fatalf("Rolling Restart ER! %s in maintenance", db.opts.Server.Bind)
+		}
+	}
+
+	t.Log("Rolling Restart OK")
+}
+
+func Test_Witness(t *testing.T) {
+
+	nodes := []*ClientConfig{
+		{Addr: "n1"},
+		{Addr: "n2"},
+		{Addr: "w1", Witness: true},
+	}
+
+	// the writes of 2 of 3 nodes must be on 1 data node at least
+	if n := witnessDataQuorum(nodes, 2); n != 1 {
+		t.Fatalf("witness data quorum %d", n)
+	}
+	if n := witnessDataQuorum(nodes, 3); n != 2 {
+		t.Fatalf("witness data quorum %d", n)
+	}
+
+	cfg := &ConfigCluster{
+		MainNodes: nodes,
+	}
+	for i := 0; i < 100; i++ {
+		for _, v := range cfg.keyMainNodes("main", []byte(fmt.Sprintf("key-%d", i)), 2) {
+			if v.witness() {
+				t.Fatal("request routed to the witness")
+			}
+		}
+	}
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+	cn.opts.Server.Bind = "w1"
+	cn.opts.Cluster.MainNodes = nodes
+	if !cn.nodeWitness() {
+		t.Fatal("witness node not found")
+	}
+
+	it := &InternalServiceImpl{
+		db:       cn,
+		prepares: map[string]*kv2.ObjectWriter{},
+	}
+
+	rr := &kv2.ObjectWriter{
+		Meta:      &kv2.ObjectMeta{Key: []byte("k")},
+		TableName: "main",
+	}
+	rs, err := it.witnessPrepare(rr)
+	if err != nil || rs.Meta.Version == 0 {
+		t.Fatalf("witness prepare %v", err)
+	}
+
+	if _, err := it.witnessPrepare(rr); err == nil {
+		t.Fatal("witness prepare of a pending proposal")
+	}
+
+	rr2 := &kv2.ObjectWriter{
+		Meta: &kv2.ObjectMeta{Key: []byte("k"), Version: rs.Meta.Version + 10},
+	}
+	if rs, err := it.witnessAccept(rr2); err != nil || rs.Meta.Version != rr2.Meta.Version {
+		t.Fatalf("witness accept %v", err)
+	}
+	if it.witnessVersions["main"] != rr2.Meta.Version {
+		t.Fatal("witness version not updated")
+	}
+}
+
+func Test_WitnessCommit(t *testing.T) {
+
+	var (
+		dirs  = []string{t.TempDir(), t.TempDir(), t.TempDir()}
+		nodes = []*ClientConfig{}
+		dbs   = make([]*Conn, len(dirs))
+	)
+	for i, port := range []int{20461, 20462, 20463} {
+		nodes = append(nodes, &ClientConfig{
+			Addr:      fmt.Sprintf("127.0.0.1:%d", port),
+			AccessKey: dbTestAccessKey,
+			Witness:   i == 2,
+		})
+	}
+
+	for i := range dirs {
+		cfg := NewConfig(dirs[i])
+		cfg.Server.Bind = nodes[i].Addr
+		cfg.Server.AccessKey = dbTestAccessKey
+		cfg.Cluster.MainNodes = nodes
+		db, err := Open(cfg)
+		if err != nil {
+			t.Fatalf("Open ER! %s", err.Error())
+		}
+		dbs[i] = db
+	}
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+
+	commit := func(db *Conn, key string) uint64 {
+		rs := db.Commit(kv2.NewObjectWriter([]byte(key), key).TableNameSet("main"))
+		if !rs.OK() {
+			t.Fatalf("Witness Commit ER! %s %s", key, rs.Message)
+		}
+		return rs.Meta.Version
+	}
+
+	query := func(db *Conn, key string) uint64 {
+		rs := db.objectLocalQuery(kv2.NewObjectReader([]byte(key)).TableNameSet("main"))
+		if !rs.OK() || len(rs.Items) == 0 || rs.DataValue().String() != key {
+			return 0
+		}
+		return rs.Items[0].Meta.Version
+	}
+
+	// all the nodes up, the write is on both data nodes and not on the
+	// witness
+	ver := commit(dbs[0], "witness-1")
+	for tn := time.Now(); query(dbs[1], "witness-1") != ver && time.Since(tn) < 10*time.Second; {
+		time.Sleep(100e6)
+	}
+	if query(dbs[0], "witness-1") != ver || query(dbs[1], "witness-1") != ver {
+		t.Fatal("Witness Commit ER! write not on the data nodes")
+	}
+	if query(dbs[2], "witness-1") != 0 {
+		t.Fatal("Witness Commit ER! data on the witness")
+	}
+	if rs := dbs[2].Commit(kv2.NewObjectWriter([]byte("witness-w"), "1")); rs.OK() {
+		t.Fatal("Witness Commit ER! write coordinated by the witness")
+	}
+
+	// one data node down, the quorum of the data node and the witness
+	// still commits the writes
+	dbs[1].Close()
+
+	for i := 2; i <= 5; i++ {
+		key := fmt.Sprintf("witness-%d", i)
+		if ver := commit(dbs[0], key); query(dbs[0], key) != ver {
+			t.Fatalf("Witness Commit ER! %s not read from the data node", key)
+		}
+		if query(dbs[2], key) != 0 {
+			t.Fatalf("Witness Commit ER! %s on the witness", key)
+		}
+	}
+	if query(dbs[0], "witness-1") != ver {
+		t.Fatal("Witness Commit ER! write lost")
+	}
+
+	t.Log("Witness Commit OK")
+}
+
+func Test_Maintenance(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts:  &Config{},
+		dbSys: db,
+	}
+
+	if cn.Maintenance() {
+		t.Fatal("maintenance on")
+	}
+
+	if err := cn.MaintenanceSet(true); err != nil {
+		t.Fatal(err)
+	}
+	if !cn.Maintenance() {
+		t.Fatal("maintenance off")
+	}
+	if err := cn.Ready(); err == nil {
+		t.Fatal("node in maintenance ready")
+	}
+
+	// the state is kept across restarts
+	cn2 := &Conn{
+		opts:  &Config{},
+		dbSys: db,
+	}
+	if err := cn2.maintenanceLoad(); err != nil || !cn2.Maintenance() {
+		t.Fatalf("maintenance not loaded %v", err)
+	}
+
+	if !nodeRefused(errMaintenance) {
+		t.Fatal("maintenance refused")
+	}
+	if nodeRefused(fmt.Errorf("node down")) {
+		t.Fatal("maintenance refused")
+	}
+
+	if err := cn2.MaintenanceSet(false); err != nil || cn2.Maintenance() {
+		t.Fatalf("maintenance on %v", err)
+	}
+	cn3 := &Conn{
+		opts:  &Config{},
+		dbSys: db,
+	}
+	if err := cn3.maintenanceLoad(); err != nil || cn3.Maintenance() {
+		t.Fatalf("maintenance loaded %v", err)
+	}
+}
+
+func Test_Ready(t *testing.T) {
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	probe := func(fn http.HandlerFunc, path string) (int, string) {
+		w := httptest.NewRecorder()
+		fn(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := probe(cn.httpHealthz, "/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Fatalf("healthz ER! %d %s", code, body)
+	}
+	if code, body := probe(cn.httpReadyz, "/readyz"); code != http.StatusOK || body != "ok\n" {
+		t.Fatalf("readyz ER! %d %s", code, body)
+	}
+
+	// the local node pulls the logs of the other main node n2
+	cn.members.mu.Lock()
+	cn.members.nodes = []*ClientConfig{
+		{Addr: cn.opts.Server.Bind},
+		{Addr: "127.0.0.1:1"},
+	}
+	cn.members.mu.Unlock()
+
+	// the probes use the cached offsets of n2, no one refreshed yet
+	tn := time.Now()
+	if code, _ := probe(cn.httpReadyz, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz ER! no peer offsets %d", code)
+	}
+	if d := time.Since(tn); d > time.Second {
+		t.Fatalf("readyz ER! probe %v", d)
+	}
+
+	setPeers := func(offset uint64, updated int64) {
+		cn.readyPeers.mu.Lock()
+		cn.readyPeers.peers = []*nodeStatusResult{{
+			Addr:    "127.0.0.1:1",
+			Offsets: map[string]uint64{"main": offset},
+		}}
+		cn.readyPeers.updated = updated
+		cn.readyPeers.mu.Unlock()
+	}
+
+	setPeers(hlcNow(), time.Now().Unix())
+	if code, body := probe(cn.httpReadyz, "/readyz"); code != http.StatusServiceUnavailable ||
+		!strings.Contains(body, "replication lag") {
+		t.Fatalf("readyz ER! lag %d %s", code, body)
+	}
+
+	// the stale offsets are not used
+	setPeers(hlcNow(), time.Now().Unix()-readyPeerStale-1)
+	if code, _ := probe(cn.httpReadyz, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz ER! stale peer offsets %d", code)
+	}
+
+	setPeers(0, time.Now().Unix())
+	if code, _ := probe(cn.httpReadyz, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz ER! no lag %d", code)
+	}
+
+	// the nodes not reachable are skipped by the refresh
+	setPeers(hlcNow(), time.Now().Unix())
+	if err := cn.readyPeerRefresh(); err != nil {
+		t.Fatalf("readyz ER! refresh %s", err.Error())
+	}
+	if ls := cn.readyPeerList(); ls == nil || len(ls) != 0 {
+		t.Fatalf("readyz ER! peers of refresh %d", len(ls))
+	}
+	if code, _ := probe(cn.httpReadyz, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz ER! node down %d", code)
+	}
+
+	if err := cn.MaintenanceSet(true); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := probe(cn.httpReadyz, "/readyz"); code != http.StatusServiceUnavailable ||
+		!strings.Contains(body, "in maintenance") {
+		t.Fatalf("readyz ER! maintenance %d %s", code, body)
+	}
+	if code, _ := probe(cn.httpHealthz, "/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz ER! maintenance %d", code)
+	}
+	cn.MaintenanceSet(false)
+
+	cn.members.mu.Lock()
+	cn.members.nodes = nil
+	cn.members.mu.Unlock()
+}
+
+func Test_Trigger(t *testing.T) {
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	var (
+		mu     sync.Mutex
+		events []*ChangeEvent
+		fails  = 1
+	)
+	fn := func(ls []*ChangeEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if fails > 0 {
+			fails -= 1
+			return errors.New("fail")
+		}
+		events = append(events, ls...)
+		return nil
+	}
+
+	// wait returns the keys of the events once n of them are delivered
+	wait := func(n int) []string {
+		for i := 0; i < 500; i++ {
+			mu.Lock()
+			if len(events) >= n {
+				var keys []string
+				for _, ev := range events {
+					if ev.Deleted {
+						keys = append(keys, string(ev.Key)+" deleted")
+					} else {
+						keys = append(keys, string(ev.Key))
+					}
+				}
+				events = nil
+				mu.Unlock()
+				return keys
+			}
+			mu.Unlock()
+			time.Sleep(10e6)
+		}
+		return nil
+	}
+
+	if err := cn.TriggerRegister("trigger test", "main", []byte("trg-a/"), fn); err == nil {
+		t.Fatal("trigger, invalid name")
+	}
+	if err := cn.TriggerRegister("trg", "main", []byte("trg-a/"), nil); err == nil {
+		t.Fatal("trigger, no func")
+	}
+	if err := cn.TriggerRegister("trg", "main", []byte("trg-a/"), fn); err != nil {
+		t.Fatal(err)
+	}
+	if err := cn.TriggerRegister("trg", "main", []byte("trg-a/"), fn); err == nil {
+		t.Fatal("trigger, registered twice")
+	}
+
+	for _, k := range []string{"trg-a/1", "trg-b/1", "trg-a/2"} {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(k), k).TableNameSet("main")); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("trg-a/1"), nil).
+		TableNameSet("main").ModeDeleteSet(true)); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+
+	// the failed delivery is retried, the keys of other prefixes are skipped,
+	// and the log keeps the last version of the deleted key
+	keys := wait(2)
+	if len(keys) != 2 || keys[0] != "trg-a/2" || keys[1] != "trg-a/1 deleted" {
+		t.Fatalf("trigger, events %v", keys)
+	}
+
+	// the offset delivered is resumed by the trigger registered again
+	cn.TriggerUnregister("trg")
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("trg-a/3"), "3").TableNameSet("main")); !rs.OK() {
+		t.Fatal(rs.Message)
+	}
+	if err := cn.TriggerRegister("trg", "main", []byte("trg-a/"), fn); err != nil {
+		t.Fatal(err)
+	}
+	if keys := wait(1); len(keys) != 1 || keys[0] != "trg-a/3" {
+		t.Fatalf("trigger, resumed events %v", keys)
+	}
+}
+
+// testKafkaBroker serves the Metadata and Produce requests of the kafka
+// sink, the bodies of the responses are returned by fn.
+func testKafkaBroker(t *testing.T, fn func(apiKey int16, rd *kafkaReader) []byte) string {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					head := make([]byte, 4)
+					if _, err := io.ReadFull(conn, head); err != nil {
+						return
+					}
+					bs := make([]byte, binary.BigEndian.Uint32(head))
+					if _, err := io.ReadFull(conn, bs); err != nil {
+						return
+					}
+					rd := &kafkaReader{bs: bs}
+					apiKey, _, correlationId := rd.int16(), rd.int16(), rd.int32()
+					rd.string()
+					body := binary.BigEndian.AppendUint32(nil, uint32(correlationId))
+					body = append(body, fn(apiKey, rd)...)
+					if _, err := conn.Write(kafkaBytes(nil, body)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+func Test_SinkKafka(t *testing.T) {
+
+	events := []*ChangeEvent{
+		{Table: "main", Key: []byte("sink-1"), Version: 1, Value: []byte("v1")},
+		{Table: "main", Key: []byte("sink-2"), Version: 2, Deleted: true},
+		{Table: "main", Key: []byte("sink-3"), Version: 3, Value: []byte("v3")},
+	}
+
+	// the record batch (magic 2) of the events
+	batch, err := kafkaRecordBatch(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := &kafkaReader{bs: batch}
+	if rd.int64() != 0 || int(rd.int32()) != len(batch)-12 {
+		t.Fatal("kafka, record batch length")
+	}
+	rd.int32()
+	if magic := rd.next(1)[0]; magic != 2 {
+		t.Fatalf("kafka, record batch magic %d", magic)
+	}
+	if crc := uint32(rd.int32()); crc != crc32.Checksum(rd.bs, kafkaCrcTable) {
+		t.Fatal("kafka, record batch crc")
+	}
+	rd.next(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	if n := rd.int32(); n != 3 {
+		t.Fatalf("kafka, record batch records %d", n)
+	}
+	for i, ev := range events {
+		varint := func() int64 {
+			v, n := binary.Varint(rd.bs)
+			rd.next(n)
+			return v
+		}
+		varint()
+		rd.next(1)
+		varint()
+		if delta := varint(); delta != int64(i) {
+			t.Fatalf("kafka, record offset delta %d", delta)
+		}
+		key := rd.next(int(varint()))
+		var ev2 ChangeEvent
+		if err := json.Unmarshal(rd.next(int(varint())), &ev2); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, ev.Key) || !bytes.Equal(ev2.Key, ev.Key) ||
+			ev2.Version != ev.Version || ev2.Deleted != ev.Deleted {
+			t.Fatalf("kafka, record %d", i)
+		}
+		varint()
+	}
+	if rd.err != nil || len(rd.bs) != 0 {
+		t.Fatal("kafka, record batch size")
+	}
+
+	// the metadata and produce responses of a broker of two partitions
+	var (
+		mu       sync.Mutex
+		produced = map[int32]int{}
+		code     int16
+		addr     string
+	)
+	brokerAddr := testKafkaBroker(t, func(apiKey int16, rd *kafkaReader) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if apiKey == kafkaApiMetadata {
+			host, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			bs := binary.BigEndian.AppendUint32(nil, 1)
+			bs = binary.BigEndian.AppendUint32(bs, 7)
+			bs = kafkaString(bs, host)
+			bs = binary.BigEndian.AppendUint32(bs, uint32(p))
+			bs = binary.BigEndian.AppendUint32(bs, 1)
+			bs = binary.BigEndian.AppendUint16(bs, 0)
+			bs = kafkaString(bs, "changes")
+			bs = binary.BigEndian.AppendUint32(bs, 2)
+			for _, id := range []uint32{1, 0} {
+				bs = binary.BigEndian.AppendUint16(bs, 0)
+				bs = binary.BigEndian.AppendUint32(bs, id)
+				bs = binary.BigEndian.AppendUint32(bs, 7)
+				// the null replicas, and the isr of one node
+				bs = binary.BigEndian.AppendUint32(bs, ^uint32(0))
+				bs = binary.BigEndian.AppendUint32(bs, 1)
+				bs = binary.BigEndian.AppendUint32(bs, 7)
+			}
+			return bs
+		}
+		rd.next(2 + 2 + 4 + 4)
+		topic := rd.string()
+		rd.int32()
+		partition := rd.int32()
+		batch := rd.next(int(rd.int32()))
+		if topic == "changes" && rd.err == nil {
+			produced[partition] += int(binary.BigEndian.Uint32(batch[57:]))
+		}
+		bs := binary.BigEndian.AppendUint32(nil, 1)
+		bs = kafkaString(bs, topic)
+		bs = binary.BigEndian.AppendUint32(bs, 1)
+		bs = binary.BigEndian.AppendUint32(bs, uint32(partition))
+		bs = binary.BigEndian.AppendUint16(bs, uint16(code))
+		bs = binary.BigEndian.AppendUint64(bs, 0)
+		bs = binary.BigEndian.AppendUint64(bs, 0)
+		return binary.BigEndian.AppendUint32(bs, 0)
+	})
+	mu.Lock()
+	addr = brokerAddr
+	mu.Unlock()
+
+	sink := &kafkaSink{
+		brokers: []string{"127.0.0.1:1", brokerAddr},
+		topic:   "changes",
+	}
+	if err := sink.send(events); err != nil {
+		t.Fatalf("kafka, send %v", err)
+	}
+	mu.Lock()
+	if len(sink.leaders) != 2 || sink.leaders[0] != 7 || sink.leaders[1] != 7 ||
+		produced[0]+produced[1] != 3 {
+		t.Fatalf("kafka, produced %v leaders %v", produced, sink.leaders)
+	}
+	// the partition error fails the send, and the metadata is refreshed
+	code = 6
+	mu.Unlock()
+
+	if err := sink.send(events); err == nil || sink.leaders != nil {
+		t.Fatal("kafka, partition error not returned")
+	}
+
+	mu.Lock()
+	code = 0
+	mu.Unlock()
+	if err := sink.send(events[:1]); err != nil || sink.leaders == nil {
+		t.Fatalf("kafka, send after error %v", err)
+	}
+
+	// the invalid lengths and indexes of the responses are errors
+	metadata := func(partitions []int32, arrays ...uint32) []byte {
+		bs := binary.BigEndian.AppendUint32(nil, 0)
+		bs = binary.BigEndian.AppendUint32(bs, 1)
+		bs = binary.BigEndian.AppendUint16(bs, 0)
+		bs = kafkaString(bs, "changes")
+		bs = binary.BigEndian.AppendUint32(bs, uint32(len(partitions)))
+		for _, p := range partitions {
+			bs = binary.BigEndian.AppendUint16(bs, 0)
+			bs = binary.BigEndian.AppendUint32(bs, uint32(p))
+			bs = binary.BigEndian.AppendUint32(bs, 1)
+			for _, n := range arrays {
+				bs = binary.BigEndian.AppendUint32(bs, n)
+			}
+		}
+		return bs
+	}
+	for i, bs := range [][]byte{
+		metadata([]int32{-1}, 0, 0),
+		metadata([]int32{0, 2}, 0, 0),
+		metadata([]int32{1 << 30}, 0, 0),
+		metadata([]int32{0}, ^uint32(1), 0),
+		metadata([]int32{0}, 1<<30, 0),
+		metadata([]int32{0}, 0),
+		metadata([]int32{}),
+		{0, 0, 0, 1, 0, 0, 0, 1, 0xff, 0xfe},
+		{0x7f, 0xff, 0xff, 0xff},
+		{},
+	} {
+		if _, _, err := kafkaMetadataDecode(&kafkaReader{bs: bs}, "changes"); err == nil {
+			t.Fatalf("kafka, invalid metadata %d decoded", i)
+		}
+	}
+	if _, leaders, err := kafkaMetadataDecode(&kafkaReader{bs: metadata([]int32{1, 0}, ^uint32(0), 0)},
+		"changes"); err != nil || len(leaders) != 2 {
+		t.Fatalf("kafka, metadata of null arrays %v", err)
+	}
+	for i, bs := range [][]byte{
+		{0, 0, 0, 1, 0, 1},
+		{0x7f, 0xff, 0xff, 0xff},
+		{0, 0, 0, 1, 0, 0, 0x7f, 0xff, 0xff, 0xff},
+	} {
+		if err := kafkaProduceDecode(&kafkaReader{bs: bs}, 0); err == nil {
+			t.Fatalf("kafka, invalid produce response %d decoded", i)
+		}
+	}
+}
+
+func Test_SinkNats(t *testing.T) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	var (
+		mu       sync.Mutex
+		connects []string
+		payloads []string
+		reply    = "PONG"
+		info     = "INFO {}"
+	)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				mu.Lock()
+				conn.Write([]byte(info + "\r\n"))
+				mu.Unlock()
+				rd := bufio.NewReader(conn)
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					switch {
+					case strings.HasPrefix(line, "CONNECT "):
+						connects = append(connects, strings.TrimSpace(line[8:]))
+					case strings.HasPrefix(line, "PUB sink.changes "):
+						n, _ := strconv.Atoi(strings.TrimSpace(line[17:]))
+						bs := make([]byte, n+2)
+						io.ReadFull(rd, bs)
+						payloads = append(payloads, string(bs[:n]))
+					case line == "PING\r\n":
+						// the ping of the server is answered before the pong
+						conn.Write([]byte("PING\r\n"))
+						if l, _ := rd.ReadString('\n'); l != "PONG\r\n" {
+							mu.Unlock()
+							return
+						}
+						conn.Write([]byte(reply + "\r\n"))
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+
+	sink := &natsSink{
+		addr:    "nats://kvgo:secret@" + lis.Addr().String(),
+		subject: "sink.changes",
+	}
+	events := []*ChangeEvent{
+		{Table: "main", Key: []byte("sink-1"), Version: 1},
+		{Table: "main", Key: []byte("sink-2"), Version: 2},
+	}
+
+	if err := sink.send(events); err != nil {
+		t.Fatalf("nats, send %v", err)
+	}
+
+	mu.Lock()
+	var opts map[string]interface{}
+	if len(connects) != 1 || json.Unmarshal([]byte(connects[0]), &opts) != nil ||
+		opts["user"] != "kvgo" || opts["pass"] != "secret" || opts["verbose"] != false {
+		t.Fatalf("nats, connect %v", connects)
+	}
+	if len(payloads) != 2 || !strings.Contains(payloads[1], `"version":2`) {
+		t.Fatalf("nats, payloads %v", payloads)
+	}
+	reply = "-ERR 'Permissions Violation'"
+	mu.Unlock()
+
+	// the error of the server fails the send, and the next one reconnects
+	if err := sink.send(events); err == nil || sink.conn != nil {
+		t.Fatal("nats, server error not returned")
+	}
+
+	mu.Lock()
+	reply = "PONG"
+	mu.Unlock()
+	if err := sink.send(events[:1]); err != nil {
+		t.Fatalf("nats, send after error %v", err)
+	}
+	mu.Lock()
+	if len(connects) != 2 || len(payloads) != 5 {
+		t.Fatalf("nats, reconnect %d %d", len(connects), len(payloads))
+	}
+	sink.conn.Close()
+	sink.conn = nil
+
+	// the protocol lines longer than the max are refused
+	info = "INFO " + strings.Repeat("x", natsLineMax)
+	mu.Unlock()
+	if err := sink.send(events); err != errNatsLine {
+		t.Fatalf("nats, long line %v", err)
+	}
+}
+
+func Test_ReplicaLag(t *testing.T) {
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+
+	tn := time.Now().Unix()
+	cn.replicaLags.lags = map[string]*ReplicaLag{
+		"n2": {Addr: "n2", PullLag: 5000, PeerLag: 3000, Updated: tn},
+		"n3": {Addr: "n3", PullLag: 100, PeerLag: 200, Updated: tn},
+		"n4": {Addr: "n4", PullLag: 90000, PeerLag: 0, Updated: tn - 600},
+	}
+
+	if ls := cn.ReplicationLags(); len(ls) != 2 || ls[0].Addr != "n2" {
+		t.Fatal("replication lags")
+	}
+
+	// disabled by default
+	if cn.replicaLagRead() != nil || cn.replicaLagThrottle() != 0 {
+		t.Fatal("replication lag limits enabled")
+	}
+
+	cn.opts.Cluster.ReadLagTime = 1000
+	if err := cn.replicaLagRead(); err == nil || !nodeRefused(err) {
+		t.Fatal("lagging node ready for reads")
+	}
+	cn.opts.Cluster.ReadLagTime = 10000
+	if err := cn.replicaLagRead(); err != nil {
+		t.Fatal(err)
+	}
+
+	// one of the peers caught up
+	cn.opts.Cluster.ThrottleLagTime = 1000
+	if d := cn.replicaLagThrottle(); d != 0 {
+		t.Fatalf("writes throttled %v", d)
+	}
+
+	cn.replicaLags.lags["n3"].PeerLag = 2000
+	if d := cn.replicaLagThrottle(); d != 100*time.Millisecond {
+		t.Fatalf("writes throttled %v", d)
+	}
+}
+
+func Test_LogRetention(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tdb := &dbTable{db: db, tableName: "main"}
+
+	if err := tdb.logCompactedCheck(5); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put(keySysLogCompacted, []byte("100"), nil)
+
+	if err := tdb.logCompactedCheck(50); err == nil || !logCompactedError(err.Error()) {
+		t.Fatal("pull of the compacted log")
+	}
+	for _, offset := range []uint64{0, 100, 200} {
+		if err := tdb.logCompactedCheck(offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+	cn.opts.Server.Bind = "n1"
+	for _, v := range []string{"n1", "n2", "n3"} {
+		cn.opts.Cluster.MainNodes = append(cn.opts.Cluster.MainNodes, &ClientConfig{
+			Addr: v,
+		})
+	}
+
+	tn := time.Now().Unix()
+	cn.replicaLags.lags = map[string]*ReplicaLag{
+		"n2": {Addr: "n2", Updated: tn, offsets: map[string]uint64{"main": 300}},
+		"n3": {Addr: "n3", Updated: tn, offsets: map[string]uint64{"main": 200}},
+	}
+	if n := cn.logRetentionSafeOffset("main"); n != 200 {
+		t.Fatalf("log retention safe offset %d", n)
+	}
+
+	// the deletes are kept for the nodes not reachable
+	delete(cn.replicaLags.lags, "n3")
+	if n := cn.logRetentionSafeOffset("main"); n != 0 {
+		t.Fatalf("log retention safe offset %d", n)
+	}
+}
+
+func Test_GetMeta(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts: &Config{},
+		tables: map[string]*dbTable{
+			"main": {db: db, tableName: "main"},
+		},
+	}
+
+	if meta, err := cn.GetMeta("main", []byte("k1")); err != nil || meta != nil {
+		t.Fatalf("meta of the key not found %v", err)
+	}
+
+	if _, err := cn.GetMeta("none", []byte("k1")); err == nil {
+		t.Fatal("meta of the table not found")
+	}
+
+	if tm := metaTime(1500); !tm.Equal(time.Unix(1, 5e8)) {
+		t.Fatalf("meta time %v", tm)
+	}
+	if tm := metaTime(0); !tm.IsZero() {
+		t.Fatalf("meta time %v", tm)
+	}
+}
+
+func Test_Attrs(t *testing.T) {
+
+	ow := kv2.NewObjectWriter([]byte("k1"), "v1")
+	ow.Meta.Attrs = kv2.ObjectMetaAttrMetaOff
+
+	AttrsSet(ow, AttrHidden|AttrUser|1)
+	if ow.Meta.Attrs != kv2.ObjectMetaAttrMetaOff|AttrHidden|AttrUser {
+		t.Fatalf("attrs %x", ow.Meta.Attrs)
+	}
+	if Attrs(ow.Meta) != AttrHidden|AttrUser {
+		t.Fatalf("attrs %x", Attrs(ow.Meta))
+	}
+
+	AttrsSet(ow, AttrEncrypted)
+	if Attrs(ow.Meta) != AttrEncrypted || !kv2.AttrAllow(ow.Meta.Attrs, kv2.ObjectMetaAttrMetaOff) {
+		t.Fatalf("attrs %x", ow.Meta.Attrs)
+	}
+
+	if Attrs(nil) != 0 {
+		t.Fatal("attrs of nil meta")
+	}
+}
+
+func Test_Immutable(t *testing.T) {
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+	cn.opts.Feature.ImmutablePrefixes = []*ConfigImmutablePrefix{
+		{Table: "main", Prefix: "blob/"},
+	}
+
+	ow := kv2.NewObjectWriter([]byte("k1"), "v1")
+	ow.TableName = "main"
+
+	// new keys
+	if err := cn.immutableCheck(ow, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := &kv2.ObjectMeta{Key: []byte("k1"), Version: 1}
+	if err := cn.immutableCheck(ow, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	meta.Attrs = AttrImmutable
+	if err := cn.immutableCheck(ow, meta); err != ErrImmutable {
+		t.Fatal("overwrite of the immutable key")
+	}
+
+	ow.Mode = kv2.ObjectWriterModeDelete
+	if err := cn.immutableCheck(ow, meta); err != nil {
+		t.Fatal("delete of the immutable key")
+	}
+
+	ow2 := kv2.NewObjectWriter([]byte("blob/0a1b"), "v1")
+	ow2.TableName = "main"
+	if err := cn.immutableCheck(ow2, &kv2.ObjectMeta{Version: 1}); err != ErrImmutable {
+		t.Fatal("overwrite of the immutable prefix")
+	}
+	ow2.TableName = "other"
+	if err := cn.immutableCheck(ow2, &kv2.ObjectMeta{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(WriteForceMetadataKey, "true"))
+	if !writeForceIncoming(ctx) || writeForceIncoming(context.Background()) {
+		t.Fatal("write force metadata")
+	}
+}
+
+func Test_CasHash(t *testing.T) {
+
+	hash := casHash([]byte("abc"))
+	if hash != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Fatalf("cas hash %s", hash)
+	}
+
+	if err := casHashValid(hash); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"", "abc", hash[:62], hash + "00", "../" + hash[3:]} {
+		if err := casHashValid(v); err == nil {
+			t.Fatalf("invalid cas hash %s", v)
+		}
+	}
+
+	if string(casKeyBlob(hash)) == string(casKeyRef(hash)) {
+		t.Fatal("cas keys")
+	}
+}
+
+func Test_CasRefs(t *testing.T) {
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	value := []byte("cas-value")
+
+	// the same value is stored once with two references
+	var hashes [2]string
+	for i := range hashes {
+		if hashes[i], err = cn.PutCAS(value); err != nil {
+			t.Fatalf("cas put ER! %s", err.Error())
+		}
+	}
+	if hashes[0] != casHash(value) || hashes[1] != hashes[0] {
+		t.Fatalf("cas put ER! hashes %v", hashes)
+	}
+
+	refs := func() uint64 {
+		var n uint64
+		if err := cn.txnLocal(nil, func(tx *Txn) error {
+			var err error
+			n, err = casRefs(tx, cn.opts.Feature.CasTable, hashes[0])
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := refs(); n != 2 {
+		t.Fatalf("cas put ER! refs %d", n)
+	}
+
+	// the blob is kept until the last reference is released
+	if err := cn.ReleaseCAS(hashes[0]); err != nil {
+		t.Fatalf("cas release ER! %s", err.Error())
+	}
+	if n := refs(); n != 1 {
+		t.Fatalf("cas release ER! refs %d", n)
+	}
+	if bs, err := cn.GetCAS(hashes[0]); err != nil || string(bs) != string(value) {
+		t.Fatalf("cas get ER! %q %v", bs, err)
+	}
+
+	if err := cn.ReleaseCAS(hashes[0]); err != nil {
+		t.Fatalf("cas release ER! %s", err.Error())
+	}
+	if n := refs(); n != 0 {
+		t.Fatalf("cas release ER! refs %d", n)
+	}
+	if _, err := cn.GetCAS(hashes[0]); err != ErrNotFound {
+		t.Fatalf("cas get ER! released blob %v", err)
+	}
+	if err := cn.ReleaseCAS(hashes[0]); err != ErrNotFound {
+		t.Fatalf("cas release ER! released blob %v", err)
+	}
+	if err := cn.ReleaseCAS("none"); err == nil {
+		t.Fatal("cas release ER! invalid hash")
+	}
+
+	// a released value is stored again by the next put
+	if hash, err := cn.PutCAS(value); err != nil || hash != hashes[0] || refs() != 1 {
+		t.Fatalf("cas put ER! %v", err)
+	}
+	if bs, err := cn.GetCAS(hashes[0]); err != nil || string(bs) != string(value) {
+		t.Fatalf("cas get ER! %q %v", bs, err)
+	}
+
+	// not supported in cluster mode
+	cluster := &Conn{
+		opts: &Config{},
+	}
+	cluster.opts.Cluster.MainNodes = []*ClientConfig{{Addr: "n1"}, {Addr: "n2"}}
+	if _, err := cluster.PutCAS(value); err != errCasCluster {
+		t.Fatalf("cas put ER! cluster mode %v", err)
+	}
+	if err := cluster.ReleaseCAS(hashes[0]); err != errCasCluster {
+		t.Fatalf("cas release ER! cluster mode %v", err)
+	}
+}
+
+func Test_CasGC(t *testing.T) {
+
+	cfg := (&Config{}).Reset()
+	if cfg.Feature.CasGcInterval != 3600 {
+		t.Fatalf("cas gc interval %d", cfg.Feature.CasGcInterval)
+	}
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+	cn.opts.Cluster.MainNodes = []*ClientConfig{{Addr: "n1"}, {Addr: "n2"}}
+
+	if _, err := cn.CasGC(); err == nil {
+		t.Fatal("cas gc in cluster mode")
+	}
+
+	if stats := cn.casStats(); stats.Blobs != 0 || stats.DedupRatio != 0 {
+		t.Fatal("cas stats before gc")
+	}
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	table := cn.opts.Feature.CasTable
+
+	// two referenced values, one of them with two references
+	var refs []string
+	for _, v := range []string{"cas-ref-1", "cas-ref-1", "cas-ref-2"} {
+		hash, err := cn.PutCAS([]byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, hash)
+	}
+
+	// the orphans left by the crashes, the blobs written without a counter
+	var orphans []string
+	if err := cn.txnInternal(nil, func(tx *Txn) error {
+		for _, v := range []string{"cas-orphan-1", "cas-orphan-22"} {
+			hash := casHash([]byte(v))
+			if err := tx.Put(table, casKeyBlob(hash), []byte(v)); err != nil {
+				return err
+			}
+			orphans = append(orphans, hash)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := cn.CasGC()
+	if err != nil {
+		t.Fatalf("cas gc ER! %s", err.Error())
+	}
+	if stats.Blobs != 2 || stats.Refs != 3 || stats.Bytes != 18 ||
+		stats.LogicalBytes != 27 || stats.DedupRatio != 1.5 ||
+		stats.Orphans != 2 || stats.ReclaimedBytes != 25 {
+		t.Fatalf("cas gc ER! stats %+v", stats)
+	}
+	if s := cn.casStats(); *s != *stats {
+		t.Fatalf("cas gc ER! stats %+v", s)
+	}
+
+	for _, hash := range refs {
+		if _, err := cn.GetCAS(hash); err != nil {
+			t.Fatalf("cas gc ER! referenced blob %s removed", hash)
+		}
+	}
+	for _, hash := range orphans {
+		if _, err := cn.GetCAS(hash); err != ErrNotFound {
+			t.Fatalf("cas gc ER! orphan blob %s kept", hash)
+		}
+	}
+
+	// nothing is removed by the next collection
+	if stats, err = cn.CasGC(); err != nil || stats.Orphans != 0 ||
+		stats.Blobs != 2 || stats.ReclaimedBytes != 25 {
+		t.Fatalf("cas gc ER! %+v %v", stats, err)
+	}
+}
+
+func Test_BinaryKeys(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := [][]byte{
+		{},
+		{0x00},
+		{0x00, 0x00},
+		{0x00, 0xff},
+		{nsKeyMeta},
+		{nsKeyData, 0x00},
+		[]byte("a"),
+		{'a', 0xff},
+		{'a', 0xff, 0xff, 0x01},
+		{0xff},
+		{0xff, 0xff, 0xff},
+	}
+	for _, k := range keys {
+		db.Put(keyEncode(nsKeyData, k), []byte{1}, nil)
+		db.Put(historyKeyEncode(k, 1), []byte{1}, nil)
+		if k2, v, err := historyKeyDecode(historyKeyEncode(k, 7)); err != nil ||
+			string(k2) != string(k) || v != 7 {
+			t.Fatalf("history key %v", k)
+		}
+	}
+	db.Put([]byte{nsKeyData + 1}, []byte{1}, nil)
+
+	count := func(rg *util.Range) int {
+		iter := db.NewIterator(rg, nil)
+		defer iter.Release()
+		n := 0
+		for iter.Next() {
+			n += 1
+		}
+		return n
+	}
+
+	if n := count(&util.Range{
+		Start: keyEncode(nsKeyData, nil),
+		Limit: keyPrefixLimit(keyEncode(nsKeyData, nil)),
+	}); n != len(keys) {
+		t.Fatalf("binary keys scan %d", n)
+	}
+
+	if n := count(&util.Range{
+		Start: keyEncode(nsKeyData, []byte("a")),
+		Limit: keyPrefixLimit(keyEncode(nsKeyData, []byte("a"))),
+	}); n != 3 {
+		t.Fatalf("binary keys prefix scan %d", n)
+	}
+
+	if n := count(&util.Range{
+		Start: historyKeyPrefix([]byte{0xff}, false),
+		Limit: keyPrefixLimit(historyKeyPrefix([]byte{0xff}, false)),
+	}); n != 2 {
+		t.Fatalf("binary keys history scan %d", n)
+	}
+
+	// the ranges of the prefixes (NsKeyRange, the sys tables, the rewrite
+	// and dump scans) include the keys with 0xff bytes after the prefix
+	offset, cutset := NsKeyRange("ns")
+	for _, k := range [][]byte{
+		append(bytesClone(offset), 0xff),
+		append(bytesClone(offset), 0xff, 0xff, 0x01),
+		append(nsSysTable("t1"), 0xff),
+		append(nsSysTable(""), 0xff, 0xff),
+	} {
+		db.Put(keyEncode(nsKeyData, k), []byte{1}, nil)
+	}
+	db.Put(keyEncode(nsKeyData, NsKey("nsz")), []byte{1}, nil)
+
+	if n := count(&util.Range{
+		Start: keyEncode(nsKeyData, offset),
+		Limit: keyPrefixLimit(keyEncode(nsKeyData, cutset)),
+	}); n != 2 {
+		t.Fatalf("binary keys ns range scan %d", n)
+	}
+
+	if n := count(&util.Range{
+		Start: keyEncode(nsKeyData, nsSysTable("")),
+		Limit: keyPrefixLimit(keyEncode(nsKeyData, nsSysTable(""))),
+	}); n != 2 {
+		t.Fatalf("binary keys sys table scan %d", n)
+	}
+
+	if !keyInternal(casKeyBlob(casHash([]byte("abc")))) || keyInternal([]byte("cas:blob:")) ||
+		keyInternal([]byte{0x00}) {
+		t.Fatal("internal keys")
+	}
+}
+
+func Test_KeyInternal(t *testing.T) {
+
+	cn, err := Open(NewConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	key := keyInternalEncode("test")
+
+	// the reserved keys are refused by all the public writes
+	if rs := cn.Commit(kv2.NewObjectWriter(key, "1")); rs.OK() {
+		t.Fatal("internal keys, commit")
+	}
+	if rs := cn.CommitForce(kv2.NewObjectWriter(key, "1")); rs.OK() {
+		t.Fatal("internal keys, commit force")
+	}
+	if rs := cn.BatchCommit(&kv2.BatchRequest{
+		Items: []*kv2.BatchItem{
+			{Writer: kv2.NewObjectWriter([]byte("internal-1"), "1")},
+			{Writer: kv2.NewObjectWriter(key, "1")},
+		},
+	}); rs.OK() {
+		t.Fatal("internal keys, batch commit")
+	}
+	if err := cn.BatchLoad(func(bl *BatchLoader) error {
+		if rs := bl.Commit(kv2.NewObjectWriter(key, "1")); rs.OK() {
+			t.Fatal("internal keys, batch load")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cn.Merge("main", key, MergeOperatorAppend, []byte("1")); err == nil {
+		t.Fatal("internal keys, merge")
+	}
+	if err := cn.txnLocal(nil, func(tx *Txn) error {
+		return tx.Put("main", key, []byte("1"))
+	}); err != errKeyInternal {
+		t.Fatalf("internal keys, transaction %v", err)
+	}
+	if _, err := cn.ScriptEval(ScriptLua, []byte(`kv.put("main", ARGV[1], "1")`), key); err == nil {
+		t.Fatal("internal keys, script")
+	}
+
+	if rs := cn.NewReader([]byte("internal-1")).Query(); !rs.NotFound() {
+		t.Fatal("internal keys, batch partially committed")
+	}
+	if rs := cn.NewReader(key).Query(); !rs.NotFound() {
+		t.Fatal("internal keys, written")
+	}
+
+	// the internal writes of kvgo
+	if err := cn.txnInternal(nil, func(tx *Txn) error {
+		return tx.Put("main", key, []byte("1"))
+	}); err != nil {
+		t.Fatalf("internal keys, internal transaction %v", err)
+	}
+	if rs := cn.commit(kv2.NewObjectWriter(key, "2")); !rs.OK() {
+		t.Fatalf("internal keys, internal commit %s", rs.Message)
+	}
+	if rs := cn.NewReader(key).Query(); !rs.OK() || rs.DataValue().String() != "2" {
+		t.Fatal("internal keys, internal writes")
+	}
+}
+
+func Test_SystemScan(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts:   &Config{},
+		tables: map[string]*dbTable{},
+	}
+	cn.tables["main"] = &dbTable{db: db, tableName: "main"}
+
+	for i := 0; i < 5; i++ {
+		db.Put(keyEncode(nsKeyLog, uint64ToBytes(uint64(i+1))), []byte{1}, nil)
+	}
+	db.Put(keyEncode(nsKeyData, []byte("user")), []byte{1}, nil)
+	db.Put(keyEncode(nsKeyData, casKeyBlob("x")), []byte{2}, nil)
+	db.Put(keyEncode(nsKeyData, casKeyRef("x")), []byte{3}, nil)
+
+	ret, err := cn.systemScanLocal(&systemScanRequest{Space: "log", Limit: 3})
+	if err != nil || len(ret.Items) != 3 || !ret.Next {
+		t.Fatal("system scan log")
+	}
+
+	ret, err = cn.systemScanLocal(&systemScanRequest{Space: "log", Offset: ret.Items[2].Key})
+	if err != nil || len(ret.Items) != 2 || ret.Next ||
+		string(ret.Items[0].Key) != string(uint64ToBytes(4)) {
+		t.Fatal("system scan log offset")
+	}
+
+	ret, err = cn.systemScanLocal(&systemScanRequest{Space: "internal"})
+	if err != nil || len(ret.Items) != 2 ||
+		string(keyInternalEncode(string(ret.Items[0].Key))) != string(casKeyBlob("x")) {
+		t.Fatal("system scan internal")
+	}
+
+	if _, err := cn.systemScanLocal(&systemScanRequest{Space: "data"}); err == nil {
+		t.Fatal("system scan of user keys")
+	}
+	if _, err := cn.systemScanLocal(&systemScanRequest{Table: "t2", Space: "log"}); err == nil {
+		t.Fatal("system scan of table not found")
+	}
+}
+
+func Test_DataDirs(t *testing.T) {
+
+	var (
+		root   = t.TempDir()
+		walDir = filepath.Join(root, "wal")
+		extras = []string{filepath.Join(root, "data-2"), filepath.Join(root, "data-3")}
+	)
+
+	open := func() (*Conn, error) {
+		cfg := NewConfig(filepath.Join(root, "data"))
+		cfg.Storage.WalDirectory = walDir
+		cfg.Storage.ExtraDataDirectories = extras
+		return Open(cfg)
+	}
+
+	cn, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the values are not compressed, so the compaction writes several files
+	for i := 0; i < 10000; i++ {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(fmt.Sprintf("dirs-%05d", i)), randHexString(500)).
+			TableNameSet("main")); !rs.OK() {
+			cn.Close()
+			t.Fatalf("Commit ER! %s", rs.Message)
+		}
+	}
+
+	tdb := cn.tabledb("main")
+	if err := tdb.db.CompactRange(util.Range{}); err != nil {
+		cn.Close()
+		t.Fatal(err)
+	}
+
+	// the writes after the compaction are only in the journal
+	if rs := cn.Commit(kv2.NewObjectWriter([]byte("dirs-journal"), "1").
+		TableNameSet("main")); !rs.OK() {
+		cn.Close()
+		t.Fatalf("Commit ER! %s", rs.Message)
+	}
+
+	var (
+		name    = filepath.Base(dbTableDir(cn.opts.Storage.DataDirectory, tdb.tableId))
+		dataDir = dbTableDir(cn.opts.Storage.DataDirectory, tdb.tableId)
+	)
+	cn.Close()
+
+	// the journal files are kept in the wal directory
+	if ls, _ := filepath.Glob(filepath.Join(walDir, name, "*.log")); len(ls) == 0 {
+		t.Fatal("data dirs, no journal in the wal directory")
+	}
+	if ls, _ := filepath.Glob(filepath.Join(dataDir, "*.log")); len(ls) > 0 {
+		t.Fatal("data dirs, journal in the data directory")
+	}
+
+	// the table files are spread over the data directories by their numbers
+	var (
+		dirs = []string{dataDir, filepath.Join(extras[0], name), filepath.Join(extras[1], name)}
+		used = map[string]bool{}
+	)
+	for _, dir := range dirs {
+		ls, _ := filepath.Glob(filepath.Join(dir, "*.ldb"))
+		for _, file := range ls {
+			num, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), ".ldb"), 10, 64)
+			if dirs[num%int64(len(dirs))] != dir {
+				t.Fatalf("data dirs, table file %s misplaced", file)
+			}
+			used[dir] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Fatal("data dirs, table files not spread")
+	}
+
+	if cn, err = open(); err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for _, key := range []string{"dirs-00000", "dirs-05000", "dirs-09999", "dirs-journal"} {
+		if rs := cn.NewReader([]byte(key)).TableNameSet("main").Query(); !rs.OK() {
+			t.Fatalf("data dirs, %s not found after reopen", key)
+		}
+	}
+}
+
+func Test_Migration(t *testing.T) {
+
+	open := func() *leveldb.DB {
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	// the created tables are marked with the current version
+	db := open()
+	defer db.Close()
+	if err := dbMigrate("t1", db, true); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dataFormatVersionGet(db); err != nil || v != dataFormatVersion {
+		t.Fatalf("migration, created version %d", v)
+	}
+
+	migrations := dataMigrations
+	defer func() {
+		dataMigrations = migrations
+	}()
+
+	// the pending migrations run once, in order of their versions
+	var runs []string
+	dataMigrations = []*dataMigration{{
+		from: 0,
+		name: "test",
+		run: func(db *leveldb.DB) error {
+			runs = append(runs, "test")
+			return db.Put(append([]byte{nsKeySys}, "migrated"...), []byte("1"), nil)
+		},
+	}}
+
+	db2 := open()
+	defer db2.Close()
+	for i := 0; i < 2; i++ {
+		if err := dbMigrate("t2", db2, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := dataFormatVersionGet(db2); v != dataFormatVersion || len(runs) != 1 {
+		t.Fatalf("migration, version %d, runs %d", v, len(runs))
+	}
+	if _, err := db2.Get(append([]byte{nsKeySys}, "migrated"...), nil); err != nil {
+		t.Fatal("migration, not run")
+	}
+
+	// the failed checks stop all migrations, the failed runs keep the version
+	for _, m := range []*dataMigration{
+		{from: 0, check: func(db *leveldb.DB) error { return errors.New("check") },
+			run: func(db *leveldb.DB) error { runs = append(runs, "check"); return nil }},
+		{from: 0, run: func(db *leveldb.DB) error { return errors.New("run") }},
+	} {
+		dataMigrations = []*dataMigration{m}
+		db3 := open()
+		if err := dbMigrate("t3", db3, false); err == nil {
+			t.Fatal("migration, fail not returned")
+		}
+		if v, _ := dataFormatVersionGet(db3); v != 0 || len(runs) != 1 {
+			t.Fatalf("migration, version %d after fail", v)
+		}
+		db3.Close()
+	}
+
+	// no migration path
+	dataMigrations = nil
+	db4 := open()
+	defer db4.Close()
+	if err := dbMigrate("t4", db4, false); err == nil || !strings.Contains(err.Error(), "no migration path") {
+		t.Fatal("migration, no path")
+	}
+
+	// the tables of a newer release are not opened
+	dataFormatVersionSet(db4, dataFormatVersion+1)
+	if err := dbMigrate("t4", db4, false); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatal("migration, newer version")
+	}
+}
+
+func Test_DataLayout(t *testing.T) {
+
+	dir := t.TempDir()
+
+	if err := dataLayoutSetup(dir); err != nil {
+		t.Fatal(err)
+	}
+	layout, err := dataLayoutGet(dir)
+	if err != nil || layout.Version != dataLayoutVersion ||
+		layout.Engine != dataLayoutEngine || layout.Release != Version {
+		t.Fatal("data layout")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, dataLayoutFile),
+		[]byte(fmt.Sprintf(`{"version":%d,"engine":"goleveldb"}`, dataLayoutVersion+1)), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := dataLayoutSetup(dir); err == nil {
+		t.Fatal("open of newer layout")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, dataLayoutFile), []byte(`{"version":1,"engine":"rocksdb"}`), 0640)
+	if err := dataLayoutSetup(dir); err == nil {
+		t.Fatal("open of another engine")
+	}
+
+	if _, err := Inspect(filepath.Join(dir, "none")); err == nil {
+		t.Fatal("inspect of directory not found")
+	}
+
+	if v := dbTableDir("/data/kvgo/", 10); v != "/data/kvgo/10_0_0" ||
+		!dataLayoutTableDirReg.MatchString(filepath.Base(v)) {
+		t.Fatalf("table dir %s", v)
+	}
+}
+
+func Test_TableStats(t *testing.T) {
+
+	st := &leveldb.DBStats{
+		LevelTablesCounts: []int{5, 3, 0, 1},
+		LevelSizes:        leveldb.Sizes{8 << 20, 130 << 20, 0, 50 << 20},
+		LevelWrite:        leveldb.Sizes{10 << 20, 40 << 20, 0, 50 << 20},
+	}
+
+	ts := tableStatsBuild("main", st)
+	if len(ts.Levels) != 4 || ts.Size != 188<<20 {
+		t.Fatal("table stats levels")
+	}
+
+	// 5 tables of level 0, and one table of the level 1 and 3
+	if ts.ReadAmp != 7 {
+		t.Fatalf("table stats read amp %d", ts.ReadAmp)
+	}
+
+	if ts.WriteAmp != 10 {
+		t.Fatalf("table stats write amp %f", ts.WriteAmp)
+	}
+
+	// level 0 over the trigger, level 1 over 100 MiB by 30 MiB, level 3
+	// under 10 GiB
+	if ts.PendingCompaction != 38<<20 {
+		t.Fatalf("table stats pending compaction %d", ts.PendingCompaction)
+	}
+}
+
+func Test_MemoryBudget(t *testing.T) {
+
+	mb := newMemoryBudget(1000)
+	mb.tablesSet(4)
+
+	var (
+		blockCache  = mb.blockCache
+		writeBuffer = mb.writeBuffer
+		opts        = []*opt.Options{}
+	)
+
+	for i := 0; i < 4+memoryBudgetTableSpare+1; i++ {
+		o := &opt.Options{}
+		mb.tableOptionsSet(o)
+		opts = append(opts, o)
+	}
+
+	// the tables of the node and the spare ones take equal shares
+	for i := 1; i < 4+memoryBudgetTableSpare; i++ {
+		if opts[i].BlockCacheCapacity != opts[0].BlockCacheCapacity ||
+			opts[i].WriteBuffer != opts[0].WriteBuffer {
+			t.Fatalf("MemoryBudget ER! table %d share %d/%d, expect %d/%d", i,
+				opts[i].BlockCacheCapacity, opts[i].WriteBuffer,
+				opts[0].BlockCacheCapacity, opts[0].WriteBuffer)
+		}
+	}
+	if n := int64(opts[0].BlockCacheCapacity); n != blockCache/(4+memoryBudgetTableSpare) {
+		t.Fatalf("MemoryBudget ER! block cache %d", n)
+	}
+
+	var sumBlockCache, sumWriteBuffer int64
+	for _, o := range opts[:4+memoryBudgetTableSpare] {
+		sumBlockCache += int64(o.BlockCacheCapacity)
+		sumWriteBuffer += 2 * int64(o.WriteBuffer)
+	}
+	if sumBlockCache > blockCache || sumWriteBuffer > writeBuffer {
+		t.Fatalf("MemoryBudget ER! over budget %d/%d %d/%d",
+			sumBlockCache, blockCache, sumWriteBuffer, writeBuffer)
+	}
+
+	// the tables out of the budget get the minimum sizes
+	if o := opts[len(opts)-1]; o.BlockCacheCapacity != 8*opt.MiB || o.WriteBuffer != 4*opt.MiB {
+		t.Fatalf("MemoryBudget ER! table out of budget %d/%d", o.BlockCacheCapacity, o.WriteBuffer)
+	}
+}
+
+func Test_CompactionPacer(t *testing.T) {
+
+	var nilPacer *compactionPacer
+	nilPacer.observe(time.Second)
+	if nilPacer.Throttled() || nilPacer.delay(1<<20) != 0 || newCompactionPacer(0) != nil {
+		t.Fatal("disabled compaction pacer")
+	}
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	p := newCompactionPacer(1000)
+	for i := 0; i < 100; i++ {
+		p.observe(5 * time.Millisecond)
+	}
+	if p.Latency() <= 1000 {
+		t.Fatalf("compaction pacer latency %d", p.Latency())
+	}
+
+	p.refresh([]*leveldb.DB{db})
+	if !p.Throttled() {
+		t.Fatal("compaction pacer throttle over the target")
+	}
+	if d := p.delay(compactionPacerRate / 64); d != time.Second/64 {
+		t.Fatalf("compaction pacer delay %v", d)
+	}
+	if d := p.delay(compactionPacerRate); d != compactionPacerSleepMax {
+		t.Fatalf("compaction pacer delay max %v", d)
+	}
+
+	for i := 0; i < 200; i++ {
+		p.observe(100 * time.Microsecond)
+	}
+	p.refresh([]*leveldb.DB{db})
+	if p.Throttled() || p.delay(1<<20) != 0 {
+		t.Fatal("compaction pacer throttle under the target")
+	}
+}
+
+func Test_CompactionWorkers(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), &opt.Options{
+		WriteBuffer:           64 * opt.KiB,
+		CompactionTableSize:   32 * opt.KiB,
+		CompactionTotalSize:   128 * opt.KiB,
+		CompactionConcurrency: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var (
+		value = bytes.Repeat([]byte("v"), 100)
+		keys  = map[string]string{}
+	)
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 5000; i++ {
+			k := fmt.Sprintf("key-%06d", rand.Intn(10000))
+			if rand.Intn(5) == 0 {
+				db.Delete([]byte(k), nil)
+				delete(keys, k)
+				continue
+			}
+			v := fmt.Sprintf("%s-%d-%d", value, round, i)
+			db.Put([]byte(k), []byte(v), nil)
+			keys[k] = v
+		}
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	num := 0
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		if keys[string(iter.Key())] != string(iter.Value()) {
+			t.Fatalf("compaction workers, key %s", string(iter.Key()))
+		}
+		num += 1
+	}
+	iter.Release()
+
+	if num != len(keys) {
+		t.Fatalf("compaction workers, keys %d != %d", num, len(keys))
+	}
+}
+
+func Test_OpenProgress(t *testing.T) {
+
+	stor := storage.NewMemStorage()
+
+	db, err := leveldb.Open(stor, &opt.Options{
+		WriteBuffer: 4 * opt.MiB,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 5000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%06d", i)), value, nil)
+	}
+	db.Close()
+
+	var (
+		cn = &Conn{}
+		ls []*OpenProgress
+	)
+	cn.openProgressFunc = func(p *OpenProgress) {
+		ls = append(ls, p)
+	}
+
+	db, err = leveldb.Open(stor, &opt.Options{
+		WriteBuffer:      4 * opt.MiB,
+		RecoveryProgress: cn.openProgress("main"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var (
+		phases  = map[string]bool{}
+		journal []*OpenProgress
+	)
+	for _, p := range ls {
+		if p.Table != "main" {
+			t.Fatalf("open progress, table %s", p.Table)
+		}
+		phases[p.Phase] = true
+		if p.Phase == "journal" {
+			journal = append(journal, p)
+		}
+	}
+	if !phases["manifest"] || len(journal) < 3 {
+		t.Fatalf("open progress, phases %v, journal %d", phases, len(journal))
+	}
+
+	for i, p := range journal {
+		if i > 0 && p.Done < journal[i-1].Done {
+			t.Fatal("open progress not monotonic")
+		}
+		if p.Done < p.Total && p.Percent >= 100 {
+			t.Fatalf("open progress, percent %.1f", p.Percent)
+		}
+	}
+
+	if last := journal[len(journal)-1]; last.Total < 5000*100 || last.Done != last.Total || last.Percent != 100 {
+		t.Fatalf("open progress, last %d/%d", last.Done, last.Total)
+	}
+
+	if n, err := db.Has([]byte("key-004999"), nil); err != nil || !n {
+		t.Fatal("open progress, journal not recovered")
+	}
+}
+
+func Test_ValueCache(t *testing.T) {
+
+	c := newLruCache(1<<20, 0)
+
+	// the deletes of the keys of other shards do not fail the fills
+	k1, k2 := "k1", "k2"
+	for i := 0; lruCacheShard(k2) == lruCacheShard(k1); i++ {
+		k2 = fmt.Sprintf("k2-%d", i)
+	}
+	gen := c.Generation(k1)
+	c.Del(k2)
+	if c.Set(k1, []byte("v1"), gen); !func() bool { _, ok := c.Get(k1); return ok }() {
+		t.Fatal("value cache, fill failed by the delete of another shard")
+	}
+
+	gen = c.Generation(k1)
+	c.Del(k1)
+	if c.Set(k1, []byte("v0"), gen); func() bool { _, ok := c.Get(k1); return ok }() {
+		t.Fatal("value cache, stale fill cached")
+	}
+
+	gen = c.Generation(k2)
+	c.Purge()
+	if c.Set(k2, []byte("v2"), gen); func() bool { _, ok := c.Get(k2); return ok }() {
+		t.Fatal("value cache, stale fill cached after purge")
+	}
+
+	// the items rewritten or removed by the compaction filters
+	cn := &Conn{
+		opts:          &Config{},
+		tables:        map[string]*dbTable{},
+		valueCache:    newLruCache(1<<20, 0),
+		notFoundCache: newLruCache(1<<20, 0),
+	}
+
+	filter := &compactionFilter{
+		tableName: "main",
+		fn: func(tableName string, item *kv2.ObjectItem) (bool, bool) {
+			switch string(item.Meta.Key) {
+			case "cf-1":
+				if item.Data != nil && item.DataValue().String() == "v1" {
+					item.DataValueSet("f1", nil)
+					return false, true
+				}
+			case "cf-2":
+				return true, false
+			}
+			return false, false
+		},
+		invalidate: func(keys [][]byte) {
+			for _, key := range keys {
+				cn.valueCacheInvalidate(10, key)
+			}
+		},
+		purge: cn.valueCachePurge,
+	}
+
+	db, err := leveldb.Open(storage.NewMemStorage(), &opt.Options{
+		CompactionFilter: filter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tdb := &dbTable{
+		db:           db,
+		tableName:    "main",
+		tableId:      10,
+		incrSets:     map[string]*dbTableIncrSet{},
+		logAsyncSets: map[string]bool{},
+		logLockSets:  map[uint64]uint64{},
+	}
+	cn.tables["main"] = tdb
+
+	for _, k := range []string{"cf-1", "cf-2"} {
+		if rs := cn.commitLocal(kv2.NewObjectWriter([]byte(k), "v1").TableNameSet("main"), 0); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+		if _, err := cn.valueGet(tdb, nsKeyData, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.CompactRange(util.Range{})
+
+	// the tables of the keys around are merged with the table of the items
+	for _, k := range []string{"cf-0", "cf-3"} {
+		if rs := cn.commitLocal(kv2.NewObjectWriter([]byte(k), "v1").TableNameSet("main"), 0); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+	db.CompactRange(util.Range{})
+
+	bs, err := cn.valueGet(tdb, nsKeyData, []byte("cf-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, err := kv2.ObjectItemDecode(bs); err != nil || item.DataValue().String() != "f1" {
+		t.Fatal("value cache, value rewritten by the compaction filter not invalidated")
+	}
+	if _, err := cn.valueGet(tdb, nsKeyData, []byte("cf-2")); err == nil {
+		t.Fatal("value cache, value removed by the compaction filter not invalidated")
+	}
+
+	// the caches are purged if too many keys are filtered
+	filter.overflow = true
+	cn.valueCache.Set(valueCacheKey(tdb, nsKeyData, []byte("cf-3")), []byte("v1"),
+		cn.valueCache.Generation(valueCacheKey(tdb, nsKeyData, []byte("cf-3"))))
+	filter.Committed()
+	if _, ok := cn.valueCache.Get(valueCacheKey(tdb, nsKeyData, []byte("cf-3"))); ok {
+		t.Fatal("value cache, not purged on the overflow of the filtered keys")
+	}
+}
+
+func Test_CompactionFilter(t *testing.T) {
+
+	var (
+		mu     sync.Mutex
+		tables = map[string]bool{}
+	)
+
+	cn, err := Open(NewConfig(t.TempDir()), CompactionFilterFunc(
+		func(tableName string, item *kv2.ObjectItem) (bool, bool) {
+			mu.Lock()
+			tables[tableName] = true
+			mu.Unlock()
+			switch string(item.Meta.Key) {
+			case "cfo-drop":
+				return true, false
+			case "cfo-change":
+				if item.Data != nil && item.DataValue().String() == "v1" {
+					item.DataValueSet("v2", nil)
+					return false, true
+				}
+			}
+			return false, false
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	for _, k := range []string{"cfo-keep", "cfo-drop", "cfo-change"} {
+		if rs := cn.Commit(kv2.NewObjectWriter([]byte(k), "v1").TableNameSet("main")); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+		// the values are cached before the compaction
+		if rs := cn.NewReader([]byte(k)).TableNameSet("main").Query(); !rs.OK() {
+			t.Fatal(rs.Message)
+		}
+	}
+
+	tdb := cn.tabledb("main")
+	if err := tdb.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	if !tables["main"] {
+		mu.Unlock()
+		t.Fatal("compaction filter, not called")
+	}
+	mu.Unlock()
+
+	for k, v := range map[string]string{"cfo-keep": "v1", "cfo-change": "v2"} {
+		if rs := cn.NewReader([]byte(k)).TableNameSet("main").Query(); !rs.OK() ||
+			rs.DataValue().String() != v {
+			t.Fatalf("compaction filter, %s value", k)
+		}
+	}
+
+	// both the data and meta entries of the removed items are dropped
+	if rs := cn.NewReader([]byte("cfo-drop")).TableNameSet("main").Query(); !rs.NotFound() {
+		t.Fatal("compaction filter, item not removed")
+	}
+	for _, ns := range []byte{nsKeyMeta, nsKeyData} {
+		if _, err := tdb.db.Get(keyEncode(ns, []byte("cfo-drop")), nil); err != leveldb.ErrNotFound {
+			t.Fatalf("compaction filter, ns %d entry not removed", ns)
+		}
+	}
+
+	// the caches are purged if too many keys are filtered
+	purged := 0
+	filter := &compactionFilter{
+		invalidate: func(keys [][]byte) {},
+		purge:      func() { purged += 1 },
+	}
+	for i := 0; i <= compactionFilterKeysMax; i++ {
+		filter.filtered(uint64ToBytes(uint64(i)))
+	}
+	filter.Committed()
+	if purged != 1 || filter.keys != nil || filter.overflow {
+		t.Fatal("compaction filter, caches not purged")
+	}
+}
+
+func Test_CacheWarmup(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		db.Put(keyEncode(nsKeyData, []byte(fmt.Sprintf("key-%d", i))), []byte("value"), nil)
+	}
+
+	var (
+		dir = t.TempDir()
+		cn  = &Conn{
+			opts:    &Config{},
+			tables:  map[string]*dbTable{},
+			hotKeys: newCacheHotKeys(3),
+		}
+	)
+	cn.opts.Storage.DataDirectory = dir
+	cn.tables["main"] = &dbTable{db: db, tableName: "main", tableId: 10}
+
+	// one of every cacheHotKeysSample reads is tracked
+	for _, i := range []int{0, 1, 2, 3, 2} {
+		for j := 0; j < cacheHotKeysSample; j++ {
+			cn.hotKeys.touch("main", []byte(fmt.Sprintf("key-%d", i)))
+		}
+	}
+	if err := cn.SaveCacheState(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := cacheStateLoad(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Keys) != 3 || string(state.Keys[0].Key) != "key-2" ||
+		string(state.Keys[2].Key) != "key-1" {
+		t.Fatal("cache warmup, hot keys")
+	}
+
+	cn2 := &Conn{
+		opts:       cn.opts,
+		tables:     cn.tables,
+		hotKeys:    newCacheHotKeys(3),
+		valueCache: newLruCache(1<<20, 0),
+	}
+	cn2.workerCacheWarmup()
+
+	for _, i := range []int{1, 2, 3} {
+		ck := valueCacheKey(cn.tables["main"], nsKeyData, []byte(fmt.Sprintf("key-%d", i)))
+		if _, ok := cn2.valueCache.Get(ck); !ok {
+			t.Fatalf("cache warmup, key-%d not cached", i)
+		}
+	}
+
+	if ls := cn2.hotKeys.keys(); len(ls) != 3 || string(ls[0].Key) != "key-2" {
+		t.Fatal("cache warmup, hot keys order not restored")
+	}
+
+	// the large lists are sharded, the keys are merged by the recency
+	hk := newCacheHotKeys(100000)
+	if len(hk.shards) != cacheHotKeysShardMax {
+		t.Fatalf("cache warmup, shards %d", len(hk.shards))
+	}
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < cacheHotKeysSample; j++ {
+			hk.touch("main", []byte(fmt.Sprintf("key-%04d", i)))
+		}
+	}
+	if ls := hk.keys(); len(ls) != 1000 || string(ls[0].Key) != "key-0999" ||
+		string(ls[999].Key) != "key-0000" {
+		t.Fatal("cache warmup, sharded hot keys")
+	}
+
+	// the reads of the tracked keys do not allocate
+	key := []byte("key-0500")
+	if n := testing.AllocsPerRun(100, func() {
+		hk.touch("main", key)
+	}); n != 0 {
+		t.Fatalf("cache warmup, touch allocs %v", n)
+	}
+}
+
+func Test_PinPrefix(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"user:1", "user:2", "other:1"} {
+		db.Put(keyEncode(nsKeyData, []byte(k)), []byte("v1-"+k), nil)
+	}
+
+	cn := &Conn{
+		opts:   &Config{},
+		tables: map[string]*dbTable{},
+		pinned: newPinnedCache(1 << 20),
+	}
+	tdb := &dbTable{db: db, tableName: "main", tableId: 10}
+	cn.tables["main"] = tdb
+
+	if err := cn.PinPrefix("main", []byte("user:")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cn.PinPrefix("main", []byte("user:1")); err == nil {
+		t.Fatal("pin prefix, overlap accepted")
+	}
+
+	ls, _ := cn.PinnedPrefixes()
+	if len(ls) != 1 || ls[0].Keys != 2 || ls[0].Size < 1 {
+		t.Fatal("pin prefix, list")
+	}
+
+	// the writes bypassing the cache are not visible, the reads of the
+	// pinned keys never hit the disk
+	db.Put(keyEncode(nsKeyData, []byte("user:1")), []byte("v2"), nil)
+	db.Put(keyEncode(nsKeyData, []byte("user:9")), []byte("v2"), nil)
+	if bs, err := cn.valueGet(tdb, nsKeyData, []byte("user:1")); err != nil || string(bs) != "v1-user:1" {
+		t.Fatal("pin prefix, pinned value")
+	}
+	if _, err := cn.valueGet(tdb, nsKeyData, []byte("user:9")); err != leveldb.ErrNotFound {
+		t.Fatal("pin prefix, pinned not found")
+	}
+
+	cn.valueCacheDel(tdb, []byte("user:1"))
+	if bs, err := cn.valueGet(tdb, nsKeyData, []byte("user:1")); err != nil || string(bs) != "v2" {
+		t.Fatal("pin prefix, dirty key")
+	}
+	db.Put(keyEncode(nsKeyData, []byte("user:1")), []byte("v3"), nil)
+	if bs, _ := cn.valueGet(tdb, nsKeyData, []byte("user:1")); string(bs) != "v2" {
+		t.Fatal("pin prefix, dirty key not filled")
+	}
+
+	// reloaded after the compactions
+	cn.pinned.refresh(cn)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	cn.pinned.refresh(cn)
+	if bs, err := cn.valueGet(tdb, nsKeyData, []byte("user:9")); err != nil || string(bs) != "v2" {
+		t.Fatal("pin prefix, not reloaded after compaction")
+	}
+
+	if err := cn.UnpinPrefix("main", []byte("user:")); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := cn.valueGet(tdb, nsKeyData, []byte("user:1")); string(bs) != "v3" {
+		t.Fatal("pin prefix, unpin")
+	}
+
+	cn.pinned = newPinnedCache(100)
+	if err := cn.PinPrefix("main", []byte("user:")); err == nil {
+		t.Fatal("pin prefix, capacity")
+	}
+	if ls, _ := cn.PinnedPrefixes(); len(ls) != 0 {
+		t.Fatal("pin prefix, failed pin not released")
+	}
+}
+
+func Test_StorageReadDirect(t *testing.T) {
+
+	dir := t.TempDir()
+
+	data := make([]byte, 3*directIOAlign+100)
+	rand.Read(data)
+	file := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(file, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := directReaderOpen(file)
+	if err != nil {
+		t.Skipf("direct io not supported: %s", err.Error())
+	}
+	for _, v := range [][2]int{{0, 10}, {4000, 200}, {5000, 7000}, {len(data) - 50, 50}} {
+		p := make([]byte, v[1])
+		if n, err := r.ReadAt(p, int64(v[0])); err != nil || n != v[1] ||
+			!bytes.Equal(p, data[v[0]:v[0]+v[1]]) {
+			t.Fatalf("direct read at %d, n %d, err %v", v[0], n, err)
+		}
+	}
+	if n, err := r.ReadAt(make([]byte, 100), int64(len(data)-50)); n != 50 || err != io.EOF {
+		t.Fatal("direct read, EOF")
+	}
+	r.Close()
+
+	testStorageReadMode(t, filepath.Join(dir, "db"), StorageReadDirect)
+}
+
+func Test_StorageReadMmap(t *testing.T) {
+	testStorageReadMode(t, t.TempDir(), StorageReadMmap)
+}
+
+func testStorageReadMode(t *testing.T, dir, mode string) {
+
+	stor, err := newDirStorage(dir, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stor.Close()
+	stor.mode = mode
+
+	db, err := leveldb.Open(stor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%06d", i)), []byte(fmt.Sprintf("value-%d", i)), nil)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+
+	fds, _ := stor.List(storage.TypeTable)
+	if len(fds) == 0 {
+		t.Fatalf("%s read, no table files", mode)
+	}
+	r2, err := stor.Open(fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r2.(*tableReader); !ok {
+		t.Fatalf("%s read, reader not opened by the read mode", mode)
+	}
+	r2.Close()
+
+	for i := 0; i < 2000; i += 7 {
+		if bs, err := db.Get([]byte(fmt.Sprintf("key-%06d", i)), nil); err != nil ||
+			string(bs) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("%s read, key-%06d", mode, i)
+		}
+	}
+}
+
+func Test_CorruptionQuarantine(t *testing.T) {
+
+	var (
+		dataDir = t.TempDir()
+		dir     = dbTableDir(dataDir, 10)
+	)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		db.Put(keyEncode(nsKeyData, []byte(fmt.Sprintf("key-%03d", i))), []byte("value"), nil)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ldb"))
+	if len(files) != 1 {
+		t.Fatalf("corruption, table files %d", len(files))
+	}
+	bs, _ := ioutil.ReadFile(files[0])
+	for i := 8; i < 24; i++ {
+		bs[i] ^= 0xff
+	}
+	ioutil.WriteFile(files[0], bs, 0640)
+
+	if db, err = leveldb.OpenFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	cn := &Conn{
+		opts:   &Config{},
+		tables: map[string]*dbTable{},
+	}
+	cn.opts.Storage.DataDirectory = dataDir
+	tdb := &dbTable{db: db, tableName: "main", tableId: 10}
+	cn.tables["main"] = tdb
+
+	_, err = cn.valueGet(tdb, nsKeyData, []byte("key-000"))
+	if err == nil || !errCorrupted(err) {
+		t.Fatalf("corruption, read err %v", err)
+	}
+
+	// no replicas to serve the read
+	if _, err2 := cn.corruptionRead(tdb, []byte("key-000"), err); err2 != err {
+		t.Fatal("corruption, read without replicas")
+	}
+	cn.corruptionReport(tdb, err)
+
+	// the file is quarantined in background, and kept without replicas
+	var (
+		total int64
+		ls    []*CorruptionFile
+	)
+	for i := 0; i < 100; i++ {
+		if total, ls = cn.Corruptions(); len(ls) == 1 && ls[0].RepairError != "" {
+			break
+		}
+		time.Sleep(10e6)
+	}
+	if total != 2 || len(ls) != 1 || ls[0].Reads != 2 || !ls[0].Live ||
+		ls[0].File != corruptionFileNum(err) || ls[0].RepairError == "" {
+		t.Fatalf("corruption, total %d, files %d", total, len(ls))
+	}
+
+	if bs2, err := ioutil.ReadFile(ls[0].Quarantine); err != nil || !bytes.Equal(bs, bs2) {
+		t.Fatal("corruption, file not quarantined")
+	}
+}
+
+func Test_CorruptionRepair(t *testing.T) {
+
+	dir := "/dev/shm/kvgo/sim-corruption"
+	if _, err := exec.Command("rm", "-rf", dir).Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := newSimCluster(dir, 3, 1, simOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the values fill the data blocks in the middle of the table file
+	values := map[int]string{}
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		values[i] = randHexString(500)
+		if rs := sim.Commit(i%3, kv2.NewObjectWriter(key, values[i])); !rs.OK() {
+			sim.Close()
+			t.Fatalf("corruption, commit ER! %s", rs.Message)
+		}
+	}
+
+	// the replication of the commits to the minority is asynchronous
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		for j := 0; j < 3; j++ {
+			if rs := sim.Query(j, kv2.NewObjectReader(key)); !rs.OK() {
+				if rs := sim.QueryQuorum(j, kv2.NewObjectReader(key)); !rs.OK() {
+					sim.Close()
+					t.Fatalf("corruption, query ER! %s", rs.Message)
+				}
+			}
+		}
+	}
+
+	tdb := sim.nodes[0].tabledb("main")
+	if err := tdb.db.CompactRange(util.Range{}); err != nil {
+		sim.Close()
+		t.Fatal(err)
+	}
+	sim.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dbTableDir(
+		filepath.Join(dir, "node-0"), tdb.tableId), "*.ldb"))
+	if len(files) != 1 {
+		t.Fatalf("corruption, table files %d", len(files))
+	}
+	bs, _ := ioutil.ReadFile(files[0])
+	for i := len(bs) / 2; i < len(bs)/2+16; i++ {
+		bs[i] ^= 0xff
+	}
+	ioutil.WriteFile(files[0], bs, 0640)
+
+	if sim, err = newSimCluster(dir, 3, 1, simOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	// the corrupted reads are served by the replicas
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		if rs := sim.Query(0, kv2.NewObjectReader(key)); !rs.OK() ||
+			rs.DataValue().String() != values[i] {
+			t.Fatalf("corruption, query ER! %s", rs.Message)
+		}
+	}
+
+	cn := sim.nodes[0]
+
+	var ls []*CorruptionFile
+	for i := 0; i < 300; i++ {
+		if _, ls = cn.Corruptions(); len(ls) > 0 && ls[0].repaired {
+			break
+		}
+		time.Sleep(10e6)
+	}
+	if len(ls) == 0 || !ls[0].repaired || ls[0].Live || ls[0].Quarantine == "" {
+		t.Fatalf("corruption, file not repaired %v", ls)
+	}
+
+	// the keys of the dropped blocks are restored to the local store
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		if rs := cn.objectLocalQuery(kv2.NewObjectReader(key)); !rs.OK() ||
+			rs.DataValue().String() != values[i] {
+			t.Fatalf("corruption, key %s not repaired", key)
+		}
+	}
+}
+
+func Test_NodeFailpoint(t *testing.T) {
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+
+	// the result of the command is returned as an item
+	cmd := func(req *NodeFailpointRequest) bool {
+		bs, _ := json.Marshal(req)
+		rs := cn.failpointCmdLocal(nil, bs)
+		return rs.OK() && len(rs.Items) > 0
+	}
+
+	if cmd(&NodeFailpointRequest{Name: "none", Enable: true}) {
+		t.Fatal("node failpoint, unknown name accepted")
+	}
+
+	ok := cmd(&NodeFailpointRequest{
+		Name:     FailpointPartition,
+		Enable:   true,
+		Duration: 1,
+	})
+	if !failpointEnabled {
+		if ok {
+			t.Fatal("node failpoint, enabled without the failpoint tag")
+		}
+		return
+	}
+	if !ok {
+		t.Fatal("node failpoint, enable")
+	}
+
+	if _, err := clientConn("127.0.0.1:9100", &hauth.AccessKey{Id: "test"}, false, nil, nil, false); err == nil {
+		t.Fatal("node failpoint, partition not injected")
+	}
+
+	// disabled by the node after the duration
+	time.Sleep(1100 * time.Millisecond)
+	if err := failpointInject(FailpointPartition); err != nil {
+		t.Fatal("node failpoint, not disabled after the duration")
+	}
+}
+
+func Test_Tenant(t *testing.T) {
+
+	dir := t.TempDir()
+
+	dbSys, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbSys.Close()
+
+	cn := &Conn{
+		opts:   &Config{},
+		dbSys:  dbSys,
+		tables: map[string]*dbTable{},
+	}
+	cn.opts.Storage.DataDirectory = dir
+
+	tdir := dbTableDir(dir, 20)
+	db, err := leveldb.OpenFile(tdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.tables["acme"] = &dbTable{db: db, tableName: "acme", tableId: 20}
+
+	for _, v := range []*Tenant{
+		{Name: "acme", Table: "acme", Quota: &TenantQuota{MaxBytes: 1, MaxValueSize: 10}},
+		{Name: "beta", Table: "beta"},
+	} {
+		bs, _ := json.Marshal(v)
+		dbSys.Put(keySysTenant(v.Name), bs, nil)
+	}
+
+	if err := cn.tenantRefresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	ow := func(table string, n int) *kv2.ObjectWriter {
+		return &kv2.ObjectWriter{
+			Meta:      &kv2.ObjectMeta{Key: []byte("k1")},
+			Data:      &kv2.ObjectData{Value: bytes.Repeat([]byte("v"), n)},
+			TableName: table,
+		}
+	}
+
+	if err := cn.tenantQuotaCheck(ow("acme", 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cn.tenantQuotaCheck(ow("acme", 11)); err != ErrTenantQuota {
+		t.Fatal("tenant quota, value size accepted")
+	}
+	if err := cn.tenantQuotaCheck(ow("main", 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put(keyEncode(nsKeyData, []byte("k1")), []byte("v1"), nil)
+	db.CompactRange(util.Range{})
+	if err := cn.tenantRefresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cn.tenantQuotaCheck(ow("acme", 1)); err != ErrTenantQuota {
+		t.Fatal("tenant quota, size accepted")
+	}
+	if err := cn.tenantQuotaCheck(ow("acme", 1).ModeDeleteSet(true)); err != nil {
+		t.Fatal("tenant quota, delete denied")
+	}
+
+	ls, err := cn.tenantListLocal()
+	if err != nil || len(ls) != 2 || ls[0].Name != "acme" || ls[1].Name != "beta" {
+		t.Fatal("tenant list")
+	}
+	if ls[0].Bytes < 1 || ls[0].Stats == nil || ls[1].Stats != nil {
+		t.Fatalf("tenant list, usage %d", ls[0].Bytes)
+	}
+
+	cn.opts.Cluster.MainNodes = []*ClientConfig{{Addr: "127.0.0.1:9100"}}
+	if _, _, err := cn.tenantCreateLocal("gamma", nil); err != errTenantCluster {
+		t.Fatal("tenant create, cluster mode accepted")
+	}
+	if err := cn.tenantDeleteLocal("beta"); err != errTenantCluster {
+		t.Fatal("tenant delete, cluster mode accepted")
+	}
+	if _, err := cn.tenantListLocal(); err != errTenantCluster {
+		t.Fatal("tenant list, cluster mode accepted")
+	}
+	cn.opts.Cluster.MainNodes = nil
+
+	if err := cn.dbTableDrop("main"); err == nil {
+		t.Fatal("table drop, main dropped")
+	}
+	if err := cn.dbTableDrop("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if cn.tabledb("acme") != nil {
+		t.Fatal("table drop, table open")
+	}
+	if _, err := os.Stat(tdir); !os.IsNotExist(err) {
+		t.Fatal("table drop, data not removed")
+	}
+}
+
+func Test_TableUsage(t *testing.T) {
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dir := t.TempDir()
+
+	cn := &Conn{
+		opts:   &Config{},
+		tables: map[string]*dbTable{},
+		uptime: time.Now().Unix(),
+	}
+	cn.opts.Tenant.UsageReportDirectory = dir
+	cn.opts.Reset()
+	cn.tables["acme"] = &dbTable{db: db, tableName: "acme", tableId: 20}
+	cn.tenants.tables = map[string]*tenantUsage{
+		"acme": {tenant: &Tenant{Name: "t-acme", Table: "acme"}},
+	}
+
+	var (
+		ow = &kv2.ObjectWriter{
+			Meta:      &kv2.ObjectMeta{Key: []byte("k1")},
+			Data:      &kv2.ObjectData{Value: []byte("value")},
+			TableName: "acme",
+		}
+		or = &kv2.ObjectReader{TableName: "acme"}
+		rs = &kv2.ObjectResult{Items: []*kv2.ObjectItem{{
+			Meta: &kv2.ObjectMeta{Key: []byte("k1")},
+			Data: &kv2.ObjectData{Value: []byte("value")},
+		}}}
+	)
+
+	cn.usageWrite(ow, kv2.NewObjectResultOK())
+	cn.usageWrite(ow, nil)
+	cn.usageRead(or, rs)
+	cn.usageRead(&kv2.ObjectReader{TableName: sysTableName}, rs)
+
+	ls, err := cn.TableUsages()
+	if err != nil || len(ls) != 1 {
+		t.Fatal("table usages")
+	}
+	if u := ls[0]; u.Table != "acme" || u.Tenant != "t-acme" || u.Writes != 2 ||
+		u.Reads != 1 || u.BytesWritten != 7 || u.BytesRead != 7 {
+		t.Fatalf("table usages, %+v", u)
+	}
+
+	path, err := cn.usageReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	if len(rows) != 2 || !strings.HasPrefix(rows[1], "acme,t-acme,") ||
+		!strings.HasSuffix(rows[1], ",1,2,7,7,0") {
+		t.Fatalf("usage report, csv %q", rows)
+	}
+
+	// the usages of the next report period
+	cn.usageRead(or, nil)
+	if ls, _ = cn.TableUsages(); ls[0].Reads != 1 || ls[0].Writes != 0 || ls[0].BytesRead != 0 {
+		t.Fatalf("table usages, next period %+v", ls[0])
+	}
+
+	bs, _ = usageReportEncode(UsageReportJson, ls)
+	var ls2 []*TableUsage
+	if err := json.Unmarshal(bs, &ls2); err != nil || len(ls2) != 1 || ls2[0].Reads != 1 {
+		t.Fatal("usage report, json")
+	}
+}
+
+func Test_KeyToken(t *testing.T) {
+
+	cn := &Conn{
+		opts: &Config{},
+	}
+
+	if _, err := cn.KeyTokenIssue("main", []byte("user:1:"), time.Minute); err == nil {
+		t.Fatal("key token, issued without server secret")
+	}
+
+	cn.opts.Server.AccessKey = &hauth.AccessKey{
+		Id:     authKeyAccessKeySystem,
+		Secret: "secret",
+	}
+
+	if _, err := cn.KeyTokenIssue("main", nil, 48*time.Hour); err == nil {
+		t.Fatal("key token, ttl out of range")
+	}
+
+	token, err := cn.KeyTokenIssue("", []byte("user:1:"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		rr    *kv2.ObjectReader
+		allow bool
+	}{
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKey, Keys: [][]byte{[]byte("user:1:name")}}, true},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKey, Keys: [][]byte{[]byte("user:1:a"), []byte("user:2:a")}}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKey, Keys: [][]byte{[]byte("user:1:a")}, TableName: "acme"}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:1:"), KeyCutset: []byte("user:1:")}, true},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:1:a"), KeyCutset: []byte("user:1:b")}, true},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:1:"), KeyCutset: []byte("user:1;")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:1:"), KeyCutset: []byte("user:1")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:1:")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange | kv2.ObjectReaderModeRevRange, KeyOffset: []byte("user:1;"), KeyCutset: []byte("user:1:")}, true},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange | kv2.ObjectReaderModeRevRange, KeyOffset: []byte("user:1:z"), KeyCutset: []byte("user:1:a")}, true},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange | kv2.ObjectReaderModeRevRange, KeyOffset: []byte("user:1:z")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange | kv2.ObjectReaderModeRevRange, KeyCutset: []byte("user:1:")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange | kv2.ObjectReaderModeRevRange, KeyOffset: []byte("user:2"), KeyCutset: []byte("user:1:")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:1:"), KeyCutset: []byte("user:2")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeKeyRange, KeyOffset: []byte("user:0")}, false},
+		{&kv2.ObjectReader{Mode: kv2.ObjectReaderModeLogRange}, false},
+	} {
+		if err := cn.keyTokenAllow(token, v.rr); (err == nil) != v.allow {
+			t.Fatalf("key token, reader %+v, err %v", v.rr, err)
+		}
+	}
+
+	rr := &kv2.ObjectReader{Mode: kv2.ObjectReaderModeKey, Keys: [][]byte{[]byte("user:1:name")}}
+
+	// tampered claims or another secret
+	c, _ := keyTokenDecode([]byte("secret"), token)
+	c.Prefix = []byte("user:")
+	if token2, _ := keyTokenEncode([]byte("other"), c); cn.keyTokenAllow(token2, rr) == nil {
+		t.Fatal("key token, signature of another secret accepted")
+	}
+	n := strings.LastIndexByte(token, '.')
+	if token2, _ := keyTokenEncode([]byte("other"), c); cn.keyTokenAllow(token2[:strings.LastIndexByte(token2, '.')]+token[n:], rr) == nil {
+		t.Fatal("key token, tampered claims accepted")
+	}
+
+	c.Expired = time.Now().UnixNano()/1e6 - 1
+	if token2, _ := keyTokenEncode([]byte("secret"), c); cn.keyTokenAllow(token2, rr) == nil {
+		t.Fatal("key token, expired token accepted")
+	}
+}
+
+func Test_Jwt(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := func(bs []byte) string {
+		return base64.RawURLEncoding.EncodeToString(bs)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "r1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		},
+	})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(jwksFile, jwks, 0640)
+
+	// the issuer and the audience are required
+	for _, v := range []*ConfigJwt{
+		{Audience: "kvgo", JwksUrl: jwksFile},
+		{Issuer: "https://idp.example.com", JwksUrl: jwksFile},
+	} {
+		if err := v.Valid(); err == nil {
+			t.Fatalf("jwt, config of issuer %q audience %q accepted", v.Issuer, v.Audience)
+		}
+	}
+
+	cfg := &Config{}
+	cfg.Server.Jwt = &ConfigJwt{
+		Issuer:   "https://idp.example.com",
+		Audience: "kvgo",
+		JwksUrl:  jwksFile,
+		RoleMap:  map[string]string{"kv-admin": "sa", "kv-client": "client"},
+	}
+	if err := cfg.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Reset()
+
+	ja := newJwtAuth(cfg.Server.Jwt)
+
+	sign := func(alg, kid string, claims map[string]interface{}) string {
+		hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+		bs, _ := json.Marshal(claims)
+		payload := b64(hdr) + "." + b64(bs)
+		sum := sha256.Sum256([]byte(payload))
+		var sig []byte
+		switch alg {
+		case "RS256":
+			sig, _ = rsa.SignPKCS1v15(crand.Reader, rsaKey, crypto.SHA256, sum[:])
+		case "ES256":
+			r, s, _ := ecdsa.Sign(crand.Reader, ecKey, sum[:])
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		default:
+			sig = []byte("sig")
+		}
+		return payload + "." + b64(sig)
+	}
+
+	claims := func(roles interface{}, tables interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":         "https://idp.example.com",
+			"aud":         []string{"other", "kvgo"},
+			"sub":         "svc-1",
+			"exp":         time.Now().Add(time.Minute).Unix(),
+			"roles":       roles,
+			"kvgo_tables": tables,
+		}
+	}
+
+	av, err := ja.validate(sign("RS256", "r1", claims([]string{"kv-admin"}, "*")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if av.Allow(authPermSysAll) != nil || av.Allow(authPermTableWrite, hauth.NewScopeFilter(AuthScopeTable, "any")) != nil {
+		t.Fatal("jwt, sa role denied")
+	}
+
+	av, err = ja.validate(sign("ES256", "e1", claims("kv-client", []string{"acme"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if av.Allow(authPermSysAll) == nil {
+		t.Fatal("jwt, client role allowed sys/all")
+	}
+	if av.Allow(authPermTableRead, hauth.NewScopeFilter(AuthScopeTable, "acme")) != nil ||
+		av.Allow(authPermTableRead, hauth.NewScopeFilter(AuthScopeTable, "main")) == nil {
+		t.Fatal("jwt, table scopes")
+	}
+
+	for name, token := range map[string]string{
+		"expired": sign("RS256", "r1", func() map[string]interface{} {
+			c := claims("kv-client", "*")
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+			return c
+		}()),
+		"issuer": sign("RS256", "r1", func() map[string]interface{} {
+			c := claims("kv-client", "*")
+			c["iss"] = "https://evil.example.com"
+			return c
+		}()),
+		"audience": sign("RS256", "r1", func() map[string]interface{} {
+			c := claims("kv-client", "*")
+			c["aud"] = "other"
+			return c
+		}()),
+		"no issuer": sign("RS256", "r1", func() map[string]interface{} {
+			c := claims("kv-admin", "*")
+			delete(c, "iss")
+			return c
+		}()),
+		"no audience": sign("RS256", "r1", func() map[string]interface{} {
+			c := claims("kv-admin", "*")
+			delete(c, "aud")
+			return c
+		}()),
+		"role":          sign("RS256", "r1", claims("guest", "*")),
+		"unmapped role": sign("RS256", "r1", claims([]string{"sa", "client"}, "*")),
+		"hs256":         sign("HS256", "r1", claims("kv-client", "*")),
+		"alg":           sign("ES256", "r1", claims("kv-client", "*")),
+		"kid":           sign("RS256", "r2", claims("kv-client", "*")),
+		"signature": func() string {
+			t1, t2 := sign("RS256", "r1", claims("kv-admin", "*")), sign("RS256", "r1", claims("kv-client", "*"))
+			return t1[:strings.LastIndexByte(t1, '.')] + t2[strings.LastIndexByte(t2, '.'):]
+		}(),
+		"malformed": "a.b",
+	} {
+		if _, err := ja.validate(token); err == nil {
+			t.Fatalf("jwt, %s accepted", name)
+		}
+	}
+
+	// the audience is checked even if the config is not validated
+	ja2 := newJwtAuth(&ConfigJwt{Issuer: "https://idp.example.com", JwksUrl: jwksFile})
+	if _, err := ja2.validate(sign("RS256", "r1", claims("kv-admin", "*"))); err == nil {
+		t.Fatal("jwt, token accepted without the audience of the config")
+	}
+
+	cn := &Conn{
+		opts:   cfg,
+		keyMgr: hauth.NewAccessKeyManager(),
+		jwt:    ja,
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs("authorization", "Bearer "+sign("ES256", "e1", claims("kv-client", "acme"))))
+	av2, err := cn.appAuthParse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := av2.(*roleValidator); !ok {
+		t.Fatal("jwt, access key validator of the bearer call")
+	}
+
+	h := cn.httpAuth(func(w http.ResponseWriter, r *http.Request) {})
+	for token, code := range map[string]int{
+		sign("RS256", "r1", claims("kv-admin", "*")):  http.StatusOK,
+		sign("RS256", "r1", claims("kv-client", "*")): http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != code {
+			t.Fatalf("jwt, http status %d, expected %d", w.Code, code)
+		}
+	}
+}
+
+func Test_Firewall(t *testing.T) {
+
+	if err := (&ConfigFirewall{Allow: []string{"10.0.0.0/33"}}).Valid(); err == nil {
+		t.Fatal("firewall, invalid cidr accepted")
+	}
+	if err := (&ConfigFirewall{Listeners: []*ConfigFirewallRule{{Name: "ftp"}}}).Valid(); err == nil {
+		t.Fatal("firewall, invalid listener accepted")
+	}
+
+	fw, err := newFirewall(&ConfigFirewall{
+		Deny: []string{"192.168.1.66"},
+		Listeners: []*ConfigFirewallRule{
+			{Name: FirewallListenerHttp, Allow: []string{"10.0.0.0/8", "::1"}},
+		},
+		Identities: []*ConfigFirewallRule{
+			{Name: "ak-1", Allow: []string{"10.1.0.0/16"}, Deny: []string{"10.1.2.0/24"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 9100}
+	}
+
+	for _, v := range []struct {
+		listener string
+		addr     net.Addr
+		allow    bool
+	}{
+		{FirewallListenerRpc, tcp("192.168.1.65"), true},
+		{FirewallListenerRpc, tcp("192.168.1.66"), false},
+		{FirewallListenerHttp, tcp("10.2.3.4"), true},
+		{FirewallListenerHttp, tcp("::1"), true},
+		{FirewallListenerHttp, tcp("192.168.1.65"), false},
+		{FirewallListenerHttp, &net.UnixAddr{Name: "/run/kvgo.sock", Net: "unix"}, true},
+	} {
+		if fw.allowListener(v.listener, v.addr) != v.allow {
+			t.Fatalf("firewall, listener %s addr %s", v.listener, v.addr)
+		}
+	}
+
+	peerCtx := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: tcp(ip)})
+	}
+	if fw.allowIdentity(peerCtx("10.1.3.4"), "ak-1") != nil ||
+		fw.allowIdentity(peerCtx("10.1.2.4"), "ak-1") == nil ||
+		fw.allowIdentity(peerCtx("10.2.0.1"), "ak-1") == nil ||
+		fw.allowIdentity(peerCtx("10.2.0.1"), "ak-2") != nil {
+		t.Fatal("firewall, identity rules")
+	}
+
+	// the http basic auth is checked by the rule of the identity
+	cn := &Conn{
+		opts:     &Config{},
+		keyMgr:   hauth.NewAccessKeyManager(),
+		firewall: fw,
+	}
+	cn.keyMgr.KeySet(&hauth.AccessKey{Id: "ak-1", Secret: "s1", Roles: []string{"sa"}})
+
+	h := cn.httpAuth(func(w http.ResponseWriter, r *http.Request) {})
+	for ip, code := range map[string]int{
+		"10.1.3.4": http.StatusOK,
+		"10.1.2.4": http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.RemoteAddr = ip + ":9100"
+		r.SetBasicAuth("ak-1", "s1")
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != code {
+			t.Fatalf("firewall, http basic auth of %s, status %d", ip, w.Code)
+		}
+	}
+
+	// the denied connections are closed right after accepted
+	fw, _ = newFirewall(&ConfigFirewall{Deny: []string{"127.0.0.0/8"}})
+	cn = &Conn{firewall: fw}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis = cn.firewallListen(FirewallListenerRpc, lis)
+	defer lis.Close()
+
+	go func() {
+		if c, err := lis.Accept(); err == nil {
+			c.Close()
+			t.Error("firewall, denied connection accepted")
+		}
+	}()
+
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("firewall, connection not closed, err %v", err)
+	}
+	if cn.FirewallDenied() != 1 {
+		t.Fatal("firewall, denied count")
+	}
+}
+
+func Test_ValueEncryptor(t *testing.T) {
+
+	var (
+		k1 = bytes.Repeat([]byte{1}, 32)
+		k2 = bytes.Repeat([]byte{2}, 32)
+	)
+
+	enc1, err := NewValueEncryptor(map[uint8][]byte{1: k1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := enc1.Encrypt([]byte("secret value"), []byte("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bs, []byte("secret")) || !enc1.Encrypted(bs) {
+		t.Fatal("value encryptor, not encrypted")
+	}
+
+	// the key 1 is kept to decrypt the old values after rotated to 2
+	enc2, _ := NewValueEncryptor(map[uint8][]byte{1: k1, 2: k2}, 2)
+	if v, err := enc2.Decrypt(bs, []byte("k1")); err != nil || string(v) != "secret value" {
+		t.Fatal("value encryptor, decrypt of the old key")
+	}
+	if bs2, _ := enc2.Encrypt([]byte("v2"), nil); bs2[1] != 2 {
+		t.Fatal("value encryptor, active key")
+	}
+
+	if _, err := enc1.Decrypt(bs, []byte("k2")); err == nil {
+		t.Fatal("value encryptor, decrypted by another object key")
+	}
+	bs[len(bs)-1] ^= 1
+	if _, err := enc1.Decrypt(bs, []byte("k1")); err == nil {
+		t.Fatal("value encryptor, tampered value decrypted")
+	}
+
+	cfg := &ConfigClientEncryption{
+		Keys:      []*ConfigEncryptionKey{{Id: 7, Key: strings.Repeat("ab", 32)}},
+		ActiveKey: 7,
+		Tables:    []string{"main"},
+	}
+	if (&ConfigClientEncryption{Keys: cfg.Keys, ActiveKey: 8}).Valid() == nil {
+		t.Fatal("client encryption, active key not found")
+	}
+
+	cn := &Conn{
+		opts: &Config{
+			ClientEncryption: cfg,
+		},
+	}
+	cn.valueCrypt, _ = cfg.encryptor()
+
+	ow := &kv2.ObjectWriter{
+		Meta: &kv2.ObjectMeta{Key: []byte("k1")},
+		Data: &kv2.ObjectData{Value: []byte("plain")},
+	}
+	restore, err := cn.valueEncrypt(ow)
+	if err != nil || !cn.valueCrypt.Encrypted(ow.Data.Value) {
+		t.Fatal("client encryption, value not encrypted")
+	}
+	sealed := ow.Data.Value
+
+	// the value of the caller is restored after the send, so the retries
+	// encrypt the plaintext again
+	if restore(); string(ow.Data.Value) != "plain" {
+		t.Fatal("client encryption, value of the caller not restored")
+	}
+	restore, _ = cn.valueEncrypt(ow)
+	if v, err := cn.valueCrypt.Decrypt(ow.Data.Value, []byte("k1")); err != nil || string(v) != "plain" {
+		t.Fatal("client encryption, value of the retry encrypted twice")
+	}
+	restore()
+
+	// the plaintexts looking like a ciphertext are encrypted too
+	ow.Data.Value = sealed
+	restore, _ = cn.valueEncrypt(ow)
+	if v, err := cn.valueCrypt.Decrypt(ow.Data.Value, []byte("k1")); err != nil || !bytes.Equal(v, sealed) {
+		t.Fatal("client encryption, value looking encrypted kept in clear")
+	}
+	restore()
+
+	ow2 := &kv2.ObjectWriter{
+		Meta:      &kv2.ObjectMeta{Key: []byte("k1")},
+		Data:      &kv2.ObjectData{Value: []byte("plain")},
+		TableName: "logs",
+	}
+	if cn.valueEncrypt(ow2); string(ow2.Data.Value) != "plain" {
+		t.Fatal("client encryption, value of another table encrypted")
+	}
+
+	rs := &kv2.ObjectResult{Items: []*kv2.ObjectItem{
+		{Meta: &kv2.ObjectMeta{Key: []byte("k1")}, Data: &kv2.ObjectData{Value: sealed}},
+		{Meta: &kv2.ObjectMeta{Key: []byte("k0")}, Data: &kv2.ObjectData{Value: []byte("old")}},
+	}}
+	if rs = cn.valueDecrypt("", rs); len(rs.Items) != 2 ||
+		string(rs.Items[0].Data.Value) != "plain" || string(rs.Items[1].Data.Value) != "old" {
+		t.Fatal("client encryption, values not decrypted")
+	}
+}
+
+type testCryptoProvider struct {
+	stdCryptoProvider
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (it *testCryptoProvider) Name() string {
+	return "test"
+}
+
+func (it *testCryptoProvider) count(name string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.calls[name]++
+}
+
+func (it *testCryptoProvider) NewHash(h crypto.Hash) (hash.Hash, error) {
+	it.count("hash")
+	return it.stdCryptoProvider.NewHash(h)
+}
+
+func (it *testCryptoProvider) NewHMAC(h crypto.Hash, key []byte) (hash.Hash, error) {
+	it.count("hmac")
+	return it.stdCryptoProvider.NewHMAC(h, key)
+}
+
+func (it *testCryptoProvider) NewAEAD(key []byte) (cipher.AEAD, error) {
+	it.count("aead")
+	return it.stdCryptoProvider.NewAEAD(key)
+}
+
+func (it *testCryptoProvider) Rand() io.Reader {
+	it.count("rand")
+	return it.stdCryptoProvider.Rand()
+}
+
+func (it *testCryptoProvider) Verify(pub crypto.PublicKey, h crypto.Hash, digest, sig []byte) error {
+	it.count("verify")
+	return it.stdCryptoProvider.Verify(pub, h, digest, sig)
+}
+
+func Test_CryptoProvider(t *testing.T) {
+
+	p := &testCryptoProvider{calls: map[string]int{}}
+	CryptoProviderSet(p)
+	defer CryptoProviderSet(nil)
+
+	cfg := &Config{}
+	cfg.Server.CryptoProvider = "fips"
+	if err := cfg.Valid(); err == nil {
+		t.Fatal("crypto provider, open with a provider not linked")
+	}
+	if cfg.Server.CryptoProvider = "test"; cfg.Valid() != nil {
+		t.Fatal("crypto provider, open with the provider linked")
+	}
+
+	cfg.Server.Bind = "127.0.0.1:9100"
+	cfg.Server.AccessKey = NewSystemAccessKey()
+	cfg.Cluster.MainNodes = []*ClientConfig{{Addr: "127.0.0.1:9101"}}
+	if err := cfg.Valid(); err == nil {
+		t.Fatal("crypto provider, open with the hauth credentials")
+	}
+	if cfg.Server.RequestSign.Required = true; cfg.Valid() == nil {
+		t.Fatal("crypto provider, open with the hauth credentials of the main nodes")
+	}
+	if cfg.Cluster.MainNodes[0].RequestSign = true; cfg.Valid() != nil {
+		t.Fatal("crypto provider, open with the signed requests")
+	}
+
+	enc, err := NewValueEncryptor(map[uint8][]byte{1: bytes.Repeat([]byte{1}, 32)}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := enc.Encrypt([]byte("value"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := enc.Decrypt(bs, nil); err != nil || string(v) != "value" {
+		t.Fatal("crypto provider, value decrypt")
+	}
+
+	token, err := keyTokenEncode([]byte("secret"), &keyTokenClaims{
+		Table:   "main",
+		Expired: time.Now().UnixNano()/1e6 + 60e3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyTokenDecode([]byte("secret"), token); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	sum := sha256.Sum256([]byte("payload"))
+	r, s, _ := ecdsa.Sign(crand.Reader, ecKey, sum[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	if err := jwtVerify("ES256", &ecKey.PublicKey, []byte("payload"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := jwtVerify("ES256", &ecKey.PublicKey, []byte("payload2"), sig); err == nil {
+		t.Fatal("crypto provider, invalid signature verified")
+	}
+
+	for _, v := range []string{"hash", "hmac", "aead", "rand", "verify"} {
+		if p.calls[v] == 0 {
+			t.Fatalf("crypto provider, %s not used", v)
+		}
+	}
+}
+
+type testSecretStore map[string]string
+
+func (it testSecretStore) Secret(ref string) (string, error) {
+	if v, ok := it[ref]; ok {
+		return v, nil
+	}
+	return "", errors.New("secret not found")
+}
+
+func Test_Secrets(t *testing.T) {
+
+	var (
+		dir   = t.TempDir()
+		path  = filepath.Join(dir, "backup-key")
+		key1  = strings.Repeat("ab", 32)
+		key2  = strings.Repeat("cd", 32)
+		store = testSecretStore{"kvgo/enc": key1}
+	)
+
+	SecretStoreRegister("test", store)
+
+	if err := ioutil.WriteFile(path, []byte(key1+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KVGO_TEST_SECRET", "server-secret-0123456789")
+	defer os.Unsetenv("KVGO_TEST_SECRET")
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" || r.URL.Path != "/v1/secret/data/kvgo" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"tiering":"s3-secret"},"metadata":{"version":1}}}`))
+	}))
+	defer vault.Close()
+
+	cfg := &Config{}
+	cfg.Server.AccessKey = &hauth.AccessKey{Id: "00000000", Secret: "env:KVGO_TEST_SECRET"}
+	cfg.Backup.EncryptKey = "file:" + path
+	cfg.ClientEncryption = &ConfigClientEncryption{
+		Keys:      []*ConfigEncryptionKey{{Id: 1, Key: "test:kvgo/enc"}},
+		ActiveKey: 1,
+	}
+	cfg.Storage.Tiering = &ConfigTiering{SecretKey: "vault:secret/data/kvgo#tiering"}
+	cfg.Secrets.VaultAddr = vault.URL
+	cfg.Secrets.VaultToken = "env:KVGO_TEST_VAULT_TOKEN"
+
+	if _, err := newSecretSet(cfg); err == nil {
+		t.Fatal("secrets, resolved without the vault token")
+	}
+	os.Setenv("KVGO_TEST_VAULT_TOKEN", "vault-token")
+	defer os.Unsetenv("KVGO_TEST_VAULT_TOKEN")
+
+	ss, err := newSecretSet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.AccessKey.Secret != "server-secret-0123456789" ||
+		cfg.Backup.EncryptKey != key1 ||
+		cfg.ClientEncryption.Keys[0].Key != key1 ||
+		cfg.Storage.Tiering.SecretKey != "s3-secret" || len(ss.refs) != 4 {
+		t.Fatal("secrets, references not resolved")
+	}
+
+	// the plain secrets are kept as is
+	if _, _, ok := secretRefParse("0123456789abcdef"); ok {
+		t.Fatal("secrets, plain secret parsed as a reference")
+	}
+	if _, _, ok := secretRefParse("unknown:ref"); ok {
+		t.Fatal("secrets, reference of an unknown store")
+	}
+
+	cn := &Conn{
+		opts:    cfg,
+		secrets: ss,
+	}
+	cn.valueCrypt, _ = cfg.ClientEncryption.encryptor()
+	sealed, _ := cn.valueCrypt.Encrypt([]byte("value"), nil)
+
+	os.Setenv("KVGO_TEST_SECRET", "server-secret-rotated-0123456789")
+	ioutil.WriteFile(path, []byte(key2), 0600)
+	store["kvgo/enc"] = key2
+
+	if changed := ss.refresh(); len(changed) != 3 {
+		t.Fatalf("secrets, refresh changed %v", changed)
+	}
+	if v := ss.value(&cfg.Backup.EncryptKey); v != key2 {
+		t.Fatal("secrets, backup key not refreshed")
+	}
+	if bs, _ := cn.keyTokenSecret(); string(bs) != "server-secret-rotated-0123456789" {
+		t.Fatal("secrets, server key not refreshed")
+	}
+
+	if err := cn.valueCryptRotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cn.valueCrypt.Decrypt(sealed, nil); err == nil {
+		t.Fatal("secrets, client encryption key not refreshed")
+	}
+
+	// the last secrets are kept if the store fails
+	delete(store, "kvgo/enc")
+	ss.refresh()
+	if v := ss.value(&cfg.ClientEncryption.Keys[0].Key); v != key2 {
+		t.Fatal("secrets, secret lost on the store error")
+	}
+
+	// the access keys of the main nodes are refreshed with the connections
+	os.Setenv("KVGO_TEST_NODE_SECRET", "node-secret-0123456789")
+	defer os.Unsetenv("KVGO_TEST_NODE_SECRET")
+
+	cfg2 := &Config{}
+	cfg2.Cluster.MainNodes = []*ClientConfig{{
+		Addr:      "127.0.0.1:9566",
+		AccessKey: &hauth.AccessKey{Id: "00000000", Secret: "env:KVGO_TEST_NODE_SECRET"},
+	}}
+	node := cfg2.Cluster.MainNodes[0]
+
+	if cn.secrets, err = newSecretSet(cfg2); err != nil {
+		t.Fatal(err)
+	}
+	cn.opts = cfg2
+
+	if _, err := clientConn(node.Addr, node.AccessKey, false, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("KVGO_TEST_NODE_SECRET", "node-secret-rotated-0123456789")
+	cn.secretsRefresh()
+
+	if node.AccessKey.Secret != "node-secret-rotated-0123456789" {
+		t.Fatal("secrets, main node key not refreshed")
+	}
+
+	grpcClientMu.Lock()
+	_, ok := grpcClientConns[node.Addr+"."+node.AccessKey.Id]
+	grpcClientMu.Unlock()
+	if ok {
+		t.Fatal("secrets, main node connection not dropped")
+	}
+}
+
+type testTransportStream struct {
+	grpc.ServerTransportStream
+	method string
+}
+
+func (it *testTransportStream) Method() string {
+	return it.method
+}
+
+func Test_RequestSign(t *testing.T) {
+
+	key := &hauth.AccessKey{
+		Id:     "k1",
+		Secret: "secret-of-k1",
+		Roles:  []string{"client"},
+		Scopes: []*hauth.ScopeFilter{{Name: AuthScopeTable, Value: "t1"}},
+	}
+
+	cn := &Conn{
+		opts:    &Config{},
+		keyMgr:  hauth.NewAccessKeyManager(),
+		reqSign: newReqSignAuth(&ConfigRequestSign{Window: 300}),
+	}
+	cn.keyMgr.KeySet(key)
+
+	const method = "/kvgo.Public/Query"
+
+	var (
+		req  = kv2.NewObjectReader([]byte("k1")).TableNameSet("t1")
+		req2 = kv2.NewObjectReader([]byte("k2")).TableNameSet("t1")
+	)
+
+	sign := func(k *hauth.AccessKey, md ...string) string {
+		sign, err := reqSignRequest(k, method, req, metadata.Pairs(md...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(sign, k.Secret) {
+			t.Fatal("request sign, secret sent")
+		}
+		return sign
+	}
+
+	incomingOf := func(method, sign string, req interface{}, md ...string) context.Context {
+		ctx := grpc.NewContextWithServerTransportStream(context.Background(),
+			&testTransportStream{method: method})
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(append(md, ReqSignMetadataKey, sign)...))
+		var ret context.Context
+		cn.reqSignUnaryInterceptor(ctx, req, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+			ret = ctx
+			return nil, nil
+		})
+		return ret
+	}
+
+	incoming := func(method, sign string) context.Context {
+		return incomingOf(method, sign, req)
+	}
+
+	s1 := sign(key)
+
+	av, err := cn.appAuthParse(incoming(method, s1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if av.Allow(authPermTableRead, hauth.NewScopeFilter(AuthScopeTable, "t1")) != nil ||
+		av.Allow(authPermTableRead, hauth.NewScopeFilter(AuthScopeTable, "t2")) == nil {
+		t.Fatal("request sign, table scopes of the key")
+	}
+	if appIdentity(av) != "k1" {
+		t.Fatal("request sign, identity of the key")
+	}
+
+	// replayed
+	if _, err := cn.appAuthParse(incoming(method, s1)); err == nil || cn.RequestSignReplayed() != 1 {
+		t.Fatal("request sign, replayed request allowed")
+	}
+
+	// signed for another method
+	if _, err := cn.appAuthParse(incoming("/kvgo.Public/Commit", sign(key))); err == nil {
+		t.Fatal("request sign, request of another method allowed")
+	}
+
+	// signed for another request
+	if _, err := cn.appAuthParse(incomingOf(method, sign(key), req2)); err == nil {
+		t.Fatal("request sign, request of another payload allowed")
+	}
+
+	// the metadata are signed with the request
+	if _, err := cn.appAuthParse(incomingOf(method, sign(key, WriteForceMetadataKey, "true"), req,
+		WriteForceMetadataKey, "true", RequestIdMetadataKey, "r1")); err != nil {
+		t.Fatalf("request sign, signed metadata %v", err)
+	}
+	for _, md := range [][]string{
+		{},
+		{WriteForceMetadataKey, "false"},
+		{WriteForceMetadataKey, "true", SessionVersionMetadataKey, "100"},
+	} {
+		if _, err := cn.appAuthParse(incomingOf(method, sign(key, WriteForceMetadataKey, "true"),
+			req, md...)); err == nil {
+			t.Fatalf("request sign, request of other metadata %v allowed", md)
+		}
+	}
+
+	// signed by another secret
+	if _, err := cn.appAuthParse(incoming(method, sign(&hauth.AccessKey{
+		Id: "k1", Secret: "other"}))); err == nil {
+		t.Fatal("request sign, request of another secret allowed")
+	}
+
+	// out of the window
+	digest, _ := reqSignDigest(req)
+	s2, _ := reqSignEncode([]byte(key.Secret), key.Id,
+		time.Now().Add(-time.Hour).UnixNano()/1e6, strings.Repeat("00", reqSignNonce), method, digest, "")
+	if _, err := cn.appAuthParse(incoming(method, s2)); err == nil {
+		t.Fatal("request sign, expired request allowed")
+	}
+
+	// the nonces are kept until their requests are out of the window
+	for i := range cn.reqSign.shards {
+		cn.reqSign.shards[i].swept -= cn.reqSign.window
+	}
+	if _, err := cn.reqSign.validate(incoming(method, s1), s1, cn.keyMgr); err == nil {
+		t.Fatal("request sign, replayed after the sweep")
+	}
+	for i := range cn.reqSign.shards {
+		shard := &cn.reqSign.shards[i]
+		for k := range shard.nonces {
+			shard.nonces[k] = 0
+		}
+		shard.swept = 0
+	}
+	if _, err := cn.appAuthParse(incoming(method, sign(key))); err != nil {
+		t.Fatal(err)
+	}
+	swept := 0
+	for i := range cn.reqSign.shards {
+		if shard := &cn.reqSign.shards[i]; shard.swept > 0 {
+			if swept += 1; len(shard.nonces) != 1 {
+				t.Fatalf("request sign, expired nonces not swept, %d kept", len(shard.nonces))
+			}
+		}
+	}
+	if swept != 1 {
+		t.Fatalf("request sign, %d shards swept", swept)
+	}
+
+	// the requests of a full shard are refused, the nonces in it are not
+	// dropped before their requests are out of the window
+	cn.reqSign.noncesMax = 1
+	var lens [reqSignNonceShards]int
+	for i := range cn.reqSign.shards {
+		lens[i] = len(cn.reqSign.shards[i].nonces)
+	}
+	full := 0
+	for i := 0; i <= reqSignNonceShards && full == 0; i++ {
+		if _, err := cn.appAuthParse(incoming(method, sign(key))); err != nil {
+			full += 1
+		}
+	}
+	for i := range cn.reqSign.shards {
+		if n := len(cn.reqSign.shards[i].nonces); n > 1 && n != lens[i] {
+			t.Fatalf("request sign, nonces not capped, %d kept", n)
+		}
+	}
+	if full == 0 {
+		t.Fatal("request sign, requests of the full shards allowed")
+	}
+	cn.reqSign.noncesMax = reqSignNoncesMax / reqSignNonceShards
+
+	cn.opts.Server.RequestSign.Required = true
+	if _, err := cn.appAuthValid(context.Background()); err == nil {
+		t.Fatal("request sign, unsigned request allowed")
+	}
+	if _, err := cn.appAuthValid(incoming(method, sign(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the internal calls are checked by the firewall rule of the identity
+	cn.firewall, _ = newFirewall(&ConfigFirewall{
+		Identities: []*ConfigFirewallRule{{Name: "k1", Allow: []string{"10.1.0.0/16"}}},
+	})
+	peerCtx := func(ctx context.Context, ip string) context.Context {
+		return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 9100}})
+	}
+	if _, err := cn.appAuthValid(peerCtx(incoming(method, sign(key)), "10.1.2.3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cn.appAuthValid(peerCtx(incoming(method, sign(key)), "10.2.2.3")); err == nil {
+		t.Fatal("request sign, internal call of a denied address allowed")
+	}
+
+	// the signed requests of a client
+	dir := "/dev/shm/kvgo/request-sign"
+	if _, err := exec.Command("rm", "-rf", dir).Output(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewConfig(dir)
+	cfg.Server.Bind = "127.0.0.1:10061"
+	cfg.Server.AccessKey = dbTestAccessKey
+	cfg.Server.RequestSign.Required = true
+
+	srv, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, signed := range []bool{true, false} {
+
+		ccfg := &Config{ClientConnectEnable: true}
+		ccfg.Cluster.MainNodes = []*ClientConfig{{
+			Addr:        cfg.Server.Bind,
+			AccessKey:   dbTestAccessKey,
+			RequestSign: signed,
+		}}
+
+		c, err := Open(ccfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs := c.NewWriter([]byte("sign-1"), "1").Commit()
+		if signed && !rs.OK() {
+			t.Fatalf("request sign, signed commit ER! %s", rs.Message)
+		} else if !signed && rs.OK() {
+			t.Fatal("request sign, unsigned commit allowed")
+		}
+		if signed {
+			if rs := c.NewReader([]byte("sign-1")).Query(); !rs.OK() ||
+				rs.DataValue().String() != "1" {
+				t.Fatalf("request sign, signed query ER! %s", rs.Message)
+			}
+		}
+
+		c.Close()
+	}
+}
+
+func Test_TLSReload(t *testing.T) {
+
+	var (
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "tls.crt")
+		keyFile  = filepath.Join(dir, "tls.key")
+	)
+
+	c1, _ := TLSCertCreate("n1")
+	c2, _ := TLSCertCreate("n2")
+
+	write := func(cert, key string) {
+		ioutil.WriteFile(certFile, []byte(cert), 0600)
+		ioutil.WriteFile(keyFile, []byte(key), 0600)
+	}
+	write(c1.ServerCertData, c1.ServerKeyData)
+
+	tr, err := newTLSReloader(&ConfigTLSCertificate{
+		ServerCertFile: certFile,
+		ServerKeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", tr.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	dial := func() (*tls.Conn, string) {
+		c, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	conn1, name := dial()
+	defer conn1.Close()
+	if name != "n1" {
+		t.Fatal("tls reload, certificate of the open")
+	}
+
+	if ok, err := tr.reload(); ok || err != nil {
+		t.Fatal("tls reload, reloaded without changes")
+	}
+
+	// the key not matched is refused, the certificate in use is kept
+	write(c2.ServerCertData, c1.ServerKeyData)
+	if _, err := tr.reload(); err == nil {
+		t.Fatal("tls reload, key not matched")
+	}
+
+	write(c2.ServerCertData, c2.ServerKeyData)
+	if ok, err := tr.reload(); !ok || err != nil || tr.statusGet().Reloads != 1 {
+		t.Fatal("tls reload, certificate not reloaded")
+	}
+
+	conn2, name := dial()
+	defer conn2.Close()
+	if name != "n2" {
+		t.Fatal("tls reload, certificate of the new connections")
+	}
+
+	// the connections established before are kept
+	buf := make([]byte, 4)
+	if _, err := conn1.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn1, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("tls reload, connection dropped")
+	}
+
+	cn := &Conn{opts: &Config{}}
+	if _, err := cn.TLSReload(); err == nil {
+		t.Fatal("tls reload, no certificate setup")
+	}
+	cn.tls = tr
+	if status, err := cn.TLSReload(); err != nil || !strings.Contains(status.Subject, "n2") {
+		t.Fatal("tls reload, status")
 	}
 }
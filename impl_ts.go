@@ -0,0 +1,159 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+func tsKeySeries(series string) string {
+	return "ts:" + series
+}
+
+func tsKeyRetention(series string) []byte {
+	return NsKey("ts-retention", series)
+}
+
+// TimeSeriesConn stores the points of a series by the keys of NsTimeKey,
+// the retention of a series is applied to each point as its ttl, so the
+// expired points are removed by the ttl worker of the server.
+type TimeSeriesConn struct {
+	kv2.ClientTable
+	mu         sync.RWMutex
+	retentions map[string]int64
+}
+
+type TsPoint struct {
+	Time time.Time
+	Item *kv2.ObjectItem
+}
+
+func NewTimeSeriesConn(c kv2.ClientTable) (*TimeSeriesConn, error) {
+	return &TimeSeriesConn{
+		ClientTable: c,
+		retentions:  map[string]int64{},
+	}, nil
+}
+
+// TsRetentionSet sets the retention of the series, 0 means keep forever.
+// It applies to the points written after it.
+func (cn *TimeSeriesConn) TsRetentionSet(series string, retention time.Duration) *kv2.ObjectResult {
+
+	ms := int64(retention / time.Millisecond)
+	if ms < 0 {
+		return kv2.NewObjectResultClientError(errors.New("invalid retention"))
+	}
+
+	rs := cn.NewWriter(tsKeyRetention(series), ms).Commit()
+	if rs.OK() {
+		cn.mu.Lock()
+		cn.retentions[series] = ms
+		cn.mu.Unlock()
+	}
+
+	return rs
+}
+
+func (cn *TimeSeriesConn) tsRetention(series string) (int64, error) {
+
+	cn.mu.RLock()
+	ms, ok := cn.retentions[series]
+	cn.mu.RUnlock()
+
+	if ok {
+		return ms, nil
+	}
+
+	rs := cn.NewReader(tsKeyRetention(series)).Query()
+	if rs.OK() {
+		ms = rs.DataValue().Int64()
+	} else if !rs.NotFound() {
+		return 0, rs.Error()
+	}
+
+	cn.mu.Lock()
+	cn.retentions[series] = ms
+	cn.mu.Unlock()
+
+	return ms, nil
+}
+
+// TsPut writes the value of the series at time t, the point with the
+// same series and time (in milliseconds) will be overwritten.
+func (cn *TimeSeriesConn) TsPut(series string, t time.Time, value interface{}) *kv2.ObjectResult {
+
+	retention, err := cn.tsRetention(series)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	w := cn.NewWriter(NsTimeKey(tsKeySeries(series), t), value)
+
+	if retention > 0 {
+		ttl := retention - int64(time.Since(t)/time.Millisecond)
+		if ttl < 1 {
+			return kv2.NewObjectResultOK()
+		}
+		w.ExpireSet(ttl)
+	}
+
+	return w.Commit()
+}
+
+// TsRange returns the points of the series in the time range [from, to],
+// at most limit points are returned, the next page can be continued
+// from the time of the last point + 1ms.
+func (cn *TimeSeriesConn) TsRange(series string, from, to time.Time, limit int64) ([]*TsPoint, error) {
+
+	if to.Before(from) {
+		return nil, errors.New("invalid time range")
+	}
+
+	var (
+		ns     = tsKeySeries(series)
+		offset = NsTimeKey(ns, from.Add(-time.Millisecond))
+		cutset = NsTimeKey(ns, to)
+		ls     = []*TsPoint{}
+	)
+
+	rs := cn.NewReader(nil).KeyRangeSet(offset, cutset).
+		LimitNumSet(limit).Query()
+	if !rs.OK() {
+		if rs.NotFound() {
+			return ls, nil
+		}
+		return nil, rs.Error()
+	}
+
+	for _, item := range rs.Items {
+		if item.Meta == nil {
+			continue
+		}
+		t, err := NsTimeKeyParse(ns, item.Meta.Key, false)
+		if err != nil {
+			continue
+		}
+		ls = append(ls, &TsPoint{
+			Time: t,
+			Item: item,
+		})
+	}
+
+	return ls, nil
+}
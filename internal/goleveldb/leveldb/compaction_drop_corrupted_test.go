@@ -0,0 +1,91 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/errors"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+)
+
+func TestCompactRangeDropCorrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ldb"))
+	if len(files) != 1 {
+		t.Fatalf("table files %d", len(files))
+	}
+	bs, _ := ioutil.ReadFile(files[0])
+	for i := 8; i < 24; i++ {
+		bs[i] ^= 0xff
+	}
+	ioutil.WriteFile(files[0], bs, 0640)
+
+	if db, err = OpenFile(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	num, _ := strconv.ParseInt(strings.TrimSuffix(filepath.Base(files[0]), ".ldb"), 10, 64)
+	if umin, umax, ok := db.TableFileRange(num); !ok ||
+		string(umin) != "key-000000" || string(umax) != "key-000999" {
+		t.Fatalf("table range %q .. %q, %v", umin, umax, ok)
+	}
+
+	if _, err := db.Get([]byte("key-000000"), nil); !errors.IsCorrupted(err) {
+		t.Fatalf("get of the corrupted block, err %v", err)
+	}
+
+	if err := db.CompactRangeDropCorrupted(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := db.TableFileRange(num); ok {
+		v, _ := db.GetProperty("leveldb.sstables")
+		t.Fatalf("corrupted table %d not replaced, %s", num, v)
+	}
+
+	// the keys of the dropped block are lost, the others are kept
+	found := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key-%06d", i)), nil); err == nil {
+			found += 1
+		} else if err != ErrNotFound {
+			t.Fatalf("get after the compaction, err %v", err)
+		}
+	}
+	if found == 0 || found == 1000 {
+		t.Fatalf("keys found %d", found)
+	}
+
+	if err := db.Put([]byte("key-new"), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+}
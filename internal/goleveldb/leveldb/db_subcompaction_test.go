@@ -0,0 +1,324 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+)
+
+// logStorage counts the subcompactions of the log of the DB.
+type logStorage struct {
+	storage.Storage
+	splits int32
+}
+
+func (s *logStorage) Log(str string) {
+	if strings.HasPrefix(str, "table@compaction subcompactions") {
+		atomic.AddInt32(&s.splits, 1)
+	}
+}
+
+func subcompactionOptions(n int) *opt.Options {
+	return &opt.Options{
+		WriteBuffer:           64 * opt.KiB,
+		CompactionTableSize:   32 * opt.KiB,
+		CompactionTotalSize:   128 * opt.KiB,
+		CompactionConcurrency: n,
+	}
+}
+
+// subcompactionLoad writes the same random puts and deletes to the DBs,
+// and returns the snapshots taken between the rounds.
+func subcompactionLoad(t *testing.T, dbs ...*DB) [][]*Snapshot {
+
+	var (
+		rnd   = rand.New(rand.NewSource(1))
+		value = bytes.Repeat([]byte("v"), 100)
+		snaps = make([][]*Snapshot, len(dbs))
+	)
+
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 4000; i++ {
+			var (
+				k   = []byte(fmt.Sprintf("key-%06d", rnd.Intn(8000)))
+				del = rnd.Intn(5) == 0
+				v   = []byte(fmt.Sprintf("%s-%d-%d", value, round, i))
+			)
+			for _, db := range dbs {
+				if del {
+					db.Delete(k, nil)
+				} else {
+					db.Put(k, v, nil)
+				}
+			}
+		}
+		for j, db := range dbs {
+			if round%2 == 0 {
+				snap, err := db.GetSnapshot()
+				if err != nil {
+					t.Fatal(err)
+				}
+				snaps[j] = append(snaps[j], snap)
+			}
+			if err := db.CompactRange(util.Range{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return snaps
+}
+
+func subcompactionDump(next func() bool, key, value func() []byte) map[string]string {
+	m := map[string]string{}
+	for next() {
+		m[string(key())] = string(value())
+	}
+	return m
+}
+
+func subcompactionEqual(t *testing.T, name string, a, b map[string]string) {
+	if len(a) != len(b) {
+		t.Fatalf("%s, keys %d != %d", name, len(a), len(b))
+	}
+	for k, v := range a {
+		if b[k] != v {
+			t.Fatalf("%s, key %s", name, k)
+		}
+	}
+}
+
+// The subcompactions in parallel return the same keys and versions of the
+// snapshots as the compaction of one range.
+func TestSubcompactionConsistency(t *testing.T) {
+
+	stor := &logStorage{Storage: storage.NewMemStorage()}
+
+	db1, err := Open(storage.NewMemStorage(), subcompactionOptions(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+
+	db4, err := Open(stor, subcompactionOptions(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db4.Close()
+
+	snaps := subcompactionLoad(t, db1, db4)
+
+	if atomic.LoadInt32(&stor.splits) == 0 {
+		t.Fatal("subcompaction, no compaction split")
+	}
+
+	it1, it4 := db1.NewIterator(nil, nil), db4.NewIterator(nil, nil)
+	subcompactionEqual(t, "subcompaction",
+		subcompactionDump(it1.Next, it1.Key, it1.Value),
+		subcompactionDump(it4.Next, it4.Key, it4.Value))
+	it1.Release()
+	it4.Release()
+
+	for i := range snaps[0] {
+		s1, s4 := snaps[0][i].NewIterator(nil, nil), snaps[1][i].NewIterator(nil, nil)
+		subcompactionEqual(t, fmt.Sprintf("subcompaction snapshot %d", i),
+			subcompactionDump(s1.Next, s1.Key, s1.Value),
+			subcompactionDump(s4.Next, s4.Key, s4.Value))
+		s1.Release()
+		s4.Release()
+		snaps[0][i].Release()
+		snaps[1][i].Release()
+	}
+
+	// the output tables of a level are not overlapped
+	v := db4.s.version()
+	defer v.release()
+	for level, tables := range v.levels {
+		if level == 0 {
+			continue
+		}
+		for i := 1; i < len(tables); i++ {
+			if db4.s.icmp.uCompare(tables[i-1].imax.ukey(), tables[i].imin.ukey()) >= 0 {
+				t.Fatalf("subcompaction, tables of L%d overlapped", level)
+			}
+		}
+	}
+}
+
+type subcompactionFilter struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (f *subcompactionFilter) Filter(level int, ukey, value []byte) (bool, []byte) {
+	f.mu.Lock()
+	f.calls[string(ukey)]++
+	f.mu.Unlock()
+	if ukey[len(ukey)-1]%2 == 0 {
+		return true, nil
+	}
+	return false, append([]byte("f-"), value...)
+}
+
+func TestSubcompactionFilter(t *testing.T) {
+
+	var (
+		stor   = &logStorage{Storage: storage.NewMemStorage()}
+		filter = &subcompactionFilter{calls: map[string]int{}}
+		o      = subcompactionOptions(4)
+		value  = bytes.Repeat([]byte("v"), 100)
+	)
+	o.CompactionFilter = filter
+
+	db, err := Open(stor, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 8000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%06d", i)), value, nil)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+	// rewrite the tables of the output level, so they are compacted by
+	// the subcompactions
+	for i := 1; i < 8000; i += 2 {
+		db.Put([]byte(fmt.Sprintf("key-%06d", i)), value, nil)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&stor.splits) == 0 {
+		t.Fatal("subcompaction filter, no compaction split")
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	num := 0
+	for iter.Next() {
+		if k := iter.Key(); k[len(k)-1]%2 == 0 {
+			t.Fatalf("subcompaction filter, key %s not dropped", k)
+		}
+		if !bytes.HasPrefix(iter.Value(), []byte("f-")) {
+			t.Fatalf("subcompaction filter, key %s not rewritten", iter.Key())
+		}
+		num++
+	}
+	if num != 4000 {
+		t.Fatalf("subcompaction filter, keys %d", num)
+	}
+}
+
+// The tables of the subcompactions are removed if the DB is closed before
+// all of them are done, and the keys are kept.
+func TestSubcompactionRevert(t *testing.T) {
+
+	var (
+		mem     = storage.NewMemStorage()
+		stor    = &logStorage{Storage: mem}
+		o       = subcompactionOptions(4)
+		value   = bytes.Repeat([]byte("v"), 100)
+		blocked = make(chan struct{})
+		release = make(chan struct{})
+		once    sync.Once
+		armed   = int32(-1)
+	)
+	o.CompactionFilter = filterFunc(func(ukey []byte) {
+		// block the last subcompaction of a split compaction after armed
+		if n := atomic.LoadInt32(&armed); n >= 0 && atomic.LoadInt32(&stor.splits) > n &&
+			bytes.Equal(ukey, []byte("key-007999")) {
+			once.Do(func() {
+				close(blocked)
+				<-release
+			})
+		}
+	})
+
+	db, err := Open(stor, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%06d", i)), value, nil)
+	}
+	db.CompactRange(util.Range{})
+	for i := 0; i < 8000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%06d", i)), []byte("v2"), nil)
+	}
+
+	atomic.StoreInt32(&armed, atomic.LoadInt32(&stor.splits))
+	go db.CompactRange(util.Range{})
+
+	select {
+	case <-blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("subcompaction revert, no compaction split")
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	for !db.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-closed
+
+	db, err = Open(mem, subcompactionOptions(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// no tables of the reverted subcompactions are left
+	fds, err := mem.List(storage.TypeTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := db.s.version()
+	live := map[int64]bool{}
+	for _, tables := range v.levels {
+		for _, tf := range tables {
+			live[tf.fd.Num] = true
+		}
+	}
+	v.release()
+	for _, fd := range fds {
+		if !live[fd.Num] {
+			t.Fatalf("subcompaction revert, table %d left", fd.Num)
+		}
+	}
+
+	for i := 0; i < 8000; i++ {
+		if v, err := db.Get([]byte(fmt.Sprintf("key-%06d", i)), nil); err != nil || string(v) != "v2" {
+			t.Fatalf("subcompaction revert, key-%06d", i)
+		}
+	}
+}
+
+type filterFunc func(ukey []byte)
+
+func (f filterFunc) Filter(level int, ukey, value []byte) (bool, []byte) {
+	f(ukey)
+	return false, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"io"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+// The number of records replayed between two progress reports.
+const recoveryProgressRecords = 256
+
+// recoveryProgress reports the progress of a recovery phase by the read
+// offset of the files, the nil *recoveryProgress reports nothing.
+type recoveryProgress struct {
+	fn    func(phase string, done, total int64)
+	phase string
+	done  int64
+	total int64
+	n     int
+}
+
+func newRecoveryProgress(fn func(phase string, done, total int64), phase string,
+	stor storage.Storage, fds ...storage.FileDesc) *recoveryProgress {
+	if fn == nil {
+		return nil
+	}
+	p := &recoveryProgress{
+		fn:    fn,
+		phase: phase,
+	}
+	for _, fd := range fds {
+		r, err := stor.Open(fd)
+		if err != nil {
+			continue
+		}
+		if size, err := r.Seek(0, io.SeekEnd); err == nil {
+			p.total += size
+		}
+		r.Close()
+	}
+	p.fn(p.phase, 0, p.total)
+	return p
+}
+
+// record is called after every replayed record of the file r.
+func (p *recoveryProgress) record(r storage.Reader) {
+	if p == nil {
+		return
+	}
+	if p.n++; p.n%recoveryProgressRecords != 0 {
+		return
+	}
+	if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+		p.fn(p.phase, p.done+off, p.total)
+	}
+}
+
+// fileDone is called after the file r is replayed.
+func (p *recoveryProgress) fileDone(r storage.Reader) {
+	if p == nil {
+		return
+	}
+	if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+		p.done += off
+	}
+	if p.done > p.total {
+		p.total = p.done
+	}
+	p.fn(p.phase, p.done, p.total)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+func TestRecoveryProgress(t *testing.T) {
+	mem := storage.NewMemStorage()
+	defer mem.Close()
+
+	// the memdb is not flushed on close, the journal is replayed on open
+	o := &opt.Options{WriteBuffer: 16 * opt.MiB}
+	db, err := Open(mem, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	type report struct {
+		done, total int64
+	}
+	reports := map[string][]report{}
+	o.RecoveryProgress = func(phase string, done, total int64) {
+		reports[phase] = append(reports[phase], report{done, total})
+	}
+	if db, err = Open(mem, o); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, phase := range []string{"manifest", "journal"} {
+		rs := reports[phase]
+		if len(rs) < 2 {
+			t.Fatalf("phase %s reports %d", phase, len(rs))
+		}
+		for i := 1; i < len(rs); i++ {
+			if rs[i].done < rs[i-1].done || rs[i].done > rs[i].total {
+				t.Fatalf("phase %s report #%d %v after %v", phase, i, rs[i], rs[i-1])
+			}
+		}
+		if last := rs[len(rs)-1]; last.done == 0 || last.done != last.total {
+			t.Fatalf("phase %s last report %v", phase, last)
+		}
+	}
+	// 4000 records in the journal report at every recoveryProgressRecords
+	if n := len(reports["journal"]); n < 4000/recoveryProgressRecords {
+		t.Fatalf("journal reports %d", n)
+	}
+
+	if v, err := db.Get([]byte("key-003999"), nil); err != nil || len(v) != 100 {
+		t.Fatalf("get after recovery %d %v", len(v), err)
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwtJwksRefresh    = time.Hour
+	jwtJwksRefreshMin = 30 * time.Second
+	jwtLeeway         = 60 // in seconds
+)
+
+// ConfigJwt accepts the JWT bearer tokens of an OIDC identity provider as
+// an alternative to the access keys, on the public service and the http
+// apis. The tokens are signed by a key of the JSON Web Key Set of JwksUrl
+// in RS256/384/512 or ES256/384/512, and the roles and the tables of the
+// claims are mapped to the roles and the table scopes of the access keys.
+//
+// The issuer and the audience are required, the tokens of the same provider
+// issued to the other clients are refused.
+type ConfigJwt struct {
+	Issuer   string `toml:"issuer" json:"issuer"`
+	Audience string `toml:"audience" json:"audience"`
+
+	// The http(s) url or the local file path of the JSON Web Key Set
+	JwksUrl string `toml:"jwks_url" json:"jwks_url"`
+
+	// The claims of the roles and of the tables allowed ("*" for all
+	// tables), the nested claims are separated by dots, e.g.
+	// realm_access.roles
+	RolesClaim  string `toml:"roles_claim" json:"roles_claim" desc:"default to roles"`
+	TablesClaim string `toml:"tables_claim" json:"tables_claim" desc:"default to kvgo_tables"`
+
+	// The roles of the claim mapped to the roles of kvgo (sa or client),
+	// only the roles of the map are allowed if it is setup, the roles of
+	// the same names are mapped otherwise
+	RoleMap map[string]string `toml:"role_map" json:"role_map"`
+}
+
+func (it *ConfigJwt) Valid() error {
+	if it.JwksUrl == "" {
+		return errors.New("no server/jwt/jwks_url setup")
+	}
+	if it.Issuer == "" {
+		return errors.New("no server/jwt/issuer setup")
+	}
+	if it.Audience == "" {
+		return errors.New("no server/jwt/audience setup")
+	}
+	for _, v := range it.RoleMap {
+		if authRole(v) == nil {
+			return fmt.Errorf("invalid server/jwt/role_map role %s", v)
+		}
+	}
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtAuth validates the tokens by the keys of the JSON Web Key Set, which
+// is reloaded every hour, or on the tokens of an unknown key id at most
+// every 30 seconds.
+type jwtAuth struct {
+	cfg     *ConfigJwt
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	client  *http.Client
+}
+
+func newJwtAuth(cfg *ConfigJwt) *jwtAuth {
+	if cfg == nil {
+		return nil
+	}
+	return &jwtAuth{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func jwtB64Int(s string) (*big.Int, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+func (it *jwtJwk) publicKey() (crypto.PublicKey, error) {
+
+	switch it.Kty {
+
+	case "RSA":
+		n, err := jwtB64Int(it.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwtB64Int(it.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch it.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + it.Crv)
+		}
+		x, err := jwtB64Int(it.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwtB64Int(it.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("unsupported key type " + it.Kty)
+}
+
+func jwtJwksParse(bs []byte) (map[string]crypto.PublicKey, error) {
+
+	var set struct {
+		Keys []*jwtJwk `json:"keys"`
+	}
+	if err := json.Unmarshal(bs, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, v := range set.Keys {
+		if v.Use != "" && v.Use != "sig" {
+			continue
+		}
+		if k, err := v.publicKey(); err == nil {
+			keys[v.Kid] = k
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key found in jwks")
+	}
+
+	return keys, nil
+}
+
+func (it *jwtAuth) jwksFetch() ([]byte, error) {
+
+	if !strings.HasPrefix(it.cfg.JwksUrl, "http://") &&
+		!strings.HasPrefix(it.cfg.JwksUrl, "https://") {
+		return ioutil.ReadFile(it.cfg.JwksUrl)
+	}
+
+	rsp, err := it.client.Get(it.cfg.JwksUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks status %d", rsp.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+}
+
+func (it *jwtAuth) key(kid string) (crypto.PublicKey, error) {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	var (
+		k, ok = it.keys[kid]
+		age   = time.Since(it.fetched)
+	)
+
+	if (ok && age < jwtJwksRefresh) || (!ok && it.keys != nil && age < jwtJwksRefreshMin) {
+		if !ok {
+			return nil, errors.New("jwt key not found")
+		}
+		return k, nil
+	}
+
+	bs, err := it.jwksFetch()
+	if err == nil {
+		var keys map[string]crypto.PublicKey
+		if keys, err = jwtJwksParse(bs); err == nil {
+			it.keys = keys
+		}
+	}
+	it.fetched = time.Now()
+
+	if err != nil && it.keys == nil {
+		return nil, err
+	}
+
+	// the keys fetched before are used if the refresh fails
+	if k, ok = it.keys[kid]; !ok {
+		return nil, errors.New("jwt key not found")
+	}
+
+	return k, nil
+}
+
+func jwtVerify(alg string, key crypto.PublicKey, payload, sig []byte) error {
+
+	var ch crypto.Hash
+
+	switch alg[2:] {
+	case "256":
+		ch = crypto.SHA256
+	case "384":
+		ch = crypto.SHA384
+	case "512":
+		ch = crypto.SHA512
+	default:
+		return errors.New("unsupported jwt alg " + alg)
+	}
+
+	sum, err := cryptoSum(ch, payload)
+	if err != nil {
+		return err
+	}
+
+	switch alg[:2] {
+
+	case "RS":
+		if k, ok := key.(*rsa.PublicKey); ok {
+			return cryptoProvider().Verify(k, ch, sum, sig)
+		}
+
+	case "ES":
+		if k, ok := key.(*ecdsa.PublicKey); ok {
+			n := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*n {
+				return errors.New("invalid jwt signature")
+			}
+			// the raw r || s of the jwt to the ASN.1 of the provider
+			der, err := asn1.Marshal(struct {
+				R, S *big.Int
+			}{
+				new(big.Int).SetBytes(sig[:n]),
+				new(big.Int).SetBytes(sig[n:]),
+			})
+			if err != nil {
+				return err
+			}
+			if err := cryptoProvider().Verify(k, ch, sum, der); err != nil {
+				return errors.New("invalid jwt signature")
+			}
+			return nil
+		}
+
+	default:
+		return errors.New("unsupported jwt alg " + alg)
+	}
+
+	return errors.New("jwt alg not match the key")
+}
+
+// jwtClaimStrings returns the string or the strings of the claim of the
+// dot separated path.
+func jwtClaimStrings(claims map[string]interface{}, path string) []string {
+
+	var v interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		ls := []string{}
+		for _, v2 := range v {
+			if s, ok := v2.(string); ok {
+				ls = append(ls, s)
+			}
+		}
+		return ls
+	}
+
+	return nil
+}
+
+func jwtClaimTime(claims map[string]interface{}, name string) (int64, bool) {
+	if v, ok := claims[name].(float64); ok {
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// validate returns the validator of the permissions of the token, the
+// token is of the issuer and the audience of the config, and not expired.
+func (it *jwtAuth) validate(token string) (*roleValidator, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid jwt")
+	}
+
+	var (
+		hdr    jwtHeader
+		claims map[string]interface{}
+	)
+
+	bs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(bs, &hdr) != nil || len(hdr.Alg) != 5 {
+		return nil, errors.New("invalid jwt header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid jwt signature")
+	}
+
+	key, err := it.key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jwtVerify(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	bs, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(bs, &claims) != nil {
+		return nil, errors.New("invalid jwt claims")
+	}
+
+	tn := time.Now().Unix()
+
+	if exp, ok := jwtClaimTime(claims, "exp"); !ok || tn > exp+jwtLeeway {
+		return nil, errors.New("jwt expired")
+	}
+
+	if nbf, ok := jwtClaimTime(claims, "nbf"); ok && tn+jwtLeeway < nbf {
+		return nil, errors.New("jwt not valid yet")
+	}
+
+	if iss, _ := claims["iss"].(string); it.cfg.Issuer == "" || iss != it.cfg.Issuer {
+		return nil, errors.New("jwt issuer not match")
+	}
+
+	match := false
+	for _, v := range jwtClaimStrings(claims, "aud") {
+		if v != "" && v == it.cfg.Audience {
+			match = true
+			break
+		}
+	}
+	if !match {
+		return nil, errors.New("jwt audience not match")
+	}
+
+	av := &roleValidator{
+		kind:   "jwt",
+		perms:  map[string]bool{},
+		tables: map[string]bool{},
+	}
+	av.subject, _ = claims["sub"].(string)
+
+	for _, v := range jwtClaimStrings(claims, it.cfg.RolesClaim) {
+		if len(it.cfg.RoleMap) > 0 {
+			v2, ok := it.cfg.RoleMap[v]
+			if !ok {
+				continue
+			}
+			v = v2
+		}
+		if role := authRole(v); role != nil {
+			for _, p := range role.Permissions {
+				av.perms[p] = true
+			}
+		}
+	}
+
+	if len(av.perms) == 0 {
+		return nil, errors.New("jwt, no role allowed")
+	}
+
+	for _, v := range jwtClaimStrings(claims, it.cfg.TablesClaim) {
+		av.tables[v] = true
+	}
+
+	return av, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	keepaliveTimeMin    = int64(5000)
+	keepaliveTimeoutDef = int64(5000)
+)
+
+// params returns the keepalive time and timeout, the nil or disabled
+// settings return 0.
+func (it *ConfigKeepalive) params() (time.Duration, time.Duration) {
+
+	if it == nil || it.Time < 1 {
+		return 0, 0
+	}
+
+	var (
+		tm      = it.Time
+		timeout = it.Timeout
+	)
+
+	if tm < keepaliveTimeMin {
+		tm = keepaliveTimeMin
+	}
+
+	if timeout < 1 {
+		timeout = keepaliveTimeoutDef
+	}
+
+	return time.Duration(tm) * time.Millisecond, time.Duration(timeout) * time.Millisecond
+}
+
+func keepaliveDialOptions(ka *ConfigKeepalive) []grpc.DialOption {
+
+	tm, timeout := ka.params()
+	if tm == 0 {
+		return nil
+	}
+
+	dialer := &net.Dialer{
+		KeepAlive: tm,
+	}
+
+	return []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                tm,
+			Timeout:             timeout,
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}),
+	}
+}
+
+// keepaliveServerOptions returns the keepalive of the server, the pings of
+// the clients are accepted at the minimum interval of the clients instead
+// of the 5 minutes by default of grpc, which closes the connections of the
+// clients pinging more often.
+func keepaliveServerOptions(ka *ConfigKeepalive) []grpc.ServerOption {
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Duration(keepaliveTimeMin) * time.Millisecond,
+			PermitWithoutStream: true,
+		}),
+	}
+
+	if tm, timeout := ka.params(); tm > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    tm,
+			Timeout: timeout,
+		}))
+	}
+
+	return opts
+}
@@ -0,0 +1,318 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+	"google.golang.org/grpc/metadata"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// KeyTokenMetadataKey is the grpc metadata key of the key token of a query,
+// the query is allowed by the token instead of the access key of the call.
+const KeyTokenMetadataKey = "x-kvgo-key-token"
+
+const (
+	keyTokenVersion = "v1"
+	keyTokenTTLMax  = 24 * time.Hour
+)
+
+var errKeyTokenInvalid = errors.New("invalid key token")
+
+// keyTokenClaims is what a key token grants, the reads of the keys of the
+// prefix of the table until Expired in milliseconds.
+type keyTokenClaims struct {
+	Table   string `json:"t"`
+	Prefix  []byte `json:"p"`
+	Issued  int64  `json:"i"`
+	Expired int64  `json:"e"`
+}
+
+type keyTokenRequest struct {
+	Table  string `json:"table"`
+	Prefix []byte `json:"prefix"`
+	TTL    int64  `json:"ttl"` // in milliseconds
+}
+
+// keyTokenSecret returns the secret the tokens are signed with, the secret
+// of the server access key, which is the same on all nodes of the cluster.
+func (cn *Conn) keyTokenSecret() ([]byte, error) {
+	if cn.opts.Server.AccessKey == nil || cn.opts.Server.AccessKey.Secret == "" {
+		return nil, errors.New("no server/access_key setup")
+	}
+	return []byte(cn.secrets.value(&cn.opts.Server.AccessKey.Secret)), nil
+}
+
+func keyTokenSign(secret []byte, payload string) (string, error) {
+	sum, err := cryptoHmac(crypto.SHA256, secret, []byte(payload))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
+
+// keyTokenEncode returns the token of "v1.{claims}.{signature}", the claims
+// in base64 json and the signature the HMAC-SHA256 of "v1.{claims}".
+func keyTokenEncode(secret []byte, c *keyTokenClaims) (string, error) {
+
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	payload := keyTokenVersion + "." + base64.RawURLEncoding.EncodeToString(bs)
+
+	sign, err := keyTokenSign(secret, payload)
+	if err != nil {
+		return "", err
+	}
+
+	return payload + "." + sign, nil
+}
+
+func keyTokenDecode(secret []byte, token string) (*keyTokenClaims, error) {
+
+	n := strings.LastIndexByte(token, '.')
+	if n < 0 || !strings.HasPrefix(token, keyTokenVersion+".") {
+		return nil, errKeyTokenInvalid
+	}
+
+	sign, err := keyTokenSign(secret, token[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal([]byte(token[n+1:]), []byte(sign)) {
+		return nil, errKeyTokenInvalid
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(token[len(keyTokenVersion)+1 : n])
+	if err != nil {
+		return nil, errKeyTokenInvalid
+	}
+
+	var c keyTokenClaims
+	if err := json.Unmarshal(bs, &c); err != nil {
+		return nil, errKeyTokenInvalid
+	}
+
+	if c.Expired <= time.Now().UnixNano()/1e6 {
+		return nil, errors.New("key token expired")
+	}
+
+	return &c, nil
+}
+
+// allow returns nil if the query reads only the keys of the prefix of the
+// table, the log range queries are not allowed.
+func (it *keyTokenClaims) allow(rr *kv2.ObjectReader) error {
+
+	table := rr.TableName
+	if table == "" {
+		table = "main"
+	}
+
+	if table != it.Table {
+		return errors.New("key token, table not allowed")
+	}
+
+	switch {
+
+	case kv2.AttrAllow(rr.Mode, kv2.ObjectReaderModeKey):
+		for _, k := range rr.Keys {
+			if !bytes.HasPrefix(k, it.Prefix) {
+				return errors.New("key token, key not allowed")
+			}
+		}
+		return nil
+
+	case kv2.AttrAllow(rr.Mode, kv2.ObjectReaderModeKeyRange):
+		if !it.allowRange(rr) {
+			return errors.New("key token, key range not allowed")
+		}
+		return nil
+	}
+
+	return errors.New("key token, query mode not allowed")
+}
+
+// allowRange returns true if the range query reads the keys in
+// [Prefix, BytesPrefix(Prefix).Limit) only, under the semantics applied by
+// objectQueryKeyRange:
+//
+//	forward: (KeyOffset, BytesPrefix(KeyCutset).Limit)
+//	reverse: [KeyCutset, KeyOffset), the empty KeyOffset is the end of keys
+func (it *keyTokenClaims) allowRange(rr *kv2.ObjectReader) bool {
+
+	limit := util.BytesPrefix(it.Prefix).Limit
+	if limit == nil {
+		return true // the empty prefix grants the whole table
+	}
+
+	if kv2.AttrAllow(rr.Mode, kv2.ObjectReaderModeRevRange) {
+		return bytes.Compare(rr.KeyCutset, it.Prefix) >= 0 &&
+			len(rr.KeyOffset) > 0 && bytes.Compare(rr.KeyOffset, limit) <= 0
+	}
+
+	// the upper bound is widened to the prefix limit of the cutset, so the
+	// cutset must be in the prefix
+	return bytes.Compare(rr.KeyOffset, it.Prefix) >= 0 &&
+		bytes.HasPrefix(rr.KeyCutset, it.Prefix)
+}
+
+func keyTokenIncoming(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get(KeyTokenMetadataKey); len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return ""
+}
+
+// keyTokenAllow returns nil if the token is valid and allows the query.
+func (cn *Conn) keyTokenAllow(token string, rr *kv2.ObjectReader) error {
+
+	secret, err := cn.keyTokenSecret()
+	if err != nil {
+		return err
+	}
+
+	c, err := keyTokenDecode(secret, token)
+	if err != nil {
+		return err
+	}
+
+	return c.allow(rr)
+}
+
+// KeyTokenIssue returns a token which grants the reads of the keys of the
+// prefix of the table until the ttl (max to 24 hours) passes, signed with
+// the secret of the server access key. The token is passed by QueryToken
+// or by the grpc metadata of KeyTokenMetadataKey, so the holder reads the
+// keys without an access key of the table.
+func (cn *Conn) KeyTokenIssue(table string, prefix []byte, ttl time.Duration) (string, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		bs, err := json.Marshal(&keyTokenRequest{
+			Table:  table,
+			Prefix: prefix,
+			TTL:    int64(ttl / time.Millisecond),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: "KeyTokenIssue",
+			Body:   bs,
+		})
+		if !rs.OK() {
+			return "", rs.Error()
+		}
+
+		if len(rs.Items) == 0 {
+			return "", errors.New("no key token found")
+		}
+
+		return string(rs.DataValue().Bytes()), nil
+	}
+
+	return cn.keyTokenIssueLocal(table, prefix, ttl)
+}
+
+func (cn *Conn) keyTokenIssueLocal(table string, prefix []byte, ttl time.Duration) (string, error) {
+
+	if table == "" {
+		table = "main"
+	}
+
+	if table == sysTableName {
+		return "", errors.New("key token, table not allowed")
+	}
+
+	if ttl < time.Second || ttl > keyTokenTTLMax {
+		return "", errors.New("invalid key token ttl")
+	}
+
+	secret, err := cn.keyTokenSecret()
+	if err != nil {
+		return "", err
+	}
+
+	tn := time.Now().UnixNano() / 1e6
+
+	return keyTokenEncode(secret, &keyTokenClaims{
+		Table:   table,
+		Prefix:  prefix,
+		Issued:  tn,
+		Expired: tn + int64(ttl/time.Millisecond),
+	})
+}
+
+// QueryToken reads the keys by the token of KeyTokenIssue, in client mode
+// the query is allowed by the token only, the access keys of the nodes of
+// Cluster.MainNodes are not checked.
+func (cn *Conn) QueryToken(token string, rr *kv2.ObjectReader) *kv2.ObjectResult {
+
+	if cn.opts.ClientConnectEnable ||
+		(len(cn.opts.Cluster.MainNodes) > 0 && cn.opts.Server.Bind == "") {
+		return cn.objectQueryRemote(rr, KeyTokenMetadataKey, token)
+	}
+
+	if err := cn.keyTokenAllow(token, rr); err != nil {
+		return kv2.NewObjectResultAccessDenied(err.Error())
+	}
+
+	return cn.Query(rr)
+}
+
+func (cn *Conn) keyTokenCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	var req keyTokenRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	if req.Table == "" {
+		req.Table = "main"
+	}
+
+	if av != nil {
+		if err := av.Allow(authPermTableRead,
+			hauth.NewScopeFilter(AuthScopeTable, req.Table)); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	token, err := cn.keyTokenIssueLocal(req.Table, req.Prefix, time.Duration(req.TTL)*time.Millisecond)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	return sysCmdResultBytes([]byte(token))
+}
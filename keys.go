@@ -0,0 +1,130 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Key schema helpers
+//
+// Keys are built as "<ns>:<part>:<part>...", numeric parts are encoded in
+// big-endian fixed width (the same as the log-id and ttl keys of the server),
+// so that the sort order of the keys equals the numeric order of the parts,
+// and time parts are encoded in milliseconds as ObjectMeta.Created/Updated.
+
+const (
+	keySchemaSep = ':'
+)
+
+// NsKey returns a key of the namespace ns composed by the parts args.
+// Supported types of parts are string, []byte, uint32, uint64, int, int64
+// and time.Time, other types are formatted by fmt.Sprint.
+func NsKey(ns string, args ...interface{}) []byte {
+
+	key := []byte(ns)
+
+	for _, v := range args {
+
+		key = append(key, keySchemaSep)
+
+		switch v.(type) {
+
+		case string:
+			key = append(key, []byte(v.(string))...)
+
+		case []byte:
+			key = append(key, v.([]byte)...)
+
+		case uint32:
+			key = append(key, uint32ToBytes(v.(uint32))...)
+
+		case uint64:
+			key = append(key, uint64ToBytes(v.(uint64))...)
+
+		case int:
+			key = append(key, uint64ToBytes(keySchemaInt(int64(v.(int))))...)
+
+		case int64:
+			key = append(key, uint64ToBytes(keySchemaInt(v.(int64)))...)
+
+		case time.Time:
+			key = append(key, uint64ToBytes(keySchemaTime(v.(time.Time)))...)
+
+		default:
+			key = append(key, []byte(fmt.Sprint(v))...)
+		}
+	}
+
+	return key
+}
+
+// NsIncrKey returns a key of the namespace ns ordered by the incr-id,
+// the incr-id usually comes from ObjectMeta.IncrId or NextSeq.
+func NsIncrKey(ns string, incrId uint64) []byte {
+	return NsKey(ns, incrId)
+}
+
+// NsTimeKey returns a key of the namespace ns ordered by time from the
+// oldest to the newest.
+func NsTimeKey(ns string, t time.Time, args ...interface{}) []byte {
+	return NsKey(ns, append([]interface{}{keySchemaTime(t)}, args...)...)
+}
+
+// NsTimeKeyRev returns a key of the namespace ns ordered by time from the
+// newest to the oldest.
+func NsTimeKeyRev(ns string, t time.Time, args ...interface{}) []byte {
+	return NsKey(ns, append([]interface{}{^keySchemaTime(t)}, args...)...)
+}
+
+// NsTimeKeyParse returns the time of a key created by NsTimeKey or
+// NsTimeKeyRev (rev = true).
+func NsTimeKeyParse(ns string, key []byte, rev bool) (time.Time, error) {
+
+	prefix := append([]byte(ns), keySchemaSep)
+
+	if !bytes.HasPrefix(key, prefix) || len(key) < len(prefix)+8 {
+		return time.Time{}, errors.New("invalid time key")
+	}
+
+	ms := binary.BigEndian.Uint64(key[len(prefix) : len(prefix)+8])
+	if rev {
+		ms = ^ms
+	}
+
+	return time.Unix(int64(ms/1e3), int64(ms%1e3)*1e6), nil
+}
+
+// NsKeyRange returns the offset and cutset of all keys prefixed by
+// NsKey(ns, args...), it can be used in KeyRangeSet directly. The cutset
+// is the prefix itself, the forward range queries end before the least key
+// greater than all the keys of the prefix (see keyPrefixLimit), so the keys
+// with 0xff bytes after the prefix are included.
+func NsKeyRange(ns string, args ...interface{}) ([]byte, []byte) {
+	offset := append(NsKey(ns, args...), keySchemaSep)
+	return offset, bytesClone(offset)
+}
+
+func keySchemaInt(v int64) uint64 {
+	return uint64(v) ^ (1 << 63)
+}
+
+func keySchemaTime(t time.Time) uint64 {
+	return uint64(t.UnixNano() / 1e6)
+}
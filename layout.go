@@ -0,0 +1,281 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+)
+
+// dataLayoutVersion is the version of the layout of the data directory (the
+// directories of the tables and the files beside them), the format of the
+// entries of a table is versioned by dataFormatVersion.
+const (
+	dataLayoutVersion = 1
+	dataLayoutFile    = "LAYOUT"
+	dataLayoutEngine  = "goleveldb"
+)
+
+var dataLayoutTableDirReg = regexp.MustCompile(`^([0-9]+)_0_0$`)
+
+// DataLayout is the layout descriptor of a data directory.
+type DataLayout struct {
+	Version int    `json:"version"`
+	Engine  string `json:"engine"`
+	Release string `json:"release,omitempty"`
+}
+
+func dbTableDir(dataDir string, tableId uint32) string {
+	return filepath.Clean(fmt.Sprintf("%s/%d_%d_%d", dataDir, tableId, 0, 0))
+}
+
+func dataLayoutGet(dir string) (*DataLayout, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, dataLayoutFile))
+	if err != nil {
+		return nil, err
+	}
+	var layout DataLayout
+	if err := json.Unmarshal(bs, &layout); err != nil {
+		return nil, err
+	}
+	return &layout, nil
+}
+
+// dataLayoutSetup checks the layout of the data directory, the directories
+// written before the layout versioning are of version 1, and the layouts of
+// a newer release or of another engine are refused to open.
+func dataLayoutSetup(dir string) error {
+
+	layout, err := dataLayoutGet(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("data directory %s invalid layout file, err %s", dir, err.Error())
+	}
+
+	if layout != nil {
+
+		if layout.Engine != dataLayoutEngine {
+			return fmt.Errorf("data directory %s engine %s not supported", dir, layout.Engine)
+		}
+
+		if layout.Version > dataLayoutVersion {
+			return fmt.Errorf("data directory %s layout version %d is newer than the version %d of this release (%s), upgrade kvgo to open it",
+				dir, layout.Version, dataLayoutVersion, Version)
+		}
+
+		if layout.Version == dataLayoutVersion && layout.Release == Version {
+			return nil
+		}
+	}
+
+	bs, _ := json.MarshalIndent(&DataLayout{
+		Version: dataLayoutVersion,
+		Engine:  dataLayoutEngine,
+		Release: Version,
+	}, "", "  ")
+
+	tmp := filepath.Join(dir, dataLayoutFile+".tmp")
+	if err := ioutil.WriteFile(tmp, append(bs, '\n'), 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, dataLayoutFile))
+}
+
+// InspectReport is the report of Inspect.
+type InspectReport struct {
+	Directory string          `json:"directory"`
+	Layout    *DataLayout     `json:"layout,omitempty"`
+	LockPid   int             `json:"lock_pid,omitempty"`
+	Tables    []*InspectTable `json:"tables"`
+	Issues    []string        `json:"issues,omitempty"`
+}
+
+// InspectTable is the state of a table of InspectReport, the sizes are the
+// approximate disk sizes in bytes.
+type InspectTable struct {
+	Name          string  `json:"name"`
+	Id            uint32  `json:"id"`
+	Directory     string  `json:"directory"`
+	InstanceId    string  `json:"instance_id,omitempty"`
+	FormatVersion int     `json:"format_version"`
+	LevelTables   []int   `json:"level_tables,omitempty"`
+	LevelSizes    []int64 `json:"level_sizes,omitempty"`
+	MetaSize      int64   `json:"meta_size"`
+	DataSize      int64   `json:"data_size"`
+	LogSize       int64   `json:"log_size"`
+	LogOffset     uint64  `json:"log_offset"`
+	LogCompacted  uint64  `json:"log_compacted,omitempty"`
+}
+
+func (it *InspectReport) issuef(format string, args ...interface{}) {
+	it.Issues = append(it.Issues, fmt.Sprintf(format, args...))
+}
+
+// Inspect reports the layout, the tables and the inconsistencies of the
+// data directory without modifying it. The tables are opened read-only, the
+// directory should not be in use by a running store (inspect a copy of it),
+// and the tables of the extra data, wal or tiering directories are not
+// readable by Inspect.
+func Inspect(dir string) (*InspectReport, error) {
+
+	dir = filepath.Clean(dir)
+
+	if st, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !st.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	rep := &InspectReport{
+		Directory: dir,
+		Tables:    []*InspectTable{},
+	}
+
+	if layout, err := dataLayoutGet(dir); err == nil {
+		rep.Layout = layout
+		if layout.Engine != dataLayoutEngine {
+			rep.issuef("layout engine %s not supported", layout.Engine)
+		}
+		if layout.Version > dataLayoutVersion {
+			rep.issuef("layout version %d newer than %d", layout.Version, dataLayoutVersion)
+		}
+	} else if os.IsNotExist(err) {
+		rep.issuef("layout file not found, written by a release before the layout versioning")
+	} else {
+		rep.issuef("invalid layout file, err %s", err.Error())
+	}
+
+	if pid := dirLockPid(filepath.Join(dir, dirLockFile)); pid > 0 && processAlive(pid) {
+		rep.LockPid = pid
+		rep.issuef("data directory in use by pid %d, the report may be inconsistent", pid)
+	}
+
+	sysDb, err := inspectOpen(filepath.Join(dir, sysTableName))
+	if err != nil {
+		return nil, fmt.Errorf("open table %s, err %s", sysTableName, err.Error())
+	}
+	defer sysDb.Close()
+
+	rep.Tables = append(rep.Tables, inspectTable(rep, &dbTable{
+		db:        sysDb,
+		tableName: sysTableName,
+	}, filepath.Join(dir, sysTableName)))
+
+	ls, err := dbSysTableList(sysDb)
+	if err != nil {
+		rep.issuef("table %s, invalid table list, err %s", sysTableName, err.Error())
+	}
+
+	dirs := map[string]bool{}
+	for _, t := range ls {
+
+		tdir := dbTableDir(dir, t.tableId)
+		dirs[filepath.Base(tdir)] = true
+
+		db, err := inspectOpen(tdir)
+		if err != nil {
+			rep.issuef("table %s (%d), open %s, err %s", t.tableName, t.tableId, tdir, err.Error())
+			continue
+		}
+
+		t.db = db
+		rep.Tables = append(rep.Tables, inspectTable(rep, t, tdir))
+		db.Close()
+	}
+
+	if fis, err := ioutil.ReadDir(dir); err == nil {
+		for _, fi := range fis {
+			if fi.IsDir() && dataLayoutTableDirReg.MatchString(fi.Name()) && !dirs[fi.Name()] {
+				rep.issuef("directory %s not of any table", fi.Name())
+			}
+		}
+	}
+
+	sort.Slice(rep.Tables[1:], func(i, j int) bool {
+		return rep.Tables[1+i].Id < rep.Tables[1+j].Id
+	})
+
+	return rep, nil
+}
+
+func inspectOpen(dir string) (*leveldb.DB, error) {
+	return leveldb.OpenFile(dir, &opt.Options{
+		ReadOnly:       true,
+		ErrorIfMissing: true,
+	})
+}
+
+func inspectTable(rep *InspectReport, tdb *dbTable, dir string) *InspectTable {
+
+	t := &InspectTable{
+		Name:      tdb.tableName,
+		Id:        tdb.tableId,
+		Directory: dir,
+	}
+
+	if bs, err := tdb.db.Get(keySysInstanceId, nil); err == nil {
+		t.InstanceId = string(bs)
+	} else {
+		rep.issuef("table %s, instance id not found", t.Name)
+	}
+
+	if v, err := dataFormatVersionGet(tdb.db); err != nil {
+		rep.issuef("table %s, invalid format version, err %s", t.Name, err.Error())
+	} else {
+		t.FormatVersion = v
+		if v > dataFormatVersion {
+			rep.issuef("table %s, format version %d newer than %d", t.Name, v, dataFormatVersion)
+		} else if v < dataFormatVersion {
+			rep.issuef("table %s, format version %d to be migrated to %d on open", t.Name, v, dataFormatVersion)
+		}
+	}
+
+	var st leveldb.DBStats
+	if err := tdb.db.Stats(&st); err == nil {
+		t.LevelTables, t.LevelSizes = st.LevelTablesCounts, st.LevelSizes
+	}
+
+	if s, err := tdb.db.SizeOf([]util.Range{
+		{Start: []byte{nsKeyMeta}, Limit: []byte{nsKeyMeta + 1}},
+		{Start: []byte{nsKeyData}, Limit: []byte{nsKeyData + 1}},
+	}); err == nil && len(s) == 2 {
+		t.MetaSize, t.DataSize = s[0], s[1]
+	}
+	t.LogSize = tdb.logSize()
+
+	iter := tdb.db.NewIterator(logRange(), nil)
+	if iter.Last() && len(iter.Key()) == 9 {
+		t.LogOffset = binary.BigEndian.Uint64(iter.Key()[1:])
+	}
+	iter.Release()
+
+	if v, err := tdb.logCompacted(); err != nil {
+		rep.issuef("table %s, invalid log compacted offset, err %s", t.Name, err.Error())
+	} else {
+		t.LogCompacted = v
+	}
+
+	return t
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc/status"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	leadershipTransferTimeout = 30 * time.Second
+	leadershipTransferPoll    = 200 * time.Millisecond
+
+	// the hint of the target in the message of errMaintenance
+	errTransferredTo = ", transferred to "
+)
+
+type leadershipTransferRequest struct {
+	Target  string `json:"target"`
+	Timeout int64  `json:"timeout,omitempty"`
+}
+
+type leadershipTransferResult struct {
+	Addr   string `json:"addr"`
+	Target string `json:"target"`
+}
+
+// TransferLeadership hands the client requests of the node over to the
+// main node target, e.g. of a healthier zone, before the node is taken down
+// for a maintenance.
+//
+// The main nodes are leaderless (see NodeRoleMain), every one of them
+// coordinates the writes it receives, so the leadership of a node is the
+// share of the client requests it serves. The transfer checks the target is
+// a healthy voter of the same membership epoch, puts the node in
+// maintenance, so it refuses the new client requests with the target as the
+// hint the clients fail over to, and waits until the target has pulled all
+// the logs of the node. The maintenance is turned off again if the target
+// does not catch up in time. The leadership is taken back by turning the
+// maintenance off.
+func (cn *Conn) TransferLeadership(target string) error {
+	return cn.leadershipTransfer(target, leadershipTransferTimeout)
+}
+
+func (cn *Conn) leadershipTransfer(target string, timeout time.Duration) error {
+
+	if cn.opts.ClientConnectEnable || len(cn.opts.Cluster.MainNodes) == 0 {
+		return errors.New("leadership transfer only supported in the main nodes of a cluster")
+	}
+
+	if cn.dbSys == nil {
+		return errors.New("store not open")
+	}
+
+	if cn.Maintenance() {
+		return errors.New("node already in maintenance")
+	}
+
+	if target == cn.opts.Server.Bind {
+		return errors.New("leadership transfer to the node itself")
+	}
+
+	var node *ClientConfig
+	for _, v := range cn.mainNodes() {
+		if v.Addr == target {
+			node = v
+			break
+		}
+	}
+	if node == nil {
+		return fmt.Errorf("node %s not a voter of the cluster", target)
+	}
+
+	var st nodeStatusResult
+	if err := nodeCmdRemote(node, "NodeStatus", struct{}{}, &st); err != nil {
+		return err
+	}
+	if err := cn.leadershipTargetValid(&st); err != nil {
+		return err
+	}
+
+	cn.transferTarget.Store(target)
+	if err := cn.MaintenanceSet(true); err != nil {
+		cn.transferTarget.Store("")
+		return err
+	}
+
+	// the node coordinates no new writes from now on, the target has the
+	// leadership once it has pulled the logs of the node up to here
+	offsets, err := cn.nodeLogOffsets("")
+	if err == nil {
+		err = errors.New("timeout")
+		for tn := time.Now(); time.Since(tn) < timeout; time.Sleep(leadershipTransferPoll) {
+			if err2 := nodeCmdRemote(node, "NodeStatus", struct{}{}, &st); err2 == nil &&
+				leadershipCaughtUp(cn.opts.Server.Bind, offsets, &st) {
+				err = nil
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		if err2 := cn.MaintenanceSet(false); err2 != nil {
+			hlog.Printf("warn", "kvgo leadership transfer, maintenance off err %s", err2.Error())
+		}
+		return fmt.Errorf("leadership transfer to %s, target not caught up, err %s", target, err.Error())
+	}
+
+	hlog.Printf("warn", "kvgo node %s leadership transferred to %s", cn.opts.Server.Bind, target)
+
+	return nil
+}
+
+// leadershipTargetValid returns nil if the target of the status is a
+// healthy voter of the membership of the node.
+func (cn *Conn) leadershipTargetValid(st *nodeStatusResult) error {
+	epoch, _ := cn.memberEpoch()
+	switch {
+	case st.Removed:
+		return fmt.Errorf("node %s removed", st.Addr)
+	case st.Maintenance:
+		return fmt.Errorf("node %s in maintenance", st.Addr)
+	case st.Fenced || st.Epoch != epoch:
+		return fmt.Errorf("node %s of epoch %d, expected %d", st.Addr, st.Epoch, epoch)
+	}
+	return nil
+}
+
+// leadershipCaughtUp returns whether the target of the status has pulled
+// the logs of the node addr up to the offsets.
+func leadershipCaughtUp(addr string, offsets map[string]uint64, st *nodeStatusResult) bool {
+	pulled := st.Pulled[addr]
+	for name, offset := range offsets {
+		if offset > 0 && pulled[name] < offset {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeRefusedTarget returns the node the refused request of the node in
+// maintenance was transferred to, if any.
+func nodeRefusedTarget(err error) string {
+	msg := status.Convert(err).Message()
+	if !strings.HasPrefix(msg, errMaintenanceMessage) {
+		return ""
+	}
+	if n := strings.Index(msg, errTransferredTo); n > 0 {
+		return msg[n+len(errTransferredTo):]
+	}
+	return ""
+}
+
+// failoverTarget moves the main node the refused request of the node i was
+// transferred to next to the node i, so the clients fail over to it first.
+func (it *ConfigCluster) failoverTarget(nodes []*ClientConfig, i int, err error) {
+
+	target := nodeRefusedTarget(err)
+	if target == "" || i+1 >= len(nodes) {
+		return
+	}
+
+	for j := i + 1; j < len(nodes); j++ {
+		if nodes[j].Addr == target {
+			nodes[i+1], nodes[j] = nodes[j], nodes[i+1]
+			return
+		}
+	}
+
+	for _, v := range dataNodes(it.MainNodes) {
+		if v.Addr == target {
+			nodes[i+1] = v
+			return
+		}
+	}
+}
+
+func (cn *Conn) leadershipTransferCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req leadershipTransferRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	timeout := leadershipTransferTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	if err := cn.leadershipTransfer(req.Target, timeout); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(&leadershipTransferResult{
+		Addr:   cn.opts.Server.Bind,
+		Target: req.Target,
+	})
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
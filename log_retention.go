@@ -0,0 +1,211 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const logCompactedPrefix = "log compacted"
+
+var keySysLogCompacted = append([]byte{nsKeySys}, []byte("log:compacted")...)
+
+func logRange() *util.Range {
+	return &util.Range{
+		Start: keyEncode(nsKeyLog, uint64ToBytes(0)),
+		Limit: keyEncode(nsKeyLog, []byte{0xff}),
+	}
+}
+
+// logCompacted returns the newest log offset of the deletes removed from the
+// write log of the table, the pulls of the log from an older offset miss
+// the deletes.
+func (tdb *dbTable) logCompacted() (uint64, error) {
+	bs, err := tdb.db.Get(keySysLogCompacted, nil)
+	if err != nil {
+		if err.Error() == ldbNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(string(bs), 10, 64)
+}
+
+// logCompactedCheck returns an error if the log is pulled from an offset
+// older than the compacted offset, the puller copies the snapshot of the
+// table instead. The pulls from 0 are of new replicas that have no deletes
+// to miss.
+func (tdb *dbTable) logCompactedCheck(offset uint64) error {
+	if offset == 0 {
+		return nil
+	}
+	compacted, err := tdb.logCompacted()
+	if err != nil {
+		return err
+	}
+	if offset < compacted {
+		return fmt.Errorf("%s, offset %d < %d", logCompactedPrefix, offset, compacted)
+	}
+	return nil
+}
+
+func logCompactedError(msg string) bool {
+	return strings.HasPrefix(msg, logCompactedPrefix)
+}
+
+// logSize returns the approximate disk size in bytes of the write log of
+// the table.
+func (tdb *dbTable) logSize() int64 {
+	if s, err := tdb.db.SizeOf([]util.Range{*logRange()}); err == nil && len(s) > 0 {
+		return s[0]
+	}
+	return 0
+}
+
+// logRetentionSafeOffset returns the log offset of the table pulled by all
+// the other main nodes holding data, the deletes after it are kept by the
+// retention time.
+func (cn *Conn) logRetentionSafeOffset(tableName string) uint64 {
+
+	lags := map[string]*ReplicaLag{}
+	for _, v := range cn.ReplicationLags() {
+		lags[v.Addr] = v
+	}
+
+	offset := ^uint64(0)
+
+	for _, v := range cn.mainNodes() {
+		if v.Addr == cn.opts.Server.Bind || v.witness() {
+			continue
+		}
+		lag, ok := lags[v.Addr]
+		if !ok {
+			return 0
+		}
+		if n := lag.offsets[tableName]; n < offset {
+			offset = n
+		}
+	}
+
+	return offset
+}
+
+// logRetentionTable removes the deletes of the write log of the table that
+// are out of Feature.LogRetentionTime or Feature.LogRetentionSize, the
+// newest write of every live key is always kept, so the log is compacted
+// into a snapshot of the table and the deletes of the retention.
+func (cn *Conn) logRetentionTable(tdb *dbTable) error {
+
+	var (
+		retTime = cn.opts.Feature.LogRetentionTime
+		retSize = cn.opts.Feature.LogRetentionSize * opt.MiB
+	)
+
+	if retTime < 1 && retSize < 1 {
+		return nil
+	}
+
+	var (
+		over      = int64(0)
+		safe      = uint64(0)
+		cutTime   = time.Now().Unix() - retTime
+		compacted = uint64(0)
+		ndel      = 0
+		batch     = new(leveldb.Batch)
+		rg        = logRange()
+	)
+
+	if retSize > 0 {
+		if size := tdb.logSize(); size > retSize {
+			over = size - retSize
+		}
+	}
+
+	if retTime > 0 {
+		safe = cn.logRetentionSafeOffset(tdb.tableName)
+	}
+
+	iter := tdb.db.NewIterator(rg, nil)
+
+	for iter.Next() {
+
+		if bytes.Compare(iter.Key(), rg.Limit) >= 0 || len(iter.Key()) != 9 {
+			break
+		}
+
+		offset := binary.BigEndian.Uint64(iter.Key()[1:])
+
+		byTime := retTime > 0 && VersionTime(offset).Unix() < cutTime
+		if !byTime && over <= 0 {
+			break
+		}
+
+		if len(iter.Value()) < 2 {
+			continue
+		}
+
+		meta, err := kv2.ObjectMetaDecode(iter.Value())
+		if err != nil || meta == nil ||
+			!kv2.AttrAllow(meta.Attrs, kv2.ObjectMetaAttrDelete) {
+			continue
+		}
+
+		if over <= 0 && offset > safe {
+			break
+		}
+
+		batch.Delete(iter.Key())
+		over -= int64(len(iter.Key()) + len(iter.Value()))
+		compacted = offset
+		ndel += 1
+
+		if ndel%1000 == 0 {
+			if err := cn.logCompactedSet(tdb, batch, compacted); err != nil {
+				iter.Release()
+				return err
+			}
+			batch = new(leveldb.Batch)
+		}
+	}
+
+	iter.Release()
+
+	if compacted > 0 {
+		if err := cn.logCompactedSet(tdb, batch, compacted); err != nil {
+			return err
+		}
+		hlog.Printf("info", "table %s, log retention removed %d deletes, compacted offset %d",
+			tdb.tableName, ndel, compacted)
+	}
+
+	return nil
+}
+
+func (cn *Conn) logCompactedSet(tdb *dbTable, batch *leveldb.Batch, offset uint64) error {
+	batch.Put(keySysLogCompacted, []byte(strconv.FormatUint(offset, 10)))
+	return cn.dbWrite(tdb, batch)
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// errMaintenance is returned to the clients by a node in maintenance, it is
+// of the grpc code Unavailable so the clients fail over to the other main
+// nodes.
+var errMaintenance = status.Error(codes.Unavailable, errMaintenanceMessage)
+
+const errMaintenanceMessage = "node in maintenance"
+
+var keySysNodeMaintenance = append([]byte{nsKeySys}, []byte("node:maintenance")...)
+
+// nodeRefused returns whether the request was refused by a node in
+// maintenance or lagging behind the cluster, the request was not run and
+// can be sent to another node.
+func nodeRefused(err error) bool {
+	st := status.Convert(err)
+	return st.Code() == codes.Unavailable &&
+		(strings.HasPrefix(st.Message(), errMaintenanceMessage) ||
+			strings.HasPrefix(st.Message(), errReplicaLagMessage))
+}
+
+type maintenanceRequest struct {
+	Enable bool `json:"enable"`
+}
+
+type maintenanceResult struct {
+	Addr        string `json:"addr"`
+	Maintenance bool   `json:"maintenance"`
+}
+
+// Maintenance returns whether the node is in maintenance.
+//
+// A node in maintenance still replicates the writes of the other main
+// nodes and votes in their quorums, but it does not coordinate the writes
+// or serve the queries of the clients, reports not ready to the load
+// balancers, and pauses the scheduled backups, the tiering migration and
+// the log compaction. The state is saved and kept across restarts until it
+// is turned off.
+func (cn *Conn) Maintenance() bool {
+	return atomic.LoadInt32(&cn.maintenance) == 1
+}
+
+// MaintenanceSet turns the maintenance of the node on or off.
+func (cn *Conn) MaintenanceSet(enable bool) error {
+
+	if enable == cn.Maintenance() {
+		return nil
+	}
+
+	var err error
+	if enable {
+		err = cn.dbSys.Put(keySysNodeMaintenance, []byte("1"), nil)
+	} else {
+		err = cn.dbSys.Delete(keySysNodeMaintenance, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	if enable {
+		atomic.StoreInt32(&cn.maintenance, 1)
+	} else {
+		atomic.StoreInt32(&cn.maintenance, 0)
+		cn.transferTarget.Store("")
+	}
+
+	hlog.Printf("warn", "kvgo node %s maintenance %v", cn.opts.Server.Bind, enable)
+
+	return nil
+}
+
+// maintenanceErr returns errMaintenance, with the hint of the node the
+// leadership was transferred to, see TransferLeadership.
+func (cn *Conn) maintenanceErr() error {
+	if v, _ := cn.transferTarget.Load().(string); v != "" {
+		return status.Error(codes.Unavailable, errMaintenanceMessage+errTransferredTo+v)
+	}
+	return errMaintenance
+}
+
+func (cn *Conn) maintenanceLoad() error {
+
+	if cn.dbSys == nil {
+		return nil
+	}
+
+	if _, err := cn.dbSys.Get(keySysNodeMaintenance, nil); err != nil {
+		if err.Error() == ldbNotFound {
+			return nil
+		}
+		return err
+	}
+
+	atomic.StoreInt32(&cn.maintenance, 1)
+	hlog.Printf("warn", "kvgo node %s in maintenance", cn.opts.Server.Bind)
+
+	return nil
+}
+
+func (cn *Conn) maintenanceCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req maintenanceRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	if cn.dbSys == nil {
+		return kv2.NewObjectResultServerError(errors.New("store not open"))
+	}
+
+	if err := cn.MaintenanceSet(req.Enable); err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	bs, err := json.Marshal(&maintenanceResult{
+		Addr:        cn.opts.Server.Bind,
+		Maintenance: cn.Maintenance(),
+	})
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
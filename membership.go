@@ -0,0 +1,531 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	NodeJoinLearning = "learning"
+	NodeJoinJoined   = "joined"
+	NodeJoinFailed   = "failed"
+
+	nodeStateLearner = "learner"
+	nodeStateVoter   = "voter"
+
+	nodeJoinTimeout = int64(3600)
+)
+
+func keySysNodeAdded(addr string) []byte {
+	return append([]byte{nsKeySys}, []byte("node:added:"+addr)...)
+}
+
+func keySysReplicaOfAdded(addr string) []byte {
+	return append([]byte{nsKeySys}, []byte("replica-of:added:"+addr)...)
+}
+
+func keySysReplicaOfRemoved(addr string) []byte {
+	return append([]byte{nsKeySys}, []byte("replica-of:removed:"+addr)...)
+}
+
+// nodeMember is a main node added at runtime, the learners pull the logs of
+// the main nodes but are not counted in the quorums until they are voters.
+type nodeMember struct {
+	Node  *ClientConfig `json:"node"`
+	State string        `json:"state"`
+}
+
+// NodeJoinStatus is the progress of the addition of a main node, the node
+// joins the quorums after it has pulled the logs of all other main nodes.
+type NodeJoinStatus struct {
+	Addr    string `json:"addr"`
+	State   string `json:"state"`
+	Tables  int    `json:"tables"`
+	Synced  int    `json:"synced"`
+	Message string `json:"message,omitempty"`
+	Created int64  `json:"created"`
+	Updated int64  `json:"updated"`
+}
+
+type membershipRequest struct {
+	Node      *ClientConfig        `json:"node,omitempty"`
+	ReplicaOf *ConfigReplicaOfNode `json:"replica_of,omitempty"`
+	Addr      string               `json:"addr,omitempty"`
+	Members   []*nodeMember        `json:"members,omitempty"`
+	Epoch     uint64               `json:"epoch,omitempty"`
+}
+
+// membersAdded returns the main nodes and the Replica-Of nodes added at
+// runtime and the removed Replica-Of nodes.
+func (cn *Conn) membersAdded() ([]*nodeMember, []*ConfigReplicaOfNode, map[string]bool, error) {
+
+	var (
+		added     = []*nodeMember{}
+		replicaOf = []*ConfigReplicaOfNode{}
+		removed   = map[string]bool{}
+	)
+
+	iter := cn.dbSys.NewIterator(util.BytesPrefix(keySysNodeAdded("")), nil)
+	for iter.Next() {
+		var m nodeMember
+		if err := json.Unmarshal(iter.Value(), &m); err == nil && m.Node != nil {
+			added = append(added, &m)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	iter = cn.dbSys.NewIterator(util.BytesPrefix(keySysReplicaOfAdded("")), nil)
+	for iter.Next() {
+		var v ConfigReplicaOfNode
+		if err := json.Unmarshal(iter.Value(), &v); err == nil && v.ClientConfig != nil {
+			replicaOf = append(replicaOf, &v)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	iter = cn.dbSys.NewIterator(util.BytesPrefix(keySysReplicaOfRemoved("")), nil)
+	for iter.Next() {
+		removed[string(iter.Key()[len(keySysReplicaOfRemoved("")):])] = true
+	}
+	iter.Release()
+
+	return added, replicaOf, removed, iter.Error()
+}
+
+// replicaOfNodes returns the Replica-Of nodes of the setup and the ones
+// added at runtime, without the removed ones.
+func (cn *Conn) replicaOfNodes() []*ConfigReplicaOfNode {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	if cn.members.replicaOf != nil {
+		return cn.members.replicaOf
+	}
+	return cn.opts.Cluster.ReplicaOfNodes
+}
+
+// nodeLearner returns whether the local node is a learner.
+func (cn *Conn) nodeLearner() bool {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	for _, v := range cn.members.learners {
+		if v.Addr == cn.opts.Server.Bind {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeJoinApply saves the states of the members of the epoch, the saved
+// states override the setup of the local node.
+func (cn *Conn) nodeJoinApply(members []*nodeMember, epoch uint64) error {
+
+	for _, m := range members {
+
+		if m.Node == nil || m.Node.Addr == "" {
+			return errors.New("no addr setup")
+		}
+
+		if !m.Node.accessKeyValid() {
+			return fmt.Errorf("node %s, no access_key setup", m.Node.Addr)
+		}
+
+		if err := cn.dbSys.Delete(keySysNodeRemoved(m.Node.Addr), nil); err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		if err := cn.dbSys.Put(keySysNodeAdded(m.Node.Addr), bs, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := cn.epochSet(epoch); err != nil {
+		return err
+	}
+
+	return cn.membersRefresh()
+}
+
+// accessKeyValid returns true if the access key of the node is setup, it
+// is added to the keys of the internal calls of the members.
+func (it *ClientConfig) accessKeyValid() bool {
+	return it.AccessKey != nil && it.AccessKey.Id != "" && it.AccessKey.Secret != ""
+}
+
+// NodeAdd starts the addition of the main node to the cluster. The node is
+// added as a learner first, which pulls the logs of all main nodes and is
+// not counted in the quorums, and it becomes a voter after it has caught
+// up, so a quorum of the new membership always has the committed writes.
+// One node is added or removed at a time, the progress is returned by
+// NodeJoinStatusList.
+//
+// The new node is started with itself as the only main node of its setup,
+// the membership of the cluster is sent to it and persisted by all nodes.
+func (cn *Conn) NodeAdd(node *ClientConfig) error {
+
+	if cn.opts.ClientConnectEnable || len(cn.opts.Cluster.MainNodes) == 0 {
+		return errors.New("node add only supported in the main nodes of a cluster")
+	}
+
+	if node == nil || node.Addr == "" {
+		return errors.New("no addr setup")
+	}
+
+	if !node.accessKeyValid() {
+		return errors.New("no access_key setup")
+	}
+
+	host, port, err := net.SplitHostPort(node.Addr)
+	if err != nil {
+		return err
+	}
+	node.Addr = net.JoinHostPort(host, port)
+
+	voters := cn.mainNodes()
+	if len(voters)+1 > kv2.ObjectClusterNodeMax {
+		return errors.New("Deny of kv2.ObjectClusterNodeMax")
+	}
+	for _, v := range voters {
+		if v.Addr == node.Addr {
+			return errors.New("node already in the cluster")
+		}
+	}
+
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+
+	if cn.members.changing() {
+		return errors.New("membership change in progress")
+	}
+
+	if cn.members.joins == nil {
+		cn.members.joins = map[string]*NodeJoinStatus{}
+	}
+
+	tn := time.Now().UnixNano() / 1e6
+	cn.members.joins[node.Addr] = &NodeJoinStatus{
+		Addr:    node.Addr,
+		State:   NodeJoinLearning,
+		Created: tn,
+		Updated: tn,
+	}
+
+	go cn.nodeJoinRun(node, voters)
+
+	return nil
+}
+
+// changing returns whether a node is being added or removed, must be called
+// with the lock held.
+func (it *clusterMembers) changing() bool {
+	for _, st := range it.decommission {
+		if st.State == DecommissionDraining || st.State == DecommissionRemoving {
+			return true
+		}
+	}
+	for _, st := range it.joins {
+		if st.State == NodeJoinLearning {
+			return true
+		}
+	}
+	return false
+}
+
+func (cn *Conn) nodeJoinUpdate(addr string, fn func(st *NodeJoinStatus)) {
+	cn.members.mu.Lock()
+	defer cn.members.mu.Unlock()
+	if st, ok := cn.members.joins[addr]; ok {
+		fn(st)
+		st.Updated = time.Now().UnixNano() / 1e6
+	}
+}
+
+// nodeJoinSend sends the states of the members to the voters and the node.
+func (cn *Conn) nodeJoinSend(node *ClientConfig, voters []*ClientConfig, state string) error {
+
+	req := &membershipRequest{
+		Epoch: cn.epochNext(),
+	}
+	for _, v := range voters {
+		req.Members = append(req.Members, &nodeMember{
+			Node:  v,
+			State: nodeStateVoter,
+		})
+	}
+	req.Members = append(req.Members, &nodeMember{
+		Node:  node,
+		State: state,
+	})
+
+	// the node is the first one to know it is a learner and the last one
+	// to know it is a voter
+	targets := []*ClientConfig{node}
+	if state == nodeStateVoter {
+		targets = append(append([]*ClientConfig{}, voters...), node)
+	} else {
+		targets = append(targets, voters...)
+	}
+
+	for _, v := range targets {
+		var err error
+		if v.Addr == cn.opts.Server.Bind {
+			err = cn.nodeJoinApply(req.Members, req.Epoch)
+		} else {
+			err = nodeCmdRemote(v, "NodeJoin", req, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cn *Conn) nodeJoinRun(node *ClientConfig, voters []*ClientConfig) {
+
+	var (
+		tn  = time.Now().Unix()
+		err = cn.nodeJoinSend(node, voters, nodeStateLearner)
+	)
+
+	// the witness has no logs to catch up with
+	for err == nil && !cn.close && !node.witness() {
+
+		if time.Now().Unix()-tn > nodeJoinTimeout {
+			err = errors.New("timeout waiting for the replication")
+			break
+		}
+
+		synced, total, err2 := cn.nodeJoinCheck(node, voters)
+		if err2 == nil {
+			cn.nodeJoinUpdate(node.Addr, func(st *NodeJoinStatus) {
+				st.Tables, st.Synced, st.Message = total, synced, ""
+			})
+			if total > 0 && synced == total {
+				break
+			}
+		} else {
+			cn.nodeJoinUpdate(node.Addr, func(st *NodeJoinStatus) {
+				st.Message = err2.Error()
+			})
+		}
+
+		time.Sleep(decommissionCheckSleep)
+	}
+
+	if err == nil && cn.close {
+		err = errors.New("closed")
+	}
+
+	if err == nil {
+		err = cn.nodeJoinSend(node, voters, nodeStateVoter)
+	}
+
+	cn.nodeJoinUpdate(node.Addr, func(st *NodeJoinStatus) {
+		if err != nil {
+			st.State, st.Message = NodeJoinFailed, err.Error()
+		} else {
+			st.State, st.Message = NodeJoinJoined, ""
+		}
+	})
+
+	if err != nil {
+		hlog.Printf("warn", "kvgo node add %s err %s", node.Addr, err.Error())
+	} else {
+		hlog.Printf("info", "kvgo node add %s done", node.Addr)
+	}
+}
+
+// nodeJoinCheck returns the number of the tables of the voters that the
+// node has pulled up to their safe offsets.
+func (cn *Conn) nodeJoinCheck(node *ClientConfig, voters []*ClientConfig) (int, int, error) {
+
+	var (
+		synced = map[string]int{}
+		tables = map[string]bool{}
+	)
+
+	for _, v := range dataNodes(voters) {
+
+		var offsets, pulled map[string]uint64
+
+		if v.Addr == cn.opts.Server.Bind {
+			var err error
+			if offsets, err = cn.nodeLogOffsets(""); err != nil {
+				return 0, 0, err
+			}
+		} else if err := nodeCmdRemote(v, "NodeLogOffsets",
+			&decommissionRequest{}, &offsets); err != nil {
+			return 0, 0, err
+		}
+
+		if err := nodeCmdRemote(node, "NodeLogOffsets", &decommissionRequest{
+			Addr: v.Addr,
+		}, &pulled); err != nil {
+			return 0, 0, err
+		}
+
+		for name, offset := range offsets {
+			tables[name] = true
+			if v2, ok := pulled[name]; ok && v2 >= offset {
+				synced[name] += 1
+			}
+		}
+	}
+
+	num := 0
+	for name := range tables {
+		if synced[name] == len(dataNodes(voters)) {
+			num += 1
+		}
+	}
+
+	return num, len(tables), nil
+}
+
+// NodeJoinStatusList returns the node additions started by this node.
+func (cn *Conn) NodeJoinStatusList() []*NodeJoinStatus {
+	cn.members.mu.RLock()
+	defer cn.members.mu.RUnlock()
+	ls := []*NodeJoinStatus{}
+	for _, v := range cn.members.joins {
+		st := *v
+		ls = append(ls, &st)
+	}
+	return ls
+}
+
+// ReplicaOfAdd adds the Replica-Of node to the local node at runtime, the
+// logs of its tables are pulled from the next round of the workers.
+func (cn *Conn) ReplicaOfAdd(node *ConfigReplicaOfNode) error {
+
+	if cn.dbSys == nil {
+		return errors.New("replica-of only supported in the server nodes")
+	}
+
+	if node == nil || node.ClientConfig == nil || node.Addr == "" {
+		return errors.New("no addr setup")
+	}
+
+	for _, tm := range node.TableMaps {
+		if tm.From == "" || tm.To == "" {
+			return errors.New("invalid table_maps")
+		}
+	}
+
+	bs, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	if err := cn.dbSys.Delete(keySysReplicaOfRemoved(node.Addr), nil); err != nil {
+		return err
+	}
+
+	if err := cn.dbSys.Put(keySysReplicaOfAdded(node.Addr), bs, nil); err != nil {
+		return err
+	}
+
+	return cn.membersRefresh()
+}
+
+// ReplicaOfRemove stops pulling the logs from the Replica-Of node addr.
+func (cn *Conn) ReplicaOfRemove(addr string) error {
+
+	if cn.dbSys == nil {
+		return errors.New("replica-of only supported in the server nodes")
+	}
+
+	if addr == "" {
+		return errors.New("no addr setup")
+	}
+
+	if err := cn.dbSys.Delete(keySysReplicaOfAdded(addr), nil); err != nil {
+		return err
+	}
+
+	if err := cn.dbSys.Put(keySysReplicaOfRemoved(addr), []byte("1"), nil); err != nil {
+		return err
+	}
+
+	return cn.membersRefresh()
+}
+
+func (cn *Conn) membershipCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req membershipRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	var err error
+
+	switch method {
+
+	case "NodeAdd":
+		err = cn.NodeAdd(req.Node)
+
+	case "NodeJoin":
+		err = cn.nodeJoinApply(req.Members, req.Epoch)
+
+	case "NodeJoinStatus":
+		bs, err := json.Marshal(cn.NodeJoinStatusList())
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		return sysCmdResultBytes(bs)
+
+	case "ReplicaOfAdd":
+		err = cn.ReplicaOfAdd(req.ReplicaOf)
+
+	case "ReplicaOfRemove":
+		err = cn.ReplicaOfRemove(req.Addr)
+
+	default:
+		return kv2.NewObjectResultClientError(errors.New("cmd not found"))
+	}
+
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	return kv2.NewObjectResultOK()
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+)
+
+const (
+	memoryBudgetBlockCacheShare  = 40
+	memoryBudgetWriteBufferShare = 20
+	memoryBudgetValueCacheShare  = 25
+	memoryBudgetCheckSleep       = 10e9
+	memoryBudgetTableSpare       = 2
+)
+
+// memoryBudget divides the memory budget of the node, the block cache and
+// write buffer shares are reserved by the tables when they are opened (the
+// shares are divided equally by the tables of the node, plus a few spare
+// ones for the tables created later, since the sizes of the engine can not
+// be changed after open), and the value cache share is adjusted by the
+// memory pressure of the process.
+type memoryBudget struct {
+	mu          sync.Mutex
+	total       int64
+	blockCache  int64
+	writeBuffer int64
+	valueCache  int64
+	shares      int
+	tableCache  int64
+	tableBuffer int64
+}
+
+func newMemoryBudget(mb int) *memoryBudget {
+	if mb < 1 {
+		return nil
+	}
+	total := int64(mb) * opt.MiB
+	it := &memoryBudget{
+		total:       total,
+		blockCache:  total * memoryBudgetBlockCacheShare / 100,
+		writeBuffer: total * memoryBudgetWriteBufferShare / 100,
+		valueCache:  total * memoryBudgetValueCacheShare / 100,
+	}
+	it.tablesSet(1)
+	return it
+}
+
+// tablesSet sets the number of the tables to be opened, the block cache and
+// write buffer are divided equally by them and the spare tables.
+func (it *memoryBudget) tablesSet(n int) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.shares = n + memoryBudgetTableSpare
+	it.tableCache = it.blockCache / int64(it.shares)
+	it.tableBuffer = it.writeBuffer / int64(2*it.shares)
+}
+
+// tableOptionsSet reserves the block cache and write buffer of a new table,
+// the tables opened after all the shares are taken get the minimum sizes.
+// The write buffer is counted twice, since the engine keeps the frozen one
+// while it is being flushed.
+func (it *memoryBudget) tableOptionsSet(opts *opt.Options) {
+
+	if it == nil {
+		return
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	var (
+		blockCache  int64
+		writeBuffer int64
+	)
+
+	if it.shares > 0 {
+		blockCache, writeBuffer = it.tableCache, it.tableBuffer
+		it.shares -= 1
+	}
+
+	if blockCache < 8*opt.MiB {
+		blockCache = 8 * opt.MiB
+	}
+	if writeBuffer < 4*opt.MiB {
+		writeBuffer = 4 * opt.MiB
+	} else if writeBuffer > 128*opt.MiB {
+		writeBuffer = 128 * opt.MiB
+	}
+
+	opts.BlockCacheCapacity = int(blockCache)
+	opts.WriteBuffer = int(writeBuffer)
+}
+
+func (cn *Conn) workerMemoryBudget() {
+
+	var (
+		ms     runtime.MemStats
+		target = cn.memBudget.valueCache
+		limit  = cn.memBudget.total
+	)
+
+	for !cn.close {
+
+		time.Sleep(memoryBudgetCheckSleep)
+
+		runtime.ReadMemStats(&ms)
+
+		var (
+			used = int64(ms.HeapInuse)
+			size = cn.valueCache.Capacity()
+		)
+
+		switch {
+
+		case used > limit:
+			if size > 0 {
+				cn.valueCache.SetCapacity(size / 2)
+				hlog.Printf("warn", "kvgo memory %d MiB over budget %d MiB, value cache shrink to %d MiB",
+					used/opt.MiB, limit/opt.MiB, size/2/opt.MiB)
+			}
+			cn.notFoundCache.Purge()
+
+		case used < limit*8/10 && size < target:
+			if size += target / 4; size > target {
+				size = target
+			}
+			cn.valueCache.SetCapacity(size)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	mergeOperandMax     = 1 << 20
+	mergeRefreshLimit   = 1000
+	mergeCommitRetry    = 10
+	mergeOperatorLenMax = 64
+)
+
+// The built-in merge operators.
+const (
+	// MergeOperatorCounter adds the operands to the value, the value and the
+	// operands are int64 numbers in decimal.
+	MergeOperatorCounter = "counter"
+
+	// MergeOperatorAppend appends the operands to the value.
+	MergeOperatorAppend = "append"
+
+	// MergeOperatorSetUnion merges the operands into the value, the value
+	// and the operands are JSON arrays of strings, the result is sorted.
+	MergeOperatorSetUnion = "set-union"
+)
+
+// MergeFunc returns the value of the key with the operands applied in order,
+// the value is nil if the key does not exist. The function must be
+// deterministic, it may be called more than once with the same arguments.
+type MergeFunc func(key, value []byte, operands [][]byte) ([]byte, error)
+
+var (
+	mergeMu        sync.RWMutex
+	mergeOperators = map[string]MergeFunc{
+		MergeOperatorCounter:  mergeCounter,
+		MergeOperatorAppend:   mergeAppend,
+		MergeOperatorSetUnion: mergeSetUnion,
+	}
+)
+
+// MergeOperatorRegister registers the merge operator name, the operators
+// must be registered before Open in the servers and the embedded
+// applications, the operands of an unregistered operator are kept and the
+// reads of their keys fail.
+func MergeOperatorRegister(name string, fn MergeFunc) error {
+
+	if name == "" || len(name) > mergeOperatorLenMax {
+		return errors.New("invalid merge operator name")
+	}
+	if fn == nil {
+		return errors.New("no merge func setup")
+	}
+
+	mergeMu.Lock()
+	defer mergeMu.Unlock()
+
+	mergeOperators[name] = fn
+
+	return nil
+}
+
+func mergeOperator(name string) MergeFunc {
+	mergeMu.RLock()
+	defer mergeMu.RUnlock()
+	return mergeOperators[name]
+}
+
+func mergeCounter(key, value []byte, operands [][]byte) ([]byte, error) {
+	var n int64
+	if len(value) > 0 {
+		v, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		n = v
+	}
+	for _, op := range operands {
+		v, err := strconv.ParseInt(string(op), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		n += v
+	}
+	return []byte(strconv.FormatInt(n, 10)), nil
+}
+
+func mergeAppend(key, value []byte, operands [][]byte) ([]byte, error) {
+	ret := append([]byte{}, value...)
+	for _, op := range operands {
+		ret = append(ret, op...)
+	}
+	return ret, nil
+}
+
+func mergeSetUnion(key, value []byte, operands [][]byte) ([]byte, error) {
+	var (
+		set = map[string]bool{}
+		ls  []string
+	)
+	for _, v := range append([][]byte{value}, operands...) {
+		if len(v) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(v, &ls); err != nil {
+			return nil, err
+		}
+		for _, s := range ls {
+			set[s] = true
+		}
+	}
+	ls = make([]string, 0, len(set))
+	for s := range set {
+		ls = append(ls, s)
+	}
+	sort.Strings(ls)
+	return json.Marshal(ls)
+}
+
+// mergeKeyPrefix returns the prefix of the operand keys of the key, the
+// length of the key is encoded so the prefix of a key is not the prefix of
+// another key.
+func mergeKeyPrefix(key []byte) []byte {
+	return append(keyEncode(nsKeyMerge, binary.AppendUvarint(nil, uint64(len(key)))), key...)
+}
+
+func mergeKeyDecode(bs []byte) []byte {
+	if len(bs) < 1 || bs[0] != nsKeyMerge {
+		return nil
+	}
+	n, i := binary.Uvarint(bs[1:])
+	if i <= 0 || 1+i+int(n)+8 != len(bs) {
+		return nil
+	}
+	return bs[1+i : 1+i+int(n)]
+}
+
+type mergeOperand struct {
+	key      []byte
+	operator string
+	operand  []byte
+}
+
+func mergeOperandEncode(operator string, operand []byte) []byte {
+	return append(append([]byte{uint8(len(operator))}, operator...), operand...)
+}
+
+func mergeOperandDecode(key, bs []byte) (*mergeOperand, error) {
+	if len(bs) < 1 || len(bs) < 1+int(bs[0]) {
+		return nil, errors.New("invalid merge operand")
+	}
+	return &mergeOperand{
+		key:      key,
+		operator: string(bs[1 : 1+bs[0]]),
+		operand:  bs[1+bs[0]:],
+	}, nil
+}
+
+// mergeUsedInit sets the mergeUsed flag if the table has pending operands,
+// the operand lookups of the reads and writes are skipped until the first
+// merge of the table.
+func (it *dbTable) mergeUsedInit() {
+	iter := it.db.NewIterator(&util.Range{
+		Start: []byte{nsKeyMerge},
+		Limit: []byte{nsKeyMerge + 1},
+	}, nil)
+	defer iter.Release()
+	if iter.Next() {
+		atomic.StoreInt32(&it.mergeUsed, 1)
+	}
+}
+
+func (it *dbTable) mergeOperands(key []byte) ([]*mergeOperand, error) {
+
+	if atomic.LoadInt32(&it.mergeUsed) == 0 {
+		return nil, nil
+	}
+
+	var (
+		prefix = mergeKeyPrefix(key)
+		iter   = it.db.NewIterator(util.BytesPrefix(prefix), nil)
+		ls     []*mergeOperand
+	)
+	defer iter.Release()
+
+	for iter.Next() {
+		op, err := mergeOperandDecode(bytesClone(iter.Key()), bytesClone(iter.Value()))
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, op)
+	}
+
+	return ls, iter.Error()
+}
+
+// mergeApply applies the operands to the value, the operands of a key are
+// applied in runs of the same operator.
+func mergeApply(key, value []byte, ls []*mergeOperand) ([]byte, error) {
+
+	for i := 0; i < len(ls); {
+
+		fn := mergeOperator(ls[i].operator)
+		if fn == nil {
+			return nil, errors.New("merge operator (" + ls[i].operator + ") not found")
+		}
+
+		j, operands := i, [][]byte{}
+		for ; j < len(ls) && ls[j].operator == ls[i].operator; j++ {
+			operands = append(operands, ls[j].operand)
+		}
+
+		v, err := fn(key, value, operands)
+		if err != nil {
+			return nil, err
+		}
+		value, i = v, j
+	}
+
+	return value, nil
+}
+
+// mergeOperandsDel deletes the pending operands of the key in the batch,
+// the operands are discarded by any put or delete of the key.
+func (cn *Conn) mergeOperandsDel(tdb *dbTable, batch *leveldb.Batch, key []byte) {
+	ls, _ := tdb.mergeOperands(key)
+	for _, op := range ls {
+		batch.Delete(op.key)
+	}
+}
+
+// mergeValueGet applies the pending operands of the key to the encoded item
+// read from the data namespace.
+func (cn *Conn) mergeValueGet(tdb *dbTable, key, bs []byte, err error) ([]byte, error) {
+
+	if err != nil && err != leveldb.ErrNotFound {
+		return bs, err
+	}
+
+	ls, err2 := tdb.mergeOperands(key)
+	if err2 != nil {
+		return nil, err2
+	} else if len(ls) == 0 {
+		return bs, err
+	}
+
+	var item *kv2.ObjectItem
+	if err == nil {
+		if item, err = kv2.ObjectItemDecode(bs); err != nil {
+			return nil, err
+		}
+	} else {
+		item = &kv2.ObjectItem{
+			Meta: &kv2.ObjectMeta{
+				Key: key,
+			},
+			Data: &kv2.ObjectData{},
+		}
+	}
+
+	var value []byte
+	if item.Data != nil && len(item.Data.Value) > 0 {
+		value = item.DataValue().Bytes()
+	}
+
+	value, err = mergeApply(key, value, ls)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := item.DataValueSet(value, nil); err != nil {
+		return nil, err
+	}
+
+	return kv2.StdProto.Encode(item)
+}
+
+// Merge writes a merge record of the operand to the key, the record is
+// applied to the value by the registered operator lazily, on the reads of
+// the key and in the background, instead of a read-modify-write on every
+// update, so the concurrent updates of a hot key do not contend.
+//
+// The key reads return the merged value, while the range and log queries
+// return the value as of the last background merge. The merge records are
+// discarded by any later put or delete of the key.
+//
+// In cluster mode the operand is applied by a read-modify-write with a
+// version check on the main node.
+//
+// The merges of the immutable keys (of AttrImmutable or of the
+// Feature.ImmutablePrefixes) fail with ErrImmutable.
+func (cn *Conn) Merge(tableName string, key []byte, operator string, operand []byte) error {
+
+	if cn.opts.ClientConnectEnable {
+
+		bs, err := json.Marshal(&mergeRequest{
+			Table:    tableName,
+			Key:      key,
+			Operator: operator,
+			Operand:  operand,
+		})
+		if err != nil {
+			return err
+		}
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: "ObjectMerge",
+			Body:   bs,
+		})
+		if !rs.OK() {
+			return rs.Error()
+		}
+		return nil
+	}
+
+	if len(key) < 1 {
+		return errors.New("invalid key")
+	}
+	if keyInternal(key) {
+		return errKeyInternal
+	}
+	if len(operand) > mergeOperandMax {
+		return errors.New("invalid operand size")
+	}
+	if mergeOperator(operator) == nil {
+		return errors.New("merge operator (" + operator + ") not found")
+	}
+	if tableName == "" {
+		tableName = "main"
+	}
+	if cn.opts.Feature.immutable(tableName, key) {
+		return ErrImmutable
+	}
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return cn.mergeCommit(tableName, key, operator, operand)
+	}
+
+	return cn.mergeLocal(tableName, key, operator, operand)
+}
+
+type mergeRequest struct {
+	Table    string `json:"table"`
+	Key      []byte `json:"key"`
+	Operator string `json:"operator"`
+	Operand  []byte `json:"operand"`
+}
+
+func (cn *Conn) mergeCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	var req mergeRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	if req.Table == "" {
+		req.Table = "main"
+	}
+
+	if av != nil {
+		if err := av.Allow(authPermTableWrite,
+			hauth.NewScopeFilter(AuthScopeTable, req.Table)); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	if err := cn.Merge(req.Table, req.Key, req.Operator, req.Operand); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	return kv2.NewObjectResultOK()
+}
+
+func (cn *Conn) mergeLocal(tableName string, key []byte, operator string, operand []byte) error {
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil {
+		return errors.New("table not found")
+	}
+
+	mu := cn.commitLock(tableName, key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the operands are folded into the value in the background, so the
+	// immutable keys are refused here instead of on the fold
+	meta, err := tdb.objectMetaRead(key, cn.opts.Feature.WriteMetaDisable)
+	if err != nil {
+		return err
+	}
+	if Attrs(meta)&AttrImmutable != 0 {
+		return ErrImmutable
+	}
+
+	atomic.StoreInt32(&tdb.mergeUsed, 1)
+
+	batch := new(leveldb.Batch)
+	batch.Put(append(mergeKeyPrefix(key), uint64ToBytes(atomic.AddUint64(&cn.mergeSeq, 1))...),
+		mergeOperandEncode(operator, operand))
+
+	return cn.dbWrite(tdb, batch)
+}
+
+func (cn *Conn) mergeCommit(tableName string, key []byte, operator string, operand []byte) error {
+
+	var (
+		op = &mergeOperand{
+			operator: operator,
+			operand:  operand,
+		}
+		deadline = time.Now().Add(commitRetryTimeout)
+	)
+
+	for i := 0; i < mergeCommitRetry; i++ {
+
+		rs := cn.Query(kv2.NewObjectReader(key).TableNameSet(tableName))
+		if !rs.OK() && !rs.NotFound() {
+			return rs.Error()
+		}
+
+		var (
+			value   []byte
+			version uint64
+		)
+		if rs.OK() {
+			value = rs.DataValue().Bytes()
+			if item := rs.Items[0]; item.Meta != nil {
+				version = item.Meta.Version
+			}
+		}
+
+		value, err := mergeApply(key, value, []*mergeOperand{op})
+		if err != nil {
+			return err
+		}
+
+		rr := kv2.NewObjectWriter(key, value).TableNameSet(tableName)
+		if version > 0 {
+			rr.PrevVersion = version
+		} else {
+			rr.ModeCreateSet(true)
+		}
+
+		if rs := cn.Commit(rr); rs.OK() {
+			if version == 0 && commitCreateExists(rs) {
+				continue
+			}
+			return nil
+		} else if commitRetryable(rs, deadline) {
+			i -= 1
+		} else if !rs.NotFound() && !resultErrIs(rs, errPrevVersion) {
+			return rs.Error()
+		}
+	}
+
+	return errors.New("merge conflict")
+}
+
+// workerLocalMergeRefresh folds the pending operands into the values.
+func (cn *Conn) workerLocalMergeRefresh() error {
+
+	for _, tdb := range cn.tables {
+
+		if atomic.LoadInt32(&tdb.mergeUsed) == 0 {
+			continue
+		}
+
+		if err := cn.workerLocalMergeRefreshTable(tdb); err != nil {
+			hlog.Printf("warn", "local merge refresh table %s, err %s",
+				tdb.tableName, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (cn *Conn) workerLocalMergeRefreshTable(tdb *dbTable) error {
+
+	var (
+		keys [][]byte
+		num  = 0
+		iter = tdb.db.NewIterator(&util.Range{
+			Start: []byte{nsKeyMerge},
+			Limit: []byte{nsKeyMerge + 1},
+		}, nil)
+	)
+
+	for iter.Next() && num < mergeRefreshLimit {
+		if key := mergeKeyDecode(iter.Key()); key != nil &&
+			(len(keys) == 0 || !bytes.Equal(keys[len(keys)-1], key)) {
+			keys = append(keys, bytesClone(key))
+		}
+		num += 1
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// the fold error of a key (such as the operands of an unregistered
+	// operator) does not block the other keys of the table
+	for _, key := range keys {
+		if err := cn.mergeFold(tdb, key); err != nil {
+			hlog.Printf("warn", "local merge fold table %s, key %q, err %s",
+				tdb.tableName, key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (cn *Conn) mergeFold(tdb *dbTable, key []byte) error {
+
+	mu := cn.commitLock(tdb.tableName, key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	bs, err := tdb.db.Get(keyEncode(nsKeyData, key), nil)
+	if bs, err = cn.mergeValueGet(tdb, key, bs, err); err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	item, err := kv2.ObjectItemDecode(bs)
+	if err != nil {
+		return err
+	}
+
+	rr := kv2.NewObjectWriter(key, item.DataValue().Bytes()).
+		TableNameSet(tdb.tableName)
+	if item.Meta != nil && item.Meta.Expired > 0 {
+		rr.Meta.Expired = item.Meta.Expired
+	}
+	if err := rr.CommitValid(); err != nil {
+		return err
+	}
+
+	if rs := cn.commitLocked(rr, 0, false); !rs.OK() {
+		return rs.Error()
+	}
+
+	return nil
+}
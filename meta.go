@@ -0,0 +1,183 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// The attribute bits of the keys, the bits 32 to 47 of the attrs of the meta
+// are set by the applications, e.g. by the middleware layers tagging the
+// keys without wrapping their values, the other bits are of the system.
+//
+// The attribute bits are set by the writes (AttrsSet) and replaced by every
+// write of the key, a write without them clears them. They are returned in
+// the meta of the items of the queries (Attrs) and by GetMeta, and are only
+// tags kvgo does not interpret, except AttrImmutable (see ErrImmutable).
+const (
+	AttrImmutable  uint64 = 1 << 32
+	AttrHidden     uint64 = 1 << 33
+	AttrCompressed uint64 = 1 << 34
+	AttrEncrypted  uint64 = 1 << 35
+
+	// AttrUser is the first of the bits free to the applications, the
+	// bits from AttrUser to AttrUser << 11 are not used by kvgo
+	AttrUser uint64 = 1 << 36
+
+	// AttrMask is the mask of all the attribute bits
+	AttrMask uint64 = 0xffff << 32
+)
+
+// AttrsSet sets the attribute bits of the write, the bits out of AttrMask
+// are ignored.
+func AttrsSet(ow *kv2.ObjectWriter, attrs uint64) *kv2.ObjectWriter {
+	if ow.Meta == nil {
+		ow.Meta = &kv2.ObjectMeta{}
+	}
+	ow.Meta.Attrs = (ow.Meta.Attrs &^ AttrMask) | (attrs & AttrMask)
+	return ow
+}
+
+// Attrs returns the attribute bits of the meta of a key.
+func Attrs(meta *kv2.ObjectMeta) uint64 {
+	if meta == nil {
+		return 0
+	}
+	return meta.Attrs & AttrMask
+}
+
+// Meta is the metadata of a key.
+//
+// The meta of a key is saved in one of two encodings: by default the meta
+// is saved alone beside the object (meta and value) of the key, so it can be
+// read without reading the value; with Feature.WriteMetaDisable (or the
+// writes of MetaOff) only the object is saved and the meta is decoded from
+// it. Both encodings are read whatever the setting, so the setting can be
+// changed on the existing datasets, and the keys are converted by their next
+// write.
+type Meta struct {
+	Key     []byte `json:"key"`
+	Version uint64 `json:"version"`
+	IncrId  uint64 `json:"incr_id,omitempty"`
+
+	// the attribute bits of the key, see AttrImmutable
+	Attrs   uint64    `json:"attrs,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// the expiry time of the key, zero if the key has no ttl
+	Expired time.Time `json:"expired,omitempty"`
+
+	// the size in bytes of the encoded object of the key
+	Size int64 `json:"size"`
+}
+
+func metaTime(ms uint64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(ms/1e3), int64(ms%1e3)*1e6)
+}
+
+func newMeta(meta *kv2.ObjectMeta, size int64) *Meta {
+	return &Meta{
+		Key:     meta.Key,
+		Version: meta.Version,
+		IncrId:  meta.IncrId,
+		Attrs:   Attrs(meta),
+		Created: metaTime(meta.Created),
+		Updated: metaTime(meta.Updated),
+		Expired: metaTime(meta.Expired),
+		Size:    size,
+	}
+}
+
+// objectMetaRead returns the meta of the key, read from the namespace of
+// the meta or decoded from the object in the namespace of the data, dataFirst
+// sets the namespace tried first. It returns nil if the key does not exist.
+func (tdb *dbTable) objectMetaRead(key []byte, dataFirst bool) (*kv2.ObjectMeta, error) {
+
+	nsKeys := []byte{nsKeyMeta, nsKeyData}
+	if dataFirst {
+		nsKeys[0], nsKeys[1] = nsKeyData, nsKeyMeta
+	}
+
+	for _, ns := range nsKeys {
+		bs, err := tdb.db.Get(keyEncode(ns, key), nil)
+		if err == nil {
+			return kv2.ObjectMetaDecode(bs)
+		}
+		if err.Error() != ldbNotFound {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// GetMeta returns the meta of the key in the table without its value, or
+// nil if the key does not exist or is expired.
+func (cn *Conn) GetMeta(tableName string, key []byte) (*Meta, error) {
+
+	if tableName == "" {
+		tableName = "main"
+	}
+
+	if cn.opts.ClientConnectEnable {
+
+		rs := cn.Query(kv2.NewObjectReader(key).TableNameSet(tableName))
+		if rs.NotFound() {
+			return nil, nil
+		}
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+		if len(rs.Items) == 0 || rs.Items[0].Meta == nil {
+			return nil, nil
+		}
+
+		item, size := rs.Items[0], int64(0)
+		if item.Data != nil {
+			size = int64(len(item.Data.Value))
+		}
+		return newMeta(item.Meta, size), nil
+	}
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil {
+		return nil, errors.New("table not found")
+	}
+
+	meta, err := tdb.objectMetaRead(key, cn.opts.Feature.WriteMetaDisable)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+
+	if meta.Expired > 0 && meta.Expired <= uint64(time.Now().UnixNano()/1e6) {
+		return nil, nil
+	}
+
+	var size int64
+	if bs, err := tdb.db.Get(keyEncode(nsKeyData, key), nil); err == nil {
+		size = int64(len(bs))
+	} else if err.Error() != ldbNotFound {
+		return nil, err
+	}
+
+	return newMeta(meta, size), nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+)
+
+// dataFormatVersion is the version of the on-disk format of the tables
+// written by this release, it is increased by every release that changes
+// the format, with a migration from the previous version.
+const dataFormatVersion = 1
+
+var keySysFormatVersion = append([]byte{nsKeySys}, []byte("format:version")...)
+
+type dataMigration struct {
+	from int
+	name string
+
+	// check returns an error if the migration can not be done, it is called
+	// for all the pending migrations before any of them runs
+	check func(db *leveldb.DB) error
+
+	run func(db *leveldb.DB) error
+
+	// notes of the rollback to the previous release
+	rollback string
+}
+
+var dataMigrations = []*dataMigration{
+	{
+		from:     0,
+		name:     "format version marker",
+		rollback: "no format change, the previous releases ignore the marker",
+	},
+}
+
+func dataFormatVersionGet(db *leveldb.DB) (int, error) {
+	bs, err := db.Get(keySysFormatVersion, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.Atoi(string(bs))
+}
+
+func dataFormatVersionSet(db *leveldb.DB, v int) error {
+	return db.Put(keySysFormatVersion, []byte(strconv.Itoa(v)), nil)
+}
+
+// dbMigrate upgrades the table to dataFormatVersion, the tables created by
+// this release are marked with the current version directly, and the tables
+// of a newer release are refused to open.
+func dbMigrate(dir string, db *leveldb.DB, created bool) error {
+
+	if created {
+		return dataFormatVersionSet(db, dataFormatVersion)
+	}
+
+	ver, err := dataFormatVersionGet(db)
+	if err != nil {
+		return err
+	}
+
+	if ver == dataFormatVersion {
+		return nil
+	}
+
+	if ver > dataFormatVersion {
+		return fmt.Errorf("table %s format version %d is newer than the version %d of this release (%s), upgrade kvgo to open it",
+			dir, ver, dataFormatVersion, Version)
+	}
+
+	var pending []*dataMigration
+	for _, m := range dataMigrations {
+		if m.from >= ver && m.from < dataFormatVersion {
+			pending = append(pending, m)
+		}
+	}
+
+	if len(pending) != dataFormatVersion-ver {
+		return fmt.Errorf("table %s no migration path from format version %d to %d",
+			dir, ver, dataFormatVersion)
+	}
+
+	// pre-flight checks
+	for _, m := range pending {
+		if m.check != nil {
+			if err := m.check(db); err != nil {
+				return fmt.Errorf("table %s migration %d (%s) check fail: %s",
+					dir, m.from, m.name, err.Error())
+			}
+		}
+	}
+
+	for _, m := range pending {
+
+		hlog.Printf("warn", "kvgo table %s migrate format version %d to %d (%s), rollback notes: %s",
+			dir, m.from, m.from+1, m.name, m.rollback)
+
+		if m.run != nil {
+			if err := m.run(db); err != nil {
+				return fmt.Errorf("table %s migration %d (%s) fail: %s",
+					dir, m.from, m.name, err.Error())
+			}
+		}
+
+		if err := dataFormatVersionSet(db, m.from+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+)
+
+const (
+	// the interval of the progress logs of the default reporter, the
+	// tables recovered in less time are not logged
+	openProgressLogInterval = 5 * time.Second
+)
+
+// OpenProgress is the recovery progress of a table while Open replays the
+// manifest and the WAL (journal) of the table.
+type OpenProgress struct {
+	Table   string        `json:"table"`
+	Phase   string        `json:"phase"` // manifest or journal
+	Done    int64         `json:"done"`  // bytes
+	Total   int64         `json:"total"` // bytes
+	Percent float64       `json:"percent"`
+	Elapsed time.Duration `json:"elapsed"`
+	Eta     time.Duration `json:"eta"`
+}
+
+// OpenProgressFunc is called by Open with the recovery progress of the
+// tables, it may be passed to Open as one of the args to replace the
+// default reporter, which logs the progress (and sends it as the STATUS
+// to systemd) if the recovery of a table takes more than a few seconds.
+type OpenProgressFunc func(p *OpenProgress)
+
+type openProgressTracker struct {
+	mu     sync.Mutex
+	table  string
+	fn     OpenProgressFunc
+	phase  string
+	start  time.Time
+	logged time.Time
+}
+
+func (it *openProgressTracker) update(phase string, done, total int64) {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	tn := time.Now()
+
+	if phase != it.phase {
+		it.phase, it.start, it.logged = phase, tn, tn
+	}
+
+	p := &OpenProgress{
+		Table:   it.table,
+		Phase:   phase,
+		Done:    done,
+		Total:   total,
+		Elapsed: tn.Sub(it.start),
+	}
+	if total > 0 {
+		p.Percent = float64(done) * 100 / float64(total)
+	} else {
+		p.Percent = 100
+	}
+	if done > 0 && done < total {
+		p.Eta = time.Duration(float64(p.Elapsed) * float64(total-done) / float64(done))
+	}
+
+	if it.fn != nil {
+		it.fn(p)
+		return
+	}
+
+	if done < total && tn.Sub(it.logged) < openProgressLogInterval {
+		return
+	}
+	if done >= total && p.Elapsed < openProgressLogInterval {
+		return
+	}
+	it.logged = tn
+
+	msg := openProgressString(p)
+	hlog.Printf("info", "kvgo %s", msg)
+	SystemdNotify("STATUS=" + msg)
+}
+
+func openProgressString(p *OpenProgress) string {
+	if p.Done >= p.Total {
+		return fmt.Sprintf("table %s %s recovered, %d bytes in %v",
+			p.Table, p.Phase, p.Total, p.Elapsed.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("table %s %s recovery %.1f%% (%d/%d bytes), eta %v",
+		p.Table, p.Phase, p.Percent, p.Done, p.Total, p.Eta.Round(time.Second))
+}
+
+// openProgress returns the recovery progress callback of the leveldb
+// options of the table.
+func (cn *Conn) openProgress(table string) func(phase string, done, total int64) {
+	it := &openProgressTracker{
+		table: table,
+		fn:    cn.openProgressFunc,
+	}
+	return it.update
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	procArgsMax    = 100
+	procArgSizeMax = 1 << 20
+)
+
+// ProcedureFunc is a server-side procedure, it is run in the transaction
+// tx with the arguments of the caller and returns the result to the
+// caller. The writes of the procedure are discarded if it returns an error.
+type ProcedureFunc func(tx *Txn, args [][]byte) ([]byte, error)
+
+var (
+	procMu     sync.RWMutex
+	procedures = map[string]ProcedureFunc{}
+)
+
+// ProcedureRegister registers the procedure name, the procedures must be
+// registered by the server application before Open. Unlike the scripts the
+// procedures are compiled into the server, so the clients can only run
+// the operations allowed by the application.
+func ProcedureRegister(name string, fn ProcedureFunc) error {
+
+	if !seqNameReg.MatchString(name) {
+		return errors.New("invalid procedure name")
+	}
+	if fn == nil {
+		return errors.New("no procedure func setup")
+	}
+
+	procMu.Lock()
+	defer procMu.Unlock()
+
+	procedures[name] = fn
+
+	return nil
+}
+
+func procedure(name string) ProcedureFunc {
+	procMu.RLock()
+	defer procMu.RUnlock()
+	return procedures[name]
+}
+
+type procedureCallRequest struct {
+	Name string   `json:"name"`
+	Args [][]byte `json:"args,omitempty"`
+}
+
+// ProcedureCall runs the procedure name in a transaction on the server (or
+// locally in embedded mode) and returns its result. The procedures are not
+// supported in cluster mode.
+func (cn *Conn) ProcedureCall(name string, args ...[]byte) ([]byte, error) {
+
+	if !cn.opts.ClientConnectEnable {
+		return cn.procedureCallLocal(nil, name, args)
+	}
+
+	bs, err := json.Marshal(&procedureCallRequest{
+		Name: name,
+		Args: args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rs := cn.SysCmd(&kv2.SysCmdRequest{
+		Method: "ProcedureCall",
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	if len(rs.Items) == 0 {
+		return nil, nil
+	}
+
+	return rs.DataValue().Bytes(), nil
+}
+
+func (cn *Conn) procedureCallLocal(av appValidator, name string, args [][]byte) ([]byte, error) {
+
+	fn := procedure(name)
+	if fn == nil {
+		return nil, errors.New("procedure (" + name + ") not found")
+	}
+
+	if len(args) > procArgsMax {
+		return nil, errors.New("too many procedure args")
+	}
+	for _, v := range args {
+		if len(v) > procArgSizeMax {
+			return nil, errors.New("invalid procedure arg size")
+		}
+	}
+
+	var ret []byte
+
+	err := cn.txnLocal(av, func(tx *Txn) error {
+		var err error
+		ret, err = fn(tx, args)
+		return err
+	})
+
+	return ret, err
+}
+
+func (cn *Conn) procedureCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	var req procedureCallRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	ret, err := cn.procedureCallLocal(av, req.Name, req.Args)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	return sysCmdResultBytes(ret)
+}
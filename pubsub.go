@@ -0,0 +1,502 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	pubSubQueueMax      = 1000
+	pubSubChannelMax    = 200
+	pubSubPollWaitDef   = int64(3000)
+	pubSubPollWaitMax   = int64(10000)
+	pubSubIdleTTL       = int64(60)
+	pubSubGcSleep       = 10e9
+	pubSubRetrySleep    = 1e9
+	pubSubMessageMax    = 100
+	pubSubChannelLenMax = 200
+)
+
+// PubSubMessage is an ephemeral message of a channel, the messages are
+// never persisted and are dropped if the queue of a subscriber is full.
+type PubSubMessage struct {
+	Channel string `json:"channel"`
+	Data    []byte `json:"data"`
+}
+
+type pubSubRequest struct {
+	Id       string         `json:"id,omitempty"`
+	Channels []string       `json:"channels,omitempty"`
+	Message  *PubSubMessage `json:"message,omitempty"`
+	WaitTime int64          `json:"wait_time,omitempty"`
+}
+
+type pubSubResult struct {
+	Id       string           `json:"id,omitempty"`
+	Messages []*PubSubMessage `json:"messages,omitempty"`
+}
+
+type pubSubSubscriber struct {
+	id       string
+	channels map[string]bool
+	queue    chan *PubSubMessage
+	active   int64 // atomic, the unix time of the last poll
+	local    bool
+}
+
+type pubSubHub struct {
+	mu   sync.RWMutex
+	subs map[string]*pubSubSubscriber
+}
+
+func newPubSubHub() *pubSubHub {
+	return &pubSubHub{
+		subs: map[string]*pubSubSubscriber{},
+	}
+}
+
+func pubSubChannelsValid(channels []string) error {
+	if len(channels) < 1 || len(channels) > pubSubChannelMax {
+		return errors.New("invalid channels")
+	}
+	for _, v := range channels {
+		if v == "" || len(v) > pubSubChannelLenMax {
+			return errors.New("invalid channel name")
+		}
+	}
+	return nil
+}
+
+func (it *pubSubHub) subscribe(channels []string, local bool) (*pubSubSubscriber, error) {
+
+	if err := pubSubChannelsValid(channels); err != nil {
+		return nil, err
+	}
+
+	sub := &pubSubSubscriber{
+		id:       randHexString(16),
+		channels: map[string]bool{},
+		queue:    make(chan *PubSubMessage, pubSubQueueMax),
+		active:   time.Now().Unix(),
+		local:    local,
+	}
+	for _, v := range channels {
+		sub.channels[v] = true
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.gc()
+	it.subs[sub.id] = sub
+
+	return sub, nil
+}
+
+func (it *pubSubHub) unsubscribe(id string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if sub, ok := it.subs[id]; ok {
+		delete(it.subs, id)
+		close(sub.queue)
+	}
+}
+
+// gc removes the remote subscribers that have not polled in pubSubIdleTTL,
+// must be called with the lock held.
+func (it *pubSubHub) gc() {
+	tn := time.Now().Unix()
+	for id, sub := range it.subs {
+		if !sub.local && atomic.LoadInt64(&sub.active)+pubSubIdleTTL < tn {
+			delete(it.subs, id)
+			close(sub.queue)
+		}
+	}
+}
+
+func (cn *Conn) workerPubSub() {
+
+	for !cn.close {
+
+		time.Sleep(pubSubGcSleep)
+
+		cn.pubsub.mu.Lock()
+		cn.pubsub.gc()
+		cn.pubsub.mu.Unlock()
+	}
+}
+
+func (it *pubSubHub) publish(msg *PubSubMessage) int {
+
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+
+	num := 0
+	for _, sub := range it.subs {
+		if !sub.channels[msg.Channel] {
+			continue
+		}
+		select {
+		case sub.queue <- msg:
+			num += 1
+		default:
+		}
+	}
+
+	return num
+}
+
+func (it *pubSubHub) poll(id string, wait int64) ([]*PubSubMessage, error) {
+
+	it.mu.RLock()
+	sub, ok := it.subs[id]
+	if ok {
+		atomic.StoreInt64(&sub.active, time.Now().Unix())
+	}
+	it.mu.RUnlock()
+
+	if !ok {
+		return nil, errors.New("subscription not found")
+	}
+
+	if wait < 0 {
+		wait = 0
+	} else if wait > pubSubPollWaitMax {
+		wait = pubSubPollWaitMax
+	}
+
+	var (
+		ls = []*PubSubMessage{}
+		tr = time.NewTimer(time.Duration(wait) * time.Millisecond)
+	)
+	defer tr.Stop()
+
+	select {
+	case msg, ok := <-sub.queue:
+		if !ok {
+			return nil, errors.New("subscription closed")
+		}
+		ls = append(ls, msg)
+	case <-tr.C:
+		return ls, nil
+	}
+
+	for len(ls) < pubSubMessageMax {
+		select {
+		case msg, ok := <-sub.queue:
+			if !ok {
+				return ls, nil
+			}
+			ls = append(ls, msg)
+		default:
+			return ls, nil
+		}
+	}
+
+	return ls, nil
+}
+
+func (cn *Conn) pubSubCmdLocal(method string, body []byte) *kv2.ObjectResult {
+
+	var (
+		req pubSubRequest
+		ret pubSubResult
+	)
+
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	switch method {
+
+	case "PubSubPublish":
+		if req.Message == nil {
+			return kv2.NewObjectResultClientError(errors.New("no message setup"))
+		}
+		if err := pubSubChannelsValid([]string{req.Message.Channel}); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		cn.pubsub.publish(req.Message)
+
+	case "PubSubSubscribe":
+		sub, err := cn.pubsub.subscribe(req.Channels, false)
+		if err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		ret.Id = sub.id
+
+	case "PubSubPoll":
+		ls, err := cn.pubsub.poll(req.Id, req.WaitTime)
+		if err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		ret.Id, ret.Messages = req.Id, ls
+
+	case "PubSubUnsubscribe":
+		cn.pubsub.unsubscribe(req.Id)
+
+	default:
+		return kv2.NewObjectResultClientError(errors.New("cmd not found"))
+	}
+
+	bs, err := json.Marshal(&ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	item := &kv2.ObjectItem{
+		Meta: &kv2.ObjectMeta{},
+		Data: &kv2.ObjectData{},
+	}
+	if err := item.DataValueSet(bs, nil); err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	rs := kv2.NewObjectResultOK()
+	rs.Items = append(rs.Items, item)
+
+	return rs
+}
+
+func pubSubCmdRemote(c kv2.Client, method string, req *pubSubRequest) (*pubSubResult, error) {
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := c.Connector().SysCmd(&kv2.SysCmdRequest{
+		Method: method,
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	var ret pubSubResult
+	if len(rs.Items) > 0 {
+		if err := wireDecode(rs.DataValue().Bytes(), &ret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ret, nil
+}
+
+// Publish sends the data to all subscribers of the channel. In client or
+// cluster mode the message is also sent to the other main nodes, since the
+// subscribers may be connected to any of them, over the connections of the
+// cluster shared by the calls.
+func (cn *Conn) Publish(channel string, data []byte) error {
+
+	msg := &PubSubMessage{
+		Channel: channel,
+		Data:    data,
+	}
+
+	if err := pubSubChannelsValid([]string{channel}); err != nil {
+		return err
+	}
+
+	var (
+		num int
+		err error
+	)
+
+	if !cn.opts.ClientConnectEnable {
+		cn.pubsub.publish(msg)
+		num += 1
+	}
+
+	body, err := json.Marshal(&pubSubRequest{
+		Message: msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, v := range cn.mainNodes() {
+
+		if !cn.opts.ClientConnectEnable && v.Addr == cn.opts.Server.Bind {
+			continue
+		}
+
+		ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+		rs, err2 := cn.transport.SysCmd(ctx, v, &kv2.SysCmdRequest{
+			Method: "PubSubPublish",
+			Body:   body,
+		})
+		fc()
+		if err2 == nil && !rs.OK() {
+			err2 = rs.Error()
+		}
+		if err2 != nil {
+			err = err2
+			continue
+		}
+
+		num += 1
+	}
+
+	if num == 0 && err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Subscription receives the messages of the subscribed channels from C
+// until Close is called.
+type Subscription struct {
+	C      <-chan *PubSubMessage
+	mu     sync.Mutex
+	db     *Conn
+	id     string
+	close  bool
+	closed chan bool
+}
+
+// Subscribe returns a subscription of the channels. In client mode the
+// subscription is bound to one of the main nodes and resubscribes to
+// another one if the node is unavailable, the messages published during
+// the switch are lost.
+func (cn *Conn) Subscribe(channels ...string) (*Subscription, error) {
+
+	if !cn.opts.ClientConnectEnable {
+
+		sub, err := cn.pubsub.subscribe(channels, true)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Subscription{
+			C:  sub.queue,
+			db: cn,
+			id: sub.id,
+		}, nil
+	}
+
+	if err := pubSubChannelsValid(channels); err != nil {
+		return nil, err
+	}
+
+	var (
+		queue = make(chan *PubSubMessage, pubSubQueueMax)
+		sub   = &Subscription{
+			C:      queue,
+			db:     cn,
+			closed: make(chan bool),
+		}
+	)
+
+	go sub.pollRemote(channels, queue)
+
+	return sub, nil
+}
+
+func (it *Subscription) pollRemote(channels []string, queue chan *PubSubMessage) {
+
+	defer close(queue)
+
+	var (
+		c   kv2.Client
+		err error
+	)
+
+	for !it.closing() {
+
+		if c == nil || it.id == "" {
+
+			if mainNodes := it.db.opts.Cluster.randMainNodes(1); len(mainNodes) > 0 {
+				if c, err = mainNodes[0].NewClient(); err == nil {
+					var ret *pubSubResult
+					if ret, err = pubSubCmdRemote(c, "PubSubSubscribe", &pubSubRequest{
+						Channels: channels,
+					}); err == nil {
+						it.mu.Lock()
+						it.id = ret.Id
+						it.mu.Unlock()
+					}
+				}
+			} else {
+				err = errors.New("no master found")
+			}
+
+			if err != nil {
+				c = nil
+				time.Sleep(pubSubRetrySleep)
+				continue
+			}
+		}
+
+		ret, err := pubSubCmdRemote(c, "PubSubPoll", &pubSubRequest{
+			Id:       it.id,
+			WaitTime: pubSubPollWaitDef,
+		})
+		if err != nil {
+			c = nil
+			time.Sleep(pubSubRetrySleep)
+			continue
+		}
+
+		for _, msg := range ret.Messages {
+			select {
+			case queue <- msg:
+			case <-it.closed:
+				return
+			}
+		}
+	}
+
+	if c != nil && it.id != "" {
+		pubSubCmdRemote(c, "PubSubUnsubscribe", &pubSubRequest{
+			Id: it.id,
+		})
+	}
+}
+
+func (it *Subscription) closing() bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.close
+}
+
+// Close stops the subscription and closes C.
+func (it *Subscription) Close() error {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.close {
+		return nil
+	}
+	it.close = true
+
+	if it.closed != nil {
+		close(it.closed)
+	} else {
+		it.db.pubsub.unsubscribe(it.id)
+	}
+
+	return nil
+}
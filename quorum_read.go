@@ -0,0 +1,521 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+type objectDigest struct {
+	Key       []byte `json:"key"`
+	Version   uint64 `json:"version,omitempty"`
+	DataCheck uint64 `json:"data_check,omitempty"`
+	Item      []byte `json:"item,omitempty"`
+}
+
+type objectDigestRequest struct {
+	Table  string   `json:"table"`
+	Keys   [][]byte `json:"keys"`
+	Values bool     `json:"values,omitempty"`
+
+	// the keys of the range [Offset, Cutset), up to Limit keys, are read if
+	// no Keys are set
+	Offset []byte `json:"offset,omitempty"`
+	Cutset []byte `json:"cutset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type objectDigestResult struct {
+	Digests []*objectDigest `json:"digests"`
+}
+
+type objectRepairRequest struct {
+	Table string   `json:"table"`
+	Items [][]byte `json:"items"`
+}
+
+// QueryQuorum reads the keys from a quorum of the main nodes without the
+// cost of a linearizable query. The node serving the query reads the values
+// from its local store and only the digests, the versions and data checks,
+// from the peers. If the digests mismatch, the newest value is fetched from
+// the peer that has it and returned, and the stale nodes are repaired in
+// the background. The nodes missing a key are not repaired, since the key
+// may also be deleted by a write they have not pulled yet, the log pulls
+// bring them up to date. A key of the local store that the peers of the
+// read quorum miss is checked against the digests of all peers, and is not
+// found if none of them has it, or a server error if they are not reachable.
+//
+// Only the queries of the keys are supported.
+func (cn *Conn) QueryQuorum(rr *kv2.ObjectReader) *kv2.ObjectResult {
+
+	if !kv2.AttrAllow(rr.Mode, kv2.ObjectReaderModeKey) {
+		return kv2.NewObjectResultClientError(errors.New("quorum read of keys only"))
+	}
+
+	if cn.opts.ClientConnectEnable ||
+		(len(cn.opts.Cluster.MainNodes) > 0 && cn.opts.Server.Bind == "") {
+		return cn.objectQueryRemote(rr, ReadConsistencyMetadataKey, ReadConsistencyQuorum)
+	}
+
+	return cn.objectQuorumQuery(rr)
+}
+
+func (cn *Conn) objectQuorumQuery(rr *kv2.ObjectReader) *kv2.ObjectResult {
+
+	var (
+		nodes, dQuo = cn.dataQuorum(rr.TableName)
+		peers       []*ClientConfig
+	)
+	for _, v := range nodes {
+		if v.Addr != cn.opts.Server.Bind {
+			peers = append(peers, v)
+		}
+	}
+
+	// the repairs need the full items
+	rs := cn.objectLocalQuery(kv2.NewObjectReader(rr.Keys...).TableNameSet(rr.TableName))
+	if len(peers) == 0 || (!rs.OK() && !rs.NotFound()) {
+		return rs
+	}
+
+	var (
+		nCap = len(peers) + 1
+		nQuo = nCap - dQuo + 1
+	)
+
+	digests, err := cn.objectDigestQuorum(peers, rr.TableName, rr.Keys, nQuo-1)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	locals := map[string]*kv2.ObjectItem{}
+	for _, item := range rs.Items {
+		if item.Meta != nil {
+			locals[string(item.Meta.Key)] = item
+		}
+	}
+
+	// a local key missing on all peers of the read quorum may be a write
+	// that never reached a quorum, the digests of all peers decide it
+	for _, key := range rr.Keys {
+		if locals[string(key)] != nil && !objectDigestsHave(digests, key) {
+			if digests, err = cn.objectDigestQuorum(peers, rr.TableName, rr.Keys, len(peers)); err != nil {
+				return kv2.NewObjectResultServerError(errors.New("quorum read mismatch, " + err.Error()))
+			}
+			break
+		}
+	}
+
+	var (
+		items  []*kv2.ObjectItem
+		repair = map[*ClientConfig][]*kv2.ObjectItem{}
+	)
+
+	for _, key := range rr.Keys {
+
+		var (
+			local   = locals[string(key)]
+			version = uint64(0)
+			newest  *ClientConfig
+		)
+		if local != nil {
+			version = local.Meta.Version
+		}
+
+		for node, ls := range digests {
+			if d := objectDigestFind(ls, key); d != nil && d.Version > version {
+				version, newest = d.Version, node
+			}
+		}
+
+		// only the local node has the key, the write is not committed by a
+		// quorum, so it is neither returned nor repaired
+		if newest == nil && local != nil && dQuo > 1 && !objectDigestsHave(digests, key) {
+			continue
+		}
+
+		if newest != nil {
+			item, err := cn.objectDigestValue(newest, rr.TableName, key)
+			if err != nil {
+				return kv2.NewObjectResultServerError(err)
+			}
+			if local != nil {
+				repair[nil] = append(repair[nil], item)
+			}
+			local = item
+		}
+
+		if local == nil {
+			continue
+		}
+
+		for node, ls := range digests {
+			if d := objectDigestFind(ls, key); d != nil && d.Version > 0 && d.Version < version {
+				repair[node] = append(repair[node], local)
+			}
+		}
+
+		items = append(items, local)
+	}
+
+	if len(repair) > 0 {
+		go cn.objectQuorumRepair(rr.TableName, repair)
+	}
+
+	rs = kv2.NewObjectResultOK()
+	if kv2.AttrAllow(rr.Attrs, kv2.ObjectMetaAttrDataOff) {
+		for i, item := range items {
+			items[i] = &kv2.ObjectItem{
+				Meta: item.Meta,
+			}
+		}
+	}
+	rs.Items = items
+	if len(items) == 0 && len(rr.Keys) == 1 {
+		rs.StatusMessage(kv2.ResultNotFound, "")
+	}
+
+	return rs
+}
+
+// objectDigestsHave returns whether any of the digests has the key.
+func objectDigestsHave(digests map[*ClientConfig][]*objectDigest, key []byte) bool {
+	for _, ls := range digests {
+		if d := objectDigestFind(ls, key); d != nil && d.Version > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func objectDigestFind(ls []*objectDigest, key []byte) *objectDigest {
+	for _, v := range ls {
+		if bytes.Equal(v.Key, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+// objectDigestQuorum returns the digests of the keys of at least nQuo of
+// the peers.
+func (cn *Conn) objectDigestQuorum(peers []*ClientConfig,
+	table string, keys [][]byte, nQuo int) (map[*ClientConfig][]*objectDigest, error) {
+
+	body, err := json.Marshal(&objectDigestRequest{
+		Table: table,
+		Keys:  keys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type digestItem struct {
+		node *ClientConfig
+		ls   []*objectDigest
+	}
+
+	var (
+		pQue = make(chan *digestItem, len(peers))
+		pTTL = time.After(time.Millisecond * time.Duration(objAcceptTTL))
+		ret  = map[*ClientConfig][]*objectDigest{}
+	)
+
+	for _, v := range peers {
+
+		go func(v *ClientConfig) {
+
+			ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+			defer fc()
+
+			var ret objectDigestResult
+
+			rs, err := cn.transport.SysCmd(ctx, v, &kv2.SysCmdRequest{
+				Method: "ObjectDigest",
+				Body:   body,
+			})
+			if err == nil && rs.OK() && len(rs.Items) > 0 &&
+				wireDecode(rs.DataValue().Bytes(), &ret) == nil {
+				pQue <- &digestItem{v, ret.Digests}
+			} else {
+				pQue <- nil
+			}
+		}(v)
+	}
+
+	for i := 0; i < len(peers) && len(ret) < nQuo; i++ {
+		select {
+		case v := <-pQue:
+			if v != nil {
+				ret[v.node] = v.ls
+			}
+		case <-pTTL:
+			return nil, errors.New("quorum read timeout")
+		}
+	}
+
+	if len(ret) < nQuo {
+		return nil, errors.New("quorum read not reached")
+	}
+
+	return ret, nil
+}
+
+// objectDigestValue fetches the item of the key from the node.
+func (cn *Conn) objectDigestValue(node *ClientConfig, table string, key []byte) (*kv2.ObjectItem, error) {
+
+	body, err := json.Marshal(&objectDigestRequest{
+		Table:  table,
+		Keys:   [][]byte{key},
+		Values: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+	defer fc()
+
+	rs, err := cn.transport.SysCmd(ctx, node, &kv2.SysCmdRequest{
+		Method: "ObjectDigest",
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	var ret objectDigestResult
+	if len(rs.Items) > 0 {
+		if err := wireDecode(rs.DataValue().Bytes(), &ret); err != nil {
+			return nil, err
+		}
+	}
+
+	if d := objectDigestFind(ret.Digests, key); d != nil && len(d.Item) > 0 {
+		var item kv2.ObjectItem
+		if err := kv2.StdProto.Decode(d.Item, &item); err != nil {
+			return nil, err
+		}
+		return &item, nil
+	}
+
+	return nil, errors.New("quorum read value not found")
+}
+
+// objectDigestRange reads the digests of the keys of the range of the
+// request.
+func (cn *Conn) objectDigestRange(tdb *dbTable, req *objectDigestRequest, ret *objectDigestResult) error {
+
+	iter := tdb.db.NewIterator(&util.Range{
+		Start: keyEncode(nsKeyData, req.Offset),
+		Limit: keyEncode(nsKeyData, req.Cutset),
+	}, nil)
+	defer iter.Release()
+
+	for iter.Next() && (req.Limit < 1 || len(ret.Digests) < req.Limit) {
+
+		item, err := kv2.ObjectItemDecode(iter.Value())
+		if err != nil {
+			return err
+		}
+
+		d := &objectDigest{
+			Key:       bytesClone(iter.Key()[1:]),
+			Version:   item.Meta.Version,
+			DataCheck: item.Meta.DataCheck,
+		}
+		if req.Values {
+			if d.Item, err = kv2.StdProto.Encode(item); err != nil {
+				return err
+			}
+		}
+		ret.Digests = append(ret.Digests, d)
+	}
+
+	return iter.Error()
+}
+
+// objectQuorumRepair writes the newest items to the stale nodes, the nil
+// node is the local node.
+func (cn *Conn) objectQuorumRepair(table string, repair map[*ClientConfig][]*kv2.ObjectItem) {
+
+	for node, items := range repair {
+
+		if node == nil {
+			if err := cn.objectRepairLocal(table, items); err != nil {
+				hlog.Printf("warn", "kvgo quorum read repair local/%s, err %s", table, err.Error())
+			}
+			continue
+		}
+
+		req := &objectRepairRequest{
+			Table: table,
+		}
+		for _, item := range items {
+			bs, err := kv2.StdProto.Encode(item)
+			if err != nil {
+				continue
+			}
+			req.Items = append(req.Items, bs)
+		}
+
+		body, err := json.Marshal(req)
+		if err != nil {
+			continue
+		}
+
+		ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+		rs, err := cn.transport.SysCmd(ctx, node, &kv2.SysCmdRequest{
+			Method: "ObjectRepair",
+			Body:   body,
+		})
+		fc()
+		if err == nil && !rs.OK() {
+			err = rs.Error()
+		}
+		if err != nil {
+			hlog.Printf("warn", "kvgo quorum read repair %s/%s, err %s", node.Addr, table, err.Error())
+		}
+	}
+}
+
+// objectRepairLocal writes the items at their versions, the items older
+// than the local ones are ignored.
+func (cn *Conn) objectRepairLocal(table string, items []*kv2.ObjectItem) error {
+
+	for _, item := range items {
+
+		if item.Meta == nil || item.Meta.Version == 0 {
+			continue
+		}
+
+		ow := &kv2.ObjectWriter{
+			Meta: item.Meta,
+			Data: item.Data,
+		}
+		if kv2.AttrAllow(item.Meta.Attrs, kv2.ObjectMetaAttrDelete) {
+			ow.ModeDeleteSet(true)
+		}
+		ow.TableNameSet(table)
+
+		if rs := cn.commitLocal(ow, item.Meta.Version); !rs.OK() {
+			return rs.Error()
+		}
+	}
+
+	return nil
+}
+
+func (cn *Conn) objectDigestCmdLocal(method string, body []byte) *kv2.ObjectResult {
+
+	switch method {
+
+	case "ObjectDigest":
+
+		var (
+			req objectDigestRequest
+			ret objectDigestResult
+		)
+		if err := wireDecode(body, &req); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+
+		tdb := cn.tabledb(req.Table)
+		if tdb == nil {
+			return kv2.NewObjectResultClientError(errors.New("table not found"))
+		}
+
+		if len(req.Keys) == 0 && len(req.Cutset) > 0 {
+			if err := cn.objectDigestRange(tdb, &req, &ret); err != nil {
+				return kv2.NewObjectResultServerError(err)
+			}
+		}
+
+		for _, key := range req.Keys {
+
+			d := &objectDigest{
+				Key: key,
+			}
+			ret.Digests = append(ret.Digests, d)
+
+			ns := nsKeyMeta
+			if req.Values {
+				ns = nsKeyData
+			}
+
+			bs, err := cn.valueGet(tdb, ns, key)
+			if err != nil {
+				if err.Error() == ldbNotFound {
+					continue
+				}
+				return kv2.NewObjectResultServerError(err)
+			}
+
+			item, err := kv2.ObjectItemDecode(bs)
+			if err != nil {
+				return kv2.NewObjectResultServerError(err)
+			}
+
+			d.Version, d.DataCheck = item.Meta.Version, item.Meta.DataCheck
+			if req.Values {
+				if d.Item, err = kv2.StdProto.Encode(item); err != nil {
+					return kv2.NewObjectResultServerError(err)
+				}
+			}
+		}
+
+		bs, err := json.Marshal(&ret)
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		return sysCmdResultBytes(bs)
+
+	case "ObjectRepair":
+
+		var req objectRepairRequest
+		if err := wireDecode(body, &req); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+
+		var items []*kv2.ObjectItem
+		for _, bs := range req.Items {
+			var item kv2.ObjectItem
+			if err := kv2.StdProto.Decode(bs, &item); err != nil {
+				return kv2.NewObjectResultClientError(err)
+			}
+			items = append(items, &item)
+		}
+
+		if err := cn.objectRepairLocal(req.Table, items); err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+
+		return kv2.NewObjectResultOK()
+	}
+
+	return kv2.NewObjectResultClientError(errors.New("cmd not found"))
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ReadConsistencyMetadataKey is the grpc metadata of the consistency
+	// of a query, the linearizable queries are served after the read index.
+	ReadConsistencyMetadataKey = "x-kvgo-read-consistency"
+
+	ReadConsistencyLinearizable = "linearizable"
+	ReadConsistencyQuorum       = "quorum"
+)
+
+type readIndexRequest struct {
+	Table string `json:"table"`
+}
+
+// QueryLinearizable queries the latest state of the cluster, the result
+// includes all writes committed before the query is sent.
+//
+// The writes are not sent through the log. The node serving the query gets
+// the read index, the max log version of the table of a quorum of the main
+// nodes, which covers the version of every committed write since the read
+// quorum and the write quorum overlap. Then it waits until it has pulled the
+// logs up to the read index, the same way as the queries of a Session.
+func (cn *Conn) QueryLinearizable(rr *kv2.ObjectReader) *kv2.ObjectResult {
+
+	if cn.opts.ClientConnectEnable ||
+		(len(cn.opts.Cluster.MainNodes) > 0 && cn.opts.Server.Bind == "") {
+		return cn.objectQueryRemote(rr, ReadConsistencyMetadataKey, ReadConsistencyLinearizable)
+	}
+
+	if err := cn.readIndexWait(rr.TableName); err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return cn.objectLocalQuery(rr)
+}
+
+func readConsistencyIncoming(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get(ReadConsistencyMetadataKey); len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return ""
+}
+
+// readIndex returns the max log version of the table of a quorum of the
+// main nodes.
+func (cn *Conn) readIndex(table string) (uint64, error) {
+
+	nodes, dQuo := cn.dataQuorum(table)
+	if len(nodes) < 2 {
+		tdb := cn.tabledb(table)
+		if tdb == nil {
+			return 0, errors.New("table not found")
+		}
+		return tdb.objectLogVersionSet(0, 0, 0)
+	}
+
+	body, err := json.Marshal(&readIndexRequest{
+		Table: table,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		nCap = len(nodes)
+		nQuo = nCap - dQuo + 1
+		pQue = make(chan uint64, nCap)
+		pNum = 0
+		pLog = uint64(0)
+		pTTL = time.After(time.Millisecond * time.Duration(objAcceptTTL))
+	)
+
+	for _, v := range nodes {
+
+		go func(v *ClientConfig) {
+
+			ctx, fc := context.WithTimeout(context.Background(), time.Second*3)
+			defer fc()
+
+			rs, err := cn.transport.SysCmd(ctx, v, &kv2.SysCmdRequest{
+				Method: "ReadIndex",
+				Body:   body,
+			})
+			if err == nil && rs.OK() && rs.Meta != nil && rs.Meta.Version > 0 {
+				pQue <- rs.Meta.Version
+			} else {
+				pQue <- 0
+			}
+		}(v)
+	}
+
+	for i := 0; i < nCap && pNum < nQuo; i++ {
+		select {
+		case v := <-pQue:
+			if v > 0 {
+				pNum += 1
+				if v > pLog {
+					pLog = v
+				}
+			}
+		case <-pTTL:
+			return 0, errors.New("read index timeout")
+		}
+	}
+
+	if pNum < nQuo {
+		return 0, errors.New("read index quorum not reached")
+	}
+
+	return pLog, nil
+}
+
+// readIndexWait waits for the node to catch up to the read index of the
+// table.
+func (cn *Conn) readIndexWait(table string) error {
+
+	version, err := cn.readIndex(table)
+	if err != nil {
+		return err
+	}
+
+	return cn.sessionWait(table, version)
+}
+
+func (cn *Conn) readIndexCmdLocal(body []byte) *kv2.ObjectResult {
+
+	var req readIndexRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	tdb := cn.tabledb(req.Table)
+	if tdb == nil {
+		return kv2.NewObjectResultClientError(errors.New("table not found"))
+	}
+
+	version, err := tdb.objectLogVersionSet(0, 0, 0)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	rs := kv2.NewObjectResultOK()
+	rs.Meta = &kv2.ObjectMeta{
+		Version: version,
+	}
+	return rs
+}
@@ -0,0 +1,205 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	replicaLagInterval      = 5e9
+	replicaLagThrottleMax   = int64(1000)
+	errReplicaLagMessage    = "node lagging behind the cluster"
+	replicaLagStaleInterval = int64(30)
+)
+
+var errReplicaLag = status.Error(codes.Unavailable, errReplicaLagMessage)
+
+// ReplicaLag is the replication lag in milliseconds between the local node
+// and the main node Addr: PullLag is how far the local node lags behind the
+// writes of Addr, PeerLag is how far Addr lags behind the writes of the
+// local node.
+type ReplicaLag struct {
+	Addr    string `json:"addr"`
+	PullLag int64  `json:"pull_lag"`
+	PeerLag int64  `json:"peer_lag"`
+	Updated int64  `json:"updated"`
+
+	// the log offsets of the local tables pulled by Addr
+	offsets map[string]uint64
+}
+
+type replicaLagStatus struct {
+	mu   sync.RWMutex
+	lags map[string]*ReplicaLag
+}
+
+// ReplicationLags returns the replication lags between the local node and
+// the other main nodes holding data, refreshed every few seconds. The nodes
+// not reachable are not reported.
+func (cn *Conn) ReplicationLags() []*ReplicaLag {
+
+	cn.replicaLags.mu.RLock()
+	defer cn.replicaLags.mu.RUnlock()
+
+	var (
+		ls = []*ReplicaLag{}
+		tn = time.Now().Unix()
+	)
+	for _, v := range cn.replicaLags.lags {
+		if v.Updated+replicaLagStaleInterval >= tn {
+			lag := *v
+			ls = append(ls, &lag)
+		}
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Addr < ls[j].Addr
+	})
+
+	return ls
+}
+
+// replicaLagRead returns errReplicaLag if the local node lags behind one of
+// the other main nodes more than Cluster.ReadLagTime, the clients fail over
+// the queries to the other nodes.
+func (cn *Conn) replicaLagRead() error {
+	if cn.opts.Cluster.ReadLagTime > 0 {
+		for _, v := range cn.ReplicationLags() {
+			if v.PullLag > cn.opts.Cluster.ReadLagTime {
+				return errReplicaLag
+			}
+		}
+	}
+	return nil
+}
+
+// replicaLagThrottle returns how long a write coordinated by the local node
+// is delayed. The writes are throttled if all the other main nodes holding
+// data lag behind the local node more than Cluster.ThrottleLagTime, so they
+// can catch up before more writes are acked by a quorum that can not hold
+// them yet. The delay grows with the lag, up to a second.
+func (cn *Conn) replicaLagThrottle() time.Duration {
+
+	if cn.opts.Cluster.ThrottleLagTime < 1 {
+		return 0
+	}
+
+	ls := cn.ReplicationLags()
+	if len(ls) == 0 {
+		return 0
+	}
+
+	lag := int64(-1)
+	for _, v := range ls {
+		if lag < 0 || v.PeerLag < lag {
+			lag = v.PeerLag
+		}
+	}
+
+	if lag <= cn.opts.Cluster.ThrottleLagTime {
+		return 0
+	}
+
+	ms := (lag - cn.opts.Cluster.ThrottleLagTime) / 10
+	if ms < 1 {
+		ms = 1
+	} else if ms > replicaLagThrottleMax {
+		ms = replicaLagThrottleMax
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (cn *Conn) replicaLagRefresh() error {
+
+	if cn.nodeWitness() {
+		return nil
+	}
+
+	local, err := cn.nodeStatus()
+	if err != nil {
+		return err
+	}
+
+	lags := map[string]*ReplicaLag{}
+
+	for _, v := range cn.mainNodes() {
+
+		if v.Addr == cn.opts.Server.Bind || v.witness() {
+			continue
+		}
+
+		ret := &nodeStatusResult{}
+		if err := nodeCmdRemote(v, "NodeStatus", struct{}{}, ret); err != nil {
+			continue
+		}
+		ret.Addr = v.Addr
+
+		lags[v.Addr] = &ReplicaLag{
+			Addr:    v.Addr,
+			PullLag: nodeStatusLag(local, []*nodeStatusResult{ret}),
+			PeerLag: nodeStatusLag(ret, []*nodeStatusResult{local}),
+			Updated: time.Now().Unix(),
+			offsets: ret.Pulled[cn.opts.Server.Bind],
+		}
+	}
+
+	cn.replicaLags.mu.Lock()
+	prev := cn.replicaLags.lags
+	cn.replicaLags.lags = lags
+	cn.replicaLags.mu.Unlock()
+
+	// alerts on the lags crossing the thresholds
+	for addr, v := range lags {
+		var p ReplicaLag
+		if v2, ok := prev[addr]; ok {
+			p = *v2
+		}
+		if limit := cn.opts.Cluster.ReadLagTime; limit > 0 &&
+			v.PullLag > limit && p.PullLag <= limit {
+			hlog.Printf("warn", "kvgo replication lag behind %s %d ms, not ready for reads",
+				addr, v.PullLag)
+		}
+		if limit := cn.opts.Cluster.ThrottleLagTime; limit > 0 &&
+			v.PeerLag > limit && p.PeerLag <= limit {
+			hlog.Printf("warn", "kvgo replication lag of %s %d ms", addr, v.PeerLag)
+		}
+	}
+
+	return nil
+}
+
+func (cn *Conn) workerReplicaLag() {
+
+	for !cn.close {
+
+		time.Sleep(replicaLagInterval)
+
+		if cn.close || len(cn.mainNodes()) < 2 {
+			continue
+		}
+
+		if err := cn.replicaLagRefresh(); err != nil {
+			hlog.Printf("warn", "kvgo replication lag refresh err %s", err.Error())
+		}
+	}
+}
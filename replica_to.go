@@ -0,0 +1,104 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// replicaToSetup registers the triggers pushing the changes of the tables
+// of the node to the remote cluster, the remote nodes apply the changes by
+// their conflict policies, and the duplicated deliveries are no-ops.
+func (cn *Conn) replicaToSetup(node *ConfigReplicaToNode) error {
+
+	if node.ClientConfig == nil || node.Addr == "" {
+		return errors.New("no addr setup")
+	}
+
+	for _, tm := range node.TableMaps {
+
+		if tm.From == "" || tm.To == "" {
+			return errors.New("invalid table_maps")
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(node.Addr + "/" + tm.From + "/" + tm.To))
+
+		tm := tm
+
+		if err := cn.triggerRegister(&trigger{
+			name:   fmt.Sprintf("replica-to.%016x", h.Sum64()),
+			table:  tm.From,
+			prefix: []byte(node.Prefix),
+			fn: func(events []*ChangeEvent) error {
+				return replicaToPush(node.ClientConfig, tm.To, events)
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replicaToPush(node *ClientConfig, tableName string, events []*ChangeEvent) error {
+
+	c, err := node.NewClient()
+	if err != nil {
+		return err
+	}
+
+	if err := node.featureCheck(FeatureReplicaApply); err != nil {
+		return err
+	}
+
+	req := &replicaApplyRequest{
+		Table: tableName,
+	}
+
+	for _, ev := range events {
+
+		if ev.item == nil || ev.item.Meta == nil {
+			continue
+		}
+
+		bs, err := kv2.StdProto.Encode(ev.item)
+		if err != nil {
+			return err
+		}
+
+		req.Items = append(req.Items, bs)
+	}
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rs := c.Connector().SysCmd(&kv2.SysCmdRequest{
+		Method: "ReplicaApply",
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return fmt.Errorf("replica-to %s/%s, err %s", node.Addr, tableName, rs.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+)
+
+const (
+	DurabilityAsync = "async"
+	DurabilitySync  = "sync"
+)
+
+// replicationPolicy returns the policy of the key of the table, or nil if
+// no policy matches.
+func (it *ConfigCluster) replicationPolicy(table string, key []byte) *ConfigReplicationPolicy {
+	var hit *ConfigReplicationPolicy
+	for _, v := range it.ReplicationPolicies {
+		if v.Table != table || !bytes.HasPrefix(key, []byte(v.Prefix)) {
+			continue
+		}
+		if hit == nil || len(v.Prefix) > len(hit.Prefix) {
+			hit = v
+		}
+	}
+	return hit
+}
+
+// quorum returns the number of the main nodes that must accept the writes.
+func (it *ConfigReplicationPolicy) quorum(nCap int) int {
+	if it == nil || it.Replicas < 1 {
+		return nCap/2 + 1
+	}
+	if it.Replicas > nCap {
+		return nCap
+	}
+	return it.Replicas
+}
+
+func (it *ConfigReplicationPolicy) durable() bool {
+	return it != nil && it.Durability == DurabilitySync
+}
+
+// dbWriteObject writes the batch of the key to the table, the batch is
+// synced if the replication policy of the key is sync, or otherwise by the
+// fsync policy. The batch of noSync is never synced, see BatchLoad.
+func (cn *Conn) dbWriteObject(tdb *dbTable, key []byte, batch *leveldb.Batch, noSync bool) error {
+
+	if noSync {
+		return cn.dbWriteNoSync(tdb, batch)
+	}
+
+	if !cn.opts.Cluster.replicationPolicy(tdb.tableName, key).durable() {
+		return cn.dbWrite(tdb, batch)
+	}
+
+	if err := failpointInject(FailpointSyncWrite); err != nil {
+		return err
+	}
+
+	return tdb.db.Write(batch, syncWriteOpts)
+}
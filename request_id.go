@@ -0,0 +1,200 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	// RequestIdMetadataKey is the grpc metadata of the request id, which is
+	// sent by the clients and returned in the header of the responses.
+	RequestIdMetadataKey = "x-kvgo-request-id"
+
+	requestIdLenMax = 64
+	requestLogMax   = 1000
+)
+
+// RequestLogEntry is a request served by the node, the recent requests are
+// listed in /debug/requests of the debug listener.
+type RequestLogEntry struct {
+	Id      string `json:"id"`
+	Method  string `json:"method"`
+	Peer    string `json:"peer,omitempty"`
+	Time    int64  `json:"time"`
+	Latency int64  `json:"latency"` // in microseconds
+	Status  uint64 `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type requestLog struct {
+	mu    sync.Mutex
+	items []*RequestLogEntry
+	next  int
+}
+
+func newRequestLog(capacity int) *requestLog {
+	return &requestLog{
+		items: make([]*RequestLogEntry, 0, capacity),
+	}
+}
+
+func (it *requestLog) add(entry *RequestLogEntry) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if len(it.items) < cap(it.items) {
+		it.items = append(it.items, entry)
+	} else {
+		it.items[it.next] = entry
+	}
+	it.next = (it.next + 1) % cap(it.items)
+}
+
+// list returns the recent requests from the newest to the oldest, filtered
+// by the request id if id is not empty.
+func (it *requestLog) list(id string, errOnly bool, limit int) []*RequestLogEntry {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	ls := []*RequestLogEntry{}
+	for i := 1; i <= len(it.items) && len(ls) < limit; i++ {
+		entry := it.items[(it.next-i+len(it.items))%len(it.items)]
+		if (id != "" && entry.Id != id) || (errOnly && entry.Error == "") {
+			continue
+		}
+		ls = append(ls, entry)
+	}
+
+	return ls
+}
+
+type requestIdCtxKey struct{}
+
+// RequestIdFromContext returns the request id of the rpc served with the
+// context, or empty if not set.
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdCtxKey{}).(string)
+	return id
+}
+
+func requestIdValid(id string) bool {
+	if id == "" || len(id) > requestIdLenMax {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIdIncoming returns the request id of the client metadata, or a new
+// one if the client does not send it.
+func requestIdIncoming(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ls := md.Get(RequestIdMetadataKey); len(ls) > 0 && requestIdValid(ls[0]) {
+			return ls[0]
+		}
+	}
+	return randHexString(16)
+}
+
+// requestUnaryInterceptor sets the request id of every rpc, returns it in
+// the response header and in the messages of the errors, logs the failed
+// requests, and records the request into the recent requests.
+func (cn *Conn) requestUnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	var (
+		tn    = time.Now()
+		id    = requestIdIncoming(ctx)
+		entry = &RequestLogEntry{
+			Id:     id,
+			Method: info.FullMethod,
+			Time:   tn.UnixNano() / 1e6,
+		}
+	)
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.Peer = p.Addr.String()
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIdMetadataKey, id))
+
+	rs, err := handler(context.WithValue(ctx, requestIdCtxKey{}, id), req)
+
+	if err != nil {
+		entry.Error = err.Error()
+		err = status.Errorf(status.Code(err), "%s (request_id %s)", status.Convert(err).Message(), id)
+	} else if ors, ok := rs.(*kv2.ObjectResult); ok && ors != nil {
+		entry.Status = ors.Status
+		if !ors.OK() && !ors.NotFound() {
+			entry.Error = ors.Message
+			ors.Message += " (request_id " + id + ")"
+		}
+	}
+
+	entry.Latency = int64(time.Since(tn) / time.Microsecond)
+
+	if entry.Error != "" {
+		hlog.Printf("warn", "kvgo request %s %s from %s failed: %s",
+			id, entry.Method, entry.Peer, entry.Error)
+	}
+
+	if cn.requests != nil {
+		cn.requests.add(entry)
+	}
+
+	return rs, err
+}
+
+// requestIdOutgoing returns the context of the call with a new request id.
+func requestIdOutgoing(ctx context.Context) (context.Context, string) {
+	id := randHexString(16)
+	return metadata.AppendToOutgoingContext(ctx, RequestIdMetadataKey, id), id
+}
+
+// debugRequests lists the recent requests as json, filtered by the query
+// parameters id, errors=1 and limit (default to 100).
+func (cn *Conn) debugRequests(w http.ResponseWriter, r *http.Request) {
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > requestLogMax {
+		limit = 100
+	}
+
+	ls := []*RequestLogEntry{}
+	if cn.requests != nil {
+		ls = cn.requests.list(r.URL.Query().Get("id"), r.URL.Query().Get("errors") == "1", limit)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ls)
+}
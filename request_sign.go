@@ -0,0 +1,336 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hauth/go/hauth/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	ReqSignMetadataKey = "x-kvgo-sign"
+
+	reqSignVersion     = "v1"
+	reqSignNonce       = 12
+	reqSignNonceShards = 16
+	reqSignNoncesMax   = 1 << 20
+)
+
+// reqSignMetadataKeys are the metadata of the calls which change how the
+// requests are served, they are signed with the requests.
+var reqSignMetadataKeys = []string{
+	EpochMetadataKey,
+	KeyTokenMetadataKey,
+	ReadConsistencyMetadataKey,
+	SessionVersionMetadataKey,
+	WriteForceMetadataKey,
+}
+
+// ConfigRequestSign sets the signed requests of the access keys (see
+// ClientConfig.RequestSign), a signed request is refused if its time is
+// out of the Window of the server time, or if its nonce is seen in the
+// Window, so the captured requests are not replayed.
+type ConfigRequestSign struct {
+	// Refuse the requests of the access keys which are not signed, the
+	// requests of the JWT bearer tokens are not affected
+	Required bool `toml:"required" json:"required"`
+
+	Window int64 `toml:"window" json:"window" desc:"in seconds, default to 300, min to 10"`
+}
+
+// reqSignUnaryInterceptor signs each call by the HMAC-SHA256 of the access
+// key id, the time, a random nonce, the method, the SHA-256 digest of the
+// encoded request and the reqSignMetadataKeys of the call, so the secret
+// of the key is never sent and a signature is not valid for another
+// request, or for the same request with other metadata.
+func reqSignUnaryInterceptor(key *hauth.AccessKey) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+		md, _ := metadata.FromOutgoingContext(ctx)
+
+		sign, err := reqSignRequest(key, method, req, md)
+		if err != nil {
+			return err
+		}
+
+		return invoker(metadata.AppendToOutgoingContext(ctx, ReqSignMetadataKey, sign),
+			method, req, reply, cc, opts...)
+	}
+}
+
+// reqSignRequest returns the signature of the request of the method with
+// the metadata md.
+func reqSignRequest(key *hauth.AccessKey, method string, req interface{}, md metadata.MD) (string, error) {
+
+	nonce := make([]byte, reqSignNonce)
+	if err := cryptoRandRead(nonce); err != nil {
+		return "", err
+	}
+
+	digest, err := reqSignDigest(req)
+	if err != nil {
+		return "", err
+	}
+
+	return reqSignEncode([]byte(key.Secret), key.Id,
+		time.Now().UnixNano()/1e6, hex.EncodeToString(nonce), method, digest,
+		reqSignMetadata(md))
+}
+
+// reqSignMetadata returns the signed metadata of md, the lines of
+// "{key}={value}" of the reqSignMetadataKeys in order.
+func reqSignMetadata(md metadata.MD) string {
+	var ss []string
+	for _, k := range reqSignMetadataKeys {
+		for _, v := range md.Get(k) {
+			ss = append(ss, k+"="+v)
+		}
+	}
+	return strings.Join(ss, "\n")
+}
+
+// reqSignDigest returns the SHA-256 digest in hex of the encoded request.
+func reqSignDigest(req interface{}) (string, error) {
+
+	bs, err := kv2.StdProto.Encode(req)
+	if err != nil {
+		return "", err
+	}
+
+	sum, err := cryptoSum(crypto.SHA256, bs)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum), nil
+}
+
+// reqSignEncode returns the signature "v1:{key id}:{time}:{nonce}:{hmac}",
+// the hmac in base64 of the HMAC-SHA256 of the fields, the method, the
+// digest of the request and the signed metadata (the last field, so its
+// separators are not ambiguous).
+func reqSignEncode(secret []byte, id string, tn int64, nonce, method, digest, md string) (string, error) {
+
+	payload := strings.Join([]string{
+		reqSignVersion, id, strconv.FormatInt(tn, 10), nonce, method, digest, md,
+	}, ":")
+
+	sum, err := cryptoHmac(crypto.SHA256, secret, []byte(payload))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		reqSignVersion, id, strconv.FormatInt(tn, 10), nonce,
+		base64.RawURLEncoding.EncodeToString(sum),
+	}, ":"), nil
+}
+
+type reqSignDigestCtxKey struct{}
+
+// reqSignUnaryInterceptor keeps the digest of the request of the signed
+// call in the context, with which the signature is checked.
+func (cn *Conn) reqSignUnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	if cn.reqSign != nil && reqSignIncoming(ctx) != "" {
+		digest, err := reqSignDigest(req)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, reqSignDigestCtxKey{}, digest)
+	}
+
+	return handler(ctx, req)
+}
+
+// reqSignIncoming returns the signature of the metadata of the call.
+func reqSignIncoming(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get(ReqSignMetadataKey); len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return ""
+}
+
+// reqSignAuth checks the signed requests, the nonce of a request is kept
+// until its time is out of the window, in which the time of the signature
+// is accepted, so a nonce is refused as long as its request is valid. The
+// nonces are of each node, a request of a node may be replayed to another
+// node in the window.
+//
+// The nonces are kept in the shards of reqSignNonceShards, each one of
+// reqSignNoncesMax/reqSignNonceShards nonces at most, the requests of a
+// full shard are refused until the nonces in it expire, as the nonces can
+// not be dropped before their requests are out of the window.
+type reqSignAuth struct {
+	window    int64
+	noncesMax int
+	shards    [reqSignNonceShards]reqSignNonceShard
+	replayed  int64
+}
+
+type reqSignNonceShard struct {
+	mu     sync.Mutex
+	swept  int64
+	nonces map[string]int64
+}
+
+func newReqSignAuth(cfg *ConfigRequestSign) *reqSignAuth {
+	it := &reqSignAuth{
+		window:    cfg.Window * 1e3,
+		noncesMax: reqSignNoncesMax / reqSignNonceShards,
+	}
+	tn := time.Now().UnixNano() / 1e6
+	for i := range it.shards {
+		it.shards[i].swept = tn
+		it.shards[i].nonces = map[string]int64{}
+	}
+	return it
+}
+
+func (it *reqSignAuth) shard(nonce string) *reqSignNonceShard {
+	h := fnv.New32a()
+	h.Write([]byte(nonce))
+	return &it.shards[h.Sum32()%reqSignNonceShards]
+}
+
+// validate returns the access key of the signature of the call.
+func (it *reqSignAuth) validate(ctx context.Context, sign string,
+	keyMgr *hauth.AccessKeyManager) (*hauth.AccessKey, error) {
+
+	ss := strings.Split(sign, ":")
+	if len(ss) != 5 || ss[0] != reqSignVersion || len(ss[3]) != 2*reqSignNonce {
+		return nil, errors.New("invalid request signature")
+	}
+
+	tn, err := strconv.ParseInt(ss[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid request signature")
+	}
+
+	now := time.Now().UnixNano() / 1e6
+	if tn < now-it.window || tn > now+it.window {
+		return nil, errors.New("request signature expired, time out of the window")
+	}
+
+	key := keyMgr.KeyGet(ss[1])
+	if key == nil {
+		return nil, errors.New("access key " + ss[1] + " not found")
+	}
+
+	var (
+		method, _ = grpc.Method(ctx)
+		digest, _ = ctx.Value(reqSignDigestCtxKey{}).(string)
+		md, _     = metadata.FromIncomingContext(ctx)
+	)
+
+	sign2, err := reqSignEncode([]byte(key.Secret), ss[1], tn, ss[3], method, digest,
+		reqSignMetadata(md))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sign), []byte(sign2)) {
+		return nil, errors.New("invalid request signature")
+	}
+
+	// the nonces are kept after the signature is checked, so the nonces
+	// are only of the callers of the keys
+	var (
+		nonce = ss[1] + ":" + ss[3]
+		shard = it.shard(nonce)
+	)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// a full shard is swept once a second at most
+	if now-shard.swept >= it.window ||
+		(len(shard.nonces) >= it.noncesMax && now-shard.swept >= 1e3) {
+		for k, expired := range shard.nonces {
+			if expired < now {
+				delete(shard.nonces, k)
+			}
+		}
+		shard.swept = now
+	}
+
+	if _, ok := shard.nonces[nonce]; ok {
+		atomic.AddInt64(&it.replayed, 1)
+		return nil, errors.New("request signature replayed")
+	}
+
+	if len(shard.nonces) >= it.noncesMax {
+		return nil, errors.New("too many signed requests in the window")
+	}
+	shard.nonces[nonce] = tn + it.window
+
+	return key, nil
+}
+
+// reqSignValidator returns the validator of the roles and the table scopes
+// of the access key.
+func reqSignValidator(key *hauth.AccessKey) *roleValidator {
+
+	av := &roleValidator{
+		kind:    "key",
+		subject: key.Id,
+		perms:   map[string]bool{},
+		tables:  map[string]bool{},
+	}
+
+	for _, v := range key.Roles {
+		if role := authRole(v); role != nil {
+			for _, p := range role.Permissions {
+				av.perms[p] = true
+			}
+		}
+	}
+
+	for _, v := range key.Scopes {
+		if v.Name == AuthScopeTable {
+			av.tables[v.Value] = true
+		}
+	}
+
+	return av
+}
+
+// RequestSignReplayed returns the number of the signed requests refused as
+// replayed.
+func (cn *Conn) RequestSignReplayed() int64 {
+	if cn.reqSign == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&cn.reqSign.replayed)
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/hooto/hlog4g/hlog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	RpcCompressNone   = "none"
+	RpcCompressGzip   = "gzip"
+	RpcCompressSnappy = "snappy"
+
+	// the requests smaller than rpcCompressSizeMin are sent uncompressed,
+	// except the queries whose results are compressed only if the request is.
+	rpcCompressSizeMin = 1024
+)
+
+var (
+	rpcCompressorMu sync.RWMutex
+	rpcCompressors  = []string{RpcCompressGzip, RpcCompressSnappy}
+)
+
+func init() {
+	encoding.RegisterCompressor(&rpcSnappy{})
+}
+
+// RpcCompressorRegister registers the payload compressor of the RPC, which
+// is used by the setting ClientConfig.Compress of the clients and accepted by
+// the servers. The built-in ones are gzip and snappy, others (e.g. zstd) are
+// plugged in by registering a compressor of their library, it must be called
+// in an init function of both the clients and the servers.
+func RpcCompressorRegister(c encoding.Compressor) {
+	encoding.RegisterCompressor(c)
+	rpcCompressorMu.Lock()
+	defer rpcCompressorMu.Unlock()
+	for _, v := range rpcCompressors {
+		if v == c.Name() {
+			return
+		}
+	}
+	rpcCompressors = append(rpcCompressors, c.Name())
+}
+
+func rpcCompressorList() []string {
+	rpcCompressorMu.RLock()
+	defer rpcCompressorMu.RUnlock()
+	return append([]string{}, rpcCompressors...)
+}
+
+type rpcSnappy struct{}
+
+func (it *rpcSnappy) Name() string {
+	return RpcCompressSnappy
+}
+
+func (it *rpcSnappy) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (it *rpcSnappy) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// rpcCompressNegotiate returns the compressor of the connection, which is the
+// configured one if both the client and the server support it, or none.
+func rpcCompressNegotiate(name string, server *HandshakeInfo) string {
+
+	if name == "" || name == RpcCompressNone {
+		return ""
+	}
+
+	if encoding.GetCompressor(name) == nil {
+		hlog.Printf("warn", "kvgo rpc compressor %s not registered, compression disabled", name)
+		return ""
+	}
+
+	if server != nil {
+		for _, v := range server.Compressors {
+			if v == name {
+				return name
+			}
+		}
+	}
+
+	hlog.Printf("warn", "kvgo rpc compressor %s not supported by the server, compression disabled", name)
+	return ""
+}
+
+// callOptions returns the options of the call whose request is size bytes,
+// the size < 0 means the call returns the large results (e.g. the scans) and
+// is always compressed, since the server compresses the result with the
+// compressor of the request.
+func (it *ClientConnector) callOptions(size int) []grpc.CallOption {
+	if it.compress == "" || (size >= 0 && size < rpcCompressSizeMin) {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(it.compress)}
+}
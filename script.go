@@ -0,0 +1,160 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	scriptSizeMax = 64 * 1024
+	scriptArgsMax = 100
+)
+
+// ScriptEngine runs the scripts of a language, the script is run in the
+// transaction tx and can access the tables by its Get, Put and Delete. The
+// Lua engine (ScriptLua) is built in, the other languages (e.g. a WASM
+// runtime) can be registered by the server application.
+type ScriptEngine interface {
+	Eval(tx *Txn, script []byte, args [][]byte) ([]byte, error)
+}
+
+var (
+	scriptMu      sync.RWMutex
+	scriptEngines = map[string]ScriptEngine{}
+)
+
+// ScriptEngineRegister registers the engine of the script language lang,
+// the engines must be registered in the servers before Open.
+func ScriptEngineRegister(lang string, engine ScriptEngine) error {
+
+	if lang == "" || engine == nil {
+		return errors.New("invalid script engine")
+	}
+
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+
+	scriptEngines[lang] = engine
+
+	return nil
+}
+
+func scriptEngine(lang string) ScriptEngine {
+	scriptMu.RLock()
+	defer scriptMu.RUnlock()
+	return scriptEngines[lang]
+}
+
+type scriptEvalRequest struct {
+	Lang   string   `json:"lang"`
+	Script []byte   `json:"script"`
+	Args   [][]byte `json:"args,omitempty"`
+}
+
+// ScriptEval runs the script atomically on the server (or locally in
+// embedded mode), like EVAL of Redis, and returns its result. The scripts
+// are not supported in cluster mode.
+func (cn *Conn) ScriptEval(lang string, script []byte, args ...[]byte) ([]byte, error) {
+
+	if !cn.opts.ClientConnectEnable {
+		return cn.scriptEvalLocal(nil, lang, script, args)
+	}
+
+	bs, err := json.Marshal(&scriptEvalRequest{
+		Lang:   lang,
+		Script: script,
+		Args:   args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rs := cn.SysCmd(&kv2.SysCmdRequest{
+		Method: "ScriptEval",
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	if len(rs.Items) == 0 {
+		return nil, nil
+	}
+
+	return rs.DataValue().Bytes(), nil
+}
+
+func (cn *Conn) scriptEvalLocal(av appValidator, lang string, script []byte, args [][]byte) ([]byte, error) {
+
+	if len(script) == 0 || len(script) > scriptSizeMax {
+		return nil, errors.New("invalid script size")
+	}
+
+	if len(args) > scriptArgsMax {
+		return nil, errors.New("too many script args")
+	}
+
+	engine := scriptEngine(lang)
+	if engine == nil {
+		return nil, errors.New("script engine (" + lang + ") not found")
+	}
+
+	var ret []byte
+
+	err := cn.txnLocal(av, func(tx *Txn) error {
+		var err error
+		ret, err = engine.Eval(tx, script, args)
+		return err
+	})
+
+	return ret, err
+}
+
+func (cn *Conn) scriptCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	var req scriptEvalRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	ret, err := cn.scriptEvalLocal(av, req.Lang, req.Script, req.Args)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	return sysCmdResultBytes(ret)
+}
+
+// sysCmdResultBytes returns the result of a sys cmd with the value bs.
+func sysCmdResultBytes(bs []byte) *kv2.ObjectResult {
+
+	item := &kv2.ObjectItem{
+		Meta: &kv2.ObjectMeta{},
+		Data: &kv2.ObjectData{},
+	}
+	if err := item.DataValueSet(bs, nil); err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	rs := kv2.NewObjectResultOK()
+	rs.Items = append(rs.Items, item)
+
+	return rs
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	scriptLuaRegistryMax = 1 << 20
+	scriptLuaCallStack   = 200
+)
+
+// ScriptLua is the name of the built-in Lua 5.1 script engine. The scripts
+// read the args by ARGV[1..n] and access the tables by
+//
+//	kv.get(table, key)         -- returns the value, or nil if not found
+//	kv.put(table, key, value)
+//	kv.del(table, key)
+//
+// the first value returned by the script (a string, a number, a boolean
+// or nil) is the result of ScriptEval, a raised error rolls back all the
+// writes of the script.
+const ScriptLua = "lua"
+
+func init() {
+	ScriptEngineRegister(ScriptLua, scriptLuaEngine{})
+}
+
+type scriptLuaEngine struct{}
+
+func (scriptLuaEngine) Eval(tx *Txn, script []byte, args [][]byte) ([]byte, error) {
+
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptLuaCallStack,
+		RegistryMaxSize: scriptLuaRegistryMax,
+	})
+	defer L.Close()
+
+	// the io, os and package libs are not opened, and the loaders of the
+	// base lib are removed, the scripts can only access the kv api
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	argv := L.NewTable()
+	for _, v := range args {
+		argv.Append(lua.LString(v))
+	}
+	L.SetGlobal("ARGV", argv)
+
+	L.SetGlobal("kv", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get": func(L *lua.LState) int {
+			v, err := tx.Get(L.CheckString(1), []byte(L.CheckString(2)))
+			if err == ErrNotFound {
+				L.Push(lua.LNil)
+				return 1
+			} else if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(lua.LString(v))
+			return 1
+		},
+		"put": func(L *lua.LState) int {
+			if err := tx.Put(L.CheckString(1), []byte(L.CheckString(2)),
+				[]byte(L.CheckString(3))); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			return 0
+		},
+		"del": func(L *lua.LState) int {
+			if err := tx.Delete(L.CheckString(1), []byte(L.CheckString(2))); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			return 0
+		},
+	}))
+
+	// the script is stopped on the timeout of the transaction
+	L.SetContext(tx.Context())
+
+	fn, err := L.LoadString(string(script))
+	if err != nil {
+		return nil, err
+	}
+
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, err
+	}
+
+	switch v := L.Get(-1).(type) {
+	case *lua.LNilType:
+		return nil, nil
+
+	case lua.LString, lua.LNumber, lua.LBool:
+		return []byte(v.String()), nil
+	}
+
+	return nil, errors.New("invalid script result type " + L.Get(-1).Type().String())
+}
@@ -0,0 +1,338 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/filter"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	secondaryCatchUpIntervalDef = 5000 // in milliseconds
+	secondaryCatchUpIntervalMin = 100
+)
+
+var errSecondaryReadOnly = errors.New("read-only secondary")
+
+// ConfigSecondary is the setting of a read-only secondary instance.
+type ConfigSecondary struct {
+	// The private working directory of the secondary, the files of the
+	// primary are linked (or copied) into it.
+	Directory string `toml:"directory" json:"directory"`
+
+	// The interval in milliseconds the secondary catches up with the
+	// primary in background, default to 5000, -1 to disable (then the
+	// TryCatchUpWithPrimary is called by the application).
+	CatchUpInterval int64 `toml:"catch_up_interval" json:"catch_up_interval"`
+}
+
+// Secondary is a read-only instance of the store of another process, it
+// opens a copy of the primary with the table files hard linked and the
+// journals copied (so the writes of the primary since the last compaction
+// are replayed, like the catch-up from the WAL of the RocksDB secondary
+// instances), and catches up with the primary by opening a new copy. The
+// tables are copied one by one, so the reads across the tables are not a
+// consistent snapshot.
+//
+// The Secondary is a kv2.ClientConnector, the writes are refused.
+type Secondary struct {
+	mu      sync.RWMutex
+	catchMu sync.Mutex
+	primary ConfigStorage
+	opts    ConfigSecondary
+	lock    *dirLock
+	gen     uint64
+	cur     *Conn
+	prev    *Conn
+	close   bool
+	closed  chan bool
+}
+
+// OpenSecondary opens the read-only secondary of the primary storage.
+func OpenSecondary(primary ConfigStorage, cfg ConfigSecondary) (*Secondary, error) {
+
+	if primary.DataDirectory == "" || cfg.Directory == "" {
+		return nil, errors.New("no directory setup")
+	}
+
+	primary.DataDirectory = filepath.Clean(primary.DataDirectory)
+	cfg.Directory = filepath.Clean(cfg.Directory)
+
+	if primary.DataDirectory == cfg.Directory {
+		return nil, errors.New("the directory of the secondary must not be the primary's")
+	}
+
+	if cfg.CatchUpInterval == 0 {
+		cfg.CatchUpInterval = secondaryCatchUpIntervalDef
+	} else if cfg.CatchUpInterval > 0 && cfg.CatchUpInterval < secondaryCatchUpIntervalMin {
+		cfg.CatchUpInterval = secondaryCatchUpIntervalMin
+	}
+
+	lock, err := dirLockAcquire(cfg.Directory, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// the copies left by the last run
+	if ls, err := ioutil.ReadDir(cfg.Directory); err == nil {
+		for _, v := range ls {
+			if v.IsDir() {
+				os.RemoveAll(filepath.Join(cfg.Directory, v.Name()))
+			}
+		}
+	}
+
+	it := &Secondary{
+		primary: primary,
+		opts:    cfg,
+		lock:    lock,
+		closed:  make(chan bool),
+	}
+
+	if err := it.TryCatchUpWithPrimary(); err != nil {
+		lock.Release()
+		return nil, err
+	}
+
+	if cfg.CatchUpInterval > 0 {
+		go it.worker()
+	}
+
+	return it, nil
+}
+
+func (it *Secondary) worker() {
+
+	tr := time.NewTicker(time.Duration(it.opts.CatchUpInterval) * time.Millisecond)
+	defer tr.Stop()
+
+	for {
+		select {
+		case <-tr.C:
+			if err := it.TryCatchUpWithPrimary(); err != nil {
+				hlog.Printf("warn", "kvgo secondary catch up err %s", err.Error())
+			}
+		case <-it.closed:
+			return
+		}
+	}
+}
+
+// TryCatchUpWithPrimary opens a new copy of the primary and switches the
+// reads to it. The copy before the current one is closed, so the reads
+// still running on it after another catch-up fail.
+func (it *Secondary) TryCatchUpWithPrimary() error {
+
+	it.catchMu.Lock()
+	defer it.catchMu.Unlock()
+
+	it.mu.RLock()
+	gen := it.gen + 1
+	it.mu.RUnlock()
+
+	dir := filepath.Join(it.opts.Directory, fmt.Sprintf("%d", gen))
+
+	cn, err := it.open(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	it.mu.Lock()
+	if it.close {
+		it.mu.Unlock()
+		secondaryConnClose(cn)
+		return errors.New("closed")
+	}
+	prev := it.prev
+	it.gen, it.prev, it.cur = gen, it.cur, cn
+	it.mu.Unlock()
+
+	if prev != nil {
+		secondaryConnClose(prev)
+	}
+
+	return nil
+}
+
+func (it *Secondary) open(dir string) (*Conn, error) {
+
+	cn := &Conn{
+		keyMgr: hauth.NewAccessKeyManager(),
+		tables: map[string]*dbTable{},
+		opts: &Config{
+			Storage: ConfigStorage{
+				DataDirectory: dir,
+			},
+		},
+		uptime: time.Now().Unix(),
+		pubsub: newPubSubHub(),
+	}
+	cn.opts.Reset()
+
+	sys, err := it.openTable(dir, &dbTable{
+		tableName: sysTableName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cn.dbSys = sys.db
+	cn.tables[sysTableName] = sys
+
+	ls, err := dbSysTableList(cn.dbSys)
+	if err != nil {
+		secondaryConnClose(cn)
+		return nil, err
+	}
+
+	for _, t := range ls {
+		if t.tableName == sysTableName {
+			continue
+		}
+		if t, err = it.openTable(dir, t); err != nil {
+			secondaryConnClose(cn)
+			return nil, err
+		}
+		cn.tables[t.tableName] = t
+	}
+
+	return cn, nil
+}
+
+func (it *Secondary) openTable(dir string, tdb *dbTable) (*dbTable, error) {
+
+	var (
+		dirName = tableDirName(tdb)
+		dst     = filepath.Join(dir, dirName)
+		err     error
+	)
+
+	for i := 0; i < checkpointRetry; i++ {
+		// the table files may be removed by the compactions of the primary
+		// before they are linked
+		if err = checkpointTable(&it.primary, dirName, dst); err == nil ||
+			!os.IsNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tdb.db, err = leveldb.OpenFile(dst, &opt.Options{
+		ReadOnly:               true,
+		BlockCacheCapacity:     8 * opt.MiB,
+		OpenFilesCacheCapacity: 100,
+		Filter:                 filter.NewBloomFilter(10),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if bs, err := tdb.db.Get(keySysInstanceId, nil); err == nil {
+		tdb.instId = string(bs)
+	}
+
+	if tdb.incrSets == nil {
+		tdb.incrSets = map[string]*dbTableIncrSet{}
+		tdb.logAsyncSets = map[string]bool{}
+		tdb.logLockSets = map[uint64]uint64{}
+	}
+
+	return tdb, nil
+}
+
+func secondaryConnClose(cn *Conn) {
+	for _, tdb := range cn.tables {
+		if tdb.db != nil {
+			tdb.db.Close()
+			tdb.db = nil
+		}
+	}
+	os.RemoveAll(cn.opts.Storage.DataDirectory)
+}
+
+func (it *Secondary) conn() (*Conn, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	if it.close || it.cur == nil {
+		return nil, errors.New("closed")
+	}
+	return it.cur, nil
+}
+
+func (it *Secondary) Query(rr *kv2.ObjectReader) *kv2.ObjectResult {
+	cn, err := it.conn()
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+	return cn.objectLocalQuery(rr)
+}
+
+func (it *Secondary) Commit(rr *kv2.ObjectWriter) *kv2.ObjectResult {
+	return kv2.NewObjectResultClientError(errSecondaryReadOnly)
+}
+
+func (it *Secondary) BatchCommit(rr *kv2.BatchRequest) *kv2.BatchResult {
+	return rr.NewResult(kv2.ResultClientError, errSecondaryReadOnly.Error())
+}
+
+func (it *Secondary) SysCmd(rr *kv2.SysCmdRequest) *kv2.ObjectResult {
+	return kv2.NewObjectResultClientError(errSecondaryReadOnly)
+}
+
+func (it *Secondary) NewClient() (kv2.Client, error) {
+	return kv2.NewClient(it)
+}
+
+func (it *Secondary) NewReader(keys ...[]byte) *kv2.ClientReader {
+	return kv2.NewClientReader(it, keys...)
+}
+
+// Close closes the secondary and removes the copies of the primary.
+func (it *Secondary) Close() error {
+
+	it.mu.Lock()
+	if it.close {
+		it.mu.Unlock()
+		return nil
+	}
+	it.close = true
+	close(it.closed)
+	cur, prev := it.cur, it.prev
+	it.cur, it.prev = nil, nil
+	it.mu.Unlock()
+
+	for _, cn := range []*Conn{prev, cur} {
+		if cn != nil {
+			secondaryConnClose(cn)
+		}
+	}
+
+	return it.lock.Release()
+}
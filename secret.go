@@ -0,0 +1,490 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	SecretRefFile  = "file"
+	SecretRefEnv   = "env"
+	SecretRefVault = "vault"
+)
+
+// SecretStore resolves the secrets of the references "{scheme}:{ref}" of
+// an external store (e.g. a cloud KMS or secret manager), which is plugged
+// in by SecretStoreRegister.
+type SecretStore interface {
+	Secret(ref string) (string, error)
+}
+
+var (
+	secretStoreMu sync.RWMutex
+	secretStores  = map[string]SecretStore{}
+)
+
+// SecretStoreRegister registers the store of the scheme, which resolves the
+// secret settings of "{scheme}:{ref}".
+func SecretStoreRegister(scheme string, s SecretStore) {
+	secretStoreMu.Lock()
+	defer secretStoreMu.Unlock()
+	secretStores[scheme] = s
+}
+
+func secretStore(scheme string) SecretStore {
+	secretStoreMu.RLock()
+	defer secretStoreMu.RUnlock()
+	return secretStores[scheme]
+}
+
+// ConfigSecrets sets the secret stores of the secret settings, each of
+// the server/access_key/secret, backup/encrypt_key, client_encryption/keys/key,
+// storage/tiering/secret_key and cluster/main_nodes/access_key/secret may
+// be a reference of
+//
+//	file:{path}            the content of the file
+//	env:{name}             the environment variable
+//	vault:{path}#{field}   the field of the secret of a Vault KV engine
+//	{scheme}:{ref}         the store registered by SecretStoreRegister
+//
+// instead of the secret, so the secrets are not in the config files. The
+// references are resolved at the open, and the server access key, the
+// backup encrypt key, the client encryption keys and the access keys of the
+// main nodes are refreshed every RefreshInterval.
+type ConfigSecrets struct {
+	RefreshInterval int64 `toml:"refresh_interval" json:"refresh_interval" desc:"in seconds, default to 300, min to 10"`
+
+	// The address of the Vault server, default to the env VAULT_ADDR
+	VaultAddr string `toml:"vault_addr" json:"vault_addr"`
+
+	// The token of the Vault server, default to the env VAULT_TOKEN, which
+	// may be a reference of file: or env:
+	VaultToken string `toml:"vault_token" json:"vault_token"`
+}
+
+type secretRef struct {
+	name  string
+	ref   string
+	field *string
+	value string
+}
+
+type secretSet struct {
+	mu   sync.RWMutex
+	cfg  *ConfigSecrets
+	refs []*secretRef
+	hc   *http.Client
+}
+
+// secretFields returns the secret settings of the config by their names.
+func secretFields(cfg *Config) ([]string, []*string) {
+
+	var (
+		names  []string
+		fields []*string
+	)
+
+	add := func(name string, p *string) {
+		names, fields = append(names, name), append(fields, p)
+	}
+
+	if cfg.Server.AccessKey != nil {
+		add("server/access_key/secret", &cfg.Server.AccessKey.Secret)
+	}
+
+	add("backup/encrypt_key", &cfg.Backup.EncryptKey)
+
+	if cfg.ClientEncryption != nil {
+		for _, v := range cfg.ClientEncryption.Keys {
+			add(fmt.Sprintf("client_encryption/keys/%d/key", v.Id), &v.Key)
+		}
+	}
+
+	if cfg.Storage.Tiering != nil {
+		add("storage/tiering/secret_key", &cfg.Storage.Tiering.SecretKey)
+	}
+
+	for _, v := range cfg.Cluster.MainNodes {
+		if v.AccessKey != nil {
+			add("cluster/main_nodes/"+v.Addr+"/access_key/secret", &v.AccessKey.Secret)
+		}
+	}
+
+	return names, fields
+}
+
+// secretRefParse returns the scheme and the reference of the setting, ok is
+// false if the setting is the secret itself.
+func secretRefParse(s string) (string, string, bool) {
+
+	n := strings.IndexByte(s, ':')
+	if n < 1 {
+		return "", "", false
+	}
+
+	switch scheme := s[:n]; scheme {
+	case SecretRefFile, SecretRefEnv, SecretRefVault:
+		return scheme, s[n+1:], true
+
+	default:
+		if secretStore(scheme) != nil {
+			return scheme, s[n+1:], true
+		}
+	}
+
+	return "", "", false
+}
+
+// newSecretSet resolves the references of the secret settings of the
+// config, the settings are replaced by the secrets.
+func newSecretSet(cfg *Config) (*secretSet, error) {
+
+	it := &secretSet{
+		cfg: &cfg.Secrets,
+		hc:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	names, fields := secretFields(cfg)
+
+	for i, p := range fields {
+
+		if _, _, ok := secretRefParse(*p); !ok {
+			continue
+		}
+
+		ref := &secretRef{
+			name:  names[i],
+			ref:   *p,
+			field: p,
+		}
+
+		v, err := it.resolve(ref.ref)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s err %s", ref.name, err.Error())
+		}
+
+		ref.value = v
+		it.refs = append(it.refs, ref)
+	}
+
+	// the settings are kept as is if any reference fails
+	for _, ref := range it.refs {
+		*ref.field = ref.value
+	}
+
+	return it, nil
+}
+
+func (it *secretSet) resolve(s string) (string, error) {
+
+	scheme, ref, ok := secretRefParse(s)
+	if !ok {
+		return s, nil
+	}
+
+	var (
+		v   string
+		err error
+	)
+
+	switch scheme {
+
+	case SecretRefFile:
+		var bs []byte
+		if bs, err = ioutil.ReadFile(ref); err == nil {
+			v = strings.TrimSpace(string(bs))
+		}
+
+	case SecretRefEnv:
+		v = os.Getenv(ref)
+
+	case SecretRefVault:
+		v, err = it.vaultGet(ref)
+
+	default:
+		v, err = secretStore(scheme).Secret(ref)
+	}
+
+	if err == nil && v == "" {
+		err = errors.New("empty secret of " + scheme + ":" + ref)
+	}
+
+	return v, err
+}
+
+// vaultGet reads the field of the secret of the path "{path}#{field}" from
+// the Vault KV engine (version 1 or 2).
+func (it *secretSet) vaultGet(ref string) (string, error) {
+
+	n := strings.LastIndexByte(ref, '#')
+	if n < 1 || n == len(ref)-1 {
+		return "", errors.New("invalid vault secret " + ref + ", {path}#{field} required")
+	}
+
+	addr, token := it.cfg.VaultAddr, it.cfg.VaultToken
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	} else if scheme, _, ok := secretRefParse(token); ok && scheme != SecretRefVault {
+		var err error
+		if token, err = it.resolve(token); err != nil {
+			return "", err
+		}
+	}
+	if addr == "" || token == "" {
+		return "", errors.New("no secrets/vault_addr or vault_token setup")
+	}
+
+	req, err := http.NewRequest("GET",
+		strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(ref[:n], "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	rsp, err := it.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	bs, err := ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s status %d", ref[:n], rsp.StatusCode)
+	}
+
+	var ret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(bs, &ret); err != nil {
+		return "", err
+	}
+
+	// the secrets of the KV version 2 are in data.data
+	data := ret.Data
+	if v, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = v
+		}
+	}
+
+	v, ok := data[ref[n+1:]].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s field %s not found", ref[:n], ref[n+1:])
+	}
+
+	return v, nil
+}
+
+// value returns the latest secret of the setting, which is refreshed after
+// the open if it is a reference.
+func (it *secretSet) value(p *string) string {
+	if it != nil {
+		it.mu.RLock()
+		defer it.mu.RUnlock()
+		for _, v := range it.refs {
+			if v.field == p {
+				return v.value
+			}
+		}
+	}
+	return *p
+}
+
+// named returns the latest secret of the setting of the name.
+func (it *secretSet) named(name string) (string, bool) {
+	if it != nil {
+		it.mu.RLock()
+		defer it.mu.RUnlock()
+		for _, v := range it.refs {
+			if v.name == name {
+				return v.value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// refresh resolves the references again, and returns the names of the
+// settings changed, the last secrets are kept if the stores fail.
+func (it *secretSet) refresh() []string {
+
+	var changed []string
+
+	for _, ref := range it.refs {
+
+		v, err := it.resolve(ref.ref)
+		if err != nil {
+			hlog.Printf("warn", "kvgo secret %s refresh err %s", ref.name, err.Error())
+			continue
+		}
+
+		it.mu.Lock()
+		if v != ref.value {
+			ref.value = v
+			changed = append(changed, ref.name)
+		}
+		it.mu.Unlock()
+	}
+
+	return changed
+}
+
+func (cn *Conn) workerSecrets() {
+
+	var (
+		interval = time.Duration(cn.opts.Secrets.RefreshInterval) * time.Second
+		next     = time.Now().Add(interval)
+	)
+
+	for !cn.close {
+
+		time.Sleep(1e9)
+
+		if time.Now().Before(next) {
+			continue
+		}
+		next = next.Add(interval)
+
+		cn.secretsRefresh()
+	}
+}
+
+// secretsRefresh applies the secrets changed in the stores, the settings of
+// the connections of the tiering are kept until the restart.
+func (cn *Conn) secretsRefresh() {
+
+	for _, name := range cn.secrets.refresh() {
+
+		var err error
+
+		switch {
+
+		case name == "server/access_key/secret":
+			err = cn.serverKeyRotate(cn.secrets.value(&cn.opts.Server.AccessKey.Secret))
+
+		case strings.HasPrefix(name, "client_encryption/"):
+			err = cn.valueCryptRotate()
+
+		case strings.HasPrefix(name, "cluster/main_nodes/"):
+			err = cn.mainNodeKeyRotate(name)
+
+		case name == "backup/encrypt_key":
+			// read by the next backup
+
+		default:
+			hlog.Printf("warn", "kvgo secret %s changed, applied after restart", name)
+			continue
+		}
+
+		if err != nil {
+			hlog.Printf("warn", "kvgo secret %s refresh err %s", name, err.Error())
+		} else {
+			hlog.Printf("info", "kvgo secret %s refreshed", name)
+		}
+	}
+}
+
+// serverKeyRotate replaces the secret of the server access key, which is
+// also the secret of the key tokens.
+func (cn *Conn) serverKeyRotate(secret string) error {
+
+	if cn.keyMgr == nil || cn.opts.ClientConnectEnable {
+		return nil
+	}
+
+	key := *cn.opts.Server.AccessKey
+	key.Secret = secret
+
+	rr := kv2.NewObjectWriter(nsSysAccessKey(key.Id), &key).
+		TableNameSet(sysTableName)
+	if rs := cn.commitLocal(rr, 0); !rs.OK() {
+		return rs.Error()
+	}
+
+	return cn.keyMgr.KeySet(&key)
+}
+
+// mainNodeKeyRotate replaces the access key of the main node of the secret
+// setting by a copy with the new secret, as the cached connections of the
+// node sign the calls with the last key, and closes them, so the next calls
+// dial again with the new secret.
+func (cn *Conn) mainNodeKeyRotate(name string) error {
+
+	secret, ok := cn.secrets.named(name)
+	if !ok {
+		return nil
+	}
+
+	for _, v := range cn.opts.Cluster.MainNodes {
+
+		if v.AccessKey == nil ||
+			name != "cluster/main_nodes/"+v.Addr+"/access_key/secret" {
+			continue
+		}
+
+		key := *v.AccessKey
+		key.Secret = secret
+		v.AccessKey = &key
+
+		clientConnDrop(v.Addr)
+	}
+
+	return nil
+}
+
+// valueCryptRotate replaces the keys of the client encryption.
+func (cn *Conn) valueCryptRotate() error {
+
+	if cn.valueCrypt == nil {
+		return nil
+	}
+
+	cfg := &ConfigClientEncryption{
+		ActiveKey: cn.opts.ClientEncryption.ActiveKey,
+	}
+	for _, v := range cn.opts.ClientEncryption.Keys {
+		cfg.Keys = append(cfg.Keys, &ConfigEncryptionKey{
+			Id:  v.Id,
+			Key: cn.secrets.value(&v.Key),
+		})
+	}
+
+	keys, active, err := cfg.keys()
+	if err != nil {
+		return err
+	}
+
+	return cn.valueCrypt.reset(keys, active)
+}
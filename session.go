@@ -0,0 +1,221 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// SessionVersionMetadataKey is the grpc metadata of the version that
+	// the node must have caught up to before it serves the query.
+	SessionVersionMetadataKey = "x-kvgo-session-version"
+
+	sessionWaitTimeDef = int64(1000)
+	sessionWaitTimeMax = int64(10000)
+	sessionWaitSleep   = 10 * time.Millisecond
+)
+
+var errSessionVersionNotReached = errors.New("session version not reached")
+
+// Session gives the read-your-writes guarantee to a sequence of writes and
+// reads: a Query of the session never misses the writes committed by the
+// session before it, even if the query lands on a main node that has not
+// pulled the writes from its peers yet. The node waits up to the
+// SessionWaitTime of the cluster for the writes and returns an error if it
+// has not caught up by then.
+//
+// The Token of the session can be passed to NewSession in another process
+// to continue the session, e.g. across the requests of a web client.
+type Session struct {
+	mu       sync.Mutex
+	db       *Conn
+	versions map[string]uint64
+}
+
+// NewSession returns a new session, or continues the session of the token
+// if it is not empty.
+func (cn *Conn) NewSession(token string) (*Session, error) {
+
+	sess := &Session{
+		db:       cn,
+		versions: map[string]uint64{},
+	}
+
+	if token != "" {
+		bs, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, errors.New("invalid session token")
+		}
+		if err := json.Unmarshal(bs, &sess.versions); err != nil {
+			return nil, errors.New("invalid session token")
+		}
+	}
+
+	return sess, nil
+}
+
+// Token returns the last written version of each table of the session.
+func (it *Session) Token() string {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	bs, _ := json.Marshal(it.versions)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// Version returns the last version written by the session to the table.
+func (it *Session) Version(table string) uint64 {
+	if table == "" {
+		table = "main"
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.versions[table]
+}
+
+func (it *Session) versionSet(table string, version uint64) {
+	if table == "" {
+		table = "main"
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if version > it.versions[table] {
+		it.versions[table] = version
+	}
+}
+
+func (it *Session) Commit(rr *kv2.ObjectWriter) *kv2.ObjectResult {
+	rs := it.db.Commit(rr)
+	if rs.OK() && rs.Meta != nil && rs.Meta.Version > 0 {
+		it.versionSet(rr.TableName, rs.Meta.Version)
+	}
+	return rs
+}
+
+func (it *Session) Query(rr *kv2.ObjectReader) *kv2.ObjectResult {
+
+	cn, version := it.db, it.Version(rr.TableName)
+
+	if cn.opts.ClientConnectEnable ||
+		(len(cn.opts.Cluster.MainNodes) > 0 && cn.opts.Server.Bind == "") {
+		return cn.objectQueryRemote(rr, sessionVersionMetadata(version)...)
+	}
+
+	if err := cn.sessionWait(rr.TableName, version); err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return cn.objectLocalQuery(rr)
+}
+
+func sessionVersionMetadata(version uint64) []string {
+	if version == 0 {
+		return nil
+	}
+	return []string{SessionVersionMetadataKey, strconv.FormatUint(version, 10)}
+}
+
+func sessionVersionIncoming(ctx context.Context) uint64 {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get(SessionVersionMetadataKey); len(vs) > 0 {
+			if v, err := strconv.ParseUint(vs[0], 10, 64); err == nil {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+// sessionQuorum returns the least number of the main nodes that accept the
+// writes of the table by the replication policies.
+func (it *ConfigCluster) sessionQuorum(table string, nCap int) int {
+	q := nCap/2 + 1
+	for _, v := range it.ReplicationPolicies {
+		if v.Table == table {
+			if n := v.quorum(nCap); n < q {
+				q = n
+			}
+		}
+	}
+	return q
+}
+
+// sessionSynced returns whether the node has all writes of the table up to
+// the version. A write is accepted by at least a quorum of the main nodes,
+// so the node has it if the node itself and the peers it has pulled the
+// logs up to the version from are more than the nodes not in the quorum.
+func (cn *Conn) sessionSynced(tdb *dbTable, version uint64) (bool, error) {
+
+	nodes, nQuo := cn.dataQuorum(tdb.tableName)
+	if len(nodes) < 2 {
+		return true, nil
+	}
+
+	synced := 1
+
+	for _, v := range nodes {
+		if v.Addr == cn.opts.Server.Bind {
+			continue
+		}
+		offset, err := tdb.objectLogAsyncOffset(v.Addr, tdb.tableName)
+		if err != nil {
+			return false, err
+		}
+		if offset >= version {
+			synced += 1
+		}
+	}
+
+	return synced >= len(nodes)-nQuo+1, nil
+}
+
+// sessionWait waits up to the SessionWaitTime for the node to catch up to
+// the version of the table.
+func (cn *Conn) sessionWait(table string, version uint64) error {
+
+	if version == 0 {
+		return nil
+	}
+
+	tdb := cn.tabledb(table)
+	if tdb == nil {
+		return errors.New("table not found")
+	}
+
+	deadline := time.Now().Add(time.Duration(cn.opts.Cluster.SessionWaitTime) * time.Millisecond)
+
+	for {
+		ok, err := cn.sessionSynced(tdb, version)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errSessionVersionNotReached
+		}
+		time.Sleep(sessionWaitSleep)
+	}
+}
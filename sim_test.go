@@ -0,0 +1,368 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// simOptions are the faults of the simulated network.
+type simOptions struct {
+	// The probability that a request, or the reply of a request, is dropped.
+	DropRate float64
+
+	// The max delay of the delivery of a request by the simulated clock, the
+	// random delays reorder the concurrent requests.
+	MaxDelay time.Duration
+}
+
+// simCluster is a cluster of in-process nodes connected by a simulated
+// network and clock, to run the replication of the cluster mode with
+// induced partitions, drops and reorderings.
+//
+// The faults of every message are drawn from a random source derived from
+// the seed, the link (from, to) and the sequence of the message on the link,
+// so a test that issues its commits in a fixed order replays the same faults
+// with the same seed. The proposals expire by the simulated clock, which is
+// moved by Advance and by the delivery of the delayed messages, no message
+// waits for the real time.
+type simCluster struct {
+	mu         sync.Mutex
+	seed       int64
+	opts       simOptions
+	nodes      []*Conn
+	internals  []*InternalServiceImpl
+	addrs      map[string]int
+	links      map[[2]int]int64
+	parts      map[[2]int]bool
+	clock      time.Time
+	pending    []*simMessage
+	seq        int64
+	delivering bool
+}
+
+// simMessage is a delayed message, it is delivered when the simulated clock
+// reaches its time.
+type simMessage struct {
+	at    time.Time
+	seq   int64
+	ready chan struct{}
+}
+
+type simTransport struct {
+	sim  *simCluster
+	from int
+}
+
+// newSimCluster opens n nodes in the sub directories of dir.
+func newSimCluster(dir string, n int, seed int64, opts simOptions) (*simCluster, error) {
+
+	if n < 1 || n > kv2.ObjectClusterNodeMax {
+		return nil, errors.New("invalid number of nodes")
+	}
+
+	it := &simCluster{
+		seed:  seed,
+		opts:  opts,
+		addrs: map[string]int{},
+		links: map[[2]int]int64{},
+		parts: map[[2]int]bool{},
+		clock: time.Unix(1e9, 0),
+	}
+
+	key := NewSystemAccessKey()
+
+	for i := 0; i < n; i++ {
+
+		var nodes []*ClientConfig
+		for j := 0; j < n; j++ {
+			nodes = append(nodes, &ClientConfig{
+				Addr:      fmt.Sprintf("sim-%d:9000", j),
+				AccessKey: key,
+			})
+		}
+		it.addrs[nodes[i].Addr] = i
+
+		from := i
+		cn, err := Open(&Config{
+			Storage: ConfigStorage{
+				DataDirectory: filepath.Join(dir, fmt.Sprintf("node-%d", i)),
+			},
+			Cluster: ConfigCluster{
+				MainNodes: nodes,
+			},
+		}, connSetupFunc(func(cn *Conn) {
+			// the nodes are not served, the bind address only identifies
+			// the local node of the main nodes
+			cn.opts.Server.Bind = nodes[from].Addr
+			cn.transport = &simTransport{
+				sim:  it,
+				from: from,
+			}
+			cn.clock = it.Now
+		}))
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+
+		it.nodes = append(it.nodes, cn)
+		it.internals = append(it.internals, &InternalServiceImpl{
+			db:       cn,
+			prepares: map[string]*kv2.ObjectWriter{},
+		})
+	}
+
+	return it, nil
+}
+
+// Commit commits the object through the node.
+func (it *simCluster) Commit(node int, rr *kv2.ObjectWriter) *kv2.ObjectResult {
+	return it.nodes[node].Commit(rr)
+}
+
+// Query reads the object from the local store of the node.
+func (it *simCluster) Query(node int, rr *kv2.ObjectReader) *kv2.ObjectResult {
+	return it.nodes[node].objectLocalQuery(rr)
+}
+
+// QueryQuorum reads the object through the quorum read of the node.
+func (it *simCluster) QueryQuorum(node int, rr *kv2.ObjectReader) *kv2.ObjectResult {
+	return it.nodes[node].QueryQuorum(rr)
+}
+
+// Partition splits the nodes into the groups, the nodes of different groups
+// can not reach each other, and the nodes not in any group are isolated.
+func (it *simCluster) Partition(groups ...[]int) {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	group := map[int]int{}
+	for g, ls := range groups {
+		for _, i := range ls {
+			group[i] = g + 1
+		}
+	}
+
+	it.parts = map[[2]int]bool{}
+	for i := range it.nodes {
+		for j := range it.nodes {
+			if i != j && (group[i] == 0 || group[i] != group[j]) {
+				it.parts[[2]int{i, j}] = true
+			}
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (it *simCluster) Heal() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.parts = map[[2]int]bool{}
+}
+
+// Advance moves the simulated clock forward, the messages delayed until the
+// new time are delivered.
+func (it *simCluster) Advance(d time.Duration) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.clock = it.clock.Add(d)
+	for len(it.pending) > 0 && !it.pending[0].at.After(it.clock) {
+		close(it.pending[0].ready)
+		it.pending = it.pending[1:]
+	}
+}
+
+// delay schedules the delivery of a message after d by the simulated clock.
+func (it *simCluster) delay(d time.Duration) *simMessage {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.seq += 1
+	m := &simMessage{
+		at:    it.clock.Add(d),
+		seq:   it.seq,
+		ready: make(chan struct{}),
+	}
+
+	i := sort.Search(len(it.pending), func(i int) bool {
+		p := it.pending[i]
+		return p.at.After(m.at) || (p.at.Equal(m.at) && p.seq > m.seq)
+	})
+	it.pending = append(it.pending, nil)
+	copy(it.pending[i+1:], it.pending[i:])
+	it.pending[i] = m
+
+	if !it.delivering {
+		it.delivering = true
+		go it.deliver()
+	}
+
+	return m
+}
+
+// cancel removes the message if it is not delivered.
+func (it *simCluster) cancel(m *simMessage) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	for i, p := range it.pending {
+		if p == m {
+			it.pending = append(it.pending[:i], it.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// deliver delivers the pending messages in order of their times, and moves
+// the simulated clock to the time of each one. The concurrent requests are
+// given a chance to be scheduled before every delivery, so the later
+// requests of shorter delays overtake the earlier ones.
+func (it *simCluster) deliver() {
+	for {
+		runtime.Gosched()
+
+		it.mu.Lock()
+		if len(it.pending) == 0 {
+			it.delivering = false
+			it.mu.Unlock()
+			return
+		}
+		m := it.pending[0]
+		it.pending = it.pending[1:]
+		if m.at.After(it.clock) {
+			it.clock = m.at
+		}
+		close(m.ready)
+		it.mu.Unlock()
+	}
+}
+
+// Now returns the simulated clock.
+func (it *simCluster) Now() time.Time {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.clock
+}
+
+func (it *simCluster) Close() error {
+	for _, cn := range it.nodes {
+		cn.Close()
+	}
+	return nil
+}
+
+// fault draws the faults of the next message on the link.
+func (it *simCluster) fault(from, to int) (dropReq, dropReply bool, delay time.Duration, err error) {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	link := [2]int{from, to}
+	if it.parts[link] {
+		return false, false, 0, errors.New("sim: network partitioned")
+	}
+
+	it.links[link] += 1
+
+	rnd := rand.New(rand.NewSource(it.seed ^ int64(from)<<48 ^ int64(to)<<32 ^ it.links[link]))
+
+	dropReq = rnd.Float64() < it.opts.DropRate
+	dropReply = rnd.Float64() < it.opts.DropRate
+	if it.opts.MaxDelay > 0 {
+		delay = time.Duration(rnd.Int63n(int64(it.opts.MaxDelay)))
+	}
+
+	return dropReq, dropReply, delay, nil
+}
+
+// send delivers a copy of the request to the node, as the node decodes its
+// own copy over the wire.
+func (it *simTransport) send(ctx context.Context, node *ClientConfig,
+	fn func(ctx context.Context, to *InternalServiceImpl) (*kv2.ObjectResult, error)) (*kv2.ObjectResult, error) {
+
+	to, ok := it.sim.addrs[node.Addr]
+	if !ok {
+		return nil, errors.New("sim: node not found")
+	}
+
+	dropReq, dropReply, delay, err := it.sim.fault(it.from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if delay > 0 {
+		m := it.sim.delay(delay)
+		select {
+		case <-m.ready:
+		case <-ctx.Done():
+			it.sim.cancel(m)
+			return nil, ctx.Err()
+		}
+	}
+
+	if dropReq {
+		return nil, errors.New("sim: request dropped")
+	}
+
+	md, err := newAppCredential(node.AccessKey).GetRequestMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	md2, _ := metadata.FromOutgoingContext(ctx)
+
+	rs, err := fn(metadata.NewIncomingContext(ctx, metadata.Join(metadata.New(md), md2)), it.sim.internals[to])
+	if dropReply {
+		return nil, errors.New("sim: reply dropped")
+	}
+
+	return rs, err
+}
+
+func (it *simTransport) Prepare(ctx context.Context,
+	node *ClientConfig, rr *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
+	return it.send(ctx, node, func(ctx context.Context, to *InternalServiceImpl) (*kv2.ObjectResult, error) {
+		return to.Prepare(ctx, proto.Clone(rr).(*kv2.ObjectWriter))
+	})
+}
+
+func (it *simTransport) Accept(ctx context.Context,
+	node *ClientConfig, rr *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
+	return it.send(ctx, node, func(ctx context.Context, to *InternalServiceImpl) (*kv2.ObjectResult, error) {
+		return to.Accept(ctx, proto.Clone(rr).(*kv2.ObjectWriter))
+	})
+}
+
+func (it *simTransport) SysCmd(ctx context.Context,
+	node *ClientConfig, req *kv2.SysCmdRequest) (*kv2.ObjectResult, error) {
+	return it.send(ctx, node, func(ctx context.Context, to *InternalServiceImpl) (*kv2.ObjectResult, error) {
+		return (&PublicServiceImpl{db: to.db}).SysCmd(ctx, proto.Clone(req).(*kv2.SysCmdRequest))
+	})
+}
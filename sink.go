@@ -0,0 +1,583 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The types of change stream sinks, see ConfigSink.
+const (
+	SinkWebhook = "webhook"
+	SinkKafka   = "kafka"
+	SinkNats    = "nats"
+)
+
+const (
+	sinkDialTimeout = 10 * time.Second
+	sinkIoTimeout   = 30 * time.Second
+
+	// the max size of the protocol lines sent by the nats server
+	natsLineMax = 64 << 10
+)
+
+var (
+	errKafkaResponse = errors.New("kafka invalid response")
+	errNatsLine      = errors.New("nats invalid protocol line")
+)
+
+func (cn *Conn) sinkSetup(cfg *ConfigSink) error {
+
+	var fn TriggerFunc
+
+	switch cfg.Type {
+
+	case SinkWebhook:
+		fn = triggerWebhook(cfg.Addr)
+
+	case SinkKafka:
+		fn = (&kafkaSink{
+			brokers: strings.Split(cfg.Addr, ","),
+			topic:   cfg.Topic,
+		}).send
+
+	case SinkNats:
+		fn = (&natsSink{
+			addr:    cfg.Addr,
+			subject: cfg.Topic,
+		}).send
+
+	default:
+		return errors.New("invalid sink type")
+	}
+
+	return cn.triggerRegister(&trigger{
+		name:   "sink." + cfg.Name,
+		table:  cfg.Table,
+		prefix: []byte(cfg.Prefix),
+		fn:     fn,
+		batch:  cfg.BatchNum,
+	})
+}
+
+// natsSink publishes the changes by the core protocol of NATS, every batch
+// is flushed by a PING so the batch is received by the server before the
+// offset is saved.
+type natsSink struct {
+	addr    string
+	subject string
+	conn    net.Conn
+	rd      *bufio.Reader
+}
+
+func (it *natsSink) connect() error {
+
+	u, err := url.Parse(it.addr)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host += ":4222"
+	}
+
+	conn, err := net.DialTimeout("tcp", host, sinkDialTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sinkIoTimeout))
+
+	rd := bufio.NewReaderSize(conn, natsLineMax)
+
+	// INFO {...}
+	if line, err := natsReadLine(rd); err != nil {
+		conn.Close()
+		return err
+	} else if !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return errors.New("nats invalid server info")
+	}
+
+	opts := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "kvgo",
+		"lang":     "go",
+		"version":  Version,
+	}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		opts["pass"], _ = u.User.Password()
+	}
+
+	bs, _ := json.Marshal(opts)
+	if _, err := conn.Write([]byte("CONNECT " + string(bs) + "\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+
+	it.conn, it.rd = conn, rd
+
+	return nil
+}
+
+func (it *natsSink) send(events []*ChangeEvent) error {
+
+	if it.conn == nil {
+		if err := it.connect(); err != nil {
+			return err
+		}
+	}
+
+	err := it.publish(events)
+	if err != nil {
+		it.conn.Close()
+		it.conn = nil
+	}
+
+	return err
+}
+
+func (it *natsSink) publish(events []*ChangeEvent) error {
+
+	it.conn.SetDeadline(time.Now().Add(sinkIoTimeout))
+
+	wr := bufio.NewWriter(it.conn)
+
+	for _, ev := range events {
+		bs, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(wr, "PUB %s %d\r\n", it.subject, len(bs))
+		wr.Write(bs)
+		wr.WriteString("\r\n")
+	}
+
+	wr.WriteString("PING\r\n")
+
+	if err := wr.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		line, err := natsReadLine(it.rd)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			it.conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats " + strings.TrimSpace(line))
+		}
+	}
+}
+
+// natsReadLine reads a protocol line of the server, the lines longer than
+// natsLineMax are refused instead of being buffered.
+func natsReadLine(rd *bufio.Reader) (string, error) {
+	bs, err := rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errNatsLine
+	}
+	return string(bs), err
+}
+
+// kafkaSink produces the changes by the Kafka protocol (Metadata v0 and
+// Produce v3 with record batches v2, acks all), the changes are
+// partitioned by the hash of the keys so the changes of a key are kept in
+// order.
+type kafkaSink struct {
+	brokers    []string
+	topic      string
+	conns      map[int32]*kafkaConn
+	addrs      map[int32]string
+	leaders    []int32
+	correlated int32
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+const (
+	kafkaApiProduce  = 0
+	kafkaApiMetadata = 3
+	kafkaClientId    = "kvgo"
+	kafkaTimeout     = 30000
+)
+
+var kafkaCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func kafkaString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func kafkaBytes(buf, bs []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(bs)))
+	return append(buf, bs...)
+}
+
+type kafkaReader struct {
+	bs  []byte
+	err error
+}
+
+// next returns the next n bytes of the response. The lengths are sent by
+// the broker, so an invalid one sets err and the zero bytes of the fixed
+// size fields are returned, the reads after the error return zeros too.
+func (it *kafkaReader) next(n int) []byte {
+	if it.err != nil || n < 0 || len(it.bs) < n {
+		if it.err == nil {
+			it.err = errKafkaResponse
+		}
+		return make([]byte, 8)
+	}
+	bs := it.bs[:n]
+	it.bs = it.bs[n:]
+	return bs
+}
+
+func (it *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(it.next(2))) }
+func (it *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(it.next(4))) }
+func (it *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(it.next(8))) }
+
+// array returns the length of the next array, whose items take at least
+// size bytes each, the null array (-1) is empty.
+func (it *kafkaReader) array(size int) int {
+	n := it.int32()
+	if n == -1 || it.err != nil {
+		return 0
+	}
+	if n < 0 || int64(n)*int64(size) > int64(len(it.bs)) {
+		it.err = errKafkaResponse
+		return 0
+	}
+	return int(n)
+}
+
+func (it *kafkaReader) string() string {
+	n := it.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(it.next(int(n)))
+}
+
+func (it *kafkaConn) request(apiKey, apiVersion int16, correlationId int32, body []byte) (*kafkaReader, error) {
+
+	it.conn.SetDeadline(time.Now().Add(sinkIoTimeout))
+
+	req := binary.BigEndian.AppendUint16(nil, uint16(apiKey))
+	req = binary.BigEndian.AppendUint16(req, uint16(apiVersion))
+	req = binary.BigEndian.AppendUint32(req, uint32(correlationId))
+	req = kafkaString(req, kafkaClientId)
+	req = append(req, body...)
+
+	if _, err := it.conn.Write(kafkaBytes(nil, req)); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(it.rd, head); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(head)
+	if size < 4 || size > 64<<20 {
+		return nil, errors.New("kafka invalid response size")
+	}
+	if int32(binary.BigEndian.Uint32(head[4:])) != correlationId {
+		return nil, errors.New("kafka invalid correlation id")
+	}
+
+	bs := make([]byte, size-4)
+	if _, err := io.ReadFull(it.rd, bs); err != nil {
+		return nil, err
+	}
+
+	return &kafkaReader{bs: bs}, nil
+}
+
+func kafkaDial(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", strings.TrimSpace(addr), sinkDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{
+		conn: conn,
+		rd:   bufio.NewReader(conn),
+	}, nil
+}
+
+func (it *kafkaSink) close() {
+	for _, c := range it.conns {
+		c.conn.Close()
+	}
+	it.conns, it.leaders = nil, nil
+}
+
+// metadata refreshes the leaders of the partitions of the topic.
+func (it *kafkaSink) metadata() error {
+
+	var err error
+
+	for _, addr := range it.brokers {
+
+		var c *kafkaConn
+		if c, err = kafkaDial(addr); err != nil {
+			continue
+		}
+
+		it.correlated += 1
+
+		body := binary.BigEndian.AppendUint32(nil, 1)
+		body = kafkaString(body, it.topic)
+
+		var rd *kafkaReader
+		rd, err = c.request(kafkaApiMetadata, 0, it.correlated, body)
+		c.conn.Close()
+		if err != nil {
+			continue
+		}
+
+		var (
+			addrs   map[int32]string
+			leaders []int32
+		)
+		// the invalid responses are retried by the next broker
+		if addrs, leaders, err = kafkaMetadataDecode(rd, it.topic); err == errKafkaResponse {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		it.addrs, it.leaders = addrs, leaders
+		it.conns = map[int32]*kafkaConn{}
+
+		return nil
+	}
+
+	if err == nil {
+		err = errors.New("kafka no brokers")
+	}
+
+	return err
+}
+
+// kafkaMetadataDecode returns the addresses of the brokers and the leaders
+// of the partitions of the topic of a Metadata v0 response.
+func kafkaMetadataDecode(rd *kafkaReader, topic string) (map[int32]string, []int32, error) {
+
+	addrs := map[int32]string{}
+	for n := rd.array(10); n > 0 && rd.err == nil; n-- {
+		id := rd.int32()
+		host := rd.string()
+		port := rd.int32()
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	leaders := []int32{}
+	for n := rd.array(8); n > 0 && rd.err == nil; n-- {
+		if code := rd.int16(); code != 0 && rd.err == nil {
+			return nil, nil, fmt.Errorf("kafka topic %s error code %d", topic, code)
+		}
+		rd.string()
+		np := rd.array(18)
+		for m := np; m > 0 && rd.err == nil; m-- {
+			rd.int16()
+			partition := rd.int32()
+			leader := rd.int32()
+			rd.next(4 * rd.array(4))
+			rd.next(4 * rd.array(4))
+			if rd.err != nil {
+				break
+			}
+			// the ids of the partitions are 0 to the number of them - 1
+			if partition < 0 || int(partition) >= np {
+				return nil, nil, errKafkaResponse
+			}
+			for int(partition) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[partition] = leader
+		}
+	}
+
+	if rd.err != nil {
+		return nil, nil, rd.err
+	}
+	if len(leaders) == 0 {
+		return nil, nil, errors.New("kafka topic " + topic + " not found")
+	}
+
+	return addrs, leaders, nil
+}
+
+// kafkaProduceDecode returns the error of the partition of a Produce v3
+// response.
+func kafkaProduceDecode(rd *kafkaReader, partition int32) error {
+
+	for n := rd.array(6); n > 0 && rd.err == nil; n-- {
+		rd.string()
+		for m := rd.array(22); m > 0 && rd.err == nil; m-- {
+			rd.int32()
+			if code := rd.int16(); code != 0 && rd.err == nil {
+				return fmt.Errorf("kafka produce partition %d error code %d", partition, code)
+			}
+			rd.int64()
+			rd.int64()
+		}
+	}
+
+	return rd.err
+}
+
+// kafkaRecordBatch encodes the changes into a record batch (magic 2).
+func kafkaRecordBatch(events []*ChangeEvent) ([]byte, error) {
+
+	tn := time.Now().UnixNano() / 1e6
+
+	var records []byte
+	for i, ev := range events {
+
+		value, err := json.Marshal(ev)
+		if err != nil {
+			return nil, err
+		}
+
+		rec := []byte{0}                         // attributes
+		rec = binary.AppendVarint(rec, 0)        // timestamp delta
+		rec = binary.AppendVarint(rec, int64(i)) // offset delta
+		rec = binary.AppendVarint(rec, int64(len(ev.Key)))
+		rec = append(rec, ev.Key...)
+		rec = binary.AppendVarint(rec, int64(len(value)))
+		rec = append(rec, value...)
+		rec = binary.AppendVarint(rec, 0) // headers
+
+		records = binary.AppendVarint(records, int64(len(rec)))
+		records = append(records, rec...)
+	}
+
+	// the fields covered by the crc
+	body := binary.BigEndian.AppendUint16(nil, 0)                     // attributes
+	body = binary.BigEndian.AppendUint32(body, uint32(len(events)-1)) // last offset delta
+	body = binary.BigEndian.AppendUint64(body, uint64(tn))            // first timestamp
+	body = binary.BigEndian.AppendUint64(body, uint64(tn))            // max timestamp
+	body = binary.BigEndian.AppendUint64(body, ^uint64(0))            // producer id
+	body = binary.BigEndian.AppendUint16(body, ^uint16(0))            // producer epoch
+	body = binary.BigEndian.AppendUint32(body, ^uint32(0))            // base sequence
+	body = binary.BigEndian.AppendUint32(body, uint32(len(events)))   // records
+	body = append(body, records...)
+
+	batch := binary.BigEndian.AppendUint64(nil, 0)                        // base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(body))) // length
+	batch = binary.BigEndian.AppendUint32(batch, ^uint32(0))              // partition leader epoch
+	batch = append(batch, 2)                                              // magic
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(body, kafkaCrcTable))
+
+	return append(batch, body...), nil
+}
+
+func (it *kafkaSink) send(events []*ChangeEvent) error {
+
+	if it.leaders == nil {
+		if err := it.metadata(); err != nil {
+			return err
+		}
+	}
+
+	err := it.produce(events)
+	if err != nil {
+		it.close()
+	}
+
+	return err
+}
+
+func (it *kafkaSink) produce(events []*ChangeEvent) error {
+
+	// the changes of every partition, in order
+	parts := map[int32][]*ChangeEvent{}
+	for _, ev := range events {
+		h := fnv.New32a()
+		h.Write(ev.Key)
+		p := int32(h.Sum32() % uint32(len(it.leaders)))
+		parts[p] = append(parts[p], ev)
+	}
+
+	for p, ls := range parts {
+
+		leader := it.leaders[p]
+		addr, ok := it.addrs[leader]
+		if !ok {
+			return fmt.Errorf("kafka partition %d leader not available", p)
+		}
+
+		c := it.conns[leader]
+		if c == nil {
+			var err error
+			if c, err = kafkaDial(addr); err != nil {
+				return err
+			}
+			it.conns[leader] = c
+		}
+
+		batch, err := kafkaRecordBatch(ls)
+		if err != nil {
+			return err
+		}
+
+		body := binary.BigEndian.AppendUint16(nil, ^uint16(0)) // null transactional id
+		body = binary.BigEndian.AppendUint16(body, ^uint16(0)) // acks all
+		body = binary.BigEndian.AppendUint32(body, kafkaTimeout)
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = kafkaString(body, it.topic)
+		body = binary.BigEndian.AppendUint32(body, 1)
+		body = binary.BigEndian.AppendUint32(body, uint32(p))
+		body = kafkaBytes(body, batch)
+
+		it.correlated += 1
+
+		rd, err := c.request(kafkaApiProduce, 3, it.correlated, body)
+		if err != nil {
+			return err
+		}
+
+		if err := kafkaProduceDecode(rd, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	snapshotIdleTTL   = int64(60)
+	snapshotReadLimit = 100
+	snapshotReadSize  = 4 * int(kv2.MiB)
+	snapshotMax       = 16
+)
+
+// snapshotSession is a consistent snapshot of a table streamed to a new
+// replica, the replica applies the snapshot and then pulls the log after
+// the log offset of the snapshot.
+type snapshotSession struct {
+	id        string
+	tableName string
+	snap      *leveldb.Snapshot
+	logOffset uint64
+	active    int64
+}
+
+type snapshotHub struct {
+	mu       sync.Mutex
+	sessions map[string]*snapshotSession
+}
+
+type snapshotRequest struct {
+	Id     string `json:"id,omitempty"`
+	Table  string `json:"table,omitempty"`
+	Offset []byte `json:"offset,omitempty"`
+}
+
+type snapshotResult struct {
+	Id        string   `json:"id"`
+	LogOffset uint64   `json:"log_offset"`
+	Items     [][]byte `json:"items,omitempty"`
+	Offset    []byte   `json:"offset,omitempty"`
+	Next      bool     `json:"next"`
+}
+
+// objectLogSafeOffset returns the log offset all versions before which are
+// written, the versions of the commits in progress are excluded.
+func (tdb *dbTable) objectLogSafeOffset() uint64 {
+	tdb.logMu.Lock()
+	defer tdb.logMu.Unlock()
+	offset := tdb.logOffset
+	for v := range tdb.logLockSets {
+		if v <= offset {
+			offset = v - 1
+		}
+	}
+	return offset
+}
+
+// gc releases the snapshots not read in snapshotIdleTTL, must be called
+// with the lock held.
+func (it *snapshotHub) gc() {
+	tn := time.Now().Unix()
+	for id, s := range it.sessions {
+		if s.active+snapshotIdleTTL < tn {
+			s.snap.Release()
+			delete(it.sessions, id)
+		}
+	}
+}
+
+func (cn *Conn) snapshotCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	var req snapshotRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	hub := &cn.snapshots
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.gc()
+
+	var (
+		ret snapshotResult
+		ss  *snapshotSession
+	)
+
+	if method == "SnapshotOpen" {
+
+		if av != nil {
+			if err := av.Allow(authPermTableRead,
+				hauth.NewScopeFilter(AuthScopeTable, req.Table)); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+
+		tdb := cn.tabledb(req.Table)
+		if tdb == nil {
+			return kv2.NewObjectResultClientError(errors.New("table not found"))
+		}
+
+		if len(hub.sessions) >= snapshotMax {
+			return kv2.NewObjectResultServerError(errors.New("too many snapshots"))
+		}
+
+		logOffset := tdb.objectLogSafeOffset()
+
+		snap, err := tdb.db.GetSnapshot()
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+
+		ss = &snapshotSession{
+			id:        randHexString(16),
+			tableName: req.Table,
+			snap:      snap,
+			logOffset: logOffset,
+		}
+
+		if hub.sessions == nil {
+			hub.sessions = map[string]*snapshotSession{}
+		}
+		hub.sessions[ss.id] = ss
+
+	} else {
+
+		var ok bool
+		if ss, ok = hub.sessions[req.Id]; !ok {
+			return kv2.NewObjectResultClientError(errors.New("snapshot not found"))
+		}
+
+		if av != nil {
+			if err := av.Allow(authPermTableRead,
+				hauth.NewScopeFilter(AuthScopeTable, ss.tableName)); err != nil {
+				return kv2.NewObjectResultAccessDenied(err.Error())
+			}
+		}
+
+		if method == "SnapshotClose" {
+			ss.snap.Release()
+			delete(hub.sessions, ss.id)
+			return kv2.NewObjectResultOK()
+		}
+	}
+
+	ss.active = time.Now().Unix()
+	ret.Id, ret.LogOffset = ss.id, ss.logOffset
+
+	// the items are read from the data namespace, and from the meta
+	// namespace for the items of ObjectMetaAttrDataOff which have no data
+	// entry, the offset is the last key read with its namespace
+	var (
+		iter = ss.snap.NewIterator(&util.Range{
+			Start: []byte{nsKeyMeta},
+			Limit: []byte{nsKeyData + 1},
+		}, nil)
+		size = 0
+	)
+	defer iter.Release()
+
+	ok := iter.First()
+	if len(req.Offset) > 0 {
+		if ok = iter.Seek(req.Offset); ok && string(iter.Key()) == string(req.Offset) {
+			ok = iter.Next()
+		}
+	}
+
+	for ; ok; ok = iter.Next() {
+
+		if iter.Key()[0] == nsKeyMeta {
+			if _, err := ss.snap.Get(keyEncode(nsKeyData, iter.Key()[1:]), nil); err == nil {
+				continue
+			} else if err != leveldb.ErrNotFound {
+				return kv2.NewObjectResultServerError(err)
+			}
+		}
+
+		if len(ret.Items) >= snapshotReadLimit || size >= snapshotReadSize {
+			ret.Next = true
+			break
+		}
+
+		ret.Items = append(ret.Items, bytesClone(iter.Value()))
+		ret.Offset = bytesClone(iter.Key())
+		size += len(iter.Value())
+	}
+
+	if err := iter.Error(); err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	bs, err := json.Marshal(&ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
+
+func snapshotCmdRemote(c kv2.Client, method string, req *snapshotRequest) (*snapshotResult, error) {
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := c.Connector().SysCmd(&kv2.SysCmdRequest{
+		Method: method,
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	var ret snapshotResult
+	if len(rs.Items) > 0 {
+		if err := wireDecode(rs.DataValue().Bytes(), &ret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ret, nil
+}
+
+// replicaBootstrap copies the consistent snapshot of the table of the
+// upstream node to the local table, and saves the log offset of the
+// snapshot, from which the log of the upstream is pulled after.
+func (cn *Conn) replicaBootstrap(hp *ClientConfig, tm *ConfigReplicaTableMap, dt *dbTable) (uint64, error) {
+
+	c, err := hp.NewClient()
+	if err != nil {
+		return 0, err
+	}
+
+	// the upstream of the older versions has no snapshot, the whole log
+	// is pulled instead
+	if hs, err := hp.Handshake(); err != nil {
+		return 0, err
+	} else if !hs.Feature(FeatureSnapshot) {
+		hlog.Printf("warn", "kvgo replica bootstrap from %s (%s) not supported, pull the logs",
+			hp.Addr, hs.Version)
+		return 0, nil
+	}
+
+	ret, err := snapshotCmdRemote(c, "SnapshotOpen", &snapshotRequest{
+		Table: tm.From,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer snapshotCmdRemote(c, "SnapshotClose", &snapshotRequest{
+		Id: ret.Id,
+	})
+
+	var (
+		id        = ret.Id
+		logOffset = ret.LogOffset
+		num       = 0
+	)
+
+	hlog.Printf("info", "kvgo replica bootstrap from %s/%s to local/%s, log offset %d",
+		hp.Addr, tm.From, tm.To, logOffset)
+
+	for !cn.close {
+
+		for _, bs := range ret.Items {
+
+			item, err := kv2.ObjectItemDecode(bs)
+			if err != nil {
+				return 0, err
+			}
+
+			ow := &kv2.ObjectWriter{
+				Meta: item.Meta,
+				Data: item.Data,
+			}
+			ow.TableNameSet(tm.To)
+
+			if rs := cn.commitLocal(ow, item.Meta.Version); !rs.OK() {
+				return 0, rs.Error()
+			}
+			num += 1
+		}
+
+		if !ret.Next {
+			break
+		}
+
+		if ret, err = snapshotCmdRemote(c, "SnapshotRead", &snapshotRequest{
+			Id:     id,
+			Offset: ret.Offset,
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	if cn.close {
+		return 0, errors.New("closed")
+	}
+
+	if err := dt.db.Put(keySysLogAsync(hp.Addr, tm.From),
+		[]byte(strconv.FormatUint(logOffset, 10)), nil); err != nil {
+		return 0, err
+	}
+
+	hlog.Printf("info", "kvgo replica bootstrap from %s/%s to local/%s, num %d",
+		hp.Addr, tm.From, tm.To, num)
+
+	return logOffset, nil
+}
@@ -0,0 +1,571 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"github.com/golang/snappy"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// The block-based table format of RocksDB (format_version 1, no compression
+// on write), as written by SstFileWriter so the files can be read by
+// sst_dump and ingested by IngestExternalFile:
+//
+//	[data block]... [properties block] [metaindex block] [index block] [footer]
+//
+// Each block is followed by a trailer of the compression type (1 byte) and
+// the masked crc32c of the block and the type (4 bytes). The keys of the
+// data blocks are internal keys, the user key followed by the fixed64 of
+// (sequence << 8 | type), the sequences are 0 in the external files.
+const (
+	sstMagicLegacy      = uint64(0xdb4775248b80fb57)
+	sstMagic            = uint64(0x88e241b785f4cff7)
+	sstFormatVersion    = 1
+	sstFormatVersionMax = 5
+	sstFooterSizeLegacy = 48
+	sstFooterSize       = 53
+	sstBlockSize        = 4096
+	sstBlockRestart     = 16
+	sstBlockTrailerSize = 5
+	sstChecksumCrc32c   = 1
+	sstCompressNone     = 0
+	sstCompressSnappy   = 1
+	sstKeyTypeDeletion  = 0
+	sstKeyTypeValue     = 1
+	sstDumpScanLimit    = 1000
+)
+
+var sstCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func sstCrcMask(crc uint32) uint32 {
+	return ((crc >> 15) | (crc << 17)) + 0xa282ead8
+}
+
+type sstBlockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (it sstBlockHandle) encode(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, it.offset)
+	return binary.AppendUvarint(buf, it.size)
+}
+
+func sstBlockHandleDecode(bs []byte) (sstBlockHandle, int, error) {
+	offset, n := binary.Uvarint(bs)
+	if n <= 0 {
+		return sstBlockHandle{}, 0, errors.New("sst invalid block handle")
+	}
+	size, n2 := binary.Uvarint(bs[n:])
+	if n2 <= 0 {
+		return sstBlockHandle{}, 0, errors.New("sst invalid block handle")
+	}
+	return sstBlockHandle{offset, size}, n + n2, nil
+}
+
+type sstBlockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	interval int
+	counter  int
+	lastKey  []byte
+}
+
+func (it *sstBlockBuilder) add(key, value []byte) {
+
+	shared := 0
+	if it.counter < it.interval && len(it.restarts) > 0 {
+		for shared < len(key) && shared < len(it.lastKey) && key[shared] == it.lastKey[shared] {
+			shared++
+		}
+	} else {
+		it.restarts = append(it.restarts, uint32(len(it.buf)))
+		it.counter = 0
+	}
+
+	it.buf = binary.AppendUvarint(it.buf, uint64(shared))
+	it.buf = binary.AppendUvarint(it.buf, uint64(len(key)-shared))
+	it.buf = binary.AppendUvarint(it.buf, uint64(len(value)))
+	it.buf = append(it.buf, key[shared:]...)
+	it.buf = append(it.buf, value...)
+
+	it.lastKey = append(it.lastKey[:0], key...)
+	it.counter++
+}
+
+func (it *sstBlockBuilder) finish() []byte {
+	if len(it.restarts) == 0 {
+		it.restarts = append(it.restarts, 0)
+	}
+	for _, v := range it.restarts {
+		it.buf = binary.LittleEndian.AppendUint32(it.buf, v)
+	}
+	return binary.LittleEndian.AppendUint32(it.buf, uint32(len(it.restarts)))
+}
+
+func (it *sstBlockBuilder) reset() {
+	it.buf, it.restarts, it.counter, it.lastKey = it.buf[:0], it.restarts[:0], 0, it.lastKey[:0]
+}
+
+type sstWriter struct {
+	w       *bufio.Writer
+	offset  uint64
+	data    sstBlockBuilder
+	index   sstBlockBuilder
+	lastKey []byte
+	props   map[string]uint64
+}
+
+func newSstWriter(w *bufio.Writer) *sstWriter {
+	return &sstWriter{
+		w:     w,
+		data:  sstBlockBuilder{interval: sstBlockRestart},
+		index: sstBlockBuilder{interval: 1},
+		props: map[string]uint64{},
+	}
+}
+
+func (it *sstWriter) writeBlock(bs []byte) (sstBlockHandle, error) {
+
+	h := sstBlockHandle{it.offset, uint64(len(bs))}
+
+	trailer := []byte{sstCompressNone, 0, 0, 0, 0}
+	crc := crc32.Update(crc32.Checksum(bs, sstCrcTable), sstCrcTable, trailer[:1])
+	binary.LittleEndian.PutUint32(trailer[1:], sstCrcMask(crc))
+
+	if _, err := it.w.Write(bs); err != nil {
+		return h, err
+	}
+	if _, err := it.w.Write(trailer); err != nil {
+		return h, err
+	}
+
+	it.offset += uint64(len(bs) + sstBlockTrailerSize)
+
+	return h, nil
+}
+
+// add appends the key, the keys must be added in ascending order.
+func (it *sstWriter) add(key, value []byte) error {
+
+	if it.lastKey != nil && bytes.Compare(key, it.lastKey) <= 0 {
+		return errors.New("sst keys out of order")
+	}
+
+	ikey := binary.LittleEndian.AppendUint64(append([]byte{}, key...), sstKeyTypeValue)
+
+	it.data.add(ikey, value)
+	it.lastKey = append(it.lastKey[:0], key...)
+
+	it.props["rocksdb.num.entries"] += 1
+	it.props["rocksdb.raw.key.size"] += uint64(len(ikey))
+	it.props["rocksdb.raw.value.size"] += uint64(len(value))
+
+	if len(it.data.buf) >= sstBlockSize {
+		return it.flush()
+	}
+	return nil
+}
+
+func (it *sstWriter) flush() error {
+
+	if len(it.data.restarts) == 0 {
+		return nil
+	}
+
+	lastKey := append([]byte{}, it.data.lastKey...)
+
+	h, err := it.writeBlock(it.data.finish())
+	if err != nil {
+		return err
+	}
+	it.data.reset()
+
+	it.index.add(lastKey, h.encode(nil))
+	it.props["rocksdb.num.data.blocks"] += 1
+
+	return nil
+}
+
+func (it *sstWriter) finish() error {
+
+	if err := it.flush(); err != nil {
+		return err
+	}
+
+	it.props["rocksdb.data.size"] = it.offset
+
+	indexBlock := it.index.finish()
+	it.props["rocksdb.index.size"] = uint64(len(indexBlock) + sstBlockTrailerSize)
+
+	// properties block
+	var (
+		props = sstBlockBuilder{interval: 1}
+		vals  = map[string][]byte{
+			"rocksdb.comparator":                     []byte("leveldb.BytewiseComparator"),
+			"rocksdb.external_sst_file.version":      binary.LittleEndian.AppendUint32(nil, 2),
+			"rocksdb.external_sst_file.global_seqno": binary.LittleEndian.AppendUint64(nil, 0),
+			"rocksdb.format.version":                 binary.AppendUvarint(nil, sstFormatVersion),
+			"rocksdb.creating.column.family.id":      binary.AppendUvarint(nil, 0),
+			"rocksdb.column.family.name":             []byte("default"),
+			"rocksdb.filter.size":                    binary.AppendUvarint(nil, 0),
+			"rocksdb.index.key.is.user.key":          binary.AppendUvarint(nil, 0),
+			"rocksdb.index.value.is.delta.encoded":   binary.AppendUvarint(nil, 0),
+			"rocksdb.creating.host.identity":         []byte("kvgo"),
+			"rocksdb.merge.operator":                 []byte("nullptr"),
+			"rocksdb.prefix.extractor.name":          []byte("nullptr"),
+			"rocksdb.property.collectors":            []byte("[]"),
+			"rocksdb.compression":                    []byte("NoCompression"),
+			"rocksdb.index.type":                     binary.AppendUvarint(nil, 0),
+			"rocksdb.fixed.key.length":               binary.AppendUvarint(nil, 0),
+			"rocksdb.deleted.keys":                   binary.AppendUvarint(nil, 0),
+			"rocksdb.merge.operands":                 binary.AppendUvarint(nil, 0),
+			"rocksdb.num.range-deletions":            binary.AppendUvarint(nil, 0),
+		}
+		keys = []string{}
+	)
+	for k, v := range it.props {
+		vals[k] = binary.AppendUvarint(nil, v)
+	}
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		props.add([]byte(k), vals[k])
+	}
+
+	propsHandle, err := it.writeBlock(props.finish())
+	if err != nil {
+		return err
+	}
+
+	meta := sstBlockBuilder{interval: 1}
+	meta.add([]byte("rocksdb.properties"), propsHandle.encode(nil))
+
+	metaHandle, err := it.writeBlock(meta.finish())
+	if err != nil {
+		return err
+	}
+
+	indexHandle, err := it.writeBlock(indexBlock)
+	if err != nil {
+		return err
+	}
+
+	footer := []byte{sstChecksumCrc32c}
+	footer = metaHandle.encode(footer)
+	footer = indexHandle.encode(footer)
+	footer = append(footer, make([]byte, sstFooterSize-12-len(footer))...)
+	footer = binary.LittleEndian.AppendUint32(footer, sstFormatVersion)
+	footer = binary.LittleEndian.AppendUint64(footer, sstMagic)
+
+	if _, err := it.w.Write(footer); err != nil {
+		return err
+	}
+
+	return it.w.Flush()
+}
+
+// DumpSST writes the items of the prefix of the table into a RocksDB SST
+// file, as written by SstFileWriter, which can be read by sst_dump and
+// ingested by IngestExternalFile. Only the values are written, the metas
+// (versions, ttl, attrs) of the items are not.
+func (cn *Conn) DumpSST(tableName string, prefix []byte, path string) (int64, error) {
+
+	fp, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var (
+		w      = newSstWriter(bufio.NewWriter(fp))
+		offset = prefix
+		cutset = bytesClone(prefix)
+		num    = int64(0)
+	)
+
+	for {
+
+		rs := cn.Query(kv2.NewObjectReader(nil).TableNameSet(tableName).
+			KeyRangeSet(offset, cutset).LimitNumSet(sstDumpScanLimit))
+		if !rs.OK() && !rs.NotFound() {
+			return num, rs.Error()
+		}
+
+		for _, item := range rs.Items {
+			if err := w.add(item.Meta.Key, item.DataValue().Bytes()); err != nil {
+				return num, err
+			}
+			offset = item.Meta.Key
+			num += 1
+		}
+
+		if len(rs.Items) < sstDumpScanLimit {
+			break
+		}
+	}
+
+	if err := w.finish(); err != nil {
+		return num, err
+	}
+
+	return num, fp.Sync()
+}
+
+type sstReader struct {
+	fp       *os.File
+	checksum byte
+}
+
+func (it *sstReader) readBlock(h sstBlockHandle) ([]byte, error) {
+
+	buf := make([]byte, h.size+sstBlockTrailerSize)
+	if _, err := it.fp.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, err
+	}
+
+	var (
+		bs    = buf[:h.size]
+		ctype = buf[h.size]
+	)
+
+	if it.checksum == sstChecksumCrc32c {
+		crc := crc32.Update(crc32.Checksum(bs, sstCrcTable), sstCrcTable, buf[h.size:h.size+1])
+		if sstCrcMask(crc) != binary.LittleEndian.Uint32(buf[h.size+1:]) {
+			return nil, fmt.Errorf("sst block checksum mismatch at %d", h.offset)
+		}
+	}
+
+	switch ctype {
+	case sstCompressNone:
+		return bs, nil
+	case sstCompressSnappy:
+		return snappy.Decode(nil, bs)
+	}
+
+	return nil, fmt.Errorf("sst compression type %d not supported", ctype)
+}
+
+// sstBlockEntries calls fn with the entries of the block in order.
+func sstBlockEntries(bs []byte, fn func(key, value []byte) error) error {
+
+	if len(bs) < 4 {
+		return errors.New("sst invalid block")
+	}
+
+	num := binary.LittleEndian.Uint32(bs[len(bs)-4:])
+	if num&(1<<31) != 0 {
+		return errors.New("sst data block hash index not supported")
+	}
+
+	end := len(bs) - 4 - 4*int(num)
+	if end < 0 {
+		return errors.New("sst invalid block")
+	}
+
+	var (
+		key []byte
+		off = 0
+	)
+
+	for off < end {
+
+		shared, n1 := binary.Uvarint(bs[off:end])
+		nonShared, n2 := binary.Uvarint(bs[off+n1 : end])
+		valueLen, n3 := binary.Uvarint(bs[off+n1+n2 : end])
+		if n1 <= 0 || n2 <= 0 || n3 <= 0 {
+			return errors.New("sst invalid block entry")
+		}
+		off += n1 + n2 + n3
+
+		if int(shared) > len(key) || off+int(nonShared)+int(valueLen) > end {
+			return errors.New("sst invalid block entry")
+		}
+
+		key = append(key[:shared], bs[off:off+int(nonShared)]...)
+		off += int(nonShared)
+
+		if err := fn(key, bs[off:off+int(valueLen)]); err != nil {
+			return err
+		}
+		off += int(valueLen)
+	}
+
+	return nil
+}
+
+// IngestSST loads the values of a RocksDB SST file into the table, the
+// newest version of every key is loaded, and the deleted keys are skipped.
+// The files of the block-based format without compression or with snappy
+// are supported.
+func (cn *Conn) IngestSST(tableName string, path string) (int64, error) {
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	st, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if st.Size() < sstFooterSizeLegacy {
+		return 0, errors.New("sst invalid file")
+	}
+
+	footer := make([]byte, sstFooterSize)
+	if st.Size() < sstFooterSize {
+		footer = footer[:sstFooterSizeLegacy]
+	}
+	if _, err := fp.ReadAt(footer, st.Size()-int64(len(footer))); err != nil {
+		return 0, err
+	}
+
+	var (
+		r      = &sstReader{fp: fp, checksum: sstChecksumCrc32c}
+		magic  = binary.LittleEndian.Uint64(footer[len(footer)-8:])
+		handle []byte
+	)
+
+	switch magic {
+
+	case sstMagicLegacy:
+		handle = footer[len(footer)-sstFooterSizeLegacy:]
+
+	case sstMagic:
+		if len(footer) < sstFooterSize {
+			return 0, errors.New("sst invalid footer")
+		}
+		if v := binary.LittleEndian.Uint32(footer[sstFooterSize-12:]); v > sstFormatVersionMax {
+			return 0, fmt.Errorf("sst format version %d not supported", v)
+		}
+		r.checksum = footer[0]
+		handle = footer[1:]
+
+	default:
+		return 0, errors.New("sst invalid magic number")
+	}
+
+	metaHandle, n, err := sstBlockHandleDecode(handle)
+	if err != nil {
+		return 0, err
+	}
+	indexHandle, _, err := sstBlockHandleDecode(handle[n:])
+	if err != nil {
+		return 0, err
+	}
+
+	// the index values must not be delta encoded (format_version >= 4)
+	metaBlock, err := r.readBlock(metaHandle)
+	if err != nil {
+		return 0, err
+	}
+	if err := sstBlockEntries(metaBlock, func(key, value []byte) error {
+		if string(key) != "rocksdb.properties" {
+			return nil
+		}
+		h, _, err := sstBlockHandleDecode(value)
+		if err != nil {
+			return err
+		}
+		props, err := r.readBlock(h)
+		if err != nil {
+			return err
+		}
+		return sstBlockEntries(props, func(key, value []byte) error {
+			switch string(key) {
+			case "rocksdb.index.value.is.delta.encoded", "rocksdb.index.type":
+				if v, _ := binary.Uvarint(value); v > 0 {
+					return fmt.Errorf("sst %s %d not supported", key, v)
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		return 0, err
+	}
+
+	indexBlock, err := r.readBlock(indexHandle)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		num     = int64(0)
+		lastKey []byte
+	)
+
+	err = cn.BatchLoad(func(bl *BatchLoader) error {
+		return sstBlockEntries(indexBlock, func(_, value []byte) error {
+
+			h, _, err := sstBlockHandleDecode(value)
+			if err != nil {
+				return err
+			}
+
+			data, err := r.readBlock(h)
+			if err != nil {
+				return err
+			}
+
+			return sstBlockEntries(data, func(ikey, value []byte) error {
+
+				if len(ikey) < 8 {
+					return errors.New("sst invalid internal key")
+				}
+
+				var (
+					key = ikey[:len(ikey)-8]
+					typ = ikey[len(ikey)-8]
+				)
+
+				// the newer versions of the key come first
+				if lastKey != nil && bytes.Equal(key, lastKey) {
+					return nil
+				}
+				lastKey = append(lastKey[:0], key...)
+
+				if typ != sstKeyTypeValue {
+					return nil
+				}
+
+				rs := bl.Commit(kv2.NewObjectWriter(bytesClone(key), bytesClone(value)).
+					TableNameSet(tableName))
+				if !rs.OK() {
+					return rs.Error()
+				}
+				num += 1
+
+				return nil
+			})
+		})
+	})
+
+	return num, err
+}
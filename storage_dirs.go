@@ -0,0 +1,255 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"os"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+// dirStorage is a storage of the engine that spreads the files over several
+// directories:
+//
+//   - the journal (write-ahead log) files are kept in the wal directory if
+//     setup, so the sequential log writes don't compete with the compaction
+//     reads of the data directory.
+//   - the table files are spread by their file number over the data directory
+//     and the extra data directories, so the combined capacity and bandwidth
+//     of all disks are used.
+//   - the other files (manifest, lock, log) are kept in the data directory.
+//   - the cold table files are moved to the object storage if the tiering is
+//     setup, see ConfigTiering.
+//   - the table files are read by the ReadMode of ConfigStorage.
+//
+// The files are still found in the other directories if the settings have
+// changed, so the switch needs no migration.
+type dirStorage struct {
+	storage.Storage
+	wal    storage.Storage
+	tables []storage.Storage
+	all    []storage.Storage
+	dirs   map[storage.Storage]string
+	tier   *tierTable
+	pacer  *compactionPacer
+	mode   string
+}
+
+func newDirStorage(dir, walDir string, extraDirs []string, tiering *ConfigTiering) (*dirStorage, error) {
+
+	stor, err := storage.OpenFile(dir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &dirStorage{
+		Storage: stor,
+		tables:  []storage.Storage{stor},
+		all:     []storage.Storage{stor},
+		dirs:    map[storage.Storage]string{stor: dir},
+	}
+
+	open := func(dir string) (storage.Storage, error) {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, err
+		}
+		s, err := storage.OpenFile(dir, false)
+		if err == nil {
+			it.all = append(it.all, s)
+			it.dirs[s] = dir
+		}
+		return s, err
+	}
+
+	if walDir != "" {
+		if it.wal, err = open(walDir); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+
+	for _, v := range extraDirs {
+		s, err := open(v)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.tables = append(it.tables, s)
+	}
+
+	if tiering.enabled() {
+		if it.tier, err = newTierTable(tiering, dir); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+
+	return it, nil
+}
+
+// route returns the storages that may keep the file, the first one is where
+// the file is created, and the data directory is always included.
+func (it *dirStorage) route(fd storage.FileDesc) []storage.Storage {
+
+	switch fd.Type {
+
+	case storage.TypeJournal:
+		if it.wal != nil {
+			return []storage.Storage{it.wal, it.Storage}
+		}
+
+	case storage.TypeTable:
+		if n := len(it.tables); n > 1 {
+			ls := []storage.Storage{}
+			for i, off := 0, int(fd.Num%int64(n)); i < n; i++ {
+				ls = append(ls, it.tables[(off+i)%n])
+			}
+			return ls
+		}
+	}
+
+	return []storage.Storage{it.Storage}
+}
+
+type dirStorageLocker struct {
+	locks []storage.Locker
+}
+
+func (it *dirStorageLocker) Unlock() {
+	for _, v := range it.locks {
+		v.Unlock()
+	}
+}
+
+func (it *dirStorage) Lock() (storage.Locker, error) {
+	locker := &dirStorageLocker{}
+	for _, s := range it.all {
+		lock, err := s.Lock()
+		if err != nil {
+			locker.Unlock()
+			return nil, err
+		}
+		locker.locks = append(locker.locks, lock)
+	}
+	return locker, nil
+}
+
+func (it *dirStorage) List(ft storage.FileType) ([]storage.FileDesc, error) {
+
+	ls, err := it.Storage.List(ft)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range it.all[1:] {
+		ft2 := ft & (storage.TypeJournal | storage.TypeTable)
+		if ft2 == 0 {
+			break
+		}
+		ls2, err := s.List(ft2)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, ls2...)
+	}
+
+	if it.tier != nil && ft&storage.TypeTable != 0 {
+		local := map[int64]bool{}
+		for _, fd := range ls {
+			if fd.Type == storage.TypeTable {
+				local[fd.Num] = true
+			}
+		}
+		for _, fd := range it.tier.list() {
+			if !local[fd.Num] {
+				ls = append(ls, fd)
+			}
+		}
+	}
+
+	return ls, nil
+}
+
+func (it *dirStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	var (
+		r   storage.Reader
+		err error
+	)
+	for _, s := range it.route(fd) {
+		if r, err = s.Open(fd); err == nil || !os.IsNotExist(err) {
+			if err == nil && fd.Type == storage.TypeTable {
+				if r2 := tableReaderOpen(it.mode, it.dirs[s], fd); r2 != nil {
+					r.Close()
+					r = r2
+				}
+				if it.tier != nil {
+					r = &tierReader{Reader: r, access: it.tier.touch(fd.Num)}
+				}
+			}
+			return r, err
+		}
+	}
+	if it.tier != nil && fd.Type == storage.TypeTable && it.tier.has(fd.Num) {
+		return it.tier.open(fd.Num)
+	}
+	return nil, err
+}
+
+func (it *dirStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	if fd.Type == storage.TypeTable {
+		if err := failpointInject(FailpointCompactionSlow); err != nil {
+			return nil, err
+		}
+	}
+	w, err := it.route(fd)[0].Create(fd)
+	if err == nil && it.pacer != nil && fd.Type == storage.TypeTable {
+		w = &compactionPacerWriter{Writer: w, pacer: it.pacer}
+	}
+	return w, err
+}
+
+func (it *dirStorage) Remove(fd storage.FileDesc) error {
+	if it.tier != nil && fd.Type == storage.TypeTable {
+		if ok, err := it.tier.remove(fd.Num); ok {
+			return err
+		}
+	}
+	var err error
+	for _, s := range it.route(fd) {
+		if err = s.Remove(fd); err == nil || !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (it *dirStorage) Rename(oldfd, newfd storage.FileDesc) error {
+	s := it.route(oldfd)[0]
+	if s != it.route(newfd)[0] {
+		return errors.New("rename across the data directories")
+	}
+	return s.Rename(oldfd, newfd)
+}
+
+func (it *dirStorage) Close() error {
+	var err error
+	for _, s := range it.all {
+		if err2 := s.Close(); err2 != nil {
+			err = err2
+		}
+	}
+	return err
+}
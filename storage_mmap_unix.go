@@ -0,0 +1,56 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package kvgo
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+func mmapReaderOpen(path string) (storage.Reader, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < 1 || int64(int(st.Size())) != st.Size() {
+		return nil, errors.New("invalid file size to mmap")
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(st.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tableReader{
+		ReaderAt: mmapData(data),
+		size:     st.Size(),
+		close: func() error {
+			return syscall.Munmap(data)
+		},
+	}, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+const (
+	// the table files are read by pread through the page cache
+	StorageReadPread = "pread"
+
+	// the table files are read with O_DIRECT bypassing the page cache, so
+	// the blocks are not cached twice (by the block cache and the page
+	// cache), it needs the block cache sized to the working set
+	StorageReadDirect = "direct"
+
+	// the table files are mapped into memory, the point reads avoid the
+	// syscalls and copies of pread, but the page faults of a dataset much
+	// larger than the memory raise the tail latency
+	StorageReadMmap = "mmap"
+
+	directIOAlign = 4096
+)
+
+var (
+	errStorageReadNotSupported = errors.New("read mode not supported on this platform")
+	storageReadWarnOnce        sync.Once
+)
+
+// storageTableFile returns the path of the table file in the directory, the
+// same name as the goleveldb file storage.
+func storageTableFile(dir string, fd storage.FileDesc) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.ldb", fd.Num))
+}
+
+// tableReaderOpen opens the table file of the read mode, the nil reader is
+// returned if the default reader of the storage should be used.
+func tableReaderOpen(mode, dir string, fd storage.FileDesc) storage.Reader {
+
+	var (
+		r   storage.Reader
+		err error
+	)
+
+	switch mode {
+	case StorageReadDirect:
+		r, err = directReaderOpen(storageTableFile(dir, fd))
+	case StorageReadMmap:
+		r, err = mmapReaderOpen(storageTableFile(dir, fd))
+	default:
+		return nil
+	}
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			storageReadWarnOnce.Do(func() {
+				hlog.Printf("warn", "kvgo storage read mode %s err %s, fallback to %s",
+					mode, err.Error(), StorageReadPread)
+			})
+		}
+		return nil
+	}
+
+	return r
+}
+
+var directIOBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0)
+	},
+}
+
+// directIOBuf returns the buffer of size bytes aligned to directIOAlign.
+func directIOBuf(size int) ([]byte, []byte) {
+	raw := directIOBufPool.Get().([]byte)
+	if cap(raw) < size+directIOAlign {
+		raw = make([]byte, size+directIOAlign)
+	}
+	raw = raw[:cap(raw)]
+	off := 0
+	if m := int(uintptr(unsafe.Pointer(&raw[0])) & (directIOAlign - 1)); m > 0 {
+		off = directIOAlign - m
+	}
+	return raw, raw[off : off+size]
+}
+
+// tableReader implements the storage.Reader of the table file by ReadAt.
+type tableReader struct {
+	io.ReaderAt
+	mu    sync.Mutex
+	size  int64
+	pos   int64
+	close func() error
+}
+
+func (it *tableReader) Read(p []byte) (int, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.pos >= it.size {
+		return 0, io.EOF
+	}
+	n, err := it.ReadAt(p, it.pos)
+	it.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (it *tableReader) Seek(offset int64, whence int) (int64, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += it.pos
+	case io.SeekEnd:
+		offset += it.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	it.pos = offset
+	return offset, nil
+}
+
+func (it *tableReader) Close() error {
+	return it.close()
+}
+
+// directReader reads the file opened with O_DIRECT, the reads are aligned
+// to directIOAlign by a bounce buffer.
+type directReader struct {
+	f    *os.File
+	size int64
+}
+
+func (it *directReader) ReadAt(p []byte, off int64) (int, error) {
+
+	if off >= it.size {
+		return 0, io.EOF
+	}
+
+	var (
+		start = off &^ (directIOAlign - 1)
+		end   = (off + int64(len(p)) + directIOAlign - 1) &^ (directIOAlign - 1)
+	)
+
+	raw, buf := directIOBuf(int(end - start))
+	defer directIOBufPool.Put(raw)
+
+	n, err := it.f.ReadAt(buf, start)
+	if err == io.EOF {
+		err = nil
+	}
+
+	n -= int(off - start)
+	if n < 0 {
+		n = 0
+	} else if n > len(p) {
+		n = len(p)
+	}
+	copy(p, buf[off-start:int(off-start)+n])
+
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// mmapData reads the table file mapped into memory.
+type mmapData []byte
+
+func (it mmapData) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(it)) {
+		return 0, io.EOF
+	}
+	n := copy(p, it[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package kvgo
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+func directReaderOpen(path string) (storage.Reader, error) {
+
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r := &directReader{
+		f:    f,
+		size: st.Size(),
+	}
+
+	// the filesystems without the O_DIRECT support (e.g. tmpfs) fail on the
+	// first read
+	if _, err := r.ReadAt(make([]byte, 1), 0); err != nil && st.Size() > 0 {
+		f.Close()
+		return nil, err
+	}
+
+	return &tableReader{
+		ReaderAt: r,
+		size:     st.Size(),
+		close:    f.Close,
+	}, nil
+}
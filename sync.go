@@ -0,0 +1,175 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	SyncWritesNone     = "none"
+	SyncWritesInterval = "interval"
+	SyncWritesAlways   = "always"
+)
+
+var (
+	keySysSyncTime = append([]byte{nsKeySys}, []byte("sync:time")...)
+	syncWriteOpts  = &opt.WriteOptions{Sync: true}
+)
+
+// writeOptions returns the write options of the fsync policy, every local
+// write of the tables must use it.
+func (cn *Conn) writeOptions() *opt.WriteOptions {
+	atomic.StoreInt32(&cn.syncDirty, 1)
+	if cn.opts.Performance.SyncWrites == SyncWritesAlways {
+		return syncWriteOpts
+	}
+	return nil
+}
+
+// dbWrite writes the batch to the table with the fsync policy.
+func (cn *Conn) dbWrite(tdb *dbTable, batch *leveldb.Batch) error {
+	if err := failpointInject(FailpointSyncWrite); err != nil {
+		return err
+	}
+	return tdb.db.Write(batch, cn.writeOptions())
+}
+
+// dbWriteNoSync writes the batch to the table without fsync, the batch is
+// synced by the next sync of the tables.
+func (cn *Conn) dbWriteNoSync(tdb *dbTable, batch *leveldb.Batch) error {
+	if err := failpointInject(FailpointSyncWrite); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&cn.syncDirty, 1)
+	return tdb.db.Write(batch, nil)
+}
+
+// syncTables flushes the journals of all tables to disk. The engine has no
+// explicit fsync, so a small synced write is made to each table, which also
+// syncs all writes before it.
+func (cn *Conn) syncTables() error {
+	if atomic.SwapInt32(&cn.syncDirty, 0) == 0 {
+		return nil
+	}
+	if err := failpointInject(FailpointSyncWrite); err != nil {
+		atomic.StoreInt32(&cn.syncDirty, 1)
+		return err
+	}
+	cn.mu.RLock()
+	tables := []*dbTable{}
+	for _, tdb := range cn.tables {
+		tables = append(tables, tdb)
+	}
+	cn.mu.RUnlock()
+
+	tn := uint64ToBytes(uint64(time.Now().UnixNano() / 1e6))
+	for _, tdb := range tables {
+		if err := tdb.db.Put(keySysSyncTime, tn, syncWriteOpts); err != nil {
+			atomic.StoreInt32(&cn.syncDirty, 1)
+			return err
+		}
+	}
+	return nil
+}
+
+func (cn *Conn) workerSync() {
+
+	interval := time.Duration(cn.opts.Performance.SyncInterval) * time.Millisecond
+
+	for !cn.close {
+
+		time.Sleep(interval)
+
+		if err := cn.syncTables(); err != nil {
+			hlog.Printf("warn", "kvgo sync tables err %s", err.Error())
+		}
+	}
+}
+
+// BatchLoader is the client connector of a BatchLoad, the local writes
+// committed through it are not fsynced regardless of the SyncWrites and
+// replication policies. The reads and the batch commits are passed to the
+// Conn as is.
+type BatchLoader struct {
+	cn *Conn
+}
+
+func (it *BatchLoader) Query(rr *kv2.ObjectReader) *kv2.ObjectResult {
+	return it.cn.Query(rr)
+}
+
+func (it *BatchLoader) Commit(rr *kv2.ObjectWriter) *kv2.ObjectResult {
+	if it.cn.opts.ClientConnectEnable || len(it.cn.opts.Cluster.MainNodes) > 0 {
+		return it.cn.Commit(rr)
+	}
+	if keyInternalWrite(rr) {
+		return kv2.NewObjectResultClientError(errKeyInternal)
+	}
+	return it.cn.usageWrite(rr, it.cn.commitLocalWrite(rr, 0, false, true))
+}
+
+func (it *BatchLoader) BatchCommit(rr *kv2.BatchRequest) *kv2.BatchResult {
+	return it.cn.BatchCommit(rr)
+}
+
+func (it *BatchLoader) SysCmd(rr *kv2.SysCmdRequest) *kv2.ObjectResult {
+	return it.cn.SysCmd(rr)
+}
+
+// Close is a no-op, the Conn is owned by the caller of BatchLoad.
+func (it *BatchLoader) Close() error {
+	return nil
+}
+
+func (it *BatchLoader) NewClient() (kv2.Client, error) {
+	return kv2.NewClient(it)
+}
+
+func (it *BatchLoader) NewWriter(key []byte, value interface{}, opts ...interface{}) *kv2.ClientWriter {
+	return kv2.NewClientWriter(it, key, value, opts...)
+}
+
+// BatchLoad runs fn with a loader whose writes are not fsynced, and syncs
+// all tables once when fn returns, which is much faster for bulk imports
+// under the always or interval policy. Only the writes committed through
+// the loader skip the fsync, the other writes keep the SyncWrites policy.
+//
+// A crash during fn may lose any of the writes of the loader. In cluster
+// mode the writes are committed through the quorum with the policies of the
+// nodes.
+func (cn *Conn) BatchLoad(fn func(bl *BatchLoader) error) error {
+
+	err := fn(&BatchLoader{cn: cn})
+
+	if cn.opts.ClientConnectEnable || len(cn.opts.Cluster.MainNodes) > 0 {
+		return err
+	}
+
+	if cn.opts.Performance.SyncWrites != SyncWritesNone {
+		if err2 := cn.syncTables(); err == nil {
+			err = err2
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/hooto/hlog4g/hlog"
+)
+
+type sysResources struct {
+	cpus     int
+	memory   int64 // in bytes, 0 if unknown
+	openFile int64 // the soft limit of open files, 0 if unknown
+}
+
+func sysFileInt64(path string) (int64, bool) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(bs)), 10, 64)
+	return v, err == nil
+}
+
+// sysResourcesDetect returns the resources available to the process, the
+// limits of the cgroup (v2 or v1) are applied if the process runs in a
+// container.
+func sysResourcesDetect() *sysResources {
+
+	res := &sysResources{
+		cpus: runtime.NumCPU(),
+	}
+
+	// cpu quota
+	if bs, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		if ar := strings.Fields(string(bs)); len(ar) == 2 && ar[0] != "max" {
+			quota, _ := strconv.ParseInt(ar[0], 10, 64)
+			period, _ := strconv.ParseInt(ar[1], 10, 64)
+			if quota > 0 && period > 0 {
+				res.cpuLimit(quota, period)
+			}
+		}
+	} else if quota, ok := sysFileInt64("/sys/fs/cgroup/cpu/cpu.cfs_quota_us"); ok && quota > 0 {
+		if period, ok := sysFileInt64("/sys/fs/cgroup/cpu/cpu.cfs_period_us"); ok && period > 0 {
+			res.cpuLimit(quota, period)
+		}
+	}
+
+	// physical memory
+	if fp, err := os.Open("/proc/meminfo"); err == nil {
+		scan := bufio.NewScanner(fp)
+		for scan.Scan() {
+			if ar := strings.Fields(scan.Text()); len(ar) >= 2 && ar[0] == "MemTotal:" {
+				if v, err := strconv.ParseInt(ar[1], 10, 64); err == nil {
+					res.memory = v * 1024
+				}
+				break
+			}
+		}
+		fp.Close()
+	}
+
+	// memory limit, v1 reports a huge number if unlimited
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+	} {
+		if v, ok := sysFileInt64(path); ok && v > 0 && (res.memory == 0 || v < res.memory) {
+			res.memory = v
+			break
+		}
+	}
+
+	// open files
+	if fp, err := os.Open("/proc/self/limits"); err == nil {
+		scan := bufio.NewScanner(fp)
+		for scan.Scan() {
+			if line := scan.Text(); strings.HasPrefix(line, "Max open files") {
+				if ar := strings.Fields(line[len("Max open files"):]); len(ar) > 0 {
+					res.openFile, _ = strconv.ParseInt(ar[0], 10, 64)
+				}
+				break
+			}
+		}
+		fp.Close()
+	}
+
+	return res
+}
+
+func (it *sysResources) cpuLimit(quota, period int64) {
+	n := int((quota + period - 1) / period)
+	if n > 0 && n < it.cpus {
+		it.cpus = n
+	}
+}
+
+// autoTune sets the sizes that are not setup from the resources available
+// to the process, the explicit settings are kept.
+func (it *ConfigPerformance) autoTune() {
+
+	var (
+		res = sysResourcesDetect()
+		mem = int(res.memory / (1 << 20))
+	)
+
+	if mem > 0 {
+
+		if it.BlockCacheSize == 0 {
+			it.BlockCacheSize = mem / 8
+		}
+
+		if it.WriteBufferSize == 0 {
+			it.WriteBufferSize = mem / 64
+		}
+
+		if it.MaxTableSize == 0 && mem >= 8192 {
+			it.MaxTableSize = 32
+		}
+	}
+
+	if it.WriteBufferSize == 0 && res.cpus <= 2 {
+		it.WriteBufferSize = 4
+	}
+
+	if it.MaxOpenFiles == 0 && res.openFile > 0 {
+		it.MaxOpenFiles = int(res.openFile / 2)
+	}
+
+	if it.CompactionWorkers == 0 && res.cpus >= 8 {
+		it.CompactionWorkers = res.cpus / 4
+	}
+
+	hlog.Printf("info", "kvgo auto-tuning, cpu %d, memory %d MiB, open files %d",
+		res.cpus, mem, res.openFile)
+}
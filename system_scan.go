@@ -0,0 +1,201 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	systemScanLimitDef  = 100
+	systemScanLimitMax  = 1000
+	systemScanSizeLimit = 4 * int(kv2.MiB)
+)
+
+// The key spaces of the internal metadata of a table, the entries of these
+// spaces are never returned by the range queries, and are read by
+// SystemScan only.
+var systemScanSpaces = map[string]byte{
+	"sys":      nsKeySys,
+	"meta":     nsKeyMeta,
+	"log":      nsKeyLog,
+	"ttl":      nsKeyTtl,
+	"merge":    nsKeyMerge,
+	"history":  nsKeyHistory,
+	"internal": nsKeyData,
+}
+
+// SystemEntry is a raw entry of the internal key spaces, the key is the key
+// in the space, without the prefix of the space.
+type SystemEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type systemScanRequest struct {
+	Table  string `json:"table"`
+	Space  string `json:"space"`
+	Offset []byte `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type systemScanResult struct {
+	Items []*SystemEntry `json:"items,omitempty"`
+	Next  bool           `json:"next,omitempty"`
+}
+
+func systemScanPrefix(space string) ([]byte, error) {
+	ns, ok := systemScanSpaces[space]
+	if !ok {
+		return nil, errors.New("invalid system space")
+	}
+	if space == "internal" {
+		return keyEncode(ns, []byte(keyInternalPrefix)), nil
+	}
+	return []byte{ns}, nil
+}
+
+// SystemScan returns the raw entries of the internal key space (sys, meta,
+// log, ttl, merge, history or internal) of the table after the offset, the
+// second result is true if there are more entries. It is an admin call for
+// debugging and requires the sys/all permission in client mode, the
+// entries are read from the local node or the connected node only.
+func (cn *Conn) SystemScan(tableName, space string, offset []byte, limit int) ([]*SystemEntry, bool, error) {
+
+	req := &systemScanRequest{
+		Table:  tableName,
+		Space:  space,
+		Offset: offset,
+		Limit:  limit,
+	}
+
+	if cn.opts.ClientConnectEnable {
+
+		bs, err := json.Marshal(req)
+		if err != nil {
+			return nil, false, err
+		}
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: "SystemScan",
+			Body:   bs,
+		})
+		if !rs.OK() {
+			return nil, false, rs.Error()
+		}
+
+		var ret systemScanResult
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &ret); err != nil {
+				return nil, false, err
+			}
+		}
+
+		return ret.Items, ret.Next, nil
+	}
+
+	ret, err := cn.systemScanLocal(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return ret.Items, ret.Next, nil
+}
+
+func (cn *Conn) systemScanLocal(req *systemScanRequest) (*systemScanResult, error) {
+
+	if req.Table == "" {
+		req.Table = "main"
+	}
+
+	tdb := cn.tabledb(req.Table)
+	if tdb == nil {
+		return nil, errors.New("table not found")
+	}
+
+	prefix, err := systemScanPrefix(req.Space)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Limit < 1 {
+		req.Limit = systemScanLimitDef
+	} else if req.Limit > systemScanLimitMax {
+		req.Limit = systemScanLimitMax
+	}
+
+	var (
+		ret  = &systemScanResult{}
+		size = 0
+		iter = tdb.db.NewIterator(util.BytesPrefix(prefix), nil)
+	)
+	defer iter.Release()
+
+	ok := iter.Seek(append(bytesClone(prefix), req.Offset...))
+	if ok && len(req.Offset) > 0 && string(iter.Key()[len(prefix):]) == string(req.Offset) {
+		ok = iter.Next()
+	}
+
+	for ; ok; ok = iter.Next() {
+
+		if len(ret.Items) >= req.Limit || size >= systemScanSizeLimit {
+			ret.Next = true
+			break
+		}
+
+		ret.Items = append(ret.Items, &SystemEntry{
+			Key:   bytesClone(iter.Key()[len(prefix):]),
+			Value: bytesClone(iter.Value()),
+		})
+		size += len(iter.Key()) + len(iter.Value())
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (cn *Conn) systemScanCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req systemScanRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	ret, err := cn.systemScanLocal(&req)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
@@ -0,0 +1,163 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// the first file descriptor passed by the socket activation
+	systemdListenFdsStart = 3
+
+	// the names (FileDescriptorName= of the socket units) of the listeners
+	// of Server.Bind, Server.HttpBind and Server.DebugBind
+	SystemdListenerServer = "server"
+	SystemdListenerHttp   = "http"
+	SystemdListenerDebug  = "debug"
+)
+
+var (
+	systemdMu        sync.Mutex
+	systemdInited    bool
+	systemdListeners []*systemdListener
+)
+
+type systemdListener struct {
+	name string
+	lis  net.Listener
+}
+
+// systemdListenersInit takes the listeners passed by the systemd socket
+// activation (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES), the environment
+// variables are unset so they are not inherited by the child processes.
+func systemdListenersInit() {
+
+	if systemdInited {
+		return
+	}
+	systemdInited = true
+
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+
+	num, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || num < 1 {
+		return
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < num; i++ {
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(systemdListenFdsStart+i), name)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+
+		systemdListeners = append(systemdListeners, &systemdListener{
+			name: name,
+			lis:  lis,
+		})
+	}
+}
+
+// systemdListen returns the listener passed by the socket activation of the
+// name, or else the listener of the same port as the addr, or nil if not
+// found.
+func systemdListen(name, addr string) net.Listener {
+
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+
+	systemdListenersInit()
+
+	_, port, _ := net.SplitHostPort(addr)
+
+	for _, match := range []func(v *systemdListener) bool{
+		func(v *systemdListener) bool {
+			return v.name == name
+		},
+		func(v *systemdListener) bool {
+			_, port2, err := net.SplitHostPort(v.lis.Addr().String())
+			return err == nil && port != "" && port2 == port
+		},
+	} {
+		for i, v := range systemdListeners {
+			if match(v) {
+				systemdListeners = append(systemdListeners[:i], systemdListeners[i+1:]...)
+				return v.lis
+			}
+		}
+	}
+
+	return nil
+}
+
+// listen returns the listener passed by the socket activation if found,
+// or else listens on the addr.
+func listen(name, addr string) (net.Listener, error) {
+	if lis := systemdListen(name, addr); lis != nil {
+		return lis, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// SystemdNotify sends the state (e.g. "READY=1", "STOPPING=1") to the
+// service manager by the socket of NOTIFY_SOCKET, it is a no-op if the
+// process is not run by systemd with Type=notify. The kvgo sends READY=1
+// after Open and STOPPING=1 in Close itself.
+func SystemdNotify(state string) error {
+
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(sock, "/") && !strings.HasPrefix(sock, "@") {
+		return errors.New("invalid NOTIFY_SOCKET")
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: sock,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/opt"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// TableLevelStats is the state of a level of the SST tables of a table,
+// Read and Write are the bytes read and written by the compactions of the
+// level since the table was opened.
+type TableLevelStats struct {
+	Level    int   `json:"level"`
+	Tables   int   `json:"tables"`
+	Size     int64 `json:"size"`
+	Read     int64 `json:"read"`
+	Write    int64 `json:"write"`
+	Duration int64 `json:"duration"` // in milliseconds
+}
+
+// TableStats is the SST level statistics of a table.
+type TableStats struct {
+	Name   string             `json:"name"`
+	Size   int64              `json:"size"`
+	Levels []*TableLevelStats `json:"levels"`
+
+	// WriteAmp is the bytes written by the flushes and the compactions of
+	// all levels divided by the bytes flushed into the level 0, and ReadAmp
+	// is the number of the tables a point read may check in the worst case
+	// (all tables of the level 0 and one table of each other level), both
+	// are estimates.
+	WriteAmp float64 `json:"write_amp"`
+	ReadAmp  int     `json:"read_amp"`
+
+	// PendingCompaction is the estimated bytes to be compacted to bring
+	// every level under its size target, it increases when the compactions
+	// fall behind the writes.
+	PendingCompaction int64 `json:"pending_compaction"`
+
+	Compactions struct {
+		Mem       uint32 `json:"mem"`
+		Level0    uint32 `json:"level0"`
+		NonLevel0 uint32 `json:"non_level0"`
+		Seek      uint32 `json:"seek"`
+	} `json:"compactions"`
+
+	WriteDelayCount    int32 `json:"write_delay_count"`
+	WriteDelayDuration int64 `json:"write_delay_duration"` // in milliseconds
+	WritePaused        bool  `json:"write_paused"`
+}
+
+type tableStatsRequest struct {
+	Table string `json:"table,omitempty"`
+}
+
+func tableStatsBuild(name string, st *leveldb.DBStats) *TableStats {
+
+	var (
+		ret = &TableStats{
+			Name:   name,
+			Size:   st.LevelSizes.Sum(),
+			Levels: []*TableLevelStats{},
+		}
+		// the tables use the default size targets of the levels
+		defOpts *opt.Options
+		written int64
+	)
+
+	for i, n := range st.LevelTablesCounts {
+
+		v := &TableLevelStats{
+			Level:  i,
+			Tables: n,
+		}
+		if i < len(st.LevelSizes) {
+			v.Size = st.LevelSizes[i]
+		}
+		if i < len(st.LevelRead) {
+			v.Read = st.LevelRead[i]
+		}
+		if i < len(st.LevelWrite) {
+			v.Write = st.LevelWrite[i]
+			written += v.Write
+		}
+		if i < len(st.LevelDurations) {
+			v.Duration = int64(st.LevelDurations[i] / 1e6)
+		}
+		ret.Levels = append(ret.Levels, v)
+
+		if i == 0 {
+			ret.ReadAmp += n
+			if n >= defOpts.GetCompactionL0Trigger() {
+				ret.PendingCompaction += v.Size
+			}
+		} else if n > 0 {
+			ret.ReadAmp += 1
+			if target := defOpts.GetCompactionTotalSize(i); v.Size > target {
+				ret.PendingCompaction += v.Size - target
+			}
+		}
+	}
+
+	if len(ret.Levels) > 0 && ret.Levels[0].Write > 0 {
+		ret.WriteAmp = float64(written) / float64(ret.Levels[0].Write)
+	}
+
+	ret.Compactions.Mem = st.MemComp
+	ret.Compactions.Level0 = st.Level0Comp
+	ret.Compactions.NonLevel0 = st.NonLevel0Comp
+	ret.Compactions.Seek = st.SeekComp
+
+	ret.WriteDelayCount = st.WriteDelayCount
+	ret.WriteDelayDuration = int64(st.WriteDelayDuration / 1e6)
+	ret.WritePaused = st.WritePaused
+
+	return ret
+}
+
+// TableStats returns the SST level statistics of the tables of the node,
+// of all tables if tableName is empty. In client mode the statistics are
+// of the connected node.
+func (cn *Conn) TableStats(tableName string) ([]*TableStats, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		bs, err := json.Marshal(&tableStatsRequest{
+			Table: tableName,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: "TableStats",
+			Body:   bs,
+		})
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+
+		var ls []*TableStats
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &ls); err != nil {
+				return nil, err
+			}
+		}
+
+		return ls, nil
+	}
+
+	return cn.tableStatsLocal(tableName)
+}
+
+func (cn *Conn) tableStatsLocal(tableName string) ([]*TableStats, error) {
+
+	ls := []*TableStats{}
+
+	cn.mu.RLock()
+	defer cn.mu.RUnlock()
+
+	for name, tdb := range cn.tables {
+		if tdb.db == nil || (tableName != "" && name != tableName) {
+			continue
+		}
+		var st leveldb.DBStats
+		if err := tdb.db.Stats(&st); err != nil {
+			return nil, err
+		}
+		ls = append(ls, tableStatsBuild(name, &st))
+	}
+
+	if tableName != "" && len(ls) == 0 {
+		return nil, errors.New("table not found")
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Name < ls[j].Name
+	})
+
+	return ls, nil
+}
+
+func (cn *Conn) tableStatsCmdLocal(av appValidator, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req tableStatsRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	ls, err := cn.tableStatsLocal(req.Table)
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(ls)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
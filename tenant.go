@@ -0,0 +1,493 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	tenantRefreshSleep = 10e9
+)
+
+// ErrTenantQuota is returned by the writes into the table of a tenant out
+// of its quota.
+var ErrTenantQuota = errors.New("tenant quota exceeded")
+
+// errTenantCluster is returned by the tenant commands of a cluster node.
+var errTenantCluster = errors.New("tenants not supported in cluster mode, " +
+	"the shared service must run on a single node")
+
+// Tenant is a user of the shared service, it owns the table of the same
+// name as its keyspace and an access key limited to the table.
+//
+// The tenants are only supported by the single node servers and the
+// embedded stores, the tenant commands of the cluster nodes fail with
+// errTenantCluster. The table of a tenant would be set up only on the node
+// running TableSet, the others open it on their restarts, and a table can
+// not be dropped on the other nodes, so neither the keyspace nor the quota
+// of a tenant could be enforced on all the nodes.
+type Tenant struct {
+	Name      string       `json:"name"`
+	Table     string       `json:"table"`
+	AccessKey string       `json:"access_key"`
+	Quota     *TenantQuota `json:"quota,omitempty"`
+	Created   int64        `json:"created"`
+}
+
+// TenantQuota limits the writes of a tenant, MaxBytes is the size of its
+// table on disk and MaxValueSize the size of a value, 0 is unlimited. The
+// size is refreshed every 10 seconds, so the writes in between may exceed
+// MaxBytes a little.
+type TenantQuota struct {
+	MaxBytes     int64 `json:"max_bytes,omitempty"`
+	MaxValueSize int64 `json:"max_value_size,omitempty"`
+}
+
+// TenantStatus is the tenant with the usage and the statistics of its
+// table on the node.
+type TenantStatus struct {
+	*Tenant
+	Bytes int64       `json:"bytes"`
+	Stats *TableStats `json:"stats,omitempty"`
+}
+
+type tenantRequest struct {
+	Name  string       `json:"name,omitempty"`
+	Quota *TenantQuota `json:"quota,omitempty"`
+}
+
+type tenantCreateResponse struct {
+	Tenant    *Tenant          `json:"tenant"`
+	AccessKey *hauth.AccessKey `json:"access_key"`
+}
+
+type tenantUsage struct {
+	tenant *Tenant
+	bytes  int64
+}
+
+type tenantSet struct {
+	mu     sync.RWMutex
+	tables map[string]*tenantUsage
+}
+
+func keySysTenant(name string) []byte {
+	return append([]byte{nsKeySys}, []byte("tenant:"+name)...)
+}
+
+func (cn *Conn) tenantGet(name string) (*Tenant, error) {
+
+	bs, err := cn.dbSys.Get(keySysTenant(name), nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil, errors.New("tenant not found")
+		}
+		return nil, err
+	}
+
+	var t Tenant
+	if err := json.Unmarshal(bs, &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (cn *Conn) tenantList() ([]*Tenant, error) {
+
+	ls := []*Tenant{}
+
+	iter := cn.dbSys.NewIterator(util.BytesPrefix(keySysTenant("")), nil)
+	for iter.Next() {
+		var t Tenant
+		if err := json.Unmarshal(iter.Value(), &t); err == nil {
+			ls = append(ls, &t)
+		}
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Name < ls[j].Name
+	})
+
+	return ls, nil
+}
+
+// tenantRefresh reloads the tenants and the sizes of their tables, which
+// the quota checks of the writes use.
+func (cn *Conn) tenantRefresh() error {
+
+	ls, err := cn.tenantList()
+	if err != nil {
+		return err
+	}
+
+	tables := map[string]*tenantUsage{}
+
+	for _, t := range ls {
+		u := &tenantUsage{
+			tenant: t,
+		}
+		if tdb := cn.tabledb(t.Table); tdb != nil {
+			var st leveldb.DBStats
+			if err := tdb.db.Stats(&st); err == nil {
+				u.bytes = st.LevelSizes.Sum()
+			}
+		}
+		tables[t.Table] = u
+	}
+
+	cn.tenants.mu.Lock()
+	cn.tenants.tables = tables
+	cn.tenants.mu.Unlock()
+
+	return nil
+}
+
+// tenantQuotaCheck returns ErrTenantQuota if the write into the table of a
+// tenant is out of its quota, the deletes are always allowed.
+func (cn *Conn) tenantQuotaCheck(rr *kv2.ObjectWriter) error {
+
+	if kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeDelete) {
+		return nil
+	}
+
+	cn.tenants.mu.RLock()
+	u := cn.tenants.tables[rr.TableName]
+	cn.tenants.mu.RUnlock()
+
+	if u == nil || u.tenant.Quota == nil {
+		return nil
+	}
+
+	q := u.tenant.Quota
+
+	if q.MaxValueSize > 0 && rr.Data != nil && int64(len(rr.Data.Value)) > q.MaxValueSize {
+		return ErrTenantQuota
+	}
+
+	if q.MaxBytes > 0 && u.bytes >= q.MaxBytes {
+		return ErrTenantQuota
+	}
+
+	return nil
+}
+
+func (cn *Conn) workerTenant() {
+
+	for !cn.close {
+
+		if err := cn.tenantRefresh(); err != nil {
+			hlog.Printf("warn", "kvgo tenant refresh err %s", err.Error())
+		}
+
+		time.Sleep(tenantRefreshSleep)
+	}
+}
+
+// TenantCreate creates the tenant of the name, which provisions the table
+// of the same name, an access key of the client role limited to the table
+// and the quota. The secret of the returned key is only shown here. It is
+// not supported in cluster mode.
+func (cn *Conn) TenantCreate(name string, quota *TenantQuota) (*Tenant, *hauth.AccessKey, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		var ret tenantCreateResponse
+		if err := cn.tenantCmd("TenantCreate", &tenantRequest{
+			Name:  name,
+			Quota: quota,
+		}, &ret); err != nil {
+			return nil, nil, err
+		}
+
+		return ret.Tenant, ret.AccessKey, nil
+	}
+
+	return cn.tenantCreateLocal(name, quota)
+}
+
+// TenantDelete deletes the tenant with its access key, table and data. It
+// is not supported in cluster mode.
+func (cn *Conn) TenantDelete(name string) error {
+
+	if cn.opts.ClientConnectEnable {
+		return cn.tenantCmd("TenantDelete", &tenantRequest{
+			Name: name,
+		}, nil)
+	}
+
+	return cn.tenantDeleteLocal(name)
+}
+
+// TenantList returns the tenants with their usages on the node. It is not
+// supported in cluster mode.
+func (cn *Conn) TenantList() ([]*TenantStatus, error) {
+
+	if cn.opts.ClientConnectEnable {
+		var ls []*TenantStatus
+		if err := cn.tenantCmd("TenantList", &tenantRequest{}, &ls); err != nil {
+			return nil, err
+		}
+		return ls, nil
+	}
+
+	return cn.tenantListLocal()
+}
+
+func (cn *Conn) tenantCmd(method string, req *tenantRequest, ret interface{}) error {
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rs := cn.SysCmd(&kv2.SysCmdRequest{
+		Method: method,
+		Body:   bs,
+	})
+	if !rs.OK() {
+		return rs.Error()
+	}
+
+	if ret != nil && len(rs.Items) > 0 {
+		return wireDecode(rs.DataValue().Bytes(), ret)
+	}
+
+	return nil
+}
+
+func (cn *Conn) tenantCreateLocal(name string, quota *TenantQuota) (*Tenant, *hauth.AccessKey, error) {
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return nil, nil, errTenantCluster
+	}
+
+	if !kv2.TableNameReg.MatchString(name) || name == "main" {
+		return nil, nil, errors.New("invalid tenant name")
+	}
+
+	if quota != nil && (quota.MaxBytes < 0 || quota.MaxValueSize < 0) {
+		return nil, nil, errors.New("invalid tenant quota")
+	}
+
+	if _, err := cn.tenantGet(name); err == nil {
+		return nil, nil, errors.New("tenant already exists")
+	}
+
+	// the keyspace of a tenant is not shared with the existing tables
+	if cn.tabledb(name) != nil {
+		return nil, nil, errors.New("table already exists")
+	}
+
+	bs, err := kv2.StdProto.Encode(&kv2.TableSetRequest{
+		Name: name,
+		Desc: "tenant " + name,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rs := cn.sysCmdLocal(nil, &kv2.SysCmdRequest{
+		Method: "TableSet",
+		Body:   bs,
+	}); !rs.OK() {
+		return nil, nil, rs.Error()
+	}
+
+	key := hauth.NewAccessKey()
+	key.Roles = []string{"client"}
+	key.Scopes = []*hauth.ScopeFilter{
+		hauth.NewScopeFilter(AuthScopeTable, name),
+	}
+	key.Description = "tenant " + name
+
+	if !hauth.AccessKeyIdReg.MatchString(key.Id) {
+		return nil, nil, errors.New("invalid access key id")
+	}
+
+	if rs := cn.Commit(kv2.NewObjectWriter(nsSysAccessKey(key.Id), key).
+		TableNameSet(sysTableName)); !rs.OK() {
+		return nil, nil, rs.Error()
+	}
+	cn.keyMgr.KeySet(key)
+
+	t := &Tenant{
+		Name:      name,
+		Table:     name,
+		AccessKey: key.Id,
+		Quota:     quota,
+		Created:   time.Now().UnixNano() / 1e6,
+	}
+
+	if bs, err = json.Marshal(t); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cn.dbSys.Put(keySysTenant(name), bs, nil); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cn.tenantRefresh(); err != nil {
+		return nil, nil, err
+	}
+
+	hlog.Printf("info", "kvgo tenant %s created, access key %s", name, key.Id)
+
+	return t, key, nil
+}
+
+func (cn *Conn) tenantDeleteLocal(name string) error {
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return errTenantCluster
+	}
+
+	t, err := cn.tenantGet(name)
+	if err != nil {
+		return err
+	}
+
+	// the key manager has no removal, the key is disabled by a new secret
+	// without any role or scope
+	if key := cn.keyMgr.KeyGet(t.AccessKey); key != nil {
+		key.Secret = randHexString(40)
+		key.Roles = []string{}
+		key.Scopes = []*hauth.ScopeFilter{}
+		cn.keyMgr.KeySet(key)
+	}
+
+	for _, k := range [][]byte{
+		nsSysAccessKey(t.AccessKey),
+		nsSysTable(t.Table),
+		nsSysTableStatus(t.Table),
+	} {
+		if rs := cn.Commit(kv2.NewObjectWriter(k, nil).
+			TableNameSet(sysTableName).
+			ModeDeleteSet(true)); !rs.OK() {
+			return rs.Error()
+		}
+	}
+
+	if err := cn.dbTableDrop(t.Table); err != nil {
+		return err
+	}
+
+	if err := cn.dbSys.Delete(keySysTenant(name), nil); err != nil {
+		return err
+	}
+
+	hlog.Printf("info", "kvgo tenant %s deleted", name)
+
+	return cn.tenantRefresh()
+}
+
+func (cn *Conn) tenantListLocal() ([]*TenantStatus, error) {
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return nil, errTenantCluster
+	}
+
+	if err := cn.tenantRefresh(); err != nil {
+		return nil, err
+	}
+
+	cn.tenants.mu.RLock()
+	defer cn.tenants.mu.RUnlock()
+
+	ls := []*TenantStatus{}
+
+	for _, u := range cn.tenants.tables {
+		st := &TenantStatus{
+			Tenant: u.tenant,
+			Bytes:  u.bytes,
+		}
+		if ts, err := cn.tableStatsLocal(u.tenant.Table); err == nil && len(ts) == 1 {
+			st.Stats = ts[0]
+		}
+		ls = append(ls, st)
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Name < ls[j].Name
+	})
+
+	return ls, nil
+}
+
+func (cn *Conn) tenantCmdLocal(av appValidator, method string, body []byte) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	var req tenantRequest
+	if err := wireDecode(body, &req); err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	var ret interface{}
+
+	switch method {
+
+	case "TenantCreate":
+		t, key, err := cn.tenantCreateLocal(req.Name, req.Quota)
+		if err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		ret = &tenantCreateResponse{
+			Tenant:    t,
+			AccessKey: key,
+		}
+
+	case "TenantDelete":
+		if err := cn.tenantDeleteLocal(req.Name); err != nil {
+			return kv2.NewObjectResultClientError(err)
+		}
+		return kv2.NewObjectResultOK()
+
+	case "TenantList":
+		ls, err := cn.tenantListLocal()
+		if err != nil {
+			return kv2.NewObjectResultServerError(err)
+		}
+		ret = ls
+	}
+
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
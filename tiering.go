@@ -0,0 +1,458 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/storage"
+)
+
+const (
+	tierIndexName     = "kvgo-tier.json"
+	tierCacheDirName  = "tier-cache"
+	tierColdDaysDef   = 30
+	tierCacheSizeDef  = 1024 // in MiB
+	tierCheckInterval = 10 * time.Minute
+)
+
+// TierObjectStore is the object storage of the cold table files, the
+// built-in one is the S3 compatible storage of ConfigTiering, others are
+// plugged in by ConfigTiering.Store.
+type TierObjectStore interface {
+	Put(name string, r io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	Delete(name string) error
+}
+
+func (it *ConfigTiering) enabled() bool {
+	return it != nil && (it.Store != nil || it.Bucket != "")
+}
+
+func (it *ConfigTiering) objectStore() TierObjectStore {
+	if it.Store != nil {
+		return it.Store
+	}
+	return newTierS3(it)
+}
+
+// tierTable keeps the table files of a table moved to the object storage,
+// and the local cache of the files fetched back on access.
+//
+// The moved files are listed in the index file of the table directory, so
+// the checkpoints and the secondary instances fetch them from the object
+// storage too.
+type tierTable struct {
+	mu      sync.Mutex
+	cfg     *ConfigTiering
+	store   TierObjectStore
+	dir     string
+	name    string
+	cache   string
+	remote  map[int64]int64 // file number -> size
+	access  map[int64]*int64
+	started int64
+}
+
+func newTierTable(cfg *ConfigTiering, dir string) (*tierTable, error) {
+
+	it := &tierTable{
+		cfg:     cfg,
+		store:   cfg.objectStore(),
+		dir:     dir,
+		name:    filepath.Base(dir),
+		cache:   filepath.Join(cfg.CacheDirectory, filepath.Base(dir)),
+		access:  map[int64]*int64{},
+		started: time.Now().Unix(),
+	}
+
+	if err := os.MkdirAll(it.cache, 0750); err != nil {
+		return nil, err
+	}
+
+	remote, err := tierIndexGet(dir)
+	if err != nil {
+		return nil, err
+	}
+	it.remote = remote
+
+	return it, nil
+}
+
+func tierIndexGet(dir string) (map[int64]int64, error) {
+
+	remote := map[int64]int64{}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, tierIndexName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return remote, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &remote); err != nil {
+		return nil, fmt.Errorf("invalid tier index of %s: %s", dir, err.Error())
+	}
+
+	return remote, nil
+}
+
+// indexFlush writes the index atomically, must be called with the lock held.
+func (it *tierTable) indexFlush() error {
+
+	bs, err := json.Marshal(it.remote)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(it.dir, tierIndexName+".tmp")
+	if err := ioutil.WriteFile(tmp, bs, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(it.dir, tierIndexName))
+}
+
+func tierObjectName(cfg *ConfigTiering, tableDir string, num int64) string {
+	return path.Join(cfg.Prefix, tableDir, fmt.Sprintf("%06d.ldb", num))
+}
+
+func (it *tierTable) objectName(num int64) string {
+	return tierObjectName(it.cfg, it.name, num)
+}
+
+func (it *tierTable) has(num int64) bool {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	_, ok := it.remote[num]
+	return ok
+}
+
+func (it *tierTable) list() []storage.FileDesc {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	ls := []storage.FileDesc{}
+	for num := range it.remote {
+		ls = append(ls, storage.FileDesc{Type: storage.TypeTable, Num: num})
+	}
+	return ls
+}
+
+// touch returns the last access time of the file, the files not accessed
+// since the process started are taken as accessed at the start.
+func (it *tierTable) touch(num int64) *int64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	p, ok := it.access[num]
+	if !ok {
+		p = new(int64)
+		*p = it.started
+		it.access[num] = p
+	}
+	atomic.StoreInt64(p, time.Now().Unix())
+	return p
+}
+
+func (it *tierTable) accessed(num int64) int64 {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if p, ok := it.access[num]; ok {
+		return atomic.LoadInt64(p)
+	}
+	return it.started
+}
+
+// open returns the reader of the moved file from the cache, the file is
+// fetched into the cache if missing.
+func (it *tierTable) open(num int64) (storage.Reader, error) {
+
+	var (
+		access = it.touch(num)
+		file   = filepath.Join(it.cache, fmt.Sprintf("%06d.ldb", num))
+	)
+
+	fp, err := os.Open(file)
+	if err == nil {
+		// the cache is evicted by the modified time
+		tn := time.Now()
+		os.Chtimes(file, tn, tn)
+		return &tierReader{Reader: fp, access: access}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := tierFetch(it.store, it.objectName(num), file); err != nil {
+		return nil, err
+	}
+
+	it.cacheEvict(file)
+
+	if fp, err = os.Open(file); err != nil {
+		return nil, err
+	}
+
+	return &tierReader{Reader: fp, access: access}, nil
+}
+
+// tierFetch downloads the object into the file.
+func tierFetch(store TierObjectStore, name, file string) error {
+
+	r, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := file + ".tmp"
+
+	fpo, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fpo, r)
+	if err2 := fpo.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// cacheEvict removes the least recently accessed files from the cache until
+// it fits into the CacheSize, except the file keep. The removed files are
+// still readable by the readers which opened them.
+func (it *tierTable) cacheEvict(keep string) {
+
+	ls, err := ioutil.ReadDir(it.cache)
+	if err != nil {
+		return
+	}
+
+	var size int64
+	for _, v := range ls {
+		size += v.Size()
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].ModTime().Before(ls[j].ModTime())
+	})
+
+	for _, v := range ls {
+		if size <= int64(it.cfg.CacheSize)*(1<<20) {
+			break
+		}
+		if file := filepath.Join(it.cache, v.Name()); file != keep {
+			if os.Remove(file) == nil {
+				size -= v.Size()
+			}
+		}
+	}
+}
+
+// remove deletes the moved file, returns false if the file is not moved.
+func (it *tierTable) remove(num int64) (bool, error) {
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	delete(it.access, num)
+
+	if _, ok := it.remote[num]; !ok {
+		return false, nil
+	}
+
+	if err := it.store.Delete(it.objectName(num)); err != nil {
+		return true, err
+	}
+
+	os.Remove(filepath.Join(it.cache, fmt.Sprintf("%06d.ldb", num)))
+
+	delete(it.remote, num)
+
+	return true, it.indexFlush()
+}
+
+// tierReader records the access time of the table file on every read.
+type tierReader struct {
+	storage.Reader
+	access *int64
+}
+
+func (it *tierReader) ReadAt(p []byte, off int64) (int, error) {
+	atomic.StoreInt64(it.access, time.Now().Unix())
+	return it.Reader.ReadAt(p, off)
+}
+
+func (it *tierReader) Read(p []byte) (int, error) {
+	atomic.StoreInt64(it.access, time.Now().Unix())
+	return it.Reader.Read(p)
+}
+
+// tierMigrate moves the local table files not accessed since cutoff (unix
+// time in seconds) to the object storage, and returns the number of the
+// moved files.
+func (it *dirStorage) tierMigrate(cutoff int64) (int, error) {
+
+	if it.tier == nil {
+		return 0, nil
+	}
+
+	num := 0
+
+	for _, s := range it.tables {
+
+		ls, err := s.List(storage.TypeTable)
+		if err != nil {
+			return num, err
+		}
+
+		for _, fd := range ls {
+
+			if it.tier.has(fd.Num) || it.tier.accessed(fd.Num) >= cutoff {
+				continue
+			}
+
+			if err := it.tierUpload(s, fd); err != nil {
+				return num, err
+			}
+			num += 1
+		}
+	}
+
+	return num, nil
+}
+
+func (it *dirStorage) tierUpload(s storage.Storage, fd storage.FileDesc) error {
+
+	r, err := s.Open(fd)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = it.tier.store.Put(it.tier.objectName(fd.Num), r, size)
+	}
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	it.tier.mu.Lock()
+	defer it.tier.mu.Unlock()
+
+	// the file removed by a compaction during the upload
+	if r, err = s.Open(fd); err != nil {
+		it.tier.store.Delete(it.tier.objectName(fd.Num))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	r.Close()
+
+	it.tier.remote[fd.Num] = size
+	if err := it.tier.indexFlush(); err != nil {
+		delete(it.tier.remote, fd.Num)
+		return err
+	}
+
+	return s.Remove(fd)
+}
+
+// tierCheckpoint fetches the moved table files of the table directory
+// dirName listed in the index of src into dst.
+func tierCheckpoint(cfg *ConfigTiering, src, dirName, dst string) error {
+
+	remote, err := tierIndexGet(src)
+	if err != nil || len(remote) == 0 {
+		return err
+	}
+
+	if !cfg.enabled() {
+		return errors.New("the table files are moved to the object storage, but no tiering setup")
+	}
+
+	store := cfg.objectStore()
+
+	for num := range remote {
+		name := fmt.Sprintf("%06d.ldb", num)
+		if err := fileCopy(filepath.Join(cfg.CacheDirectory, dirName, name), filepath.Join(dst, name)); err == nil {
+			continue
+		}
+		if err := tierFetch(store, tierObjectName(cfg, dirName, num), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cn *Conn) workerTiering() {
+
+	for !cn.close {
+
+		time.Sleep(tierCheckInterval)
+
+		if cn.Maintenance() {
+			continue
+		}
+
+		cutoff := time.Now().Unix() - int64(cn.opts.Storage.Tiering.ColdDays)*86400
+
+		cn.mu.RLock()
+		tables := []*dbTable{}
+		for _, tdb := range cn.tables {
+			tables = append(tables, tdb)
+		}
+		cn.mu.RUnlock()
+
+		for _, tdb := range tables {
+			if tdb.stor == nil || cn.close {
+				continue
+			}
+			if num, err := tdb.stor.tierMigrate(cutoff); err != nil {
+				hlog.Printf("warn", "kvgo tiering table %s err %s", tdb.tableName, err.Error())
+			} else if num > 0 {
+				hlog.Printf("info", "kvgo tiering table %s, %d files moved", tdb.tableName, num)
+			}
+		}
+	}
+}
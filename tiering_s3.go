@@ -0,0 +1,180 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	tierS3Algorithm     = "AWS4-HMAC-SHA256"
+	tierS3UnsignedBody  = "UNSIGNED-PAYLOAD"
+	tierS3SignedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	tierS3Timeout       = 10 * time.Minute
+)
+
+// tierS3 is the object storage of the S3 compatible services, the objects
+// are addressed in the path style (Endpoint/Bucket/Key) and the requests
+// are signed by the AWS signature version 4.
+type tierS3 struct {
+	cfg    *ConfigTiering
+	client *http.Client
+}
+
+func newTierS3(cfg *ConfigTiering) *tierS3 {
+	return &tierS3{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: tierS3Timeout,
+		},
+	}
+}
+
+func (it *tierS3) Put(name string, r io.Reader, size int64) error {
+	rsp, err := it.do("PUT", name, r, size)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func (it *tierS3) Get(name string) (io.ReadCloser, error) {
+	rsp, err := it.do("GET", name, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Body, nil
+}
+
+func (it *tierS3) Delete(name string) error {
+	rsp, err := it.do("DELETE", name, nil, 0)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+func (it *tierS3) do(method, name string, body io.Reader, size int64) (*http.Response, error) {
+
+	u, err := url.Parse(strings.TrimRight(it.cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + it.cfg.Bucket + "/" + strings.TrimLeft(name, "/")
+	u.RawPath = tierS3PathEscape(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	if err := tierS3Sign(req, it.cfg, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	rsp, err := it.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode/100 != 2 {
+		bs, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		rsp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s status %d: %s", method, name, rsp.StatusCode, string(bs))
+	}
+
+	return rsp, nil
+}
+
+// tierS3Sign signs the request by the AWS signature version 4, the payload
+// is not signed, which is allowed by S3.
+func tierS3Sign(req *http.Request, cfg *ConfigTiering, tn time.Time) error {
+
+	var (
+		amzDate = tn.Format("20060102T150405Z")
+		day     = tn.Format("20060102")
+		region  = cfg.Region
+	)
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", tierS3UnsignedBody)
+
+	var (
+		scope     = day + "/" + region + "/s3/aws4_request"
+		canonical = strings.Join([]string{
+			req.Method,
+			tierS3PathEscape(req.URL.Path),
+			"",
+			"host:" + req.URL.Host,
+			"x-amz-content-sha256:" + tierS3UnsignedBody,
+			"x-amz-date:" + amzDate,
+			"",
+			tierS3SignedHeaders,
+			tierS3UnsignedBody,
+		}, "\n")
+		key = []byte("AWS4" + cfg.SecretKey)
+	)
+
+	hash, err := cryptoSum(crypto.SHA256, []byte(canonical))
+	if err != nil {
+		return err
+	}
+	strToSign := tierS3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash)
+
+	for _, v := range []string{day, region, "s3", "aws4_request", strToSign} {
+		if key, err = cryptoHmac(crypto.SHA256, key, []byte(v)); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		tierS3Algorithm, cfg.AccessKey, scope, tierS3SignedHeaders,
+		hex.EncodeToString(key)))
+
+	return nil
+}
+
+// tierS3PathEscape escapes the path by the URI encoding of the signature,
+// all bytes except the unreserved characters and the slash.
+func tierS3PathEscape(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
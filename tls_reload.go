@@ -0,0 +1,244 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// TLSStatus is the certificate of the rpc endpoint in use.
+type TLSStatus struct {
+	Subject  string `json:"subject"`
+	NotAfter int64  `json:"not_after"`
+	Loaded   int64  `json:"loaded"`
+	Reloads  int64  `json:"reloads"`
+}
+
+// tlsReloader serves the certificate of Server.AuthTLSCert to the new
+// handshakes, the certificate is reloaded when the files are changed
+// (e.g. rotated by cert-manager) or by TLSReload, the connections
+// established before are kept.
+type tlsReloader struct {
+	mu       sync.RWMutex
+	cfg      *ConfigTLSCertificate
+	cert     *tls.Certificate
+	certData []byte
+	keyData  []byte
+	status   TLSStatus
+}
+
+func newTLSReloader(cfg *ConfigTLSCertificate) (*tlsReloader, error) {
+
+	it := &tlsReloader{
+		cfg: cfg,
+	}
+
+	if _, err := it.reload(); err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+func (it *tlsReloader) watched() bool {
+	return it.cfg.ServerCertFile != "" || it.cfg.ServerKeyFile != ""
+}
+
+// load returns the pem of the files, or of the data if the files are not
+// setup.
+func (it *tlsReloader) load() ([]byte, []byte, error) {
+
+	var (
+		certData = []byte(it.cfg.ServerCertData)
+		keyData  = []byte(it.cfg.ServerKeyData)
+	)
+
+	if it.cfg.ServerCertFile != "" {
+		bs, err := ioutil.ReadFile(it.cfg.ServerCertFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		certData = []byte(strings.TrimSpace(string(bs)))
+	}
+
+	if it.cfg.ServerKeyFile != "" {
+		bs, err := ioutil.ReadFile(it.cfg.ServerKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyData = []byte(strings.TrimSpace(string(bs)))
+	}
+
+	return certData, keyData, nil
+}
+
+// reload loads the certificate again, and returns true if it is changed.
+// The certificate in use is kept if the new one is invalid, e.g. the cert
+// file is written but the key file is not yet.
+func (it *tlsReloader) reload() (bool, error) {
+
+	certData, keyData, err := it.load()
+	if err != nil {
+		return false, err
+	}
+
+	it.mu.RLock()
+	same := it.cert != nil &&
+		bytes.Equal(certData, it.certData) && bytes.Equal(keyData, it.keyData)
+	it.mu.RUnlock()
+
+	if same {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return false, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.cert != nil {
+		it.status.Reloads++
+	}
+
+	it.cert, it.certData, it.keyData = &cert, certData, keyData
+	it.status.Subject = leaf.Subject.String()
+	it.status.NotAfter = leaf.NotAfter.UnixNano() / 1e6
+	it.status.Loaded = time.Now().UnixNano() / 1e6
+
+	return true, nil
+}
+
+func (it *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return it.cert, nil
+}
+
+func (it *tlsReloader) config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: it.getCertificate,
+	}
+}
+
+func (it *tlsReloader) statusGet() *TLSStatus {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	status := it.status
+	return &status
+}
+
+func (cn *Conn) workerTLSReload() {
+
+	var (
+		interval = time.Duration(cn.opts.Server.AuthTLSCert.ReloadInterval) * time.Second
+		next     = time.Now().Add(interval)
+	)
+
+	for !cn.close {
+
+		time.Sleep(1e9)
+
+		if time.Now().Before(next) {
+			continue
+		}
+		next = next.Add(interval)
+
+		if ok, err := cn.tls.reload(); err != nil {
+			hlog.Printf("warn", "kvgo tls reload err %s", err.Error())
+		} else if ok {
+			hlog.Printf("info", "kvgo tls reloaded, %s", cn.tls.statusGet().Subject)
+		}
+	}
+}
+
+// TLSReload reloads the certificate of the rpc endpoint from the files of
+// Server.AuthTLSCert, the new certificate is served to the new connections
+// and the established ones are kept.
+func (cn *Conn) TLSReload() (*TLSStatus, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: "TLSReload",
+		})
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+
+		var status TLSStatus
+		if err := wireDecode(rs.DataValue().Bytes(), &status); err != nil {
+			return nil, err
+		}
+
+		return &status, nil
+	}
+
+	cn.mu.RLock()
+	tr := cn.tls
+	cn.mu.RUnlock()
+
+	if tr == nil {
+		return nil, errors.New("no server/auth_tls_cert setup")
+	}
+
+	if ok, err := tr.reload(); err != nil {
+		return nil, err
+	} else if ok {
+		hlog.Printf("info", "kvgo tls reloaded, %s", tr.statusGet().Subject)
+	}
+
+	return tr.statusGet(), nil
+}
+
+func (cn *Conn) tlsReloadCmdLocal(av appValidator) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	status, err := cn.TLSReload()
+	if err != nil {
+		return kv2.NewObjectResultClientError(err)
+	}
+
+	bs, err := json.Marshal(status)
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	triggerRefreshSleep = 200e6
+	triggerBatchNum     = 100
+	triggerHttpTimeout  = 10 * time.Second
+	triggerRetryMin     = time.Second
+	triggerRetryMax     = 60 * time.Second
+)
+
+// ChangeEvent is a change of a key read from the write log of a table.
+type ChangeEvent struct {
+	Table   string `json:"table"`
+	Key     []byte `json:"key"`
+	Version uint64 `json:"version"`
+	Updated uint64 `json:"updated"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Value   []byte `json:"value,omitempty"`
+	Expired uint64 `json:"expired,omitempty"`
+
+	item *kv2.ObjectItem
+}
+
+// TriggerFunc is called with the changes of the keys of a trigger, the
+// changes are delivered again if it returns an error.
+type TriggerFunc func(events []*ChangeEvent) error
+
+type trigger struct {
+	name    string
+	table   string
+	prefix  []byte
+	fn      TriggerFunc
+	batch   int
+	offset  uint64
+	loaded  bool
+	retry   time.Duration
+	retryAt time.Time
+}
+
+// TriggerRegister registers the trigger name fired after the commits of
+// the keys of the prefix in the table (in embedded mode, the servers
+// configure the triggers with webhook urls in Config.Triggers).
+//
+// The triggers tail the write log of the table, and the offset of the log
+// delivered is saved by name, so the changes are delivered at least once
+// in order of commits, even if the process restarts. Since the log keeps
+// the last version of every key, the successive changes of a key may be
+// delivered as its last change only. The changes are not delivered if the
+// write log is disabled.
+func (cn *Conn) TriggerRegister(name, tableName string, prefix []byte, fn TriggerFunc) error {
+
+	return cn.triggerRegister(&trigger{
+		name:   name,
+		table:  tableName,
+		prefix: bytesClone(prefix),
+		fn:     fn,
+	})
+}
+
+func (cn *Conn) triggerRegister(tr *trigger) error {
+
+	if !seqNameReg.MatchString(tr.name) {
+		return errors.New("invalid trigger name")
+	}
+
+	if tr.fn == nil {
+		return errors.New("no trigger func setup")
+	}
+
+	if cn.opts.ClientConnectEnable {
+		return errors.New("trigger not supported in client mode")
+	}
+
+	if tr.table == "" {
+		tr.table = "main"
+	}
+
+	if tr.batch < 1 || int64(tr.batch) > kv2.ObjectReaderLimitNumMax {
+		tr.batch = triggerBatchNum
+	}
+
+	cn.trigMu.Lock()
+	defer cn.trigMu.Unlock()
+
+	if cn.triggers == nil {
+		cn.triggers = map[string]*trigger{}
+	}
+
+	if _, ok := cn.triggers[tr.name]; ok {
+		return errors.New("trigger (" + tr.name + ") already registered")
+	}
+
+	cn.triggers[tr.name] = tr
+
+	return nil
+}
+
+// TriggerUnregister removes the trigger name, the saved offset is kept so
+// the trigger is resumed if it is registered again.
+func (cn *Conn) TriggerUnregister(name string) {
+	cn.trigMu.Lock()
+	defer cn.trigMu.Unlock()
+	delete(cn.triggers, name)
+}
+
+func triggerWebhook(url string) TriggerFunc {
+
+	client := &http.Client{
+		Timeout: triggerHttpTimeout,
+	}
+
+	return func(events []*ChangeEvent) error {
+
+		bs, err := json.Marshal(events)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(bs))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook status %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+func (cn *Conn) workerTrigger() {
+
+	for _, v := range cn.opts.Triggers {
+		if err := cn.TriggerRegister(v.Name, v.Table, []byte(v.Prefix),
+			triggerWebhook(v.Url)); err != nil {
+			hlog.Printf("warn", "kvgo trigger %s setup err %s", v.Name, err.Error())
+		}
+	}
+
+	for _, v := range cn.opts.Cluster.ReplicaToNodes {
+		if err := cn.replicaToSetup(v); err != nil {
+			hlog.Printf("warn", "kvgo replica-to %s setup err %s", v.Addr, err.Error())
+		}
+	}
+
+	for _, v := range cn.opts.Sinks {
+		if err := cn.sinkSetup(v); err != nil {
+			hlog.Printf("warn", "kvgo sink %s setup err %s", v.Name, err.Error())
+		}
+	}
+
+	for !cn.close {
+
+		time.Sleep(triggerRefreshSleep)
+
+		cn.trigMu.Lock()
+		ls := make([]*trigger, 0, len(cn.triggers))
+		for _, v := range cn.triggers {
+			ls = append(ls, v)
+		}
+		cn.trigMu.Unlock()
+
+		for _, tr := range ls {
+
+			if time.Now().Before(tr.retryAt) {
+				continue
+			}
+
+			// retry the failed deliveries with exponential backoff
+			if err := cn.triggerRefresh(tr); err != nil {
+				if tr.retry *= 2; tr.retry < triggerRetryMin {
+					tr.retry = triggerRetryMin
+				} else if tr.retry > triggerRetryMax {
+					tr.retry = triggerRetryMax
+				}
+				tr.retryAt = time.Now().Add(tr.retry)
+				hlog.Printf("warn", "kvgo trigger %s err %s, retry in %v",
+					tr.name, err.Error(), tr.retry)
+			} else {
+				tr.retry = 0
+			}
+		}
+	}
+}
+
+func (cn *Conn) triggerRefresh(tr *trigger) error {
+
+	tdb := cn.tabledb(tr.table)
+	if tdb == nil {
+		return errors.New("table not found")
+	}
+
+	if !tr.loaded {
+		if bs, err := tdb.db.Get(keySysTriggerOffset(tr.name), nil); err == nil {
+			if tr.offset, err = strconv.ParseUint(string(bs), 10, 64); err != nil {
+				return err
+			}
+		} else if err.Error() != ldbNotFound {
+			return err
+		}
+		tr.loaded = true
+	}
+
+	for !cn.close {
+
+		if tdb.logOffset <= tr.offset {
+			return nil
+		}
+
+		rr := kv2.NewObjectReader().
+			TableNameSet(tr.table).
+			LogOffsetSet(tr.offset).LimitNumSet(int64(tr.batch))
+
+		rs := cn.objectLocalQuery(rr)
+		if !rs.OK() {
+			return rs.Error()
+		}
+
+		if len(rs.Items) == 0 {
+			return nil
+		}
+
+		var (
+			events = []*ChangeEvent{}
+			offset = tr.offset
+		)
+
+		for _, item := range rs.Items {
+
+			if item.Meta == nil {
+				continue
+			}
+
+			if item.Meta.Version > offset {
+				offset = item.Meta.Version
+			}
+
+			if !bytes.HasPrefix(item.Meta.Key, tr.prefix) {
+				continue
+			}
+
+			ev := &ChangeEvent{
+				Table:   tr.table,
+				Key:     item.Meta.Key,
+				Version: item.Meta.Version,
+				Updated: item.Meta.Updated,
+				Deleted: kv2.AttrAllow(item.Meta.Attrs, kv2.ObjectMetaAttrDelete),
+				Expired: item.Meta.Expired,
+				item:    item,
+			}
+			if !ev.Deleted && item.Data != nil {
+				ev.Value = item.DataValue().Bytes()
+			}
+
+			events = append(events, ev)
+		}
+
+		if len(events) > 0 {
+			if err := tr.fn(events); err != nil {
+				return err
+			}
+		}
+
+		if offset > tr.offset {
+			if err := tdb.db.Put(keySysTriggerOffset(tr.name),
+				[]byte(strconv.FormatUint(offset, 10)), nil); err != nil {
+				return err
+			}
+			tr.offset = offset
+		}
+
+		if !rs.Next {
+			return nil
+		}
+	}
+
+	return nil
+}
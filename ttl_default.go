@@ -0,0 +1,51 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// ttlDefault returns the default TTL in milliseconds of the key of the
+// table, or 0 if no default matches.
+func (it *ConfigFeature) ttlDefault(table string, key []byte) int64 {
+	var hit *ConfigTtlDefault
+	for _, v := range it.TtlDefaults {
+		if v.Table != table || !bytes.HasPrefix(key, []byte(v.Prefix)) {
+			continue
+		}
+		if hit == nil || len(v.Prefix) > len(hit.Prefix) {
+			hit = v
+		}
+	}
+	if hit == nil {
+		return 0
+	}
+	return hit.Ttl
+}
+
+// ttlDefaultSet sets the default TTL of the new write without a TTL, the
+// writes replicated from other nodes keep their TTLs.
+func (cn *Conn) ttlDefaultSet(rr *kv2.ObjectWriter) {
+	if rr.Meta == nil || rr.Meta.Expired > 0 ||
+		kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeDelete) {
+		return
+	}
+	if ttl := cn.opts.Feature.ttlDefault(rr.TableName, rr.Meta.Key); ttl > 0 {
+		rr.Meta.Expired = uint64(cn.timeNow().UnixNano()/1e6 + ttl)
+	}
+}
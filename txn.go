@@ -0,0 +1,312 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	hauth "github.com/hooto/hauth/go/hauth/v1"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	txnWriteMax = 1000
+	txnTimeout  = 5 * time.Second
+)
+
+// ErrNotFound is returned by the reads of a transaction if the key does
+// not exist.
+var ErrNotFound = errors.New("not found")
+
+// Txn is a transaction of the server-side scripts and procedures, the
+// transactions of a server are serialized with all the commits of the
+// server, so the reads are repeatable and the writes are not interleaved
+// with other writes.
+//
+// The writes are buffered and committed in one batch when the transaction
+// returns without error, and discarded otherwise. The writes are checked as
+// the commits of the public service when they are buffered, and all of them
+// are checked again before the batch is written, so either all or none of
+// them are committed. The writes of a transaction must be in one table.
+type Txn struct {
+	db       *Conn
+	av       appValidator
+	ctx      context.Context
+	internal bool
+	table    string
+	writes   []*txnWrite
+	index    map[string]int
+}
+
+type txnWrite struct {
+	rr     *kv2.ObjectWriter
+	value  []byte
+	delete bool
+}
+
+func txnTable(tableName string) string {
+	if tableName == "" {
+		return "main"
+	}
+	return tableName
+}
+
+func txnKey(tableName string, key []byte) string {
+	return txnTable(tableName) + ":" + string(key)
+}
+
+// Context returns the context of the transaction, it is canceled after the
+// timeout of the transaction, the long running scripts and procedures
+// should stop on it.
+func (it *Txn) Context() context.Context {
+	return it.ctx
+}
+
+func (it *Txn) allow(perm, tableName string) error {
+	if it.av == nil {
+		return nil
+	}
+	tableName = txnTable(tableName)
+	if err := it.av.Allow(perm, hauth.NewScopeFilter(AuthScopeTable, tableName)); err != nil {
+		return fmt.Errorf("table (%s) %s", tableName, err.Error())
+	}
+	return nil
+}
+
+// Get returns the value of the key, the writes of the transaction are
+// visible to its reads.
+func (it *Txn) Get(tableName string, key []byte) ([]byte, error) {
+
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := it.allow(authPermTableRead, tableName); err != nil {
+		return nil, err
+	}
+
+	if i, ok := it.index[txnKey(tableName, key)]; ok {
+		if w := it.writes[i]; !w.delete {
+			return w.value, nil
+		}
+		return nil, ErrNotFound
+	}
+
+	rs := it.db.objectLocalQuery(kv2.NewObjectReader(key).TableNameSet(tableName))
+	if rs.NotFound() {
+		return nil, ErrNotFound
+	} else if !rs.OK() {
+		return nil, rs.Error()
+	}
+
+	return rs.DataValue().Bytes(), nil
+}
+
+// Put sets the value of the key.
+func (it *Txn) Put(tableName string, key, value []byte) error {
+	return it.write(&txnWrite{
+		rr:    kv2.NewObjectWriter(key, value).TableNameSet(tableName),
+		value: value,
+	})
+}
+
+// Delete deletes the key.
+func (it *Txn) Delete(tableName string, key []byte) error {
+	return it.write(&txnWrite{
+		rr: kv2.NewObjectWriter(key, nil).TableNameSet(tableName).
+			ModeDeleteSet(true),
+		delete: true,
+	})
+}
+
+func (it *Txn) write(w *txnWrite) error {
+
+	if err := it.ctx.Err(); err != nil {
+		return err
+	}
+
+	rr := w.rr
+
+	if err := it.allow(authPermTableWrite, rr.TableName); err != nil {
+		return err
+	}
+
+	// the sys table is written only by the sys/all permission, as the
+	// commits of the public service
+	if it.av != nil && rr.TableName == "sys" && it.av.Allow(authPermSysAll) != nil {
+		return fmt.Errorf("table (%s) access denied", txnTable(rr.TableName))
+	}
+
+	// the internal keys are written only by the transactions of kvgo
+	if keyInternal(rr.Meta.Key) && !it.internal {
+		return errKeyInternal
+	}
+
+	if err := rr.CommitValid(); err != nil {
+		return err
+	}
+
+	if it.table != "" && it.table != txnTable(rr.TableName) {
+		return errors.New("the writes of a transaction must be in one table")
+	}
+
+	if it.db.tabledb(rr.TableName) == nil {
+		return errors.New("table not found")
+	}
+
+	if err := it.db.tenantQuotaCheck(rr); err != nil {
+		return err
+	}
+	it.db.ttlDefaultSet(rr)
+
+	meta, err := it.db.objectMetaGet(rr)
+	if meta == nil && err != nil {
+		return err
+	}
+	if err := it.db.immutableCheck(rr, meta); err != nil {
+		return err
+	}
+
+	k := txnKey(rr.TableName, rr.Meta.Key)
+	if i, ok := it.index[k]; ok {
+		it.writes[i] = w
+		return nil
+	}
+
+	if len(it.writes) >= txnWriteMax {
+		return errors.New("too many writes in transaction")
+	}
+
+	it.table = txnTable(rr.TableName)
+	it.index[k] = len(it.writes)
+	it.writes = append(it.writes, w)
+
+	return nil
+}
+
+// txnLock locks the commits of all keys.
+func (cn *Conn) txnLock() {
+	for i := range cn.commitMus {
+		cn.commitMus[i].Lock()
+	}
+}
+
+func (cn *Conn) txnUnlock() {
+	for i := len(cn.commitMus) - 1; i >= 0; i-- {
+		cn.commitMus[i].Unlock()
+	}
+}
+
+// txnLocal runs fn in a transaction of the local server.
+func (cn *Conn) txnLocal(av appValidator, fn func(tx *Txn) error) error {
+	return cn.txnRun(av, false, fn)
+}
+
+// txnInternal runs fn in a transaction of kvgo, which may write the keys of
+// keyInternalPrefix.
+func (cn *Conn) txnInternal(av appValidator, fn func(tx *Txn) error) error {
+	return cn.txnRun(av, true, fn)
+}
+
+func (cn *Conn) txnRun(av appValidator, internal bool, fn func(tx *Txn) error) error {
+
+	if len(cn.opts.Cluster.MainNodes) > 0 {
+		return errors.New("transaction not supported in cluster mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), txnTimeout)
+	defer cancel()
+
+	tx := &Txn{
+		db:       cn,
+		av:       av,
+		ctx:      ctx,
+		internal: internal,
+		index:    map[string]int{},
+	}
+
+	cn.txnLock()
+	defer cn.txnUnlock()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return cn.txnCommit(tx)
+}
+
+// txnCommit writes the buffered writes of the transaction in one batch,
+// with the commit locks of all keys held. The writes are checked again by
+// the commits of the batch, nothing is written if one of them fails.
+func (cn *Conn) txnCommit(tx *Txn) error {
+
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	tdb := cn.tabledb(tx.table)
+	if tdb == nil {
+		return errors.New("table not found")
+	}
+
+	var (
+		batch = new(leveldb.Batch)
+		dones []func(err error)
+		rss   = make([]*kv2.ObjectResult, len(tx.writes))
+		// the batch is synced if any of the keys is of a durable policy
+		key = tx.writes[0].rr.Meta.Key
+	)
+
+	for i, w := range tx.writes {
+		rs, done := cn.commitLockedBatch(batch, w.rr, 0, false)
+		if !rs.OK() {
+			return rs.Error()
+		}
+		if done != nil {
+			dones = append(dones, done)
+		}
+		if cn.opts.Cluster.replicationPolicy(tdb.tableName, w.rr.Meta.Key).durable() {
+			key = w.rr.Meta.Key
+		}
+		rss[i] = rs
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	err := cn.dbWriteObject(tdb, key, batch, false)
+	for _, done := range dones {
+		done(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, w := range tx.writes {
+		cn.usageWrite(w.rr, rss[i])
+	}
+
+	return nil
+}
@@ -0,0 +1,374 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hooto/hlog4g/hlog"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	UsageReportCsv  = "csv"
+	UsageReportJson = "json"
+)
+
+// TableUsage is the usage of a table, and of its tenant if Tenant is set,
+// on the node from Start to End in milliseconds. Reads and Writes are the
+// requests served, BytesRead and BytesWritten the bytes of the keys and
+// the values transferred, and BytesStored the size of the table on disk
+// at End.
+type TableUsage struct {
+	Table        string `json:"table"`
+	Tenant       string `json:"tenant,omitempty"`
+	Start        int64  `json:"start"`
+	End          int64  `json:"end"`
+	Reads        int64  `json:"reads"`
+	Writes       int64  `json:"writes"`
+	BytesRead    int64  `json:"bytes_read"`
+	BytesWritten int64  `json:"bytes_written"`
+	BytesStored  int64  `json:"bytes_stored"`
+}
+
+type tableUsageCounter struct {
+	reads        int64
+	writes       int64
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// tableUsageStatus keeps the counters of the tables since the node was
+// opened, and the counters at the start of the current report period.
+type tableUsageStatus struct {
+	mu     sync.RWMutex
+	tables map[string]*tableUsageCounter
+	start  int64
+	last   map[string]tableUsageCounter
+}
+
+func (it *tableUsageStatus) counter(table string) *tableUsageCounter {
+
+	if table == "" {
+		table = "main"
+	}
+
+	it.mu.RLock()
+	c := it.tables[table]
+	it.mu.RUnlock()
+
+	if c != nil {
+		return c
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.tables == nil {
+		it.tables = map[string]*tableUsageCounter{}
+	}
+	if c = it.tables[table]; c == nil {
+		c = &tableUsageCounter{}
+		it.tables[table] = c
+	}
+
+	return c
+}
+
+func (it *tableUsageCounter) load() tableUsageCounter {
+	return tableUsageCounter{
+		reads:        atomic.LoadInt64(&it.reads),
+		writes:       atomic.LoadInt64(&it.writes),
+		bytesRead:    atomic.LoadInt64(&it.bytesRead),
+		bytesWritten: atomic.LoadInt64(&it.bytesWritten),
+	}
+}
+
+// usageRead counts the read request and the bytes of the items read.
+func (cn *Conn) usageRead(rr *kv2.ObjectReader, rs *kv2.ObjectResult) *kv2.ObjectResult {
+
+	c := cn.usage.counter(rr.TableName)
+	atomic.AddInt64(&c.reads, 1)
+
+	if rs != nil {
+		var n int64
+		for _, item := range rs.Items {
+			if item.Meta != nil {
+				n += int64(len(item.Meta.Key))
+			}
+			if item.Data != nil {
+				n += int64(len(item.Data.Value))
+			}
+		}
+		if n > 0 {
+			atomic.AddInt64(&c.bytesRead, n)
+		}
+	}
+
+	return rs
+}
+
+// usageWrite counts the write request, and the bytes of the key and the
+// value if it is committed.
+func (cn *Conn) usageWrite(rr *kv2.ObjectWriter, rs *kv2.ObjectResult) *kv2.ObjectResult {
+
+	c := cn.usage.counter(rr.TableName)
+	atomic.AddInt64(&c.writes, 1)
+
+	if rs != nil && rs.OK() {
+		var n int64
+		if rr.Meta != nil {
+			n += int64(len(rr.Meta.Key))
+		}
+		if rr.Data != nil {
+			n += int64(len(rr.Data.Value))
+		}
+		atomic.AddInt64(&c.bytesWritten, n)
+	}
+
+	return rs
+}
+
+// TableUsages returns the usages of the tables on the node in the current
+// report period, which starts when the node is opened and restarts after
+// each usage report of Tenant.UsageReportInterval.
+func (cn *Conn) TableUsages() ([]*TableUsage, error) {
+
+	if cn.opts.ClientConnectEnable {
+
+		rs := cn.SysCmd(&kv2.SysCmdRequest{
+			Method: "TableUsages",
+		})
+		if !rs.OK() {
+			return nil, rs.Error()
+		}
+
+		var ls []*TableUsage
+		if len(rs.Items) > 0 {
+			if err := wireDecode(rs.DataValue().Bytes(), &ls); err != nil {
+				return nil, err
+			}
+		}
+
+		return ls, nil
+	}
+
+	return cn.tableUsages(false), nil
+}
+
+func (cn *Conn) tableUsagesCmdLocal(av appValidator) *kv2.ObjectResult {
+
+	if av != nil {
+		if err := av.Allow(authPermSysAll); err != nil {
+			return kv2.NewObjectResultAccessDenied(err.Error())
+		}
+	}
+
+	bs, err := json.Marshal(cn.tableUsages(false))
+	if err != nil {
+		return kv2.NewObjectResultServerError(err)
+	}
+
+	return sysCmdResultBytes(bs)
+}
+
+func (cn *Conn) tableUsages(restart bool) []*TableUsage {
+
+	var (
+		end    = time.Now().UnixNano() / 1e6
+		tables = map[string]bool{}
+		ls     = []*TableUsage{}
+	)
+
+	cn.mu.RLock()
+	for name, tdb := range cn.tables {
+		if tdb.db != nil && name != sysTableName {
+			tables[name] = true
+		}
+	}
+	cn.mu.RUnlock()
+
+	cn.usage.mu.Lock()
+
+	for name := range cn.usage.tables {
+		if name != sysTableName {
+			tables[name] = true
+		}
+	}
+
+	if cn.usage.start == 0 {
+		cn.usage.start = cn.uptime * 1e3
+	}
+
+	last := map[string]tableUsageCounter{}
+
+	for name := range tables {
+
+		var (
+			u = &TableUsage{
+				Table: name,
+				Start: cn.usage.start,
+				End:   end,
+			}
+			cur tableUsageCounter
+		)
+
+		if c := cn.usage.tables[name]; c != nil {
+			cur = c.load()
+		}
+		prev := cn.usage.last[name]
+		last[name] = cur
+
+		u.Reads = cur.reads - prev.reads
+		u.Writes = cur.writes - prev.writes
+		u.BytesRead = cur.bytesRead - prev.bytesRead
+		u.BytesWritten = cur.bytesWritten - prev.bytesWritten
+
+		ls = append(ls, u)
+	}
+
+	if restart {
+		cn.usage.start, cn.usage.last = end, last
+	}
+
+	cn.usage.mu.Unlock()
+
+	cn.tenants.mu.RLock()
+	for _, u := range ls {
+		if t := cn.tenants.tables[u.Table]; t != nil {
+			u.Tenant = t.tenant.Name
+		}
+	}
+	cn.tenants.mu.RUnlock()
+
+	for _, u := range ls {
+		if tdb := cn.tabledb(u.Table); tdb != nil {
+			var st leveldb.DBStats
+			if err := tdb.db.Stats(&st); err == nil {
+				u.BytesStored = st.LevelSizes.Sum()
+			}
+		}
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Table < ls[j].Table
+	})
+
+	return ls
+}
+
+// usageReportEncode encodes the usages in the format, the csv has a header
+// of the json names of the fields.
+func usageReportEncode(format string, ls []*TableUsage) ([]byte, error) {
+
+	if format == UsageReportJson {
+		return json.MarshalIndent(ls, "", "  ")
+	}
+
+	var (
+		buf bytes.Buffer
+		w   = csv.NewWriter(&buf)
+		i64 = func(v int64) string {
+			return strconv.FormatInt(v, 10)
+		}
+	)
+
+	w.Write([]string{"table", "tenant", "start", "end", "reads", "writes",
+		"bytes_read", "bytes_written", "bytes_stored"})
+
+	for _, u := range ls {
+		w.Write([]string{u.Table, u.Tenant, i64(u.Start), i64(u.End),
+			i64(u.Reads), i64(u.Writes), i64(u.BytesRead), i64(u.BytesWritten), i64(u.BytesStored)})
+	}
+
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// usageReport writes the usages of the report period into the file
+// usage-{end time}.{format} of the directory, and restarts the period.
+func (cn *Conn) usageReport() (string, error) {
+
+	var (
+		cfg = &cn.opts.Tenant
+		ls  = cn.tableUsages(true)
+	)
+
+	bs, err := usageReportEncode(cfg.UsageReportFormat, ls)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(cfg.UsageReportDirectory, 0750); err != nil {
+		return "", err
+	}
+
+	var end int64
+	if len(ls) > 0 {
+		end = ls[0].End
+	} else {
+		end = time.Now().UnixNano() / 1e6
+	}
+
+	var (
+		name = fmt.Sprintf("usage-%s.%s",
+			time.Unix(0, end*1e6).UTC().Format("20060102T150405Z"), cfg.UsageReportFormat)
+		path = filepath.Join(cfg.UsageReportDirectory, name)
+	)
+
+	if err := ioutil.WriteFile(path+".tmp", bs, 0640); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(path+".tmp", path)
+}
+
+func (cn *Conn) workerUsageReport() {
+
+	var (
+		interval = time.Duration(cn.opts.Tenant.UsageReportInterval) * time.Second
+		next     = time.Now().Add(interval)
+	)
+
+	for !cn.close {
+
+		time.Sleep(1e9)
+
+		if time.Now().Before(next) {
+			continue
+		}
+		next = next.Add(interval)
+
+		if path, err := cn.usageReport(); err != nil {
+			hlog.Printf("warn", "kvgo usage report err %s", err.Error())
+		} else {
+			hlog.Printf("info", "kvgo usage report %s", path)
+		}
+	}
+}
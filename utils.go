@@ -23,10 +23,15 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	mrand "math/rand"
 	"time"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
 )
 
 func debugPrint(args ...interface{}) {
@@ -41,6 +46,34 @@ func keyEncode(ns byte, key []byte) []byte {
 	return append([]byte{ns}, key...)
 }
 
+// keyPrefixLimit returns the least key greater than all the keys prefixed
+// by prefix, unlike prefix + 0xff it also covers the keys of the prefix
+// followed by 0xff bytes.
+func keyPrefixLimit(prefix []byte) []byte {
+	return util.BytesPrefix(prefix).Limit
+}
+
+// keyInternalEncode returns the key of the internal entries (such as the
+// blobs of PutCAS) stored in the key space of the tables, the keys of
+// keyInternalPrefix are reserved and written by kvgo only, the writes of
+// them by the public APIs and the rpcs fail with errKeyInternal, so they
+// never collide with the keys of the clients, and are hidden from the range
+// queries, see SystemScan.
+func keyInternalEncode(key string) []byte {
+	return append([]byte(keyInternalPrefix), key...)
+}
+
+func keyInternal(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(keyInternalPrefix))
+}
+
+// errKeyInternal is returned by the public writes of the reserved keys.
+var errKeyInternal = errors.New("keys of the reserved prefix can not be written")
+
+func keyInternalWrite(rr *kv2.ObjectWriter) bool {
+	return rr != nil && rr.Meta != nil && keyInternal(rr.Meta.Key)
+}
+
 func bytesClone(src []byte) []byte {
 
 	dst := make([]byte, len(src))
@@ -84,7 +117,7 @@ func randHexString(length int) string {
 	}
 
 	bs := make([]byte, length)
-	if _, err := crand.Read(bs); err != nil {
+	if err := cryptoRandRead(bs); err != nil {
 		for i := range bs {
 			bs[i] = uint8(mrand.Intn(256))
 		}
@@ -0,0 +1,306 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+const (
+	valueCryptMagic   byte = 0xe5
+	valueCryptKeySize      = 32
+	valueCryptNonce        = 12
+	valueCryptTag          = 16
+
+	// magic, key id, nonce and sealed data key, nonce of the value
+	valueCryptHeader = 2 + valueCryptNonce + valueCryptKeySize + valueCryptTag + valueCryptNonce
+)
+
+// ConfigClientEncryption encrypts the values of the client before they are
+// sent, so the servers only hold the ciphertexts, see ValueEncryptor. The
+// merges, the scripts and the other server side operations on the values
+// of the tables do not work on the ciphertexts.
+type ConfigClientEncryption struct {
+	// The keys of the encryption, the keys of the old values are kept
+	// after the ActiveKey is changed
+	Keys []*ConfigEncryptionKey `toml:"keys" json:"keys"`
+
+	// The id of the key of the new values
+	ActiveKey int `toml:"active_key" json:"active_key"`
+
+	// The tables of the values encrypted, all tables if empty
+	Tables []string `toml:"tables" json:"tables"`
+}
+
+// ConfigEncryptionKey is an AES-256 key in 64 hex digits and its id in 0 ~ 255.
+type ConfigEncryptionKey struct {
+	Id  int    `toml:"id" json:"id"`
+	Key string `toml:"key" json:"key"`
+}
+
+func (it *ConfigClientEncryption) Valid() error {
+	_, err := it.encryptor()
+	return err
+}
+
+func (it *ConfigClientEncryption) encryptor() (*ValueEncryptor, error) {
+	keys, active, err := it.keys()
+	if err != nil {
+		return nil, err
+	}
+	return NewValueEncryptor(keys, active)
+}
+
+func (it *ConfigClientEncryption) keys() (map[uint8][]byte, uint8, error) {
+
+	keys := map[uint8][]byte{}
+
+	for _, v := range it.Keys {
+		if v.Id < 0 || v.Id > 255 {
+			return nil, 0, errors.New("invalid client_encryption/keys/id")
+		}
+		bs, err := hex.DecodeString(v.Key)
+		if err != nil || len(bs) != valueCryptKeySize {
+			return nil, 0, errors.New("invalid client_encryption/keys/key, 64 hex digits required")
+		}
+		keys[uint8(v.Id)] = bs
+	}
+
+	if it.ActiveKey < 0 || it.ActiveKey > 255 {
+		return nil, 0, errors.New("invalid client_encryption/active_key")
+	}
+
+	return keys, uint8(it.ActiveKey), nil
+}
+
+// ValueEncryptor encrypts the values by the envelope encryption, a value is
+// encrypted by a random data key in AES-256-GCM, and the data key by the
+// active key, the id of which is in the header byte after the magic byte,
+// so the values of the old keys are still decrypted after the active key
+// is changed. The object key is the additional data of the encryption, so
+// a ciphertext copied to another key is not decrypted.
+type ValueEncryptor struct {
+	mu     sync.RWMutex
+	keys   map[uint8]cipher.AEAD
+	active uint8
+}
+
+func valueCryptAead(key []byte) (cipher.AEAD, error) {
+	return cryptoProvider().NewAEAD(key)
+}
+
+// NewValueEncryptor returns the encryptor of the AES-256 keys of the ids,
+// the new values are encrypted by the key of the active id.
+func NewValueEncryptor(keys map[uint8][]byte, active uint8) (*ValueEncryptor, error) {
+
+	it := &ValueEncryptor{}
+	if err := it.reset(keys, active); err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// reset replaces the keys, e.g. the keys refreshed from the secret store.
+func (it *ValueEncryptor) reset(keys map[uint8][]byte, active uint8) error {
+
+	aeads := map[uint8]cipher.AEAD{}
+
+	for id, key := range keys {
+		if len(key) != valueCryptKeySize {
+			return fmt.Errorf("invalid size of the key %d", id)
+		}
+		aead, err := valueCryptAead(key)
+		if err != nil {
+			return err
+		}
+		aeads[id] = aead
+	}
+
+	if _, ok := aeads[active]; !ok {
+		return fmt.Errorf("active key %d not found", active)
+	}
+
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	it.keys, it.active = aeads, active
+
+	return nil
+}
+
+// Encrypted returns true if the value is a ciphertext of a known key.
+func (it *ValueEncryptor) Encrypted(bs []byte) bool {
+	if len(bs) < valueCryptHeader+valueCryptTag || bs[0] != valueCryptMagic {
+		return false
+	}
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	_, ok := it.keys[bs[1]]
+	return ok
+}
+
+// Encrypt returns the ciphertext of the value, ad is the additional data
+// which is required by Decrypt, e.g. the key of the object.
+func (it *ValueEncryptor) Encrypt(value, ad []byte) ([]byte, error) {
+
+	it.mu.RLock()
+	kek, active := it.keys[it.active], it.active
+	it.mu.RUnlock()
+
+	var (
+		dek = make([]byte, valueCryptKeySize)
+		bs  = make([]byte, 2+valueCryptNonce, valueCryptHeader+len(value)+valueCryptTag)
+	)
+
+	bs[0], bs[1] = valueCryptMagic, active
+
+	if err := cryptoRandRead(dek); err != nil {
+		return nil, err
+	}
+	if err := cryptoRandRead(bs[2 : 2+valueCryptNonce]); err != nil {
+		return nil, err
+	}
+	bs = kek.Seal(bs, bs[2:2+valueCryptNonce], dek, bs[:2])
+
+	aead, err := valueCryptAead(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, valueCryptNonce)
+	if err := cryptoRandRead(nonce); err != nil {
+		return nil, err
+	}
+	bs = append(bs, nonce...)
+
+	return aead.Seal(bs, nonce, value, ad), nil
+}
+
+// Decrypt returns the value of the ciphertext of Encrypt.
+func (it *ValueEncryptor) Decrypt(bs, ad []byte) ([]byte, error) {
+
+	if len(bs) < valueCryptHeader+valueCryptTag || bs[0] != valueCryptMagic {
+		return nil, errors.New("invalid encrypted value")
+	}
+
+	it.mu.RLock()
+	kek, ok := it.keys[bs[1]]
+	it.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("encryption key %d not found", bs[1])
+	}
+
+	var (
+		n     = 2 + valueCryptNonce + valueCryptKeySize + valueCryptTag
+		nonce = bs[n : n+valueCryptNonce]
+	)
+
+	dek, err := kek.Open(nil, bs[2:2+valueCryptNonce], bs[2+valueCryptNonce:n], bs[:2])
+	if err != nil {
+		return nil, errors.New("invalid encrypted value, data key not decrypted")
+	}
+
+	aead, err := valueCryptAead(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := aead.Open(nil, nonce, bs[valueCryptHeader:], ad)
+	if err != nil {
+		return nil, errors.New("invalid encrypted value")
+	}
+
+	return value, nil
+}
+
+func (cn *Conn) valueCryptTable(table string) bool {
+
+	if cn.valueCrypt == nil || table == sysTableName {
+		return false
+	}
+
+	if len(cn.opts.ClientEncryption.Tables) == 0 {
+		return true
+	}
+
+	if table == "" {
+		table = "main"
+	}
+
+	for _, v := range cn.opts.ClientEncryption.Tables {
+		if v == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// valueEncrypt encrypts the value of the write of the encrypted tables for
+// the send, every value is encrypted even if it looks like a ciphertext.
+// The returned func restores the value of the caller after the send, so a
+// retry of the write encrypts the plaintext again, not the ciphertext.
+func (cn *Conn) valueEncrypt(rr *kv2.ObjectWriter) (func(), error) {
+
+	if !cn.valueCryptTable(rr.TableName) || rr.Meta == nil ||
+		rr.Data == nil || len(rr.Data.Value) == 0 ||
+		kv2.AttrAllow(rr.Mode, kv2.ObjectWriterModeDelete) {
+		return func() {}, nil
+	}
+
+	bs, err := cn.valueCrypt.Encrypt(rr.Data.Value, rr.Meta.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	value := rr.Data.Value
+	rr.Data.Value = bs
+
+	return func() { rr.Data.Value = value }, nil
+}
+
+// valueDecrypt decrypts the values of the items of the encrypted tables,
+// the values not encrypted (e.g. the ones written before the encryption is
+// setup) are kept.
+func (cn *Conn) valueDecrypt(table string, rs *kv2.ObjectResult) *kv2.ObjectResult {
+
+	if rs == nil || !cn.valueCryptTable(table) {
+		return rs
+	}
+
+	for _, item := range rs.Items {
+
+		if item.Meta == nil || item.Data == nil ||
+			!cn.valueCrypt.Encrypted(item.Data.Value) {
+			continue
+		}
+
+		value, err := cn.valueCrypt.Decrypt(item.Data.Value, item.Meta.Key)
+		if err != nil {
+			return kv2.NewObjectResultClientError(fmt.Errorf("key %q, %s",
+				item.Meta.Key, err.Error()))
+		}
+		item.Data.Value = value
+	}
+
+	return rs
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+	"sync"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+var valueRefPool = sync.Pool{
+	New: func() interface{} {
+		return &ValueRef{}
+	},
+}
+
+// ValueRef holds the encoded object of a key read by GetRef (embedded mode
+// only), the ValueRefs are pooled, so the ValueRef and its bytes must not be
+// used after Release.
+type ValueRef struct {
+	bs   []byte
+	live bool
+}
+
+// GetRef returns a ValueRef of the key in the table, or an error with
+// leveldb.ErrNotFound if the key does not exist. The key is read as the
+// key queries do, through the value cache, with the pending merge operands
+// applied and the corrupted blocks repaired from the peers, but without the
+// result and the decoding of the item.
+func (cn *Conn) GetRef(tableName string, key []byte) (*ValueRef, error) {
+
+	if cn.opts.ClientConnectEnable {
+		return nil, errors.New("value ref is only supported in embedded mode")
+	}
+
+	tdb := cn.tabledb(tableName)
+	if tdb == nil {
+		return nil, errors.New("table not found")
+	}
+
+	bs, err := cn.valueGet(tdb, nsKeyData, key)
+	bs, err = cn.mergeValueGet(tdb, key, bs, err)
+
+	if err != nil && errCorrupted(err) {
+		if item, err2 := cn.corruptionRead(tdb, key, err); err2 == nil {
+			bs, err = kv2.StdProto.Encode(item)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cn.hotKeys.touch(tdb.tableName, key)
+
+	ref := valueRefPool.Get().(*ValueRef)
+	ref.bs, ref.live = bs, true
+
+	return ref, nil
+}
+
+// Bytes returns the encoded object, which may be shared with the value
+// cache and must not be modified.
+func (it *ValueRef) Bytes() []byte {
+	return it.bs
+}
+
+// Item decodes the object.
+func (it *ValueRef) Item() (*kv2.ObjectItem, error) {
+	if !it.live {
+		return nil, errors.New("value ref released")
+	}
+	return kv2.ObjectItemDecode(it.bs)
+}
+
+// Release returns the ValueRef to the pool, the later calls are no-ops.
+func (it *ValueRef) Release() {
+	if !it.live {
+		return
+	}
+	it.bs, it.live = nil, false
+	valueRefPool.Put(it)
+}
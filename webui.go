@@ -0,0 +1,470 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+)
+
+const (
+	webUIKeyLimitDef   = 50
+	webUIKeyLimitMax   = 1000
+	webUIValuePreview  = 256
+	webUIRequestHeader = "X-Kvgo-Request"
+)
+
+type webUIKeyItem struct {
+	Key     string `json:"key"`
+	KeyHex  string `json:"key_hex"`
+	Value   string `json:"value"`
+	Size    int    `json:"size"`
+	Version uint64 `json:"version"`
+	Updated int64  `json:"updated"`
+	Expired uint64 `json:"expired,omitempty"`
+}
+
+type webUITableMetrics struct {
+	IORead         uint64  `json:"io_read"`
+	IOWrite        uint64  `json:"io_write"`
+	Size           int64   `json:"size"`
+	WriteDelay     int32   `json:"write_delay"`
+	WritePaused    bool    `json:"write_paused"`
+	AliveSnapshots int32   `json:"alive_snapshots"`
+	LogSize        int64   `json:"log_size"`
+	L0Tables       int     `json:"l0_tables"`
+	PendingCompact int64   `json:"pending_compaction"`
+	WriteAmp       float64 `json:"write_amp"`
+
+	// the requests and the bytes transferred since the node was opened
+	Reads        int64 `json:"reads"`
+	Writes       int64 `json:"writes"`
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+type webUIMetrics struct {
+	Time       int64                         `json:"time"`
+	Goroutines int                           `json:"goroutines"`
+	HeapAlloc  uint64                        `json:"heap_alloc"`
+	Tables     map[string]*webUITableMetrics `json:"tables"`
+	Replicas   []*ReplicaLag                 `json:"replicas,omitempty"`
+
+	// the average read latency in microseconds and the compaction throttle
+	// of Performance.CompactionReadLatencySLO
+	ReadLatency         int64 `json:"read_latency,omitempty"`
+	CompactionThrottled bool  `json:"compaction_throttled,omitempty"`
+
+	// the corrupted reads and the quarantined table files, see Corruptions
+	Corruptions     int64 `json:"corruptions,omitempty"`
+	CorruptionFiles int   `json:"corruption_files,omitempty"`
+}
+
+// webUIText returns the bytes as a string if it is valid utf-8, or else as
+// a hex string.
+func webUIText(bs []byte) string {
+	if utf8.Valid(bs) {
+		return string(bs)
+	}
+	return "0x" + hex.EncodeToString(bs)
+}
+
+func webUIJson(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		v = map[string]string{"error": err.Error()}
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// webUIHandle registers the handlers of the web admin ui, the pages are
+// served under /ui/ and the json apis under /ui/api/.
+func (cn *Conn) webUIHandle(mux *http.ServeMux) {
+	mux.HandleFunc("/", cn.httpAuth(cn.webUIIndex))
+	mux.HandleFunc("/ui/", cn.httpAuth(cn.webUIIndex))
+	mux.HandleFunc("/ui/api/tables", cn.httpAuth(cn.webUITables))
+	mux.HandleFunc("/ui/api/keys", cn.httpAuth(cn.webUIKeys))
+	mux.HandleFunc("/ui/api/metrics", cn.httpAuth(cn.webUIMetrics))
+	mux.HandleFunc("/ui/api/backup", cn.httpAuth(cn.webUIBackup))
+}
+
+func (cn *Conn) webUIIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(webUIPage))
+}
+
+func (cn *Conn) webUITables(w http.ResponseWriter, r *http.Request) {
+	cn.mu.RLock()
+	ls := []string{}
+	for name := range cn.tables {
+		ls = append(ls, name)
+	}
+	cn.mu.RUnlock()
+	sort.Strings(ls)
+	webUIJson(w, ls, nil)
+}
+
+// webUIKeys returns the keys of the prefix after the offset (the last key
+// of the previous page, in hex).
+func (cn *Conn) webUIKeys(w http.ResponseWriter, r *http.Request) {
+
+	var (
+		q      = r.URL.Query()
+		prefix = []byte(q.Get("prefix"))
+		offset = prefix
+		cutset = bytesClone(prefix)
+		limit  = int64(webUIKeyLimitDef)
+	)
+
+	if v := q.Get("offset"); v != "" {
+		bs, err := hex.DecodeString(v)
+		if err != nil {
+			webUIJson(w, nil, errors.New("invalid offset"))
+			return
+		}
+		offset = bs
+	}
+
+	if v, err := strconv.ParseInt(q.Get("limit"), 10, 64); err == nil && v > 0 {
+		if limit = v; limit > webUIKeyLimitMax {
+			limit = webUIKeyLimitMax
+		}
+	}
+
+	rs := cn.NewReader(nil).TableNameSet(q.Get("table")).
+		KeyRangeSet(offset, cutset).LimitNumSet(limit).Query()
+	if !rs.OK() && !rs.NotFound() {
+		webUIJson(w, nil, rs.Error())
+		return
+	}
+
+	ls := []*webUIKeyItem{}
+	for _, item := range rs.Items {
+		if item.Meta == nil {
+			continue
+		}
+		var (
+			value = item.DataValue().Bytes()
+			size  = len(value)
+		)
+		if len(value) > webUIValuePreview {
+			value = value[:webUIValuePreview]
+		}
+		ls = append(ls, &webUIKeyItem{
+			Key:     webUIText(item.Meta.Key),
+			KeyHex:  hex.EncodeToString(item.Meta.Key),
+			Value:   webUIText(value),
+			Size:    size,
+			Version: item.Meta.Version,
+			Updated: VersionTime(item.Meta.Version).UnixNano() / 1e6,
+			Expired: item.Meta.Expired,
+		})
+	}
+
+	webUIJson(w, ls, nil)
+}
+
+func (cn *Conn) webUIMetrics(w http.ResponseWriter, r *http.Request) {
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	ret := &webUIMetrics{
+		Time:       time.Now().UnixNano() / 1e6,
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  ms.HeapAlloc,
+		Tables:     map[string]*webUITableMetrics{},
+		Replicas:   cn.ReplicationLags(),
+
+		ReadLatency:         cn.compactionPacer.Latency(),
+		CompactionThrottled: cn.compactionPacer.Throttled(),
+	}
+
+	if n, ls := cn.Corruptions(); n > 0 {
+		ret.Corruptions, ret.CorruptionFiles = n, len(ls)
+	}
+
+	cn.mu.RLock()
+	for name, tdb := range cn.tables {
+		if tdb.db == nil {
+			continue
+		}
+		var st leveldb.DBStats
+		if err := tdb.db.Stats(&st); err != nil {
+			continue
+		}
+		ts := tableStatsBuild(name, &st)
+		ret.Tables[name] = &webUITableMetrics{
+			IORead:         st.IORead,
+			IOWrite:        st.IOWrite,
+			Size:           st.LevelSizes.Sum(),
+			WriteDelay:     st.WriteDelayCount,
+			WritePaused:    st.WritePaused,
+			AliveSnapshots: st.AliveSnapshots,
+			LogSize:        tdb.logSize(),
+			PendingCompact: ts.PendingCompaction,
+			WriteAmp:       ts.WriteAmp,
+		}
+		if len(st.LevelTablesCounts) > 0 {
+			ret.Tables[name].L0Tables = st.LevelTablesCounts[0]
+		}
+		c := cn.usage.counter(name).load()
+		ret.Tables[name].Reads, ret.Tables[name].Writes = c.reads, c.writes
+		ret.Tables[name].BytesRead, ret.Tables[name].BytesWritten = c.bytesRead, c.bytesWritten
+	}
+	cn.mu.RUnlock()
+
+	webUIJson(w, ret, nil)
+}
+
+// webUIBackup starts a backup into the directory, the requests must be
+// posted by the page (with the webUIRequestHeader) so the backup can not be
+// triggered by the links or forms of the other sites.
+func (cn *Conn) webUIBackup(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost || r.Header.Get(webUIRequestHeader) == "" {
+		webUIJson(w, nil, errors.New("invalid request"))
+		return
+	}
+
+	var req struct {
+		Directory   string `json:"directory"`
+		Incremental bool   `json:"incremental"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		webUIJson(w, nil, err)
+		return
+	}
+	if req.Directory == "" {
+		webUIJson(w, nil, errors.New("no directory setup"))
+		return
+	}
+
+	mf, err := cn.Backup(req.Directory, req.Incremental)
+	webUIJson(w, mf, err)
+}
+
+const webUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kvgo admin</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 16px; }
+nav a { margin-right: 16px; cursor: pointer; color: #06c; }
+section { display: none; margin-top: 16px; }
+section.active { display: block; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.value { max-width: 480px; word-break: break-all; font-family: monospace; }
+.up { color: #080; }
+.down { color: #c00; }
+.err { color: #c00; }
+canvas { border: 1px solid #ccc; margin: 4px 8px 4px 0; }
+</style>
+</head>
+<body>
+<h3>kvgo admin</h3>
+<nav>
+<a data-page="status">Status</a>
+<a data-page="keys">Keys</a>
+<a data-page="metrics">Metrics</a>
+<a data-page="backup">Backup</a>
+</nav>
+
+<section id="status">
+<table id="status-nodes"></table>
+</section>
+
+<section id="keys">
+<select id="keys-table"></select>
+<input id="keys-prefix" placeholder="prefix">
+<button id="keys-search">Search</button>
+<button id="keys-next">Next</button>
+<span id="keys-err" class="err"></span>
+<table id="keys-list"></table>
+</section>
+
+<section id="metrics">
+<div><canvas id="chart-heap" width="360" height="120"></canvas>
+<canvas id="chart-goroutines" width="360" height="120"></canvas></div>
+<div><canvas id="chart-read" width="360" height="120"></canvas>
+<canvas id="chart-write" width="360" height="120"></canvas></div>
+<table id="metrics-tables"></table>
+</section>
+
+<section id="backup">
+<input id="backup-dir" placeholder="directory" size="40">
+<label><input id="backup-incr" type="checkbox"> incremental</label>
+<button id="backup-run">Start Backup</button>
+<pre id="backup-result"></pre>
+</section>
+
+<script>
+var page = "status", samples = [], keysOffset = "";
+
+function $(id) { return document.getElementById(id); }
+
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, function(c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+  });
+}
+
+function api(path, opts) {
+  return fetch(path, opts).then(function(r) {
+    return r.json().then(function(v) {
+      if (!r.ok) { throw new Error(v.error || r.statusText); }
+      return v;
+    });
+  });
+}
+
+function rows(el, head, ls) {
+  var h = "<tr>" + head.map(function(v) { return "<th>" + v + "</th>"; }).join("") + "</tr>";
+  ls.forEach(function(r) {
+    h += "<tr>" + r.map(function(v) { return "<td>" + v + "</td>"; }).join("") + "</tr>";
+  });
+  $(el).innerHTML = h;
+}
+
+function show(p) {
+  page = p;
+  document.querySelectorAll("section").forEach(function(el) {
+    el.className = el.id == p ? "active" : "";
+  });
+  refresh();
+}
+
+function refresh() {
+  if (page == "status") {
+    api("/status.json").then(function(v) {
+      rows("status-nodes", ["Addr", "Role", "Health", "Lag (ms)", "Tables", "Version", "Uptime (s)", "Message"],
+        v.nodes.map(function(n) {
+          return [esc(n.addr) + (n.removed ? " (removed)" : ""), esc(n.role),
+            "<span class=\"" + esc(n.health) + "\">" + esc(n.health) + "</span>",
+            n.lag_time, esc((n.tables || []).join(", ")), esc(n.version || ""),
+            n.uptime || "", esc(n.message || "")];
+        }));
+    });
+  }
+}
+
+function keysLoad(next) {
+  if (!next) { keysOffset = ""; }
+  var q = "table=" + encodeURIComponent($("keys-table").value) +
+    "&prefix=" + encodeURIComponent($("keys-prefix").value) +
+    "&offset=" + keysOffset;
+  api("/ui/api/keys?" + q).then(function(ls) {
+    $("keys-err").textContent = "";
+    if (ls.length > 0) { keysOffset = ls[ls.length - 1].key_hex; }
+    rows("keys-list", ["Key", "Value", "Size", "Updated", "Expired"], ls.map(function(v) {
+      return [esc(v.key), "<div class=\"value\">" + esc(v.value) + "</div>", v.size,
+        new Date(v.updated).toISOString(), v.expired ? new Date(v.expired).toISOString() : ""];
+    }));
+  }).catch(function(e) { $("keys-err").textContent = e.message; });
+}
+
+function chart(id, title, fn) {
+  var c = $(id), ctx = c.getContext("2d"), ls = [];
+  for (var i = 1; i < samples.length; i++) { ls.push(fn(samples[i], samples[i - 1])); }
+  var max = Math.max.apply(null, ls.concat([1]));
+  ctx.clearRect(0, 0, c.width, c.height);
+  ctx.fillText(title + " " + (ls.length ? ls[ls.length - 1].toFixed(1) : ""), 4, 12);
+  ctx.beginPath();
+  ls.forEach(function(v, i) {
+    var x = c.width * i / 59, y = c.height - 4 - (c.height - 20) * v / max;
+    if (i == 0) { ctx.moveTo(x, y); } else { ctx.lineTo(x, y); }
+  });
+  ctx.strokeStyle = "#06c";
+  ctx.stroke();
+}
+
+function sum(m, k) {
+  var n = 0;
+  for (var t in m.tables) { n += m.tables[t][k]; }
+  return n;
+}
+
+function metricsLoad() {
+  api("/ui/api/metrics").then(function(m) {
+    samples.push(m);
+    if (samples.length > 61) { samples.shift(); }
+    if (page != "metrics") { return; }
+    chart("chart-heap", "heap (MiB)", function(m) { return m.heap_alloc / 1048576; });
+    chart("chart-goroutines", "goroutines", function(m) { return m.goroutines; });
+    chart("chart-read", "io read (KiB/s)", function(m, p) {
+      return (sum(m, "io_read") - sum(p, "io_read")) / 1.024 / (m.time - p.time);
+    });
+    chart("chart-write", "io write (KiB/s)", function(m, p) {
+      return (sum(m, "io_write") - sum(p, "io_write")) / 1.024 / (m.time - p.time);
+    });
+    var ls = [];
+    for (var t in m.tables) {
+      var v = m.tables[t];
+      ls.push([esc(t), (v.size / 1048576).toFixed(1), v.l0_tables, (v.pending_compaction / 1048576).toFixed(1),
+        v.write_amp.toFixed(1), v.write_delay, v.write_paused, v.alive_snapshots]);
+    }
+    rows("metrics-tables", ["Table", "Size (MiB)", "L0 Tables", "Pending Compaction (MiB)", "Write Amp",
+      "Write Delays", "Write Paused", "Snapshots"], ls);
+  });
+}
+
+document.querySelectorAll("nav a").forEach(function(el) {
+  el.onclick = function() { show(el.getAttribute("data-page")); };
+});
+
+$("keys-search").onclick = function() { keysLoad(false); };
+$("keys-next").onclick = function() { keysLoad(true); };
+
+$("backup-run").onclick = function() {
+  $("backup-result").textContent = "running ...";
+  api("/ui/api/backup", {
+    method: "POST",
+    headers: {"Content-Type": "application/json", "X-Kvgo-Request": "1"},
+    body: JSON.stringify({directory: $("backup-dir").value, incremental: $("backup-incr").checked})
+  }).then(function(v) {
+    $("backup-result").textContent = "backup " + v.id + " done, " + (v.files || []).length + " files";
+  }).catch(function(e) { $("backup-result").textContent = "error: " + e.message; });
+};
+
+api("/ui/api/tables").then(function(ls) {
+  $("keys-table").innerHTML = ls.map(function(v) {
+    return "<option>" + esc(v) + "</option>";
+  }).join("");
+});
+
+show("status");
+setInterval(refresh, 10000);
+setInterval(metricsLoad, 2000);
+metricsLoad();
+</script>
+</body>
+</html>
+`
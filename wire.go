@@ -0,0 +1,51 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"encoding/json"
+)
+
+// The wire format of kvgo is frozen as follows, the changes must keep both
+// older clients and older nodes of a rolling upgrade working:
+//
+//   - the object requests and results are the protobuf messages of kvspec v2,
+//     whose fields are addressed by their tag numbers, so renaming a field is
+//     safe but a tag number must never be reused or change its type, and the
+//     fields unknown to an older peer are skipped by the protobuf decoder.
+//
+//   - the bodies of the SysCmd requests and results are JSON objects, whose
+//     fields are addressed by the names of their json tags. A tag name must
+//     never be renamed or change its type, the new fields must be optional
+//     (omitempty, and the zero value keeps the old behavior), and the fields
+//     unknown to the receiver are ignored. An empty body is the same as {}.
+//     The []byte fields are base64 strings and the uint64 fields are JSON
+//     numbers, which is exact for the HLC versions of kvgo.
+//
+//   - the behaviors that an older peer can not understand are enabled only if
+//     the peer lists the feature in its handshake (see HandshakeInfo), never
+//     by the protocol version alone.
+//
+// The golden payloads of the tests pin the encoding, a test failure there
+// means a break of the compatibility, not an outdated test.
+
+// wireDecode decodes the JSON body of a SysCmd into v, the unknown fields are
+// ignored and the empty body leaves v unchanged.
+func wireDecode(bs []byte, v interface{}) error {
+	if len(bs) == 0 {
+		return nil
+	}
+	return json.Unmarshal(bs, v)
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Eryx <evorui аt gmаil dοt cοm>, All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvgo
+
+import (
+	"errors"
+
+	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
+)
+
+// A witness is a main node that votes in the quorums of the writes but
+// stores no data, e.g. the third node of a cluster of two data centers, so
+// the cluster keeps accepting the writes if one of the data centers is
+// down without a third copy of the data.
+//
+// The witness only keeps the log versions of the proposals to order them,
+// and a write must still be accepted by at least one data node, or by more
+// if the quorum can not be reached by the witnesses, so every committed
+// write is on a data node. The witnesses serve no queries and are skipped
+// by the clients and by the log pulls.
+
+var errWitnessNoData = errors.New("witness node serves no data")
+
+func (it *ClientConfig) witness() bool {
+	return it != nil && it.Witness
+}
+
+// dataNodes returns the nodes without the witnesses.
+func dataNodes(nodes []*ClientConfig) []*ClientConfig {
+	ls := []*ClientConfig{}
+	for _, v := range nodes {
+		if !v.witness() {
+			ls = append(ls, v)
+		}
+	}
+	return ls
+}
+
+// witnessDataQuorum returns the number of the data nodes that must accept
+// a write of the quorum nQuo of the nodes.
+func witnessDataQuorum(nodes []*ClientConfig, nQuo int) int {
+	n := nQuo - (len(nodes) - len(dataNodes(nodes)))
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// dataQuorum returns the data nodes and the least number of them that
+// accept the writes of the table.
+func (cn *Conn) dataQuorum(table string) ([]*ClientConfig, int) {
+	nodes := cn.mainNodes()
+	return dataNodes(nodes),
+		witnessDataQuorum(nodes, cn.opts.Cluster.sessionQuorum(table, len(nodes)))
+}
+
+// nodeWitness returns whether the local node is a witness.
+func (cn *Conn) nodeWitness() bool {
+	for _, v := range cn.mainNodes() {
+		if v.Addr == cn.opts.Server.Bind {
+			return v.witness()
+		}
+	}
+	return false
+}
+
+// witnessPrepare votes for the proposal with the next log version of the
+// table, the versions are from the hybrid logical clock so they keep
+// increasing after a restart.
+func (it *InternalServiceImpl) witnessPrepare(or *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
+
+	it.proposalMu.Lock()
+	defer it.proposalMu.Unlock()
+
+	tn := uint64(it.db.timeNow().UnixNano() / 1e6)
+
+	if p, ok := it.prepares[string(or.Meta.Key)]; ok && (p.ProposalExpired+objAcceptTTL) > tn {
+		return nil, errors.New("deny")
+	}
+
+	if it.witnessVersions == nil {
+		it.witnessVersions = map[string]uint64{}
+	}
+
+	version := it.witnessVersions[or.TableName] + 1
+	if hv := hlcNow(); hv > version {
+		version = hv
+	}
+	it.witnessVersions[or.TableName] = version
+
+	or.ProposalExpired = tn + objAcceptTTL
+	it.prepares[string(or.Meta.Key)] = or
+
+	rs := kv2.NewObjectResultOK()
+	rs.Meta = &kv2.ObjectMeta{
+		Version: version,
+		IncrId:  or.Meta.IncrId,
+	}
+	return rs, nil
+}
+
+func (it *InternalServiceImpl) witnessAccept(rr2 *kv2.ObjectWriter) (*kv2.ObjectResult, error) {
+
+	it.proposalMu.Lock()
+	defer it.proposalMu.Unlock()
+
+	if rr2.Meta == nil {
+		return nil, errors.New("invalid request")
+	}
+
+	tn := uint64(it.db.timeNow().UnixNano() / 1e6)
+
+	rr, ok := it.prepares[string(rr2.Meta.Key)]
+	if !ok || (rr.ProposalExpired+objAcceptTTL) < tn {
+		return nil, errors.New("deny")
+	}
+
+	if it.witnessVersions[rr.TableName] < rr2.Meta.Version {
+		it.witnessVersions[rr.TableName] = rr2.Meta.Version
+	}
+
+	delete(it.prepares, string(rr2.Meta.Key))
+
+	rs := kv2.NewObjectResultOK()
+	rs.Meta = &kv2.ObjectMeta{
+		Version: rr2.Meta.Version,
+		IncrId:  rr2.Meta.IncrId,
+	}
+	return rs, nil
+}
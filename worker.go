@@ -23,8 +23,8 @@ import (
 	"time"
 
 	"github.com/hooto/hlog4g/hlog"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb"
+	"github.com/lynkdb/kvgo/internal/goleveldb/leveldb/util"
 
 	kv2 "github.com/lynkdb/kvspec/go/kvspec/v2"
 )
@@ -50,6 +50,16 @@ func (cn *Conn) workerLocal() {
 			hlog.Printf("warn", "local table refresh err %s", err.Error())
 		}
 
+		if err := cn.workerLocalMergeRefresh(); err != nil {
+			hlog.Printf("warn", "local merge refresh err %s", err.Error())
+		}
+
+		if err := cn.workerLocalHistoryRefresh(); err != nil {
+			hlog.Printf("warn", "local history refresh err %s", err.Error())
+		}
+
+		cn.workerEpochSync()
+
 		time.Sleep(workerLocalExpireSleep)
 	}
 }
@@ -91,6 +101,7 @@ func (cn *Conn) workerLocalExpiredRefreshTable(dt *dbTable) error {
 		var (
 			num   = 0
 			batch = new(leveldb.Batch)
+			dels  = [][]byte{}
 		)
 
 		for iter.Next() {
@@ -100,21 +111,22 @@ func (cn *Conn) workerLocalExpiredRefreshTable(dt *dbTable) error {
 				return err
 			}
 
-			data, err := dt.db.Get(keyEncode(nsKeyMeta, meta.Key), nil)
-			if err == nil {
+			cmeta, err := dt.objectMetaRead(meta.Key, cn.opts.Feature.WriteMetaDisable)
+			if err != nil {
+				return err
+			}
 
-				cmeta, err := kv2.ObjectMetaDecode(data)
-				if err == nil && cmeta.Version == meta.Version {
-					batch.Delete(keyEncode(nsKeyMeta, meta.Key))
-					batch.Delete(keyEncode(nsKeyData, meta.Key))
-					batch.Delete(keyEncode(nsKeyLog, uint64ToBytes(meta.Version)))
+			if cmeta != nil && cmeta.Version == meta.Version {
+				if err := cn.historyArchive(dt, batch, meta.Key, cmeta, 0); err != nil {
+					return err
 				}
-
-			} else if err.Error() != ldbNotFound {
-				return err
+				batch.Delete(keyEncode(nsKeyMeta, meta.Key))
+				batch.Delete(keyEncode(nsKeyData, meta.Key))
+				batch.Delete(keyEncode(nsKeyLog, uint64ToBytes(meta.Version)))
 			}
 
 			batch.Delete(keyExpireEncode(nsKeyTtl, meta.Expired, meta.Key))
+			dels = append(dels, meta.Key)
 			num += 1
 
 			if num >= workerLocalExpireLimit {
@@ -127,7 +139,10 @@ func (cn *Conn) workerLocalExpiredRefreshTable(dt *dbTable) error {
 		}
 
 		if num > 0 {
-			dt.db.Write(batch, nil)
+			cn.dbWrite(dt, batch)
+			for _, k := range dels {
+				cn.valueCacheDel(dt, k)
+			}
 		}
 
 		if num < workerLocalExpireLimit {
@@ -154,7 +169,7 @@ func (cn *Conn) workerLocalTableRefresh() error {
 	}
 	rgK := &util.Range{
 		Start: keyEncode(nsKeyMeta, []byte{}),
-		Limit: keyEncode(nsKeyMeta, []byte{0xff}),
+		Limit: []byte{nsKeyMeta + 1},
 	}
 	rgIncr := &util.Range{
 		Start: keySysIncrCutset(""),
@@ -167,14 +182,20 @@ func (cn *Conn) workerLocalTableRefresh() error {
 
 	if cn.opts.Feature.WriteMetaDisable {
 		rgK.Start = keyEncode(nsKeyData, []byte{})
-		rgK.Limit = keyEncode(nsKeyData, []byte{0xff})
+		rgK.Limit = []byte{nsKeyData + 1}
 	}
 
 	for _, t := range cn.tables {
 
-		if err := cn.workerLocalLogCleanTable(t); err != nil {
-			hlog.Printf("warn", "worker log clean table %s, err %s",
-				t.tableName, err.Error())
+		if !cn.Maintenance() {
+			if err := cn.workerLocalLogCleanTable(t); err != nil {
+				hlog.Printf("warn", "worker log clean table %s, err %s",
+					t.tableName, err.Error())
+			}
+			if err := cn.logRetentionTable(t); err != nil {
+				hlog.Printf("warn", "worker log retention table %s, err %s",
+					t.tableName, err.Error())
+			}
 		}
 
 		// db size
@@ -208,6 +229,18 @@ func (cn *Conn) workerLocalTableRefresh() error {
 			}
 		}
 
+		// log size and the offset of the compacted deletes
+		tableStatus.Options["log_size"] = t.logSize()
+		if compacted, err := t.logCompacted(); err == nil && compacted > 0 {
+			tableStatus.Options["log_compacted"] = int64(compacted)
+		}
+
+		// the estimated bytes of the pending compactions
+		var st leveldb.DBStats
+		if err := t.db.Stats(&st); err == nil {
+			tableStatus.Options["pending_compaction"] = tableStatsBuild(t.tableName, &st).PendingCompaction
+		}
+
 		// incr
 		iterIncr := t.db.NewIterator(rgIncr, nil)
 		for iterIncr.Next() {
@@ -278,13 +311,13 @@ func (cn *Conn) workerLocalReplicaOfLogAsync() error {
 
 	ups := map[string]bool{}
 
-	for _, hp := range cn.opts.Cluster.MainNodes {
+	for _, hp := range cn.mainNodes() {
 
 		if cn.close {
 			break
 		}
 
-		if hp.Addr == cn.opts.Server.Bind {
+		if hp.Addr == cn.opts.Server.Bind || hp.witness() || cn.nodeWitness() {
 			continue
 		}
 
@@ -312,7 +345,7 @@ func (cn *Conn) workerLocalReplicaOfLogAsync() error {
 		ups[hp.Addr] = true
 	}
 
-	for _, hp := range cn.opts.Cluster.ReplicaOfNodes {
+	for _, hp := range cn.replicaOfNodes() {
 
 		if cn.close {
 			break
@@ -379,13 +412,17 @@ func (cn *Conn) workerLocalReplicaOfLogAsyncTable(hp *ClientConfig, tm *ConfigRe
 		if err.Error() != ldbNotFound {
 			return err
 		}
+		// a new replica copies the snapshot of the upstream first
+		if offset, err = cn.replicaBootstrap(hp, tm, dt); err != nil {
+			return err
+		}
 	} else {
 		if offset, err = strconv.ParseUint(string(bs), 10, 64); err != nil {
 			return err
 		}
 	}
 
-	conn, err := clientConn(hp.Addr, hp.AccessKey, hp.AuthTLSCert, false)
+	conn, err := clientConn(hp.Addr, hp.AccessKey, hp.RequestSign, hp.AuthTLSCert, hp.Keepalive, false)
 	if err != nil {
 		return err
 	}
@@ -419,11 +456,22 @@ func (cn *Conn) workerLocalReplicaOfLogAsyncTable(hp *ClientConfig, tm *ConfigRe
 			}
 
 			time.Sleep(1e9)
-			conn, err = clientConn(hp.Addr, hp.AccessKey, hp.AuthTLSCert, true)
+			conn, err = clientConn(hp.Addr, hp.AccessKey, hp.RequestSign, hp.AuthTLSCert, hp.Keepalive, true)
 			continue
 		}
 		retry = 0
 
+		// the deletes after the offset were removed from the log of the
+		// upstream, the snapshot of the table is copied by the next pull
+		if !rs.OK() && logCompactedError(rs.Message) {
+			hlog.Printf("warn", "kvgo log async from %s/%s, %s, bootstrap from the snapshot",
+				hp.Addr, tm.From, rs.Message)
+			if err := dt.db.Delete(keySysLogAsync(hp.Addr, tm.From), nil); err != nil {
+				return err
+			}
+			break
+		}
+
 		for _, item := range rs.Items {
 
 			ow := &kv2.ObjectWriter{
@@ -502,13 +550,11 @@ func (cn *Conn) workerLocalLogCleanTable(tdb *dbTable) error {
 
 				if _, ok := sets[string(logMeta.Key)]; !ok {
 
-					if bs, err := tdb.db.Get(keyEncode(nsKeyMeta, logMeta.Key), nil); err == nil {
-						meta, err := kv2.ObjectMetaDecode(bs)
-						if err == nil && meta.Version > 0 && meta.Version != logMeta.Version {
-							batch.Delete(iter.Key())
-							ndel += 1
-							continue
-						}
+					meta, err := tdb.objectMetaRead(logMeta.Key, cn.opts.Feature.WriteMetaDisable)
+					if err == nil && meta != nil && meta.Version > 0 && meta.Version != logMeta.Version {
+						batch.Delete(iter.Key())
+						ndel += 1
+						continue
 					}
 
 					sets[string(logMeta.Key)] = logMeta.Version
@@ -521,7 +567,7 @@ func (cn *Conn) workerLocalLogCleanTable(tdb *dbTable) error {
 		ndel += 1
 
 		if ndel >= 1000 {
-			tdb.db.Write(batch, nil)
+			cn.dbWrite(tdb, batch)
 			batch = new(leveldb.Batch)
 			ndel = 0
 			hlog.Printf("info", "table %s, log clean %d/%d", tdb.tableName, ndel, len(sets))
@@ -529,7 +575,7 @@ func (cn *Conn) workerLocalLogCleanTable(tdb *dbTable) error {
 	}
 
 	if ndel > 0 {
-		tdb.db.Write(batch, nil)
+		cn.dbWrite(tdb, batch)
 		hlog.Printf("info", "table %s, log clean %d/%d", tdb.tableName, ndel, len(sets))
 	}
 